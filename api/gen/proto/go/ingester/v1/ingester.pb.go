@@ -8,8 +8,8 @@ package ingesterv1
 
 import (
 	_ "github.com/grafana/phlare/api/gen/proto/go/google/v1"
-	v11 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
-	v1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	v1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	v11 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
 	reflect "reflect"
@@ -23,6 +23,258 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type StacktraceGranularity int32
+
+const (
+	// Stacktraces nodes are keyed by function name.
+	StacktraceGranularity_STACKTRACE_GRANULARITY_FUNCTION StacktraceGranularity = 0
+	// Stacktraces nodes are keyed by function name and line number.
+	StacktraceGranularity_STACKTRACE_GRANULARITY_LINE StacktraceGranularity = 1
+)
+
+// Enum value maps for StacktraceGranularity.
+var (
+	StacktraceGranularity_name = map[int32]string{
+		0: "STACKTRACE_GRANULARITY_FUNCTION",
+		1: "STACKTRACE_GRANULARITY_LINE",
+	}
+	StacktraceGranularity_value = map[string]int32{
+		"STACKTRACE_GRANULARITY_FUNCTION": 0,
+		"STACKTRACE_GRANULARITY_LINE":     1,
+	}
+)
+
+func (x StacktraceGranularity) Enum() *StacktraceGranularity {
+	p := new(StacktraceGranularity)
+	*p = x
+	return p
+}
+
+func (x StacktraceGranularity) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (StacktraceGranularity) Descriptor() protoreflect.EnumDescriptor {
+	return file_ingester_v1_ingester_proto_enumTypes[0].Descriptor()
+}
+
+func (StacktraceGranularity) Type() protoreflect.EnumType {
+	return &file_ingester_v1_ingester_proto_enumTypes[0]
+}
+
+func (x StacktraceGranularity) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use StacktraceGranularity.Descriptor instead.
+func (StacktraceGranularity) EnumDescriptor() ([]byte, []int) {
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{0}
+}
+
+type PointsAggregation int32
+
+const (
+	// The values of the points of a bucket are summed up.
+	PointsAggregation_POINTS_AGGREGATION_SUM PointsAggregation = 0
+	// The maximum value of the points of a bucket is kept.
+	PointsAggregation_POINTS_AGGREGATION_MAX PointsAggregation = 1
+)
+
+// Enum value maps for PointsAggregation.
+var (
+	PointsAggregation_name = map[int32]string{
+		0: "POINTS_AGGREGATION_SUM",
+		1: "POINTS_AGGREGATION_MAX",
+	}
+	PointsAggregation_value = map[string]int32{
+		"POINTS_AGGREGATION_SUM": 0,
+		"POINTS_AGGREGATION_MAX": 1,
+	}
+)
+
+func (x PointsAggregation) Enum() *PointsAggregation {
+	p := new(PointsAggregation)
+	*p = x
+	return p
+}
+
+func (x PointsAggregation) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (PointsAggregation) Descriptor() protoreflect.EnumDescriptor {
+	return file_ingester_v1_ingester_proto_enumTypes[1].Descriptor()
+}
+
+func (PointsAggregation) Type() protoreflect.EnumType {
+	return &file_ingester_v1_ingester_proto_enumTypes[1]
+}
+
+func (x PointsAggregation) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use PointsAggregation.Descriptor instead.
+func (PointsAggregation) EnumDescriptor() ([]byte, []int) {
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{1}
+}
+
+// PushStreamRequest is a batch of profiles pushed on the stream.
+type PushStreamRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// series are the raw pprof profiles of the batch and their labels.
+	Series []*v1.RawProfileSeries `protobuf:"bytes,1,rep,name=series,proto3" json:"series,omitempty"`
+}
+
+func (x *PushStreamRequest) Reset() {
+	*x = PushStreamRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ingester_v1_ingester_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PushStreamRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushStreamRequest) ProtoMessage() {}
+
+func (x *PushStreamRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ingester_v1_ingester_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushStreamRequest.ProtoReflect.Descriptor instead.
+func (*PushStreamRequest) Descriptor() ([]byte, []int) {
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PushStreamRequest) GetSeries() []*v1.RawProfileSeries {
+	if x != nil {
+		return x.Series
+	}
+	return nil
+}
+
+// PushStreamResponse acknowledges the profiles of a batch.
+type PushStreamResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// acks of the profiles, in the order of the samples of the series of the batch.
+	Acks []*PushAck `protobuf:"bytes,1,rep,name=acks,proto3" json:"acks,omitempty"`
+}
+
+func (x *PushStreamResponse) Reset() {
+	*x = PushStreamResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ingester_v1_ingester_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PushStreamResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushStreamResponse) ProtoMessage() {}
+
+func (x *PushStreamResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_ingester_v1_ingester_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushStreamResponse.ProtoReflect.Descriptor instead.
+func (*PushStreamResponse) Descriptor() ([]byte, []int) {
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PushStreamResponse) GetAcks() []*PushAck {
+	if x != nil {
+		return x.Acks
+	}
+	return nil
+}
+
+// PushAck acknowledges a single profile.
+type PushAck struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// ID of the profile.
+	ID string `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	// error is set, if the profile was rejected. The other profiles of the batch are ingested regardless.
+	Error string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *PushAck) Reset() {
+	*x = PushAck{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ingester_v1_ingester_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PushAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushAck) ProtoMessage() {}
+
+func (x *PushAck) ProtoReflect() protoreflect.Message {
+	mi := &file_ingester_v1_ingester_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushAck.ProtoReflect.Descriptor instead.
+func (*PushAck) Descriptor() ([]byte, []int) {
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PushAck) GetID() string {
+	if x != nil {
+		return x.ID
+	}
+	return ""
+}
+
+func (x *PushAck) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
 type LabelValuesRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -34,7 +286,7 @@ type LabelValuesRequest struct {
 func (x *LabelValuesRequest) Reset() {
 	*x = LabelValuesRequest{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[0]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[3]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -47,7 +299,7 @@ func (x *LabelValuesRequest) String() string {
 func (*LabelValuesRequest) ProtoMessage() {}
 
 func (x *LabelValuesRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[0]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[3]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -60,7 +312,7 @@ func (x *LabelValuesRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use LabelValuesRequest.ProtoReflect.Descriptor instead.
 func (*LabelValuesRequest) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{0}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *LabelValuesRequest) GetName() string {
@@ -81,7 +333,7 @@ type LabelValuesResponse struct {
 func (x *LabelValuesResponse) Reset() {
 	*x = LabelValuesResponse{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[1]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -94,7 +346,7 @@ func (x *LabelValuesResponse) String() string {
 func (*LabelValuesResponse) ProtoMessage() {}
 
 func (x *LabelValuesResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[1]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -107,7 +359,7 @@ func (x *LabelValuesResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use LabelValuesResponse.ProtoReflect.Descriptor instead.
 func (*LabelValuesResponse) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{1}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *LabelValuesResponse) GetNames() []string {
@@ -126,7 +378,7 @@ type LabelNamesRequest struct {
 func (x *LabelNamesRequest) Reset() {
 	*x = LabelNamesRequest{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[2]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[5]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -139,7 +391,7 @@ func (x *LabelNamesRequest) String() string {
 func (*LabelNamesRequest) ProtoMessage() {}
 
 func (x *LabelNamesRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[2]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[5]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -152,7 +404,7 @@ func (x *LabelNamesRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use LabelNamesRequest.ProtoReflect.Descriptor instead.
 func (*LabelNamesRequest) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{2}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{5}
 }
 
 type LabelNamesResponse struct {
@@ -166,7 +418,7 @@ type LabelNamesResponse struct {
 func (x *LabelNamesResponse) Reset() {
 	*x = LabelNamesResponse{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[3]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[6]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -179,7 +431,7 @@ func (x *LabelNamesResponse) String() string {
 func (*LabelNamesResponse) ProtoMessage() {}
 
 func (x *LabelNamesResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[3]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[6]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -192,7 +444,7 @@ func (x *LabelNamesResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use LabelNamesResponse.ProtoReflect.Descriptor instead.
 func (*LabelNamesResponse) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{3}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *LabelNamesResponse) GetNames() []string {
@@ -211,7 +463,7 @@ type ProfileTypesRequest struct {
 func (x *ProfileTypesRequest) Reset() {
 	*x = ProfileTypesRequest{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[4]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[7]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -224,7 +476,7 @@ func (x *ProfileTypesRequest) String() string {
 func (*ProfileTypesRequest) ProtoMessage() {}
 
 func (x *ProfileTypesRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[4]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[7]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -237,7 +489,7 @@ func (x *ProfileTypesRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ProfileTypesRequest.ProtoReflect.Descriptor instead.
 func (*ProfileTypesRequest) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{4}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{7}
 }
 
 type ProfileTypesResponse struct {
@@ -245,13 +497,13 @@ type ProfileTypesResponse struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	ProfileTypes []*v1.ProfileType `protobuf:"bytes,1,rep,name=profile_types,json=profileTypes,proto3" json:"profile_types,omitempty"`
+	ProfileTypes []*v11.ProfileType `protobuf:"bytes,1,rep,name=profile_types,json=profileTypes,proto3" json:"profile_types,omitempty"`
 }
 
 func (x *ProfileTypesResponse) Reset() {
 	*x = ProfileTypesResponse{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[5]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[8]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -264,7 +516,7 @@ func (x *ProfileTypesResponse) String() string {
 func (*ProfileTypesResponse) ProtoMessage() {}
 
 func (x *ProfileTypesResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[5]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[8]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -277,10 +529,10 @@ func (x *ProfileTypesResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ProfileTypesResponse.ProtoReflect.Descriptor instead.
 func (*ProfileTypesResponse) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{5}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{8}
 }
 
-func (x *ProfileTypesResponse) GetProfileTypes() []*v1.ProfileType {
+func (x *ProfileTypesResponse) GetProfileTypes() []*v11.ProfileType {
 	if x != nil {
 		return x.ProfileTypes
 	}
@@ -298,7 +550,7 @@ type SeriesRequest struct {
 func (x *SeriesRequest) Reset() {
 	*x = SeriesRequest{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[6]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[9]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -311,7 +563,7 @@ func (x *SeriesRequest) String() string {
 func (*SeriesRequest) ProtoMessage() {}
 
 func (x *SeriesRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[6]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[9]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -324,7 +576,7 @@ func (x *SeriesRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use SeriesRequest.ProtoReflect.Descriptor instead.
 func (*SeriesRequest) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{6}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{9}
 }
 
 func (x *SeriesRequest) GetMatchers() []string {
@@ -339,13 +591,13 @@ type SeriesResponse struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	LabelsSet []*v1.Labels `protobuf:"bytes,2,rep,name=labels_set,json=labelsSet,proto3" json:"labels_set,omitempty"`
+	LabelsSet []*v11.Labels `protobuf:"bytes,2,rep,name=labels_set,json=labelsSet,proto3" json:"labels_set,omitempty"`
 }
 
 func (x *SeriesResponse) Reset() {
 	*x = SeriesResponse{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[7]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[10]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -358,7 +610,7 @@ func (x *SeriesResponse) String() string {
 func (*SeriesResponse) ProtoMessage() {}
 
 func (x *SeriesResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[7]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[10]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -371,10 +623,10 @@ func (x *SeriesResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use SeriesResponse.ProtoReflect.Descriptor instead.
 func (*SeriesResponse) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{7}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{10}
 }
 
-func (x *SeriesResponse) GetLabelsSet() []*v1.Labels {
+func (x *SeriesResponse) GetLabelsSet() []*v11.Labels {
 	if x != nil {
 		return x.LabelsSet
 	}
@@ -390,7 +642,7 @@ type FlushRequest struct {
 func (x *FlushRequest) Reset() {
 	*x = FlushRequest{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[8]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[11]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -403,7 +655,7 @@ func (x *FlushRequest) String() string {
 func (*FlushRequest) ProtoMessage() {}
 
 func (x *FlushRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[8]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[11]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -416,7 +668,7 @@ func (x *FlushRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use FlushRequest.ProtoReflect.Descriptor instead.
 func (*FlushRequest) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{8}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{11}
 }
 
 type FlushResponse struct {
@@ -428,7 +680,7 @@ type FlushResponse struct {
 func (x *FlushResponse) Reset() {
 	*x = FlushResponse{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[9]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[12]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -441,7 +693,7 @@ func (x *FlushResponse) String() string {
 func (*FlushResponse) ProtoMessage() {}
 
 func (x *FlushResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[9]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[12]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -454,7 +706,7 @@ func (x *FlushResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use FlushResponse.ProtoReflect.Descriptor instead.
 func (*FlushResponse) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{9}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{12}
 }
 
 type SelectProfilesRequest struct {
@@ -462,16 +714,16 @@ type SelectProfilesRequest struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	LabelSelector string          `protobuf:"bytes,1,opt,name=label_selector,json=labelSelector,proto3" json:"label_selector,omitempty"`
-	Type          *v1.ProfileType `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
-	Start         int64           `protobuf:"varint,3,opt,name=start,proto3" json:"start,omitempty"`
-	End           int64           `protobuf:"varint,4,opt,name=end,proto3" json:"end,omitempty"`
+	LabelSelector string           `protobuf:"bytes,1,opt,name=label_selector,json=labelSelector,proto3" json:"label_selector,omitempty"`
+	Type          *v11.ProfileType `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Start         int64            `protobuf:"varint,3,opt,name=start,proto3" json:"start,omitempty"`
+	End           int64            `protobuf:"varint,4,opt,name=end,proto3" json:"end,omitempty"`
 }
 
 func (x *SelectProfilesRequest) Reset() {
 	*x = SelectProfilesRequest{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[10]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[13]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -484,7 +736,7 @@ func (x *SelectProfilesRequest) String() string {
 func (*SelectProfilesRequest) ProtoMessage() {}
 
 func (x *SelectProfilesRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[10]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[13]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -497,7 +749,7 @@ func (x *SelectProfilesRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use SelectProfilesRequest.ProtoReflect.Descriptor instead.
 func (*SelectProfilesRequest) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{10}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{13}
 }
 
 func (x *SelectProfilesRequest) GetLabelSelector() string {
@@ -507,7 +759,7 @@ func (x *SelectProfilesRequest) GetLabelSelector() string {
 	return ""
 }
 
-func (x *SelectProfilesRequest) GetType() *v1.ProfileType {
+func (x *SelectProfilesRequest) GetType() *v11.ProfileType {
 	if x != nil {
 		return x.Type
 	}
@@ -537,12 +789,32 @@ type MergeProfilesStacktracesRequest struct {
 	Request *SelectProfilesRequest `protobuf:"bytes,1,opt,name=request,proto3" json:"request,omitempty"`
 	// On a batch of profiles, the client sends the profiles to keep for merging.
 	Profiles []bool `protobuf:"varint,2,rep,packed,name=profiles,proto3" json:"profiles,omitempty"`
+	// The granularity of the stacktraces nodes, only read from the initial request.
+	Granularity StacktraceGranularity `protobuf:"varint,3,opt,name=granularity,proto3,enum=ingester.v1.StacktraceGranularity" json:"granularity,omitempty"`
+	// Split the stacktraces by the value of this sample label, only read from the initial request.
+	// Each stacktrace gets an additional root node named "<label>=<value>". Sample labels take
+	// precedence over series labels of the same name. Samples without the label are not split.
+	SplitBySampleLabel string `protobuf:"bytes,4,opt,name=split_by_sample_label,json=splitBySampleLabel,proto3" json:"split_by_sample_label,omitempty"`
+	// Limit the memory in bytes allocated by the query, only read from the initial request.
+	// The query fails once it is exceeded. The smaller of this and the configured limit applies.
+	MaxMemoryBytes int64 `protobuf:"varint,7,opt,name=max_memory_bytes,json=maxMemoryBytes,proto3" json:"max_memory_bytes,omitempty"`
+	// Scale the values of the merged stacktraces, only read from the initial request.
+	Scaling *ValueScaling `protobuf:"bytes,8,opt,name=scaling,proto3" json:"scaling,omitempty"`
+	// Multiply the sample values by the period of their profile before merging, so that profiles
+	// sampled at different rates are comparable. Profiles without a period are not normalized.
+	// Only read from the initial request.
+	NormalizePeriod bool `protobuf:"varint,9,opt,name=normalize_period,json=normalizePeriod,proto3" json:"normalize_period,omitempty"`
+	// Trim the frames at the root of the merged stacktraces matching any of these patterns, e.g.
+	// "runtime.main" or "runtime\\..*". Patterns are regular expressions matching the whole function
+	// name. Frames are trimmed as long as they match, their children become roots and the values
+	// are preserved. Only read from the initial request.
+	TrimRootFrames []string `protobuf:"bytes,10,rep,name=trim_root_frames,json=trimRootFrames,proto3" json:"trim_root_frames,omitempty"`
 }
 
 func (x *MergeProfilesStacktracesRequest) Reset() {
 	*x = MergeProfilesStacktracesRequest{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[11]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[14]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -555,7 +827,7 @@ func (x *MergeProfilesStacktracesRequest) String() string {
 func (*MergeProfilesStacktracesRequest) ProtoMessage() {}
 
 func (x *MergeProfilesStacktracesRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[11]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[14]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -568,7 +840,7 @@ func (x *MergeProfilesStacktracesRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MergeProfilesStacktracesRequest.ProtoReflect.Descriptor instead.
 func (*MergeProfilesStacktracesRequest) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{11}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{14}
 }
 
 func (x *MergeProfilesStacktracesRequest) GetRequest() *SelectProfilesRequest {
@@ -585,6 +857,115 @@ func (x *MergeProfilesStacktracesRequest) GetProfiles() []bool {
 	return nil
 }
 
+func (x *MergeProfilesStacktracesRequest) GetGranularity() StacktraceGranularity {
+	if x != nil {
+		return x.Granularity
+	}
+	return StacktraceGranularity_STACKTRACE_GRANULARITY_FUNCTION
+}
+
+func (x *MergeProfilesStacktracesRequest) GetSplitBySampleLabel() string {
+	if x != nil {
+		return x.SplitBySampleLabel
+	}
+	return ""
+}
+
+func (x *MergeProfilesStacktracesRequest) GetMaxMemoryBytes() int64 {
+	if x != nil {
+		return x.MaxMemoryBytes
+	}
+	return 0
+}
+
+func (x *MergeProfilesStacktracesRequest) GetScaling() *ValueScaling {
+	if x != nil {
+		return x.Scaling
+	}
+	return nil
+}
+
+func (x *MergeProfilesStacktracesRequest) GetNormalizePeriod() bool {
+	if x != nil {
+		return x.NormalizePeriod
+	}
+	return false
+}
+
+func (x *MergeProfilesStacktracesRequest) GetTrimRootFrames() []string {
+	if x != nil {
+		return x.TrimRootFrames
+	}
+	return nil
+}
+
+// ValueScaling converts the values of a merge result, e.g. from nanoseconds to milliseconds.
+type ValueScaling struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The values are multiplied by this factor, 0 keeps them unchanged. Ignored in percent mode.
+	Factor float64 `protobuf:"fixed64,1,opt,name=factor,proto3" json:"factor,omitempty"`
+	// The unit of the scaled values, e.g. "milliseconds". Defaults to "percent" in percent mode.
+	Unit string `protobuf:"bytes,2,opt,name=unit,proto3" json:"unit,omitempty"`
+	// Convert the values into percent (0-100) of the total value of the result.
+	Percent bool `protobuf:"varint,3,opt,name=percent,proto3" json:"percent,omitempty"`
+}
+
+func (x *ValueScaling) Reset() {
+	*x = ValueScaling{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ingester_v1_ingester_proto_msgTypes[15]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ValueScaling) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ValueScaling) ProtoMessage() {}
+
+func (x *ValueScaling) ProtoReflect() protoreflect.Message {
+	mi := &file_ingester_v1_ingester_proto_msgTypes[15]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ValueScaling.ProtoReflect.Descriptor instead.
+func (*ValueScaling) Descriptor() ([]byte, []int) {
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *ValueScaling) GetFactor() float64 {
+	if x != nil {
+		return x.Factor
+	}
+	return 0
+}
+
+func (x *ValueScaling) GetUnit() string {
+	if x != nil {
+		return x.Unit
+	}
+	return ""
+}
+
+func (x *ValueScaling) GetPercent() bool {
+	if x != nil {
+		return x.Percent
+	}
+	return false
+}
+
 type MergeProfilesStacktracesResult struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -593,12 +974,19 @@ type MergeProfilesStacktracesResult struct {
 	// The list of stracktraces with their respective value
 	Stacktraces   []*StacktraceSample `protobuf:"bytes,1,rep,name=stacktraces,proto3" json:"stacktraces,omitempty"`
 	FunctionNames []string            `protobuf:"bytes,2,rep,name=function_names,json=functionNames,proto3" json:"function_names,omitempty"`
+	// When merged with line granularity, the line number of each entry in function_names.
+	Lines []int64 `protobuf:"varint,3,rep,packed,name=lines,proto3" json:"lines,omitempty"`
+	// When the request sets a scaling, the unit of the scaled values.
+	Unit string `protobuf:"bytes,4,opt,name=unit,proto3" json:"unit,omitempty"`
+	// The stacktraces as a tree, in depth-first order with the children of a node
+	// sorted by function name.
+	Nodes []*StacktraceNode `protobuf:"bytes,5,rep,name=nodes,proto3" json:"nodes,omitempty"`
 }
 
 func (x *MergeProfilesStacktracesResult) Reset() {
 	*x = MergeProfilesStacktracesResult{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[12]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[16]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -611,7 +999,7 @@ func (x *MergeProfilesStacktracesResult) String() string {
 func (*MergeProfilesStacktracesResult) ProtoMessage() {}
 
 func (x *MergeProfilesStacktracesResult) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[12]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[16]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -624,7 +1012,7 @@ func (x *MergeProfilesStacktracesResult) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MergeProfilesStacktracesResult.ProtoReflect.Descriptor instead.
 func (*MergeProfilesStacktracesResult) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{12}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{16}
 }
 
 func (x *MergeProfilesStacktracesResult) GetStacktraces() []*StacktraceSample {
@@ -641,6 +1029,103 @@ func (x *MergeProfilesStacktracesResult) GetFunctionNames() []string {
 	return nil
 }
 
+func (x *MergeProfilesStacktracesResult) GetLines() []int64 {
+	if x != nil {
+		return x.Lines
+	}
+	return nil
+}
+
+func (x *MergeProfilesStacktracesResult) GetUnit() string {
+	if x != nil {
+		return x.Unit
+	}
+	return ""
+}
+
+func (x *MergeProfilesStacktracesResult) GetNodes() []*StacktraceNode {
+	if x != nil {
+		return x.Nodes
+	}
+	return nil
+}
+
+// StacktraceNode is a node of the tree of the stacktraces.
+type StacktraceNode struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The index of the node in function_names.
+	FunctionId int32 `protobuf:"varint,1,opt,name=function_id,json=functionId,proto3" json:"function_id,omitempty"`
+	// The index of the parent node in nodes, -1 for root nodes.
+	Parent int32 `protobuf:"varint,2,opt,name=parent,proto3" json:"parent,omitempty"`
+	// The value of the stacktraces ending at the node.
+	Self int64 `protobuf:"varint,3,opt,name=self,proto3" json:"self,omitempty"`
+	// The value of the stacktraces going through the node, including self.
+	Total int64 `protobuf:"varint,4,opt,name=total,proto3" json:"total,omitempty"`
+}
+
+func (x *StacktraceNode) Reset() {
+	*x = StacktraceNode{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ingester_v1_ingester_proto_msgTypes[17]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *StacktraceNode) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StacktraceNode) ProtoMessage() {}
+
+func (x *StacktraceNode) ProtoReflect() protoreflect.Message {
+	mi := &file_ingester_v1_ingester_proto_msgTypes[17]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StacktraceNode.ProtoReflect.Descriptor instead.
+func (*StacktraceNode) Descriptor() ([]byte, []int) {
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *StacktraceNode) GetFunctionId() int32 {
+	if x != nil {
+		return x.FunctionId
+	}
+	return 0
+}
+
+func (x *StacktraceNode) GetParent() int32 {
+	if x != nil {
+		return x.Parent
+	}
+	return 0
+}
+
+func (x *StacktraceNode) GetSelf() int64 {
+	if x != nil {
+		return x.Self
+	}
+	return 0
+}
+
+func (x *StacktraceNode) GetTotal() int64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
 type MergeProfilesStacktracesResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -656,7 +1141,7 @@ type MergeProfilesStacktracesResponse struct {
 func (x *MergeProfilesStacktracesResponse) Reset() {
 	*x = MergeProfilesStacktracesResponse{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[13]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[18]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -669,7 +1154,7 @@ func (x *MergeProfilesStacktracesResponse) String() string {
 func (*MergeProfilesStacktracesResponse) ProtoMessage() {}
 
 func (x *MergeProfilesStacktracesResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[13]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[18]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -682,7 +1167,7 @@ func (x *MergeProfilesStacktracesResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MergeProfilesStacktracesResponse.ProtoReflect.Descriptor instead.
 func (*MergeProfilesStacktracesResponse) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{13}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{18}
 }
 
 func (x *MergeProfilesStacktracesResponse) GetSelectedProfiles() *ProfileSets {
@@ -704,14 +1189,14 @@ type ProfileSets struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	LabelsSets []*v1.Labels     `protobuf:"bytes,1,rep,name=labelsSets,proto3" json:"labelsSets,omitempty"`
+	LabelsSets []*v11.Labels    `protobuf:"bytes,1,rep,name=labelsSets,proto3" json:"labelsSets,omitempty"`
 	Profiles   []*SeriesProfile `protobuf:"bytes,2,rep,name=profiles,proto3" json:"profiles,omitempty"`
 }
 
 func (x *ProfileSets) Reset() {
 	*x = ProfileSets{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[14]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[19]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -724,7 +1209,7 @@ func (x *ProfileSets) String() string {
 func (*ProfileSets) ProtoMessage() {}
 
 func (x *ProfileSets) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[14]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[19]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -737,10 +1222,10 @@ func (x *ProfileSets) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ProfileSets.ProtoReflect.Descriptor instead.
 func (*ProfileSets) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{14}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{19}
 }
 
-func (x *ProfileSets) GetLabelsSets() []*v1.Labels {
+func (x *ProfileSets) GetLabelsSets() []*v11.Labels {
 	if x != nil {
 		return x.LabelsSets
 	}
@@ -768,7 +1253,7 @@ type SeriesProfile struct {
 func (x *SeriesProfile) Reset() {
 	*x = SeriesProfile{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[15]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[20]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -781,7 +1266,7 @@ func (x *SeriesProfile) String() string {
 func (*SeriesProfile) ProtoMessage() {}
 
 func (x *SeriesProfile) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[15]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[20]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -794,7 +1279,7 @@ func (x *SeriesProfile) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use SeriesProfile.ProtoReflect.Descriptor instead.
 func (*SeriesProfile) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{15}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{20}
 }
 
 func (x *SeriesProfile) GetLabelIndex() int32 {
@@ -820,9 +1305,9 @@ type Profile struct {
 	// The ID of the profile.
 	ID string `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
 	// The name and type of the profile.
-	Type *v1.ProfileType `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Type *v11.ProfileType `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
 	// LabelPair is the key value pairs to identify the corresponding profile
-	Labels []*v1.LabelPair `protobuf:"bytes,3,rep,name=labels,proto3" json:"labels,omitempty"`
+	Labels []*v11.LabelPair `protobuf:"bytes,3,rep,name=labels,proto3" json:"labels,omitempty"`
 	// Timestamp is when that profile was created
 	Timestamp int64 `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
 	// The list of stracktraces for the profile with their respective value
@@ -832,7 +1317,7 @@ type Profile struct {
 func (x *Profile) Reset() {
 	*x = Profile{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[16]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[21]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -845,7 +1330,7 @@ func (x *Profile) String() string {
 func (*Profile) ProtoMessage() {}
 
 func (x *Profile) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[16]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[21]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -858,7 +1343,7 @@ func (x *Profile) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Profile.ProtoReflect.Descriptor instead.
 func (*Profile) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{16}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{21}
 }
 
 func (x *Profile) GetID() string {
@@ -868,14 +1353,14 @@ func (x *Profile) GetID() string {
 	return ""
 }
 
-func (x *Profile) GetType() *v1.ProfileType {
+func (x *Profile) GetType() *v11.ProfileType {
 	if x != nil {
 		return x.Type
 	}
 	return nil
 }
 
-func (x *Profile) GetLabels() []*v1.LabelPair {
+func (x *Profile) GetLabels() []*v11.LabelPair {
 	if x != nil {
 		return x.Labels
 	}
@@ -903,12 +1388,14 @@ type StacktraceSample struct {
 
 	FunctionIds []int32 `protobuf:"varint,1,rep,packed,name=function_ids,json=functionIds,proto3" json:"function_ids,omitempty"`
 	Value       int64   `protobuf:"varint,2,opt,name=value,proto3" json:"value,omitempty"`
+	// When the request sets a scaling, the scaled value.
+	ScaledValue float64 `protobuf:"fixed64,3,opt,name=scaled_value,json=scaledValue,proto3" json:"scaled_value,omitempty"`
 }
 
 func (x *StacktraceSample) Reset() {
 	*x = StacktraceSample{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[17]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[22]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -921,7 +1408,7 @@ func (x *StacktraceSample) String() string {
 func (*StacktraceSample) ProtoMessage() {}
 
 func (x *StacktraceSample) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[17]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[22]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -934,7 +1421,7 @@ func (x *StacktraceSample) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use StacktraceSample.ProtoReflect.Descriptor instead.
 func (*StacktraceSample) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{17}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{22}
 }
 
 func (x *StacktraceSample) GetFunctionIds() []int32 {
@@ -951,6 +1438,13 @@ func (x *StacktraceSample) GetValue() int64 {
 	return 0
 }
 
+func (x *StacktraceSample) GetScaledValue() float64 {
+	if x != nil {
+		return x.ScaledValue
+	}
+	return 0
+}
+
 type MergeProfilesLabelsRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -962,12 +1456,36 @@ type MergeProfilesLabelsRequest struct {
 	By []string `protobuf:"bytes,2,rep,name=by,proto3" json:"by,omitempty"`
 	// On a batch of profiles, the client sends the profiles to keep for merging.
 	Profiles []bool `protobuf:"varint,3,rep,packed,name=profiles,proto3" json:"profiles,omitempty"`
+	// Scale the values of the merged series, only read from the initial request.
+	Scaling *ValueScaling `protobuf:"bytes,4,opt,name=scaling,proto3" json:"scaling,omitempty"`
+	// Only keep the merged series with one of these values for a label of by.
+	// Empty keeps all series. Only read from the initial request.
+	Include []string `protobuf:"bytes,5,rep,name=include,proto3" json:"include,omitempty"`
+	// Drop the merged series with one of these values for a label of by.
+	// Only read from the initial request.
+	Exclude []string `protobuf:"bytes,6,rep,name=exclude,proto3" json:"exclude,omitempty"`
+	// Rewrite the labels of the profiles before they are grouped by, as
+	// Prometheus relabeling. Only read from the initial request.
+	Relabel []*RelabelConfig `protobuf:"bytes,7,rep,name=relabel,proto3" json:"relabel,omitempty"`
+	// Merge the profiles of all sample types sharing the name and the period of
+	// the profile type of the request, e.g. inuse_space and inuse_objects of
+	// memory profiles. The series are split by sample type and labelled with
+	// __type__ and __unit__. Only read from the initial request.
+	AllSampleTypes bool `protobuf:"varint,8,opt,name=all_sample_types,json=allSampleTypes,proto3" json:"all_sample_types,omitempty"`
+	// Limit each merged series to at most max_points points, 0 keeps all points.
+	// The time range of the request is split into max_points buckets of equal
+	// duration, the points of a bucket are aggregated into a single point at the
+	// start of the bucket. Only read from the initial request.
+	MaxPoints int64 `protobuf:"varint,9,opt,name=max_points,json=maxPoints,proto3" json:"max_points,omitempty"`
+	// How the points of a bucket are aggregated, when max_points is set. Only
+	// read from the initial request.
+	PointsAggregation PointsAggregation `protobuf:"varint,10,opt,name=points_aggregation,json=pointsAggregation,proto3,enum=ingester.v1.PointsAggregation" json:"points_aggregation,omitempty"`
 }
 
 func (x *MergeProfilesLabelsRequest) Reset() {
 	*x = MergeProfilesLabelsRequest{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[18]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[23]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -980,7 +1498,7 @@ func (x *MergeProfilesLabelsRequest) String() string {
 func (*MergeProfilesLabelsRequest) ProtoMessage() {}
 
 func (x *MergeProfilesLabelsRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[18]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[23]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -993,7 +1511,7 @@ func (x *MergeProfilesLabelsRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MergeProfilesLabelsRequest.ProtoReflect.Descriptor instead.
 func (*MergeProfilesLabelsRequest) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{18}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{23}
 }
 
 func (x *MergeProfilesLabelsRequest) GetRequest() *SelectProfilesRequest {
@@ -1017,6 +1535,148 @@ func (x *MergeProfilesLabelsRequest) GetProfiles() []bool {
 	return nil
 }
 
+func (x *MergeProfilesLabelsRequest) GetScaling() *ValueScaling {
+	if x != nil {
+		return x.Scaling
+	}
+	return nil
+}
+
+func (x *MergeProfilesLabelsRequest) GetInclude() []string {
+	if x != nil {
+		return x.Include
+	}
+	return nil
+}
+
+func (x *MergeProfilesLabelsRequest) GetExclude() []string {
+	if x != nil {
+		return x.Exclude
+	}
+	return nil
+}
+
+func (x *MergeProfilesLabelsRequest) GetRelabel() []*RelabelConfig {
+	if x != nil {
+		return x.Relabel
+	}
+	return nil
+}
+
+func (x *MergeProfilesLabelsRequest) GetAllSampleTypes() bool {
+	if x != nil {
+		return x.AllSampleTypes
+	}
+	return false
+}
+
+func (x *MergeProfilesLabelsRequest) GetMaxPoints() int64 {
+	if x != nil {
+		return x.MaxPoints
+	}
+	return 0
+}
+
+func (x *MergeProfilesLabelsRequest) GetPointsAggregation() PointsAggregation {
+	if x != nil {
+		return x.PointsAggregation
+	}
+	return PointsAggregation_POINTS_AGGREGATION_SUM
+}
+
+// RelabelConfig is a Prometheus relabel config, unset fields take the
+// Prometheus defaults.
+type RelabelConfig struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	SourceLabels []string `protobuf:"bytes,1,rep,name=source_labels,json=sourceLabels,proto3" json:"source_labels,omitempty"`
+	// Defaults to ";".
+	Separator string `protobuf:"bytes,2,opt,name=separator,proto3" json:"separator,omitempty"`
+	// Defaults to "(.*)".
+	Regex       string `protobuf:"bytes,3,opt,name=regex,proto3" json:"regex,omitempty"`
+	TargetLabel string `protobuf:"bytes,4,opt,name=target_label,json=targetLabel,proto3" json:"target_label,omitempty"`
+	// Defaults to "$1".
+	Replacement string `protobuf:"bytes,5,opt,name=replacement,proto3" json:"replacement,omitempty"`
+	// Defaults to "replace".
+	Action string `protobuf:"bytes,6,opt,name=action,proto3" json:"action,omitempty"`
+}
+
+func (x *RelabelConfig) Reset() {
+	*x = RelabelConfig{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_ingester_v1_ingester_proto_msgTypes[24]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RelabelConfig) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RelabelConfig) ProtoMessage() {}
+
+func (x *RelabelConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_ingester_v1_ingester_proto_msgTypes[24]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RelabelConfig.ProtoReflect.Descriptor instead.
+func (*RelabelConfig) Descriptor() ([]byte, []int) {
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *RelabelConfig) GetSourceLabels() []string {
+	if x != nil {
+		return x.SourceLabels
+	}
+	return nil
+}
+
+func (x *RelabelConfig) GetSeparator() string {
+	if x != nil {
+		return x.Separator
+	}
+	return ""
+}
+
+func (x *RelabelConfig) GetRegex() string {
+	if x != nil {
+		return x.Regex
+	}
+	return ""
+}
+
+func (x *RelabelConfig) GetTargetLabel() string {
+	if x != nil {
+		return x.TargetLabel
+	}
+	return ""
+}
+
+func (x *RelabelConfig) GetReplacement() string {
+	if x != nil {
+		return x.Replacement
+	}
+	return ""
+}
+
+func (x *RelabelConfig) GetAction() string {
+	if x != nil {
+		return x.Action
+	}
+	return ""
+}
+
 type MergeProfilesLabelsResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -1026,13 +1686,15 @@ type MergeProfilesLabelsResponse struct {
 	// A last message without profiles signals the next message will be the result of the merge.
 	SelectedProfiles *ProfileSets `protobuf:"bytes,1,opt,name=selectedProfiles,proto3" json:"selectedProfiles,omitempty"`
 	// The list of series for the profile with their respective value
-	Series []*v1.Series `protobuf:"bytes,2,rep,name=series,proto3" json:"series,omitempty"`
+	Series []*v11.Series `protobuf:"bytes,2,rep,name=series,proto3" json:"series,omitempty"`
+	// When the request sets a scaling, the unit of the scaled values.
+	Unit string `protobuf:"bytes,3,opt,name=unit,proto3" json:"unit,omitempty"`
 }
 
 func (x *MergeProfilesLabelsResponse) Reset() {
 	*x = MergeProfilesLabelsResponse{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[19]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[25]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -1045,7 +1707,7 @@ func (x *MergeProfilesLabelsResponse) String() string {
 func (*MergeProfilesLabelsResponse) ProtoMessage() {}
 
 func (x *MergeProfilesLabelsResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[19]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[25]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1058,7 +1720,7 @@ func (x *MergeProfilesLabelsResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MergeProfilesLabelsResponse.ProtoReflect.Descriptor instead.
 func (*MergeProfilesLabelsResponse) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{19}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{25}
 }
 
 func (x *MergeProfilesLabelsResponse) GetSelectedProfiles() *ProfileSets {
@@ -1068,13 +1730,20 @@ func (x *MergeProfilesLabelsResponse) GetSelectedProfiles() *ProfileSets {
 	return nil
 }
 
-func (x *MergeProfilesLabelsResponse) GetSeries() []*v1.Series {
+func (x *MergeProfilesLabelsResponse) GetSeries() []*v11.Series {
 	if x != nil {
 		return x.Series
 	}
 	return nil
 }
 
+func (x *MergeProfilesLabelsResponse) GetUnit() string {
+	if x != nil {
+		return x.Unit
+	}
+	return ""
+}
+
 type MergeProfilesPprofRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -1084,12 +1753,23 @@ type MergeProfilesPprofRequest struct {
 	Request *SelectProfilesRequest `protobuf:"bytes,1,opt,name=request,proto3" json:"request,omitempty"`
 	// On a batch of profiles, the client sends the profiles to keep for merging.
 	Profiles []bool `protobuf:"varint,2,rep,packed,name=profiles,proto3" json:"profiles,omitempty"`
+	// Only merge the samples with a sample label of this name and value, e.g. the trace_id of a
+	// trace. Samples without the label are excluded. Only read from the initial request.
+	SampleLabel *v11.LabelPair `protobuf:"bytes,3,opt,name=sample_label,json=sampleLabel,proto3" json:"sample_label,omitempty"`
+	// Drop the samples of the merged profile with a value below min_value or below min_percent
+	// (0-100) of the total value, along with the locations, functions and mappings referenced only
+	// by them. Only read from the initial request.
+	MinValue   int64   `protobuf:"varint,4,opt,name=min_value,json=minValue,proto3" json:"min_value,omitempty"`
+	MinPercent float64 `protobuf:"fixed64,5,opt,name=min_percent,json=minPercent,proto3" json:"min_percent,omitempty"`
+	// Add the values of the dropped samples to a single sample with a stacktrace of a single
+	// function named "other", so the total value is preserved.
+	AggregatePruned bool `protobuf:"varint,6,opt,name=aggregate_pruned,json=aggregatePruned,proto3" json:"aggregate_pruned,omitempty"`
 }
 
 func (x *MergeProfilesPprofRequest) Reset() {
 	*x = MergeProfilesPprofRequest{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[20]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[26]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -1102,7 +1782,7 @@ func (x *MergeProfilesPprofRequest) String() string {
 func (*MergeProfilesPprofRequest) ProtoMessage() {}
 
 func (x *MergeProfilesPprofRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[20]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[26]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1115,7 +1795,7 @@ func (x *MergeProfilesPprofRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MergeProfilesPprofRequest.ProtoReflect.Descriptor instead.
 func (*MergeProfilesPprofRequest) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{20}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{26}
 }
 
 func (x *MergeProfilesPprofRequest) GetRequest() *SelectProfilesRequest {
@@ -1132,6 +1812,34 @@ func (x *MergeProfilesPprofRequest) GetProfiles() []bool {
 	return nil
 }
 
+func (x *MergeProfilesPprofRequest) GetSampleLabel() *v11.LabelPair {
+	if x != nil {
+		return x.SampleLabel
+	}
+	return nil
+}
+
+func (x *MergeProfilesPprofRequest) GetMinValue() int64 {
+	if x != nil {
+		return x.MinValue
+	}
+	return 0
+}
+
+func (x *MergeProfilesPprofRequest) GetMinPercent() float64 {
+	if x != nil {
+		return x.MinPercent
+	}
+	return 0
+}
+
+func (x *MergeProfilesPprofRequest) GetAggregatePruned() bool {
+	if x != nil {
+		return x.AggregatePruned
+	}
+	return false
+}
+
 type MergeProfilesPprofResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -1147,7 +1855,7 @@ type MergeProfilesPprofResponse struct {
 func (x *MergeProfilesPprofResponse) Reset() {
 	*x = MergeProfilesPprofResponse{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_ingester_v1_ingester_proto_msgTypes[21]
+		mi := &file_ingester_v1_ingester_proto_msgTypes[27]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -1160,7 +1868,7 @@ func (x *MergeProfilesPprofResponse) String() string {
 func (*MergeProfilesPprofResponse) ProtoMessage() {}
 
 func (x *MergeProfilesPprofResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_ingester_v1_ingester_proto_msgTypes[21]
+	mi := &file_ingester_v1_ingester_proto_msgTypes[27]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1173,7 +1881,7 @@ func (x *MergeProfilesPprofResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MergeProfilesPprofResponse.ProtoReflect.Descriptor instead.
 func (*MergeProfilesPprofResponse) Descriptor() ([]byte, []int) {
-	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{21}
+	return file_ingester_v1_ingester_proto_rawDescGZIP(), []int{27}
 }
 
 func (x *MergeProfilesPprofResponse) GetSelectedProfiles() *ProfileSets {
@@ -1199,195 +1907,306 @@ var file_ingester_v1_ingester_proto_rawDesc = []byte{
 	0x65, 0x2f, 0x76, 0x31, 0x2f, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f,
 	0x74, 0x6f, 0x1a, 0x12, 0x70, 0x75, 0x73, 0x68, 0x2f, 0x76, 0x31, 0x2f, 0x70, 0x75, 0x73, 0x68,
 	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x14, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2f, 0x76, 0x31,
-	0x2f, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x28, 0x0a, 0x12,
-	0x4c, 0x61, 0x62, 0x65, 0x6c, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65,
-	0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0x2b, 0x0a, 0x13, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x56,
-	0x61, 0x6c, 0x75, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x14, 0x0a,
-	0x05, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x6e, 0x61,
-	0x6d, 0x65, 0x73, 0x22, 0x13, 0x0a, 0x11, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x4e, 0x61, 0x6d, 0x65,
-	0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0x2a, 0x0a, 0x12, 0x4c, 0x61, 0x62, 0x65,
-	0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x14,
-	0x0a, 0x05, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x6e,
-	0x61, 0x6d, 0x65, 0x73, 0x22, 0x15, 0x0a, 0x13, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54,
-	0x79, 0x70, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0x52, 0x0a, 0x14, 0x50,
-	0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f,
-	0x6e, 0x73, 0x65, 0x12, 0x3a, 0x0a, 0x0d, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x5f, 0x74,
-	0x79, 0x70, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x74, 0x79, 0x70,
-	0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70,
-	0x65, 0x52, 0x0c, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x73, 0x22,
-	0x2b, 0x0a, 0x0d, 0x53, 0x65, 0x72, 0x69, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
-	0x12, 0x1a, 0x0a, 0x08, 0x6d, 0x61, 0x74, 0x63, 0x68, 0x65, 0x72, 0x73, 0x18, 0x01, 0x20, 0x03,
-	0x28, 0x09, 0x52, 0x08, 0x6d, 0x61, 0x74, 0x63, 0x68, 0x65, 0x72, 0x73, 0x22, 0x41, 0x0a, 0x0e,
-	0x53, 0x65, 0x72, 0x69, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x2f,
-	0x0a, 0x0a, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x5f, 0x73, 0x65, 0x74, 0x18, 0x02, 0x20, 0x03,
-	0x28, 0x0b, 0x32, 0x10, 0x2e, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61,
-	0x62, 0x65, 0x6c, 0x73, 0x52, 0x09, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x53, 0x65, 0x74, 0x22,
-	0x0e, 0x0a, 0x0c, 0x46, 0x6c, 0x75, 0x73, 0x68, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x22,
-	0x0f, 0x0a, 0x0d, 0x46, 0x6c, 0x75, 0x73, 0x68, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
-	0x22, 0x91, 0x01, 0x0a, 0x15, 0x53, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x50, 0x72, 0x6f, 0x66, 0x69,
-	0x6c, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x25, 0x0a, 0x0e, 0x6c, 0x61,
-	0x62, 0x65, 0x6c, 0x5f, 0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x18, 0x01, 0x20, 0x01,
-	0x28, 0x09, 0x52, 0x0d, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x53, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x6f,
-	0x72, 0x12, 0x29, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32,
-	0x15, 0x2e, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69,
-	0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x14, 0x0a, 0x05,
-	0x73, 0x74, 0x61, 0x72, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x73, 0x74, 0x61,
-	0x72, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x65, 0x6e, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52,
-	0x03, 0x65, 0x6e, 0x64, 0x22, 0x7b, 0x0a, 0x1f, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f,
-	0x66, 0x69, 0x6c, 0x65, 0x73, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73,
-	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3c, 0x0a, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65,
-	0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x22, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73,
-	0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x50, 0x72, 0x6f,
-	0x66, 0x69, 0x6c, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x07, 0x72, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65,
-	0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x08, 0x52, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65,
-	0x73, 0x22, 0x88, 0x01, 0x0a, 0x1e, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69,
-	0x6c, 0x65, 0x73, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65,
-	0x73, 0x75, 0x6c, 0x74, 0x12, 0x3f, 0x0a, 0x0b, 0x73, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61,
-	0x63, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x69, 0x6e, 0x67, 0x65,
-	0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61,
-	0x63, 0x65, 0x53, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x52, 0x0b, 0x73, 0x74, 0x61, 0x63, 0x6b, 0x74,
-	0x72, 0x61, 0x63, 0x65, 0x73, 0x12, 0x25, 0x0a, 0x0e, 0x66, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f,
-	0x6e, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0d, 0x66,
-	0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x22, 0xad, 0x01, 0x0a,
-	0x20, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x53, 0x74,
-	0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
-	0x65, 0x12, 0x44, 0x0a, 0x10, 0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x65, 0x64, 0x50, 0x72, 0x6f,
-	0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x69, 0x6e,
-	0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c,
-	0x65, 0x53, 0x65, 0x74, 0x73, 0x52, 0x10, 0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x65, 0x64, 0x50,
-	0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x43, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c,
-	0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x2b, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74,
-	0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69,
-	0x6c, 0x65, 0x73, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65,
-	0x73, 0x75, 0x6c, 0x74, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x22, 0x77, 0x0a, 0x0b,
-	0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x53, 0x65, 0x74, 0x73, 0x12, 0x30, 0x0a, 0x0a, 0x6c,
-	0x61, 0x62, 0x65, 0x6c, 0x73, 0x53, 0x65, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32,
-	0x10, 0x2e, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x62, 0x65, 0x6c,
-	0x73, 0x52, 0x0a, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x53, 0x65, 0x74, 0x73, 0x12, 0x36, 0x0a,
-	0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32,
-	0x1a, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x65,
-	0x72, 0x69, 0x65, 0x73, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x52, 0x08, 0x70, 0x72, 0x6f,
-	0x66, 0x69, 0x6c, 0x65, 0x73, 0x22, 0x4d, 0x0a, 0x0d, 0x53, 0x65, 0x72, 0x69, 0x65, 0x73, 0x50,
-	0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x49,
-	0x6e, 0x64, 0x65, 0x78, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x6c, 0x61, 0x62, 0x65,
-	0x6c, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74,
-	0x61, 0x6d, 0x70, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73,
-	0x74, 0x61, 0x6d, 0x70, 0x22, 0xd0, 0x01, 0x0a, 0x07, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65,
-	0x12, 0x0e, 0x0a, 0x02, 0x49, 0x44, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x49, 0x44,
-	0x12, 0x29, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x15,
-	0x2e, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c,
-	0x65, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x2b, 0x0a, 0x06, 0x6c,
-	0x61, 0x62, 0x65, 0x6c, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74, 0x79,
-	0x70, 0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x50, 0x61, 0x69, 0x72,
-	0x52, 0x06, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65,
-	0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d,
-	0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x3f, 0x0a, 0x0b, 0x73, 0x74, 0x61, 0x63, 0x6b, 0x74,
-	0x72, 0x61, 0x63, 0x65, 0x73, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x69, 0x6e,
-	0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74,
-	0x72, 0x61, 0x63, 0x65, 0x53, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x52, 0x0b, 0x73, 0x74, 0x61, 0x63,
-	0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x22, 0x4b, 0x0a, 0x10, 0x53, 0x74, 0x61, 0x63, 0x6b,
-	0x74, 0x72, 0x61, 0x63, 0x65, 0x53, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x12, 0x21, 0x0a, 0x0c, 0x66,
-	0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x69, 0x64, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28,
-	0x05, 0x52, 0x0b, 0x66, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x64, 0x73, 0x12, 0x14,
-	0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x76,
-	0x61, 0x6c, 0x75, 0x65, 0x22, 0x86, 0x01, 0x0a, 0x1a, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72,
-	0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x52, 0x65, 0x71, 0x75,
-	0x65, 0x73, 0x74, 0x12, 0x3c, 0x0a, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x0b, 0x32, 0x22, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e,
-	0x76, 0x31, 0x2e, 0x53, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65,
-	0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73,
-	0x74, 0x12, 0x0e, 0x0a, 0x02, 0x62, 0x79, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x02, 0x62,
-	0x79, 0x12, 0x1a, 0x0a, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x03, 0x20,
-	0x03, 0x28, 0x08, 0x52, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x22, 0x8d, 0x01,
-	0x0a, 0x1b, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x4c,
-	0x61, 0x62, 0x65, 0x6c, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x44, 0x0a,
-	0x10, 0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x65, 0x64, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65,
-	0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74,
-	0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x53, 0x65, 0x74,
-	0x73, 0x52, 0x10, 0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x65, 0x64, 0x50, 0x72, 0x6f, 0x66, 0x69,
-	0x6c, 0x65, 0x73, 0x12, 0x28, 0x0a, 0x06, 0x73, 0x65, 0x72, 0x69, 0x65, 0x73, 0x18, 0x02, 0x20,
-	0x03, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x53,
-	0x65, 0x72, 0x69, 0x65, 0x73, 0x52, 0x06, 0x73, 0x65, 0x72, 0x69, 0x65, 0x73, 0x22, 0x75, 0x0a,
-	0x19, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x50, 0x70,
-	0x72, 0x6f, 0x66, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3c, 0x0a, 0x07, 0x72, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x22, 0x2e, 0x69, 0x6e,
-	0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x65, 0x6c, 0x65, 0x63, 0x74,
-	0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52,
-	0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x70, 0x72, 0x6f, 0x66,
-	0x69, 0x6c, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x08, 0x52, 0x08, 0x70, 0x72, 0x6f, 0x66,
-	0x69, 0x6c, 0x65, 0x73, 0x22, 0x7a, 0x0a, 0x1a, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f,
-	0x66, 0x69, 0x6c, 0x65, 0x73, 0x50, 0x70, 0x72, 0x6f, 0x66, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
-	0x73, 0x65, 0x12, 0x44, 0x0a, 0x10, 0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x65, 0x64, 0x50, 0x72,
-	0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x69,
-	0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69,
-	0x6c, 0x65, 0x53, 0x65, 0x74, 0x73, 0x52, 0x10, 0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x65, 0x64,
-	0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75,
-	0x6c, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74,
-	0x32, 0xa7, 0x06, 0x0a, 0x0f, 0x49, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x53, 0x65, 0x72,
-	0x76, 0x69, 0x63, 0x65, 0x12, 0x35, 0x0a, 0x04, 0x50, 0x75, 0x73, 0x68, 0x12, 0x14, 0x2e, 0x70,
-	0x75, 0x73, 0x68, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x75, 0x73, 0x68, 0x52, 0x65, 0x71, 0x75, 0x65,
-	0x73, 0x74, 0x1a, 0x15, 0x2e, 0x70, 0x75, 0x73, 0x68, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x75, 0x73,
-	0x68, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x52, 0x0a, 0x0b, 0x4c,
-	0x61, 0x62, 0x65, 0x6c, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x12, 0x1f, 0x2e, 0x69, 0x6e, 0x67,
-	0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x56, 0x61,
-	0x6c, 0x75, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x20, 0x2e, 0x69, 0x6e,
-	0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x56,
-	0x61, 0x6c, 0x75, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12,
-	0x4f, 0x0a, 0x0a, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x12, 0x1e, 0x2e,
-	0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x62, 0x65,
-	0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1f, 0x2e,
-	0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x62, 0x65,
-	0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00,
-	0x12, 0x55, 0x0a, 0x0c, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x73,
-	0x12, 0x20, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50,
-	0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65,
-	0x73, 0x74, 0x1a, 0x21, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31,
-	0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x73, 0x52, 0x65, 0x73,
-	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x43, 0x0a, 0x06, 0x53, 0x65, 0x72, 0x69, 0x65,
-	0x73, 0x12, 0x1a, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e,
-	0x53, 0x65, 0x72, 0x69, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b, 0x2e,
-	0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x65, 0x72, 0x69,
-	0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x40, 0x0a, 0x05,
-	0x46, 0x6c, 0x75, 0x73, 0x68, 0x12, 0x19, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72,
-	0x2e, 0x76, 0x31, 0x2e, 0x46, 0x6c, 0x75, 0x73, 0x68, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
-	0x1a, 0x1a, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x46,
-	0x6c, 0x75, 0x73, 0x68, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x7d,
-	0x0a, 0x18, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x53,
-	0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x12, 0x2c, 0x2e, 0x69, 0x6e, 0x67,
-	0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72,
-	0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65,
-	0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x2d, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73,
+	0x2f, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x46, 0x0a, 0x11,
+	0x50, 0x75, 0x73, 0x68, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x31, 0x0a, 0x06, 0x73, 0x65, 0x72, 0x69, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28,
+	0x0b, 0x32, 0x19, 0x2e, 0x70, 0x75, 0x73, 0x68, 0x2e, 0x76, 0x31, 0x2e, 0x52, 0x61, 0x77, 0x50,
+	0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x53, 0x65, 0x72, 0x69, 0x65, 0x73, 0x52, 0x06, 0x73, 0x65,
+	0x72, 0x69, 0x65, 0x73, 0x22, 0x3e, 0x0a, 0x12, 0x50, 0x75, 0x73, 0x68, 0x53, 0x74, 0x72, 0x65,
+	0x61, 0x6d, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x28, 0x0a, 0x04, 0x61, 0x63,
+	0x6b, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73,
+	0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x75, 0x73, 0x68, 0x41, 0x63, 0x6b, 0x52, 0x04,
+	0x61, 0x63, 0x6b, 0x73, 0x22, 0x2f, 0x0a, 0x07, 0x50, 0x75, 0x73, 0x68, 0x41, 0x63, 0x6b, 0x12,
+	0x0e, 0x0a, 0x02, 0x49, 0x44, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x49, 0x44, 0x12,
+	0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
+	0x65, 0x72, 0x72, 0x6f, 0x72, 0x22, 0x28, 0x0a, 0x12, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x56, 0x61,
+	0x6c, 0x75, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x6e,
+	0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x22,
+	0x2b, 0x0a, 0x13, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x18,
+	0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x22, 0x13, 0x0a, 0x11,
+	0x4c, 0x61, 0x62, 0x65, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x22, 0x2a, 0x0a, 0x12, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x6e, 0x61, 0x6d, 0x65, 0x73,
+	0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x22, 0x15, 0x0a,
+	0x13, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x73, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x22, 0x52, 0x0a, 0x14, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54,
+	0x79, 0x70, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3a, 0x0a, 0x0d,
+	0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x73, 0x18, 0x01, 0x20,
+	0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x50,
+	0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x52, 0x0c, 0x70, 0x72, 0x6f, 0x66,
+	0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x73, 0x22, 0x2b, 0x0a, 0x0d, 0x53, 0x65, 0x72, 0x69,
+	0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x6d, 0x61, 0x74,
+	0x63, 0x68, 0x65, 0x72, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x08, 0x6d, 0x61, 0x74,
+	0x63, 0x68, 0x65, 0x72, 0x73, 0x22, 0x41, 0x0a, 0x0e, 0x53, 0x65, 0x72, 0x69, 0x65, 0x73, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x2f, 0x0a, 0x0a, 0x6c, 0x61, 0x62, 0x65, 0x6c,
+	0x73, 0x5f, 0x73, 0x65, 0x74, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x74, 0x79,
+	0x70, 0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x52, 0x09, 0x6c,
+	0x61, 0x62, 0x65, 0x6c, 0x73, 0x53, 0x65, 0x74, 0x22, 0x0e, 0x0a, 0x0c, 0x46, 0x6c, 0x75, 0x73,
+	0x68, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0x0f, 0x0a, 0x0d, 0x46, 0x6c, 0x75, 0x73,
+	0x68, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x91, 0x01, 0x0a, 0x15, 0x53, 0x65,
+	0x6c, 0x65, 0x63, 0x74, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x12, 0x25, 0x0a, 0x0e, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x5f, 0x73, 0x65, 0x6c,
+	0x65, 0x63, 0x74, 0x6f, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x6c, 0x61, 0x62,
+	0x65, 0x6c, 0x53, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x12, 0x29, 0x0a, 0x04, 0x74, 0x79,
+	0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x74, 0x79, 0x70, 0x65, 0x73,
+	0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x52,
+	0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x72, 0x74, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x73, 0x74, 0x61, 0x72, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x65,
+	0x6e, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x03, 0x65, 0x6e, 0x64, 0x22, 0xb4, 0x03,
+	0x0a, 0x1f, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x53,
+	0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x3c, 0x0a, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x22, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31,
+	0x2e, 0x53, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x1a, 0x0a, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28,
+	0x08, 0x52, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x44, 0x0a, 0x0b, 0x67,
+	0x72, 0x61, 0x6e, 0x75, 0x6c, 0x61, 0x72, 0x69, 0x74, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e,
+	0x32, 0x22, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53,
+	0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x47, 0x72, 0x61, 0x6e, 0x75, 0x6c, 0x61,
+	0x72, 0x69, 0x74, 0x79, 0x52, 0x0b, 0x67, 0x72, 0x61, 0x6e, 0x75, 0x6c, 0x61, 0x72, 0x69, 0x74,
+	0x79, 0x12, 0x31, 0x0a, 0x15, 0x73, 0x70, 0x6c, 0x69, 0x74, 0x5f, 0x62, 0x79, 0x5f, 0x73, 0x61,
+	0x6d, 0x70, 0x6c, 0x65, 0x5f, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x12, 0x73, 0x70, 0x6c, 0x69, 0x74, 0x42, 0x79, 0x53, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x4c,
+	0x61, 0x62, 0x65, 0x6c, 0x12, 0x28, 0x0a, 0x10, 0x6d, 0x61, 0x78, 0x5f, 0x6d, 0x65, 0x6d, 0x6f,
+	0x72, 0x79, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x07, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e,
+	0x6d, 0x61, 0x78, 0x4d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x33,
+	0x0a, 0x07, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x19, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x56, 0x61,
+	0x6c, 0x75, 0x65, 0x53, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x52, 0x07, 0x73, 0x63, 0x61, 0x6c,
+	0x69, 0x6e, 0x67, 0x12, 0x29, 0x0a, 0x10, 0x6e, 0x6f, 0x72, 0x6d, 0x61, 0x6c, 0x69, 0x7a, 0x65,
+	0x5f, 0x70, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x18, 0x09, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x6e,
+	0x6f, 0x72, 0x6d, 0x61, 0x6c, 0x69, 0x7a, 0x65, 0x50, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x12, 0x28,
+	0x0a, 0x10, 0x74, 0x72, 0x69, 0x6d, 0x5f, 0x72, 0x6f, 0x6f, 0x74, 0x5f, 0x66, 0x72, 0x61, 0x6d,
+	0x65, 0x73, 0x18, 0x0a, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0e, 0x74, 0x72, 0x69, 0x6d, 0x52, 0x6f,
+	0x6f, 0x74, 0x46, 0x72, 0x61, 0x6d, 0x65, 0x73, 0x4a, 0x04, 0x08, 0x05, 0x10, 0x06, 0x4a, 0x04,
+	0x08, 0x06, 0x10, 0x07, 0x22, 0x54, 0x0a, 0x0c, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x53, 0x63, 0x61,
+	0x6c, 0x69, 0x6e, 0x67, 0x12, 0x16, 0x0a, 0x06, 0x66, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x01, 0x52, 0x06, 0x66, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x12, 0x12, 0x0a, 0x04,
+	0x75, 0x6e, 0x69, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x75, 0x6e, 0x69, 0x74,
+	0x12, 0x18, 0x0a, 0x07, 0x70, 0x65, 0x72, 0x63, 0x65, 0x6e, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x07, 0x70, 0x65, 0x72, 0x63, 0x65, 0x6e, 0x74, 0x22, 0xe5, 0x01, 0x0a, 0x1e, 0x4d,
+	0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x53, 0x74, 0x61, 0x63,
+	0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x3f, 0x0a,
+	0x0b, 0x73, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31,
+	0x2e, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x53, 0x61, 0x6d, 0x70, 0x6c,
+	0x65, 0x52, 0x0b, 0x73, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x12, 0x25,
+	0x0a, 0x0e, 0x66, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x73,
+	0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0d, 0x66, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e,
+	0x4e, 0x61, 0x6d, 0x65, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x6c, 0x69, 0x6e, 0x65, 0x73, 0x18, 0x03,
+	0x20, 0x03, 0x28, 0x03, 0x52, 0x05, 0x6c, 0x69, 0x6e, 0x65, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x75,
+	0x6e, 0x69, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x75, 0x6e, 0x69, 0x74, 0x12,
+	0x31, 0x0a, 0x05, 0x6e, 0x6f, 0x64, 0x65, 0x73, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1b,
+	0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x74, 0x61,
+	0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x4e, 0x6f, 0x64, 0x65, 0x52, 0x05, 0x6e, 0x6f, 0x64,
+	0x65, 0x73, 0x22, 0x73, 0x0a, 0x0e, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65,
+	0x4e, 0x6f, 0x64, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x66, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e,
+	0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x66, 0x75, 0x6e, 0x63, 0x74,
+	0x69, 0x6f, 0x6e, 0x49, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x61, 0x72, 0x65, 0x6e, 0x74, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x06, 0x70, 0x61, 0x72, 0x65, 0x6e, 0x74, 0x12, 0x12, 0x0a,
+	0x04, 0x73, 0x65, 0x6c, 0x66, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x73, 0x65, 0x6c,
+	0x66, 0x12, 0x14, 0x0a, 0x05, 0x74, 0x6f, 0x74, 0x61, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x05, 0x74, 0x6f, 0x74, 0x61, 0x6c, 0x22, 0xad, 0x01, 0x0a, 0x20, 0x4d, 0x65, 0x72, 0x67,
+	0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72,
+	0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x44, 0x0a, 0x10,
+	0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x65, 0x64, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65,
+	0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x53, 0x65, 0x74, 0x73,
+	0x52, 0x10, 0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x65, 0x64, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c,
+	0x65, 0x73, 0x12, 0x43, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x2b, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31,
+	0x2e, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x53, 0x74,
+	0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x52,
+	0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x22, 0x77, 0x0a, 0x0b, 0x50, 0x72, 0x6f, 0x66, 0x69,
+	0x6c, 0x65, 0x53, 0x65, 0x74, 0x73, 0x12, 0x30, 0x0a, 0x0a, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73,
+	0x53, 0x65, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x74, 0x79, 0x70,
+	0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x52, 0x0a, 0x6c, 0x61,
+	0x62, 0x65, 0x6c, 0x73, 0x53, 0x65, 0x74, 0x73, 0x12, 0x36, 0x0a, 0x08, 0x70, 0x72, 0x6f, 0x66,
+	0x69, 0x6c, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x69, 0x6e, 0x67,
+	0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x65, 0x72, 0x69, 0x65, 0x73, 0x50,
+	0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x52, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73,
+	0x22, 0x4d, 0x0a, 0x0d, 0x53, 0x65, 0x72, 0x69, 0x65, 0x73, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c,
+	0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x49, 0x6e, 0x64, 0x65,
+	0x78, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x22,
+	0xd0, 0x01, 0x0a, 0x07, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x49,
+	0x44, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x49, 0x44, 0x12, 0x29, 0x0a, 0x04, 0x74,
+	0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x74, 0x79, 0x70, 0x65,
+	0x73, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65,
+	0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x2b, 0x0a, 0x06, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73,
+	0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x76,
+	0x31, 0x2e, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x50, 0x61, 0x69, 0x72, 0x52, 0x06, 0x6c, 0x61, 0x62,
+	0x65, 0x6c, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
+	0x70, 0x12, 0x3f, 0x0a, 0x0b, 0x73, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73,
+	0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65,
+	0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x53,
+	0x61, 0x6d, 0x70, 0x6c, 0x65, 0x52, 0x0b, 0x73, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63,
+	0x65, 0x73, 0x22, 0x6e, 0x0a, 0x10, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65,
+	0x53, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x12, 0x21, 0x0a, 0x0c, 0x66, 0x75, 0x6e, 0x63, 0x74, 0x69,
+	0x6f, 0x6e, 0x5f, 0x69, 0x64, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x05, 0x52, 0x0b, 0x66, 0x75,
+	0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x64, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c,
+	0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x12,
+	0x21, 0x0a, 0x0c, 0x73, 0x63, 0x61, 0x6c, 0x65, 0x64, 0x5f, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0b, 0x73, 0x63, 0x61, 0x6c, 0x65, 0x64, 0x56, 0x61, 0x6c,
+	0x75, 0x65, 0x22, 0xbd, 0x03, 0x0a, 0x1a, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66,
+	0x69, 0x6c, 0x65, 0x73, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x3c, 0x0a, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x22, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31,
+	0x2e, 0x53, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x0e, 0x0a, 0x02, 0x62, 0x79, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x02, 0x62, 0x79, 0x12,
+	0x1a, 0x0a, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28,
+	0x08, 0x52, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x33, 0x0a, 0x07, 0x73,
+	0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x69,
+	0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x56, 0x61, 0x6c, 0x75, 0x65,
+	0x53, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x52, 0x07, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67,
+	0x12, 0x18, 0x0a, 0x07, 0x69, 0x6e, 0x63, 0x6c, 0x75, 0x64, 0x65, 0x18, 0x05, 0x20, 0x03, 0x28,
+	0x09, 0x52, 0x07, 0x69, 0x6e, 0x63, 0x6c, 0x75, 0x64, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x65, 0x78,
+	0x63, 0x6c, 0x75, 0x64, 0x65, 0x18, 0x06, 0x20, 0x03, 0x28, 0x09, 0x52, 0x07, 0x65, 0x78, 0x63,
+	0x6c, 0x75, 0x64, 0x65, 0x12, 0x34, 0x0a, 0x07, 0x72, 0x65, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x18,
+	0x07, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72,
+	0x2e, 0x76, 0x31, 0x2e, 0x52, 0x65, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x43, 0x6f, 0x6e, 0x66, 0x69,
+	0x67, 0x52, 0x07, 0x72, 0x65, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x12, 0x28, 0x0a, 0x10, 0x61, 0x6c,
+	0x6c, 0x5f, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x73, 0x18, 0x08,
+	0x20, 0x01, 0x28, 0x08, 0x52, 0x0e, 0x61, 0x6c, 0x6c, 0x53, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x54,
+	0x79, 0x70, 0x65, 0x73, 0x12, 0x1d, 0x0a, 0x0a, 0x6d, 0x61, 0x78, 0x5f, 0x70, 0x6f, 0x69, 0x6e,
+	0x74, 0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x6d, 0x61, 0x78, 0x50, 0x6f, 0x69,
+	0x6e, 0x74, 0x73, 0x12, 0x4d, 0x0a, 0x12, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x5f, 0x61, 0x67,
+	0x67, 0x72, 0x65, 0x67, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0e, 0x32,
+	0x1e, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6f,
+	0x69, 0x6e, 0x74, 0x73, 0x41, 0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52,
+	0x11, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x41, 0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x22, 0xc5, 0x01, 0x0a, 0x0d, 0x52, 0x65, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x43, 0x6f,
+	0x6e, 0x66, 0x69, 0x67, 0x12, 0x23, 0x0a, 0x0d, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x5f, 0x6c,
+	0x61, 0x62, 0x65, 0x6c, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0c, 0x73, 0x6f, 0x75,
+	0x72, 0x63, 0x65, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x73, 0x65, 0x70,
+	0x61, 0x72, 0x61, 0x74, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x73, 0x65,
+	0x70, 0x61, 0x72, 0x61, 0x74, 0x6f, 0x72, 0x12, 0x14, 0x0a, 0x05, 0x72, 0x65, 0x67, 0x65, 0x78,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x72, 0x65, 0x67, 0x65, 0x78, 0x12, 0x21, 0x0a,
+	0x0c, 0x74, 0x61, 0x72, 0x67, 0x65, 0x74, 0x5f, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x0b, 0x74, 0x61, 0x72, 0x67, 0x65, 0x74, 0x4c, 0x61, 0x62, 0x65, 0x6c,
+	0x12, 0x20, 0x0a, 0x0b, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x63, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x18,
+	0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x63, 0x65, 0x6d, 0x65,
+	0x6e, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0xa1, 0x01, 0x0a, 0x1b, 0x4d,
+	0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x4c, 0x61, 0x62, 0x65,
+	0x6c, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x44, 0x0a, 0x10, 0x73, 0x65,
+	0x6c, 0x65, 0x63, 0x74, 0x65, 0x64, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e,
+	0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x53, 0x65, 0x74, 0x73, 0x52, 0x10,
+	0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x65, 0x64, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73,
+	0x12, 0x28, 0x0a, 0x06, 0x73, 0x65, 0x72, 0x69, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x10, 0x2e, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x65, 0x72, 0x69,
+	0x65, 0x73, 0x52, 0x06, 0x73, 0x65, 0x72, 0x69, 0x65, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x75, 0x6e,
+	0x69, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x75, 0x6e, 0x69, 0x74, 0x22, 0x96,
+	0x02, 0x0a, 0x19, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73,
+	0x50, 0x70, 0x72, 0x6f, 0x66, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3c, 0x0a, 0x07,
+	0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x22, 0x2e,
+	0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x65, 0x6c, 0x65,
+	0x63, 0x74, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x52, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x70, 0x72,
+	0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x08, 0x52, 0x08, 0x70, 0x72,
+	0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x36, 0x0a, 0x0c, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65,
+	0x5f, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74,
+	0x79, 0x70, 0x65, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x50, 0x61, 0x69,
+	0x72, 0x52, 0x0b, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x12, 0x1b,
+	0x0a, 0x09, 0x6d, 0x69, 0x6e, 0x5f, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x08, 0x6d, 0x69, 0x6e, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x6d,
+	0x69, 0x6e, 0x5f, 0x70, 0x65, 0x72, 0x63, 0x65, 0x6e, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01,
+	0x52, 0x0a, 0x6d, 0x69, 0x6e, 0x50, 0x65, 0x72, 0x63, 0x65, 0x6e, 0x74, 0x12, 0x29, 0x0a, 0x10,
+	0x61, 0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74, 0x65, 0x5f, 0x70, 0x72, 0x75, 0x6e, 0x65, 0x64,
+	0x18, 0x06, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x61, 0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74,
+	0x65, 0x50, 0x72, 0x75, 0x6e, 0x65, 0x64, 0x22, 0x7a, 0x0a, 0x1a, 0x4d, 0x65, 0x72, 0x67, 0x65,
+	0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x50, 0x70, 0x72, 0x6f, 0x66, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x44, 0x0a, 0x10, 0x73, 0x65, 0x6c, 0x65, 0x63, 0x74, 0x65,
+	0x64, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x18, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72,
+	0x6f, 0x66, 0x69, 0x6c, 0x65, 0x53, 0x65, 0x74, 0x73, 0x52, 0x10, 0x73, 0x65, 0x6c, 0x65, 0x63,
+	0x74, 0x65, 0x64, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x72,
+	0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x72, 0x65, 0x73,
+	0x75, 0x6c, 0x74, 0x2a, 0x5d, 0x0a, 0x15, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63,
+	0x65, 0x47, 0x72, 0x61, 0x6e, 0x75, 0x6c, 0x61, 0x72, 0x69, 0x74, 0x79, 0x12, 0x23, 0x0a, 0x1f,
+	0x53, 0x54, 0x41, 0x43, 0x4b, 0x54, 0x52, 0x41, 0x43, 0x45, 0x5f, 0x47, 0x52, 0x41, 0x4e, 0x55,
+	0x4c, 0x41, 0x52, 0x49, 0x54, 0x59, 0x5f, 0x46, 0x55, 0x4e, 0x43, 0x54, 0x49, 0x4f, 0x4e, 0x10,
+	0x00, 0x12, 0x1f, 0x0a, 0x1b, 0x53, 0x54, 0x41, 0x43, 0x4b, 0x54, 0x52, 0x41, 0x43, 0x45, 0x5f,
+	0x47, 0x52, 0x41, 0x4e, 0x55, 0x4c, 0x41, 0x52, 0x49, 0x54, 0x59, 0x5f, 0x4c, 0x49, 0x4e, 0x45,
+	0x10, 0x01, 0x2a, 0x4b, 0x0a, 0x11, 0x50, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x41, 0x67, 0x67, 0x72,
+	0x65, 0x67, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x16, 0x50, 0x4f, 0x49, 0x4e, 0x54,
+	0x53, 0x5f, 0x41, 0x47, 0x47, 0x52, 0x45, 0x47, 0x41, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x53, 0x55,
+	0x4d, 0x10, 0x00, 0x12, 0x1a, 0x0a, 0x16, 0x50, 0x4f, 0x49, 0x4e, 0x54, 0x53, 0x5f, 0x41, 0x47,
+	0x47, 0x52, 0x45, 0x47, 0x41, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x4d, 0x41, 0x58, 0x10, 0x01, 0x32,
+	0xfc, 0x06, 0x0a, 0x0f, 0x49, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x53, 0x65, 0x72, 0x76,
+	0x69, 0x63, 0x65, 0x12, 0x35, 0x0a, 0x04, 0x50, 0x75, 0x73, 0x68, 0x12, 0x14, 0x2e, 0x70, 0x75,
+	0x73, 0x68, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x75, 0x73, 0x68, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x15, 0x2e, 0x70, 0x75, 0x73, 0x68, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x75, 0x73, 0x68,
+	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x53, 0x0a, 0x0a, 0x50, 0x75,
+	0x73, 0x68, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x12, 0x1e, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73,
+	0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x75, 0x73, 0x68, 0x53, 0x74, 0x72, 0x65, 0x61,
+	0x6d, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1f, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73,
+	0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x75, 0x73, 0x68, 0x53, 0x74, 0x72, 0x65, 0x61,
+	0x6d, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x12,
+	0x52, 0x0a, 0x0b, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x12, 0x1f,
+	0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x62,
+	0x65, 0x6c, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a,
+	0x20, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61,
+	0x62, 0x65, 0x6c, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x22, 0x00, 0x12, 0x4f, 0x0a, 0x0a, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x4e, 0x61, 0x6d, 0x65,
+	0x73, 0x12, 0x1e, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e,
+	0x4c, 0x61, 0x62, 0x65, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x1f, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e,
+	0x4c, 0x61, 0x62, 0x65, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x22, 0x00, 0x12, 0x55, 0x0a, 0x0c, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54,
+	0x79, 0x70, 0x65, 0x73, 0x12, 0x20, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e,
+	0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65, 0x73, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x21, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65,
+	0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x79, 0x70, 0x65,
+	0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x43, 0x0a, 0x06, 0x53,
+	0x65, 0x72, 0x69, 0x65, 0x73, 0x12, 0x1a, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72,
+	0x2e, 0x76, 0x31, 0x2e, 0x53, 0x65, 0x72, 0x69, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x1b, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e,
+	0x53, 0x65, 0x72, 0x69, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00,
+	0x12, 0x40, 0x0a, 0x05, 0x46, 0x6c, 0x75, 0x73, 0x68, 0x12, 0x19, 0x2e, 0x69, 0x6e, 0x67, 0x65,
+	0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x46, 0x6c, 0x75, 0x73, 0x68, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x1a, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e,
+	0x76, 0x31, 0x2e, 0x46, 0x6c, 0x75, 0x73, 0x68, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x22, 0x00, 0x12, 0x7d, 0x0a, 0x18, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69,
+	0x6c, 0x65, 0x73, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x12, 0x2c,
+	0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x65, 0x72,
+	0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74,
+	0x72, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x2d, 0x2e, 0x69,
+	0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x65, 0x72, 0x67, 0x65,
+	0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61,
+	0x63, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x28, 0x01, 0x30,
+	0x01, 0x12, 0x6e, 0x0a, 0x13, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c,
+	0x65, 0x73, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x12, 0x27, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73,
 	0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66,
-	0x69, 0x6c, 0x65, 0x73, 0x53, 0x74, 0x61, 0x63, 0x6b, 0x74, 0x72, 0x61, 0x63, 0x65, 0x73, 0x52,
-	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x12, 0x6e, 0x0a,
-	0x13, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x4c, 0x61,
-	0x62, 0x65, 0x6c, 0x73, 0x12, 0x27, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e,
-	0x76, 0x31, 0x2e, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73,
-	0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x28, 0x2e,
-	0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x65, 0x72, 0x67,
-	0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x52,
-	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x12, 0x6b, 0x0a,
-	0x12, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x50, 0x70,
-	0x72, 0x6f, 0x66, 0x12, 0x26, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76,
-	0x31, 0x2e, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x50,
-	0x70, 0x72, 0x6f, 0x66, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x27, 0x2e, 0x69, 0x6e,
-	0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50,
-	0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x50, 0x70, 0x72, 0x6f, 0x66, 0x52, 0x65, 0x73, 0x70,
-	0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x42, 0xb0, 0x01, 0x0a, 0x0f, 0x63,
-	0x6f, 0x6d, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x42, 0x0d,
-	0x49, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x50, 0x01, 0x5a,
-	0x41, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x67, 0x72, 0x61, 0x66,
-	0x61, 0x6e, 0x61, 0x2f, 0x70, 0x68, 0x6c, 0x61, 0x72, 0x65, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x67,
-	0x65, 0x6e, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x67, 0x6f, 0x2f, 0x69, 0x6e, 0x67, 0x65,
-	0x73, 0x74, 0x65, 0x72, 0x2f, 0x76, 0x31, 0x3b, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72,
-	0x76, 0x31, 0xa2, 0x02, 0x03, 0x49, 0x58, 0x58, 0xaa, 0x02, 0x0b, 0x49, 0x6e, 0x67, 0x65, 0x73,
-	0x74, 0x65, 0x72, 0x2e, 0x56, 0x31, 0xca, 0x02, 0x0b, 0x49, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65,
-	0x72, 0x5c, 0x56, 0x31, 0xe2, 0x02, 0x17, 0x49, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x5c,
-	0x56, 0x31, 0x5c, 0x47, 0x50, 0x42, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0xea, 0x02,
-	0x0c, 0x49, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x3a, 0x3a, 0x56, 0x31, 0x62, 0x06, 0x70,
-	0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x69, 0x6c, 0x65, 0x73, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x28, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e,
+	0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x4c, 0x61, 0x62,
+	0x65, 0x6c, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x28, 0x01, 0x30,
+	0x01, 0x12, 0x6b, 0x0a, 0x12, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c,
+	0x65, 0x73, 0x50, 0x70, 0x72, 0x6f, 0x66, 0x12, 0x26, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74,
+	0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x65, 0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69,
+	0x6c, 0x65, 0x73, 0x50, 0x70, 0x72, 0x6f, 0x66, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a,
+	0x27, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x65,
+	0x72, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x50, 0x70, 0x72, 0x6f, 0x66,
+	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x42, 0xb0,
+	0x01, 0x0a, 0x0f, 0x63, 0x6f, 0x6d, 0x2e, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e,
+	0x76, 0x31, 0x42, 0x0d, 0x49, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x50, 0x72, 0x6f, 0x74,
+	0x6f, 0x50, 0x01, 0x5a, 0x41, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f,
+	0x67, 0x72, 0x61, 0x66, 0x61, 0x6e, 0x61, 0x2f, 0x70, 0x68, 0x6c, 0x61, 0x72, 0x65, 0x2f, 0x61,
+	0x70, 0x69, 0x2f, 0x67, 0x65, 0x6e, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x67, 0x6f, 0x2f,
+	0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2f, 0x76, 0x31, 0x3b, 0x69, 0x6e, 0x67, 0x65,
+	0x73, 0x74, 0x65, 0x72, 0x76, 0x31, 0xa2, 0x02, 0x03, 0x49, 0x58, 0x58, 0xaa, 0x02, 0x0b, 0x49,
+	0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x2e, 0x56, 0x31, 0xca, 0x02, 0x0b, 0x49, 0x6e, 0x67,
+	0x65, 0x73, 0x74, 0x65, 0x72, 0x5c, 0x56, 0x31, 0xe2, 0x02, 0x17, 0x49, 0x6e, 0x67, 0x65, 0x73,
+	0x74, 0x65, 0x72, 0x5c, 0x56, 0x31, 0x5c, 0x47, 0x50, 0x42, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61,
+	0x74, 0x61, 0xea, 0x02, 0x0c, 0x49, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x65, 0x72, 0x3a, 0x3a, 0x56,
+	0x31, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -1402,78 +2221,99 @@ func file_ingester_v1_ingester_proto_rawDescGZIP() []byte {
 	return file_ingester_v1_ingester_proto_rawDescData
 }
 
-var file_ingester_v1_ingester_proto_msgTypes = make([]protoimpl.MessageInfo, 22)
+var file_ingester_v1_ingester_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_ingester_v1_ingester_proto_msgTypes = make([]protoimpl.MessageInfo, 28)
 var file_ingester_v1_ingester_proto_goTypes = []interface{}{
-	(*LabelValuesRequest)(nil),               // 0: ingester.v1.LabelValuesRequest
-	(*LabelValuesResponse)(nil),              // 1: ingester.v1.LabelValuesResponse
-	(*LabelNamesRequest)(nil),                // 2: ingester.v1.LabelNamesRequest
-	(*LabelNamesResponse)(nil),               // 3: ingester.v1.LabelNamesResponse
-	(*ProfileTypesRequest)(nil),              // 4: ingester.v1.ProfileTypesRequest
-	(*ProfileTypesResponse)(nil),             // 5: ingester.v1.ProfileTypesResponse
-	(*SeriesRequest)(nil),                    // 6: ingester.v1.SeriesRequest
-	(*SeriesResponse)(nil),                   // 7: ingester.v1.SeriesResponse
-	(*FlushRequest)(nil),                     // 8: ingester.v1.FlushRequest
-	(*FlushResponse)(nil),                    // 9: ingester.v1.FlushResponse
-	(*SelectProfilesRequest)(nil),            // 10: ingester.v1.SelectProfilesRequest
-	(*MergeProfilesStacktracesRequest)(nil),  // 11: ingester.v1.MergeProfilesStacktracesRequest
-	(*MergeProfilesStacktracesResult)(nil),   // 12: ingester.v1.MergeProfilesStacktracesResult
-	(*MergeProfilesStacktracesResponse)(nil), // 13: ingester.v1.MergeProfilesStacktracesResponse
-	(*ProfileSets)(nil),                      // 14: ingester.v1.ProfileSets
-	(*SeriesProfile)(nil),                    // 15: ingester.v1.SeriesProfile
-	(*Profile)(nil),                          // 16: ingester.v1.Profile
-	(*StacktraceSample)(nil),                 // 17: ingester.v1.StacktraceSample
-	(*MergeProfilesLabelsRequest)(nil),       // 18: ingester.v1.MergeProfilesLabelsRequest
-	(*MergeProfilesLabelsResponse)(nil),      // 19: ingester.v1.MergeProfilesLabelsResponse
-	(*MergeProfilesPprofRequest)(nil),        // 20: ingester.v1.MergeProfilesPprofRequest
-	(*MergeProfilesPprofResponse)(nil),       // 21: ingester.v1.MergeProfilesPprofResponse
-	(*v1.ProfileType)(nil),                   // 22: types.v1.ProfileType
-	(*v1.Labels)(nil),                        // 23: types.v1.Labels
-	(*v1.LabelPair)(nil),                     // 24: types.v1.LabelPair
-	(*v1.Series)(nil),                        // 25: types.v1.Series
-	(*v11.PushRequest)(nil),                  // 26: push.v1.PushRequest
-	(*v11.PushResponse)(nil),                 // 27: push.v1.PushResponse
+	(StacktraceGranularity)(0),               // 0: ingester.v1.StacktraceGranularity
+	(PointsAggregation)(0),                   // 1: ingester.v1.PointsAggregation
+	(*PushStreamRequest)(nil),                // 2: ingester.v1.PushStreamRequest
+	(*PushStreamResponse)(nil),               // 3: ingester.v1.PushStreamResponse
+	(*PushAck)(nil),                          // 4: ingester.v1.PushAck
+	(*LabelValuesRequest)(nil),               // 5: ingester.v1.LabelValuesRequest
+	(*LabelValuesResponse)(nil),              // 6: ingester.v1.LabelValuesResponse
+	(*LabelNamesRequest)(nil),                // 7: ingester.v1.LabelNamesRequest
+	(*LabelNamesResponse)(nil),               // 8: ingester.v1.LabelNamesResponse
+	(*ProfileTypesRequest)(nil),              // 9: ingester.v1.ProfileTypesRequest
+	(*ProfileTypesResponse)(nil),             // 10: ingester.v1.ProfileTypesResponse
+	(*SeriesRequest)(nil),                    // 11: ingester.v1.SeriesRequest
+	(*SeriesResponse)(nil),                   // 12: ingester.v1.SeriesResponse
+	(*FlushRequest)(nil),                     // 13: ingester.v1.FlushRequest
+	(*FlushResponse)(nil),                    // 14: ingester.v1.FlushResponse
+	(*SelectProfilesRequest)(nil),            // 15: ingester.v1.SelectProfilesRequest
+	(*MergeProfilesStacktracesRequest)(nil),  // 16: ingester.v1.MergeProfilesStacktracesRequest
+	(*ValueScaling)(nil),                     // 17: ingester.v1.ValueScaling
+	(*MergeProfilesStacktracesResult)(nil),   // 18: ingester.v1.MergeProfilesStacktracesResult
+	(*StacktraceNode)(nil),                   // 19: ingester.v1.StacktraceNode
+	(*MergeProfilesStacktracesResponse)(nil), // 20: ingester.v1.MergeProfilesStacktracesResponse
+	(*ProfileSets)(nil),                      // 21: ingester.v1.ProfileSets
+	(*SeriesProfile)(nil),                    // 22: ingester.v1.SeriesProfile
+	(*Profile)(nil),                          // 23: ingester.v1.Profile
+	(*StacktraceSample)(nil),                 // 24: ingester.v1.StacktraceSample
+	(*MergeProfilesLabelsRequest)(nil),       // 25: ingester.v1.MergeProfilesLabelsRequest
+	(*RelabelConfig)(nil),                    // 26: ingester.v1.RelabelConfig
+	(*MergeProfilesLabelsResponse)(nil),      // 27: ingester.v1.MergeProfilesLabelsResponse
+	(*MergeProfilesPprofRequest)(nil),        // 28: ingester.v1.MergeProfilesPprofRequest
+	(*MergeProfilesPprofResponse)(nil),       // 29: ingester.v1.MergeProfilesPprofResponse
+	(*v1.RawProfileSeries)(nil),              // 30: push.v1.RawProfileSeries
+	(*v11.ProfileType)(nil),                  // 31: types.v1.ProfileType
+	(*v11.Labels)(nil),                       // 32: types.v1.Labels
+	(*v11.LabelPair)(nil),                    // 33: types.v1.LabelPair
+	(*v11.Series)(nil),                       // 34: types.v1.Series
+	(*v1.PushRequest)(nil),                   // 35: push.v1.PushRequest
+	(*v1.PushResponse)(nil),                  // 36: push.v1.PushResponse
 }
 var file_ingester_v1_ingester_proto_depIdxs = []int32{
-	22, // 0: ingester.v1.ProfileTypesResponse.profile_types:type_name -> types.v1.ProfileType
-	23, // 1: ingester.v1.SeriesResponse.labels_set:type_name -> types.v1.Labels
-	22, // 2: ingester.v1.SelectProfilesRequest.type:type_name -> types.v1.ProfileType
-	10, // 3: ingester.v1.MergeProfilesStacktracesRequest.request:type_name -> ingester.v1.SelectProfilesRequest
-	17, // 4: ingester.v1.MergeProfilesStacktracesResult.stacktraces:type_name -> ingester.v1.StacktraceSample
-	14, // 5: ingester.v1.MergeProfilesStacktracesResponse.selectedProfiles:type_name -> ingester.v1.ProfileSets
-	12, // 6: ingester.v1.MergeProfilesStacktracesResponse.result:type_name -> ingester.v1.MergeProfilesStacktracesResult
-	23, // 7: ingester.v1.ProfileSets.labelsSets:type_name -> types.v1.Labels
-	15, // 8: ingester.v1.ProfileSets.profiles:type_name -> ingester.v1.SeriesProfile
-	22, // 9: ingester.v1.Profile.type:type_name -> types.v1.ProfileType
-	24, // 10: ingester.v1.Profile.labels:type_name -> types.v1.LabelPair
-	17, // 11: ingester.v1.Profile.stacktraces:type_name -> ingester.v1.StacktraceSample
-	10, // 12: ingester.v1.MergeProfilesLabelsRequest.request:type_name -> ingester.v1.SelectProfilesRequest
-	14, // 13: ingester.v1.MergeProfilesLabelsResponse.selectedProfiles:type_name -> ingester.v1.ProfileSets
-	25, // 14: ingester.v1.MergeProfilesLabelsResponse.series:type_name -> types.v1.Series
-	10, // 15: ingester.v1.MergeProfilesPprofRequest.request:type_name -> ingester.v1.SelectProfilesRequest
-	14, // 16: ingester.v1.MergeProfilesPprofResponse.selectedProfiles:type_name -> ingester.v1.ProfileSets
-	26, // 17: ingester.v1.IngesterService.Push:input_type -> push.v1.PushRequest
-	0,  // 18: ingester.v1.IngesterService.LabelValues:input_type -> ingester.v1.LabelValuesRequest
-	2,  // 19: ingester.v1.IngesterService.LabelNames:input_type -> ingester.v1.LabelNamesRequest
-	4,  // 20: ingester.v1.IngesterService.ProfileTypes:input_type -> ingester.v1.ProfileTypesRequest
-	6,  // 21: ingester.v1.IngesterService.Series:input_type -> ingester.v1.SeriesRequest
-	8,  // 22: ingester.v1.IngesterService.Flush:input_type -> ingester.v1.FlushRequest
-	11, // 23: ingester.v1.IngesterService.MergeProfilesStacktraces:input_type -> ingester.v1.MergeProfilesStacktracesRequest
-	18, // 24: ingester.v1.IngesterService.MergeProfilesLabels:input_type -> ingester.v1.MergeProfilesLabelsRequest
-	20, // 25: ingester.v1.IngesterService.MergeProfilesPprof:input_type -> ingester.v1.MergeProfilesPprofRequest
-	27, // 26: ingester.v1.IngesterService.Push:output_type -> push.v1.PushResponse
-	1,  // 27: ingester.v1.IngesterService.LabelValues:output_type -> ingester.v1.LabelValuesResponse
-	3,  // 28: ingester.v1.IngesterService.LabelNames:output_type -> ingester.v1.LabelNamesResponse
-	5,  // 29: ingester.v1.IngesterService.ProfileTypes:output_type -> ingester.v1.ProfileTypesResponse
-	7,  // 30: ingester.v1.IngesterService.Series:output_type -> ingester.v1.SeriesResponse
-	9,  // 31: ingester.v1.IngesterService.Flush:output_type -> ingester.v1.FlushResponse
-	13, // 32: ingester.v1.IngesterService.MergeProfilesStacktraces:output_type -> ingester.v1.MergeProfilesStacktracesResponse
-	19, // 33: ingester.v1.IngesterService.MergeProfilesLabels:output_type -> ingester.v1.MergeProfilesLabelsResponse
-	21, // 34: ingester.v1.IngesterService.MergeProfilesPprof:output_type -> ingester.v1.MergeProfilesPprofResponse
-	26, // [26:35] is the sub-list for method output_type
-	17, // [17:26] is the sub-list for method input_type
-	17, // [17:17] is the sub-list for extension type_name
-	17, // [17:17] is the sub-list for extension extendee
-	0,  // [0:17] is the sub-list for field type_name
+	30, // 0: ingester.v1.PushStreamRequest.series:type_name -> push.v1.RawProfileSeries
+	4,  // 1: ingester.v1.PushStreamResponse.acks:type_name -> ingester.v1.PushAck
+	31, // 2: ingester.v1.ProfileTypesResponse.profile_types:type_name -> types.v1.ProfileType
+	32, // 3: ingester.v1.SeriesResponse.labels_set:type_name -> types.v1.Labels
+	31, // 4: ingester.v1.SelectProfilesRequest.type:type_name -> types.v1.ProfileType
+	15, // 5: ingester.v1.MergeProfilesStacktracesRequest.request:type_name -> ingester.v1.SelectProfilesRequest
+	0,  // 6: ingester.v1.MergeProfilesStacktracesRequest.granularity:type_name -> ingester.v1.StacktraceGranularity
+	17, // 7: ingester.v1.MergeProfilesStacktracesRequest.scaling:type_name -> ingester.v1.ValueScaling
+	24, // 8: ingester.v1.MergeProfilesStacktracesResult.stacktraces:type_name -> ingester.v1.StacktraceSample
+	19, // 9: ingester.v1.MergeProfilesStacktracesResult.nodes:type_name -> ingester.v1.StacktraceNode
+	21, // 10: ingester.v1.MergeProfilesStacktracesResponse.selectedProfiles:type_name -> ingester.v1.ProfileSets
+	18, // 11: ingester.v1.MergeProfilesStacktracesResponse.result:type_name -> ingester.v1.MergeProfilesStacktracesResult
+	32, // 12: ingester.v1.ProfileSets.labelsSets:type_name -> types.v1.Labels
+	22, // 13: ingester.v1.ProfileSets.profiles:type_name -> ingester.v1.SeriesProfile
+	31, // 14: ingester.v1.Profile.type:type_name -> types.v1.ProfileType
+	33, // 15: ingester.v1.Profile.labels:type_name -> types.v1.LabelPair
+	24, // 16: ingester.v1.Profile.stacktraces:type_name -> ingester.v1.StacktraceSample
+	15, // 17: ingester.v1.MergeProfilesLabelsRequest.request:type_name -> ingester.v1.SelectProfilesRequest
+	17, // 18: ingester.v1.MergeProfilesLabelsRequest.scaling:type_name -> ingester.v1.ValueScaling
+	26, // 19: ingester.v1.MergeProfilesLabelsRequest.relabel:type_name -> ingester.v1.RelabelConfig
+	1,  // 20: ingester.v1.MergeProfilesLabelsRequest.points_aggregation:type_name -> ingester.v1.PointsAggregation
+	21, // 21: ingester.v1.MergeProfilesLabelsResponse.selectedProfiles:type_name -> ingester.v1.ProfileSets
+	34, // 22: ingester.v1.MergeProfilesLabelsResponse.series:type_name -> types.v1.Series
+	15, // 23: ingester.v1.MergeProfilesPprofRequest.request:type_name -> ingester.v1.SelectProfilesRequest
+	33, // 24: ingester.v1.MergeProfilesPprofRequest.sample_label:type_name -> types.v1.LabelPair
+	21, // 25: ingester.v1.MergeProfilesPprofResponse.selectedProfiles:type_name -> ingester.v1.ProfileSets
+	35, // 26: ingester.v1.IngesterService.Push:input_type -> push.v1.PushRequest
+	2,  // 27: ingester.v1.IngesterService.PushStream:input_type -> ingester.v1.PushStreamRequest
+	5,  // 28: ingester.v1.IngesterService.LabelValues:input_type -> ingester.v1.LabelValuesRequest
+	7,  // 29: ingester.v1.IngesterService.LabelNames:input_type -> ingester.v1.LabelNamesRequest
+	9,  // 30: ingester.v1.IngesterService.ProfileTypes:input_type -> ingester.v1.ProfileTypesRequest
+	11, // 31: ingester.v1.IngesterService.Series:input_type -> ingester.v1.SeriesRequest
+	13, // 32: ingester.v1.IngesterService.Flush:input_type -> ingester.v1.FlushRequest
+	16, // 33: ingester.v1.IngesterService.MergeProfilesStacktraces:input_type -> ingester.v1.MergeProfilesStacktracesRequest
+	25, // 34: ingester.v1.IngesterService.MergeProfilesLabels:input_type -> ingester.v1.MergeProfilesLabelsRequest
+	28, // 35: ingester.v1.IngesterService.MergeProfilesPprof:input_type -> ingester.v1.MergeProfilesPprofRequest
+	36, // 36: ingester.v1.IngesterService.Push:output_type -> push.v1.PushResponse
+	3,  // 37: ingester.v1.IngesterService.PushStream:output_type -> ingester.v1.PushStreamResponse
+	6,  // 38: ingester.v1.IngesterService.LabelValues:output_type -> ingester.v1.LabelValuesResponse
+	8,  // 39: ingester.v1.IngesterService.LabelNames:output_type -> ingester.v1.LabelNamesResponse
+	10, // 40: ingester.v1.IngesterService.ProfileTypes:output_type -> ingester.v1.ProfileTypesResponse
+	12, // 41: ingester.v1.IngesterService.Series:output_type -> ingester.v1.SeriesResponse
+	14, // 42: ingester.v1.IngesterService.Flush:output_type -> ingester.v1.FlushResponse
+	20, // 43: ingester.v1.IngesterService.MergeProfilesStacktraces:output_type -> ingester.v1.MergeProfilesStacktracesResponse
+	27, // 44: ingester.v1.IngesterService.MergeProfilesLabels:output_type -> ingester.v1.MergeProfilesLabelsResponse
+	29, // 45: ingester.v1.IngesterService.MergeProfilesPprof:output_type -> ingester.v1.MergeProfilesPprofResponse
+	36, // [36:46] is the sub-list for method output_type
+	26, // [26:36] is the sub-list for method input_type
+	26, // [26:26] is the sub-list for extension type_name
+	26, // [26:26] is the sub-list for extension extendee
+	0,  // [0:26] is the sub-list for field type_name
 }
 
 func init() { file_ingester_v1_ingester_proto_init() }
@@ -1483,7 +2323,7 @@ func file_ingester_v1_ingester_proto_init() {
 	}
 	if !protoimpl.UnsafeEnabled {
 		file_ingester_v1_ingester_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*LabelValuesRequest); i {
+			switch v := v.(*PushStreamRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1495,7 +2335,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*LabelValuesResponse); i {
+			switch v := v.(*PushStreamResponse); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1507,7 +2347,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*LabelNamesRequest); i {
+			switch v := v.(*PushAck); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1519,7 +2359,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*LabelNamesResponse); i {
+			switch v := v.(*LabelValuesRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1531,7 +2371,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*ProfileTypesRequest); i {
+			switch v := v.(*LabelValuesResponse); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1543,7 +2383,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*ProfileTypesResponse); i {
+			switch v := v.(*LabelNamesRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1555,7 +2395,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*SeriesRequest); i {
+			switch v := v.(*LabelNamesResponse); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1567,7 +2407,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*SeriesResponse); i {
+			switch v := v.(*ProfileTypesRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1579,7 +2419,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*FlushRequest); i {
+			switch v := v.(*ProfileTypesResponse); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1591,7 +2431,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*FlushResponse); i {
+			switch v := v.(*SeriesRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1603,7 +2443,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*SelectProfilesRequest); i {
+			switch v := v.(*SeriesResponse); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1615,7 +2455,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*MergeProfilesStacktracesRequest); i {
+			switch v := v.(*FlushRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1627,7 +2467,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*MergeProfilesStacktracesResult); i {
+			switch v := v.(*FlushResponse); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1639,7 +2479,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*MergeProfilesStacktracesResponse); i {
+			switch v := v.(*SelectProfilesRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1651,7 +2491,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[14].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*ProfileSets); i {
+			switch v := v.(*MergeProfilesStacktracesRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1663,7 +2503,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[15].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*SeriesProfile); i {
+			switch v := v.(*ValueScaling); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1675,7 +2515,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[16].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Profile); i {
+			switch v := v.(*MergeProfilesStacktracesResult); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1687,7 +2527,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[17].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*StacktraceSample); i {
+			switch v := v.(*StacktraceNode); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1699,7 +2539,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[18].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*MergeProfilesLabelsRequest); i {
+			switch v := v.(*MergeProfilesStacktracesResponse); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1711,7 +2551,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[19].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*MergeProfilesLabelsResponse); i {
+			switch v := v.(*ProfileSets); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1723,7 +2563,7 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[20].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*MergeProfilesPprofRequest); i {
+			switch v := v.(*SeriesProfile); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1735,6 +2575,78 @@ func file_ingester_v1_ingester_proto_init() {
 			}
 		}
 		file_ingester_v1_ingester_proto_msgTypes[21].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Profile); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ingester_v1_ingester_proto_msgTypes[22].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*StacktraceSample); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ingester_v1_ingester_proto_msgTypes[23].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MergeProfilesLabelsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ingester_v1_ingester_proto_msgTypes[24].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RelabelConfig); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ingester_v1_ingester_proto_msgTypes[25].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MergeProfilesLabelsResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ingester_v1_ingester_proto_msgTypes[26].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MergeProfilesPprofRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_ingester_v1_ingester_proto_msgTypes[27].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*MergeProfilesPprofResponse); i {
 			case 0:
 				return &v.state
@@ -1752,13 +2664,14 @@ func file_ingester_v1_ingester_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_ingester_v1_ingester_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   22,
+			NumEnums:      2,
+			NumMessages:   28,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_ingester_v1_ingester_proto_goTypes,
 		DependencyIndexes: file_ingester_v1_ingester_proto_depIdxs,
+		EnumInfos:         file_ingester_v1_ingester_proto_enumTypes,
 		MessageInfos:      file_ingester_v1_ingester_proto_msgTypes,
 	}.Build()
 	File_ingester_v1_ingester_proto = out.File
@@ -29,6 +29,8 @@ const (
 // IngesterServiceClient is a client for the ingester.v1.IngesterService service.
 type IngesterServiceClient interface {
 	Push(context.Context, *connect_go.Request[v1.PushRequest]) (*connect_go.Response[v1.PushResponse], error)
+	// PushStream ingests the batches of profiles streamed by the client, each batch is acknowledged by a response.
+	PushStream(context.Context) *connect_go.BidiStreamForClient[v11.PushStreamRequest, v11.PushStreamResponse]
 	LabelValues(context.Context, *connect_go.Request[v11.LabelValuesRequest]) (*connect_go.Response[v11.LabelValuesResponse], error)
 	LabelNames(context.Context, *connect_go.Request[v11.LabelNamesRequest]) (*connect_go.Response[v11.LabelNamesResponse], error)
 	ProfileTypes(context.Context, *connect_go.Request[v11.ProfileTypesRequest]) (*connect_go.Response[v11.ProfileTypesResponse], error)
@@ -54,6 +56,11 @@ func NewIngesterServiceClient(httpClient connect_go.HTTPClient, baseURL string,
 			baseURL+"/ingester.v1.IngesterService/Push",
 			opts...,
 		),
+		pushStream: connect_go.NewClient[v11.PushStreamRequest, v11.PushStreamResponse](
+			httpClient,
+			baseURL+"/ingester.v1.IngesterService/PushStream",
+			opts...,
+		),
 		labelValues: connect_go.NewClient[v11.LabelValuesRequest, v11.LabelValuesResponse](
 			httpClient,
 			baseURL+"/ingester.v1.IngesterService/LabelValues",
@@ -100,6 +107,7 @@ func NewIngesterServiceClient(httpClient connect_go.HTTPClient, baseURL string,
 // ingesterServiceClient implements IngesterServiceClient.
 type ingesterServiceClient struct {
 	push                     *connect_go.Client[v1.PushRequest, v1.PushResponse]
+	pushStream               *connect_go.Client[v11.PushStreamRequest, v11.PushStreamResponse]
 	labelValues              *connect_go.Client[v11.LabelValuesRequest, v11.LabelValuesResponse]
 	labelNames               *connect_go.Client[v11.LabelNamesRequest, v11.LabelNamesResponse]
 	profileTypes             *connect_go.Client[v11.ProfileTypesRequest, v11.ProfileTypesResponse]
@@ -115,6 +123,11 @@ func (c *ingesterServiceClient) Push(ctx context.Context, req *connect_go.Reques
 	return c.push.CallUnary(ctx, req)
 }
 
+// PushStream calls ingester.v1.IngesterService.PushStream.
+func (c *ingesterServiceClient) PushStream(ctx context.Context) *connect_go.BidiStreamForClient[v11.PushStreamRequest, v11.PushStreamResponse] {
+	return c.pushStream.CallBidiStream(ctx)
+}
+
 // LabelValues calls ingester.v1.IngesterService.LabelValues.
 func (c *ingesterServiceClient) LabelValues(ctx context.Context, req *connect_go.Request[v11.LabelValuesRequest]) (*connect_go.Response[v11.LabelValuesResponse], error) {
 	return c.labelValues.CallUnary(ctx, req)
@@ -158,6 +171,8 @@ func (c *ingesterServiceClient) MergeProfilesPprof(ctx context.Context) *connect
 // IngesterServiceHandler is an implementation of the ingester.v1.IngesterService service.
 type IngesterServiceHandler interface {
 	Push(context.Context, *connect_go.Request[v1.PushRequest]) (*connect_go.Response[v1.PushResponse], error)
+	// PushStream ingests the batches of profiles streamed by the client, each batch is acknowledged by a response.
+	PushStream(context.Context, *connect_go.BidiStream[v11.PushStreamRequest, v11.PushStreamResponse]) error
 	LabelValues(context.Context, *connect_go.Request[v11.LabelValuesRequest]) (*connect_go.Response[v11.LabelValuesResponse], error)
 	LabelNames(context.Context, *connect_go.Request[v11.LabelNamesRequest]) (*connect_go.Response[v11.LabelNamesResponse], error)
 	ProfileTypes(context.Context, *connect_go.Request[v11.ProfileTypesRequest]) (*connect_go.Response[v11.ProfileTypesResponse], error)
@@ -180,6 +195,11 @@ func NewIngesterServiceHandler(svc IngesterServiceHandler, opts ...connect_go.Ha
 		svc.Push,
 		opts...,
 	))
+	mux.Handle("/ingester.v1.IngesterService/PushStream", connect_go.NewBidiStreamHandler(
+		"/ingester.v1.IngesterService/PushStream",
+		svc.PushStream,
+		opts...,
+	))
 	mux.Handle("/ingester.v1.IngesterService/LabelValues", connect_go.NewUnaryHandler(
 		"/ingester.v1.IngesterService/LabelValues",
 		svc.LabelValues,
@@ -230,6 +250,10 @@ func (UnimplementedIngesterServiceHandler) Push(context.Context, *connect_go.Req
 	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.Push is not implemented"))
 }
 
+func (UnimplementedIngesterServiceHandler) PushStream(context.Context, *connect_go.BidiStream[v11.PushStreamRequest, v11.PushStreamResponse]) error {
+	return connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.PushStream is not implemented"))
+}
+
 func (UnimplementedIngesterServiceHandler) LabelValues(context.Context, *connect_go.Request[v11.LabelValuesRequest]) (*connect_go.Response[v11.LabelValuesResponse], error) {
 	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.LabelValues is not implemented"))
 }
@@ -24,6 +24,11 @@ func RegisterIngesterServiceHandler(mux *mux.Router, svc IngesterServiceHandler,
 		svc.Push,
 		opts...,
 	))
+	mux.Handle("/ingester.v1.IngesterService/PushStream", connect_go.NewBidiStreamHandler(
+		"/ingester.v1.IngesterService/PushStream",
+		svc.PushStream,
+		opts...,
+	))
 	mux.Handle("/ingester.v1.IngesterService/LabelValues", connect_go.NewUnaryHandler(
 		"/ingester.v1.IngesterService/LabelValues",
 		svc.LabelValues,
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -74,3 +75,70 @@ func blocksList(ctx context.Context) error {
 
 	return nil
 }
+
+// blockIDs returns the given block IDs, or the IDs of all blocks if none are given.
+func blockIDs(ctx context.Context, ids []string) ([]string, error) {
+	if len(ids) > 0 {
+		return ids, nil
+	}
+	bucket, err := filesystem.NewBucket(cfg.blocks.path)
+	if err != nil {
+		return nil, err
+	}
+
+	metas, err := phlaredb.NewBlockQuerier(ctx, bucket).BlockMetas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range metas {
+		ids = append(ids, meta.ULID.String())
+	}
+	return ids, nil
+}
+
+func blocksVerify(ctx context.Context, ids []string) error {
+	ids, err := blockIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	var (
+		out           = output(ctx)
+		totalProblems int
+	)
+	for _, id := range ids {
+		problems, err := phlaredb.VerifyBlock(ctx, filepath.Join(cfg.blocks.path, id))
+		if err != nil {
+			return fmt.Errorf("verifying block %s: %w", id, err)
+		}
+		for _, p := range problems {
+			fmt.Fprintf(out, "%s/%s\n", id, p)
+		}
+		totalProblems += len(problems)
+	}
+
+	if totalProblems > 0 {
+		return fmt.Errorf("found %d problem(s) in %d block(s)", totalProblems, len(ids))
+	}
+	return nil
+}
+
+func blocksInspect(ctx context.Context, ids []string) error {
+	ids, err := blockIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	infos := make([]phlaredb.BlockInfo, 0, len(ids))
+	for _, id := range ids {
+		info, err := phlaredb.InspectBlock(ctx, filepath.Join(cfg.blocks.path, id))
+		if err != nil {
+			return fmt.Errorf("inspecting block %s: %w", id, err)
+		}
+		infos = append(infos, info)
+	}
+
+	enc := json.NewEncoder(output(ctx))
+	enc.SetIndent("", "  ")
+	return enc.Encode(infos)
+}
@@ -44,6 +44,12 @@ func main() {
 	blocksListCmd := blocksCmd.Command("list", "List blocks.")
 	blocksListCmd.Flag("restore-missing-meta", "").Default("false").BoolVar(&cfg.blocks.restoreMissingMeta)
 
+	blocksVerifyCmd := blocksCmd.Command("verify", "Verify the consistency of blocks.")
+	blocksVerifyIDs := blocksVerifyCmd.Arg("block-id", "Block IDs to verify, all blocks are verified if none are given.").Strings()
+
+	blocksInspectCmd := blocksCmd.Command("inspect", "Print a JSON summary of blocks.")
+	blocksInspectIDs := blocksInspectCmd.Arg("block-id", "Block IDs to inspect, all blocks are inspected if none are given.").Strings()
+
 	parquetCmd := app.Command("parquet", "Operate on a Parquet file.")
 	parquetInspectCmd := parquetCmd.Command("inspect", "Inspect a parquet file's structure.")
 	parquetInspectFiles := parquetInspectCmd.Arg("file", "parquet file path").Required().ExistingFiles()
@@ -64,6 +70,10 @@ func main() {
 	switch parsedCmd {
 	case blocksListCmd.FullCommand():
 		os.Exit(checkError(blocksList(ctx)))
+	case blocksVerifyCmd.FullCommand():
+		os.Exit(checkError(blocksVerify(ctx, *blocksVerifyIDs)))
+	case blocksInspectCmd.FullCommand():
+		os.Exit(checkError(blocksInspect(ctx, *blocksInspectIDs)))
 	case parquetInspectCmd.FullCommand():
 		for _, file := range *parquetInspectFiles {
 			if err := parquetInspect(ctx, file); err != nil {
@@ -2,8 +2,10 @@ package ingester
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"sync"
 
 	"github.com/bufbuild/connect-go"
@@ -139,7 +141,7 @@ func (i *Ingester) GetOrCreateInstance(tenantID string) (*instance, error) { //n
 	if !ok {
 		var err error
 
-		inst, err = newInstance(i.phlarectx, i.dbConfig, tenantID, i.storageBucket, NewLimiter(tenantID, i.limits, i.lifecycler, i.cfg.LifecyclerConfig.RingConfig.ReplicationFactor))
+		inst, err = newInstance(i.phlarectx, i.dbConfig, tenantID, i.storageBucket, NewLimiter(tenantID, i.limits, i.lifecycler, i.cfg.LifecyclerConfig.RingConfig.ReplicationFactor, i.dbConfig.OutOfOrderWindow))
 		if err != nil {
 			return nil, err
 		}
@@ -197,16 +199,11 @@ func (i *Ingester) Push(ctx context.Context, req *connect.Request[pushv1.PushReq
 					return nil, err
 				}
 				if err := instance.Head().Ingest(ctx, p, id, series.Labels...); err != nil {
-					reason := validation.ReasonOf(err)
-					if reason != validation.Unknown {
-						validation.DiscardedProfiles.WithLabelValues(string(reason), instance.tenantID).Add(float64(1))
-						validation.DiscardedBytes.WithLabelValues(string(reason), instance.tenantID).Add(float64(size))
-						switch validation.ReasonOf(err) {
-						case validation.OutOfOrder:
-							return nil, connect.NewError(connect.CodeInvalidArgument, err)
-						case validation.SeriesLimit:
-							return nil, connect.NewError(connect.CodeResourceExhausted, err)
-						}
+					switch instance.discarded(err, size) {
+					case validation.OutOfOrder:
+						return nil, connect.NewError(connect.CodeInvalidArgument, err)
+					case validation.SeriesLimit:
+						return nil, connect.NewError(connect.CodeResourceExhausted, err)
 					}
 					return nil, err
 				}
@@ -217,6 +214,27 @@ func (i *Ingester) Push(ctx context.Context, req *connect.Request[pushv1.PushReq
 	})
 }
 
+// PushStream ingests the batches of profiles streamed by the client. The
+// profiles of a batch are ingested together by Head.IngestBatch and the batch
+// is acknowledged by a response, holding an ack for each of its profiles.
+// Rejected profiles are reported by their ack and don't close the stream.
+func (i *Ingester) PushStream(ctx context.Context, stream *connect.BidiStream[ingesterv1.PushStreamRequest, ingesterv1.PushStreamResponse]) error {
+	return i.forInstance(ctx, func(instance *instance) error {
+		for {
+			req, err := stream.Receive()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(&ingesterv1.PushStreamResponse{Acks: instance.pushBatch(ctx, req.Series)}); err != nil {
+				return err
+			}
+		}
+	})
+}
+
 func (i *Ingester) stopping(_ error) error {
 	errs := multierror.New()
 	errs.Add(services.StopAndAwaitTerminated(context.Background(), i.lifecycler))
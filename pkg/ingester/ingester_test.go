@@ -3,6 +3,8 @@ package ingester
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"net/http"
 	"os"
 	"runtime/pprof"
 	"testing"
@@ -19,13 +21,16 @@ import (
 	"github.com/stretchr/testify/require"
 
 	ingesterv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/ingester/v1/ingesterv1connect"
 	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 	"github.com/grafana/phlare/pkg/objstore/client"
 	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb"
+	pprofth "github.com/grafana/phlare/pkg/pprof/testhelper"
 	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/testhelper"
 )
 
 func defaultIngesterTestConfig(t testing.TB) Config {
@@ -100,11 +105,11 @@ func Test_MultitenantReadWrite(t *testing.T) {
 
 	labelNames, err := ing.LabelNames(tenant.InjectTenantID(context.Background(), "foo"), connect.NewRequest(&ingesterv1.LabelNamesRequest{}))
 	require.NoError(t, err)
-	require.Equal(t, []string{"__period_type__", "__period_unit__", "__profile_type__", "__type__", "__unit__", "foo"}, labelNames.Msg.Names)
+	require.Equal(t, []string{"__name__", "__period_type__", "__period_unit__", "__profile_type__", "__type__", "__unit__", "foo"}, labelNames.Msg.Names)
 
 	labelNames, err = ing.LabelNames(tenant.InjectTenantID(context.Background(), "buzz"), connect.NewRequest(&ingesterv1.LabelNamesRequest{}))
 	require.NoError(t, err)
-	require.Equal(t, []string{"__period_type__", "__period_unit__", "__profile_type__", "__type__", "__unit__", "buzz"}, labelNames.Msg.Names)
+	require.Equal(t, []string{"__name__", "__period_type__", "__period_unit__", "__profile_type__", "__type__", "__unit__", "buzz"}, labelNames.Msg.Names)
 
 	labelsValues, err := ing.LabelValues(tenant.InjectTenantID(context.Background(), "foo"), connect.NewRequest(&ingesterv1.LabelValuesRequest{Name: "foo"}))
 	require.NoError(t, err)
@@ -116,3 +121,91 @@ func Test_MultitenantReadWrite(t *testing.T) {
 
 	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
 }
+
+func Test_PushStream(t *testing.T) {
+	dbPath := t.TempDir()
+	ctx := phlarecontext.WithLogger(context.Background(), log.NewNopLogger())
+	ctx = phlarecontext.WithRegistry(ctx, prometheus.NewRegistry())
+	fs, err := client.NewBucket(ctx, client.Config{
+		StorageBackendConfig: client.StorageBackendConfig{
+			Backend:    client.Filesystem,
+			Filesystem: filesystem.Config{Directory: dbPath},
+		},
+	}, "storage")
+	require.NoError(t, err)
+
+	ing, err := New(ctx, defaultIngesterTestConfig(t), phlaredb.Config{
+		DataPath:         dbPath,
+		MaxBlockDuration: 30 * time.Hour,
+	}, fs, &fakeLimits{})
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+	defer func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle(ingesterv1connect.NewIngesterServiceHandler(ing))
+	serv := testhelper.NewInMemoryServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r.WithContext(tenant.InjectTenantID(r.Context(), "foo")))
+	}))
+	defer serv.Close()
+	stream := ingesterv1connect.NewIngesterServiceClient(serv.Client(), serv.URL()).PushStream(context.Background())
+
+	// the nine profiles of three streams are pushed in batches of three
+	streams := []string{"stream-a", "stream-b", "stream-c"}
+	sample := func(i int) (*pushv1.RawSample, []string) {
+		p := pprofth.NewProfileBuilder(time.Second.Nanoseconds() * int64(i)).CPUProfile()
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+		p.ForStacktraceString("func1").AddSamples(20)
+		raw, err := p.Profile.MarshalVT()
+		require.NoError(t, err)
+		return &pushv1.RawSample{
+			ID:         fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			RawProfile: raw,
+		}, []string{"job", "foo", "stream", streams[i%3]}
+	}
+	for batch := 0; batch < 3; batch++ {
+		req := &ingesterv1.PushStreamRequest{}
+		var expected []string
+		for i := batch * 3; i < batch*3+3; i++ {
+			s, lbls := sample(i)
+			req.Series = append(req.Series, &pushv1.RawProfileSeries{
+				Labels:  phlaremodel.LabelsFromStrings(lbls...),
+				Samples: []*pushv1.RawSample{s},
+			})
+			expected = append(expected, s.ID)
+		}
+		// a broken profile is rejected on its own, without closing the stream
+		if batch == 1 {
+			req.Series[1].Samples = append(req.Series[1].Samples, &pushv1.RawSample{
+				ID:         "00000000-0000-0000-0000-000000000042",
+				RawProfile: []byte("not a profile"),
+			})
+			expected = []string{expected[0], expected[1], "00000000-0000-0000-0000-000000000042", expected[2]}
+		}
+		require.NoError(t, stream.Send(req))
+
+		resp, err := stream.Receive()
+		require.NoError(t, err)
+		require.Len(t, resp.Acks, len(expected))
+		for idx, ack := range resp.Acks {
+			require.Equal(t, expected[idx], ack.ID)
+			if ack.ID == "00000000-0000-0000-0000-000000000042" {
+				require.NotEmpty(t, ack.Error)
+				continue
+			}
+			require.Empty(t, ack.Error)
+		}
+	}
+	require.NoError(t, stream.CloseRequest())
+	_, err = stream.Receive()
+	require.Error(t, err)
+	require.NoError(t, stream.CloseResponse())
+
+	inst, ok := ing.getInstanceByID("foo")
+	require.True(t, ok)
+	stats := inst.Head().Stats()
+	require.Equal(t, uint64(9), stats.NumProfiles)
+	require.Equal(t, uint64(3), stats.NumSeries)
+}
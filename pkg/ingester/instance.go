@@ -8,13 +8,18 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 
+	ingesterv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
 	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb"
 	"github.com/grafana/phlare/pkg/phlaredb/block"
 	"github.com/grafana/phlare/pkg/phlaredb/shipper"
+	"github.com/grafana/phlare/pkg/pprof"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 type instance struct {
@@ -103,3 +108,64 @@ func (i *instance) Stop() error {
 	i.wg.Wait()
 	return err
 }
+
+// pushBatch ingests the profiles of the series and returns their acks, in
+// the order of the samples of the series.
+func (i *instance) pushBatch(ctx context.Context, series []*pushv1.RawProfileSeries) []*ingesterv1.PushAck {
+	var (
+		acks   []*ingesterv1.PushAck
+		inputs []phlaredb.IngestInput
+		// ack and size of the inputs by their index
+		inputAcks  []*ingesterv1.PushAck
+		inputSizes []int
+	)
+	for _, s := range series {
+		for _, sample := range s.Samples {
+			ack := &ingesterv1.PushAck{ID: sample.ID}
+			acks = append(acks, ack)
+			p, size, err := pprof.FromBytes(sample.RawProfile)
+			if err != nil {
+				ack.Error = err.Error()
+				continue
+			}
+			id, err := uuid.Parse(sample.ID)
+			if err != nil {
+				ack.Error = err.Error()
+				p.ReturnToVTPool()
+				continue
+			}
+			inputs = append(inputs, phlaredb.IngestInput{Profile: p, ID: id, ExternalLabels: s.Labels})
+			inputAcks = append(inputAcks, ack)
+			inputSizes = append(inputSizes, size)
+		}
+	}
+	if len(inputs) == 0 {
+		return acks
+	}
+
+	results, err := i.Head().IngestBatchResults(ctx, inputs)
+	for idx, in := range inputs {
+		in.Profile.ReturnToVTPool()
+		// the profiles of a failed batch are rejected alike
+		profileErr := err
+		if profileErr == nil {
+			profileErr = results[idx]
+		}
+		if profileErr != nil {
+			i.discarded(profileErr, inputSizes[idx])
+			inputAcks[idx].Error = profileErr.Error()
+		}
+	}
+	return acks
+}
+
+// discarded counts a profile rejected by the head as discarded, if the
+// rejection has a known reason, and returns that reason.
+func (i *instance) discarded(err error, size int) validation.Reason {
+	reason := validation.ReasonOf(err)
+	if reason != validation.Unknown {
+		validation.DiscardedProfiles.WithLabelValues(string(reason), i.tenantID).Add(float64(1))
+		validation.DiscardedBytes.WithLabelValues(string(reason), i.tenantID).Add(float64(size))
+	}
+	return reason
+}
@@ -28,7 +28,12 @@ type Limits interface {
 type Limiter interface {
 	// AllowProfile returns an error if the profile is not allowed to be ingested.
 	// The error is a validation error and can be out of order or max series limit reached.
+	// Profiles are out of order, if older than the out of order window compared to the
+	// latest profile of their series, across all heads of the tenant.
 	AllowProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNano int64) error
+	// CheckProfile returns the error AllowProfile would return, without
+	// recording the series or the timestamp of the profile.
+	CheckProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNano int64) error
 	Stop()
 }
 
@@ -37,6 +42,7 @@ type limiter struct {
 	ring              RingCount
 	replicationFactor int
 	tenantID          string
+	outOfOrderWindow  time.Duration
 
 	activeSeries  map[model.Fingerprint]int64
 	lastTimestamp map[model.Fingerprint]int64
@@ -48,7 +54,7 @@ type limiter struct {
 	wg     sync.WaitGroup
 }
 
-func NewLimiter(tenantID string, limits Limits, ring RingCount, replicationFactor int) Limiter {
+func NewLimiter(tenantID string, limits Limits, ring RingCount, replicationFactor int, outOfOrderWindow time.Duration) Limiter {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	l := &limiter{
@@ -56,6 +62,7 @@ func NewLimiter(tenantID string, limits Limits, ring RingCount, replicationFacto
 		limits:            limits,
 		ring:              ring,
 		replicationFactor: replicationFactor,
+		outOfOrderWindow:  outOfOrderWindow,
 		activeSeries:      map[model.Fingerprint]int64{},
 		lastTimestamp:     map[model.Fingerprint]int64{},
 		cancel:            cancel,
@@ -111,28 +118,41 @@ func (l *limiter) AllowProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsN
 	return l.allowNewSeries(fp)
 }
 
+func (l *limiter) CheckProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNano int64) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if err := l.checkNewProfile(fp, lbs, tsNano); err != nil {
+		return err
+	}
+	return l.checkNewSeries(fp)
+}
+
 func (l *limiter) allowNewProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNano int64) error {
+	if err := l.checkNewProfile(fp, lbs, tsNano); err != nil {
+		return err
+	}
+
+	// set the last timestamp
+	if max, ok := l.lastTimestamp[fp]; !ok || tsNano > max {
+		l.lastTimestamp[fp] = tsNano
+	}
+	return nil
+}
+
+func (l *limiter) checkNewProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNano int64) error {
 	max, ok := l.lastTimestamp[fp]
 	if ok {
-		// profile is before the last timestamp
-		if tsNano < max {
+		// profile is before the last timestamp, beyond the out of order window
+		if tsNano < max-int64(l.outOfOrderWindow) {
 			return validation.NewErrorf(validation.OutOfOrder, "profile for series %s out of order (received %s last %s)", phlaremodel.LabelPairsString(lbs), time.Unix(0, tsNano), time.Unix(0, max))
 		}
 	}
-
-	// set the last timestamp
-	l.lastTimestamp[fp] = tsNano
 	return nil
 }
 
 func (l *limiter) allowNewSeries(fp model.Fingerprint) error {
-	_, ok := l.activeSeries[fp]
-	series := len(l.activeSeries)
-	if !ok {
-		// can this series be added?
-		if err := l.assertMaxSeriesPerUser(l.tenantID, series); err != nil {
-			return err
-		}
+	if err := l.checkNewSeries(fp); err != nil {
+		return err
 	}
 
 	// update time or add it
@@ -140,6 +160,14 @@ func (l *limiter) allowNewSeries(fp model.Fingerprint) error {
 	return nil
 }
 
+func (l *limiter) checkNewSeries(fp model.Fingerprint) error {
+	if _, ok := l.activeSeries[fp]; ok {
+		return nil
+	}
+	// can this series be added?
+	return l.assertMaxSeriesPerUser(l.tenantID, len(l.activeSeries))
+}
+
 func (l *limiter) assertMaxSeriesPerUser(tenantID string, series int) error {
 	// Start by setting the local limit either from override or default
 	localLimit := l.limits.MaxLocalSeriesPerTenant(tenantID)
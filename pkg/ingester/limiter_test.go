@@ -9,6 +9,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 type fakeLimits struct {
@@ -33,7 +34,7 @@ func (f *fakeRingCount) HealthyInstancesCount() int {
 }
 
 func TestOutOfOrder(t *testing.T) {
-	limiter := NewLimiter("foo", &fakeLimits{}, &fakeRingCount{1}, 1)
+	limiter := NewLimiter("foo", &fakeLimits{}, &fakeRingCount{1}, 1, 0)
 	defer limiter.Stop()
 
 	// First push should be allowed.
@@ -48,13 +49,30 @@ func TestOutOfOrder(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestOutOfOrderWindow(t *testing.T) {
+	limiter := NewLimiter("foo", &fakeLimits{}, &fakeRingCount{1}, 1, 10)
+	defer limiter.Stop()
+
+	require.NoError(t, limiter.AllowProfile(1, phlaremodel.LabelsFromStrings("foo", "bar"), 20))
+	// within the window of the latest profile
+	require.NoError(t, limiter.AllowProfile(1, phlaremodel.LabelsFromStrings("foo", "bar"), 10))
+	require.NoError(t, limiter.CheckProfile(1, phlaremodel.LabelsFromStrings("foo", "bar"), 10))
+	// the latest profile is not moved back by older profiles
+	require.Error(t, limiter.CheckProfile(1, phlaremodel.LabelsFromStrings("foo", "bar"), 9))
+	err := limiter.AllowProfile(1, phlaremodel.LabelsFromStrings("foo", "bar"), 9)
+	require.Error(t, err)
+	require.Equal(t, validation.OutOfOrder, validation.ReasonOf(err))
+	// other series are not affected
+	require.NoError(t, limiter.AllowProfile(2, phlaremodel.LabelsFromStrings("foo", "baz"), 1))
+}
+
 func TestGlobalMaxSeries(t *testing.T) {
 	// 5 series per user, 2 ingesters, replication factor 3.
 	// We should be able to push 7.5 series. (5 / 2 * 3 = 7.5)
 	activeSeriesTimeout = 200 * time.Millisecond
 	activeSeriesCleanup = 100 * time.Millisecond
 
-	limiter := NewLimiter("foo", &fakeLimits{maxGlobalSeriesPerTenant: 5}, &fakeRingCount{2}, 3)
+	limiter := NewLimiter("foo", &fakeLimits{maxGlobalSeriesPerTenant: 5}, &fakeRingCount{2}, 3, 0)
 	defer limiter.Stop()
 
 	for i := 0; i < 7; i++ {
@@ -79,7 +97,7 @@ func TestLocalLimit(t *testing.T) {
 	activeSeriesTimeout = 200 * time.Millisecond
 	activeSeriesCleanup = 100 * time.Millisecond
 
-	limiter := NewLimiter("foo", &fakeLimits{maxGlobalSeriesPerTenant: 5, maxLocalSeriesPerTenant: 1}, &fakeRingCount{2}, 3)
+	limiter := NewLimiter("foo", &fakeLimits{maxGlobalSeriesPerTenant: 5, maxLocalSeriesPerTenant: 1}, &fakeRingCount{2}, 3, 0)
 	defer limiter.Stop()
 
 	// local limit of 1 series should take precedence over global limit of 5 series.
@@ -90,3 +108,16 @@ func TestLocalLimit(t *testing.T) {
 	err = limiter.AllowProfile(2, phlaremodel.LabelsFromStrings("i", "2"), 0)
 	require.Error(t, err)
 }
+
+func TestCheckProfile(t *testing.T) {
+	limiter := NewLimiter("foo", &fakeLimits{maxLocalSeriesPerTenant: 1}, &fakeRingCount{1}, 1, 0)
+	defer limiter.Stop()
+
+	// checking a series doesn't make it active
+	require.NoError(t, limiter.CheckProfile(1, phlaremodel.LabelsFromStrings("i", "1"), 0))
+	require.NoError(t, limiter.CheckProfile(2, phlaremodel.LabelsFromStrings("i", "2"), 0))
+
+	require.NoError(t, limiter.AllowProfile(1, phlaremodel.LabelsFromStrings("i", "1"), 0))
+	require.NoError(t, limiter.CheckProfile(1, phlaremodel.LabelsFromStrings("i", "1"), 0))
+	require.Error(t, limiter.CheckProfile(2, phlaremodel.LabelsFromStrings("i", "2"), 0))
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"regexp"
 	"strings"
 
 	"github.com/gogo/status"
@@ -20,13 +21,27 @@ func CompareProfile(a, b *ingestv1.Profile) int64 {
 	return a.Timestamp - b.Timestamp
 }
 
-// ParseProfileTypeSelector parses the profile selector string.
+// profileTypeSegments names the segments of a profile type selector.
+var profileTypeSegments = []string{"name", "sample-type", "sample-unit", "period-type", "period-unit"}
+
+// ParseProfileTypeSelector parses the profile selector string of the form
+// <name>:<sample-type>:<sample-unit>:<period-type>:<period-unit>, optionally
+// followed by :delta. It returns an InvalidArgument error for malformed
+// selectors.
 func ParseProfileTypeSelector(id string) (*typesv1.ProfileType, error) {
 	parts := strings.Split(id, ":")
 
 	if len(parts) != 5 && len(parts) != 6 {
 		return nil, status.Errorf(codes.InvalidArgument, "profile-type selection must be of the form <name>:<sample-type>:<sample-unit>:<period-type>:<period-unit>(:delta), got(%d): %q", len(parts), id)
 	}
+	for i, segment := range profileTypeSegments {
+		if parts[i] == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "profile-type selection has an empty %s: %q", segment, id)
+		}
+	}
+	if len(parts) == 6 && parts[5] != "delta" {
+		return nil, status.Errorf(codes.InvalidArgument, "profile-type selection can only be suffixed by :delta, got %q: %q", parts[5], id)
+	}
 	name, sampleType, sampleUnit, periodType, periodUnit := parts[0], parts[1], parts[2], parts[3], parts[4]
 	return &typesv1.ProfileType{
 		Name:       name,
@@ -38,13 +53,38 @@ func ParseProfileTypeSelector(id string) (*typesv1.ProfileType, error) {
 	}, nil
 }
 
-// SelectorFromProfileType builds a *label.Matcher from an profile type struct
+// SelectorFromProfileType builds a *label.Matcher from an profile type struct.
+// Empty segments of the profile type match any value. It returns nil, if the
+// profile type is nil or all of its segments are empty.
 func SelectorFromProfileType(profileType *typesv1.ProfileType) *labels.Matcher {
-	return &labels.Matcher{
-		Type:  labels.MatchEqual,
-		Name:  LabelNameProfileType,
-		Value: profileType.Name + ":" + profileType.SampleType + ":" + profileType.SampleUnit + ":" + profileType.PeriodType + ":" + profileType.PeriodUnit,
+	if profileType == nil {
+		return nil
+	}
+	segments := []string{profileType.Name, profileType.SampleType, profileType.SampleUnit, profileType.PeriodType, profileType.PeriodUnit}
+	var empty int
+	for _, s := range segments {
+		if s == "" {
+			empty++
+		}
+	}
+	switch empty {
+	case 0:
+		return &labels.Matcher{
+			Type:  labels.MatchEqual,
+			Name:  LabelNameProfileType,
+			Value: strings.Join(segments, ":"),
+		}
+	case len(segments):
+		return nil
 	}
+	for i, s := range segments {
+		if s == "" {
+			segments[i] = "[^:]*"
+			continue
+		}
+		segments[i] = regexp.QuoteMeta(s)
+	}
+	return labels.MustNewMatcher(labels.MatchRegexp, LabelNameProfileType, strings.Join(segments, ":"))
 }
 
 // SetProfileMetadata sets the metadata on the profile.
@@ -61,3 +101,69 @@ func SetProfileMetadata(p *profile.Profile, ty *typesv1.ProfileType) {
 		p.Period = 1
 	}
 }
+
+// PrunedFunctionName is the name of the function of the sample aggregating
+// the values of the samples dropped by PruneProfile.
+const PrunedFunctionName = "other"
+
+// PruneProfile drops the samples of the profile with a value below minValue
+// or below minPercent (0-100) of the total value of the first sample type.
+// The returned profile is compacted, so locations, functions and mappings
+// referenced only by dropped samples are removed as well. If aggregate is
+// set, the values of the dropped samples are added to a sample with a single
+// location of the function PrunedFunctionName, so the total value is
+// preserved.
+func PruneProfile(p *profile.Profile, minValue int64, minPercent float64, aggregate bool) *profile.Profile {
+	if p == nil || len(p.Sample) == 0 || len(p.SampleType) == 0 || (minValue <= 0 && minPercent <= 0) {
+		return p
+	}
+
+	var total int64
+	for _, s := range p.Sample {
+		total += s.Value[0]
+	}
+	threshold := float64(minValue)
+	if t := float64(total) * minPercent / 100; t > threshold {
+		threshold = t
+	}
+
+	var (
+		kept   = make([]*profile.Sample, 0, len(p.Sample))
+		pruned = make([]int64, len(p.SampleType))
+		n      int
+	)
+	for _, s := range p.Sample {
+		if float64(s.Value[0]) >= threshold {
+			kept = append(kept, s)
+			continue
+		}
+		for i, v := range s.Value {
+			pruned[i] += v
+		}
+		n++
+	}
+	if n == 0 {
+		return p
+	}
+	p.Sample = kept
+
+	if aggregate {
+		var maxLocationID, maxFunctionID uint64
+		for _, l := range p.Location {
+			if l.ID > maxLocationID {
+				maxLocationID = l.ID
+			}
+		}
+		for _, f := range p.Function {
+			if f.ID > maxFunctionID {
+				maxFunctionID = f.ID
+			}
+		}
+		fn := &profile.Function{ID: maxFunctionID + 1, Name: PrunedFunctionName, SystemName: PrunedFunctionName}
+		loc := &profile.Location{ID: maxLocationID + 1, Line: []profile.Line{{Function: fn}}}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		p.Sample = append(p.Sample, &profile.Sample{Location: []*profile.Location{loc}, Value: pruned})
+	}
+	return p.Compact()
+}
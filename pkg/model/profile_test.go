@@ -0,0 +1,127 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+func TestParseProfileTypeSelector(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		in       string
+		expected *typesv1.ProfileType
+		err      string
+	}{
+		{
+			name: "cpu",
+			in:   "process_cpu:cpu:nanoseconds:cpu:nanoseconds",
+			expected: &typesv1.ProfileType{
+				ID:         "process_cpu:cpu:nanoseconds:cpu:nanoseconds",
+				Name:       "process_cpu",
+				SampleType: "cpu",
+				SampleUnit: "nanoseconds",
+				PeriodType: "cpu",
+				PeriodUnit: "nanoseconds",
+			},
+		},
+		{
+			name: "heap",
+			in:   "memory:inuse_space:bytes:space:bytes",
+			expected: &typesv1.ProfileType{
+				ID:         "memory:inuse_space:bytes:space:bytes",
+				Name:       "memory",
+				SampleType: "inuse_space",
+				SampleUnit: "bytes",
+				PeriodType: "space",
+				PeriodUnit: "bytes",
+			},
+		},
+		{
+			name: "goroutine",
+			in:   "goroutines:goroutine:count:goroutine:count",
+			expected: &typesv1.ProfileType{
+				ID:         "goroutines:goroutine:count:goroutine:count",
+				Name:       "goroutines",
+				SampleType: "goroutine",
+				SampleUnit: "count",
+				PeriodType: "goroutine",
+				PeriodUnit: "count",
+			},
+		},
+		{
+			name: "delta",
+			in:   "memory:alloc_space:bytes:space:bytes:delta",
+			expected: &typesv1.ProfileType{
+				ID:         "memory:alloc_space:bytes:space:bytes:delta",
+				Name:       "memory",
+				SampleType: "alloc_space",
+				SampleUnit: "bytes",
+				PeriodType: "space",
+				PeriodUnit: "bytes",
+			},
+		},
+		{
+			name: "empty",
+			in:   "",
+			err:  `rpc error: code = InvalidArgument desc = profile-type selection must be of the form <name>:<sample-type>:<sample-unit>:<period-type>:<period-unit>(:delta), got(1): ""`,
+		},
+		{
+			name: "too few segments",
+			in:   "process_cpu:cpu:nanoseconds",
+			err:  `rpc error: code = InvalidArgument desc = profile-type selection must be of the form <name>:<sample-type>:<sample-unit>:<period-type>:<period-unit>(:delta), got(3): "process_cpu:cpu:nanoseconds"`,
+		},
+		{
+			name: "too many segments",
+			in:   "process_cpu:cpu:nanoseconds:cpu:nanoseconds:delta:foo",
+			err:  `rpc error: code = InvalidArgument desc = profile-type selection must be of the form <name>:<sample-type>:<sample-unit>:<period-type>:<period-unit>(:delta), got(7): "process_cpu:cpu:nanoseconds:cpu:nanoseconds:delta:foo"`,
+		},
+		{
+			name: "empty name",
+			in:   ":cpu:nanoseconds:cpu:nanoseconds",
+			err:  `rpc error: code = InvalidArgument desc = profile-type selection has an empty name: ":cpu:nanoseconds:cpu:nanoseconds"`,
+		},
+		{
+			name: "empty period unit",
+			in:   "process_cpu:cpu:nanoseconds:cpu:",
+			err:  `rpc error: code = InvalidArgument desc = profile-type selection has an empty period-unit: "process_cpu:cpu:nanoseconds:cpu:"`,
+		},
+		{
+			name: "unknown suffix",
+			in:   "process_cpu:cpu:nanoseconds:cpu:nanoseconds:cumulative",
+			err:  `rpc error: code = InvalidArgument desc = profile-type selection can only be suffixed by :delta, got "cumulative": "process_cpu:cpu:nanoseconds:cpu:nanoseconds:cumulative"`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ParseProfileTypeSelector(tc.in)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestSelectorFromProfileType(t *testing.T) {
+	require.Nil(t, SelectorFromProfileType(nil))
+	require.Nil(t, SelectorFromProfileType(&typesv1.ProfileType{}))
+
+	m := SelectorFromProfileType(&typesv1.ProfileType{
+		Name:       "process_cpu",
+		SampleType: "cpu",
+		SampleUnit: "nanoseconds",
+		PeriodType: "cpu",
+		PeriodUnit: "nanoseconds",
+	})
+	require.Equal(t, `__profile_type__="process_cpu:cpu:nanoseconds:cpu:nanoseconds"`, m.String())
+
+	m = SelectorFromProfileType(&typesv1.ProfileType{Name: "memory", PeriodType: "space", PeriodUnit: "bytes"})
+	require.True(t, m.Matches("memory:inuse_space:bytes:space:bytes"))
+	require.True(t, m.Matches("memory:alloc_objects:count:space:bytes"))
+	require.False(t, m.Matches("process_cpu:cpu:nanoseconds:cpu:nanoseconds"))
+}
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+// relabelConfigYAML is the YAML representation of a Prometheus relabel config.
+type relabelConfigYAML struct {
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        string   `yaml:"regex,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+	Action       string   `yaml:"action,omitempty"`
+}
+
+// RelabelConfigs converts the relabel configs of a request into Prometheus
+// relabel configs. They are validated and defaulted the same way as the
+// relabel configs of a Prometheus configuration file.
+func RelabelConfigs(cfgs []*ingestv1.RelabelConfig) ([]*relabel.Config, error) {
+	result := make([]*relabel.Config, 0, len(cfgs))
+	for i, c := range cfgs {
+		b, err := yaml.Marshal(relabelConfigYAML{
+			SourceLabels: c.SourceLabels,
+			Separator:    c.Separator,
+			Regex:        c.Regex,
+			TargetLabel:  c.TargetLabel,
+			Replacement:  c.Replacement,
+			Action:       c.Action,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var rc relabel.Config
+		if err := yaml.UnmarshalStrict(b, &rc); err != nil {
+			return nil, fmt.Errorf("invalid relabel config %d: %w", i, err)
+		}
+		result = append(result, &rc)
+	}
+	return result, nil
+}
+
+// Relabel applies the relabel configs to the labels. It returns false if the
+// labels are dropped.
+func Relabel(ls Labels, cfgs ...*relabel.Config) (Labels, bool) {
+	if len(cfgs) == 0 {
+		return ls, true
+	}
+	relabeled := relabel.Process(ls.ToPrometheusLabels(), cfgs...)
+	if relabeled == nil {
+		return nil, false
+	}
+	result := make(Labels, len(relabeled))
+	for i, l := range relabeled {
+		result[i] = &typesv1.LabelPair{Name: l.Name, Value: l.Value}
+	}
+	return result, true
+}
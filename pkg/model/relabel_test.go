@@ -0,0 +1,33 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+)
+
+func TestRelabel(t *testing.T) {
+	cfgs, err := RelabelConfigs([]*ingestv1.RelabelConfig{
+		// defaults to replace the whole value
+		{SourceLabels: []string{"job", "stream"}, TargetLabel: "service"},
+		{SourceLabels: []string{"stream"}, Regex: "stream-(.*)", TargetLabel: "stream", Replacement: "$1"},
+		{SourceLabels: []string{"job"}, Regex: "drop-.*", Action: "drop"},
+	})
+	require.NoError(t, err)
+
+	relabeled, ok := Relabel(LabelsFromStrings("job", "foo", "stream", "stream-a"), cfgs...)
+	require.True(t, ok)
+	require.Equal(t, LabelsFromStrings("job", "foo", "service", "foo;stream-a", "stream", "a"), relabeled)
+
+	_, ok = Relabel(LabelsFromStrings("job", "drop-me", "stream", "stream-a"), cfgs...)
+	require.False(t, ok)
+
+	_, err = RelabelConfigs([]*ingestv1.RelabelConfig{{SourceLabels: []string{"job"}}})
+	require.Error(t, err, "replace requires a target label")
+	_, err = RelabelConfigs([]*ingestv1.RelabelConfig{{TargetLabel: "foo", Action: "unknown"}})
+	require.Error(t, err)
+	_, err = RelabelConfigs([]*ingestv1.RelabelConfig{{TargetLabel: "foo", Regex: "("}})
+	require.Error(t, err)
+}
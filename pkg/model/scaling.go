@@ -0,0 +1,68 @@
+package model
+
+import (
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+const percentUnit = "percent"
+
+// scalingFactor returns the factor and the unit of the scaled values, total
+// is the total value used in percent mode.
+func scalingFactor(scaling *ingestv1.ValueScaling, total float64) (float64, string) {
+	if scaling.Percent {
+		unit := scaling.Unit
+		if unit == "" {
+			unit = percentUnit
+		}
+		if total == 0 {
+			return 0, unit
+		}
+		return 100 / total, unit
+	}
+	if scaling.Factor == 0 {
+		return 1, scaling.Unit
+	}
+	return scaling.Factor, scaling.Unit
+}
+
+// ScaleStacktraces sets the scaled value of each stacktrace and the unit of
+// the result. In percent mode the values are converted into percent of the
+// total value of the result. It does nothing if scaling is nil.
+func ScaleStacktraces(r *ingestv1.MergeProfilesStacktracesResult, scaling *ingestv1.ValueScaling) {
+	if r == nil || scaling == nil {
+		return
+	}
+	var total int64
+	for _, s := range r.Stacktraces {
+		total += s.Value
+	}
+	factor, unit := scalingFactor(scaling, float64(total))
+	r.Unit = unit
+	for _, s := range r.Stacktraces {
+		s.ScaledValue = float64(s.Value) * factor
+	}
+}
+
+// ScaleSeries scales the values of the points of all series in place and
+// returns the unit of the scaled values. In percent mode the values are
+// converted into percent of the total value of all points. It does nothing
+// if scaling is nil.
+func ScaleSeries(series []*typesv1.Series, scaling *ingestv1.ValueScaling) string {
+	if scaling == nil {
+		return ""
+	}
+	var total float64
+	for _, s := range series {
+		for _, p := range s.Points {
+			total += p.Value
+		}
+	}
+	factor, unit := scalingFactor(scaling, total)
+	for _, s := range series {
+		for _, p := range s.Points {
+			p.Value *= factor
+		}
+	}
+	return unit
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+func TestScaleSeries(t *testing.T) {
+	newSeries := func() []*typesv1.Series {
+		return []*typesv1.Series{
+			{Labels: LabelsFromStrings("foo", "a"), Points: []*typesv1.Point{{Timestamp: 1, Value: 1e6}, {Timestamp: 2, Value: 3e6}}},
+			{Labels: LabelsFromStrings("foo", "b"), Points: []*typesv1.Point{{Timestamp: 1, Value: 4e6}}},
+		}
+	}
+	values := func(series []*typesv1.Series) []float64 {
+		var result []float64
+		for _, s := range series {
+			for _, p := range s.Points {
+				result = append(result, p.Value)
+			}
+		}
+		return result
+	}
+
+	for _, tc := range []struct {
+		name     string
+		scaling  *ingestv1.ValueScaling
+		unit     string
+		expected []float64
+	}{
+		{
+			name:     "no scaling",
+			expected: []float64{1e6, 3e6, 4e6},
+		},
+		{
+			name:     "factor",
+			scaling:  &ingestv1.ValueScaling{Factor: 1e-6, Unit: "milliseconds"},
+			unit:     "milliseconds",
+			expected: []float64{1, 3, 4},
+		},
+		{
+			name:     "zero factor keeps the values",
+			scaling:  &ingestv1.ValueScaling{Unit: "nanoseconds"},
+			unit:     "nanoseconds",
+			expected: []float64{1e6, 3e6, 4e6},
+		},
+		{
+			name:     "percent",
+			scaling:  &ingestv1.ValueScaling{Percent: true, Factor: 42},
+			unit:     "percent",
+			expected: []float64{12.5, 37.5, 50},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			series := newSeries()
+			require.Equal(t, tc.unit, ScaleSeries(series, tc.scaling))
+			require.Equal(t, tc.expected, values(series))
+		})
+	}
+}
+
+func TestScaleStacktracesPercentOfEmptyResult(t *testing.T) {
+	r := &ingestv1.MergeProfilesStacktracesResult{
+		Stacktraces: []*ingestv1.StacktraceSample{{FunctionIds: []int32{0}, Value: 0}},
+	}
+	ScaleStacktraces(r, &ingestv1.ValueScaling{Percent: true})
+	require.Equal(t, "percent", r.Unit)
+	require.Zero(t, r.Stacktraces[0].ScaledValue)
+}
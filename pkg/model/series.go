@@ -5,6 +5,7 @@ import (
 
 	"github.com/samber/lo"
 
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 )
 
@@ -38,3 +39,67 @@ func MergeSeries(series ...[]*typesv1.Series) []*typesv1.Series {
 	}
 	return result
 }
+
+// FilterSeriesByValues keeps the series with one of the included values for a
+// label of by and drops the series with one of the excluded values. All series
+// are kept when include is empty.
+func FilterSeriesByValues(series []*typesv1.Series, by, include, exclude []string) []*typesv1.Series {
+	if len(include) == 0 && len(exclude) == 0 {
+		return series
+	}
+	contains := func(s *typesv1.Series, values []string) bool {
+		for _, name := range by {
+			if lo.Contains(values, Labels(s.Labels).Get(name)) {
+				return true
+			}
+		}
+		return false
+	}
+	return lo.Filter(series, func(s *typesv1.Series, _ int) bool {
+		if len(include) > 0 && !contains(s, include) {
+			return false
+		}
+		return !contains(s, exclude)
+	})
+}
+
+// DownsampleSeries limits each series to at most maxPoints points. The time
+// range from start to end is split into maxPoints buckets of equal duration,
+// the points of a bucket are aggregated into a single point at the start of
+// the bucket. The points of the series must be sorted by timestamp. It does
+// nothing if maxPoints is not positive.
+func DownsampleSeries(series []*typesv1.Series, start, end, maxPoints int64, aggregation ingestv1.PointsAggregation) {
+	if maxPoints <= 0 || end < start {
+		return
+	}
+	width := (end - start + maxPoints) / maxPoints // the buckets cover start to end inclusive
+	bucketStart := func(ts int64) int64 {
+		idx := (ts - start) / width
+		if idx < 0 {
+			idx = 0
+		} else if idx >= maxPoints {
+			idx = maxPoints - 1
+		}
+		return start + idx*width
+	}
+	for _, s := range series {
+		points := make([]*typesv1.Point, 0, lo.Min([]int64{maxPoints, int64(len(s.Points))}))
+		for _, p := range s.Points {
+			ts := bucketStart(p.Timestamp)
+			if len(points) == 0 || points[len(points)-1].Timestamp != ts {
+				points = append(points, &typesv1.Point{Timestamp: ts, Value: p.Value})
+				continue
+			}
+			last := points[len(points)-1]
+			switch aggregation {
+			case ingestv1.PointsAggregation_POINTS_AGGREGATION_MAX:
+				if p.Value > last.Value {
+					last.Value = p.Value
+				}
+			default:
+				last.Value += p.Value
+			}
+		}
+		s.Points = points
+	}
+}
@@ -3,6 +3,9 @@ package model
 import (
 	"testing"
 
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	"github.com/grafana/phlare/pkg/testhelper"
 )
@@ -55,3 +58,85 @@ func TestMergeSeries(t *testing.T) {
 		})
 	}
 }
+
+func TestFilterSeriesByValues(t *testing.T) {
+	series := []*typesv1.Series{
+		{Labels: LabelsFromStrings("stream", "a", "job", "x")},
+		{Labels: LabelsFromStrings("stream", "b", "job", "y")},
+		{Labels: LabelsFromStrings("stream", "c", "job", "z")},
+	}
+	streams := func(series []*typesv1.Series) []string {
+		var result []string
+		for _, s := range series {
+			result = append(result, Labels(s.Labels).Get("stream"))
+		}
+		return result
+	}
+
+	for _, tc := range []struct {
+		name             string
+		by               []string
+		include, exclude []string
+		expected         []string
+	}{
+		{name: "no filter", by: []string{"stream"}, expected: []string{"a", "b", "c"}},
+		{name: "include", by: []string{"stream"}, include: []string{"a", "c"}, expected: []string{"a", "c"}},
+		{name: "exclude", by: []string{"stream"}, exclude: []string{"a"}, expected: []string{"b", "c"}},
+		{name: "include and exclude", by: []string{"stream"}, include: []string{"a", "c"}, exclude: []string{"c"}, expected: []string{"a"}},
+		{name: "any label of by", by: []string{"job", "stream"}, include: []string{"a", "y"}, expected: []string{"a", "b"}},
+		{name: "value of another label", by: []string{"stream"}, include: []string{"x"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, streams(FilterSeriesByValues(series, tc.by, tc.include, tc.exclude)))
+		})
+	}
+}
+
+func TestDownsampleSeries(t *testing.T) {
+	points := func(values ...int64) []*typesv1.Point {
+		res := make([]*typesv1.Point, 0, len(values)/2)
+		for i := 0; i < len(values); i += 2 {
+			res = append(res, &typesv1.Point{Timestamp: values[i], Value: float64(values[i+1])})
+		}
+		return res
+	}
+	for _, tc := range []struct {
+		name        string
+		maxPoints   int64
+		aggregation ingestv1.PointsAggregation
+		in          []*typesv1.Point
+		out         []*typesv1.Point
+	}{
+		{
+			name:      "disabled",
+			maxPoints: 0,
+			in:        points(0, 1, 1, 2, 5, 3),
+			out:       points(0, 1, 1, 2, 5, 3),
+		},
+		{
+			name:      "sum",
+			maxPoints: 2,
+			in:        points(0, 1, 1, 2, 5, 3, 9, 4),
+			out:       points(0, 3, 5, 7),
+		},
+		{
+			name:        "max",
+			maxPoints:   2,
+			aggregation: ingestv1.PointsAggregation_POINTS_AGGREGATION_MAX,
+			in:          points(0, 1, 1, 2, 5, 4, 9, 3),
+			out:         points(0, 2, 5, 4),
+		},
+		{
+			name:      "sparse",
+			maxPoints: 5,
+			in:        points(3, 1, 9, 2),
+			out:       points(2, 1, 8, 2),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			series := []*typesv1.Series{{Labels: LabelsFromStrings("foo", "bar"), Points: tc.in}}
+			DownsampleSeries(series, 0, 9, tc.maxPoints, tc.aggregation)
+			testhelper.EqualProto(t, tc.out, series[0].Points)
+		})
+	}
+}
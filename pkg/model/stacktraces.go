@@ -1,8 +1,12 @@
 package model
 
 import (
+	"bufio"
 	"encoding/binary"
+	"encoding/json"
+	"io"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/cespare/xxhash/v2"
@@ -13,9 +17,10 @@ import (
 func MergeBatchMergeStacktraces(responses ...*ingestv1.MergeProfilesStacktracesResult) *ingestv1.MergeProfilesStacktracesResult {
 	var (
 		result      *ingestv1.MergeProfilesStacktracesResult
-		posByName   map[string]int32
+		posByName   map[functionLine]int32
 		hasher      StacktracesHasher
 		stacktraces = map[uint64]*ingestv1.StacktraceSample{}
+		hasNodes    bool
 	)
 
 	for _, resp := range responses {
@@ -23,6 +28,7 @@ func MergeBatchMergeStacktraces(responses ...*ingestv1.MergeProfilesStacktracesR
 		if resp == nil || len(resp.Stacktraces) == 0 {
 			continue
 		}
+		hasNodes = hasNodes || len(resp.Nodes) > 0
 
 		// first non-empty result result
 		if result == nil {
@@ -35,9 +41,9 @@ func MergeBatchMergeStacktraces(responses ...*ingestv1.MergeProfilesStacktracesR
 
 		// build up the lookup map the first time
 		if posByName == nil {
-			posByName = make(map[string]int32)
+			posByName = make(map[functionLine]int32)
 			for idx, n := range result.FunctionNames {
-				posByName[n] = int32(idx)
+				posByName[functionLine{name: n, line: lineAt(result, idx)}] = int32(idx)
 			}
 		}
 
@@ -47,14 +53,19 @@ func MergeBatchMergeStacktraces(responses ...*ingestv1.MergeProfilesStacktracesR
 			ok      bool
 		)
 		for idx, n := range resp.FunctionNames {
-			rewrite[idx], ok = posByName[n]
+			key := functionLine{name: n, line: lineAt(resp, idx)}
+			rewrite[idx], ok = posByName[key]
 			if ok {
 				continue
 			}
 
 			// need to add functionName to list
 			rewrite[idx] = int32(len(result.FunctionNames))
+			posByName[key] = rewrite[idx]
 			result.FunctionNames = append(result.FunctionNames, n)
+			if len(resp.Lines) > 0 {
+				result.Lines = append(result.Lines, key.line)
+			}
 		}
 
 		// rewrite existing function ids, by building a list of unique slices
@@ -95,9 +106,28 @@ func MergeBatchMergeStacktraces(responses ...*ingestv1.MergeProfilesStacktracesR
 	// sort stacktraces by function name
 	sortStacktraces(result)
 
+	// the nodes of the responses are outdated by the merge
+	if hasNodes {
+		BuildStacktraceNodes(result)
+	}
+
 	return result
 }
 
+// functionLine identifies a stacktrace node, the line is only set for results
+// merged with line granularity.
+type functionLine struct {
+	name string
+	line int64
+}
+
+func lineAt(r *ingestv1.MergeProfilesStacktracesResult, idx int) int64 {
+	if idx < len(r.Lines) {
+		return r.Lines[idx]
+	}
+	return 0
+}
+
 type StacktracesHasher struct {
 	hash *xxhash.Digest
 	b    [4]byte
@@ -133,11 +163,17 @@ func sortStacktraces(r *ingestv1.MergeProfilesStacktracesResult) {
 				return false
 			}
 
-			if diff := strings.Compare(r.FunctionNames[r.Stacktraces[i].FunctionIds[pos]], r.FunctionNames[r.Stacktraces[j].FunctionIds[pos]]); diff < 0 {
+			idxI, idxJ := int(r.Stacktraces[i].FunctionIds[pos]), int(r.Stacktraces[j].FunctionIds[pos])
+			if diff := strings.Compare(r.FunctionNames[idxI], r.FunctionNames[idxJ]); diff < 0 {
 				break
 			} else if diff > 0 {
 				return false
 			}
+			if lineI, lineJ := lineAt(r, idxI), lineAt(r, idxJ); lineI < lineJ {
+				break
+			} else if lineI > lineJ {
+				return false
+			}
 			pos++
 		}
 
@@ -145,3 +181,344 @@ func sortStacktraces(r *ingestv1.MergeProfilesStacktracesResult) {
 		return true
 	})
 }
+
+type pruneNode struct {
+	total    int64
+	children map[int32]*pruneNode
+	sample   *ingestv1.StacktraceSample
+}
+
+func (n *pruneNode) child(functionID int32) *pruneNode {
+	if n.children == nil {
+		n.children = make(map[int32]*pruneNode)
+	}
+	c, ok := n.children[functionID]
+	if !ok {
+		c = &pruneNode{}
+		n.children[functionID] = c
+	}
+	return c
+}
+
+// PruneStacktraces removes the nodes of the stacktraces tree with a total
+// value, including all their children, below minValue or below minPercent
+// (0-100) of the total value. The value of a pruned node is added to its
+// parent, so the total value is preserved. Root nodes are never pruned.
+func PruneStacktraces(r *ingestv1.MergeProfilesStacktracesResult, minValue int64, minPercent float64) {
+	if r == nil || len(r.Stacktraces) == 0 || (minValue <= 0 && minPercent <= 0) {
+		return
+	}
+
+	// build the tree, function ids are ordered from leaf to root.
+	var (
+		root  = &pruneNode{}
+		total int64
+	)
+	for _, s := range r.Stacktraces {
+		n := root
+		for i := len(s.FunctionIds) - 1; i >= 0; i-- {
+			n = n.child(s.FunctionIds[i])
+			n.total += s.Value
+		}
+		total += s.Value
+	}
+
+	threshold := float64(minValue)
+	if t := float64(total) * minPercent / 100; t > threshold {
+		threshold = t
+	}
+
+	// truncate each stacktrace to its deepest ancestor above the threshold
+	var (
+		stacktraces = make([]*ingestv1.StacktraceSample, 0, len(r.Stacktraces))
+		rewrite     = make(map[int32]int32)
+		names       []string
+		lines       []int64
+	)
+	for _, s := range r.Stacktraces {
+		if len(s.FunctionIds) == 0 {
+			continue
+		}
+		depth := 1
+		n := root.child(s.FunctionIds[len(s.FunctionIds)-1])
+		for i := len(s.FunctionIds) - 2; i >= 0; i-- {
+			c := n.child(s.FunctionIds[i])
+			if float64(c.total) < threshold {
+				break
+			}
+			n = c
+			depth++
+		}
+		if n.sample != nil {
+			n.sample.Value += s.Value
+			continue
+		}
+
+		// keep only referenced function names
+		ids := s.FunctionIds[len(s.FunctionIds)-depth:]
+		n.sample = &ingestv1.StacktraceSample{
+			FunctionIds: make([]int32, len(ids)),
+			Value:       s.Value,
+		}
+		for i, id := range ids {
+			newID, ok := rewrite[id]
+			if !ok {
+				newID = int32(len(names))
+				rewrite[id] = newID
+				names = append(names, r.FunctionNames[id])
+				if len(r.Lines) > 0 {
+					lines = append(lines, lineAt(r, int(id)))
+				}
+			}
+			n.sample.FunctionIds[i] = newID
+		}
+		stacktraces = append(stacktraces, n.sample)
+	}
+
+	r.Stacktraces = stacktraces
+	r.FunctionNames = names
+	r.Lines = lines
+	sortStacktraces(r)
+	if len(r.Nodes) > 0 {
+		BuildStacktraceNodes(r)
+	}
+}
+
+// TrimStacktraceRoots removes the frames at the root of the stacktraces, for
+// which trim returns true, e.g. runtime frames at the base of every
+// stacktrace. Frames are removed from the root as long as they match, their
+// children become roots. The leaf frame of a stacktrace is always kept, so the
+// values are preserved. Stacktraces which became identical are merged.
+func TrimStacktraceRoots(r *ingestv1.MergeProfilesStacktracesResult, trim func(name string) bool) {
+	if r == nil || len(r.Stacktraces) == 0 || trim == nil {
+		return
+	}
+	trimmed := make([]bool, len(r.FunctionNames))
+	for i, name := range r.FunctionNames {
+		trimmed[i] = trim(name)
+	}
+
+	// function ids are ordered from leaf to root.
+	var (
+		stacktraces = make([]*ingestv1.StacktraceSample, 0, len(r.Stacktraces))
+		byHash      = make(map[uint64]*ingestv1.StacktraceSample, len(r.Stacktraces))
+		hasher      StacktracesHasher
+		rewrite     = make(map[int32]int32)
+		names       []string
+		lines       []int64
+	)
+	for _, s := range r.Stacktraces {
+		ids := s.FunctionIds
+		for len(ids) > 1 && trimmed[ids[len(ids)-1]] {
+			ids = ids[:len(ids)-1]
+		}
+		newIDs := make([]int32, len(ids))
+		for i, id := range ids {
+			newID, ok := rewrite[id]
+			if !ok {
+				newID = int32(len(names))
+				rewrite[id] = newID
+				names = append(names, r.FunctionNames[id])
+				if len(r.Lines) > 0 {
+					lines = append(lines, lineAt(r, int(id)))
+				}
+			}
+			newIDs[i] = newID
+		}
+		h := hasher.Hashes(newIDs)
+		if existing, ok := byHash[h]; ok {
+			existing.Value += s.Value
+			continue
+		}
+		sample := &ingestv1.StacktraceSample{FunctionIds: newIDs, Value: s.Value}
+		byHash[h] = sample
+		stacktraces = append(stacktraces, sample)
+	}
+
+	r.Stacktraces = stacktraces
+	r.FunctionNames = names
+	r.Lines = lines
+	sortStacktraces(r)
+	if len(r.Nodes) > 0 {
+		BuildStacktraceNodes(r)
+	}
+}
+
+type treeNode struct {
+	functionID int32
+	self       int64
+	total      int64
+	children   map[int32]*treeNode
+}
+
+func (n *treeNode) child(functionID int32) *treeNode {
+	if n.children == nil {
+		n.children = make(map[int32]*treeNode)
+	}
+	c, ok := n.children[functionID]
+	if !ok {
+		c = &treeNode{functionID: functionID}
+		n.children[functionID] = c
+	}
+	return c
+}
+
+// BuildStacktraceNodes sets the nodes of the result to the tree of its
+// stacktraces, with the self and total value of each node. Nodes are in
+// depth-first order, the children of a node are sorted by function name.
+func BuildStacktraceNodes(r *ingestv1.MergeProfilesStacktracesResult) {
+	if r == nil {
+		return
+	}
+	root := &treeNode{}
+	for _, s := range r.Stacktraces {
+		if len(s.FunctionIds) == 0 {
+			continue
+		}
+		// function ids are ordered from leaf to root.
+		n := root
+		for i := len(s.FunctionIds) - 1; i >= 0; i-- {
+			n = n.child(s.FunctionIds[i])
+			n.total += s.Value
+		}
+		n.self += s.Value
+	}
+
+	r.Nodes = r.Nodes[:0]
+	var appendChildren func(n *treeNode, parent int32)
+	appendChildren = func(n *treeNode, parent int32) {
+		children := make([]*treeNode, 0, len(n.children))
+		for _, c := range n.children {
+			children = append(children, c)
+		}
+		sort.Slice(children, func(i, j int) bool {
+			idxI, idxJ := int(children[i].functionID), int(children[j].functionID)
+			if diff := strings.Compare(r.FunctionNames[idxI], r.FunctionNames[idxJ]); diff != 0 {
+				return diff < 0
+			}
+			return lineAt(r, idxI) < lineAt(r, idxJ)
+		})
+		for _, c := range children {
+			idx := int32(len(r.Nodes))
+			r.Nodes = append(r.Nodes, &ingestv1.StacktraceNode{
+				FunctionId: c.functionID,
+				Parent:     parent,
+				Self:       c.self,
+				Total:      c.total,
+			})
+			appendChildren(c, idx)
+		}
+	}
+	appendChildren(root, -1)
+}
+
+// WriteCollapsed writes the stacktraces in the collapsed format of
+// flamegraph.pl, as understood by speedscope: one line per stacktrace with
+// its function names from root to leaf separated by ';', followed by a space
+// and its value.
+func WriteCollapsed(w io.Writer, r *ingestv1.MergeProfilesStacktracesResult) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range r.GetStacktraces() {
+		if len(s.FunctionIds) == 0 {
+			continue
+		}
+		// function ids are ordered from leaf to root.
+		for i := len(s.FunctionIds) - 1; i >= 0; i-- {
+			if _, err := bw.WriteString(r.FunctionNames[s.FunctionIds[i]]); err != nil {
+				return err
+			}
+			sep := byte(';')
+			if i == 0 {
+				sep = ' '
+			}
+			if err := bw.WriteByte(sep); err != nil {
+				return err
+			}
+		}
+		if _, err := bw.WriteString(strconv.FormatInt(s.Value, 10)); err != nil {
+			return err
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// speedscopeUnits are the value units understood by speedscope, other units
+// are written as "none".
+var speedscopeUnits = map[string]struct{}{
+	"bytes":        {},
+	"nanoseconds":  {},
+	"microseconds": {},
+	"milliseconds": {},
+	"seconds":      {},
+}
+
+type speedscopeFile struct {
+	Schema   string              `json:"$schema"`
+	Exporter string              `json:"exporter"`
+	Name     string              `json:"name"`
+	Shared   speedscopeShared    `json:"shared"`
+	Profiles []speedscopeProfile `json:"profiles"`
+}
+
+type speedscopeShared struct {
+	Frames []speedscopeFrame `json:"frames"`
+}
+
+type speedscopeFrame struct {
+	Name string `json:"name"`
+}
+
+type speedscopeProfile struct {
+	Type       string    `json:"type"`
+	Name       string    `json:"name"`
+	Unit       string    `json:"unit"`
+	StartValue int64     `json:"startValue"`
+	EndValue   int64     `json:"endValue"`
+	Samples    [][]int32 `json:"samples"`
+	Weights    []int64   `json:"weights"`
+}
+
+// WriteSpeedscope writes the stacktraces as a single profile of the "sampled"
+// type of the speedscope file format, see
+// https://www.speedscope.app/file-format-schema.json. Every stacktrace is a
+// sample of the frames from root to leaf weighted by its value. The frames
+// are the function names, unit is the unit of the values.
+func WriteSpeedscope(w io.Writer, r *ingestv1.MergeProfilesStacktracesResult, name, unit string) error {
+	if _, ok := speedscopeUnits[unit]; !ok {
+		unit = "none"
+	}
+	profile := speedscopeProfile{
+		Type:    "sampled",
+		Name:    name,
+		Unit:    unit,
+		Samples: make([][]int32, 0, len(r.GetStacktraces())),
+		Weights: make([]int64, 0, len(r.GetStacktraces())),
+	}
+	for _, s := range r.GetStacktraces() {
+		if len(s.FunctionIds) == 0 {
+			continue
+		}
+		// function ids are ordered from leaf to root.
+		sample := make([]int32, len(s.FunctionIds))
+		for i, id := range s.FunctionIds {
+			sample[len(sample)-1-i] = id
+		}
+		profile.Samples = append(profile.Samples, sample)
+		profile.Weights = append(profile.Weights, s.Value)
+		profile.EndValue += s.Value
+	}
+	frames := make([]speedscopeFrame, len(r.GetFunctionNames()))
+	for i, fn := range r.GetFunctionNames() {
+		frames[i].Name = fn
+	}
+	return json.NewEncoder(w).Encode(speedscopeFile{
+		Schema:   "https://www.speedscope.app/file-format-schema.json",
+		Exporter: "phlare",
+		Name:     name,
+		Shared:   speedscopeShared{Frames: frames},
+		Profiles: []speedscopeProfile{profile},
+	})
+}
@@ -1,8 +1,11 @@
 package model
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/require"
+
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	"github.com/grafana/phlare/pkg/testhelper"
 )
@@ -112,6 +115,109 @@ func TestMergeBatchResponse(t *testing.T) {
 				FunctionNames: []string{"my", "other", "stack", "foo", "bar"},
 			},
 		},
+		{
+			name: "lines",
+			in: []*ingestv1.MergeProfilesStacktracesResult{
+				{
+					Stacktraces: []*ingestv1.StacktraceSample{
+						{
+							FunctionIds: []int32{0, 1},
+							Value:       1,
+						},
+					},
+					FunctionNames: []string{"my", "other"},
+					Lines:         []int64{0, 10},
+				},
+				{
+					Stacktraces: []*ingestv1.StacktraceSample{
+						{
+							FunctionIds: []int32{0, 1},
+							Value:       2,
+						},
+						{
+							FunctionIds: []int32{0, 2},
+							Value:       3,
+						},
+					},
+					FunctionNames: []string{"my", "other", "other"},
+					Lines:         []int64{0, 10, 20},
+				},
+			},
+			expected: &ingestv1.MergeProfilesStacktracesResult{
+				Stacktraces: []*ingestv1.StacktraceSample{
+					{
+						FunctionIds: []int32{0, 1},
+						Value:       3,
+					},
+					{
+						FunctionIds: []int32{0, 2},
+						Value:       3,
+					},
+				},
+				FunctionNames: []string{"my", "other", "other"},
+				Lines:         []int64{0, 10, 20},
+			},
+		},
+		{
+			name: "nodes",
+			in: []*ingestv1.MergeProfilesStacktracesResult{
+				{
+					Stacktraces: []*ingestv1.StacktraceSample{
+						{
+							FunctionIds: []int32{0, 1},
+							Value:       1,
+						},
+					},
+					FunctionNames: []string{"my", "other"},
+					Lines:         []int64{0, 10},
+					Nodes: []*ingestv1.StacktraceNode{
+						{FunctionId: 1, Parent: -1, Total: 1},
+						{FunctionId: 0, Parent: 0, Self: 1, Total: 1},
+					},
+				},
+				{
+					Stacktraces: []*ingestv1.StacktraceSample{
+						{
+							FunctionIds: []int32{1, 0},
+							Value:       2,
+						},
+						{
+							FunctionIds: []int32{1, 2},
+							Value:       3,
+						},
+					},
+					FunctionNames: []string{"other", "my", "other"},
+					Lines:         []int64{10, 0, 20},
+					Nodes: []*ingestv1.StacktraceNode{
+						{FunctionId: 0, Parent: -1, Total: 2},
+						{FunctionId: 1, Parent: 0, Self: 2, Total: 2},
+						{FunctionId: 2, Parent: -1, Total: 3},
+						{FunctionId: 1, Parent: 2, Self: 3, Total: 3},
+					},
+				},
+			},
+			expected: &ingestv1.MergeProfilesStacktracesResult{
+				Stacktraces: []*ingestv1.StacktraceSample{
+					{
+						FunctionIds: []int32{0, 1},
+						Value:       3,
+					},
+					{
+						FunctionIds: []int32{0, 2},
+						Value:       3,
+					},
+				},
+				FunctionNames: []string{"my", "other", "other"},
+				Lines:         []int64{0, 10, 20},
+				// the nodes are rebuilt from the merged stacktraces
+				Nodes: []*ingestv1.StacktraceNode{
+					{FunctionId: 1, Parent: -1, Total: 3},
+					{FunctionId: 0, Parent: 0, Self: 3, Total: 3},
+					{FunctionId: 2, Parent: -1, Total: 3},
+					{FunctionId: 0, Parent: 2, Self: 3, Total: 3},
+				},
+			},
+		},
 	} {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
@@ -120,3 +226,95 @@ func TestMergeBatchResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestTrimStacktraceRoots(t *testing.T) {
+	r := &ingestv1.MergeProfilesStacktracesResult{
+		FunctionNames: []string{"leaf", "a", "b", "runtime.main", "runtime.goexit"},
+		// function ids are ordered from leaf to root
+		Stacktraces: []*ingestv1.StacktraceSample{
+			{FunctionIds: []int32{0, 1, 3, 4}, Value: 1},
+			{FunctionIds: []int32{0, 1, 4}, Value: 2},
+			{FunctionIds: []int32{4}, Value: 3},
+			{FunctionIds: []int32{2, 3}, Value: 4},
+		},
+	}
+	TrimStacktraceRoots(r, func(name string) bool {
+		return name == "runtime.main" || name == "runtime.goexit"
+	})
+
+	result := make(map[string]int64)
+	for _, s := range r.Stacktraces {
+		names := make([]string, len(s.FunctionIds))
+		for i, id := range s.FunctionIds {
+			names[i] = r.FunctionNames[id]
+		}
+		result[strings.Join(names, ";")] += s.Value
+	}
+	// stacktraces identical once trimmed are merged and leaf frames are kept
+	require.Equal(t, map[string]int64{
+		"leaf;a":         3,
+		"runtime.goexit": 3,
+		"b":              4,
+	}, result)
+	require.Len(t, r.Stacktraces, 3)
+	require.NotContains(t, r.FunctionNames, "runtime.main")
+}
+
+func TestPruneStacktraces(t *testing.T) {
+	prune := func(minValue int64, minPercent float64) map[string]int64 {
+		r := &ingestv1.MergeProfilesStacktracesResult{
+			FunctionNames: []string{"main", "work", "tiny", "big", "small", "noise"},
+			// function ids are ordered from leaf to root
+			Stacktraces: []*ingestv1.StacktraceSample{
+				{FunctionIds: []int32{1, 0}, Value: 1000},
+				{FunctionIds: []int32{2, 1, 0}, Value: 1},
+				{FunctionIds: []int32{3, 0}, Value: 500},
+				{FunctionIds: []int32{4, 3, 0}, Value: 2},
+				{FunctionIds: []int32{5, 0}, Value: 3},
+			},
+		}
+		PruneStacktraces(r, minValue, minPercent)
+
+		// index the stacktraces from root to leaf
+		result := make(map[string]int64)
+		for _, s := range r.Stacktraces {
+			names := make([]string, len(s.FunctionIds))
+			for i, id := range s.FunctionIds {
+				names[len(names)-1-i] = r.FunctionNames[id]
+			}
+			result[strings.Join(names, ";")] += s.Value
+		}
+		return result
+	}
+
+	t.Run("no pruning", func(t *testing.T) {
+		require.Equal(t, map[string]int64{
+			"main;work":      1000,
+			"main;work;tiny": 1,
+			"main;big":       500,
+			"main;big;small": 2,
+			"main;noise":     3,
+		}, prune(0, 0))
+	})
+
+	t.Run("prune below 1 percent", func(t *testing.T) {
+		require.Equal(t, map[string]int64{
+			"main":      3,
+			"main;work": 1001,
+			"main;big":  502,
+		}, prune(0, 1))
+	})
+
+	t.Run("prune below min value", func(t *testing.T) {
+		require.Equal(t, map[string]int64{
+			"main":      505,
+			"main;work": 1001,
+		}, prune(600, 0))
+	})
+
+	t.Run("root nodes are never pruned", func(t *testing.T) {
+		require.Equal(t, map[string]int64{
+			"main": 1506,
+		}, prune(10000, 0))
+	})
+}
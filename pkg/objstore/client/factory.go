@@ -2,6 +2,7 @@ package client
 
 import (
 	"context"
+	"io"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thanos-io/objstore"
@@ -140,5 +141,6 @@ func (b *readerAt) ReadAt(p []byte, off int64) (n int, err error) {
 		return -1, err
 	}
 	defer rc.Close()
-	return rc.Read(p)
+	// a single Read may return less than requested for network backed readers.
+	return io.ReadFull(rc, p)
 }
@@ -2,6 +2,8 @@ package parquet
 
 import (
 	"encoding/binary"
+	"io"
+	"sync"
 
 	"github.com/grafana/phlare/pkg/objstore"
 )
@@ -9,6 +11,21 @@ import (
 type parquetReaderAt struct {
 	objstore.ReaderAt
 	footerSize uint32
+
+	mtx sync.RWMutex
+	// sections announced by parquet-go while opening the file, they are
+	// fetched with a single range request on first access and kept in memory.
+	sections []*section
+}
+
+type section struct {
+	offset int64
+	length int64
+	data   []byte
+}
+
+func (s *section) contains(off, length int64) bool {
+	return off >= s.offset && off+length <= s.offset+s.length
 }
 
 func NewReaderAt(r objstore.ReaderAt) objstore.ReaderAt {
@@ -19,17 +36,32 @@ func NewReaderAt(r objstore.ReaderAt) objstore.ReaderAt {
 
 // called by parquet-go in OpenFile() to set offset and length of footer section
 func (r *parquetReaderAt) SetFooterSection(offset, length int64) {
-	// todo cache footer section
+	// include the footer length and magic bytes, so reopening the file is served from memory.
+	r.addSection(offset, r.Size()-offset)
 }
 
 // called by parquet-go in OpenFile() to set offset and length of column indexes
 func (r *parquetReaderAt) SetColumnIndexSection(offset, length int64) {
-	// todo cache column index section
+	r.addSection(offset, length)
 }
 
 // called by parquet-go in OpenFile() to set offset and length of offset index section
 func (r *parquetReaderAt) SetOffsetIndexSection(offset, length int64) {
-	// todo cache offset index section
+	r.addSection(offset, length)
+}
+
+func (r *parquetReaderAt) addSection(offset, length int64) {
+	if offset < 0 || length <= 0 || offset+length > r.Size() {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, s := range r.sections {
+		if s.offset == offset && s.length == length {
+			return
+		}
+	}
+	r.sections = append(r.sections, &section{offset: offset, length: length})
 }
 
 func (r *parquetReaderAt) ReadAt(p []byte, off int64) (int, error) {
@@ -45,6 +77,44 @@ func (r *parquetReaderAt) ReadAt(p []byte, off int64) (int, error) {
 		return 8, nil
 	}
 
-	// todo handle cache
+	if n, ok, err := r.readSection(p, off); ok {
+		return n, err
+	}
+
 	return r.ReaderAt.ReadAt(p, off)
 }
+
+// readSection serves the read from a known section, it returns false if no
+// section contains the requested range.
+func (r *parquetReaderAt) readSection(p []byte, off int64) (int, bool, error) {
+	r.mtx.RLock()
+	var s *section
+	for _, c := range r.sections {
+		if c.contains(off, int64(len(p))) {
+			s = c
+			break
+		}
+	}
+	if s == nil {
+		r.mtx.RUnlock()
+		return 0, false, nil
+	}
+	data := s.data
+	r.mtx.RUnlock()
+
+	if data == nil {
+		r.mtx.Lock()
+		if s.data == nil {
+			buf := make([]byte, s.length)
+			if _, err := r.ReaderAt.ReadAt(buf, s.offset); err != nil && err != io.EOF {
+				r.mtx.Unlock()
+				return 0, true, err
+			}
+			s.data = buf
+		}
+		data = s.data
+		r.mtx.Unlock()
+	}
+
+	return copy(p, data[off-s.offset:]), true, nil
+}
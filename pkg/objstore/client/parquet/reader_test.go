@@ -0,0 +1,61 @@
+package parquet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/segmentio/parquet-go"
+	"github.com/stretchr/testify/require"
+)
+
+type countingReaderAt struct {
+	*bytes.Reader
+	reads int
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads++
+	return r.Reader.ReadAt(p, off)
+}
+
+func (r *countingReaderAt) Close() error { return nil }
+
+type row struct {
+	ID   int64  `parquet:"id"`
+	Name string `parquet:"name"`
+}
+
+func TestReaderAtCachesSections(t *testing.T) {
+	var buf bytes.Buffer
+	w := parquet.NewGenericWriter[row](&buf)
+	rows := make([]row, 1000)
+	for i := range rows {
+		rows[i] = row{ID: int64(i), Name: "foo"}
+	}
+	_, err := w.Write(rows)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	ra := &countingReaderAt{Reader: bytes.NewReader(buf.Bytes())}
+	r := NewReaderAt(ra)
+
+	f, err := parquet.OpenFile(r, r.Size())
+	require.NoError(t, err)
+	require.Equal(t, int64(len(rows)), f.NumRows())
+	reads := ra.reads
+	require.Greater(t, reads, 0)
+
+	// reopening is served entirely from the cached sections.
+	f, err = parquet.OpenFile(r, r.Size())
+	require.NoError(t, err)
+	require.Equal(t, int64(len(rows)), f.NumRows())
+	require.Equal(t, reads, ra.reads)
+
+	result := make([]row, len(rows))
+	n, err := parquet.NewGenericReader[row](f).Read(result)
+	require.Equal(t, len(rows), n)
+	if err != nil {
+		require.ErrorContains(t, err, "EOF")
+	}
+	require.Equal(t, rows, result)
+}
@@ -21,6 +21,7 @@ const (
 	IndexFilename        = "index.tsdb"
 	ParquetSuffix        = ".parquet"
 	DeletionMarkFilename = "deletion-mark.json"
+	PartsDirname         = "parts"
 
 	HostnameLabel = "__hostname__"
 )
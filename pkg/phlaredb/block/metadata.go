@@ -50,6 +50,8 @@ type File struct {
 	RelPath string `json:"relPath"`
 	// SizeBytes is optional (e.g meta.json does not show size).
 	SizeBytes uint64 `json:"sizeBytes,omitempty"`
+	// CRC32C is the optional hex encoded CRC-32C (Castagnoli) checksum of the file content.
+	CRC32C string `json:"crc32c,omitempty"`
 
 	// Parquet can contain some optional Parquet file info
 	Parquet *ParquetFile `json:"parquet,omitempty"`
@@ -66,6 +68,19 @@ type TSDBFile struct {
 	NumSeries uint64 `json:"numSeries,omitempty"`
 }
 
+// Encryption describes how the files of an encrypted block are encrypted.
+type Encryption struct {
+	// Algorithm used to encrypt the files.
+	Algorithm string `json:"algorithm"`
+	// Nonce is random per block, the nonce of each file is derived from it.
+	Nonce []byte `json:"nonce"`
+	// Files lists the relative paths of the encrypted files.
+	Files []string `json:"files"`
+	// SegmentSize is the size of the plaintext segments the files are
+	// encrypted in, each segment is sealed on its own.
+	SegmentSize int `json:"segmentSize"`
+}
+
 type Meta struct {
 	// Unique identifier for the block and its contents. Changes on compaction.
 	ULID ulid.ULID `json:"ulid"`
@@ -93,6 +108,15 @@ type Meta struct {
 
 	// Source is a real upload source of the block.
 	Source SourceType `json:"source,omitempty"`
+
+	// Encryption is set if files of the block are encrypted at rest.
+	Encryption *Encryption `json:"encryption,omitempty"`
+
+	// Parts are the metas of the blocks appended to this block, which are
+	// stored in its parts directory. The files of the parts are part of
+	// Files, their time range and stats are included in the ones of the
+	// block.
+	Parts []*Meta `json:"parts,omitempty"`
 }
 
 func (m *Meta) FileByRelPath(name string) *File {
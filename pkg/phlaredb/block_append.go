@@ -0,0 +1,106 @@
+package phlaredb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+// AppendBlock appends the block in src to the block in dst, without
+// rewriting the files of dst as parquet files are immutable. This allows to
+// backfill profiles slowly into an existing block, instead of creating many
+// small blocks.
+//
+// The directory of src is moved to the parts directory of dst and its meta
+// added to the parts of the meta of dst. The meta of dst is written last, so
+// dst is unchanged if the append fails. A part keeps its own TSDB index and
+// symbols, the series indexes of its profiles reference the series of its own
+// index. Block queriers read the parts of a block along with it, until the
+// block is rewritten by a compaction.
+//
+// The stats of dst are the sum of the stats of its parts, so a series with
+// profiles in several parts is counted once per part.
+func AppendBlock(ctx context.Context, dst, src string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	meta, _, err := block.MetaFromDir(dst)
+	if err != nil {
+		return errors.Wrap(err, "reading block meta")
+	}
+	part, _, err := block.MetaFromDir(src)
+	if err != nil {
+		return errors.Wrap(err, "reading meta of the appended block")
+	}
+	if len(part.Parts) > 0 {
+		return errors.Errorf("block %s has parts itself and cannot be appended", part.ULID)
+	}
+	if part.ULID == meta.ULID {
+		return errors.Errorf("block %s cannot be appended to itself", part.ULID)
+	}
+	for _, p := range meta.Parts {
+		if p.ULID == part.ULID {
+			return errors.Errorf("block %s is already a part of block %s", part.ULID, meta.ULID)
+		}
+	}
+
+	partsDir := filepath.Join(dst, block.PartsDirname)
+	if err := os.MkdirAll(partsDir, defaultFolderMode); err != nil {
+		return err
+	}
+	partDir := filepath.Join(partsDir, part.ULID.String())
+	if err := fileutil.Rename(src, partDir); err != nil {
+		return errors.Wrap(err, "moving the appended block")
+	}
+
+	appendPart(meta, part)
+	if _, err := meta.WriteToFile(log.NewNopLogger(), dst); err != nil {
+		// the part is moved back, as the block doesn't reference it
+		if renameErr := fileutil.Rename(partDir, src); renameErr != nil {
+			return errors.Wrapf(err, "writing block meta, moving back the appended block failed: %v", renameErr)
+		}
+		return errors.Wrap(err, "writing block meta")
+	}
+	return nil
+}
+
+// appendPart adds the part and its files to meta and extends its time range
+// and stats.
+func appendPart(meta, part *block.Meta) {
+	meta.Parts = append(meta.Parts, part)
+
+	for _, f := range part.Files {
+		f.RelPath = filepath.Join(block.PartsDirname, part.ULID.String(), f.RelPath)
+		meta.Files = append(meta.Files, f)
+	}
+	sort.Slice(meta.Files, func(i, j int) bool {
+		return meta.Files[i].RelPath < meta.Files[j].RelPath
+	})
+
+	if part.MinTime < meta.MinTime {
+		meta.MinTime = part.MinTime
+	}
+	if part.MaxTime > meta.MaxTime {
+		meta.MaxTime = part.MaxTime
+	}
+	meta.Stats.NumProfiles += part.Stats.NumProfiles
+	meta.Stats.NumSamples += part.Stats.NumSamples
+	meta.Stats.NumSeries += part.Stats.NumSeries
+
+	if len(meta.Compaction.Sources) == 0 {
+		meta.Compaction.Sources = []ulid.ULID{meta.ULID}
+	}
+	if len(part.Compaction.Sources) == 0 {
+		meta.Compaction.Sources = append(meta.Compaction.Sources, part.ULID)
+	} else {
+		meta.Compaction.Sources = append(meta.Compaction.Sources, part.Compaction.Sources...)
+	}
+}
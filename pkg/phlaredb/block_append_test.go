@@ -0,0 +1,91 @@
+package phlaredb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	"github.com/grafana/phlare/pkg/pprof/testhelper"
+)
+
+func TestAppendBlock(t *testing.T) {
+	ctx := testContext(t)
+	dst := newVerifyTestBlock(t)
+
+	bkt, err := filesystem.NewBucket(filepath.Dir(dst))
+	require.NoError(t, err)
+	q := NewBlockQuerier(ctx, bkt)
+	defer func() {
+		require.NoError(t, q.Close())
+	}()
+
+	selectProfiles := func() []string {
+		require.NoError(t, q.Sync(ctx))
+		it, err := q.Queriers().SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(20 * time.Second / time.Millisecond),
+		})
+		require.NoError(t, err)
+		var result []string
+		for it.Next() {
+			result = append(result, fmt.Sprintf("%s@%d", it.At().Labels().Get("stream"), it.At().Timestamp().Unix()))
+		}
+		require.NoError(t, it.Err())
+		sort.Strings(result)
+		return result
+	}
+	require.Len(t, selectProfiles(), 9)
+
+	// the appended profiles include a series unknown to the block
+	head := newTestHead(t)
+	for i, stream := range []string{"stream-d", "stream-a", "stream-d"} {
+		p := testhelper.NewProfileBuilder(time.Second.Nanoseconds()*int64(9+i)).
+			CPUProfile().
+			WithLabels("stream", stream)
+		p.ForStacktraceString("func1", "func3").AddSamples(5)
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+	_, err = head.Flush(ctx)
+	require.NoError(t, err)
+	require.NoError(t, AppendBlock(ctx, dst, head.localPath))
+
+	meta, _, err := block.MetaFromDir(dst)
+	require.NoError(t, err)
+	require.Len(t, meta.Parts, 1)
+	require.Equal(t, uint64(12), meta.Stats.NumProfiles)
+	require.Equal(t, int64(11*time.Second/time.Millisecond), int64(meta.MaxTime))
+	require.NotNil(t, meta.FileByRelPath(filepath.Join(block.PartsDirname, meta.Parts[0].ULID.String(), "profiles.parquet")))
+
+	require.Equal(t, []string{
+		"stream-a@0", "stream-a@10", "stream-a@3", "stream-a@6",
+		"stream-b@1", "stream-b@4", "stream-b@7",
+		"stream-c@2", "stream-c@5", "stream-c@8",
+		"stream-d@11", "stream-d@9",
+	}, selectProfiles())
+
+	// the stacktraces of the part are resolved with its own symbols
+	r, err := q.Queriers().SelectCollapsed(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{stream="stream-a"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(20 * time.Second / time.Millisecond),
+	})
+	require.NoError(t, err)
+	collapsed, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "func1 60\nfunc2;func1 30\nfunc3;func1 5\n", string(collapsed))
+
+	// a block cannot be appended twice
+	require.Error(t, AppendBlock(context.Background(), dst, filepath.Join(dst, block.PartsDirname, meta.Parts[0].ULID.String())))
+}
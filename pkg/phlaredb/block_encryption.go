@@ -0,0 +1,396 @@
+package phlaredb
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+const (
+	blockEncryptionAlgorithm = "AES-GCM"
+	// blockEncryptionSegmentSize is the size of the plaintext segments the
+	// files are encrypted in, reads only decrypt the segments they cover.
+	blockEncryptionSegmentSize = 64 << 10
+)
+
+// ErrBlockDecryption is returned when the files of an encrypted block can't
+// be decrypted, e.g. because the key is wrong.
+var ErrBlockDecryption = errors.New("block decryption failed")
+
+// encryptedBlockFiles are the files of a block encrypted at rest.
+var encryptedBlockFiles = []string{
+	block.IndexFilename,
+	(&schemav1.ProfilePersister{}).Name() + block.ParquetSuffix,
+}
+
+// blockEncryption encrypts and decrypts the files of blocks with AES-GCM.
+// Files are split into segments sealed on their own, the nonce of a segment
+// is derived from the block nonce, the file and the position of the segment.
+type blockEncryption struct {
+	aead cipher.AEAD
+}
+
+// newBlockEncryption returns the block encryption for an AES key of 16, 24
+// or 32 bytes, it returns nil if the key is empty.
+func newBlockEncryption(key []byte) (*blockEncryption, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid block encryption key")
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	return &blockEncryption{aead: aead}, nil
+}
+
+// segmentNonce derives the nonce of a segment of the i-th file of a block
+// from the block nonce, so that no two segments are encrypted with the same
+// nonce.
+func segmentNonce(blockNonce []byte, i int, segment int64) []byte {
+	nonce := make([]byte, len(blockNonce))
+	copy(nonce, blockNonce)
+	tail := nonce[len(nonce)-4:]
+	binary.BigEndian.PutUint32(tail, binary.BigEndian.Uint32(tail)^uint32(i+1))
+	head := nonce[len(nonce)-12 : len(nonce)-4]
+	binary.BigEndian.PutUint64(head, binary.BigEndian.Uint64(head)^uint64(segment))
+	return nonce
+}
+
+// additionalData binds the ciphertext of a segment to the block, the file and
+// the position of the segment. Marking the last segment detects truncated files.
+func additionalData(meta *block.Meta, relPath string, segment int64, last bool) []byte {
+	ad := []byte(meta.ULID.String() + "/" + relPath)
+	ad = binary.BigEndian.AppendUint64(ad, uint64(segment))
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// encryptBlock encrypts the files of the block in dir in place and records
+// the encryption in meta.
+func (e *blockEncryption) encryptBlock(dir string, meta *block.Meta) error {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	// the files are replaced once all of them are encrypted, so a failed
+	// encryption leaves the block as it was
+	for i, relPath := range encryptedBlockFiles {
+		if err := e.encryptFile(filepath.Join(dir, relPath), meta, nonce, i, relPath); err != nil {
+			for _, relPath := range encryptedBlockFiles {
+				_ = os.Remove(filepath.Join(dir, relPath) + ".tmp")
+			}
+			return errors.Wrapf(err, "encrypting %s", relPath)
+		}
+	}
+	for _, relPath := range encryptedBlockFiles {
+		path := filepath.Join(dir, relPath)
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	meta.Encryption = &block.Encryption{
+		Algorithm:   blockEncryptionAlgorithm,
+		Nonce:       nonce,
+		Files:       append([]string(nil), encryptedBlockFiles...),
+		SegmentSize: blockEncryptionSegmentSize,
+	}
+	return nil
+}
+
+// encryptFile encrypts the i-th file of a block segment by segment into a
+// temporary file next to it.
+func (e *blockEncryption) encryptFile(path string, meta *block.Meta, nonce []byte, i int, relPath string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// an empty file still has a single, empty segment
+	segments := (stat.Size() + blockEncryptionSegmentSize - 1) / blockEncryptionSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	var (
+		plaintext  = make([]byte, blockEncryptionSegmentSize)
+		ciphertext = make([]byte, 0, blockEncryptionSegmentSize+e.aead.Overhead())
+	)
+	for s := int64(0); s < segments; s++ {
+		n, err := io.ReadFull(in, plaintext)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		ciphertext = e.aead.Seal(ciphertext[:0], segmentNonce(nonce, i, s), plaintext[:n], additionalData(meta, relPath, s, s == segments-1))
+		if _, err := out.Write(ciphertext); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// encryptedFile decrypts the segments of an encrypted file of a block.
+type encryptedFile struct {
+	encryption *blockEncryption
+	meta       *block.Meta
+	idx        int
+	relPath    string
+	// size is the size of the ciphertext.
+	size int64
+}
+
+// newEncryptedFile returns the encrypted file of the block with the size of its ciphertext.
+func (e *blockEncryption) newEncryptedFile(meta *block.Meta, idx int, relPath string, size int64) (*encryptedFile, error) {
+	if e == nil {
+		return nil, errors.Wrapf(ErrBlockDecryption, "block %s is encrypted, but no encryption key is configured", meta.ULID)
+	}
+	if meta.Encryption.Algorithm != blockEncryptionAlgorithm || len(meta.Encryption.Nonce) != e.aead.NonceSize() || meta.Encryption.SegmentSize <= 0 {
+		return nil, errors.Wrapf(ErrBlockDecryption, "block %s uses unsupported encryption %s", meta.ULID, meta.Encryption.Algorithm)
+	}
+	f := &encryptedFile{encryption: e, meta: meta, idx: idx, relPath: relPath, size: size}
+	if lastSize := size - (f.segments()-1)*f.sealedSegmentSize(); size == 0 || lastSize < int64(e.aead.Overhead()) {
+		return nil, errors.Wrapf(ErrBlockDecryption, "file %s of block %s is truncated", relPath, meta.ULID)
+	}
+	return f, nil
+}
+
+func (f *encryptedFile) sealedSegmentSize() int64 {
+	return int64(f.meta.Encryption.SegmentSize + f.encryption.aead.Overhead())
+}
+
+func (f *encryptedFile) segments() int64 {
+	return (f.size + f.sealedSegmentSize() - 1) / f.sealedSegmentSize()
+}
+
+// plaintextSize returns the size of the decrypted file.
+func (f *encryptedFile) plaintextSize() int64 {
+	return f.size - f.segments()*int64(f.encryption.aead.Overhead())
+}
+
+// segmentRange returns the offset and length of the ciphertext of a segment.
+func (f *encryptedFile) segmentRange(segment int64) (int64, int64) {
+	off := segment * f.sealedSegmentSize()
+	length := f.sealedSegmentSize()
+	if off+length > f.size {
+		length = f.size - off
+	}
+	return off, length
+}
+
+// open decrypts the ciphertext of a segment into dst.
+func (f *encryptedFile) open(dst []byte, segment int64, ciphertext []byte) ([]byte, error) {
+	plaintext, err := f.encryption.aead.Open(dst[:0], segmentNonce(f.meta.Encryption.Nonce, f.idx, segment), ciphertext,
+		additionalData(f.meta, f.relPath, segment, segment == f.segments()-1))
+	if err != nil {
+		return nil, errors.Wrapf(ErrBlockDecryption, "segment %d of file %s of block %s: %v", segment, f.relPath, f.meta.ULID, err)
+	}
+	return plaintext, nil
+}
+
+// decryptingBucketReader serves the decrypted content of the encrypted files
+// of a block, the other files are read unchanged. Only the segments covering
+// a read are decrypted.
+type decryptingBucketReader struct {
+	phlareobjstore.BucketReader
+	encryption *blockEncryption
+	meta       *block.Meta
+}
+
+func newDecryptingBucketReader(r phlareobjstore.BucketReader, e *blockEncryption, meta *block.Meta) *decryptingBucketReader {
+	return &decryptingBucketReader{
+		BucketReader: r,
+		encryption:   e,
+		meta:         meta,
+	}
+}
+
+// fileIndex returns the index of name within the encrypted files, -1 if it isn't encrypted.
+func (b *decryptingBucketReader) fileIndex(name string) int {
+	for i, f := range b.meta.Encryption.Files {
+		if f == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// readerAt returns the encrypted file name decrypted by segment, or nil if it isn't encrypted.
+func (b *decryptingBucketReader) readerAt(ctx context.Context, name string) (*decryptingReaderAt, error) {
+	idx := b.fileIndex(name)
+	if idx < 0 {
+		return nil, nil
+	}
+	ra, err := b.BucketReader.ReaderAt(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := b.encryption.newEncryptedFile(b.meta, idx, name, ra.Size())
+	if err != nil {
+		_ = ra.Close()
+		return nil, err
+	}
+	return &decryptingReaderAt{file: f, ciphertext: ra, segment: -1}, nil
+}
+
+func (b *decryptingBucketReader) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	ra, err := b.readerAt(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if ra == nil {
+		return b.BucketReader.Get(ctx, name)
+	}
+	return &readerAtCloser{Reader: io.NewSectionReader(ra, 0, ra.Size()), Closer: ra}, nil
+}
+
+func (b *decryptingBucketReader) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	ra, err := b.readerAt(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if ra == nil {
+		return b.BucketReader.GetRange(ctx, name, off, length)
+	}
+	if off > ra.Size() {
+		off = ra.Size()
+	}
+	if length < 0 || off+length > ra.Size() {
+		length = ra.Size() - off
+	}
+	return &readerAtCloser{Reader: io.NewSectionReader(ra, off, length), Closer: ra}, nil
+}
+
+func (b *decryptingBucketReader) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	attrs, err := b.BucketReader.Attributes(ctx, name)
+	if err != nil {
+		return attrs, err
+	}
+	if idx := b.fileIndex(name); idx >= 0 {
+		f, err := b.encryption.newEncryptedFile(b.meta, idx, name, attrs.Size)
+		if err != nil {
+			return attrs, err
+		}
+		attrs.Size = f.plaintextSize()
+	}
+	return attrs, nil
+}
+
+func (b *decryptingBucketReader) ReaderAt(ctx context.Context, name string) (phlareobjstore.ReaderAt, error) {
+	ra, err := b.readerAt(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if ra == nil {
+		return b.BucketReader.ReaderAt(ctx, name)
+	}
+	return ra, nil
+}
+
+// decryptingReaderAt reads an encrypted file, decrypting the segments
+// covering each read. The segment decrypted last is kept until Close, as
+// consecutive reads mostly read the same segment.
+type decryptingReaderAt struct {
+	file       *encryptedFile
+	ciphertext phlareobjstore.ReaderAt
+
+	mtx       sync.Mutex
+	segment   int64
+	plaintext []byte
+	sealed    []byte
+}
+
+func (r *decryptingReaderAt) Size() int64 {
+	return r.file.plaintextSize()
+}
+
+func (r *decryptingReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	segmentSize := int64(r.file.meta.Encryption.SegmentSize)
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.Size() {
+			return n, io.EOF
+		}
+		if err := r.decrypt(pos / segmentSize); err != nil {
+			return n, err
+		}
+		n += copy(p[n:], r.plaintext[pos%segmentSize:])
+	}
+	return n, nil
+}
+
+// decrypt decrypts the segment, unless it has been decrypted last.
+func (r *decryptingReaderAt) decrypt(segment int64) error {
+	if r.segment == segment {
+		return nil
+	}
+	off, length := r.file.segmentRange(segment)
+	if int64(cap(r.sealed)) < length {
+		r.sealed = make([]byte, length)
+	}
+	r.sealed = r.sealed[:length]
+	if _, err := r.ciphertext.ReadAt(r.sealed, off); err != nil && err != io.EOF {
+		return err
+	}
+	plaintext, err := r.file.open(r.plaintext, segment, r.sealed)
+	if err != nil {
+		r.segment = -1
+		return err
+	}
+	r.segment, r.plaintext = segment, plaintext
+	return nil
+}
+
+// Close drops the decrypted segment and closes the ciphertext.
+func (r *decryptingReaderAt) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.segment, r.plaintext, r.sealed = -1, nil, nil
+	return r.ciphertext.Close()
+}
+
+type readerAtCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func contextWithBlockEncryption(ctx context.Context, e *blockEncryption) context.Context {
+	return context.WithValue(ctx, blockEncryptionContextKey, e)
+}
+
+func contextBlockEncryption(ctx context.Context) *blockEncryption {
+	e, _ := ctx.Value(blockEncryptionContextKey).(*blockEncryption)
+	return e
+}
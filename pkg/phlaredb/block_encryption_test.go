@@ -0,0 +1,180 @@
+package phlaredb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+	pprofth "github.com/grafana/phlare/pkg/pprof/testhelper"
+)
+
+func newEncryptedTestBlock(t *testing.T, key []byte) (string, *block.Meta) {
+	t.Helper()
+	return newTestBlock(t, Config{BlockEncryptionKey: key}, nil, func(ctx context.Context, head *Head) error {
+		return ingestStreamProfiles(ctx, head.Ingest, 0, 9, func(_ int, p *pprofth.ProfileBuilder) {
+			p.ForStacktraceString("func1", "func2").AddSamples(10)
+		})
+	})
+}
+
+func selectAllFromBlocks(ctx context.Context, t *testing.T, localPath string) ([]Profile, error) {
+	t.Helper()
+	bkt, err := filesystem.NewBucket(localPath)
+	require.NoError(t, err)
+	q := NewBlockQuerier(ctx, bkt)
+	require.NoError(t, q.Sync(ctx))
+	defer func() {
+		require.NoError(t, q.Close())
+	}()
+
+	it, err := q.Queriers().SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: "{}",
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return iter.Slice(it)
+}
+
+func TestBlockEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	encryption, err := newBlockEncryption(key)
+	require.NoError(t, err)
+
+	localPath, meta := newEncryptedTestBlock(t, key)
+	require.NotNil(t, meta.Encryption)
+	require.Equal(t, blockEncryptionAlgorithm, meta.Encryption.Algorithm)
+	require.Len(t, meta.Encryption.Nonce, 12)
+	require.ElementsMatch(t, []string{"index.tsdb", "profiles.parquet"}, meta.Encryption.Files)
+
+	// the files on disk are not readable without decryption
+	_, err = index.NewFileReader(filepath.Join(localPath, meta.ULID.String(), block.IndexFilename))
+	require.Error(t, err)
+
+	t.Run("round trip", func(t *testing.T) {
+		profiles, err := selectAllFromBlocks(contextWithBlockEncryption(testContext(t), encryption), t, localPath)
+		require.NoError(t, err)
+		require.Len(t, profiles, 9)
+		for i, p := range profiles {
+			require.Equal(t, streams[i%3], p.Labels().Get("stream"))
+			require.Equal(t, model.TimeFromUnixNano(time.Second.Nanoseconds()*int64(i)), p.Timestamp())
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		wrong, err := newBlockEncryption(bytes.Repeat([]byte{0x24}, 32))
+		require.NoError(t, err)
+		_, err = selectAllFromBlocks(contextWithBlockEncryption(testContext(t), wrong), t, localPath)
+		require.ErrorIs(t, err, ErrBlockDecryption)
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		_, err := selectAllFromBlocks(testContext(t), t, localPath)
+		require.ErrorIs(t, err, ErrBlockDecryption)
+	})
+}
+
+func TestBlockEncryptionDisabledByDefault(t *testing.T) {
+	localPath, meta := newEncryptedTestBlock(t, nil)
+	require.Nil(t, meta.Encryption)
+
+	r, err := index.NewFileReader(filepath.Join(localPath, meta.ULID.String(), block.IndexFilename))
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+}
+
+func TestNewBlockEncryptionInvalidKey(t *testing.T) {
+	_, err := newBlockEncryption([]byte("too short"))
+	require.Error(t, err)
+}
+
+// TestBlockEncryptionSegments ensures that reads spanning segments decrypt
+// only the segments they cover and that truncated files are detected.
+func TestBlockEncryptionSegments(t *testing.T) {
+	ctx := context.Background()
+	encryption, err := newBlockEncryption(bytes.Repeat([]byte{0x42}, 32))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(1))
+	content := map[string][]byte{
+		encryptedBlockFiles[0]: make([]byte, 2*blockEncryptionSegmentSize),
+		encryptedBlockFiles[1]: make([]byte, 3*blockEncryptionSegmentSize+100),
+	}
+	for name, data := range content {
+		_, _ = rnd.Read(data)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o644))
+	}
+	meta := &block.Meta{ULID: ulid.MustNew(1, rnd)}
+	require.NoError(t, encryption.encryptBlock(dir, meta))
+	require.Equal(t, blockEncryptionSegmentSize, meta.Encryption.SegmentSize)
+
+	bkt, err := filesystem.NewBucket(dir)
+	require.NoError(t, err)
+	r := newDecryptingBucketReader(bkt, encryption, meta)
+
+	for name, data := range content {
+		attrs, err := r.Attributes(ctx, name)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), attrs.Size)
+
+		ra, err := r.ReaderAt(ctx, name)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), ra.Size())
+		for _, off := range []int64{0, blockEncryptionSegmentSize - 10, blockEncryptionSegmentSize, int64(len(data)) - 20} {
+			buf := make([]byte, 20)
+			_, err := ra.ReadAt(buf, off)
+			require.NoError(t, err)
+			require.Equal(t, data[off:off+20], buf, "offset %d of %s", off, name)
+		}
+		// reads past the end return the remaining bytes
+		buf := make([]byte, 20)
+		n, err := ra.ReadAt(buf, int64(len(data))-5)
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, data[len(data)-5:], buf[:n])
+		require.NoError(t, ra.Close())
+
+		rc, err := r.GetRange(ctx, name, blockEncryptionSegmentSize-3, blockEncryptionSegmentSize+2)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, data[blockEncryptionSegmentSize-3:2*blockEncryptionSegmentSize-1], got)
+
+		rc, err = r.Get(ctx, name)
+		require.NoError(t, err)
+		got, err = io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, data, got)
+	}
+
+	// dropping the last segment is detected
+	name := encryptedBlockFiles[0]
+	path := filepath.Join(dir, name)
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, stat.Size()/2))
+	rc, err := r.Get(ctx, name)
+	require.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	require.ErrorIs(t, err, ErrBlockDecryption)
+	require.NoError(t, rc.Close())
+}
@@ -0,0 +1,251 @@
+package phlaredb
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/segmentio/parquet-go"
+
+	"github.com/grafana/phlare/pkg/iter"
+	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+// exportBatchSize is the number of profiles whose stacktraces are resolved at once.
+const exportBatchSize = 256
+
+// ExportedProfile is a profile as written by ExportNDJSON.
+type ExportedProfile struct {
+	ID        string            `json:"id"`
+	Labels    map[string]string `json:"labels"`
+	TimeNanos int64             `json:"timeNanos"`
+	Samples   []ExportedSample  `json:"samples"`
+}
+
+// ExportedSample is a sample with its stacktrace resolved to function names,
+// starting with the leaf.
+type ExportedSample struct {
+	Stack []string `json:"stack"`
+	Value int64    `json:"value"`
+}
+
+// ExportNDJSON writes the profiles of the block in dir to w as newline
+// delimited JSON, one ExportedProfile per line, ordered by series then time.
+//
+// Profiles are streamed in batches, only the symbols of the block are held in
+// memory, as for queries. The directory name of the block must be its ULID.
+func ExportNDJSON(ctx context.Context, dir string, w io.Writer) error {
+	meta, _, err := block.MetaFromDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "reading block meta")
+	}
+	bkt, err := filesystem.NewBucket(filepath.Dir(dir))
+	if err != nil {
+		return err
+	}
+	q := newSingleBlockQuerierFromMeta(ctx, bkt, meta)
+	defer q.Close()
+	if err := q.open(ctx); err != nil {
+		return err
+	}
+
+	series, err := seriesBySeriesIndex(q.index)
+	if err != nil {
+		return err
+	}
+
+	// row groups are sorted on their own, merge them to keep the series/time order
+	h := make(exportHeap, 0, len(q.profiles.file.RowGroups()))
+	for _, rg := range q.profiles.file.RowGroups() {
+		r := &exportRowGroup{reader: parquet.NewGenericRowGroupReader[*schemav1.Profile](rg)}
+		defer r.reader.Close()
+		ok, err := r.next()
+		if err != nil {
+			return errors.Wrap(err, "reading profiles")
+		}
+		if ok {
+			h = append(h, r)
+		}
+	}
+	heap.Init(&h)
+
+	var (
+		bw    = bufio.NewWriter(w)
+		enc   = json.NewEncoder(bw)
+		batch = make([]*schemav1.Profile, 0, exportBatchSize)
+	)
+	for h.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch = append(batch, h[0].at())
+		ok, err := h[0].next()
+		if err != nil {
+			return errors.Wrap(err, "reading profiles")
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+		if len(batch) == exportBatchSize {
+			if err := q.exportProfiles(ctx, series, enc, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := q.exportProfiles(ctx, series, enc, batch); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (b *singleBlockQuerier) exportProfiles(ctx context.Context, series map[uint32]splitSeries, enc *json.Encoder, profiles []*schemav1.Profile) error {
+	if len(profiles) == 0 {
+		return nil
+	}
+	ids := newUniqueIDs[struct{}]()
+	for _, p := range profiles {
+		for _, s := range p.Samples {
+			ids[int64(s.StacktraceID)] = struct{}{}
+		}
+	}
+	stacks, err := b.resolveStacktraceNames(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range profiles {
+		s, ok := series[p.SeriesIndex]
+		if !ok {
+			return errors.Errorf("profile references series index %d, which does not exist in %s", p.SeriesIndex, block.IndexFilename)
+		}
+		exported := ExportedProfile{
+			ID:        p.ID.String(),
+			Labels:    make(map[string]string, len(s.lbls)),
+			TimeNanos: p.TimeNanos,
+			Samples:   make([]ExportedSample, len(p.Samples)),
+		}
+		for _, l := range s.lbls {
+			exported.Labels[l.Name] = l.Value
+		}
+		for i, sample := range p.Samples {
+			exported.Samples[i] = ExportedSample{
+				Stack: stacks[int64(sample.StacktraceID)],
+				Value: sample.Value,
+			}
+		}
+		if err := enc.Encode(&exported); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveStacktraceNames returns the function names of the given stacktraces,
+// inlined functions are part of the stack.
+func (b *singleBlockQuerier) resolveStacktraceNames(ctx context.Context, ids uniqueIDs[struct{}]) (map[int64][]string, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "ResolveStacktraceNames - Block")
+	defer sp.Finish()
+	var (
+		stacktraceIDs = make([]int64, 0, len(ids))
+		names         = make(map[int64][]string, len(ids))
+	)
+	for id := range ids {
+		stacktraceIDs = append(stacktraceIDs, id)
+	}
+	sort.Slice(stacktraceIDs, func(i, j int) bool {
+		return stacktraceIDs[i] < stacktraceIDs[j]
+	})
+
+	stacktraces := repeatedColumnIter(ctx, b.stacktraces.file, "LocationIDs.list.element", iter.NewSliceIterator(stacktraceIDs))
+	defer stacktraces.Close()
+	for stacktraces.Next() {
+		s := stacktraces.At()
+		for _, v := range s.Values {
+			locID := v.Uint64()
+			if locID >= uint64(len(b.locations.cache)) {
+				return nil, errors.Errorf("stacktrace %d references location %d, which does not exist", s.Row, locID)
+			}
+			for _, line := range b.locations.cache[locID].Line {
+				if line.FunctionId >= uint64(len(b.functions.cache)) {
+					return nil, errors.Errorf("location %d references function %d, which does not exist", locID, line.FunctionId)
+				}
+				nameID := b.functions.cache[line.FunctionId].Name
+				if nameID < 0 || nameID >= int64(len(b.strings.cache)) {
+					return nil, errors.Errorf("function %d references string %d, which does not exist", line.FunctionId, nameID)
+				}
+				names[s.Row] = append(names[s.Row], b.strings.cache[nameID].String)
+			}
+		}
+	}
+	if err := stacktraces.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// exportRowGroup reads the profiles of a row group in batches.
+type exportRowGroup struct {
+	reader *parquet.GenericReader[*schemav1.Profile]
+	buf    []*schemav1.Profile
+	pos    int
+	eof    bool
+}
+
+func (r *exportRowGroup) at() *schemav1.Profile {
+	return r.buf[r.pos]
+}
+
+func (r *exportRowGroup) next() (bool, error) {
+	r.pos++
+	if r.pos < len(r.buf) {
+		return true, nil
+	}
+	if r.eof {
+		return false, nil
+	}
+	// profiles handed out are still referenced, so they can't be reused
+	r.buf = make([]*schemav1.Profile, verifyBatchSize)
+	n, err := r.reader.Read(r.buf)
+	r.buf, r.pos = r.buf[:n], 0
+	if err == io.EOF {
+		r.eof = true
+	} else if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+type exportHeap []*exportRowGroup
+
+func (h exportHeap) Len() int      { return len(h) }
+func (h exportHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h exportHeap) Less(i, j int) bool {
+	pi, pj := h[i].at(), h[j].at()
+	if pi.SeriesIndex != pj.SeriesIndex {
+		return pi.SeriesIndex < pj.SeriesIndex
+	}
+	return pi.TimeNanos < pj.TimeNanos
+}
+
+func (h *exportHeap) Push(x interface{}) {
+	*h = append(*h, x.(*exportRowGroup))
+}
+
+func (h *exportHeap) Pop() interface{} {
+	n := len(*h)
+	x := (*h)[n-1]
+	*h = (*h)[0 : n-1]
+	return x
+}
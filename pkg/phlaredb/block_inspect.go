@@ -0,0 +1,327 @@
+package phlaredb
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/parquet-go"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+)
+
+// BlockInfo summarizes the content of a block.
+type BlockInfo struct {
+	ULID         string            `json:"ulid"`
+	MinTimeNanos int64             `json:"minTimeNanos"`
+	MaxTimeNanos int64             `json:"maxTimeNanos"`
+	NumSeries    uint64            `json:"numSeries"`
+	NumProfiles  uint64            `json:"numProfiles"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	ProfileTypes []ProfileTypeInfo `json:"profileTypes"`
+	Files        []ParquetFileInfo `json:"files"`
+}
+
+// ProfileTypeInfo holds the series and profile counts of a profile type.
+type ProfileTypeInfo struct {
+	ProfileType string `json:"profileType"`
+	NumSeries   uint64 `json:"numSeries"`
+	NumProfiles uint64 `json:"numProfiles"`
+}
+
+// ParquetFileInfo describes the layout of a parquet file of a block.
+type ParquetFileInfo struct {
+	RelPath   string         `json:"relPath"`
+	SizeBytes int64          `json:"sizeBytes"`
+	NumRows   int64          `json:"numRows"`
+	Codecs    []string       `json:"codecs"`
+	RowGroups []RowGroupInfo `json:"rowGroups"`
+}
+
+// RowGroupInfo describes a row group of a parquet file.
+type RowGroupInfo struct {
+	NumRows           int64 `json:"numRows"`
+	CompressedBytes   int64 `json:"compressedBytes"`
+	UncompressedBytes int64 `json:"uncompressedBytes"`
+}
+
+// InspectBlock returns a summary of the block in dir. Only the meta file, the
+// parquet metadata, the TSDB index and the series index column of the
+// profiles are read.
+func InspectBlock(ctx context.Context, dir string) (BlockInfo, error) {
+	info := BlockInfo{ULID: filepath.Base(dir)}
+
+	meta, _, err := block.MetaFromDir(dir)
+	if err != nil {
+		return info, errors.Wrap(err, "reading block meta")
+	}
+	if len(meta.Labels) > 0 {
+		info.Labels = meta.Labels
+	}
+
+	// map series indexes to their profile type
+	idx, err := index.NewFileReader(filepath.Join(dir, block.IndexFilename))
+	if err != nil {
+		return info, errors.Wrap(err, "opening tsdb index")
+	}
+	defer idx.Close()
+
+	k, v := index.AllPostingsKey()
+	postings, err := idx.Postings(k, nil, v)
+	if err != nil {
+		return info, errors.Wrap(err, "reading tsdb postings")
+	}
+	var (
+		lbls             phlaremodel.Labels
+		chks             = make([]index.ChunkMeta, 1)
+		profileTypes     = make(map[string]*ProfileTypeInfo)
+		seriesTypes      = make(map[uint32]*ProfileTypeInfo)
+		minTime, maxTime int64
+	)
+	for postings.Next() {
+		if _, err := idx.Series(postings.At(), &lbls, &chks); err != nil {
+			return info, errors.Wrap(err, "reading tsdb series")
+		}
+		profileType := lbls.Get(phlaremodel.LabelNameProfileType)
+		t, ok := profileTypes[profileType]
+		if !ok {
+			t = &ProfileTypeInfo{ProfileType: profileType}
+			profileTypes[profileType] = t
+		}
+		t.NumSeries++
+		info.NumSeries++
+		for _, chk := range chks {
+			seriesTypes[chk.SeriesIndex] = t
+			if info.NumSeries == 1 || chk.MinTime < minTime {
+				minTime = chk.MinTime
+			}
+			if info.NumSeries == 1 || chk.MaxTime > maxTime {
+				maxTime = chk.MaxTime
+			}
+		}
+	}
+	if err := postings.Err(); err != nil {
+		return info, errors.Wrap(err, "reading tsdb postings")
+	}
+	info.MinTimeNanos, info.MaxTimeNanos = minTime, maxTime
+
+	// count the profiles per series
+	profilesPath := (&schemav1.ProfilePersister{}).Name() + block.ParquetSuffix
+	counts, err := countProfilesPerSeries(ctx, filepath.Join(dir, profilesPath))
+	if err != nil {
+		return info, errors.Wrapf(err, "reading %s", profilesPath)
+	}
+	for seriesIndex, count := range counts {
+		info.NumProfiles += count
+		if t, ok := seriesTypes[seriesIndex]; ok {
+			t.NumProfiles += count
+		}
+	}
+
+	for _, t := range profileTypes {
+		info.ProfileTypes = append(info.ProfileTypes, *t)
+	}
+	sort.Slice(info.ProfileTypes, func(i, j int) bool {
+		return info.ProfileTypes[i].ProfileType < info.ProfileTypes[j].ProfileType
+	})
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return info, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), block.ParquetSuffix) {
+			continue
+		}
+		f, err := inspectParquetFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return info, err
+		}
+		info.Files = append(info.Files, f)
+	}
+
+	return info, nil
+}
+
+func openParquetFile(path string) (*os.File, *parquet.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "opening %s", filepath.Base(path))
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrapf(err, "getting stat of %s", filepath.Base(path))
+	}
+	pf, err := parquet.OpenFile(f, stat.Size(), parquet.SkipPageIndex(true), parquet.SkipBloomFilters(true))
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrapf(err, "reading parquet file %s", filepath.Base(path))
+	}
+	return f, pf, nil
+}
+
+func inspectParquetFile(path string) (ParquetFileInfo, error) {
+	f, pf, err := openParquetFile(path)
+	if err != nil {
+		return ParquetFileInfo{}, err
+	}
+	defer f.Close()
+
+	info := ParquetFileInfo{
+		RelPath:   filepath.Base(path),
+		SizeBytes: pf.Size(),
+		NumRows:   pf.NumRows(),
+	}
+	codecs := make(map[string]struct{})
+	for _, rg := range pf.Metadata().RowGroups {
+		rgInfo := RowGroupInfo{NumRows: rg.NumRows}
+		for _, c := range rg.Columns {
+			rgInfo.CompressedBytes += c.MetaData.TotalCompressedSize
+			rgInfo.UncompressedBytes += c.MetaData.TotalUncompressedSize
+			codecs[c.MetaData.Codec.String()] = struct{}{}
+		}
+		info.RowGroups = append(info.RowGroups, rgInfo)
+	}
+	for c := range codecs {
+		info.Codecs = append(info.Codecs, c)
+	}
+	sort.Strings(info.Codecs)
+	return info, nil
+}
+
+// ColumnStat sums up the column chunks of a column over all row groups.
+type ColumnStat struct {
+	CompressedBytes   int64    `json:"compressedBytes"`
+	UncompressedBytes int64    `json:"uncompressedBytes"`
+	NumValues         int64    `json:"numValues"`
+	Encodings         []string `json:"encodings"`
+}
+
+// ColumnSizes returns the stats of the columns of the parquet files of the
+// block in dir, read from the parquet metadata. As the tables share column
+// names, the columns are keyed by the table and their path, e.g.
+// "profiles/Samples.list.element.StacktraceID".
+func ColumnSizes(dir string) (map[string]ColumnStat, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]ColumnStat)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), block.ParquetSuffix) {
+			continue
+		}
+		if err := addColumnSizes(filepath.Join(dir, e.Name()), stats); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+func addColumnSizes(path string, stats map[string]ColumnStat) error {
+	f, pf, err := openParquetFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		table     = strings.TrimSuffix(filepath.Base(path), block.ParquetSuffix)
+		encodings = make(map[string]map[string]struct{})
+	)
+	for _, rg := range pf.Metadata().RowGroups {
+		for _, c := range rg.Columns {
+			key := table + "/" + strings.Join(c.MetaData.PathInSchema, ".")
+			stat := stats[key]
+			stat.CompressedBytes += c.MetaData.TotalCompressedSize
+			stat.UncompressedBytes += c.MetaData.TotalUncompressedSize
+			stat.NumValues += c.MetaData.NumValues
+			stats[key] = stat
+
+			if _, ok := encodings[key]; !ok {
+				encodings[key] = make(map[string]struct{})
+			}
+			for _, enc := range c.MetaData.Encoding {
+				encodings[key][enc.String()] = struct{}{}
+			}
+		}
+	}
+	for key, encs := range encodings {
+		stat := stats[key]
+		for enc := range encs {
+			stat.Encodings = append(stat.Encodings, enc)
+		}
+		sort.Strings(stat.Encodings)
+		stats[key] = stat
+	}
+	return nil
+}
+
+// countProfilesPerSeries reads the series index column of the profiles.
+func countProfilesPerSeries(ctx context.Context, path string) (map[uint32]uint64, error) {
+	counts := make(map[uint32]uint64)
+	err := readProfilesColumn(ctx, path, "SeriesIndex", func(v parquet.Value) {
+		counts[v.Uint32()]++
+	})
+	return counts, err
+}
+
+// readProfilesColumn calls fn for each value of the column of all profiles in
+// the parquet file at path.
+func readProfilesColumn(ctx context.Context, path string, name string, fn func(parquet.Value)) error {
+	f, pf, err := openParquetFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	column, found := pf.Schema().Lookup(name)
+	if !found {
+		return errors.Errorf("column %s not found", name)
+	}
+
+	buf := make([]parquet.Value, verifyBatchSize)
+	for _, rg := range pf.RowGroups() {
+		pages := rg.ColumnChunks()[column.ColumnIndex].Pages()
+		for {
+			if err := ctx.Err(); err != nil {
+				pages.Close()
+				return err
+			}
+			page, err := pages.ReadPage()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pages.Close()
+				return err
+			}
+			values := page.Values()
+			for {
+				n, err := values.ReadValues(buf)
+				for _, v := range buf[:n] {
+					fn(v)
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					pages.Close()
+					return err
+				}
+			}
+		}
+		if err := pages.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package phlaredb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	pprofth "github.com/grafana/phlare/pkg/pprof/testhelper"
+)
+
+func TestInspectBlock(t *testing.T) {
+	dir := newVerifyTestBlock(t)
+
+	info, err := InspectBlock(context.Background(), dir)
+	require.NoError(t, err)
+
+	require.Equal(t, []ProfileTypeInfo{
+		{ProfileType: "process_cpu:cpu:nanoseconds:cpu:nanoseconds", NumSeries: 3, NumProfiles: 9},
+	}, info.ProfileTypes)
+	require.Equal(t, uint64(3), info.NumSeries)
+	require.Equal(t, uint64(9), info.NumProfiles)
+	require.Equal(t, int64(0), info.MinTimeNanos)
+	require.Equal(t, 8*time.Second.Nanoseconds(), info.MaxTimeNanos)
+
+	require.Len(t, info.Files, 6)
+	for _, f := range info.Files {
+		require.NotEmpty(t, f.RowGroups, f.RelPath)
+		require.NotEmpty(t, f.Codecs, f.RelPath)
+		require.Greater(t, f.SizeBytes, int64(0), f.RelPath)
+		if f.RelPath == "profiles.parquet" {
+			require.Equal(t, int64(9), f.NumRows)
+		}
+	}
+
+	// the info is serializable to JSON
+	data, err := json.Marshal(info)
+	require.NoError(t, err)
+	var decoded BlockInfo
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, info, decoded)
+}
+
+func TestInspectBlockLabels(t *testing.T) {
+	ctx := testContext(t)
+	labels := map[string]string{
+		"tenant":      "team-a",
+		"source":      "shipper",
+		"config_hash": "d41d8cd98f00b204",
+	}
+	// the head is split into multiple blocks, which all carry the labels
+	head, err := NewHead(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockProfiles: 2,
+		BlockLabels:      labels,
+	}, NoLimit)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		p := pprofth.NewProfileBuilder(int64(time.Duration(i)*time.Second)).CPUProfile().WithLabels("job", "foo")
+		p.ForStacktraceString("func1").AddSamples(1)
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+	blocks, err := head.Flush(ctx)
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+
+	for _, b := range blocks {
+		meta, _, err := block.MetaFromDir(b.Dir)
+		require.NoError(t, err)
+		require.Equal(t, labels, meta.Labels)
+
+		info, err := InspectBlock(ctx, b.Dir)
+		require.NoError(t, err)
+		require.Equal(t, labels, info.Labels)
+	}
+}
+
+func TestColumnSizes(t *testing.T) {
+	dir := newVerifyTestBlock(t)
+
+	stats, err := ColumnSizes(dir)
+	require.NoError(t, err)
+
+	stacktraceIDs, ok := stats["profiles/Samples.list.element.StacktraceID"]
+	require.True(t, ok, "columns: %v", lo.Keys(stats))
+	require.Greater(t, stacktraceIDs.CompressedBytes, int64(0))
+	require.Greater(t, stacktraceIDs.UncompressedBytes, int64(0))
+	require.Greater(t, stacktraceIDs.NumValues, int64(0))
+	require.NotEmpty(t, stacktraceIDs.Encodings)
+
+	// columns of the same name are kept apart per table
+	require.Contains(t, stats, "stacktraces/ID")
+	require.Contains(t, stats, "strings/ID")
+}
+
+func TestExportNDJSON(t *testing.T) {
+	ctx := testContext(t)
+	head := newTestHead(t)
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+		// series span multiple row groups
+		if i == 4 {
+			require.NoError(t, head.profiles.cutRowGroup())
+		}
+	}
+	_, err := head.Flush(ctx)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, ExportNDJSON(ctx, head.localPath, &buf))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 9)
+	ids := make(map[string]struct{})
+	for i, line := range lines {
+		var p ExportedProfile
+		require.NoError(t, json.Unmarshal([]byte(line), &p))
+
+		// ordered by series then time
+		stream := streams[i/3]
+		require.Equal(t, "foo", p.Labels["job"])
+		require.Equal(t, stream, p.Labels["stream"])
+		require.Equal(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds", p.Labels[phlaremodel.LabelNameProfileType])
+		require.Equal(t, time.Second.Nanoseconds()*int64(3*(i%3)+i/3), p.TimeNanos)
+		require.NotContains(t, ids, p.ID)
+		ids[p.ID] = struct{}{}
+		require.ElementsMatch(t, []ExportedSample{
+			{Stack: []string{"func1", "func2"}, Value: 10},
+			{Stack: []string{"func1"}, Value: 20},
+		}, p.Samples)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -14,20 +16,23 @@ import (
 	"github.com/bufbuild/connect-go"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/gogo/status"
 	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
 	"github.com/grafana/dskit/multierror"
+	"github.com/grafana/dskit/runutil"
 	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
-	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/samber/lo"
 	"github.com/segmentio/parquet-go"
+	"go.uber.org/atomic"
 	"golang.org/x/exp/constraints"
 	"golang.org/x/sync/errgroup"
-	"google.golang.org/grpc/codes"
 
 	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
@@ -92,10 +97,67 @@ func (b *BlockQuerier) Queriers() Queriers {
 	res := make([]Querier, 0, len(b.queriers))
 	for _, q := range b.queriers {
 		res = append(res, q)
+		// the parts of a block are queried on their own, as their profiles
+		// reference their own series and symbols
+		for _, part := range q.parts {
+			res = append(res, part)
+		}
 	}
 	return res
 }
 
+// acquireQueriers returns the queriers like Queriers and marks their blocks
+// as used by a query, until release is called. The compactor doesn't merge
+// blocks in use.
+func (b *BlockQuerier) acquireQueriers() (queriers Queriers, release func()) {
+	b.queriersLock.RLock()
+	defer b.queriersLock.RUnlock()
+
+	acquired := copySlice(b.queriers)
+	for _, q := range acquired {
+		q.acquire()
+	}
+	release = func() {
+		for _, q := range acquired {
+			if err := q.release(); err != nil {
+				level.Warn(b.logger).Log("msg", "closing released block failed", "block", q.meta.ULID, "err", err)
+			}
+		}
+	}
+	queriers = make([]Querier, 0, len(acquired))
+	for _, q := range acquired {
+		queriers = append(queriers, q)
+		for _, part := range q.parts {
+			queriers = append(queriers, part)
+		}
+	}
+	return queriers, release
+}
+
+// inUse returns true if the block with the given ULID is used by a query.
+func (b *BlockQuerier) inUse(id ulid.ULID) bool {
+	b.queriersLock.RLock()
+	defer b.queriersLock.RUnlock()
+	for _, q := range b.queriers {
+		if q.meta.ULID == id {
+			return q.refs.Load() > 0
+		}
+	}
+	return false
+}
+
+// loaded returns true, if the block has been loaded by the last sync.
+func (b *BlockQuerier) loaded(id ulid.ULID) bool {
+	b.queriersLock.RLock()
+	defer b.queriersLock.RUnlock()
+	for _, q := range b.queriers {
+		if q.meta.ULID == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *BlockQuerier) BlockMetas(ctx context.Context) (metas []*block.Meta, _ error) {
 	var names []ulid.ULID
 	if err := b.bucketReader.Iter(ctx, "", func(n string) error {
@@ -200,8 +262,9 @@ func (b *BlockQuerier) Sync(ctx context.Context) error {
 
 	for pos, m := range observedMetas {
 
+		// a block with new parts needs a new querier
 		q, ok := querierByULID[m.ULID]
-		if ok {
+		if ok && len(q.meta.Parts) == len(m.Parts) {
 			b.queriers[pos] = q
 			delete(querierByULID, m.ULID)
 			continue
@@ -215,9 +278,9 @@ func (b *BlockQuerier) Sync(ctx context.Context) error {
 	})
 	b.queriersLock.Unlock()
 
-	// now close no longer available queries
+	// now close no longer available queries, once no query uses them anymore
 	for _, q := range querierByULID {
-		if err := q.Close(); err != nil {
+		if err := q.remove(); err != nil {
 			return err
 		}
 	}
@@ -238,30 +301,6 @@ func (b *BlockQuerier) Close() error {
 	return errs.Err()
 }
 
-type TableInfo struct {
-	Rows      uint64
-	RowGroups uint64
-	Bytes     uint64
-}
-
-type BlockInfo struct {
-	ID          ulid.ULID
-	MinTime     model.Time
-	MaxTime     model.Time
-	Profiles    TableInfo
-	Stacktraces TableInfo
-	Locations   TableInfo
-	Functions   TableInfo
-	Mappings    TableInfo
-	Strings     TableInfo
-	Series      uint64
-}
-
-func (b *BlockQuerier) BlockInfo() []BlockInfo {
-	result := make([]BlockInfo, len(b.queriers))
-	return result
-}
-
 type minMax struct {
 	min, max model.Time
 }
@@ -277,8 +316,20 @@ type singleBlockQuerier struct {
 	bucketReader phlareobjstore.BucketReader
 	meta         *block.Meta
 
+	// rowGroupConcurrency is the maximum number of row groups of the profiles table scanned in parallel.
+	rowGroupConcurrency int
+
 	tables []tableReader
 
+	// parts are the queriers of the blocks appended to the block.
+	parts []*singleBlockQuerier
+
+	// refs is the number of queries using the block. A block removed by a
+	// sync is closed by the last of them, guarded by refsLock.
+	refsLock sync.Mutex
+	refs     atomic.Int32
+	removed  bool
+
 	openLock    sync.Mutex
 	opened      bool
 	index       *index.Reader
@@ -297,6 +348,11 @@ func newSingleBlockQuerierFromMeta(phlarectx context.Context, bucketReader phlar
 
 		bucketReader: phlareobjstore.BucketReaderWithPrefix(bucketReader, meta.ULID.String()),
 		meta:         meta,
+
+		rowGroupConcurrency: runtime.GOMAXPROCS(0),
+	}
+	if meta.Encryption != nil {
+		q.bucketReader = newDecryptingBucketReader(q.bucketReader, contextBlockEncryption(phlarectx), meta)
 	}
 	q.tables = []tableReader{
 		&q.strings,
@@ -306,12 +362,50 @@ func newSingleBlockQuerierFromMeta(phlarectx context.Context, bucketReader phlar
 		&q.stacktraces,
 		&q.profiles,
 	}
+	for _, part := range meta.Parts {
+		q.parts = append(q.parts, newSingleBlockQuerierFromMeta(phlarectx,
+			phlareobjstore.BucketReaderWithPrefix(bucketReader, filepath.Join(meta.ULID.String(), block.PartsDirname)),
+			part,
+		))
+	}
 	return q
 }
 
+// acquire marks the block as used by a query until release is called.
+func (b *singleBlockQuerier) acquire() {
+	b.refsLock.Lock()
+	defer b.refsLock.Unlock()
+	b.refs.Inc()
+}
+
+// release marks the block as no longer used by a query. The last query
+// closes a removed block.
+func (b *singleBlockQuerier) release() error {
+	b.refsLock.Lock()
+	defer b.refsLock.Unlock()
+	if b.refs.Dec() == 0 && b.removed {
+		return b.Close()
+	}
+	return nil
+}
+
+// remove closes the block no longer available, or leaves it to the last
+// query using it.
+func (b *singleBlockQuerier) remove() error {
+	b.refsLock.Lock()
+	defer b.refsLock.Unlock()
+	b.removed = true
+	if b.refs.Load() == 0 {
+		return b.Close()
+	}
+	return nil
+}
+
+// Close closes the files of the block, they are opened again by the next query.
 func (b *singleBlockQuerier) Close() error {
 	b.openLock.Lock()
 	defer b.openLock.Unlock()
+	b.opened = false
 	errs := multierror.New()
 	if b.index != nil {
 		err := b.index.Close()
@@ -326,6 +420,11 @@ func (b *singleBlockQuerier) Close() error {
 			errs.Add(err)
 		}
 	}
+	for _, part := range b.parts {
+		if err := part.Close(); err != nil {
+			errs.Add(err)
+		}
+	}
 	return errs.Err()
 }
 
@@ -333,6 +432,11 @@ func (b *singleBlockQuerier) InRange(start, end model.Time) bool {
 	return b.meta.InRange(start, end)
 }
 
+// mergeCacheID is the ULID of the block, as blocks are immutable.
+func (b *singleBlockQuerier) mergeCacheID() string {
+	return b.meta.ULID.String()
+}
+
 // reconstructMeta can regenerate a missing metadata file from the parquet structures
 func (b *singleBlockQuerier) reconstructMeta(ctx context.Context) (*block.Meta, error) {
 	tsBoundary, _, err := b.readTSBoundaries(ctx)
@@ -395,19 +499,42 @@ func newMapPredicate[K constraints.Integer, V any](m map[K]V) query.Predicate {
 
 func (m *mapPredicate[K, V]) KeepColumnChunk(c parquet.ColumnChunk) bool {
 	if ci := c.ColumnIndex(); ci != nil {
+		keep := false
 		for i := 0; i < ci.NumPages(); i++ {
 			min := K(ci.MinValue(i).Int64())
 			max := K(ci.MaxValue(i).Int64())
 			if m.max >= min && m.min <= max {
-				return true
+				keep = true
+				break
 			}
 		}
-		return false
+		if !keep {
+			return false
+		}
+	}
+
+	if bf := c.BloomFilter(); bf != nil {
+		return m.checkBloomFilter(bf, c.Type().Kind())
 	}
 
 	return true
 }
 
+// checkBloomFilter returns false, if the bloom filter proves that the column
+// chunk contains none of the values. Errors reading the filter keep the chunk.
+func (m *mapPredicate[K, V]) checkBloomFilter(bf parquet.BloomFilter, kind parquet.Kind) bool {
+	for k := range m.m {
+		v := parquet.Int64Value(int64(k))
+		if kind == parquet.Int32 {
+			v = parquet.Int32Value(int32(k))
+		}
+		if ok, err := bf.Check(v); err != nil || ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *mapPredicate[K, V]) KeepPage(page parquet.Page) bool {
 	if min, max, ok := page.Bounds(); ok {
 		return m.max >= K(min.Int64()) && m.min <= K(max.Int64())
@@ -434,14 +561,49 @@ type Profile interface {
 type Querier interface {
 	InRange(start, end model.Time) bool
 	SelectMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (iter.Iterator[Profile], error)
-	MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile]) (*ingestv1.MergeProfilesStacktracesResult, error)
+	// CountMatchingProfiles returns the number of profiles of each series
+	// matching the request, without reading the profiles where possible.
+	CountMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (map[model.Fingerprint]uint64, error)
+	// SelectByIDRange returns the profiles matching the request, whose IDs are within [lo, hi).
+	// A hi of uuid.Nil selects all the IDs from lo.
+	SelectByIDRange(ctx context.Context, lo, hi uuid.UUID, params *ingestv1.SelectProfilesRequest) ([]ProfileWithID, error)
+	MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile], opts MergeStacktracesOptions) (*ingestv1.MergeProfilesStacktracesResult, error)
 	MergeByLabels(ctx context.Context, rows iter.Iterator[Profile], by ...string) ([]*typesv1.Series, error)
-	MergePprof(ctx context.Context, rows iter.Iterator[Profile]) (*profile.Profile, error)
+	MergePprof(ctx context.Context, rows iter.Iterator[Profile], opts MergePprofOptions) (*profile.Profile, error)
+	// Totals returns the total sample value of each profile.
+	Totals(ctx context.Context, rows iter.Iterator[Profile]) ([]ProfileWithTotal, error)
+	Series(ctx context.Context, matchers []*labels.Matcher, start, end model.Time) ([]phlaremodel.Labels, error)
+	// SeriesMaxTimes returns all series with the timestamp of their latest profile.
+	SeriesMaxTimes(ctx context.Context) ([]SeriesMaxTime, error)
 
 	// Sorts profiles for retrieval.
 	Sort([]Profile) []Profile
 }
 
+// MergeStacktracesOptions controls how samples are folded into stacktraces.
+type MergeStacktracesOptions struct {
+	Granularity ingestv1.StacktraceGranularity
+	// SplitBySampleLabel adds a root node per value of the given sample label.
+	SplitBySampleLabel string
+	// NormalizePeriod multiplies the sample values by the period of their profile.
+	NormalizePeriod bool
+}
+
+// periodFactor returns the factor to multiply the sample values of a profile
+// with the given period by. Profiles without a period are not normalized.
+func (o MergeStacktracesOptions) periodFactor(period int64) int64 {
+	if !o.NormalizePeriod || period <= 0 {
+		return 1
+	}
+	return period
+}
+
+// MergePprofOptions controls which samples are merged into the pprof profile.
+type MergePprofOptions struct {
+	// SampleLabel keeps only the samples with this sample label, if set.
+	SampleLabel *typesv1.LabelPair
+}
+
 type Queriers []Querier
 
 func (queriers Queriers) SelectMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (iter.Iterator[Profile], error) {
@@ -452,20 +614,693 @@ func (queriers Queriers) SelectMatchingProfiles(ctx context.Context, params *ing
 		if err != nil {
 			return nil, err
 		}
-		iters = append(iters, it)
+		iters = append(iters, it)
+	}
+
+	return iter.NewSortProfileIterator(iters), nil
+}
+
+// ProfileCount is the number of profiles and of distinct series matching a
+// select request.
+type ProfileCount struct {
+	Profiles uint64
+	Series   uint64
+}
+
+// CountMatchingProfiles counts the profiles matching the request, like
+// SelectMatchingProfiles without returning them. Series are counted once,
+// even if their profiles are spread across multiple queriers.
+func (queriers Queriers) CountMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (ProfileCount, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "CountMatchingProfiles")
+	defer sp.Finish()
+
+	perSeries := make(map[model.Fingerprint]uint64)
+	for _, q := range queriers.ForTimeRange(model.Time(params.Start), model.Time(params.End)) {
+		counts, err := q.CountMatchingProfiles(ctx, params)
+		if err != nil {
+			return ProfileCount{}, err
+		}
+		for fp, n := range counts {
+			perSeries[fp] += n
+		}
+	}
+
+	var result ProfileCount
+	for _, n := range perSeries {
+		if n > 0 {
+			result.Profiles += n
+			result.Series++
+		}
+	}
+	return result, nil
+}
+
+// SelectMatchingProfilesPage returns a page of the profiles matching the
+// request. The profiles are ordered by series labels then time, the first
+// offset profiles are skipped and up to limit profiles are returned, all the
+// remaining ones if limit is not positive.
+//
+// The series are skipped based on their profile counts, which are read from
+// the row group stats where possible, so only the profiles of the series on
+// the page are kept. The profiles are selected once per querier.
+func (queriers Queriers) SelectMatchingProfilesPage(ctx context.Context, params *ingestv1.SelectProfilesRequest, offset, limit int) ([]Profile, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectMatchingProfilesPage")
+	defer sp.Finish()
+
+	var (
+		start = model.Time(params.Start)
+		end   = model.Time(params.End)
+	)
+	queriers = queriers.ForTimeRange(start, end)
+	matchers, err := selectorMatchers(params)
+	if err != nil {
+		return nil, err
+	}
+
+	seriesLabels := make(map[model.Fingerprint]phlaremodel.Labels)
+	counts := make(map[model.Fingerprint]uint64)
+	for _, q := range queriers {
+		series, err := q.Series(ctx, matchers, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, lbs := range series {
+			seriesLabels[model.Fingerprint(lbs.Hash())] = lbs
+		}
+		perSeries, err := q.CountMatchingProfiles(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		for fp, n := range perSeries {
+			counts[fp] += n
+		}
+	}
+
+	fps := lo.Filter(lo.Keys(counts), func(fp model.Fingerprint, _ int) bool {
+		_, ok := seriesLabels[fp]
+		return ok && counts[fp] > 0
+	})
+	sort.Slice(fps, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(seriesLabels[fps[i]], seriesLabels[fps[j]]) < 0
+	})
+
+	// the series on the page, the profiles of the series before it are skipped
+	skip := uint64(lo.Max([]int{offset, 0}))
+	for len(fps) > 0 && skip >= counts[fps[0]] {
+		skip -= counts[fps[0]]
+		fps = fps[1:]
+	}
+	var n uint64
+	for i, fp := range fps {
+		n += counts[fp]
+		if limit > 0 && n >= skip+uint64(limit) {
+			fps = fps[:i+1]
+			break
+		}
+	}
+	if len(fps) == 0 {
+		return nil, nil
+	}
+
+	profilesPerSeries, err := queriers.selectSeriesProfiles(ctx, params, fps)
+	if err != nil {
+		return nil, err
+	}
+	var result []Profile
+	for _, fp := range fps {
+		profiles := profilesPerSeries[fp]
+		// the profiles might have changed since they were counted
+		if skip >= uint64(len(profiles)) {
+			skip -= uint64(len(profiles))
+			continue
+		}
+		result = append(result, profiles[skip:]...)
+		skip = 0
+		if limit > 0 && len(result) >= limit {
+			return result[:limit], nil
+		}
+	}
+	return result, nil
+}
+
+// selectSeriesProfiles returns the profiles of the series fps matching the
+// request ordered by time. The profiles are selected once per querier.
+func (queriers Queriers) selectSeriesProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest, fps []model.Fingerprint) (map[model.Fingerprint][]Profile, error) {
+	result := make(map[model.Fingerprint][]Profile, len(fps))
+	for _, fp := range fps {
+		result[fp] = nil
+	}
+	for _, q := range queriers {
+		it, err := q.SelectMatchingProfiles(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		profiles, err := iter.Slice(it)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range profiles {
+			if series, ok := result[p.Fingerprint()]; ok {
+				result[p.Fingerprint()] = append(series, p)
+			}
+		}
+	}
+	for _, profiles := range result {
+		sort.SliceStable(profiles, func(i, j int) bool {
+			return profiles[i].Timestamp() < profiles[j].Timestamp()
+		})
+	}
+	return result, nil
+}
+
+// countProfiles returns the number of profiles of each series of the iterator.
+func countProfiles(it iter.Iterator[Profile]) (map[model.Fingerprint]uint64, error) {
+	defer it.Close()
+	counts := make(map[model.Fingerprint]uint64)
+	for it.Next() {
+		counts[it.At().Fingerprint()]++
+	}
+	return counts, it.Err()
+}
+
+// timeNanosBounds returns the min and max TimeNanos of the profiles of the
+// row group from the column index.
+func timeNanosBounds(rg parquet.RowGroup) (min, max int64, ok bool) {
+	column, found := rg.Schema().Lookup("TimeNanos")
+	if !found {
+		return 0, 0, false
+	}
+	ci := rg.ColumnChunks()[column.ColumnIndex].ColumnIndex()
+	if ci == nil || ci.NumPages() == 0 {
+		return 0, 0, false
+	}
+	for i := 0; i < ci.NumPages(); i++ {
+		if v := ci.MinValue(i).Int64(); i == 0 || v < min {
+			min = v
+		}
+		if v := ci.MaxValue(i).Int64(); i == 0 || v > max {
+			max = v
+		}
+	}
+	return min, max, true
+}
+
+// ProfileWithTotal is a profile with the total value of its samples.
+type ProfileWithTotal struct {
+	Profile
+	Total int64
+}
+
+// ProfileWithID is a profile with its ID.
+type ProfileWithID struct {
+	Profile
+	ID uuid.UUID
+}
+
+// SelectByIDRange selects the profiles matching the request, whose IDs are
+// within [lo, hi), ordered by ID. This allows to page through the profiles,
+// by passing the ID following the last one as lo of the next page, a hi of
+// uuid.Nil selects all the IDs from lo. The profiles of the different sample
+// types of a profile share its ID, they are ordered by series.
+//
+// Row groups and pages are skipped by the statistics of the ID column, which
+// works best with time-ordered IDs, e.g. the ULIDs generated on ingestion.
+func (queriers Queriers) SelectByIDRange(ctx context.Context, lo, hi uuid.UUID, params *ingestv1.SelectProfilesRequest) ([]ProfileWithID, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectByIDRange")
+	defer sp.Finish()
+
+	var result []ProfileWithID
+	for _, q := range queriers.ForTimeRange(model.Time(params.Start), model.Time(params.End)) {
+		profiles, err := q.SelectByIDRange(ctx, lo, hi, params)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, profiles...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if cmp := bytes.Compare(result[i].ID[:], result[j].ID[:]); cmp != 0 {
+			return cmp < 0
+		}
+		if cmp := phlaremodel.CompareLabelPairs(result[i].Labels(), result[j].Labels()); cmp != 0 {
+			return cmp < 0
+		}
+		return result[i].Timestamp() < result[j].Timestamp()
+	})
+	return result, nil
+}
+
+// idInRange returns true, if the ID is within [lo, hi), a hi of uuid.Nil is unbounded.
+func idInRange(id, lo, hi uuid.UUID) bool {
+	return bytes.Compare(lo[:], id[:]) <= 0 && (hi == uuid.Nil || bytes.Compare(id[:], hi[:]) < 0)
+}
+
+// idRangePredicate keeps the IDs within [lo, hi), a hi of uuid.Nil is unbounded.
+func idRangePredicate(lo, hi uuid.UUID) *query.ByteArrayRangePredicate {
+	if hi == uuid.Nil {
+		return query.NewByteArrayRangePredicate(lo[:], nil)
+	}
+	return query.NewByteArrayRangePredicate(lo[:], hi[:])
+}
+
+// SelectTopProfiles selects the profiles like SelectMatchingProfiles, but
+// orders the profiles of each series by descending total sample value, ties
+// by time. With limit > 0, only the limit heaviest profiles of each series are
+// returned. Series are ordered by their labels.
+func (queriers Queriers) SelectTopProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest, limit int) ([]ProfileWithTotal, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectTopProfiles")
+	defer sp.Finish()
+
+	profilesPerSeries := make(map[model.Fingerprint][]ProfileWithTotal)
+	for _, q := range queriers.ForTimeRange(model.Time(params.Start), model.Time(params.End)) {
+		it, err := q.SelectMatchingProfiles(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		profiles, err := iter.Slice(it)
+		if err != nil {
+			return nil, err
+		}
+		totals, err := q.Totals(ctx, iter.NewSliceIterator(q.Sort(profiles)))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range totals {
+			profilesPerSeries[p.Fingerprint()] = append(profilesPerSeries[p.Fingerprint()], p)
+		}
+	}
+
+	series := lo.Values(profilesPerSeries)
+	sort.Slice(series, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(series[i][0].Labels(), series[j][0].Labels()) < 0
+	})
+	var result []ProfileWithTotal
+	for _, profiles := range series {
+		sort.Slice(profiles, func(i, j int) bool {
+			if profiles[i].Total != profiles[j].Total {
+				return profiles[i].Total > profiles[j].Total
+			}
+			return profiles[i].Timestamp() < profiles[j].Timestamp()
+		})
+		if limit > 0 && len(profiles) > limit {
+			profiles = profiles[:limit]
+		}
+		result = append(result, profiles...)
+	}
+	return result, nil
+}
+
+// SelectCollapsed merges the stacktraces of the selected profiles and returns
+// them in the collapsed format of flamegraph.pl, see
+// phlaremodel.WriteCollapsed.
+func (queriers Queriers) SelectCollapsed(ctx context.Context, params *ingestv1.SelectProfilesRequest) (io.Reader, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectCollapsed")
+	defer sp.Finish()
+
+	merged, err := queriers.selectMergedStacktraces(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := phlaremodel.WriteCollapsed(&buf, merged); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// SelectSpeedscope merges the stacktraces of the selected profiles and returns
+// them in the JSON file format of speedscope, see
+// phlaremodel.WriteSpeedscope. The profile is named after the profile type.
+func (queriers Queriers) SelectSpeedscope(ctx context.Context, params *ingestv1.SelectProfilesRequest) (io.Reader, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectSpeedscope")
+	defer sp.Finish()
+
+	merged, err := queriers.selectMergedStacktraces(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := phlaremodel.WriteSpeedscope(&buf, merged, params.Type.GetID(), params.Type.GetSampleUnit()); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// ResolvedSample is a sample of a profile, whose stacktrace is resolved to
+// function names ordered from leaf to root.
+type ResolvedSample struct {
+	Stack []string
+	Value int64
+}
+
+// DecodedProfile is a selected profile with its resolved samples.
+type DecodedProfile struct {
+	Labels    phlaremodel.Labels
+	Timestamp model.Time
+	Samples   []ResolvedSample
+}
+
+// SelectDecoded selects the profiles like SelectMatchingProfiles and yields
+// each profile with its samples resolved to function names, instead of
+// merging the samples of all profiles. The samples of a profile are ordered by
+// stack, the function names are redacted by the filter of ctx. The profiles
+// are decoded lazily, while iterating.
+func (queriers Queriers) SelectDecoded(ctx context.Context, params *ingestv1.SelectProfilesRequest) (iter.Iterator[DecodedProfile], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectDecoded")
+	defer sp.Finish()
+
+	var profiles []querierProfile
+	for _, q := range queriers.ForTimeRange(model.Time(params.Start), model.Time(params.End)) {
+		it, err := q.SelectMatchingProfiles(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		selected, err := iter.Slice(it)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range q.Sort(selected) {
+			profiles = append(profiles, querierProfile{querier: q, profile: p})
+		}
+	}
+	return &decodedProfilesIterator{ctx: ctx, profiles: profiles}, nil
+}
+
+type querierProfile struct {
+	querier Querier
+	profile Profile
+}
+
+type decodedProfilesIterator struct {
+	ctx      context.Context
+	profiles []querierProfile
+	curr     DecodedProfile
+	err      error
+}
+
+func (it *decodedProfilesIterator) Next() bool {
+	if it.err != nil || len(it.profiles) == 0 {
+		return false
+	}
+	next := it.profiles[0]
+	it.profiles = it.profiles[1:]
+
+	// merging a single profile resolves its samples without aggregating them with other profiles
+	merged, err := next.querier.MergeByStacktraces(it.ctx, iter.NewSliceIterator([]Profile{next.profile}), MergeStacktracesOptions{})
+	if err != nil {
+		it.err = err
+		return false
+	}
+	contextFunctionNamesFilter(it.ctx).redactStacktraces(merged)
+
+	samples := make([]ResolvedSample, 0, len(merged.Stacktraces))
+	for _, s := range merged.Stacktraces {
+		stack := make([]string, len(s.FunctionIds))
+		for i, id := range s.FunctionIds {
+			stack[i] = merged.FunctionNames[id]
+		}
+		samples = append(samples, ResolvedSample{Stack: stack, Value: s.Value})
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Stack, ";") < strings.Join(samples[j].Stack, ";")
+	})
+	it.curr = DecodedProfile{
+		Labels:    next.profile.Labels(),
+		Timestamp: next.profile.Timestamp(),
+		Samples:   samples,
+	}
+	return true
+}
+
+func (it *decodedProfilesIterator) At() DecodedProfile { return it.curr }
+
+func (it *decodedProfilesIterator) Err() error { return it.err }
+
+func (it *decodedProfilesIterator) Close() error { return nil }
+
+// selectMergedStacktraces merges the stacktraces of the selected profiles of
+// all queriers, the function names are redacted by the filter of ctx.
+func (queriers Queriers) selectMergedStacktraces(ctx context.Context, params *ingestv1.SelectProfilesRequest) (*ingestv1.MergeProfilesStacktracesResult, error) {
+	var (
+		typeCheck profileTypeCheck
+		result    []*ingestv1.MergeProfilesStacktracesResult
+	)
+	for _, q := range queriers.ForTimeRange(model.Time(params.Start), model.Time(params.End)) {
+		it, err := q.SelectMatchingProfiles(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		profiles, err := iter.Slice(it)
+		if err != nil {
+			return nil, err
+		}
+		if err := typeCheck.check(profiles); err != nil {
+			return nil, err
+		}
+		merge, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(q.Sort(profiles)), MergeStacktracesOptions{})
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, merge)
+	}
+
+	merged := phlaremodel.MergeBatchMergeStacktraces(result...)
+	contextFunctionNamesFilter(ctx).redactStacktraces(merged)
+	return merged, nil
+}
+
+// Series returns the label sets of the series matching, whose time range
+// between their first and last profile overlaps start and end. The label sets
+// are sorted and unique.
+func (queriers Queriers) Series(ctx context.Context, matchers []*labels.Matcher, start, end model.Time) ([]phlaremodel.Labels, error) {
+	var result []phlaremodel.Labels
+	for _, q := range queriers.ForTimeRange(start, end) {
+		series, err := q.Series(ctx, matchers, start, end)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, series...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(result[i], result[j]) < 0
+	})
+	unique := result[:0]
+	for i, lbs := range result {
+		if i > 0 && phlaremodel.CompareLabelPairs(lbs, result[i-1]) == 0 {
+			continue
+		}
+		unique = append(unique, lbs)
+	}
+	return unique, nil
+}
+
+// SeriesMaxTime is a series with the timestamp of its latest profile.
+type SeriesMaxTime struct {
+	Labels       phlaremodel.Labels
+	Fingerprint  model.Fingerprint
+	MaxTimeNanos int64
+}
+
+// StaleSeries returns the series without any profile newer than asOf minus
+// staleness, e.g. the series of targets which stopped reporting. The series
+// are ordered by their labels.
+func (queriers Queriers) StaleSeries(ctx context.Context, asOf time.Time, staleness time.Duration) ([]SeriesMaxTime, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "StaleSeries")
+	defer sp.Finish()
+
+	// a series is as recent as its latest profile in any querier
+	latest := make(map[model.Fingerprint]SeriesMaxTime)
+	for _, q := range queriers {
+		series, err := q.SeriesMaxTimes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range series {
+			if l, ok := latest[s.Fingerprint]; !ok || s.MaxTimeNanos > l.MaxTimeNanos {
+				latest[s.Fingerprint] = s
+			}
+		}
+	}
+
+	cutoff := asOf.Add(-staleness).UnixNano()
+	var result []SeriesMaxTime
+	for _, s := range latest {
+		if s.MaxTimeNanos <= cutoff {
+			result = append(result, s)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(result[i].Labels, result[j].Labels) < 0
+	})
+	return result, nil
+}
+
+// ProfileTypes returns the profile types of the series, whose time range
+// between their first and last profile overlaps start and end. The profile
+// types are sorted by their ID.
+func (queriers Queriers) ProfileTypes(ctx context.Context, start, end model.Time) ([]*typesv1.ProfileType, error) {
+	series, err := queriers.Series(ctx, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, phlaremodel.LabelNameProfileType, ".+"),
+	}, start, end)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]struct{})
+	for _, lbs := range series {
+		ids[lbs.Get(phlaremodel.LabelNameProfileType)] = struct{}{}
+	}
+	sortedIDs := lo.Keys(ids)
+	sort.Strings(sortedIDs)
+
+	profileTypes := make([]*typesv1.ProfileType, len(sortedIDs))
+	for i, id := range sortedIDs {
+		profileTypes[i], err = phlaremodel.ParseProfileTypeSelector(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return profileTypes, nil
+}
+
+// LabelCardinality returns the number of distinct values of each label name of
+// the series, whose time range between their first and last profile overlaps
+// start and end. The series are looked up in the TSDB index of each querier.
+func (queriers Queriers) LabelCardinality(ctx context.Context, start, end model.Time) (map[string]uint64, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "LabelCardinality")
+	defer sp.Finish()
+
+	series, err := queriers.Series(ctx, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, phlaremodel.LabelNameProfileType, ".+"),
+	}, start, end)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]map[string]struct{})
+	for _, lbs := range series {
+		for _, l := range lbs {
+			v, ok := values[l.Name]
+			if !ok {
+				v = make(map[string]struct{})
+				values[l.Name] = v
+			}
+			v[l.Value] = struct{}{}
+		}
+	}
+	cardinality := make(map[string]uint64, len(values))
+	for name, v := range values {
+		cardinality[name] = uint64(len(v))
+	}
+	return cardinality, nil
+}
+
+// Close closes the files opened by the queriers of blocks, the queriers of the
+// head are closed by the head instead. The queriers of a database, e.g. of
+// PhlareDB.Queriers, are shared by concurrent queries and closed by the
+// database, Close is meant for queriers created for a single query.
+func (queriers Queriers) Close() error {
+	errs := multierror.New()
+	for _, q := range queriers {
+		if c, ok := q.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs.Add(err)
+			}
+		}
+	}
+	return errs.Err()
+}
+
+func (queriers Queriers) ForTimeRange(start, end model.Time) Queriers {
+	result := make(Queriers, 0, len(queriers))
+	for _, q := range queriers {
+		if q.InRange(start, end) {
+			result = append(result, q)
+		}
+	}
+	return result
+}
+
+// ErrTooManyProfiles is returned when a select matches more profiles than allowed.
+var ErrTooManyProfiles = withSentinel(ErrLimitExceeded, errors.New("too many profiles selected"))
+
+// withSelectLimit returns queriers, which fail before reading any profiles, once
+// the profiles selected by a single request across all queriers exceed the limit. The queriers returned
+// are meant to be used for a single request.
+func (queriers Queriers) withSelectLimit(limit int, rejected prometheus.Counter) Queriers {
+	l := &selectLimit{limit: int64(limit), rejected: rejected}
+	result := make(Queriers, len(queriers))
+	for i, q := range queriers {
+		result[i] = &selectLimitedQuerier{Querier: q, limit: l}
+	}
+	return result
+}
+
+type selectLimit struct {
+	limit    int64
+	selected atomic.Int64
+	exceeded atomic.Bool
+	rejected prometheus.Counter
+}
+
+type selectLimitedQuerier struct {
+	Querier
+	limit *selectLimit
+}
+
+func (q *selectLimitedQuerier) mergeCacheID() string {
+	if c, ok := q.Querier.(mergeCacheQuerier); ok {
+		return c.mergeCacheID()
+	}
+	return ""
+}
+
+// SelectMatchingProfiles counts the profiles matching the request first,
+// which uses the row ranges of the index and the row group statistics
+// wherever possible, so the profiles are only read within the limit.
+func (q *selectLimitedQuerier) SelectMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (iter.Iterator[Profile], error) {
+	if q.limit.exceeded.Load() {
+		return iter.NewSliceIterator[Profile](nil), nil
+	}
+	counts, err := q.Querier.CountMatchingProfiles(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	for _, c := range counts {
+		count += int64(c)
+	}
+	if q.limit.selected.Add(count) > q.limit.limit {
+		// only the first querier exceeding the limit reports the error
+		if q.limit.exceeded.CompareAndSwap(false, true) {
+			q.limit.rejected.Inc()
+			return nil, connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("%w: the query selects more than %d profiles, select a narrower time range", ErrTooManyProfiles, q.limit.limit))
+		}
+		return iter.NewSliceIterator[Profile](nil), nil
 	}
+	return q.Querier.SelectMatchingProfiles(ctx, params)
+}
 
-	return iter.NewSortProfileIterator(iters), nil
+// ErrAmbiguousProfileType is returned when the profiles selected to be merged
+// are of more than one profile type.
+var ErrAmbiguousProfileType = errors.New("ambiguous profile type")
+
+// profileTypeCheck ensures all profiles merged by a request are of the same
+// profile type, when the profile type of the request doesn't pin it.
+type profileTypeCheck struct {
+	profileType string
+	seen        bool
 }
 
-func (queriers Queriers) ForTimeRange(start, end model.Time) Queriers {
-	result := make(Queriers, 0, len(queriers))
-	for _, q := range queriers {
-		if q.InRange(start, end) {
-			result = append(result, q)
+func (c *profileTypeCheck) check(profiles []Profile) error {
+	for _, p := range profiles {
+		profileType := p.Labels().Get(phlaremodel.LabelNameProfileType)
+		if !c.seen {
+			c.profileType, c.seen = profileType, true
+			continue
+		}
+		if profileType != c.profileType {
+			return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("%w: the query selects profiles of type %q and %q, select a single profile type", ErrAmbiguousProfileType, c.profileType, profileType))
 		}
 	}
-	return result
+	return nil
 }
 
 func (q Queriers) MergeProfilesStacktraces(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesStacktracesRequest, ingestv1.MergeProfilesStacktracesResponse]) error {
@@ -488,10 +1323,22 @@ func (q Queriers) MergeProfilesStacktraces(ctx context.Context, stream *connect.
 		otlog.String("start", model.Time(request.Start).Time().String()),
 		otlog.String("end", model.Time(request.End).Time().String()),
 		otlog.String("selector", request.LabelSelector),
-		otlog.String("profile_id", request.Type.ID),
+		otlog.String("profile_id", request.Type.GetID()),
 	)
 
+	opts := MergeStacktracesOptions{
+		Granularity:        r.Granularity,
+		SplitBySampleLabel: r.SplitBySampleLabel,
+		NormalizePeriod:    r.NormalizePeriod,
+	}
+	trimRootFrames, err := compileAnchored(r.TrimRootFrames)
+	if err != nil {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid root frames pattern: %w", err))
+	}
+
+	ctx = contextWithQueryMemory(ctx, newQueryMemory(ctx, r.MaxMemoryBytes))
 	queriers := q.ForTimeRange(model.Time(request.Start), model.Time(request.End))
+	var typeCheck profileTypeCheck
 
 	result := make([]*ingestv1.MergeProfilesStacktracesResult, 0, len(queriers))
 	var lock sync.Mutex
@@ -509,18 +1356,24 @@ func (q Queriers) MergeProfilesStacktraces(ctx context.Context, stream *connect.
 		selectedProfiles, err := filterProfiles[
 			BidiServerMerge[*ingestv1.MergeProfilesStacktracesResponse, *ingestv1.MergeProfilesStacktracesRequest],
 			*ingestv1.MergeProfilesStacktracesResponse,
-			*ingestv1.MergeProfilesStacktracesRequest](ctx, profiles, 2048, stream)
+			*ingestv1.MergeProfilesStacktracesRequest](ctx, profiles, selectProfilesBatchSize, stream)
 		if err != nil {
 			return err
 		}
+		if err := typeCheck.check(selectedProfiles); err != nil {
+			return err
+		}
 		// Sort profiles for better read locality.
 		selectedProfiles = q.Sort(selectedProfiles)
 		// Merge async the result so we can continue streaming profiles.
 		g.Go(util.RecoverPanic(func() error {
-			merge, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(selectedProfiles))
+			merge, err := contextMergeCache(ctx).mergeByStacktraces(ctx, q, request, selectedProfiles, opts)
 			if err != nil {
 				return err
 			}
+			if err := contextQueryMemory(ctx).reserve(stacktracesResultBytes(merge)); err != nil {
+				return err
+			}
 			lock.Lock()
 			defer lock.Unlock()
 			result = append(result, merge)
@@ -538,9 +1391,19 @@ func (q Queriers) MergeProfilesStacktraces(ctx context.Context, stream *connect.
 		return err
 	}
 
+	merged := phlaremodel.MergeBatchMergeStacktraces(result...)
+	if len(trimRootFrames) > 0 {
+		phlaremodel.TrimStacktraceRoots(merged, func(name string) bool {
+			return lo.SomeBy(trimRootFrames, func(re *regexp.Regexp) bool { return re.MatchString(name) })
+		})
+	}
+	contextFunctionNamesFilter(ctx).redactStacktraces(merged)
+	phlaremodel.ScaleStacktraces(merged, r.Scaling)
+	phlaremodel.BuildStacktraceNodes(merged)
+
 	// sends the final result to the client.
 	err = stream.Send(&ingestv1.MergeProfilesStacktracesResponse{
-		Result: phlaremodel.MergeBatchMergeStacktraces(result...),
+		Result: merged,
 	})
 	if err != nil {
 		if errors.Is(err, io.EOF) {
@@ -570,15 +1433,35 @@ func (q Queriers) MergeProfilesLabels(ctx context.Context, stream *connect.BidiS
 	request := r.Request
 	by := r.By
 	sort.Strings(by)
+	relabelConfigs, err := phlaremodel.RelabelConfigs(r.Relabel)
+	if err != nil {
+		return connect.NewError(connect.CodeInvalidArgument, err)
+	}
 	sp.LogFields(
 		otlog.String("start", model.Time(request.Start).Time().String()),
 		otlog.String("end", model.Time(request.End).Time().String()),
 		otlog.String("selector", request.LabelSelector),
-		otlog.String("profile_id", request.Type.ID),
+		otlog.String("profile_id", request.Type.GetID()),
 		otlog.String("by", strings.Join(by, ",")),
+		otlog.Bool("all_sample_types", r.AllSampleTypes),
 	)
 
+	mergeBy := by
+	if r.AllSampleTypes {
+		if request.Type.GetName() == "" {
+			return connect.NewError(connect.CodeInvalidArgument, errors.New("merging all sample types requires the name of the profile type"))
+		}
+		if r.Scaling != nil {
+			return connect.NewError(connect.CodeInvalidArgument, errors.New("sample types of different units can't be scaled together"))
+		}
+		request = selectAllSampleTypes(request)
+		mergeBy = append([]string{phlaremodel.LabelNameType, phlaremodel.LabelNameUnit}, by...)
+		sort.Strings(mergeBy)
+	}
+
+	ctx = contextWithQueryMemory(ctx, newQueryMemory(ctx, 0))
 	queriers := q.ForTimeRange(model.Time(request.Start), model.Time(request.End))
+	var typeCheck profileTypeCheck
 	result := make([][]*typesv1.Series, 0, len(queriers))
 	g, ctx := errgroup.WithContext(ctx)
 	s := lo.Synchronize()
@@ -594,7 +1477,17 @@ func (q Queriers) MergeProfilesLabels(ctx context.Context, stream *connect.BidiS
 		selectedProfiles, err := filterProfiles[
 			BidiServerMerge[*ingestv1.MergeProfilesLabelsResponse, *ingestv1.MergeProfilesLabelsRequest],
 			*ingestv1.MergeProfilesLabelsResponse,
-			*ingestv1.MergeProfilesLabelsRequest](ctx, profiles, 2048, stream)
+			*ingestv1.MergeProfilesLabelsRequest](ctx, profiles, selectProfilesBatchSize, stream)
+		if err != nil {
+			return err
+		}
+		// profiles of all sample types are split by sample type
+		if !r.AllSampleTypes {
+			if err := typeCheck.check(selectedProfiles); err != nil {
+				return err
+			}
+		}
+		selectedProfiles, err = relabelProfiles(selectedProfiles, relabelConfigs)
 		if err != nil {
 			return err
 		}
@@ -602,7 +1495,7 @@ func (q Queriers) MergeProfilesLabels(ctx context.Context, stream *connect.BidiS
 		selectedProfiles = q.Sort(selectedProfiles)
 		// Merge async the result so we can continue streaming profiles.
 		g.Go(util.RecoverPanic(func() error {
-			merge, err := q.MergeByLabels(ctx, iter.NewSliceIterator(selectedProfiles), by...)
+			merge, err := q.MergeByLabels(ctx, iter.NewSliceIterator(selectedProfiles), mergeBy...)
 			if err != nil {
 				return err
 			}
@@ -624,9 +1517,15 @@ func (q Queriers) MergeProfilesLabels(ctx context.Context, stream *connect.BidiS
 		return err
 	}
 
+	series := phlaremodel.MergeSeries(result...)
+	series = phlaremodel.FilterSeriesByValues(series, by, r.Include, r.Exclude)
+	unit := phlaremodel.ScaleSeries(series, r.Scaling)
+	phlaremodel.DownsampleSeries(series, request.Start, request.End, r.MaxPoints, r.PointsAggregation)
+
 	// sends the final result to the client.
 	err = stream.Send(&ingestv1.MergeProfilesLabelsResponse{
-		Series: phlaremodel.MergeSeries(result...),
+		Series: series,
+		Unit:   unit,
 	})
 	if err != nil {
 		if errors.Is(err, io.EOF) {
@@ -658,10 +1557,17 @@ func (q Queriers) MergeProfilesPprof(ctx context.Context, stream *connect.BidiSt
 		otlog.String("start", model.Time(request.Start).Time().String()),
 		otlog.String("end", model.Time(request.End).Time().String()),
 		otlog.String("selector", request.LabelSelector),
-		otlog.String("profile_id", request.Type.ID),
+		otlog.String("profile_id", request.Type.GetID()),
 	)
 
+	opts := MergePprofOptions{SampleLabel: r.SampleLabel}
+	if opts.SampleLabel != nil && opts.SampleLabel.Name == "" {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("missing sample label name"))
+	}
+
+	ctx = contextWithQueryMemory(ctx, newQueryMemory(ctx, 0))
 	queriers := q.ForTimeRange(model.Time(request.Start), model.Time(request.End))
+	var typeCheck profileTypeCheck
 
 	result := make([]*profile.Profile, 0, len(queriers))
 	var lock sync.Mutex
@@ -679,15 +1585,18 @@ func (q Queriers) MergeProfilesPprof(ctx context.Context, stream *connect.BidiSt
 		selectedProfiles, err := filterProfiles[
 			BidiServerMerge[*ingestv1.MergeProfilesPprofResponse, *ingestv1.MergeProfilesPprofRequest],
 			*ingestv1.MergeProfilesPprofResponse,
-			*ingestv1.MergeProfilesPprofRequest](ctx, profiles, 2048, stream)
+			*ingestv1.MergeProfilesPprofRequest](ctx, profiles, selectProfilesBatchSize, stream)
 		if err != nil {
 			return err
 		}
+		if err := typeCheck.check(selectedProfiles); err != nil {
+			return err
+		}
 		// Sort profiles for better read locality.
 		selectedProfiles = q.Sort(selectedProfiles)
 		// Merge async the result so we can continue streaming profiles.
 		g.Go(util.RecoverPanic(func() error {
-			merge, err := q.MergePprof(ctx, iter.NewSliceIterator(selectedProfiles))
+			merge, err := q.MergePprof(ctx, iter.NewSliceIterator(selectedProfiles), opts)
 			if err != nil {
 				return err
 			}
@@ -718,6 +1627,8 @@ func (q Queriers) MergeProfilesPprof(ctx context.Context, stream *connect.BidiSt
 	if err != nil {
 		return err
 	}
+	p = phlaremodel.PruneProfile(p, r.MinValue, r.MinPercent, r.AggregatePruned)
+	contextFunctionNamesFilter(ctx).redactProfile(p)
 
 	// connect go already handles compression.
 	var buf bytes.Buffer
@@ -738,6 +1649,59 @@ func (q Queriers) MergeProfilesPprof(ctx context.Context, stream *connect.BidiSt
 	return nil
 }
 
+// relabelProfiles rewrites the labels of the profiles with the relabel
+// configs, profiles whose labels are dropped are removed. The labels of each
+// series are only relabeled once.
+// selectAllSampleTypes returns a copy of the request selecting the profiles
+// of any sample type, which share the name and the period of its profile type.
+func selectAllSampleTypes(request *ingestv1.SelectProfilesRequest) *ingestv1.SelectProfilesRequest {
+	return &ingestv1.SelectProfilesRequest{
+		LabelSelector: request.LabelSelector,
+		Type: &typesv1.ProfileType{
+			Name:       request.Type.Name,
+			PeriodType: request.Type.PeriodType,
+			PeriodUnit: request.Type.PeriodUnit,
+		},
+		Start: request.Start,
+		End:   request.End,
+	}
+}
+
+func relabelProfiles(profiles []Profile, cfgs []*relabel.Config) ([]Profile, error) {
+	if len(cfgs) == 0 {
+		return profiles, nil
+	}
+	type relabeled struct {
+		lbs  phlaremodel.Labels
+		keep bool
+	}
+	var (
+		bySeries = make(map[model.Fingerprint]relabeled)
+		result   = profiles[:0]
+	)
+	for _, p := range profiles {
+		r, ok := bySeries[p.Fingerprint()]
+		if !ok {
+			r.lbs, r.keep = phlaremodel.Relabel(p.Labels(), cfgs...)
+			bySeries[p.Fingerprint()] = r
+		}
+		if !r.keep {
+			continue
+		}
+		switch p := p.(type) {
+		case BlockProfile:
+			p.labels = r.lbs
+			result = append(result, p)
+		case ProfileWithLabels:
+			p.lbs = r.lbs
+			result = append(result, p)
+		default:
+			return nil, fmt.Errorf("unexpected profile type %T", p)
+		}
+	}
+	return result, nil
+}
+
 type BlockProfile struct {
 	labels phlaremodel.Labels
 	fp     model.Fingerprint
@@ -767,11 +1731,44 @@ func (b *singleBlockQuerier) SelectMatchingProfiles(ctx context.Context, params
 	if err := b.open(ctx); err != nil {
 		return nil, err
 	}
-	matchers, err := parser.ParseMetricSelector(params.LabelSelector)
+	lblsPerRef, err := b.selectSeries(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		start             = model.Time(params.Start).UnixNano()
+		end               = model.Time(params.End).UnixNano()
+		profilesPerSeries map[int64][]Profile
+	)
+	// a single series is common for dashboards of a single instance
+	if len(lblsPerRef) == 1 {
+		profilesPerSeries, err = b.scanSingleSeries(ctx, lblsPerRef, start, end)
+	} else {
+		profilesPerSeries, err = b.scanProfiles(ctx, lblsPerRef, start, end)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seriesIndexes := lo.Keys(profilesPerSeries)
+	sort.Slice(seriesIndexes, func(i, j int) bool {
+		return seriesIndexes[i] < seriesIndexes[j]
+	})
+	iters := make([]iter.Iterator[Profile], 0, len(seriesIndexes))
+	for _, seriesIndex := range seriesIndexes {
+		iters = append(iters, iter.NewSliceIterator(profilesPerSeries[seriesIndex]))
+	}
+
+	return iter.NewSortProfileIterator(iters), nil
+}
+
+// selectSeries returns the series of the block matching the request by their series index.
+func (b *singleBlockQuerier) selectSeries(params *ingestv1.SelectProfilesRequest) (map[int64]labelsInfo, error) {
+	matchers, err := selectorMatchers(params)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, "failed to parse label selectors: "+err.Error())
+		return nil, err
 	}
-	matchers = append(matchers, phlaremodel.SelectorFromProfileType(params.Type))
 
 	postings, err := PostingsForMatchers(b.index, nil, matchers...)
 	if err != nil {
@@ -803,43 +1800,387 @@ func (b *singleBlockQuerier) SelectMatchingProfiles(ctx context.Context, params
 			lbls = make(phlaremodel.Labels, 0, 6)
 		}
 	}
+	return lblsPerRef, postings.Err()
+}
+
+// CountMatchingProfiles counts the profiles of the row groups within the
+// requested time range by reading only the SeriesIndex column. The rows of
+// the row groups partially in range are scanned like SelectMatchingProfiles.
+func (b *singleBlockQuerier) CountMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (map[model.Fingerprint]uint64, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "CountMatchingProfiles - Block")
+	defer sp.Finish()
+	if err := b.open(ctx); err != nil {
+		return nil, err
+	}
+	lblsPerRef, err := b.selectSeries(params)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[model.Fingerprint]uint64, len(lblsPerRef))
+	if len(lblsPerRef) == 0 {
+		return counts, nil
+	}
+
+	var (
+		start     = model.Time(params.Start).UnixNano()
+		end       = model.Time(params.End).UnixNano()
+		rowOffset int64
+		buf       = make([][]parquet.Value, 1)
+	)
+	for _, rg := range b.profiles.file.RowGroups() {
+		offset := rowOffset
+		rowOffset += rg.NumRows()
+
+		min, max, ok := timeNanosBounds(rg)
+		if ok && (max < start || min > end) {
+			continue
+		}
+		if !ok || min < start || max > end {
+			result, err := b.scanProfileRowGroups(ctx, []parquet.RowGroup{rg}, offset, lblsPerRef, start, end)
+			if err != nil {
+				return nil, err
+			}
+			for seriesIndex, profiles := range result {
+				counts[lblsPerRef[seriesIndex].fp] += uint64(len(profiles))
+			}
+			continue
+		}
+
+		it := b.profiles.rowGroupsColumnIter(ctx, []parquet.RowGroup{rg}, "SeriesIndex", newMapPredicate(lblsPerRef), "SeriesIndex")
+		for it.Next() {
+			buf = it.At().Columns(buf, "SeriesIndex")
+			counts[lblsPerRef[buf[0][0].Int64()].fp]++
+		}
+		if err := it.Err(); err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.Close()
+	}
+	return counts, nil
+}
+
+// scanProfiles returns the profiles of the given series within [start, end] grouped by series index,
+// ordered by row number within each series. The row groups of the profiles table are scanned by up
+// to rowGroupConcurrency workers.
+func (b *singleBlockQuerier) scanProfiles(ctx context.Context, lblsPerRef map[int64]labelsInfo, start, end int64) (map[int64][]Profile, error) {
+	rowGroups := b.profiles.file.RowGroups()
+	workers := b.rowGroupConcurrency
+	if workers > len(rowGroups) {
+		workers = len(rowGroups)
+	}
+	if workers <= 1 {
+		return b.scanProfileRowGroups(ctx, rowGroups, 0, lblsPerRef, start, end)
+	}
+
+	var (
+		results   = make([]map[int64][]Profile, len(rowGroups))
+		rowOffset int64
+		g, gCtx   = errgroup.WithContext(ctx)
+	)
+	g.SetLimit(workers)
+	for i := range rowGroups {
+		i, offset := i, rowOffset
+		rowOffset += rowGroups[i].NumRows()
+		g.Go(func() error {
+			var err error
+			results[i], err = b.scanProfileRowGroups(gCtx, rowGroups[i:i+1], offset, lblsPerRef, start, end)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	// row groups are merged in order, which keeps the profiles of each series ordered by row number.
+	profilesPerSeries := make(map[int64][]Profile, len(lblsPerRef))
+	for _, result := range results {
+		for seriesIndex, profiles := range result {
+			profilesPerSeries[seriesIndex] = append(profilesPerSeries[seriesIndex], profiles...)
+		}
+	}
+	return profilesPerSeries, nil
+}
+
+// scanProfileRowGroups scans the given row groups, the first of them starting at rowOffset in the profiles table.
+func (b *singleBlockQuerier) scanProfileRowGroups(ctx context.Context, rowGroups []parquet.RowGroup, rowOffset int64, lblsPerRef map[int64]labelsInfo, start, end int64) (map[int64][]Profile, error) {
 	pIt := query.NewJoinIterator(
 		0,
 		[]query.Iterator{
-			b.profiles.columnIter(ctx, "SeriesIndex", newMapPredicate(lblsPerRef), "SeriesIndex"),
-			b.profiles.columnIter(ctx, "TimeNanos", query.NewIntBetweenPredicate(model.Time(params.Start).UnixNano(), model.Time(params.End).UnixNano()), "TimeNanos"),
+			b.profiles.rowGroupsColumnIter(ctx, rowGroups, "SeriesIndex", newMapPredicate(lblsPerRef), "SeriesIndex"),
+			b.profiles.rowGroupsColumnIter(ctx, rowGroups, "TimeNanos", query.NewIntBetweenPredicate(start, end), "TimeNanos"),
 		},
 		nil,
 	)
-	iters := make([]iter.Iterator[Profile], 0, len(lblsPerRef))
 	buf := make([][]parquet.Value, 2)
 	defer pIt.Close()
 
-	currSeriesIndex := int64(-1)
-	var currentSeriesSlice []Profile
+	// group profiles by series, rows of a series are not necessarily
+	// contiguous, depending on the sort order of the block.
+	profilesPerSeries := make(map[int64][]Profile)
 	for pIt.Next() {
 		res := pIt.At()
 		buf = res.Columns(buf, "SeriesIndex", "TimeNanos")
 		seriesIndex := buf[0][0].Int64()
-		if seriesIndex != currSeriesIndex {
-			currSeriesIndex++
-			if len(currentSeriesSlice) > 0 {
-				iters = append(iters, iter.NewSliceIterator(currentSeriesSlice))
-			}
-			currentSeriesSlice = make([]Profile, 0, 100)
-		}
-		currentSeriesSlice = append(currentSeriesSlice, BlockProfile{
+		profilesPerSeries[seriesIndex] = append(profilesPerSeries[seriesIndex], BlockProfile{
 			labels: lblsPerRef[seriesIndex].lbs,
 			fp:     lblsPerRef[seriesIndex].fp,
 			ts:     model.TimeFromUnixNano(buf[1][0].Int64()),
-			RowNum: res.RowNumber[0],
+			RowNum: res.RowNumber[0] + rowOffset,
 		})
 	}
-	if len(currentSeriesSlice) > 0 {
-		iters = append(iters, iter.NewSliceIterator(currentSeriesSlice))
+	if err := pIt.Err(); err != nil {
+		return nil, err
 	}
+	return profilesPerSeries, nil
+}
 
-	return iter.NewSortProfileIterator(iters), nil
+// SelectByIDRange scans the profiles of the matching series within the time
+// range of the request for IDs within [lo, hi).
+func (b *singleBlockQuerier) SelectByIDRange(ctx context.Context, lo, hi uuid.UUID, params *ingestv1.SelectProfilesRequest) ([]ProfileWithID, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectByIDRange - Block")
+	defer sp.Finish()
+	if err := b.open(ctx); err != nil {
+		return nil, err
+	}
+	lblsPerRef, err := b.selectSeries(params)
+	if err != nil {
+		return nil, err
+	}
+	if len(lblsPerRef) == 0 {
+		return nil, nil
+	}
+
+	rowGroups := b.profiles.file.RowGroups()
+	pIt := query.NewJoinIterator(
+		0,
+		[]query.Iterator{
+			b.profiles.rowGroupsColumnIter(ctx, rowGroups, "SeriesIndex", newMapPredicate(lblsPerRef), "SeriesIndex"),
+			b.profiles.rowGroupsColumnIter(ctx, rowGroups, "TimeNanos", query.NewIntBetweenPredicate(model.Time(params.Start).UnixNano(), model.Time(params.End).UnixNano()), "TimeNanos"),
+			b.profiles.rowGroupsColumnIter(ctx, rowGroups, "ID", idRangePredicate(lo, hi), "ID"),
+		},
+		nil,
+	)
+	defer pIt.Close()
+
+	var (
+		result []ProfileWithID
+		buf    = make([][]parquet.Value, 3)
+	)
+	for pIt.Next() {
+		res := pIt.At()
+		buf = res.Columns(buf, "SeriesIndex", "TimeNanos", "ID")
+		seriesIndex := buf[0][0].Int64()
+		p := ProfileWithID{
+			Profile: BlockProfile{
+				labels: lblsPerRef[seriesIndex].lbs,
+				fp:     lblsPerRef[seriesIndex].fp,
+				ts:     model.TimeFromUnixNano(buf[1][0].Int64()),
+				RowNum: res.RowNumber[0],
+			},
+		}
+		copy(p.ID[:], buf[2][0].ByteArray())
+		result = append(result, p)
+	}
+	return result, pIt.Err()
+}
+
+// scanSingleSeries is scanProfiles for a single series. The rows of a series
+// are contiguous in row groups sorted by series, so only the pages of the
+// SeriesIndex column, whose statistics include the series, and the TimeNanos
+// of the rows of the series are read. Row groups sorted by time are scanned.
+func (b *singleBlockQuerier) scanSingleSeries(ctx context.Context, lblsPerRef map[int64]labelsInfo, start, end int64) (map[int64][]Profile, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "scanSingleSeries - Block")
+	defer sp.Finish()
+
+	seriesIndex := lo.Keys(lblsPerRef)[0]
+	info := lblsPerRef[seriesIndex]
+	ctx = query.AddMetricsToContext(ctx, b.profiles.metrics.query)
+
+	seriesColumn, ok := b.profiles.file.Schema().Lookup("SeriesIndex")
+	if !ok {
+		return nil, errors.New("'SeriesIndex' column not found")
+	}
+	timeColumn, ok := b.profiles.file.Schema().Lookup("TimeNanos")
+	if !ok {
+		return nil, errors.New("'TimeNanos' column not found")
+	}
+
+	var (
+		profiles  []Profile
+		rowOffset int64
+		pred      = newMapPredicate(lblsPerRef)
+	)
+	for _, rg := range b.profiles.file.RowGroups() {
+		offset := rowOffset
+		rowOffset += rg.NumRows()
+
+		if sortOrderOf(rg) != SeriesThenTime {
+			result, err := b.scanProfileRowGroups(ctx, []parquet.RowGroup{rg}, offset, lblsPerRef, start, end)
+			if err != nil {
+				return nil, err
+			}
+			profiles = append(profiles, result[seriesIndex]...)
+			continue
+		}
+
+		table := strings.ToLower(rg.Schema().Name()) + "s"
+		seriesChunk := rg.ColumnChunks()[seriesColumn.ColumnIndex]
+		if !pred.KeepColumnChunk(seriesChunk) {
+			continue
+		}
+		from, to, err := seriesRowRange(ctx, seriesChunk, table, rg.NumRows(), seriesIndex)
+		if err != nil {
+			return nil, err
+		}
+		if from == to {
+			continue
+		}
+		times, err := readColumnRange(ctx, rg.ColumnChunks()[timeColumn.ColumnIndex], table, "TimeNanos", from, to)
+		if err != nil {
+			return nil, err
+		}
+		for i, t := range times {
+			if ts := t.Int64(); start <= ts && ts <= end {
+				profiles = append(profiles, BlockProfile{
+					labels: info.lbs,
+					fp:     info.fp,
+					ts:     model.TimeFromUnixNano(ts),
+					RowNum: offset + from + int64(i),
+				})
+			}
+		}
+	}
+
+	if len(profiles) == 0 {
+		return map[int64][]Profile{}, nil
+	}
+	return map[int64][]Profile{seriesIndex: profiles}, nil
+}
+
+// seriesRowRange returns the rows [from, to) of the series in a column chunk
+// of SeriesIndex sorted by series. Only the pages, whose statistics include
+// the series, are read.
+func seriesRowRange(ctx context.Context, c parquet.ColumnChunk, table string, numRows int64, seriesIndex int64) (from, to int64, err error) {
+	from, to = 0, numRows
+	ci, oi := c.ColumnIndex(), c.OffsetIndex()
+	if ci != nil && oi != nil && ci.NumPages() == oi.NumPages() {
+		first, last := -1, -1
+		for i := 0; i < ci.NumPages(); i++ {
+			if ci.MinValue(i).Int64() <= seriesIndex && seriesIndex <= ci.MaxValue(i).Int64() {
+				if first < 0 {
+					first = i
+				}
+				last = i
+			}
+		}
+		if first < 0 {
+			return 0, 0, nil
+		}
+		from = oi.FirstRowIndex(first)
+		if last+1 < oi.NumPages() {
+			to = oi.FirstRowIndex(last + 1)
+		}
+	}
+
+	values, err := readColumnRange(ctx, c, table, "SeriesIndex", from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := sort.Search(len(values), func(i int) bool { return values[i].Int64() >= seriesIndex })
+	stop := sort.Search(len(values), func(i int) bool { return values[i].Int64() > seriesIndex })
+	return from + int64(start), from + int64(stop), nil
+}
+
+// readColumnRange reads the values of the rows [from, to) of a column chunk,
+// which isn't repeated.
+func readColumnRange(ctx context.Context, c parquet.ColumnChunk, table, column string, from, to int64) ([]parquet.Value, error) {
+	pages := c.Pages()
+	defer pages.Close()
+	if err := pages.SeekToRow(from); err != nil {
+		return nil, err
+	}
+
+	values := make([]parquet.Value, to-from)
+	for read := 0; read < len(values); {
+		page, err := pages.ReadPage()
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		query.PageRead(ctx, table, column)
+		n, err := page.Values().ReadValues(values[read:])
+		parquet.Release(page)
+		read += n
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (b *singleBlockQuerier) Series(ctx context.Context, matchers []*labels.Matcher, start, end model.Time) ([]phlaremodel.Labels, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "Series - Block")
+	defer sp.Finish()
+	if err := b.open(ctx); err != nil {
+		return nil, err
+	}
+
+	postings, err := PostingsForMatchers(b.index, nil, matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		result []phlaremodel.Labels
+		chks   = make([]index.ChunkMeta, 1)
+	)
+	for postings.Next() {
+		lbls := make(phlaremodel.Labels, 0, 6)
+		if _, err := b.index.Series(postings.At(), &lbls, &chks); err != nil {
+			return nil, err
+		}
+		// the series time range is stored in nanoseconds
+		if chks[0].MinTime > end.UnixNano() || chks[0].MaxTime < start.UnixNano() {
+			continue
+		}
+		result = append(result, lbls)
+	}
+	return result, postings.Err()
+}
+
+func (b *singleBlockQuerier) SeriesMaxTimes(ctx context.Context) ([]SeriesMaxTime, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SeriesMaxTimes - Block")
+	defer sp.Finish()
+	if err := b.open(ctx); err != nil {
+		return nil, err
+	}
+
+	k, v := index.AllPostingsKey()
+	postings, err := b.index.Postings(k, nil, v)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		result []SeriesMaxTime
+		chks   = make([]index.ChunkMeta, 1)
+	)
+	for postings.Next() {
+		lbls := make(phlaremodel.Labels, 0, 6)
+		fp, err := b.index.Series(postings.At(), &lbls, &chks)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, SeriesMaxTime{
+			Labels:       lbls,
+			Fingerprint:  model.Fingerprint(fp),
+			MaxTimeNanos: chks[0].MaxTime,
+		})
+	}
+	return result, postings.Err()
 }
 
 func (b *singleBlockQuerier) Sort(in []Profile) []Profile {
@@ -917,11 +2258,13 @@ func (q *singleBlockQuerier) readTSBoundaries(ctx context.Context) (minMax, []mi
 	return tsBoundary, tsBoundaryPerRowGroup, nil
 }
 
-func newByteSliceFromBucketReader(ctx context.Context, bucketReader phlareobjstore.BucketReader, path string) (index.RealByteSlice, error) {
+func newByteSliceFromBucketReader(ctx context.Context, bucketReader phlareobjstore.BucketReader, path string) (_ index.RealByteSlice, err error) {
 	f, err := bucketReader.Get(ctx, path)
 	if err != nil {
 		return nil, err
 	}
+	// the data is read into memory, the file is of no use afterwards
+	defer runutil.CloseWithErrCapture(&err, f, "closing %s", path)
 
 	data, err := io.ReadAll(f)
 	if err != nil {
@@ -1023,7 +2366,9 @@ func (r *parquetReader[M, P]) open(ctx context.Context, bucketReader phlareobjst
 
 func (r *parquetReader[M, P]) Close() error {
 	if r.reader != nil {
-		return r.reader.Close()
+		err := r.reader.Close()
+		r.reader = nil
+		return err
 	}
 	return nil
 }
@@ -1044,12 +2389,17 @@ func (r *parquetReader[M, P]) info() block.File {
 }
 
 func (r *parquetReader[M, P]) columnIter(ctx context.Context, columnName string, predicate query.Predicate, alias string) query.Iterator {
+	return r.rowGroupsColumnIter(ctx, r.file.RowGroups(), columnName, predicate, alias)
+}
+
+// rowGroupsColumnIter iterates over the column of the given row groups only, row numbers start at 0 with the first of them.
+func (r *parquetReader[M, P]) rowGroupsColumnIter(ctx context.Context, rowGroups []parquet.RowGroup, columnName string, predicate query.Predicate, alias string) query.Iterator {
 	index, _ := query.GetColumnIndexByPath(r.file, columnName)
 	if index == -1 {
 		return query.NewErrIterator(fmt.Errorf("column '%s' not found in parquet file '%s'", columnName, r.relPath()))
 	}
 	ctx = query.AddMetricsToContext(ctx, r.metrics.query)
-	return query.NewColumnIterator(ctx, r.file.RowGroups(), index, columnName, 1000, predicate, alias)
+	return query.NewColumnIterator(ctx, rowGroups, index, columnName, 1000, predicate, alias)
 }
 
 func repeatedColumnIter[T any](ctx context.Context, source Source, columnName string, rows iter.Iterator[T]) iter.Iterator[*query.RepeatedRow[T]] {
@@ -1124,7 +2474,9 @@ func (r *inMemoryparquetReader[M, P]) NumRows() int64 {
 
 func (r *inMemoryparquetReader[M, P]) Close() error {
 	if r.reader != nil {
-		return r.reader.Close()
+		err := r.reader.Close()
+		r.reader = nil
+		return err
 	}
 	return nil
 }
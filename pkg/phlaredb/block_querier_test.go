@@ -1,17 +1,34 @@
 package phlaredb
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
 
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	"github.com/grafana/phlare/pkg/iter"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/objstore/client"
 	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
 	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+	"github.com/grafana/phlare/pkg/pprof/testhelper"
 )
 
 func TestInMemoryReader(t *testing.T) {
@@ -56,3 +73,584 @@ func TestInMemoryReader(t *testing.T) {
 		j++
 	}
 }
+
+func TestSingleBlockQuerierFromObjectStorage(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// force multiple row groups for profiles
+	db.head.profiles.cfg = &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 4}
+	require.NoError(t, ingestStreamProfiles(ctx, db.Head().Ingest, 0, 12, func(i int, p *testhelper.ProfileBuilder) {
+		p.ForStacktraceString("func1", "func2").AddSamples(int64(i + 1))
+	}))
+	require.NoError(t, db.Flush(ctx))
+	metas, err := db.BlockMetas(ctx)
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	meta := metas[0]
+
+	// upload the block to an in-memory bucket, which only supports range reads.
+	bkt := objstore.NewInMemBucket()
+	blockDir := filepath.Join(db.LocalDataPath(), meta.ULID.String())
+	for _, f := range meta.Files {
+		data, err := os.ReadFile(filepath.Join(blockDir, f.RelPath))
+		require.NoError(t, err)
+		require.NoError(t, bkt.Upload(ctx, filepath.Join(meta.ULID.String(), f.RelPath), bytes.NewReader(data)))
+	}
+
+	params := &ingestv1.SelectProfilesRequest{
+		Start:         0,
+		End:           1000000000000,
+		LabelSelector: `{stream="stream-b"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+	}
+	selectProfiles := func(q *singleBlockQuerier) []string {
+		pIt, err := q.SelectMatchingProfiles(ctx, params)
+		require.NoError(t, err)
+		var result []string
+		for pIt.Next() {
+			result = append(result, fmt.Sprintf("%s@%d", pIt.At().Labels().Get("stream"), pIt.At().Timestamp().Unix()))
+		}
+		require.NoError(t, pIt.Err())
+		return result
+	}
+
+	local := newSingleBlockQuerierFromMeta(ctx, db.blockQuerier.bucketReader, meta)
+	defer func() {
+		require.NoError(t, local.Close())
+	}()
+	remote := newSingleBlockQuerierFromMeta(ctx, client.ReaderAtBucket("", bkt, prometheus.NewRegistry()), meta)
+	defer func() {
+		require.NoError(t, remote.Close())
+	}()
+
+	expected := []string{"stream-b@1", "stream-b@4", "stream-b@7", "stream-b@10"}
+	require.Equal(t, expected, selectProfiles(local))
+	require.Equal(t, expected, selectProfiles(remote))
+}
+
+func TestQueriersSeries(t *testing.T) {
+	ctx := testContext(t)
+
+	assertSeries := func(t *testing.T, queriers Queriers, start, end model.Time, expectedStreams ...string) {
+		t.Helper()
+		matchers, err := parser.ParseMetricSelector(`{__profile_type__="process_cpu:cpu:nanoseconds:cpu:nanoseconds"}`)
+		require.NoError(t, err)
+		series, err := queriers.Series(ctx, matchers, start, end)
+		require.NoError(t, err)
+		require.Len(t, series, len(expectedStreams))
+		for i, lbls := range series {
+			require.Equal(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds", lbls.Get(phlaremodel.LabelNameProfileType))
+			require.Equal(t, "foo", lbls.Get("job"))
+			require.Equal(t, expectedStreams[i], lbls.Get("stream"))
+			require.True(t, sort.SliceIsSorted(lbls, func(i, j int) bool { return lbls[i].Name < lbls[j].Name }))
+		}
+	}
+
+	t.Run("head", func(t *testing.T) {
+		head := newTestHead(t)
+		for i := 0; i < 9; i++ {
+			require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+		}
+
+		assertSeries(t, head.Queriers(), 0, model.Time(10000), streams...)
+		// only stream-c has profiles after 7s
+		assertSeries(t, head.Queriers(), model.Time(7500), model.Time(10000), "stream-c")
+		assertSeries(t, head.Queriers(), model.Time(20000), model.Time(30000))
+
+		// series of the head row groups are returned once
+		require.NoError(t, head.profiles.cutRowGroup())
+		require.NoError(t, ingestThreeProfileStreams(ctx, 9, head.Ingest))
+		assertSeries(t, head.Queriers(), 0, model.Time(10000), streams...)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		dir := newVerifyTestBlock(t)
+		bkt, err := filesystem.NewBucket(filepath.Dir(dir))
+		require.NoError(t, err)
+		meta, _, err := block.MetaFromDir(dir)
+		require.NoError(t, err)
+		q := newSingleBlockQuerierFromMeta(ctx, bkt, meta)
+		defer func() {
+			require.NoError(t, q.Close())
+		}()
+
+		assertSeries(t, Queriers{q}, 0, model.Time(10000), streams...)
+		assertSeries(t, Queriers{q}, model.Time(6500), model.Time(10000), "stream-b", "stream-c")
+		assertSeries(t, Queriers{q}, model.Time(9000), model.Time(10000))
+	})
+}
+
+func TestQueriersProfileTypes(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	cpu := testhelper.NewProfileBuilder(int64(time.Second)).CPUProfile().WithLabels("job", "foo")
+	cpu.ForStacktraceString("func1", "func2").AddSamples(10)
+	require.NoError(t, db.Head().Ingest(ctx, cpu.Profile, cpu.UUID, cpu.Labels...))
+	heap := testhelper.NewProfileBuilder(int64(5*time.Second)).MemoryProfile().WithLabels("job", "foo")
+	heap.ForStacktraceString("func1", "func2").AddSamples(1, 2, 3, 4)
+	require.NoError(t, db.Head().Ingest(ctx, heap.Profile, heap.UUID, heap.Labels...))
+
+	var (
+		cpuType = &typesv1.ProfileType{
+			ID:         "process_cpu:cpu:nanoseconds:cpu:nanoseconds",
+			Name:       "process_cpu",
+			SampleType: "cpu",
+			SampleUnit: "nanoseconds",
+			PeriodType: "cpu",
+			PeriodUnit: "nanoseconds",
+		}
+		inuseObjectsType = &typesv1.ProfileType{
+			ID:         "memory:inuse_objects:count:space:bytes",
+			Name:       "memory",
+			SampleType: "inuse_objects",
+			SampleUnit: "count",
+			PeriodType: "space",
+			PeriodUnit: "bytes",
+		}
+		inuseSpaceType = &typesv1.ProfileType{
+			ID:         "memory:inuse_space:bytes:space:bytes",
+			Name:       "memory",
+			SampleType: "inuse_space",
+			SampleUnit: "bytes",
+			PeriodType: "space",
+			PeriodUnit: "bytes",
+		}
+	)
+
+	assertProfileTypes := func(t *testing.T, queriers Queriers) {
+		t.Helper()
+		// the alloc types of the heap profile are not ingested, as they are deltas
+		profileTypes, err := queriers.ProfileTypes(ctx, 0, model.Time(10000))
+		require.NoError(t, err)
+		require.Equal(t, []*typesv1.ProfileType{inuseObjectsType, inuseSpaceType, cpuType}, profileTypes)
+
+		profileTypes, err = queriers.ProfileTypes(ctx, 0, model.Time(2000))
+		require.NoError(t, err)
+		require.Equal(t, []*typesv1.ProfileType{cpuType}, profileTypes)
+
+		profileTypes, err = queriers.ProfileTypes(ctx, model.Time(20000), model.Time(30000))
+		require.NoError(t, err)
+		require.Empty(t, profileTypes)
+	}
+
+	t.Run("head", func(t *testing.T) {
+		assertProfileTypes(t, db.Head().Queriers())
+	})
+
+	t.Run("block", func(t *testing.T) {
+		require.NoError(t, db.Flush(ctx))
+		assertProfileTypes(t, db.blockQuerier.Queriers())
+	})
+}
+
+func TestQueriersLabelCardinality(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+	}
+
+	assertCardinality := func(t *testing.T, queriers Queriers) {
+		t.Helper()
+		cardinality, err := queriers.LabelCardinality(ctx, 0, model.Time(10000))
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), cardinality["stream"])
+		require.Equal(t, uint64(1), cardinality["job"])
+		require.Equal(t, uint64(1), cardinality[phlaremodel.LabelNameProfileType])
+
+		// only stream-c has a profile after 7.5s
+		cardinality, err = queriers.LabelCardinality(ctx, model.Time(7500), model.Time(10000))
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), cardinality["stream"])
+
+		cardinality, err = queriers.LabelCardinality(ctx, model.Time(20000), model.Time(30000))
+		require.NoError(t, err)
+		require.Empty(t, cardinality)
+	}
+
+	t.Run("head", func(t *testing.T) {
+		assertCardinality(t, db.Head().Queriers())
+	})
+
+	t.Run("block", func(t *testing.T) {
+		require.NoError(t, db.Flush(ctx))
+		assertCardinality(t, db.blockQuerier.Queriers())
+	})
+}
+
+func TestQueriersClose(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("open files are counted with /proc/self/fd")
+	}
+	ctx := testContext(t)
+	dataPath := t.TempDir()
+	db, err := New(ctx, Config{
+		DataPath:         dataPath,
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+	}
+	require.NoError(t, db.Flush(ctx))
+	metas, err := db.BlockMetas(ctx)
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+
+	// openFiles returns the number of files of the data path opened by the process
+	openFiles := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		require.NoError(t, err)
+		var n int
+		for _, e := range entries {
+			target, err := os.Readlink(filepath.Join("/proc/self/fd", e.Name()))
+			if err == nil && strings.HasPrefix(target, dataPath) {
+				n++
+			}
+		}
+		return n
+	}
+	before := openFiles()
+
+	for i := 0; i < 50; i++ {
+		queriers := Queriers{newSingleBlockQuerierFromMeta(ctx, db.blockQuerier.bucketReader, metas[0])}
+		it, err := queriers.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		require.NoError(t, err)
+		// the iterator is abandoned after the first profile
+		require.True(t, it.Next())
+		require.Greater(t, openFiles(), before)
+		require.NoError(t, queriers.Close())
+		require.Equal(t, before, openFiles())
+	}
+
+	// closed queriers open their files again on the next query
+	queriers := Queriers{newSingleBlockQuerierFromMeta(ctx, db.blockQuerier.bucketReader, metas[0])}
+	for i := 0; i < 2; i++ {
+		count, err := queriers.CountMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(9), count.Profiles)
+		require.NoError(t, queriers.Close())
+	}
+	require.Equal(t, before, openFiles())
+}
+
+// newMultiRowGroupTestBlock flushes a block with the given number of profiles, spread over 3 streams
+// and split into row groups of rowsPerRowGroup profiles.
+func newMultiRowGroupTestBlock(t testing.TB, profiles, rowsPerRowGroup int) *singleBlockQuerier {
+	return newTestBlockQuerier(t, profiles, &ParquetConfig{MaxRowGroupBytes: 128 * 1024 * 1024, MaxBufferRowCount: rowsPerRowGroup}, func(i int) string {
+		return streams[i%3]
+	})
+}
+
+// newTestBlock flushes a single block with the profiles ingested by ingest
+// and returns the local path of the blocks and the meta of the block. The
+// parquet configuration of the head profiles is overridden if not nil.
+func newTestBlock(t testing.TB, cfg Config, parquet *ParquetConfig, ingest func(context.Context, *Head) error) (string, *block.Meta) {
+	t.Helper()
+	ctx := testContext(t)
+	cfg.DataPath = t.TempDir()
+	cfg.MaxBlockDuration = time.Duration(100000) * time.Minute // we will manually flush
+	db, err := New(ctx, cfg, NoLimit)
+	require.NoError(t, err)
+
+	if parquet != nil {
+		db.head.profiles.cfg = parquet
+	}
+	require.NoError(t, ingest(ctx, db.Head()))
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.Close())
+
+	localPath := filepath.Join(cfg.DataPath, pathLocal)
+	entries, err := os.ReadDir(localPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	meta, _, err := block.MetaFromDir(filepath.Join(localPath, entries[0].Name()))
+	require.NoError(t, err)
+	return localPath, meta
+}
+
+// newTestBlockQuerier returns a querier of a block with a profile per second,
+// the stream label of the i-th profile is returned by stream.
+func newTestBlockQuerier(t testing.TB, profiles int, parquet *ParquetConfig, stream func(i int) string) *singleBlockQuerier {
+	localPath, meta := newTestBlock(t, Config{}, parquet, func(ctx context.Context, head *Head) error {
+		for i := 0; i < profiles; i++ {
+			p := testhelper.NewProfileBuilder(time.Second.Nanoseconds()*int64(i)).
+				CPUProfile().
+				WithLabels("stream", stream(i))
+			p.ForStacktraceString("func1", "func2").AddSamples(int64(i + 1))
+			if err := head.Ingest(ctx, p.Profile, p.UUID, p.Labels...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	ctx := testContext(t)
+	bkt, err := filesystem.NewBucket(localPath)
+	require.NoError(t, err)
+	q := newSingleBlockQuerierFromMeta(ctx, bkt, meta)
+	t.Cleanup(func() {
+		require.NoError(t, q.Close())
+	})
+	require.NoError(t, q.open(ctx))
+	return q
+}
+
+func TestSelectMatchingProfilesBloomFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		bloomFilterColumns []string
+		expectedPageReads  float64
+	}{
+		{name: "without bloom filter", expectedPageReads: 2},
+		{name: "with bloom filter", bloomFilterColumns: []string{"SeriesIndex"}, expectedPageReads: 1},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testContext(t)
+			db, err := New(ctx, Config{
+				DataPath:         t.TempDir(),
+				MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+			}, NoLimit)
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, db.Close())
+			}()
+
+			// stream-a and stream-c end up in the first row group, stream-b and stream-d in the second one.
+			// The series index of stream-b is within the bounds of both row groups.
+			db.head.profiles.cfg = &ParquetConfig{
+				MaxRowGroupBytes:   128 * 1024 * 1024,
+				MaxBufferRowCount:  2,
+				BloomFilterColumns: tc.bloomFilterColumns,
+			}
+			for i, stream := range []string{"stream-a", "stream-c", "stream-b", "stream-d"} {
+				p := testhelper.NewProfileBuilder(time.Second.Nanoseconds()*int64(i)).
+					CPUProfile().
+					WithLabels("stream", stream)
+				p.ForStacktraceString("func1", "func2").AddSamples(10)
+				require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+			}
+			require.NoError(t, db.Flush(ctx))
+			metas, err := db.BlockMetas(ctx)
+			require.NoError(t, err)
+			require.Len(t, metas, 1)
+
+			reg := prometheus.NewPedanticRegistry()
+			ctx = contextWithBlockMetrics(ctx, newBlocksMetrics(reg))
+			q := newSingleBlockQuerierFromMeta(ctx, db.blockQuerier.bucketReader, metas[0])
+			defer func() {
+				require.NoError(t, q.Close())
+			}()
+			require.NoError(t, q.open(ctx))
+			require.Len(t, q.profiles.file.RowGroups(), 2)
+
+			it, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{stream="stream-b"}`,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			})
+			require.NoError(t, err)
+			profiles, err := iter.Slice(it)
+			require.NoError(t, err)
+			require.Len(t, profiles, 1)
+			require.Equal(t, "stream-b", profiles[0].Labels().Get("stream"))
+
+			require.Equal(t, tc.expectedPageReads, pageReads(t, reg, "profiles", "SeriesIndex"))
+		})
+	}
+}
+
+// pageReads returns the number of pages read of the column of the table.
+func pageReads(t *testing.T, reg prometheus.Gatherer, table, column string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != "phlaredb_page_reads_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			lbls := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				lbls[l.GetName()] = l.GetValue()
+			}
+			if lbls["table"] == table && lbls["column"] == column {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestSelectMatchingProfilesParallelRowGroups(t *testing.T) {
+	ctx := testContext(t)
+	q := newMultiRowGroupTestBlock(t, 120, 4)
+	require.Greater(t, len(q.profiles.file.RowGroups()), 8)
+
+	selectProfiles := func(concurrency int) []BlockProfile {
+		q.rowGroupConcurrency = concurrency
+		it, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{stream=~"stream-a|stream-c"}`,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         int64(model.TimeFromUnixNano(10 * time.Second.Nanoseconds())),
+			End:           int64(model.TimeFromUnixNano(100 * time.Second.Nanoseconds())),
+		})
+		require.NoError(t, err)
+		profiles, err := iter.Slice(it)
+		require.NoError(t, err)
+		result := make([]BlockProfile, len(profiles))
+		for i, p := range profiles {
+			result[i] = p.(BlockProfile)
+		}
+		return result
+	}
+
+	serial := selectProfiles(1)
+	require.Len(t, serial, 60)
+	for i := 1; i < len(serial); i++ {
+		require.Less(t, serial[i-1].Timestamp(), serial[i].Timestamp())
+	}
+	for _, concurrency := range []int{2, 4, 64} {
+		require.Equal(t, serial, selectProfiles(concurrency), "concurrency %d", concurrency)
+	}
+}
+
+func BenchmarkSelectMatchingProfilesRowGroups(b *testing.B) {
+	ctx := testContext(b)
+	q := newMultiRowGroupTestBlock(b, 30000, 500)
+	params := &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{}`,
+		Type:          mustParseProfileSelector(b, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(time.Hour.Nanoseconds() * 24)),
+	}
+
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", concurrency), func(b *testing.B) {
+			q.rowGroupConcurrency = concurrency
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				it, err := q.SelectMatchingProfiles(ctx, params)
+				require.NoError(b, err)
+				for it.Next() {
+				}
+				require.NoError(b, it.Err())
+			}
+		})
+	}
+}
+
+func TestSelectMatchingProfilesSingleSeries(t *testing.T) {
+	ctx := testContext(t)
+	for _, order := range []SortOrder{SeriesThenTime, TimeThenSeries} {
+		q := newTestBlockQuerier(t, 3000, &ParquetConfig{MaxRowGroupBytes: 128 * 1024 * 1024, MaxBufferRowCount: 64, SortOrder: order}, func(i int) string {
+			return fmt.Sprintf("stream-%d", i%100)
+		})
+		require.Greater(t, len(q.profiles.file.RowGroups()), 40)
+
+		// the series i has a profile at i, i+100, i+200... seconds
+		for series, expected := range map[int]int{0: 16, 42: 15, 99: 15} {
+			it, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+				LabelSelector: fmt.Sprintf(`{stream="stream-%d"}`, series),
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         int64(model.TimeFromUnixNano(500 * time.Second.Nanoseconds())),
+				End:           int64(model.TimeFromUnixNano(2000 * time.Second.Nanoseconds())),
+			})
+			require.NoError(t, err)
+			profiles, err := iter.Slice(it)
+			require.NoError(t, err)
+			require.Len(t, profiles, expected)
+
+			// the general path returns the same profiles
+			lblsPerRef := seriesLabelsPerRef(t, q, "stream", fmt.Sprintf("stream-%d", series))
+			general, err := q.scanProfiles(ctx, lblsPerRef, 500*time.Second.Nanoseconds(), 2000*time.Second.Nanoseconds())
+			require.NoError(t, err)
+			require.Equal(t, lo.Values(general)[0], profiles, "order %d series %d", order, series)
+		}
+	}
+}
+
+func BenchmarkSelectMatchingProfilesSingleSeries(b *testing.B) {
+	ctx := testContext(b)
+	q := newTestBlockQuerier(b, 100000, &ParquetConfig{MaxRowGroupBytes: 128 * 1024 * 1024, MaxBufferRowCount: 10000}, func(i int) string {
+		return fmt.Sprintf("stream-%d", i%1000)
+	})
+	lblsPerRef := seriesLabelsPerRef(b, q, "stream", "stream-42")
+
+	for _, tc := range []struct {
+		name string
+		scan func(context.Context, map[int64]labelsInfo, int64, int64) (map[int64][]Profile, error)
+	}{
+		{name: "general", scan: q.scanProfiles},
+		{name: "single series", scan: q.scanSingleSeries},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				result, err := tc.scan(ctx, lblsPerRef, 0, time.Hour.Nanoseconds()*48)
+				require.NoError(b, err)
+				require.Len(b, lo.Values(result)[0], 100)
+			}
+		})
+	}
+}
+
+// seriesLabelsPerRef returns the series of the block with the given label, as
+// looked up by SelectMatchingProfiles.
+func seriesLabelsPerRef(t testing.TB, q *singleBlockQuerier, name, value string) map[int64]labelsInfo {
+	t.Helper()
+	postings, err := PostingsForMatchers(q.index, nil, labels.MustNewMatcher(labels.MatchEqual, name, value))
+	require.NoError(t, err)
+	var (
+		lblsPerRef = make(map[int64]labelsInfo)
+		chks       = make([]index.ChunkMeta, 1)
+	)
+	for postings.Next() {
+		var lbls phlaremodel.Labels
+		fp, err := q.index.Series(postings.At(), &lbls, &chks)
+		require.NoError(t, err)
+		lblsPerRef[int64(chks[0].SeriesIndex)] = labelsInfo{fp: model.Fingerprint(fp), lbs: lbls}
+	}
+	require.NoError(t, postings.Err())
+	require.Len(t, lblsPerRef, 1)
+	return lblsPerRef
+}
@@ -0,0 +1,407 @@
+package phlaredb
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/segmentio/parquet-go"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+	"github.com/grafana/phlare/pkg/util/build"
+)
+
+const splitBatchSize = 1024
+
+// splitSeries is a series of the source block.
+type splitSeries struct {
+	lbls phlaremodel.Labels
+	fp   model.Fingerprint
+}
+
+// splitBucket collects the profiles of one time bucket of a split block.
+type splitBucket struct {
+	dir    string
+	meta   *block.Meta
+	file   *os.File
+	writer *parquet.GenericWriter[*schemav1.Profile]
+
+	// new series index by series index of the source block.
+	seriesIndexes map[uint32]uint32
+	series        []*splitSeriesInBucket
+	numRows       uint64
+	numRowGroups  uint64
+	pending       bool
+}
+
+type splitSeriesInBucket struct {
+	splitSeries
+	index            uint32
+	minTime, maxTime int64
+}
+
+// SplitBlock splits the block in src into one block per time bucket delimited
+// by boundaries. A profile with a timestamp equal to a boundary goes to the
+// later bucket. The blocks are written to destDir and their paths returned,
+// no block is written for buckets without profiles.
+//
+// The profiles of the source block are read once, each output block gets its
+// own TSDB index with the series of its profiles. Symbols are copied
+// unchanged, so the stacktraces referenced by the profiles stay valid.
+func SplitBlock(ctx context.Context, src string, boundaries []time.Time, destDir string) ([]string, error) {
+	meta, _, err := block.MetaFromDir(src)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading block meta")
+	}
+
+	boundariesNanos := make([]int64, len(boundaries))
+	for i, b := range boundaries {
+		boundariesNanos[i] = b.UnixNano()
+	}
+	sort.Slice(boundariesNanos, func(i, j int) bool { return boundariesNanos[i] < boundariesNanos[j] })
+
+	series, err := readSplitSeries(filepath.Join(src, block.IndexFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	profilesPath := (&schemav1.ProfilePersister{}).Name() + block.ParquetSuffix
+	f, err := os.Open(filepath.Join(src, profilesPath))
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", profilesPath)
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting stat of %s", profilesPath)
+	}
+	pf, err := parquet.OpenFile(f, stat.Size())
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading parquet file %s", profilesPath)
+	}
+
+	buckets := make([]*splitBucket, len(boundariesNanos)+1)
+	defer func() {
+		for _, b := range buckets {
+			if b != nil && b.file != nil {
+				b.file.Close()
+			}
+		}
+	}()
+
+	var (
+		persister = &schemav1.ProfilePersister{}
+		buf       = make([]*schemav1.Profile, splitBatchSize)
+	)
+	for _, rg := range pf.RowGroups() {
+		order := sortOrderOf(rg)
+		reader := parquet.NewGenericRowGroupReader[*schemav1.Profile](rg)
+		for {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			n, err := reader.Read(buf)
+			for _, p := range buf[:n] {
+				// profiles on a boundary go to the later bucket
+				idx := sort.Search(len(boundariesNanos), func(i int) bool { return boundariesNanos[i] > p.TimeNanos })
+				if buckets[idx] == nil {
+					b, err := newSplitBucket(destDir, meta, persister, order)
+					if err != nil {
+						return nil, err
+					}
+					buckets[idx] = b
+				}
+				s, ok := series[p.SeriesIndex]
+				if !ok {
+					return nil, errors.Errorf("profile references series index %d, which does not exist in %s", p.SeriesIndex, block.IndexFilename)
+				}
+				if err := buckets[idx].add(p, s); err != nil {
+					return nil, err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading %s", profilesPath)
+			}
+		}
+		if err := reader.Close(); err != nil {
+			return nil, err
+		}
+
+		// keep the row groups of the source block
+		for _, b := range buckets {
+			if b != nil {
+				if err := b.flushRowGroup(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var dirs []string
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if err := b.close(ctx, src, meta); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, b.dir)
+	}
+	return dirs, nil
+}
+
+func readSplitSeries(path string) (map[uint32]splitSeries, error) {
+	idx, err := index.NewFileReader(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening tsdb index")
+	}
+	defer idx.Close()
+	return seriesBySeriesIndex(idx)
+}
+
+// seriesBySeriesIndex maps the series indexes of the profiles to the series of the TSDB index.
+func seriesBySeriesIndex(idx *index.Reader) (map[uint32]splitSeries, error) {
+	k, v := index.AllPostingsKey()
+	postings, err := idx.Postings(k, nil, v)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading tsdb postings")
+	}
+	var (
+		chks   = make([]index.ChunkMeta, 1)
+		series = make(map[uint32]splitSeries)
+	)
+	for postings.Next() {
+		var lbls phlaremodel.Labels
+		fp, err := idx.Series(postings.At(), &lbls, &chks)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading tsdb series")
+		}
+		for _, chk := range chks {
+			series[chk.SeriesIndex] = splitSeries{lbls: lbls, fp: model.Fingerprint(fp)}
+		}
+	}
+	if err := postings.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading tsdb postings")
+	}
+	return series, nil
+}
+
+// sortOrderOf returns the order of the profiles in the row group.
+func sortOrderOf(rg parquet.RowGroup) SortOrder {
+	if columns := rg.SortingColumns(); len(columns) > 0 {
+		if path := columns[0].Path(); len(path) > 0 && path[0] == "TimeNanos" {
+			return TimeThenSeries
+		}
+	}
+	return SeriesThenTime
+}
+
+func newSplitBucket(destDir string, src *block.Meta, persister *schemav1.ProfilePersister, order SortOrder) (*splitBucket, error) {
+	meta := block.NewMeta()
+	for k, v := range src.Labels {
+		meta.Labels[k] = v
+	}
+	meta.Source = src.Source
+	meta.Compaction = tsdb.BlockMetaCompaction{
+		Level:   src.Compaction.Level,
+		Sources: src.Compaction.Sources,
+		Parents: []tsdb.BlockDesc{{ULID: src.ULID, MinTime: int64(src.MinTime), MaxTime: int64(src.MaxTime)}},
+	}
+	if len(meta.Compaction.Sources) == 0 {
+		meta.Compaction.Sources = []ulid.ULID{src.ULID}
+	}
+
+	dir := filepath.Join(destDir, meta.ULID.String())
+	if err := os.MkdirAll(dir, defaultFolderMode); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, persister.Name()+block.ParquetSuffix))
+	if err != nil {
+		return nil, err
+	}
+	return &splitBucket{
+		dir:  dir,
+		meta: meta,
+		file: f,
+		writer: parquet.NewGenericWriter[*schemav1.Profile](f, persister.Schema(),
+			parquet.CreatedBy("github.com/grafana/phlare/", build.Version, build.Revision),
+			parquet.SortingWriterConfig(order.sortingColumns()),
+		),
+		seriesIndexes: make(map[uint32]uint32),
+	}, nil
+}
+
+// add writes the profile to the bucket. Series indexes are assigned in order of
+// first appearance, which keeps the order of a source block sorted by series.
+func (b *splitBucket) add(p *schemav1.Profile, s splitSeries) error {
+	idx, ok := b.seriesIndexes[p.SeriesIndex]
+	if !ok {
+		idx = uint32(len(b.series))
+		b.seriesIndexes[p.SeriesIndex] = idx
+		b.series = append(b.series, &splitSeriesInBucket{splitSeries: s, index: idx, minTime: p.TimeNanos, maxTime: p.TimeNanos})
+	}
+	series := b.series[idx]
+	if p.TimeNanos < series.minTime {
+		series.minTime = p.TimeNanos
+	}
+	if p.TimeNanos > series.maxTime {
+		series.maxTime = p.TimeNanos
+	}
+	if v := model.TimeFromUnixNano(p.TimeNanos); v < b.meta.MinTime {
+		b.meta.MinTime = v
+	}
+	if v := model.TimeFromUnixNano(p.TimeNanos); v > b.meta.MaxTime {
+		b.meta.MaxTime = v
+	}
+	b.meta.Stats.NumProfiles++
+	b.meta.Stats.NumSamples += uint64(len(p.Samples))
+
+	p.SeriesIndex = idx
+	if _, err := b.writer.Write([]*schemav1.Profile{p}); err != nil {
+		return err
+	}
+	b.numRows++
+	b.pending = true
+	return nil
+}
+
+func (b *splitBucket) flushRowGroup() error {
+	if !b.pending {
+		return nil
+	}
+	b.pending = false
+	b.numRowGroups++
+	return b.writer.Flush()
+}
+
+// close finishes the profiles, writes the TSDB index, copies the symbols of
+// the source block and finally the meta.json.
+func (b *splitBucket) close(ctx context.Context, src string, srcMeta *block.Meta) error {
+	if err := b.flushRowGroup(); err != nil {
+		return err
+	}
+	if err := b.writer.Close(); err != nil {
+		return err
+	}
+	if err := b.file.Close(); err != nil {
+		return err
+	}
+	b.file = nil
+
+	files := []block.File{{
+		RelPath: (&schemav1.ProfilePersister{}).Name() + block.ParquetSuffix,
+		Parquet: &block.ParquetFile{
+			NumRowGroups: b.numRowGroups,
+			NumRows:      b.numRows,
+		},
+	}}
+
+	if err := b.writeIndex(ctx); err != nil {
+		return err
+	}
+	b.meta.Stats.NumSeries = uint64(len(b.series))
+	files = append(files, block.File{
+		RelPath: block.IndexFilename,
+		TSDB:    &block.TSDBFile{NumSeries: b.meta.Stats.NumSeries},
+	})
+
+	// symbols are shared with the source block
+	for _, f := range srcMeta.Files {
+		if f.Parquet == nil || f.RelPath == files[0].RelPath {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, f.RelPath), filepath.Join(b.dir, f.RelPath)); err != nil {
+			return errors.Wrapf(err, "copying %s", f.RelPath)
+		}
+		files = append(files, block.File{RelPath: f.RelPath, Parquet: f.Parquet})
+	}
+
+	for i := range files {
+		if stat, err := os.Stat(filepath.Join(b.dir, files[i].RelPath)); err == nil {
+			files[i].SizeBytes = uint64(stat.Size())
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].RelPath < files[j].RelPath
+	})
+	if err := setChecksums(b.dir, files); err != nil {
+		return err
+	}
+	b.meta.Files = files
+
+	_, err := b.meta.WriteToFile(log.NewNopLogger(), b.dir)
+	return err
+}
+
+func (b *splitBucket) writeIndex(ctx context.Context) error {
+	series := make([]*splitSeriesInBucket, len(b.series))
+	copy(series, b.series)
+	sort.Slice(series, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(series[i].lbls, series[j].lbls) < 0
+	})
+
+	symbolsMap := make(map[string]struct{})
+	for _, s := range series {
+		for _, l := range s.lbls {
+			symbolsMap[l.Name] = struct{}{}
+			symbolsMap[l.Value] = struct{}{}
+		}
+	}
+	symbols := make([]string, 0, len(symbolsMap))
+	for s := range symbolsMap {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+
+	writer, err := index.NewWriter(ctx, filepath.Join(b.dir, block.IndexFilename))
+	if err != nil {
+		return err
+	}
+	for _, symbol := range symbols {
+		if err := writer.AddSymbol(symbol); err != nil {
+			return err
+		}
+	}
+	for i, s := range series {
+		if err := writer.AddSeries(storage.SeriesRef(i), s.lbls, s.fp, index.ChunkMeta{
+			MinTime:     s.minTime,
+			MaxTime:     s.maxTime,
+			SeriesIndex: s.index,
+		}); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
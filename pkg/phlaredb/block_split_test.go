@@ -0,0 +1,91 @@
+package phlaredb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+func TestSplitBlock(t *testing.T) {
+	ctx := context.Background()
+	src := newVerifyTestBlock(t)
+	srcMeta, _, err := block.MetaFromDir(src)
+	require.NoError(t, err)
+
+	destDir := t.TempDir()
+	dirs, err := SplitBlock(ctx, src, []time.Time{time.Unix(6, 0), time.Unix(3, 0)}, destDir)
+	require.NoError(t, err)
+	require.Len(t, dirs, 3)
+
+	bkt, err := filesystem.NewBucket(destDir)
+	require.NoError(t, err)
+
+	for i, dir := range dirs {
+		problems, err := VerifyBlock(ctx, dir)
+		require.NoError(t, err)
+		require.Empty(t, problems)
+
+		meta, _, err := block.MetaFromDir(dir)
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), meta.Stats.NumProfiles)
+		require.Equal(t, uint64(3), meta.Stats.NumSeries)
+		require.Equal(t, srcMeta.ULID, meta.Compaction.Parents[0].ULID)
+		start := time.Unix(int64(3*i), 0)
+		require.Equal(t, start.UnixMilli(), int64(meta.MinTime))
+		require.Equal(t, start.Add(2*time.Second).UnixMilli(), int64(meta.MaxTime))
+
+		// profiles on a boundary go to the later bucket, series indexes start from 0 in each block
+		profiles, _ := readFullParquetFile[*schemav1.Profile](t, filepath.Join(dir, "profiles.parquet"))
+		require.Len(t, profiles, 3)
+		for j, p := range profiles {
+			require.Equal(t, uint32(j), p.SeriesIndex)
+			require.Equal(t, start.Add(time.Duration(j)*time.Second).UnixNano(), p.TimeNanos)
+		}
+
+		// the series indexes match the TSDB index
+		q := newSingleBlockQuerierFromMeta(ctx, bkt, meta)
+		it, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(10 * time.Second / time.Millisecond),
+		})
+		require.NoError(t, err)
+		var result []string
+		for it.Next() {
+			result = append(result, fmt.Sprintf("%s@%d", it.At().Labels().Get("stream"), it.At().Timestamp().Unix()))
+		}
+		require.NoError(t, it.Err())
+		require.Equal(t, []string{
+			fmt.Sprintf("stream-a@%d", 3*i),
+			fmt.Sprintf("stream-b@%d", 3*i+1),
+			fmt.Sprintf("stream-c@%d", 3*i+2),
+		}, result)
+		require.NoError(t, q.Close())
+	}
+}
+
+func TestSplitBlockSkipsEmptyBuckets(t *testing.T) {
+	ctx := context.Background()
+	src := newVerifyTestBlock(t)
+
+	dirs, err := SplitBlock(ctx, src, []time.Time{time.Unix(-10, 0), time.Unix(4, 0), time.Unix(100, 0)}, t.TempDir())
+	require.NoError(t, err)
+	require.Len(t, dirs, 2)
+
+	for i, expected := range []int{4, 5} {
+		meta, _, err := block.MetaFromDir(dirs[i])
+		require.NoError(t, err)
+		require.Equal(t, uint64(expected), meta.Stats.NumProfiles)
+		require.Equal(t, uint64(3), meta.Stats.NumSeries)
+	}
+}
@@ -0,0 +1,296 @@
+package phlaredb
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/parquet-go"
+	"golang.org/x/exp/slices"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+)
+
+// Problem describes an inconsistency found while verifying a block.
+type Problem struct {
+	File    string // path of the file relative to the block directory
+	Message string
+}
+
+func (p Problem) String() string {
+	return p.File + ": " + p.Message
+}
+
+const verifyBatchSize = 1024
+
+// VerifyBlock checks the consistency of the block in dir without modifying
+// it. It ensures that every profile references a series of the TSDB index
+// and a stored stacktrace, that profiles of a series are ordered by time and
+// that the row counts match the ones recorded in meta.json, if present.
+//
+// Problems found are returned, an error is only returned if the block could
+// not be read.
+func VerifyBlock(ctx context.Context, dir string) ([]Problem, error) {
+	var problems []Problem
+	report := func(file string, format string, args ...interface{}) {
+		problems = append(problems, Problem{File: file, Message: fmt.Sprintf(format, args...)})
+	}
+
+	meta, _, err := block.MetaFromDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "reading block meta")
+	}
+
+	// collect all series indexes known to the TSDB index
+	idx, err := index.NewFileReader(filepath.Join(dir, block.IndexFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "opening tsdb index")
+	}
+	defer idx.Close()
+
+	k, v := index.AllPostingsKey()
+	postings, err := idx.Postings(k, nil, v)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading tsdb postings")
+	}
+	var (
+		lbls          phlaremodel.Labels
+		chks          = make([]index.ChunkMeta, 1)
+		seriesIndexes = make(map[uint32]struct{})
+	)
+	for postings.Next() {
+		if _, err := idx.Series(postings.At(), &lbls, &chks); err != nil {
+			return nil, errors.Wrap(err, "reading tsdb series")
+		}
+		for _, chk := range chks {
+			seriesIndexes[chk.SeriesIndex] = struct{}{}
+		}
+	}
+	if err := postings.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading tsdb postings")
+	}
+
+	// stacktrace IDs correspond to the row number in the stacktraces table
+	numStacktraces, err := parquetNumRows(filepath.Join(dir, (&schemav1.StacktracePersister{}).Name()+block.ParquetSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	profilesPath := (&schemav1.ProfilePersister{}).Name() + block.ParquetSuffix
+	f, err := os.Open(filepath.Join(dir, profilesPath))
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", profilesPath)
+	}
+	defer f.Close()
+
+	var (
+		reader      = parquet.NewGenericReader[*schemav1.Profile](f)
+		buf         = make([]*schemav1.Profile, verifyBatchSize)
+		rowNum      int64
+		numProfiles = reader.NumRows()
+
+		currSeriesIndex uint32
+		lastTimeNanos   int64
+		danglingSeries  = make(map[uint32]struct{})
+	)
+	defer reader.Close()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := reader.Read(buf)
+		for _, p := range buf[:n] {
+			if _, ok := seriesIndexes[p.SeriesIndex]; !ok {
+				if _, reported := danglingSeries[p.SeriesIndex]; !reported {
+					danglingSeries[p.SeriesIndex] = struct{}{}
+					report(profilesPath, "row %d references series index %d, which does not exist in %s", rowNum, p.SeriesIndex, block.IndexFilename)
+				}
+			}
+
+			if rowNum > 0 && p.SeriesIndex == currSeriesIndex && p.TimeNanos < lastTimeNanos {
+				report(profilesPath, "row %d of series index %d has timestamp %d, which is before the previous profile's timestamp %d", rowNum, p.SeriesIndex, p.TimeNanos, lastTimeNanos)
+			}
+			currSeriesIndex = p.SeriesIndex
+			lastTimeNanos = p.TimeNanos
+
+			for _, s := range p.Samples {
+				if s.StacktraceID >= uint64(numStacktraces) {
+					report(profilesPath, "row %d references stacktrace ID %d, which does not exist (%d stacktraces)", rowNum, s.StacktraceID, numStacktraces)
+				}
+			}
+			rowNum++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", profilesPath)
+		}
+	}
+
+	if meta == nil {
+		return problems, nil
+	}
+
+	// validate row counts against the block meta
+	if meta.Stats.NumProfiles != uint64(numProfiles) {
+		report(block.MetaFilename, "expected %d profiles, %s contains %d", meta.Stats.NumProfiles, profilesPath, numProfiles)
+	}
+	if f := meta.FileByRelPath(block.IndexFilename); f != nil && f.TSDB != nil && f.TSDB.NumSeries != uint64(len(seriesIndexes)) {
+		report(block.MetaFilename, "expected %d series, %s contains %d", f.TSDB.NumSeries, block.IndexFilename, len(seriesIndexes))
+	}
+	for _, f := range meta.Files {
+		if f.Parquet == nil {
+			continue
+		}
+		numRows, err := parquetNumRows(filepath.Join(dir, f.RelPath))
+		if err != nil {
+			report(f.RelPath, "%v", err)
+			continue
+		}
+		if f.Parquet.NumRows != uint64(numRows) {
+			report(block.MetaFilename, "expected %d rows, %s contains %d", f.Parquet.NumRows, f.RelPath, numRows)
+		}
+		if err := VerifyPageChecksums(filepath.Join(dir, f.RelPath)); err != nil {
+			report(f.RelPath, "%v", err)
+		}
+	}
+
+	return problems, nil
+}
+
+// PageChecksumError is returned, when the CRC32 checksum of a page of a
+// parquet file doesn't match the content of the page. It wraps
+// parquet.ErrCorrupted.
+type PageChecksumError struct {
+	File     string // path of the parquet file
+	RowGroup int
+	Column   string
+	Err      error
+}
+
+func (e *PageChecksumError) Error() string {
+	return fmt.Sprintf("page checksum mismatch in row group %d of column %s of %s: %v", e.RowGroup, e.Column, filepath.Base(e.File), e.Err)
+}
+
+func (e *PageChecksumError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyPageChecksums reads all data pages of the parquet file at path and
+// validates them against the CRC32 checksums of their headers. It returns a
+// *PageChecksumError for the first page not matching its checksum.
+func VerifyPageChecksums(path string) error {
+	f, pf, err := openParquetFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	columns := pf.Schema().Columns()
+	for rgIdx, rg := range pf.RowGroups() {
+		for colIdx, chunk := range rg.ColumnChunks() {
+			if err := readPages(chunk.Pages()); err != nil {
+				if errors.Is(err, parquet.ErrCorrupted) {
+					return &PageChecksumError{File: path, RowGroup: rgIdx, Column: strings.Join(columns[colIdx], "."), Err: err}
+				}
+				return errors.Wrapf(err, "reading pages of %s", filepath.Base(path))
+			}
+		}
+	}
+	return nil
+}
+
+func readPages(pages parquet.Pages) error {
+	defer pages.Close()
+	for {
+		page, err := pages.ReadPage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		parquet.Release(page)
+	}
+}
+
+func parquetNumRows(path string) (int64, error) {
+	f, pf, err := openParquetFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return pf.NumRows(), nil
+}
+
+// checksummedBlockFiles are the files of a block whose checksum is stored in
+// meta.json. The symbols are left out, as they are much smaller.
+var checksummedBlockFiles = []string{
+	block.IndexFilename,
+	(&schemav1.ProfilePersister{}).Name() + block.ParquetSuffix,
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// setChecksums computes the checksums of the checksummed files of the block in
+// dir, which are listed in files.
+func setChecksums(dir string, files []block.File) error {
+	for i := range files {
+		if !slices.Contains(checksummedBlockFiles, files[i].RelPath) {
+			continue
+		}
+		sum, err := fileCRC32C(filepath.Join(dir, files[i].RelPath))
+		if err != nil {
+			return errors.Wrapf(err, "computing checksum of %s", files[i].RelPath)
+		}
+		files[i].CRC32C = sum
+	}
+	return nil
+}
+
+// VerifyChecksums recomputes the checksums of the files of the block in dir
+// and compares them to the ones stored in meta.json, to detect corrupted or
+// partially uploaded files. Files without a checksum are skipped.
+func VerifyChecksums(dir string) error {
+	meta, _, err := block.MetaFromDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "reading block meta")
+	}
+	for _, f := range meta.Files {
+		if f.CRC32C == "" {
+			continue
+		}
+		sum, err := fileCRC32C(filepath.Join(dir, f.RelPath))
+		if err != nil {
+			return errors.Wrapf(err, "computing checksum of %s", f.RelPath)
+		}
+		if sum != f.CRC32C {
+			return fmt.Errorf("checksum mismatch of %s in block %s: expected %s, computed %s", f.RelPath, meta.ULID, f.CRC32C, sum)
+		}
+	}
+	return nil
+}
+
+func fileCRC32C(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := crc32.New(crc32cTable)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
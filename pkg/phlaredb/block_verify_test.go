@@ -0,0 +1,165 @@
+package phlaredb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/parquet-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/phlare/pkg/pprof/testhelper"
+)
+
+func newVerifyTestBlock(t *testing.T) string {
+	localPath, meta := newTestBlock(t, Config{}, nil, func(ctx context.Context, head *Head) error {
+		return ingestStreamProfiles(ctx, head.Ingest, 0, 9, func(_ int, p *testhelper.ProfileBuilder) {
+			p.ForStacktraceString("func1", "func2").AddSamples(10)
+			p.ForStacktraceString("func1").AddSamples(20)
+		})
+	})
+	return filepath.Join(localPath, meta.ULID.String())
+}
+
+func rewriteProfiles(t *testing.T, dir string, fn func([]*schemav1.Profile) []*schemav1.Profile) {
+	path := filepath.Join(dir, "profiles.parquet")
+	profiles, _ := readFullParquetFile[*schemav1.Profile](t, path)
+	profiles = fn(profiles)
+
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	w := parquet.NewGenericWriter[*schemav1.Profile](f, (&schemav1.ProfilePersister{}).Schema())
+	_, err = w.Write(profiles)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, f.Close())
+}
+
+func TestVerifyBlock(t *testing.T) {
+	t.Run("valid block", func(t *testing.T) {
+		problems, err := VerifyBlock(context.Background(), newVerifyTestBlock(t))
+		require.NoError(t, err)
+		require.Empty(t, problems)
+	})
+
+	t.Run("dangling series index", func(t *testing.T) {
+		dir := newVerifyTestBlock(t)
+		rewriteProfiles(t, dir, func(ps []*schemav1.Profile) []*schemav1.Profile {
+			ps[len(ps)-1].SeriesIndex = 42
+			return ps
+		})
+
+		problems, err := VerifyBlock(context.Background(), dir)
+		require.NoError(t, err)
+		require.Equal(t, []Problem{
+			{File: "profiles.parquet", Message: "row 8 references series index 42, which does not exist in index.tsdb"},
+		}, problems)
+	})
+
+	t.Run("unresolved stacktrace and unordered timestamps", func(t *testing.T) {
+		dir := newVerifyTestBlock(t)
+		rewriteProfiles(t, dir, func(ps []*schemav1.Profile) []*schemav1.Profile {
+			ps[0].Samples[0].StacktraceID = 1000
+			ps[2].TimeNanos = 0
+			return ps
+		})
+
+		problems, err := VerifyBlock(context.Background(), dir)
+		require.NoError(t, err)
+		require.Equal(t, []Problem{
+			{File: "profiles.parquet", Message: "row 0 references stacktrace ID 1000, which does not exist (2 stacktraces)"},
+			{File: "profiles.parquet", Message: "row 2 of series index 0 has timestamp 0, which is before the previous profile's timestamp 3000000000"},
+		}, problems)
+	})
+
+	t.Run("row count mismatch", func(t *testing.T) {
+		dir := newVerifyTestBlock(t)
+		// drop the last profile
+		rewriteProfiles(t, dir, func(ps []*schemav1.Profile) []*schemav1.Profile {
+			return ps[:len(ps)-1]
+		})
+
+		problems, err := VerifyBlock(context.Background(), dir)
+		require.NoError(t, err)
+		require.Equal(t, []Problem{
+			{File: "meta.json", Message: "expected 9 profiles, profiles.parquet contains 8"},
+			{File: "meta.json", Message: "expected 9 rows, profiles.parquet contains 8"},
+		}, problems)
+	})
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir := newVerifyTestBlock(t)
+	require.NoError(t, VerifyChecksums(dir))
+
+	meta, _, err := block.MetaFromDir(dir)
+	require.NoError(t, err)
+	for _, relPath := range []string{block.IndexFilename, "profiles.parquet"} {
+		require.NotEmpty(t, meta.FileByRelPath(relPath).CRC32C, relPath)
+	}
+
+	// flip a byte in the middle of the profiles
+	path := filepath.Join(dir, "profiles.parquet")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	err = VerifyChecksums(dir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "checksum mismatch of profiles.parquet in block "+meta.ULID.String())
+}
+
+func TestVerifyPageChecksums(t *testing.T) {
+	ctx := context.Background()
+	head := newTestHead(t)
+	head.parquetConfig.PageChecksums = true
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+	}
+	_, err := head.Flush(ctx)
+	require.NoError(t, err)
+	dir := head.localPath
+
+	// the pages written by the flush are read back
+	for _, name := range []string{"profiles", "stacktraces", "locations", "functions", "mappings", "strings"} {
+		require.NoError(t, VerifyPageChecksums(filepath.Join(dir, name+block.ParquetSuffix)), name)
+	}
+	profiles, _ := readFullParquetFile[*schemav1.Profile](t, filepath.Join(dir, "profiles.parquet"))
+	require.Len(t, profiles, 9)
+
+	// flip the last byte of the column chunk of the timestamps, which is in its last data page
+	path := filepath.Join(dir, "profiles.parquet")
+	f, pf, err := openParquetFile(path)
+	require.NoError(t, err)
+	var offset int64 = -1
+	for _, cc := range pf.Metadata().RowGroups[0].Columns {
+		if strings.Join(cc.MetaData.PathInSchema, ".") == "TimeNanos" {
+			offset = cc.MetaData.DataPageOffset + cc.MetaData.TotalCompressedSize - 1
+			if dict := cc.MetaData.DictionaryPageOffset; dict > 0 && dict < cc.MetaData.DataPageOffset {
+				offset = dict + cc.MetaData.TotalCompressedSize - 1
+			}
+		}
+	}
+	require.NoError(t, f.Close())
+	require.GreaterOrEqual(t, offset, int64(0))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[offset] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	err = VerifyPageChecksums(path)
+	var checksumErr *PageChecksumError
+	require.ErrorAs(t, err, &checksumErr)
+	require.ErrorIs(t, err, parquet.ErrCorrupted)
+	require.Equal(t, "TimeNanos", checksumErr.Column)
+	require.Equal(t, 0, checksumErr.RowGroup)
+
+	// reading the profiles fails as well
+	_, err = VerifyBlock(ctx, dir)
+	require.ErrorIs(t, err, parquet.ErrCorrupted)
+}
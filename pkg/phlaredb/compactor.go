@@ -0,0 +1,422 @@
+package phlaredb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+	"github.com/grafana/phlare/pkg/util"
+)
+
+// pathCompactor is the directory of the data path, where blocks are written
+// while they are compacted.
+const pathCompactor = "compactor"
+
+// Compactor merges the local blocks of a PhlareDB into larger blocks, with a
+// leveled strategy: blocks flushed from the head are at level 0 and once
+// enough blocks of a level are available, they are merged into a single block
+// of the next level. The level of a block is recorded in the compaction
+// section of its meta.
+type Compactor struct {
+	logger log.Logger
+	db     *PhlareDB
+
+	// blocks is the number of blocks of a level merged into a block of the
+	// next level.
+	blocks int
+}
+
+func NewCompactor(db *PhlareDB, blocks int) *Compactor {
+	return &Compactor{
+		logger: log.With(db.logger, "component", "compactor"),
+		db:     db,
+		blocks: blocks,
+	}
+}
+
+// Run compacts the blocks at every interval, until ctx is canceled.
+func (c *Compactor) Run(ctx context.Context, interval time.Duration) {
+	// blocks left over by an interrupted compaction are discarded, their
+	// sources are still in place
+	if err := os.RemoveAll(filepath.Join(c.db.cfg.DataPath, pathCompactor)); err != nil {
+		level.Warn(c.logger).Log("msg", "removing blocks of interrupted compactions failed", "err", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := c.Compact(ctx); err != nil && ctx.Err() == nil {
+				level.Error(c.logger).Log("msg", "compaction failed", "err", err)
+			}
+		}
+	}
+}
+
+// Compact runs a single compaction cycle. The blocks of each level are
+// merged in order of their time range by groups of the configured number of
+// blocks, remaining blocks wait for the next cycle. Blocks used by a query
+// are left for the next cycle as well. It returns the metas of the blocks
+// written.
+func (c *Compactor) Compact(ctx context.Context) ([]*block.Meta, error) {
+	metas, err := c.db.BlockMetas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// metas are ordered by their min time
+	byLevel := make(map[int][]*block.Meta)
+	for _, m := range metas {
+		// blocks of heads still being flushed are not loaded yet, their
+		// profiles are queried from the heads
+		if !c.db.blockQuerier.loaded(m.ULID) || c.db.blockQuerier.inUse(m.ULID) {
+			continue
+		}
+		byLevel[m.Compaction.Level] = append(byLevel[m.Compaction.Level], m)
+	}
+	levels := make([]int, 0, len(byLevel))
+	for l := range byLevel {
+		levels = append(levels, l)
+	}
+	sort.Ints(levels)
+
+	var compacted []*block.Meta
+	for _, l := range levels {
+		for group := byLevel[l]; len(group) >= c.blocks; group = group[c.blocks:] {
+			if err := ctx.Err(); err != nil {
+				return compacted, err
+			}
+			meta, err := c.compact(ctx, group[:c.blocks], l+1)
+			if err != nil {
+				return compacted, errors.Wrapf(err, "compacting blocks of level %d", l)
+			}
+			if meta == nil {
+				continue
+			}
+			level.Info(c.logger).Log("msg", "compacted blocks", "block", meta.ULID, "level", l+1, "sources", c.blocks)
+			compacted = append(compacted, meta)
+		}
+	}
+	return compacted, nil
+}
+
+// compact merges the blocks into a new block of the given level. The new
+// block is written outside of the local directory, it replaces the merged
+// blocks while queries are held back by the flush lock, so that queries see
+// either the merged blocks or the new block. No block is written, if a query
+// started to use the merged blocks in the meantime.
+func (c *Compactor) compact(ctx context.Context, metas []*block.Meta, lvl int) (*block.Meta, error) {
+	cfg := c.db.cfg
+	cfg.DataPath = filepath.Join(c.db.cfg.DataPath, pathCompactor)
+	cfg.MaxBlockProfiles = 0
+
+	// the head of the compaction must not report the metrics of the head
+	// ingesting profiles
+	phlarectx := contextWithHeadMetrics(c.db.phlarectx, newHeadMetrics(prometheus.NewRegistry()))
+	h, err := NewHead(phlarectx, cfg, c.db.limiter)
+	if err != nil {
+		return nil, err
+	}
+	h.meta.Compaction = compactionOf(metas, lvl)
+
+	if err := util.RecoverPanic(func() error {
+		return h.ingestBlocks(ctx, c.db.phlarectx, c.db.blockQuerier.bucketReader, metas)
+	})(); err != nil {
+		_ = h.Close()
+		_ = os.RemoveAll(h.headPath)
+		return nil, err
+	}
+	_, err = h.Flush(ctx)
+	// the flush closes the tables, only the loop of the head is left to stop
+	close(h.stopCh)
+	h.wg.Wait()
+	if releaseErr := h.release(); err == nil {
+		err = releaseErr
+	}
+	if err != nil {
+		_ = os.RemoveAll(h.headPath)
+		_ = os.RemoveAll(h.localPath)
+		return nil, err
+	}
+
+	c.db.flushLock.Lock()
+	defer c.db.flushLock.Unlock()
+
+	// queries don't hold the flush lock while reading, a query might have
+	// started to use the blocks since they have been picked
+	for _, m := range metas {
+		if c.db.blockQuerier.inUse(m.ULID) {
+			_ = os.RemoveAll(h.localPath)
+			return nil, nil
+		}
+	}
+
+	if err := fileutil.Rename(h.localPath, filepath.Join(c.db.LocalDataPath(), h.meta.ULID.String())); err != nil {
+		_ = os.RemoveAll(h.localPath)
+		return nil, errors.Wrap(err, "moving compacted block")
+	}
+	for _, m := range metas {
+		if err := os.RemoveAll(filepath.Join(c.db.LocalDataPath(), m.ULID.String())); err != nil {
+			return nil, errors.Wrapf(err, "removing compacted block %s", m.ULID)
+		}
+	}
+	if err := c.db.blockQuerier.Sync(ctx); err != nil {
+		return nil, err
+	}
+	return h.meta, nil
+}
+
+// compactionOf returns the compaction section of the meta of a block of the
+// given level merged from the blocks of metas.
+func compactionOf(metas []*block.Meta, lvl int) tsdb.BlockMetaCompaction {
+	compaction := tsdb.BlockMetaCompaction{Level: lvl}
+	seen := make(map[ulid.ULID]struct{})
+	for _, m := range metas {
+		sources := m.Compaction.Sources
+		if len(sources) == 0 {
+			sources = []ulid.ULID{m.ULID}
+		}
+		for _, s := range sources {
+			if _, ok := seen[s]; ok {
+				continue
+			}
+			seen[s] = struct{}{}
+			compaction.Sources = append(compaction.Sources, s)
+		}
+		compaction.Parents = append(compaction.Parents, tsdb.BlockDesc{ULID: m.ULID, MinTime: int64(m.MinTime), MaxTime: int64(m.MaxTime)})
+	}
+	sort.Slice(compaction.Sources, func(i, j int) bool {
+		return compaction.Sources[i].Compare(compaction.Sources[j]) < 0
+	})
+	return compaction
+}
+
+// compactionSource is the content of a block, or of a part of a block, read
+// entirely into memory to be merged.
+type compactionSource struct {
+	strings     []string
+	mappings    []*profilev1.Mapping
+	functions   []*profilev1.Function
+	locations   []*profilev1.Location
+	stacktraces []*schemav1.Stacktrace
+	profiles    []*schemav1.Profile
+	series      map[uint32]splitSeries
+}
+
+// compactionProfile is a profile of a source, whose references have been
+// rewritten to the symbols of the head.
+type compactionProfile struct {
+	profile *schemav1.Profile
+	lbls    phlaremodel.Labels
+}
+
+// ingestBlocks adds the profiles of the blocks and of their parts to the
+// head. The blocks are read through bucketReader, which holds the blocks in
+// directories named after their ULID. The profiles of all blocks are added
+// in time order, so they pass the out of order checks of the head.
+func (h *Head) ingestBlocks(ctx context.Context, phlarectx context.Context, bucketReader phlareobjstore.BucketReader, metas []*block.Meta) error {
+	var profiles []compactionProfile
+	for _, m := range metas {
+		q := newSingleBlockQuerierFromMeta(phlarectx, bucketReader, m)
+		for _, q := range append([]*singleBlockQuerier{q}, q.parts...) {
+			src, err := readCompactionSource(ctx, q.bucketReader)
+			if err != nil {
+				return errors.Wrapf(err, "reading block %s", q.meta.ULID)
+			}
+			ingested, err := h.ingestCompactionSource(ctx, src)
+			if err != nil {
+				return errors.Wrapf(err, "merging block %s", q.meta.ULID)
+			}
+			profiles = append(profiles, ingested...)
+		}
+	}
+
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].profile.TimeNanos < profiles[j].profile.TimeNanos
+	})
+	for _, p := range profiles {
+		if err := h.profiles.add([]*schemav1.Profile{p.profile}, p.lbls, p.lbls.Get(model.MetricNameLabel)); err != nil {
+			return err
+		}
+		h.totalSamples.Add(uint64(len(p.profile.Samples)))
+		h.updateTimeRange(p.profile.TimeNanos, p.profile.TimeNanos)
+	}
+	h.updateStatsMetrics()
+	return nil
+}
+
+// ingestCompactionSource adds the symbols of src to the head and returns its
+// profiles, whose references are rewritten to the symbols of the head.
+//
+// The symbols of a block reference each other by position. They are given
+// the IDs of pprof, which start at 1, so they are rewritten like the symbols
+// of an ingested profile.
+func (h *Head) ingestCompactionSource(ctx context.Context, src *compactionSource) ([]compactionProfile, error) {
+	for i, m := range src.mappings {
+		m.Id = uint64(i + 1)
+	}
+	for i, f := range src.functions {
+		f.Id = uint64(i + 1)
+	}
+	for i, l := range src.locations {
+		l.Id = uint64(i + 1)
+		if len(src.mappings) > 0 {
+			l.MappingId++
+		} else {
+			l.MappingId = 0
+		}
+		for pos := range l.Line {
+			l.Line[pos].FunctionId++
+		}
+	}
+	for _, s := range src.stacktraces {
+		for pos := range s.LocationIDs {
+			s.LocationIDs[pos]++
+		}
+	}
+
+	rewrites := &rewriter{}
+	if err := h.strings.ingest(ctx, src.strings, rewrites); err != nil {
+		return nil, err
+	}
+	if err := h.mappings.ingest(ctx, src.mappings, rewrites); err != nil {
+		return nil, err
+	}
+	if err := h.functions.ingest(ctx, src.functions, rewrites); err != nil {
+		return nil, err
+	}
+	if err := h.locations.ingest(ctx, src.locations, rewrites); err != nil {
+		return nil, err
+	}
+	if err := h.stacktraces.ingest(ctx, src.stacktraces, rewrites); err != nil {
+		return nil, err
+	}
+
+	var (
+		helper   profilesHelper
+		profiles = make([]compactionProfile, 0, len(src.profiles))
+	)
+	for _, p := range src.profiles {
+		s, ok := src.series[p.SeriesIndex]
+		if !ok {
+			return nil, errors.Errorf("profile %s references series index %d, which does not exist in %s", p.ID, p.SeriesIndex, block.IndexFilename)
+		}
+		p.SeriesFingerprint = s.fp
+		for _, sample := range p.Samples {
+			id, ok := rewrites.stacktraces[int64(sample.StacktraceID)]
+			if !ok {
+				return nil, errors.Errorf("profile %s references stacktrace %d, which does not exist", p.ID, sample.StacktraceID)
+			}
+			sample.StacktraceID = uint64(id)
+			if len(sample.Labels) > 0 {
+				sample.Labels = h.pprofLabelCache.rewriteLabels(rewrites.strings, sample.Labels)
+			}
+		}
+		if err := helper.rewrite(rewrites, p); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, compactionProfile{profile: p, lbls: s.lbls})
+	}
+	return profiles, nil
+}
+
+// readCompactionSource reads the tables and the series of a block.
+func readCompactionSource(ctx context.Context, bucketReader phlareobjstore.BucketReader) (src *compactionSource, err error) {
+	src = &compactionSource{}
+	if src.strings, err = readBlockTable[string, *schemav1.StringPersister](ctx, bucketReader); err != nil {
+		return nil, err
+	}
+	if src.mappings, err = readBlockTable[*profilev1.Mapping, *schemav1.MappingPersister](ctx, bucketReader); err != nil {
+		return nil, err
+	}
+	if src.functions, err = readBlockTable[*profilev1.Function, *schemav1.FunctionPersister](ctx, bucketReader); err != nil {
+		return nil, err
+	}
+	if src.locations, err = readBlockTable[*profilev1.Location, *schemav1.LocationPersister](ctx, bucketReader); err != nil {
+		return nil, err
+	}
+	if src.stacktraces, err = readBlockTable[*schemav1.Stacktrace, *schemav1.StacktracePersister](ctx, bucketReader); err != nil {
+		return nil, err
+	}
+	if src.profiles, err = readBlockTable[*schemav1.Profile, *schemav1.ProfilePersister](ctx, bucketReader); err != nil {
+		return nil, err
+	}
+
+	b, err := readBlockObject(ctx, bucketReader, block.IndexFilename)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := index.NewReader(index.RealByteSlice(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "opening tsdb index")
+	}
+	defer idx.Close()
+	if src.series, err = seriesBySeriesIndex(idx); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+func readBlockTable[T any, P schemav1.Persister[T]](ctx context.Context, bucketReader phlareobjstore.BucketReader) ([]T, error) {
+	var (
+		persister P
+		rw        schemav1.ReadWriter[T, P]
+	)
+	name := persister.Name() + block.ParquetSuffix
+	b, err := readBlockObject(ctx, bucketReader, name)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := rw.ReadParquetFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", name)
+	}
+	return elems, nil
+}
+
+func readBlockObject(ctx context.Context, bucketReader phlareobjstore.BucketReader, name string) ([]byte, error) {
+	r, err := bucketReader.Get(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", name)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", name)
+	}
+	return b, nil
+}
+
+// startCompactor runs the compactor in the background, until the database is
+// closed.
+func (f *PhlareDB) startCompactor() {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.stopCompactor = cancel
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		NewCompactor(f, f.cfg.CompactionBlocks).Run(ctx, f.cfg.CompactionInterval)
+	}()
+}
@@ -0,0 +1,105 @@
+package phlaredb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+func TestCompactor(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// seed 4 blocks of level 0, with 3 profiles each
+	for b := 0; b < 4; b++ {
+		for i := b * 3; i < b*3+3; i++ {
+			require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+		}
+		require.NoError(t, db.Flush(ctx))
+	}
+	metas, err := db.BlockMetas(ctx)
+	require.NoError(t, err)
+	require.Len(t, metas, 4)
+	dirs := lo.Map(metas, func(m *block.Meta, _ int) string {
+		return filepath.Join(db.LocalDataPath(), m.ULID.String())
+	})
+
+	query := func(dirs ...string) map[string]int64 {
+		result, err := Query(ctx, dirs, nil, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		require.NoError(t, err)
+		stacktraces := make(map[string]int64, len(result.Stacktraces))
+		for _, s := range result.Stacktraces {
+			names := lo.Map(s.FunctionIds, func(id int32, _ int) string { return result.FunctionNames[id] })
+			stacktraces[strings.Join(names, ";")] += s.Value
+		}
+		return stacktraces
+	}
+	expected := query(dirs[:3]...)
+
+	compactor := NewCompactor(db, 3)
+
+	// blocks used by a query are not compacted
+	_, release := db.acquireQueriers()
+	compacted, err := compactor.Compact(ctx)
+	require.NoError(t, err)
+	require.Empty(t, compacted)
+	release()
+
+	// the 3 oldest blocks are merged, the last one waits for more blocks
+	compacted, err = compactor.Compact(ctx)
+	require.NoError(t, err)
+	require.Len(t, compacted, 1)
+	meta := compacted[0]
+	require.Equal(t, 1, meta.Compaction.Level)
+	require.Len(t, meta.Compaction.Parents, 3)
+	require.Len(t, meta.Compaction.Sources, 3)
+	require.Equal(t, uint64(9), meta.Stats.NumProfiles)
+	require.Equal(t, uint64(3), meta.Stats.NumSeries)
+	require.Equal(t, metas[0].MinTime, meta.MinTime)
+	require.Equal(t, metas[2].MaxTime, meta.MaxTime)
+
+	for _, dir := range dirs[:3] {
+		_, err := os.Stat(dir)
+		require.True(t, os.IsNotExist(err))
+	}
+	dir := filepath.Join(db.LocalDataPath(), meta.ULID.String())
+	problems, err := VerifyBlock(ctx, dir)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	require.Equal(t, expected, query(dir))
+
+	metas, err = db.BlockMetas(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 0}, lo.Map(metas, func(m *block.Meta, _ int) int { return m.Compaction.Level }))
+
+	// the queriers of the database read the compacted block
+	count, err := db.CountMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: "{}",
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), count.Profiles)
+}
@@ -42,8 +42,12 @@ type deduplicatingSlice[M Models, K comparable, H Helper[M, K], P schemav1.Persi
 	metrics *headMetrics
 	writer  *parquet.GenericWriter[P]
 
-	buffer      *parquet.Buffer
-	rowsFlushed int
+	buffer *parquet.Buffer
+	// rowsFlushed and rowGroupsFlushed count what has been written to the
+	// file, a retried flush only writes the rows added since.
+	rowsFlushed      int
+	rowGroupsFlushed int
+	closed           bool
 }
 
 func (s *deduplicatingSlice[M, K, H, P]) Name() string {
@@ -58,6 +62,58 @@ func (s *deduplicatingSlice[M, K, H, P]) Size() uint64 {
 	return s.size.Load()
 }
 
+// Len returns the number of distinct elements held by the slice, released
+// elements are not counted.
+func (s *deduplicatingSlice[M, K, H, P]) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.lookup)
+}
+
+// elements returns a copy of the slice holding the distinct elements, their
+// position is their ID.
+func (s *deduplicatingSlice[M, K, H, P]) elements() []M {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return copySlice(s.slice)
+}
+
+// restore appends elements, which are expected to be distinct and to
+// reference IDs already known to the head, without rewriting them.
+func (s *deduplicatingSlice[M, K, H, P]) restore(elems []M) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, e := range elems {
+		s.lookup[s.helper.key(e)] = int64(len(s.slice))
+		s.slice = append(s.slice, e)
+		s.metrics.sizeBytes.WithLabelValues(s.Name()).Set(float64(s.size.Add(s.helper.size(e))))
+	}
+}
+
+// release replaces the elements, which are not kept, by empty and forgets
+// their keys. This frees their memory, while the IDs of the other elements
+// stay the same. It returns the number of released elements.
+func (s *deduplicatingSlice[M, K, H, P]) release(keep func(id int64) bool, empty M) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var released int
+	for id, e := range s.slice {
+		k := s.helper.key(e)
+		// elements released before aren't in the lookup anymore
+		if pos, ok := s.lookup[k]; !ok || pos != int64(id) || keep(int64(id)) {
+			continue
+		}
+		delete(s.lookup, k)
+		s.slice[id] = empty
+		s.size.Sub(s.helper.size(e))
+		s.size.Add(s.helper.size(empty))
+		released++
+	}
+	s.metrics.sizeBytes.WithLabelValues(s.Name()).Set(float64(s.size.Load()))
+	return released
+}
+
 func (s *deduplicatingSlice[M, K, H, P]) Init(path string, cfg *ParquetConfig, metrics *headMetrics) error {
 	s.cfg = cfg
 	s.metrics = metrics
@@ -77,6 +133,9 @@ func (s *deduplicatingSlice[M, K, H, P]) Init(path string, cfg *ParquetConfig, m
 }
 
 func (s *deduplicatingSlice[M, K, H, P]) Close() error {
+	if s.closed {
+		return nil
+	}
 	if err := s.writer.Close(); err != nil {
 		return errors.Wrap(err, "closing parquet writer")
 	}
@@ -85,6 +144,15 @@ func (s *deduplicatingSlice[M, K, H, P]) Close() error {
 		return errors.Wrap(err, "closing parquet file")
 	}
 
+	// the file is only complete once closed
+	if s.cfg != nil && s.cfg.PageChecksums {
+		if err := VerifyPageChecksums(s.file.Name()); err != nil {
+			s.metrics.flushFailures.WithLabelValues(flushStageParquet).Inc()
+			return err
+		}
+	}
+
+	s.closed = true
 	return nil
 }
 
@@ -112,6 +180,11 @@ func (s *deduplicatingSlice[M, K, H, P]) maxRowsPerRowGroup() int {
 func (s *deduplicatingSlice[M, K, H, P]) Flush(ctx context.Context) (numRows uint64, numRowGroups uint64, err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	defer func() {
+		if err != nil {
+			s.metrics.flushFailures.WithLabelValues(flushStageParquet).Inc()
+		}
+	}()
 
 	// intialise buffer if not existing
 	if s.buffer == nil {
@@ -122,12 +195,7 @@ func (s *deduplicatingSlice[M, K, H, P]) Flush(ctx context.Context) (numRows uin
 		)
 	}
 
-	var (
-		maxRows = s.maxRowsPerRowGroup()
-
-		rowGroupsFlushed int
-		rowsFlushed      int
-	)
+	maxRows := s.maxRowsPerRowGroup()
 
 	for {
 		// how many rows of the head still in need of flushing
@@ -165,11 +233,10 @@ func (s *deduplicatingSlice[M, K, H, P]) Flush(ctx context.Context) (numRows uin
 		}
 
 		s.rowsFlushed += rowsToFlush
-		rowsFlushed += rowsToFlush
-		rowGroupsFlushed++
+		s.rowGroupsFlushed++
 	}
 
-	return uint64(rowsFlushed), uint64(rowGroupsFlushed), nil
+	return uint64(s.rowsFlushed), uint64(s.rowGroupsFlushed), nil
 }
 
 func (s *deduplicatingSlice[M, K, H, P]) ingest(_ context.Context, elems []M, rewriter *rewriter) error {
@@ -1,6 +1,7 @@
 package phlaredb
 
 import (
+	"encoding/binary"
 	"sync"
 
 	"github.com/prometheus/common/model"
@@ -14,6 +15,7 @@ const (
 	allocObjectTypeName = "alloc_objects"
 	allocSpaceTypeName  = "alloc_space"
 	blockProfileName    = "block"
+	mutexProfileName    = "mutex"
 	contentionsTypeName = "contentions"
 	delayTypeName       = "delay"
 )
@@ -96,6 +98,7 @@ func copySample(s *schemav1.Sample) *schemav1.Sample {
 	return &schemav1.Sample{
 		StacktraceID: s.StacktraceID,
 		Value:        s.Value,
+		Labels:       s.Labels,
 	}
 }
 
@@ -106,22 +109,51 @@ func isDelta(lbs phlaremodel.Labels) bool {
 	case "true":
 		return true
 	}
-	if lbs.Get(model.MetricNameLabel) == memoryProfileName {
+	switch lbs.Get(model.MetricNameLabel) {
+	case memoryProfileName:
 		ty := lbs.Get(phlaremodel.LabelNameType)
 		if ty == allocObjectTypeName || ty == allocSpaceTypeName {
 			return true
 		}
+	case blockProfileName, mutexProfileName:
+		// contentions and delay of Go's block and mutex profiles are cumulative.
+		ty := lbs.Get(phlaremodel.LabelNameType)
+		if ty == contentionsTypeName || ty == delayTypeName {
+			return true
+		}
 	}
 	return false
 }
 
+// deltaSampleKey identifies a sample by its stacktrace and sample labels.
+type deltaSampleKey struct {
+	stacktraceID uint64
+	labels       string
+}
+
+func newDeltaSampleKey(s *schemav1.Sample) deltaSampleKey {
+	k := deltaSampleKey{stacktraceID: s.StacktraceID}
+	if len(s.Labels) == 0 {
+		return k
+	}
+	buf := make([]byte, 0, len(s.Labels)*4*binary.MaxVarintLen64)
+	for _, l := range s.Labels {
+		buf = binary.AppendVarint(buf, l.Key)
+		buf = binary.AppendVarint(buf, l.Str)
+		buf = binary.AppendVarint(buf, l.Num)
+		buf = binary.AppendVarint(buf, l.NumUnit)
+	}
+	k.labels = string(buf)
+	return k
+}
+
 func deltaSamples(highest, new []*schemav1.Sample) ([]*schemav1.Sample, bool) {
-	stacktraces := make(map[uint64]*schemav1.Sample)
+	stacktraces := make(map[deltaSampleKey]*schemav1.Sample)
 	for _, h := range highest {
-		stacktraces[h.StacktraceID] = h
+		stacktraces[newDeltaSampleKey(h)] = h
 	}
 	for _, n := range new {
-		if s, ok := stacktraces[n.StacktraceID]; ok {
+		if s, ok := stacktraces[newDeltaSampleKey(n)]; ok {
 			if s.Value <= n.Value {
 				newMax := n.Value
 				n.Value -= s.Value
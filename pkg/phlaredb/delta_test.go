@@ -60,7 +60,7 @@ func TestComputeDelta(t *testing.T) {
 
 func newProfileSchema(p *profilev1.Profile, name string) ([]*schemav1.Profile, []phlaremodel.Labels) {
 	var (
-		labels, seriesRefs = labelsForProfile(p, &typesv1.LabelPair{Name: model.MetricNameLabel, Value: name})
+		labels, seriesRefs = pprof.LabelsForProfile(p, &typesv1.LabelPair{Name: model.MetricNameLabel, Value: name})
 		ps                 = make([]*schemav1.Profile, len(labels))
 	)
 	for idxType := range labels {
@@ -0,0 +1,136 @@
+package phlaredb
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+
+	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+type blockOnDisk struct {
+	id   ulid.ULID
+	path string
+	size int64
+}
+
+// EnforceDiskBudget deletes the oldest blocks in dir, until all blocks take
+// up no more than maxBytes. Blocks are ordered by their ULID, which is the
+// time they have been created. A maxBytes of 0 or less disables the budget.
+//
+// Only directories with a meta are deleted, so the directory of the open
+// head, which has no meta until it is flushed, is never deleted.
+func EnforceDiskBudget(ctx context.Context, dir string, maxBytes int64) error {
+	if maxBytes <= 0 {
+		return nil
+	}
+	var (
+		logger  = phlarecontext.Logger(ctx)
+		metrics = contextHeadMetrics(ctx)
+	)
+
+	blocks, err := listBlocksOnDisk(dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, b := range blocks {
+		total += b.size
+	}
+
+	for _, b := range blocks {
+		if total <= maxBytes {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(b.path); err != nil {
+			return fmt.Errorf("failed to delete oldest block %s: %w", b.path, err)
+		}
+		total -= b.size
+		metrics.diskBudgetEvictedBlocks.Inc()
+		level.Warn(logger).Log("msg", "blocks exceed the disk budget, deleted oldest block", "path", b.path, "size_bytes", b.size, "max_bytes", maxBytes)
+	}
+	return nil
+}
+
+// listBlocksOnDisk returns the blocks in dir with their size, ordered by ULID.
+func listBlocksOnDisk(dir string) ([]blockOnDisk, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []blockOnDisk
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		id, ok := block.IsBlockDir(path)
+		if !ok {
+			continue
+		}
+		meta, metaSize, err := block.MetaFromDir(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, err := blockSize(path, meta, metaSize)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, blockOnDisk{id: id, path: path, size: size})
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].id.Compare(blocks[j].id) < 0
+	})
+	return blocks, nil
+}
+
+// blockSize returns the size of the files of the meta and of the meta
+// itself. The files in the directory are summed up instead, if the meta lacks
+// the size of a file.
+func blockSize(path string, meta *block.Meta, metaSize int64) (int64, error) {
+	if len(meta.Files) == 0 {
+		return dirSize(path)
+	}
+	size := metaSize
+	for _, f := range meta.Files {
+		if f.SizeBytes == 0 {
+			return dirSize(path)
+		}
+		size += int64(f.SizeBytes)
+	}
+	return size, nil
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
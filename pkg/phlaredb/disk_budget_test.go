@@ -0,0 +1,65 @@
+package phlaredb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/phlare/pkg/pprof/testhelper"
+)
+
+func TestEnforceDiskBudget(t *testing.T) {
+	var (
+		ctx      = testContext(t)
+		dataPath = t.TempDir()
+		localDir = filepath.Join(dataPath, pathLocal)
+	)
+
+	for i := 0; i < 4; i++ {
+		head, err := NewHead(ctx, Config{DataPath: dataPath}, NoLimit)
+		require.NoError(t, err)
+		p := testhelper.NewProfileBuilder(time.Second.Nanoseconds() * int64(i)).CPUProfile()
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+		_, err = head.Flush(ctx)
+		require.NoError(t, err)
+	}
+	// the open head has no meta yet
+	openHead, err := NewHead(ctx, Config{DataPath: dataPath}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, openHead.Close())
+	}()
+
+	blocks, err := listBlocksOnDisk(localDir)
+	require.NoError(t, err)
+	require.Len(t, blocks, 4)
+	var total int64
+	for _, b := range blocks {
+		require.Greater(t, b.size, int64(0))
+		total += b.size
+	}
+
+	// within the budget nothing is deleted
+	require.NoError(t, EnforceDiskBudget(ctx, localDir, total))
+	remaining, err := listBlocksOnDisk(localDir)
+	require.NoError(t, err)
+	require.Equal(t, blocks, remaining)
+
+	// the two oldest blocks are deleted to get within the budget
+	require.NoError(t, EnforceDiskBudget(ctx, localDir, total-blocks[0].size-1))
+	remaining, err = listBlocksOnDisk(localDir)
+	require.NoError(t, err)
+	require.Equal(t, blocks[2:], remaining)
+	require.Equal(t, float64(2), testutil.ToFloat64(contextHeadMetrics(ctx).diskBudgetEvictedBlocks))
+
+	// the directory of the open head is kept
+	require.NoError(t, EnforceDiskBudget(ctx, filepath.Dir(openHead.headPath), 1))
+	_, err = os.Stat(openHead.headPath)
+	require.NoError(t, err)
+	require.Equal(t, float64(2), testutil.ToFloat64(contextHeadMetrics(ctx).diskBudgetEvictedBlocks))
+}
@@ -0,0 +1,50 @@
+package phlaredb
+
+import (
+	"errors"
+)
+
+// The errors returned by the head and the queriers match one of these
+// sentinels using errors.Is, so API layers can map them to status codes.
+var (
+	// ErrInvalidProfile is returned for profiles failing validation on ingestion.
+	ErrInvalidProfile = errors.New("invalid profile")
+	// ErrOutOfOrder is returned for profiles older than the latest profile
+	// accepted for their series.
+	ErrOutOfOrder = errors.New("profile out of order")
+	// ErrInvalidLabelSelector is returned for label selectors failing to parse.
+	ErrInvalidLabelSelector = errors.New("invalid label selector")
+	// ErrLimitExceeded is returned when a tenant or query limit is exceeded.
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrInternal is returned when storing a valid profile fails.
+	ErrInternal = errors.New("internal error")
+)
+
+// sentinelError annotates an error with a sentinel matched by errors.Is,
+// without changing its message nor hiding the errors it wraps.
+type sentinelError struct {
+	sentinel error
+	err      error
+}
+
+func (e *sentinelError) Error() string        { return e.err.Error() }
+func (e *sentinelError) Unwrap() error        { return e.err }
+func (e *sentinelError) Is(target error) bool { return target == e.sentinel }
+
+// withSentinel returns err annotated with sentinel, nil if err is nil.
+func withSentinel(sentinel, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &sentinelError{sentinel: sentinel, err: err}
+}
+
+// internalError annotates err with ErrInternal, unless it already matches a
+// sentinel.
+func internalError(err error) error {
+	var s *sentinelError
+	if err == nil || errors.As(err, &s) {
+		return err
+	}
+	return withSentinel(ErrInternal, err)
+}
@@ -0,0 +1,114 @@
+package phlaredb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	pprofth "github.com/grafana/phlare/pkg/pprof/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+type rejectingLimiter struct{ err error }
+
+func (l rejectingLimiter) AllowProfile(model.Fingerprint, phlaremodel.Labels, int64) error {
+	return l.err
+}
+
+func (l rejectingLimiter) CheckProfile(model.Fingerprint, phlaremodel.Labels, int64) error {
+	return l.err
+}
+
+func (l rejectingLimiter) Stop() {}
+
+func TestErrorSentinels(t *testing.T) {
+	ctx := testContext(t)
+	newProfile := func(ts int) *pprofth.ProfileBuilder {
+		p := pprofth.NewProfileBuilder(int64(time.Duration(ts)*time.Second)).CPUProfile().WithLabels("job", "foo")
+		p.ForStacktraceString("func1").AddSamples(1)
+		return p
+	}
+
+	t.Run("out of order", func(t *testing.T) {
+		head := newTestHead(t)
+		p := newProfile(10)
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+		p = newProfile(5)
+		err := head.Ingest(ctx, p.Profile, p.UUID, p.Labels...)
+		require.ErrorIs(t, err, ErrOutOfOrder)
+		require.NotErrorIs(t, err, ErrInternal)
+		// the reason of the validation error is kept
+		require.Equal(t, validation.OutOfOrder, validation.ReasonOf(err))
+	})
+
+	t.Run("out of order across heads", func(t *testing.T) {
+		orderErr := validation.NewErrorf(validation.OutOfOrder, "profile out of order")
+		head, err := NewHead(ctx, Config{DataPath: t.TempDir()}, rejectingLimiter{err: orderErr})
+		require.NoError(t, err)
+		p := newProfile(10)
+		err = head.Ingest(ctx, p.Profile, p.UUID, p.Labels...)
+		require.ErrorIs(t, err, ErrOutOfOrder)
+		require.NotErrorIs(t, err, ErrLimitExceeded)
+		require.Equal(t, validation.OutOfOrder, validation.ReasonOf(err))
+	})
+
+	t.Run("limit exceeded", func(t *testing.T) {
+		limitErr := validation.NewErrorf(validation.SeriesLimit, validation.SeriesLimitErrorMsg, 1, 1)
+		head, err := NewHead(ctx, Config{DataPath: t.TempDir()}, rejectingLimiter{err: limitErr})
+		require.NoError(t, err)
+		p := newProfile(10)
+		err = head.Ingest(ctx, p.Profile, p.UUID, p.Labels...)
+		require.ErrorIs(t, err, ErrLimitExceeded)
+		require.EqualError(t, err, limitErr.Error())
+		require.Equal(t, validation.SeriesLimit, validation.ReasonOf(err))
+
+		require.ErrorIs(t, ErrTooManyProfiles, ErrLimitExceeded)
+		require.ErrorIs(t, ErrQueryMemoryLimitExceeded, ErrLimitExceeded)
+	})
+
+	t.Run("invalid label selector", func(t *testing.T) {
+		db, err := New(ctx, Config{
+			DataPath:         t.TempDir(),
+			MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+		}, NoLimit)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, db.Close())
+		}()
+		p := newProfile(10)
+		require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+		require.NoError(t, db.Flush(ctx))
+		p = newProfile(20)
+		require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+		require.NoError(t, db.Head().profiles.cutRowGroup())
+
+		queriers := db.Queriers()
+		require.Len(t, queriers, 3, "block, head on disk and head in memory")
+		for _, q := range queriers {
+			_, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{job=`,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+			})
+			require.ErrorIs(t, err, ErrInvalidLabelSelector)
+			require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+		}
+	})
+
+	t.Run("internal", func(t *testing.T) {
+		err := internalError(errors.New("disk full"))
+		require.ErrorIs(t, err, ErrInternal)
+		require.EqualError(t, err, "disk full")
+
+		// errors matching a sentinel are not internal
+		err = internalError(withSentinel(ErrOutOfOrder, errors.New("out of order")))
+		require.ErrorIs(t, err, ErrOutOfOrder)
+		require.NotErrorIs(t, err, ErrInternal)
+	})
+}
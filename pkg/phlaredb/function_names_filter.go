@@ -0,0 +1,104 @@
+package phlaredb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/google/pprof/profile"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+)
+
+// RedactedFunctionName replaces the function names filtered from query results.
+const RedactedFunctionName = "<redacted>"
+
+// functionNamesFilter redacts function names from query results. A function
+// name is redacted if it matches any deny pattern, or if allow patterns are
+// set and it matches none of them. Patterns match the whole function name.
+type functionNamesFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// newFunctionNamesFilter compiles the patterns, it returns nil if no pattern is set.
+func newFunctionNamesFilter(allow, deny []string) (*functionNamesFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	var (
+		f   = &functionNamesFilter{}
+		err error
+	)
+	if f.allow, err = compileAnchored(allow); err != nil {
+		return nil, fmt.Errorf("invalid allowed function names pattern: %w", err)
+	}
+	if f.deny, err = compileAnchored(deny); err != nil {
+		return nil, fmt.Errorf("invalid denied function names pattern: %w", err)
+	}
+	return f, nil
+}
+
+func compileAnchored(patterns []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+func (f *functionNamesFilter) redacted(name string) bool {
+	for _, re := range f.deny {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	if len(f.allow) == 0 {
+		return false
+	}
+	for _, re := range f.allow {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// redactStacktraces replaces the filtered function names of the result, the
+// stacktraces and their values are left unchanged.
+func (f *functionNamesFilter) redactStacktraces(r *ingestv1.MergeProfilesStacktracesResult) {
+	if f == nil || r == nil {
+		return
+	}
+	for i, name := range r.FunctionNames {
+		if f.redacted(name) {
+			r.FunctionNames[i] = RedactedFunctionName
+		}
+	}
+}
+
+// redactProfile replaces the filtered function names of the profile.
+func (f *functionNamesFilter) redactProfile(p *profile.Profile) {
+	if f == nil || p == nil {
+		return
+	}
+	for _, fn := range p.Function {
+		if f.redacted(fn.Name) || f.redacted(fn.SystemName) {
+			fn.Name = RedactedFunctionName
+			fn.SystemName = RedactedFunctionName
+		}
+	}
+}
+
+func contextWithFunctionNamesFilter(ctx context.Context, f *functionNamesFilter) context.Context {
+	return context.WithValue(ctx, functionNamesFilterContextKey, f)
+}
+
+func contextFunctionNamesFilter(ctx context.Context) *functionNamesFilter {
+	f, _ := ctx.Value(functionNamesFilterContextKey).(*functionNamesFilter)
+	return f
+}
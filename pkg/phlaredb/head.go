@@ -3,6 +3,8 @@ package phlaredb
 import (
 	"context"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -14,10 +16,10 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/gogo/status"
 	"github.com/google/pprof/profile"
 	"github.com/google/uuid"
 	"github.com/grafana/dskit/multierror"
+	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
@@ -25,8 +27,8 @@ import (
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/tsdb/fileutil"
 	"github.com/samber/lo"
+	"github.com/segmentio/parquet-go"
 	"go.uber.org/atomic"
-	"google.golang.org/grpc/codes"
 
 	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
@@ -36,7 +38,9 @@ import (
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb/block"
 	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/phlare/pkg/pprof"
 	"github.com/grafana/phlare/pkg/slices"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 func copySlice[T any](in []T) []T {
@@ -118,34 +122,63 @@ type Table interface {
 }
 
 type Head struct {
-	logger  log.Logger
-	metrics *headMetrics
-	stopCh  chan struct{}
-	wg      sync.WaitGroup
+	logger   log.Logger
+	metrics  *headMetrics
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 
 	headPath  string // path while block is actively appended to
 	localPath string // path once block has been cut
+	tempPath  string // path of the temporary row groups, if outside of the head path
+
+	// flushedFiles are the files of the tables written by a flush, a retried
+	// flush doesn't write the tables again.
+	flushedFiles []block.File
+	// written is set once the head has been written to blocks, Flush then
+	// returns the blocks written.
+	written       bool
+	writtenBlocks []FlushedBlock
 
 	flushCh chan struct{} // this channel is closed once the Head should be flushed, should be used externally
 
 	flushForcedTimer *time.Timer // this timer will phlare after the maximum
-
-	metaLock sync.RWMutex
-	meta     *block.Meta
-
-	parquetConfig   *ParquetConfig
-	strings         deduplicatingSlice[string, string, *stringsHelper, *schemav1.StringPersister]
-	mappings        deduplicatingSlice[*profilev1.Mapping, mappingsKey, *mappingsHelper, *schemav1.MappingPersister]
-	functions       deduplicatingSlice[*profilev1.Function, functionsKey, *functionsHelper, *schemav1.FunctionPersister]
-	locations       deduplicatingSlice[*profilev1.Location, locationsKey, *locationsHelper, *schemav1.LocationPersister]
-	stacktraces     deduplicatingSlice[*schemav1.Stacktrace, stacktracesKey, *stacktracesHelper, *schemav1.StacktracePersister] // a stacktrace is a slice of location ids
-	profiles        *profileStore
-	totalSamples    *atomic.Uint64
-	tables          []Table
-	delta           *deltaProfiles
+	maxProfileAge    time.Duration
+	maxStackDepth    int
+	maxBlockProfiles uint64
+	// timestampResolution is the resolution the timestamps of the ingested profiles are truncated to.
+	timestampResolution time.Duration
+
+	metaLock     sync.RWMutex
+	meta         *block.Meta
+	minTimeNanos int64 // guarded by metaLock
+	maxTimeNanos int64 // guarded by metaLock
+
+	parquetConfig *ParquetConfig
+	strings       deduplicatingSlice[string, string, *stringsHelper, *schemav1.StringPersister]
+	mappings      deduplicatingSlice[*profilev1.Mapping, mappingsKey, *mappingsHelper, *schemav1.MappingPersister]
+	functions     deduplicatingSlice[*profilev1.Function, functionsKey, *functionsHelper, *schemav1.FunctionPersister]
+	locations     deduplicatingSlice[*profilev1.Location, locationsKey, *locationsHelper, *schemav1.LocationPersister]
+	stacktraces   deduplicatingSlice[*schemav1.Stacktrace, stacktracesKey, *stacktracesHelper, *schemav1.StacktracePersister] // a stacktrace is a slice of location ids
+	profiles      *profileStore
+	totalSamples  *atomic.Uint64
+	generation    atomic.Uint64 // incremented on each ingest, it invalidates the cached merge results of the head
+	ingestLock    sync.RWMutex  // held for reading while ingesting, Truncate and cut hold it for writing
+	next          *Head         // the head replacing the head once it is cut, guarded by ingestLock
+	tables        []Table
+	delta         *deltaProfiles
+	reservoirs    *seriesReservoirs // samples the profiles of each series, nil if disabled
+
+	// queriesLock guards queries and flushed: the row groups of a flushed head
+	// are released by the last query still reading them.
+	queriesLock     sync.Mutex
+	queries         int
+	flushed         bool
 	pprofLabelCache labelCache
 
-	limiter TenantLimiter
+	limiter     TenantLimiter
+	idGenerator IDGenerator
+	encryption  *blockEncryption
 }
 
 const (
@@ -164,13 +197,27 @@ func NewHead(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*Hea
 		stopCh: make(chan struct{}),
 
 		meta:         block.NewMeta(),
+		minTimeNanos: math.MaxInt64,
 		totalSamples: atomic.NewUint64(0),
 
 		flushCh:          make(chan struct{}),
 		flushForcedTimer: time.NewTimer(cfg.MaxBlockDuration),
+		maxProfileAge:    cfg.MaxProfileAge,
+		maxStackDepth:    cfg.MaxStackDepth,
+		maxBlockProfiles: cfg.MaxBlockProfiles,
+
+		timestampResolution: cfg.TimestampResolution,
 
 		parquetConfig: &parquetConfig,
 		limiter:       limiter,
+		idGenerator:   cfg.IDGenerator,
+		encryption:    contextBlockEncryption(phlarectx),
+	}
+	if h.idGenerator == nil {
+		h.idGenerator = NewULIDGenerator()
+	}
+	for k, v := range cfg.BlockLabels {
+		h.meta.Labels[k] = v
 	}
 	h.headPath = filepath.Join(cfg.DataPath, pathHead, h.meta.ULID.String())
 	h.localPath = filepath.Join(cfg.DataPath, pathLocal, h.meta.ULID.String())
@@ -180,6 +227,45 @@ func NewHead(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*Hea
 	}
 
 	h.parquetConfig.MaxRowGroupBytes = cfg.RowGroupTargetSize
+	if cfg.MaxBufferBytes > 0 {
+		h.parquetConfig.MaxBufferBytes = cfg.MaxBufferBytes
+	}
+	if cfg.MaxDictionaryEntries > 0 {
+		h.parquetConfig.MaxDictionaryEntries = cfg.MaxDictionaryEntries
+	}
+	if cfg.RowGroupTargetCompressedSize > 0 {
+		h.parquetConfig.TargetRowGroupCompressedBytes = cfg.RowGroupTargetCompressedSize
+	}
+	if cfg.PageChecksums {
+		h.parquetConfig.PageChecksums = true
+	}
+	if len(cfg.BloomFilterColumns) > 0 {
+		schema := (&schemav1.ProfilePersister{}).Schema()
+		for _, c := range cfg.BloomFilterColumns {
+			if _, ok := schema.Lookup(strings.Split(c, ".")...); !ok {
+				return nil, fmt.Errorf("invalid bloom filter column %q, no such column in profiles.parquet", c)
+			}
+		}
+		h.parquetConfig.BloomFilterColumns = cfg.BloomFilterColumns
+	}
+	if cfg.FlushConcurrency > 0 {
+		h.parquetConfig.FlushConcurrency = cfg.FlushConcurrency
+	}
+	switch cfg.SortOrder {
+	case "":
+	case SortOrderSeries:
+		h.parquetConfig.SortOrder = SeriesThenTime
+	case SortOrderTime:
+		h.parquetConfig.SortOrder = TimeThenSeries
+	default:
+		return nil, fmt.Errorf("invalid sort order %q, expected %q or %q", cfg.SortOrder, SortOrderSeries, SortOrderTime)
+	}
+
+	switch cfg.DuplicateProfiles {
+	case "", DuplicateProfilesDrop, DuplicateProfilesUpsert:
+	default:
+		return nil, fmt.Errorf("invalid duplicate profiles action %q, expected %q or %q", cfg.DuplicateProfiles, DuplicateProfilesDrop, DuplicateProfilesUpsert)
+	}
 
 	// ensure folder is writable
 	err := os.MkdirAll(h.headPath, defaultFolderMode)
@@ -187,8 +273,21 @@ func NewHead(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*Hea
 		return nil, err
 	}
 
+	if cfg.TempDir != "" {
+		h.tempPath = filepath.Join(cfg.TempDir, h.meta.ULID.String())
+		if err := os.MkdirAll(h.tempPath, defaultFolderMode); err != nil {
+			return nil, err
+		}
+	}
+
 	// create profile store
 	h.profiles = newProfileStore(phlarectx)
+	h.profiles.tempPath = h.tempPath
+	h.profiles.symbolsSize = h.symbolsMemorySize
+	h.profiles.dictionaryEntries = h.dictionaryEntries
+	h.profiles.outOfOrderWindow = cfg.OutOfOrderWindow
+	h.profiles.duplicateProfiles = cfg.DuplicateProfiles
+	h.profiles.cfgPerProfileType = cfg.ParquetPerProfileType
 
 	h.tables = []Table{
 		&h.strings,
@@ -205,6 +304,7 @@ func NewHead(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*Hea
 	}
 
 	h.delta = newDeltaProfiles()
+	h.reservoirs = newSeriesReservoirs(cfg.SeriesReservoirSize, cfg.DuplicateProfiles, h.metrics)
 
 	h.pprofLabelCache.init()
 
@@ -215,7 +315,8 @@ func NewHead(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*Hea
 }
 
 func (h *Head) MemorySize() uint64 {
-	var size uint64
+	// the profiles sampled by the reservoirs are held in memory until the flush
+	size := h.reservoirs.sizeBytes()
 	// TODO: Estimate size of TSDB index
 	for _, t := range h.tables {
 		size += t.MemorySize()
@@ -224,8 +325,24 @@ func (h *Head) MemorySize() uint64 {
 	return size
 }
 
+// dictionaryEntries returns the number of distinct functions and stacktraces of the head.
+func (h *Head) dictionaryEntries() (functions, stacktraces int) {
+	return h.functions.Len(), h.stacktraces.Len()
+}
+
+// symbolsMemorySize estimates the memory held by the symbol tables, which
+// are kept in memory until the head is flushed.
+func (h *Head) symbolsMemorySize() uint64 {
+	return h.strings.MemorySize() +
+		h.mappings.MemorySize() +
+		h.functions.MemorySize() +
+		h.locations.MemorySize() +
+		h.stacktraces.MemorySize() +
+		h.pprofLabelCache.size.Load()
+}
+
 func (h *Head) Size() uint64 {
-	var size uint64
+	size := h.reservoirs.sizeBytes()
 	// TODO: Estimate size of TSDB index
 	for _, t := range h.tables {
 		size += t.Size()
@@ -237,7 +354,11 @@ func (h *Head) Size() uint64 {
 func (h *Head) loop() {
 	defer h.wg.Done()
 
-	tick := time.NewTicker(5 * time.Second)
+	interval := 5 * time.Second
+	if h.maxProfileAge > 0 && h.maxProfileAge < interval {
+		interval = h.maxProfileAge
+	}
+	tick := time.NewTicker(interval)
 	defer func() {
 		tick.Stop()
 		h.flushForcedTimer.Stop()
@@ -259,6 +380,15 @@ func (h *Head) loop() {
 				close(h.flushCh)
 				return
 			}
+			if age, exceeded := h.profileAgeExceeded(time.Now()); exceeded {
+				level.Debug(h.logger).Log(
+					"msg", "max profile age reached, flush to disk",
+					"max_profile_age", h.maxProfileAge,
+					"oldest_profile_age", age,
+				)
+				close(h.flushCh)
+				return
+			}
 		case <-h.stopCh:
 			return
 		}
@@ -313,56 +443,476 @@ func (h *Head) convertSamples(ctx context.Context, r *rewriter, in []*profilev1.
 }
 
 func (h *Head) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, externalLabels ...*typesv1.LabelPair) error {
-	labels, seriesFingerprints := labelsForProfile(p, externalLabels...)
+	h.ingestLock.RLock()
+	defer h.ingestLock.RUnlock()
+	if h.next != nil {
+		return h.next.Ingest(ctx, p, id, externalLabels...)
+	}
 
-	for i, fp := range seriesFingerprints {
-		if err := h.limiter.AllowProfile(fp, labels[i], p.TimeNanos); err != nil {
-			return err
-		}
+	// invalid references would otherwise corrupt the symbols of the head
+	if err := validateProfile(p); err != nil {
+		return withSentinel(ErrInvalidProfile, err)
+	}
+	externalLabels, err := withMetricName(p, externalLabels)
+	if err != nil {
+		return err
+	}
+	labels, seriesFingerprints := pprof.LabelsForProfile(p, externalLabels...)
+
+	if err := h.allowProfile(labels, seriesFingerprints, h.truncatedTimestamp(p.TimeNanos)); err != nil {
+		return err
 	}
 
-	metricName := phlaremodel.Labels(externalLabels).Get(model.MetricNameLabel)
+	p = h.ingestedProfile(p)
 
 	// create a rewriter state
 	rewrites := &rewriter{}
 
 	if err := h.strings.ingest(ctx, p.StringTable, rewrites); err != nil {
+		return internalError(err)
+	}
+
+	stored, sampled, err := h.ingestProfile(ctx, p, id, labels, seriesFingerprints, phlaremodel.Labels(externalLabels).Get(model.MetricNameLabel), rewrites)
+	if err != nil {
+		return internalError(err)
+	}
+	for _, err := range h.storeProfiles(stored) {
+		if err != nil {
+			return internalError(err)
+		}
+	}
+	if len(stored) == 0 && !sampled {
+		return nil
+	}
+
+	h.updateTimeRange(p.TimeNanos, p.TimeNanos)
+	h.updateStatsMetrics()
+	return nil
+}
+
+// ValidateIngest checks whether Ingest would accept the profile, without
+// ingesting it. The profile is validated, its profile types are derived and
+// the limits and the ordering of its series are checked like on ingestion,
+// but neither the profile nor the head are modified.
+func (h *Head) ValidateIngest(ctx context.Context, p *profilev1.Profile, externalLabels ...*typesv1.LabelPair) error {
+	h.ingestLock.RLock()
+	defer h.ingestLock.RUnlock()
+	if h.next != nil {
+		return h.next.ValidateIngest(ctx, p, externalLabels...)
+	}
+
+	if err := validateProfile(p); err != nil {
+		return withSentinel(ErrInvalidProfile, err)
+	}
+	externalLabels, err := withMetricName(p, externalLabels)
+	if err != nil {
 		return err
 	}
+	labels, seriesFingerprints := pprof.LabelsForProfile(p, externalLabels...)
+	return h.checkProfile(labels, seriesFingerprints, h.truncatedTimestamp(p.TimeNanos))
+}
 
-	if err := h.mappings.ingest(ctx, p.Mapping, rewrites); err != nil {
+// withMetricName returns the external labels with the metric name inferred
+// from the sample types of the profile, if the labels have no metric name and
+// the profile type can be told from the sample types.
+func withMetricName(p *profilev1.Profile, externalLabels []*typesv1.LabelPair) ([]*typesv1.LabelPair, error) {
+	if phlaremodel.Labels(externalLabels).Get(model.MetricNameLabel) != "" {
+		return externalLabels, nil
+	}
+	metricName, err := pprof.InferMetricName(p)
+	if err != nil {
+		return nil, withSentinel(ErrInvalidProfile, err)
+	}
+	if metricName == "" {
+		return externalLabels, nil
+	}
+	lbls := make(phlaremodel.Labels, 0, len(externalLabels)+1)
+	for _, l := range externalLabels {
+		if l.Name != model.MetricNameLabel {
+			lbls = append(lbls, l)
+		}
+	}
+	lbls = append(lbls, &typesv1.LabelPair{Name: model.MetricNameLabel, Value: metricName})
+	sort.Sort(lbls)
+	return lbls, nil
+}
+
+// allowProfile checks the tenant limits and the ordering of the profile for each of its series.
+func (h *Head) allowProfile(labels []phlaremodel.Labels, seriesFingerprints []model.Fingerprint, tsNano int64) error {
+	for i, fp := range seriesFingerprints {
+		if err := h.limiter.AllowProfile(fp, labels[i], tsNano); err != nil {
+			return limiterError(err)
+		}
+		if err := h.profiles.index.allowProfile(fp, labels[i], tsNano, h.profiles.outOfOrderWindow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limiterError annotates an error of the limiter with the sentinel of its reason.
+func limiterError(err error) error {
+	if validation.ReasonOf(err) == validation.OutOfOrder {
+		return withSentinel(ErrOutOfOrder, err)
+	}
+	return withSentinel(ErrLimitExceeded, err)
+}
+
+// checkProfile checks the profile like allowProfile, without recording its
+// series as active or the profile as out of order.
+func (h *Head) checkProfile(labels []phlaremodel.Labels, seriesFingerprints []model.Fingerprint, tsNano int64) error {
+	for i, fp := range seriesFingerprints {
+		if err := h.limiter.CheckProfile(fp, labels[i], tsNano); err != nil {
+			return limiterError(err)
+		}
+		if err := h.profiles.index.checkProfile(fp, labels[i], tsNano, h.profiles.outOfOrderWindow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IngestInput is a single profile to be ingested by IngestBatch.
+type IngestInput struct {
+	Profile        *profilev1.Profile
+	ID             uuid.UUID
+	ExternalLabels []*typesv1.LabelPair
+}
+
+// IngestBatch ingests multiple profiles at once. The strings of all profiles
+// are interned together, the profiles are appended to the profile store at
+// once and the head statistics are only updated once, which is cheaper than
+// calling Ingest for each profile.
+//
+// A profile failing validation or ingestion doesn't prevent the others from
+// being ingested, the returned multierror contains an error for each profile
+// that failed, referencing its index in profiles.
+func (h *Head) IngestBatch(ctx context.Context, profiles []IngestInput) error {
+	results, err := h.IngestBatchResults(ctx, profiles)
+	if err != nil {
 		return err
 	}
+	errs := multierror.New()
+	for idx, err := range results {
+		if err != nil {
+			errs.Add(fmt.Errorf("profile %d: %w", idx, err))
+		}
+	}
+	return errs.Err()
+}
+
+// IngestBatchResults ingests the profiles like IngestBatch. It returns the
+// error of each profile at the index of the profile, nil if the profile was
+// ingested. err is only returned if the whole batch failed.
+func (h *Head) IngestBatchResults(ctx context.Context, profiles []IngestInput) (results []error, err error) {
+	type accepted struct {
+		idx                int
+		labels             []phlaremodel.Labels
+		seriesFingerprints []model.Fingerprint
+		metricName         string
+		stringsOffset      int
+		profile            *profilev1.Profile
+	}
+
+	h.ingestLock.RLock()
+	defer h.ingestLock.RUnlock()
+	if h.next != nil {
+		return h.next.IngestBatchResults(ctx, profiles)
+	}
+
+	var (
+		inputs   = make([]accepted, 0, len(profiles))
+		symbols  []string
+		minTime  int64 = math.MaxInt64
+		maxTime  int64 = math.MinInt64
+		ingested bool
+	)
+
+	results = make([]error, len(profiles))
+
+	// validate all profiles first, as invalid references would otherwise
+	// corrupt the symbols shared by the whole batch.
+	for idx, in := range profiles {
+		if err := validateProfile(in.Profile); err != nil {
+			results[idx] = withSentinel(ErrInvalidProfile, err)
+			continue
+		}
+		externalLabels, err := withMetricName(in.Profile, in.ExternalLabels)
+		if err != nil {
+			results[idx] = err
+			continue
+		}
+		labels, seriesFingerprints := pprof.LabelsForProfile(in.Profile, externalLabels...)
+		if err := h.allowProfile(labels, seriesFingerprints, h.truncatedTimestamp(in.Profile.TimeNanos)); err != nil {
+			results[idx] = err
+			continue
+		}
+		p := h.ingestedProfile(in.Profile)
+		inputs = append(inputs, accepted{
+			idx:                idx,
+			labels:             labels,
+			seriesFingerprints: seriesFingerprints,
+			metricName:         phlaremodel.Labels(externalLabels).Get(model.MetricNameLabel),
+			stringsOffset:      len(symbols),
+			profile:            p,
+		})
+		symbols = append(symbols, p.StringTable...)
+	}
+
+	// intern the strings of all profiles in one go
+	stringRewrites := &rewriter{}
+	if err := h.strings.ingest(ctx, symbols, stringRewrites); err != nil {
+		return nil, internalError(err)
+	}
+
+	var (
+		stored      []seriesProfile
+		storedInput []int // index of the input of each stored profile
+		sampled     = make([]bool, len(profiles))
+	)
+	for _, in := range inputs {
+		p := in.profile
+		rewrites := &rewriter{
+			strings: stringRewrites.strings[in.stringsOffset : in.stringsOffset+len(p.StringTable)],
+		}
+		inputStored, inputSampled, err := h.ingestProfile(ctx, p, profiles[in.idx].ID, in.labels, in.seriesFingerprints, in.metricName, rewrites)
+		if err != nil {
+			results[in.idx] = internalError(err)
+			continue
+		}
+		sampled[in.idx] = inputSampled
+		stored = append(stored, inputStored...)
+		for range inputStored {
+			storedInput = append(storedInput, in.idx)
+		}
+	}
+
+	// append the profiles of all inputs at once
+	hasStored := make([]bool, len(profiles))
+	for i, err := range h.storeProfiles(stored) {
+		idx := storedInput[i]
+		if err != nil && results[idx] == nil {
+			results[idx] = internalError(err)
+		}
+		hasStored[idx] = true
+	}
+
+	for _, in := range inputs {
+		if results[in.idx] != nil || !hasStored[in.idx] && !sampled[in.idx] {
+			continue
+		}
+		p := in.profile
+		ingested = true
+		if p.TimeNanos < minTime {
+			minTime = p.TimeNanos
+		}
+		if p.TimeNanos > maxTime {
+			maxTime = p.TimeNanos
+		}
+	}
+
+	if ingested {
+		h.updateTimeRange(minTime, maxTime)
+		h.updateStatsMetrics()
+	}
+
+	return results, nil
+}
+
+// TruncatedFrameName is the name of the frame replacing the root-most frames
+// of stacktraces deeper than the max stack depth.
+const TruncatedFrameName = "<truncated>"
+
+// truncateStacktraces keeps the leaf-most frames of the stacktraces deeper
+// than the max stack depth and replaces the others by a single frame named
+// TruncatedFrameName. The slices of the profile are shared with the profile
+// of the caller, they are copied before they are modified.
+func (h *Head) truncateStacktraces(p *profilev1.Profile) {
+	if h.maxStackDepth <= 0 {
+		return
+	}
+	var truncatedLocationID uint64
+	for i, s := range p.Sample {
+		if len(s.LocationId) <= h.maxStackDepth {
+			continue
+		}
+		if truncatedLocationID == 0 {
+			truncatedLocationID = addTruncatedLocation(p)
+			p.Sample = copySlice(p.Sample)
+		}
+		// location ids are ordered from leaf to root
+		p.Sample[i] = &profilev1.Sample{
+			LocationId: append(s.LocationId[:h.maxStackDepth:h.maxStackDepth], truncatedLocationID),
+			Value:      s.Value,
+			Label:      s.Label,
+		}
+		h.metrics.truncatedStacktraces.Inc()
+	}
+}
+
+// ingestedProfile returns the profile ingested for the profile p of the
+// caller, with its timestamp and stacktraces truncated. p is left untouched,
+// the returned profile is a shallow copy of it.
+func (h *Head) ingestedProfile(p *profilev1.Profile) *profilev1.Profile {
+	ingested := &profilev1.Profile{
+		SampleType:        p.SampleType,
+		Sample:            p.Sample,
+		Mapping:           p.Mapping,
+		Location:          p.Location,
+		Function:          p.Function,
+		StringTable:       p.StringTable,
+		DropFrames:        p.DropFrames,
+		KeepFrames:        p.KeepFrames,
+		TimeNanos:         h.truncatedTimestamp(p.TimeNanos),
+		DurationNanos:     p.DurationNanos,
+		PeriodType:        p.PeriodType,
+		Period:            p.Period,
+		Comment:           p.Comment,
+		DefaultSampleType: p.DefaultSampleType,
+	}
+	h.truncateStacktraces(ingested)
+	return ingested
+}
+
+// truncatedTimestamp floors the timestamp to the timestamp resolution, before
+// the profile is checked and stored.
+func (h *Head) truncatedTimestamp(tsNano int64) int64 {
+	if h.timestampResolution <= 0 {
+		return tsNano
+	}
+	return tsNano - tsNano%int64(h.timestampResolution)
+}
+
+// addTruncatedLocation adds a location with a single function named
+// TruncatedFrameName to p and returns its id.
+func addTruncatedLocation(p *profilev1.Profile) uint64 {
+	var functionID, locationID uint64
+	for _, f := range p.Function {
+		if f.Id > functionID {
+			functionID = f.Id
+		}
+	}
+	for _, l := range p.Location {
+		if l.Id > locationID {
+			locationID = l.Id
+		}
+	}
+	functionID++
+	locationID++
+
+	// the full slice expressions make append copy the slices, instead of
+	// writing to their spare capacity
+	p.StringTable = append(p.StringTable[:len(p.StringTable):len(p.StringTable)], TruncatedFrameName)
+	p.Function = append(p.Function[:len(p.Function):len(p.Function)], &profilev1.Function{
+		Id:   functionID,
+		Name: int64(len(p.StringTable) - 1),
+	})
+	p.Location = append(p.Location[:len(p.Location):len(p.Location)], &profilev1.Location{
+		Id:   locationID,
+		Line: []*profilev1.Line{{FunctionId: functionID}},
+	})
+	return locationID
+}
+
+// validateProfile ensures all references within the profile can be resolved.
+func validateProfile(p *profilev1.Profile) error {
+	if p == nil {
+		return errors.New("profile is nil")
+	}
+
+	validString := func(idx int64) bool {
+		return idx >= 0 && idx < int64(len(p.StringTable))
+	}
+	mappings := make(map[uint64]struct{}, len(p.Mapping))
+	for _, m := range p.Mapping {
+		if !validString(m.Filename) || !validString(m.BuildId) {
+			return fmt.Errorf("mapping %d references a string out of range", m.Id)
+		}
+		mappings[m.Id] = struct{}{}
+	}
+	functions := make(map[uint64]struct{}, len(p.Function))
+	for _, f := range p.Function {
+		if !validString(f.Name) || !validString(f.SystemName) || !validString(f.Filename) {
+			return fmt.Errorf("function %d references a string out of range", f.Id)
+		}
+		functions[f.Id] = struct{}{}
+	}
+	locations := make(map[uint64]struct{}, len(p.Location))
+	for _, l := range p.Location {
+		if _, ok := mappings[l.MappingId]; l.MappingId != 0 && !ok {
+			return fmt.Errorf("location %d references unknown mapping %d", l.Id, l.MappingId)
+		}
+		for _, line := range l.Line {
+			if _, ok := functions[line.FunctionId]; !ok {
+				return fmt.Errorf("location %d references unknown function %d", l.Id, line.FunctionId)
+			}
+		}
+		locations[l.Id] = struct{}{}
+	}
+	for idx, s := range p.Sample {
+		if len(s.Value) != len(p.Sample[0].Value) {
+			return fmt.Errorf("sample %d has %d values, expected %d", idx, len(s.Value), len(p.Sample[0].Value))
+		}
+		for _, locID := range s.LocationId {
+			if _, ok := locations[locID]; !ok {
+				return fmt.Errorf("sample %d references unknown location %d", idx, locID)
+			}
+		}
+		for _, l := range s.Label {
+			if !validString(l.Key) || !validString(l.Str) || !validString(l.NumUnit) {
+				return fmt.Errorf("sample %d has a label referencing a string out of range", idx)
+			}
+		}
+	}
+	return nil
+}
+
+// ingestProfile ingests the symbols and samples of p, its strings need to be
+// already ingested into rewrites. It returns the profiles of each sample type
+// to be stored by storeProfiles, referencing the symbols of the head, and
+// whether profiles have been sampled into the reservoirs instead. Profiles
+// dropped by the delta computation are neither. A profile without id gets one
+// from the ID generator of the head.
+func (h *Head) ingestProfile(ctx context.Context, p *profilev1.Profile, id uuid.UUID, labels []phlaremodel.Labels, seriesFingerprints []model.Fingerprint, metricName string, rewrites *rewriter) (stored []seriesProfile, sampled bool, err error) {
+	if id == uuid.Nil {
+		id = h.idGenerator.NewID()
+	}
+
+	if err := h.mappings.ingest(ctx, p.Mapping, rewrites); err != nil {
+		return nil, false, err
+	}
 
 	if err := h.functions.ingest(ctx, p.Function, rewrites); err != nil {
-		return err
+		return nil, false, err
 	}
 
 	if err := h.locations.ingest(ctx, p.Location, rewrites); err != nil {
-		return err
+		return nil, false, err
 	}
 
 	samplesPerType, err := h.convertSamples(ctx, rewrites, p.Sample)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
-	var profileIngested bool
 	for idxType := range samplesPerType {
 		samples := samplesPerType[idxType]
-		// Sort samples per stacktraceID and aggregate duplicate stacktraceIDs into
+		// Sort samples per stacktraceID and labels and aggregate duplicates into
 		// a single value to make sure we won't have any duplicates, as this is not recognized as part of the delta calculation.
+		// Samples with the same stacktraceID but different sample labels are kept apart.
 		sort.Slice(samples, func(i, j int) bool {
-			return samples[i].StacktraceID > samples[j].StacktraceID
+			if samples[i].StacktraceID != samples[j].StacktraceID {
+				return samples[i].StacktraceID > samples[j].StacktraceID
+			}
+			return compareSampleLabels(samples[i].Labels, samples[j].Labels) < 0
 		})
 		total := len(samples)
 		samples = slices.RemoveInPlace(samples, func(s *schemav1.Sample, i int) bool {
 			if s.Value == 0 {
 				return true
 			}
-			if i < len(p.Sample)-1 && s.StacktraceID == samples[i+1].StacktraceID {
+			if i < len(p.Sample)-1 && s.StacktraceID == samples[i+1].StacktraceID && compareSampleLabels(s.Labels, samples[i+1].Labels) == 0 {
 				samples[i+1].Value += s.Value
-				// TODO: Currently we're not aggregating labels, and we should probably decide what to do with them in this case.
 				return true
 			}
 			return false
@@ -379,6 +929,7 @@ func (h *Head) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, e
 			KeepFrames:        p.KeepFrames,
 			TimeNanos:         p.TimeNanos,
 			DurationNanos:     p.DurationNanos,
+			Period:            p.Period,
 			Comments:          copySlice(p.Comment),
 			DefaultSampleType: p.DefaultSampleType,
 		}
@@ -390,76 +941,130 @@ func (h *Head) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, e
 			continue
 		}
 
-		if err := h.profiles.ingest(ctx, []*schemav1.Profile{profile}, labels[idxType], metricName, rewrites); err != nil {
-			return err
+		if err := h.profiles.helper.rewrite(rewrites, profile); err != nil {
+			return nil, false, err
 		}
-
-		profileIngested = true
-		h.totalSamples.Add(uint64(len(profile.Samples)))
-		h.metrics.sampleValuesIngested.WithLabelValues(metricName).Add(float64(len(profile.Samples)))
 		h.metrics.sampleValuesReceived.WithLabelValues(metricName).Add(float64(len(p.Sample)))
+
+		// duplicates of stored profiles are left to the profile store
+		if h.reservoirs != nil && !h.profiles.contains(profile) && !h.reservoirs.admit(profile.SeriesFingerprint, labels[idxType], metricName) {
+			// the series exceeds the reservoir size, the profile is stored on flush, if it is sampled
+			if err := h.profiles.index.allowProfile(profile.SeriesFingerprint, labels[idxType], profile.TimeNanos, h.profiles.outOfOrderWindow); err != nil {
+				return nil, false, err
+			}
+			h.reservoirs.add(profile)
+			sampled = true
+			h.metrics.sampleValuesIngested.WithLabelValues(metricName).Add(float64(len(profile.Samples)))
+			continue
+		}
+		stored = append(stored, seriesProfile{profile: profile, lbs: labels[idxType], profileName: metricName})
 	}
 
-	if !profileIngested {
-		return nil
+	return stored, sampled, nil
+}
+
+// storeProfiles appends the profiles returned by ingestProfile to the profile
+// store at once. It returns the error of each profile at its index.
+func (h *Head) storeProfiles(profiles []seriesProfile) []error {
+	errs := h.profiles.addBatch(profiles)
+	for i, p := range profiles {
+		if errs[i] != nil {
+			continue
+		}
+		h.generation.Inc()
+		h.totalSamples.Add(uint64(len(p.profile.Samples)))
+		h.metrics.sampleValuesIngested.WithLabelValues(p.profileName).Add(float64(len(p.profile.Samples)))
 	}
+	return errs
+}
 
+// profileAgeExceeded returns the age of the oldest profile in the head and
+// whether it exceeds the max profile age.
+func (h *Head) profileAgeExceeded(now time.Time) (time.Duration, bool) {
+	if h.maxProfileAge <= 0 {
+		return 0, false
+	}
+	h.metaLock.RLock()
+	minTimeNanos := h.minTimeNanos
+	h.metaLock.RUnlock()
+	if minTimeNanos == math.MaxInt64 {
+		return 0, false
+	}
+	age := now.Sub(time.Unix(0, minTimeNanos))
+	return age, age > h.maxProfileAge
+}
+
+// updateTimeRange extends the time range of the head to include [minTimeNanos, maxTimeNanos].
+func (h *Head) updateTimeRange(minTimeNanos, maxTimeNanos int64) {
 	h.metaLock.Lock()
-	v := model.TimeFromUnixNano(p.TimeNanos)
-	if v < h.meta.MinTime {
+	defer h.metaLock.Unlock()
+
+	if v := model.TimeFromUnixNano(minTimeNanos); v < h.meta.MinTime {
 		h.meta.MinTime = v
 	}
-	if v > h.meta.MaxTime {
+	if v := model.TimeFromUnixNano(maxTimeNanos); v > h.meta.MaxTime {
 		h.meta.MaxTime = v
 	}
-	h.metaLock.Unlock()
+	if minTimeNanos < h.minTimeNanos {
+		h.minTimeNanos = minTimeNanos
+		h.metrics.minTimeSeconds.Set(float64(minTimeNanos) / 1e9)
+	}
+	if maxTimeNanos > h.maxTimeNanos {
+		h.maxTimeNanos = maxTimeNanos
+		h.metrics.maxTimeSeconds.Set(float64(maxTimeNanos) / 1e9)
+	}
+}
 
-	return nil
+func (h *Head) updateStatsMetrics() {
+	h.metrics.stacktraces.Set(float64(h.stacktraces.Len()))
+	h.metrics.functions.Set(float64(h.functions.Len()))
+	h.metrics.memoryBytes.Set(float64(h.MemorySize()))
 }
 
-func labelsForProfile(p *profilev1.Profile, externalLabels ...*typesv1.LabelPair) ([]phlaremodel.Labels, []model.Fingerprint) {
-	// build label set per sample type before references are rewritten
-	var (
-		sb                                             strings.Builder
-		lbls                                           = phlaremodel.NewLabelsBuilder(externalLabels)
-		sampleType, sampleUnit, periodType, periodUnit string
-		metricName                                     = phlaremodel.Labels(externalLabels).Get(model.MetricNameLabel)
-	)
+// HeadStats contains statistics about the data currently held by the head.
+type HeadStats struct {
+	NumSeries      uint64
+	NumProfiles    uint64
+	NumStacktraces uint64
+	NumFunctions   uint64
+	MemoryBytes    uint64
+	// MinTimeNanos and MaxTimeNanos are zero when no profile has been ingested.
+	MinTimeNanos int64
+	MaxTimeNanos int64
+}
+
+// Stats returns statistics about the head, they are maintained during
+// ingestion and cheap to retrieve.
+func (h *Head) Stats() HeadStats {
+	stats := HeadStats{
+		NumSeries:      uint64(h.profiles.index.totalSeries.Load()),
+		NumProfiles:    uint64(h.profiles.index.totalProfiles.Load()),
+		NumStacktraces: uint64(h.stacktraces.Len()),
+		NumFunctions:   uint64(h.functions.Len()),
+		MemoryBytes:    h.MemorySize(),
+	}
 
-	// set common labels
-	if p.PeriodType != nil {
-		periodType = p.StringTable[p.PeriodType.Type]
-		lbls.Set(phlaremodel.LabelNamePeriodType, periodType)
-		periodUnit = p.StringTable[p.PeriodType.Unit]
-		lbls.Set(phlaremodel.LabelNamePeriodUnit, periodUnit)
-	}
-
-	profilesLabels := make([]phlaremodel.Labels, len(p.SampleType))
-	seriesRefs := make([]model.Fingerprint, len(p.SampleType))
-	for pos := range p.SampleType {
-		sampleType = p.StringTable[p.SampleType[pos].Type]
-		lbls.Set(phlaremodel.LabelNameType, sampleType)
-		sampleUnit = p.StringTable[p.SampleType[pos].Unit]
-		lbls.Set(phlaremodel.LabelNameUnit, sampleUnit)
-
-		sb.Reset()
-		_, _ = sb.WriteString(metricName)
-		_, _ = sb.WriteRune(':')
-		_, _ = sb.WriteString(sampleType)
-		_, _ = sb.WriteRune(':')
-		_, _ = sb.WriteString(sampleUnit)
-		_, _ = sb.WriteRune(':')
-		_, _ = sb.WriteString(periodType)
-		_, _ = sb.WriteRune(':')
-		_, _ = sb.WriteString(periodUnit)
-		t := sb.String()
-		lbls.Set(phlaremodel.LabelNameProfileType, t)
-		lbs := lbls.Labels().Clone()
-		profilesLabels[pos] = lbs
-		seriesRefs[pos] = model.Fingerprint(lbs.Hash())
-
-	}
-	return profilesLabels, seriesRefs
+	h.metaLock.RLock()
+	if h.minTimeNanos <= h.maxTimeNanos {
+		stats.MinTimeNanos = h.minTimeNanos
+		stats.MaxTimeNanos = h.maxTimeNanos
+	}
+	h.metaLock.RUnlock()
+
+	return stats
+}
+
+// ForEachSeries calls fn for every series of the head ordered by
+// fingerprint, with its labels and the number of profiles ingested. The series
+// are snapshotted first, so fn doesn't block ingestion. Iteration stops at the
+// first error returned by fn.
+func (h *Head) ForEachSeries(fn func(fp model.Fingerprint, lbls phlaremodel.Labels, profileCount int) error) error {
+	for _, s := range h.profiles.index.snapshotSeries() {
+		if err := fn(s.fp, s.lbs, s.profileCount); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // LabelValues returns the possible label values for a given label name.
@@ -507,6 +1112,11 @@ func (h *Head) ProfileTypes(ctx context.Context, req *connect.Request[ingestv1.P
 	}), nil
 }
 
+// mergeCacheID identifies the profiles of the head, it changes on each ingest.
+func (h *Head) mergeCacheID() string {
+	return fmt.Sprintf("%s/%d", h.meta.ULID, h.generation.Load())
+}
+
 func (h *Head) InRange(start, end model.Time) bool {
 	h.metaLock.RLock()
 	b := &minMax{
@@ -517,29 +1127,35 @@ func (h *Head) InRange(start, end model.Time) bool {
 	return b.InRange(start, end)
 }
 
-// Returns underlying queries, the queriers should be roughly ordered in TS increasing order
+// Returns underlying queries, the queriers should be roughly ordered in TS increasing order. The queriers read a
+// single view of the profiles, so row groups cut while querying don't change the profiles seen. A head doesn't
+// query its flushed blocks, PhlareDB.Queriers hands a flushed head over to its blocks for a view across flushes.
 func (h *Head) Queriers() Queriers {
-	h.profiles.lock.RLock()
-	defer h.profiles.lock.RUnlock()
+	view := h.profiles.currentView()
 
-	queriers := make([]Querier, 0, len(h.profiles.rowGroups)+1)
-	for idx := range h.profiles.rowGroups {
+	queriers := make([]Querier, 0, len(view.rowGroups)+1)
+	for idx, rg := range view.rowGroups {
 		queriers = append(queriers, &headOnDiskQuerier{
 			head:        h,
 			rowGroupIdx: idx,
+			rg:          rg,
 		})
 	}
-	queriers = append(queriers, &headInMemoryQuerier{h})
+	queriers = append(queriers, &headInMemoryQuerier{head: h, view: view})
 	return queriers
 }
 
 // add the location IDs to the stacktraces
-func (h *Head) resolveStacktraces(ctx context.Context, stacktraceSamples stacktraceSampleMap) *ingestv1.MergeProfilesStacktracesResult {
+func (h *Head) resolveStacktraces(ctx context.Context, stacktraceSamples stacktraceSampleMap, opts MergeStacktracesOptions) *ingestv1.MergeProfilesStacktracesResult {
 	sp, _ := opentracing.StartSpanFromContext(ctx, "resolveStacktraces - Head")
 	defer sp.Finish()
 
-	names := []string{}
-	functions := map[int64]int{}
+	var (
+		byLine    = opts.Granularity == ingestv1.StacktraceGranularity_STACKTRACE_GRANULARITY_LINE
+		names     = []string{}
+		lines     []int64
+		functions = map[functionLineKey]int{}
+	)
 
 	h.stacktraces.lock.RLock()
 	h.locations.lock.RLock()
@@ -557,12 +1173,18 @@ func (h *Head) resolveStacktraces(ctx context.Context, stacktraceSamples stacktr
 		fnIds := make([]int32, 0, 2*len(locs))
 		for _, loc := range locs {
 			for _, line := range h.locations.slice[loc].Line {
-				fnNameID := h.functions.slice[line.FunctionId].Name
-				pos, ok := functions[fnNameID]
+				key := functionLineKey{name: h.functions.slice[line.FunctionId].Name}
+				if byLine {
+					key.line = line.Line
+				}
+				pos, ok := functions[key]
 				if !ok {
-					functions[fnNameID] = len(names)
+					functions[key] = len(names)
 					fnIds = append(fnIds, int32(len(names)))
-					names = append(names, h.strings.slice[h.functions.slice[line.FunctionId].Name])
+					names = append(names, h.strings.slice[key.name])
+					if byLine {
+						lines = append(lines, key.line)
+					}
 					continue
 				}
 				fnIds = append(fnIds, int32(pos))
@@ -574,10 +1196,44 @@ func (h *Head) resolveStacktraces(ctx context.Context, stacktraceSamples stacktr
 	return &ingestv1.MergeProfilesStacktracesResult{
 		Stacktraces:   lo.Values(stacktraceSamples),
 		FunctionNames: names,
+		Lines:         lines,
 	}
 }
 
-func (h *Head) resolvePprof(ctx context.Context, stacktraceSamples profileSampleMap) *profile.Profile {
+// resolveSplitStacktraces resolves the stacktraces of samples split by a
+// sample label.
+func (h *Head) resolveSplitStacktraces(ctx context.Context, values sampleLabelValues, opts MergeStacktracesOptions) *ingestv1.MergeProfilesStacktracesResult {
+	stacktraceSamples := values.stacktraceSamples()
+	result := h.resolveStacktraces(ctx, stacktraceSamples, opts)
+	values.split(result, stacktraceSamples, opts)
+	return result
+}
+
+// stringsLookup returns the string ID of s, or -1 if it is not part of the
+// head, and a function to lookup strings by ID. Strings are only ever appended
+// to the head, so the lookup reads a snapshot of them taken up front and
+// doesn't hold the strings lock while the rows of a query are read.
+func (h *Head) stringsLookup(s string) (id int64, lookup func(int64) string) {
+	h.strings.lock.RLock()
+	id, ok := h.strings.lookup[s]
+	if !ok {
+		id = -1
+	}
+	snapshot := h.strings.slice
+	h.strings.lock.RUnlock()
+
+	return id, func(id int64) string {
+		if id < int64(len(snapshot)) {
+			return snapshot[id]
+		}
+		// the string has been added after the snapshot
+		h.strings.lock.RLock()
+		defer h.strings.lock.RUnlock()
+		return h.strings.slice[id]
+	}
+}
+
+func (h *Head) resolvePprof(ctx context.Context, stacktraceSamples profileSampleMap, comments profileComments) *profile.Profile {
 	sp, _ := opentracing.StartSpanFromContext(ctx, "resolvePprof - Head")
 	defer sp.Finish()
 
@@ -587,11 +1243,13 @@ func (h *Head) resolvePprof(ctx context.Context, stacktraceSamples profileSample
 
 	h.stacktraces.lock.RLock()
 	h.locations.lock.RLock()
+	h.mappings.lock.RLock()
 	h.functions.lock.RLock()
 	h.strings.lock.RLock()
 	defer func() {
 		h.stacktraces.lock.RUnlock()
 		h.locations.lock.RUnlock()
+		h.mappings.lock.RUnlock()
 		h.functions.lock.RUnlock()
 		h.strings.lock.RUnlock()
 	}()
@@ -660,6 +1318,9 @@ func (h *Head) resolvePprof(ctx context.Context, stacktraceSamples profileSample
 		Function: lo.Values(functions),
 		Mapping:  lo.Values(mappings),
 	}
+	for _, id := range comments.ids {
+		result.Comments = append(result.Comments, h.strings.slice[id])
+	}
 	normalizeProfileIds(result)
 	return result
 }
@@ -738,7 +1399,7 @@ func (h *Head) Series(ctx context.Context, req *connect.Request[ingestv1.SeriesR
 	for _, m := range req.Msg.Matchers {
 		s, err := parser.ParseMetricSelector(m)
 		if err != nil {
-			return nil, status.Error(codes.InvalidArgument, "failed to label selector")
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("%w: %v", ErrInvalidLabelSelector, err))
 		}
 		selectors = append(selectors, s)
 	}
@@ -764,7 +1425,7 @@ func (h *Head) Series(ctx context.Context, req *connect.Request[ingestv1.SeriesR
 
 // Closes closes the head
 func (h *Head) Close() error {
-	close(h.stopCh)
+	h.stopOnce.Do(func() { close(h.stopCh) })
 
 	var merr multierror.MultiError
 	for _, t := range h.tables {
@@ -775,37 +1436,242 @@ func (h *Head) Close() error {
 	return merr.Err()
 }
 
+// Truncate drops the buffered profiles older than before without flushing
+// them, to relieve memory pressure. Profiles already cut into row groups on
+// disk are kept. Series without profiles left are removed and the
+// stacktraces no longer referenced are released, the IDs of the remaining
+// stacktraces don't change. Ingestion waits for Truncate to complete. It
+// returns the number of dropped profiles.
+func (h *Head) Truncate(before time.Time) (dropped int, err error) {
+	h.ingestLock.Lock()
+	defer h.ingestLock.Unlock()
+
+	profiles := h.profiles.truncate(before.UnixNano())
+	if len(profiles) == 0 {
+		return 0, nil
+	}
+	h.generation.Inc()
+
+	var samples uint64
+	for _, p := range profiles {
+		samples += uint64(len(p.Samples))
+	}
+	h.totalSamples.Sub(samples)
+	h.resetTimeRange()
+
+	referenced, err := h.referencedStacktraces()
+	if err != nil {
+		return len(profiles), errors.Wrap(err, "finding referenced stacktraces")
+	}
+	released := h.stacktraces.release(func(id int64) bool {
+		_, ok := referenced[uint64(id)]
+		return ok
+	}, &schemav1.Stacktrace{})
+
+	h.updateStatsMetrics()
+	level.Debug(h.logger).Log("msg", "truncated head", "before", before, "profiles", len(profiles), "stacktraces", released)
+	return len(profiles), nil
+}
+
+// resetTimeRange sets the time range of the head to the one of its series.
+func (h *Head) resetTimeRange() {
+	var (
+		minTimeNanos int64 = math.MaxInt64
+		maxTimeNanos int64
+	)
+	h.profiles.index.mutex.RLock()
+	for _, s := range h.profiles.index.profilesPerFP {
+		if s.minTime < minTimeNanos {
+			minTimeNanos = s.minTime
+		}
+		if s.maxTime > maxTimeNanos {
+			maxTimeNanos = s.maxTime
+		}
+	}
+	h.profiles.index.mutex.RUnlock()
+
+	h.metaLock.Lock()
+	defer h.metaLock.Unlock()
+	h.minTimeNanos, h.maxTimeNanos = minTimeNanos, maxTimeNanos
+	if minTimeNanos == math.MaxInt64 {
+		h.meta.MinTime, h.meta.MaxTime = math.MaxInt64, 0
+		return
+	}
+	h.meta.MinTime = model.TimeFromUnixNano(minTimeNanos)
+	h.meta.MaxTime = model.TimeFromUnixNano(maxTimeNanos)
+	h.metrics.minTimeSeconds.Set(float64(minTimeNanos) / 1e9)
+	h.metrics.maxTimeSeconds.Set(float64(maxTimeNanos) / 1e9)
+}
+
+// referencedStacktraces returns the IDs of the stacktraces referenced by the
+// profiles in memory, the profiles cut into row groups and the samples kept
+// for the delta computation.
+func (h *Head) referencedStacktraces() (map[uint64]struct{}, error) {
+	referenced := make(map[uint64]struct{})
+	addSamples := func(samples []*schemav1.Sample) {
+		for _, s := range samples {
+			referenced[s.StacktraceID] = struct{}{}
+		}
+	}
+
+	h.profiles.lock.RLock()
+	defer h.profiles.lock.RUnlock()
+	for _, p := range h.profiles.slice {
+		addSamples(p.Samples)
+	}
+	buf := make([]*schemav1.Profile, 1024)
+	for _, rg := range h.profiles.rowGroups {
+		reader := parquet.NewGenericRowGroupReader[*schemav1.Profile](rg)
+		for {
+			n, err := reader.Read(buf)
+			for _, p := range buf[:n] {
+				addSamples(p.Samples)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				_ = reader.Close()
+				return nil, err
+			}
+		}
+		if err := reader.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	h.delta.mtx.Lock()
+	defer h.delta.mtx.Unlock()
+	for _, samples := range h.delta.highestSamples {
+		addSamples(samples)
+	}
+	return referenced, nil
+}
+
 // Flush closes the head and writes data to disk
-func (h *Head) Flush(ctx context.Context) error {
+// FlushedBlock is a block written to the local directory by a flush of the head.
+type FlushedBlock struct {
+	ID  ulid.ULID
+	Dir string
+}
+
+// Flush writes the profiles of the head to the local directory and returns the
+// blocks written, e.g. for shipping them right away. An empty head writes no
+// block, while a head exceeding the maximum profiles of a block is split into
+// multiple blocks. A failed flush can be retried, while a head flushed
+// already returns the blocks written by its flush.
+func (h *Head) Flush(ctx context.Context) ([]FlushedBlock, error) {
+	if h.written {
+		return h.writtenBlocks, nil
+	}
 	start := time.Now()
 	defer func() {
 		h.metrics.flushedBlockDurationSeconds.Observe(time.Since(start).Seconds())
 	}()
-	if err := h.flush(ctx); err != nil {
+	blocks, err := h.flush(ctx)
+	if err != nil {
+		// the temporary row groups hold the profiles cut to disk, they are
+		// kept for the flush to be retried
 		h.metrics.flushedBlocks.WithLabelValues("failed").Inc()
-		return err
+		return nil, err
+	}
+	if h.tempPath != "" {
+		if err := os.RemoveAll(h.tempPath); err != nil {
+			h.metrics.flushedBlocks.WithLabelValues("failed").Inc()
+			return nil, err
+		}
 	}
 	h.metrics.flushedBlocks.WithLabelValues("success").Inc()
+	// the series of a flushed head are no longer active, while a new head
+	// might already have created series of its own
+	h.metrics.activeSeries.Sub(float64(h.profiles.index.totalSeries.Load()))
+	h.written, h.writtenBlocks = true, blocks
+	return blocks, nil
+}
+
+// cut makes the head forward the profiles ingested from now on to next, once
+// the ingestions in flight are complete. Nothing is ingested into a cut head,
+// while it is flushed, so it no longer checks whether it needs a flush.
+func (h *Head) cut(next *Head) {
+	h.ingestLock.Lock()
+	h.next = next
+	h.ingestLock.Unlock()
+
+	h.stopOnce.Do(func() { close(h.stopCh) })
+	h.wg.Wait()
+}
+
+// release closes the row groups, which the head keeps readable after its
+// flush for the queries still reading it. The head must no longer be queried.
+func (h *Head) release() error {
+	return h.profiles.releaseRowGroups()
+}
+
+// acquire marks the head as read by a query until done is called.
+func (h *Head) acquire() (done func()) {
+	h.queriesLock.Lock()
+	defer h.queriesLock.Unlock()
+	h.queries++
+	return func() {
+		h.queriesLock.Lock()
+		defer h.queriesLock.Unlock()
+		h.queries--
+		if h.queries == 0 && h.flushed {
+			if err := h.release(); err != nil {
+				level.Warn(h.logger).Log("msg", "releasing flushed head failed", "err", err)
+			}
+		}
+	}
+}
+
+// releaseWhenDone releases the flushed head, or leaves it to the last query
+// still reading it. The head must no longer be handed to new queries.
+func (h *Head) releaseWhenDone() error {
+	h.queriesLock.Lock()
+	defer h.queriesLock.Unlock()
+	h.flushed = true
+	if h.queries == 0 {
+		return h.release()
+	}
 	return nil
 }
 
-func (h *Head) flush(ctx context.Context) error {
+func (h *Head) flush(ctx context.Context) ([]FlushedBlock, error) {
+	if err := h.storeSampledProfiles(); err != nil {
+		return nil, errors.Wrap(err, "storing sampled profiles")
+	}
 	if h.profiles.empty() {
 		level.Info(h.logger).Log("msg", "head empty - no block written")
-		return os.RemoveAll(h.headPath)
+		return nil, os.RemoveAll(h.headPath)
 	}
 
-	files := make([]block.File, len(h.tables)+1)
-
-	for idx, t := range h.tables {
-		numRows, numRowGroups, err := t.Flush(ctx)
-		if err != nil {
-			return errors.Wrapf(err, "flushing of table %s", t.Name())
+	if h.flushedFiles == nil {
+		files := make([]block.File, len(h.tables)+1)
+		for idx, t := range h.tables {
+			start := time.Now()
+			numRows, numRowGroups, err := t.Flush(ctx)
+			if err != nil {
+				return nil, errors.Wrapf(err, "flushing of table %s", t.Name())
+			}
+			h.metrics.flushedTableDurationSeconds.WithLabelValues(t.Name()).Observe(time.Since(start).Seconds())
+			h.metrics.flushedTableRows.WithLabelValues(t.Name()).Observe(float64(numRows))
+			h.metrics.flushedTableRowGroups.WithLabelValues(t.Name()).Observe(float64(numRowGroups))
+			h.metrics.rowsWritten.WithLabelValues(t.Name()).Add(float64(numRows))
+			files[idx+1].Parquet = &block.ParquetFile{
+				NumRowGroups: numRowGroups,
+				NumRows:      numRows,
+			}
 		}
-		h.metrics.rowsWritten.WithLabelValues(t.Name()).Add(float64(numRows))
-		files[idx+1].Parquet = &block.ParquetFile{
-			NumRowGroups: numRowGroups,
-			NumRows:      numRows,
+		h.flushedFiles = files
+	}
+	files := append([]block.File(nil), h.flushedFiles...)
+
+	// oversized heads are split into blocks encrypted one by one, a retried
+	// flush doesn't encrypt the block again
+	split := h.maxBlockProfiles > 0 && uint64(h.profiles.index.totalProfiles.Load()) > h.maxBlockProfiles
+	if h.encryption != nil && !split && h.meta.Encryption == nil {
+		if err := h.encryption.encryptBlock(h.headPath, h.meta); err != nil {
+			return nil, errors.Wrap(err, "encrypting block")
 		}
 	}
 
@@ -826,7 +1692,7 @@ func (h *Head) flush(ctx context.Context) error {
 
 	for idx, t := range h.tables {
 		if err := t.Close(); err != nil {
-			return errors.Wrapf(err, "closing of table %s", t.Name())
+			return nil, errors.Wrapf(err, "closing of table %s", t.Name())
 		}
 
 		// add file size
@@ -841,6 +1707,11 @@ func (h *Head) flush(ctx context.Context) error {
 	sort.Slice(files, func(i, j int) bool {
 		return files[i].RelPath < files[j].RelPath
 	})
+	if !split {
+		if err := setChecksums(h.headPath, files); err != nil {
+			return nil, err
+		}
+	}
 	h.meta.Files = files
 	h.meta.Stats.NumProfiles = uint64(h.profiles.index.totalProfiles.Load())
 	h.meta.Stats.NumSamples = h.totalSamples.Load()
@@ -848,18 +1719,130 @@ func (h *Head) flush(ctx context.Context) error {
 	h.metrics.flusehdBlockProfiles.Observe(float64(h.meta.Stats.NumProfiles))
 
 	if _, err := h.meta.WriteToFile(h.logger, h.headPath); err != nil {
-		return err
+		return nil, err
 	}
 	h.metrics.blockDurationSeconds.Observe(h.meta.MaxTime.Sub(h.meta.MinTime).Seconds())
 
+	if split {
+		return h.flushSplit(ctx)
+	}
+
 	// move block to the local directory
 	if err := os.MkdirAll(filepath.Dir(h.localPath), defaultFolderMode); err != nil {
-		return err
+		return nil, err
 	}
 	if err := fileutil.Rename(h.headPath, h.localPath); err != nil {
-		return err
+		return nil, err
 	}
 
 	level.Info(h.logger).Log("msg", "head successfully written to block", "block_path", h.localPath)
-	return nil
+	return []FlushedBlock{{ID: h.meta.ULID, Dir: h.localPath}}, nil
+}
+
+// storeSampledProfiles adds the profiles sampled by the series reservoirs to the profile store.
+func (h *Head) storeSampledProfiles() error {
+	if h.reservoirs == nil {
+		return nil
+	}
+	return h.reservoirs.drain(func(profiles []*schemav1.Profile, lbs phlaremodel.Labels, profileName string) error {
+		for _, p := range profiles {
+			if err := h.profiles.add([]*schemav1.Profile{p}, lbs, profileName); err != nil {
+				// the stored profiles of the series might have been cut
+				// into a row group past the sampled profile
+				if errors.Is(err, ErrOutOfOrder) {
+					continue
+				}
+				return err
+			}
+			h.totalSamples.Add(uint64(len(p.Samples)))
+		}
+		h.generation.Inc()
+		return nil
+	})
+}
+
+// flushSplit splits the block written to the head path by time into blocks of
+// at most maxBlockProfiles profiles and moves them to the local directory.
+func (h *Head) flushSplit(ctx context.Context) ([]FlushedBlock, error) {
+	var times []int64
+	profilesPath := filepath.Join(h.headPath, h.profiles.Name()+block.ParquetSuffix)
+	if err := readProfilesColumn(ctx, profilesPath, "TimeNanos", func(v parquet.Value) {
+		times = append(times, v.Int64())
+	}); err != nil {
+		return nil, errors.Wrap(err, "reading profile timestamps")
+	}
+
+	// blocks are written next to the head first, so no partial block is loaded from the local directory,
+	// the blocks of a failed flush are written again
+	splitPath := h.headPath + "-split"
+	if err := os.RemoveAll(splitPath); err != nil {
+		return nil, err
+	}
+	dirs, err := SplitBlock(ctx, h.headPath, splitBoundaries(times, h.maxBlockProfiles), splitPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "splitting block")
+	}
+	if err := os.MkdirAll(filepath.Dir(h.localPath), defaultFolderMode); err != nil {
+		return nil, err
+	}
+	blocks := make([]FlushedBlock, 0, len(dirs))
+	for _, dir := range dirs {
+		if h.encryption != nil {
+			meta, _, err := block.MetaFromDir(dir)
+			if err != nil {
+				return nil, err
+			}
+			if err := h.encryption.encryptBlock(dir, meta); err != nil {
+				return nil, errors.Wrap(err, "encrypting block")
+			}
+			if err := setChecksums(dir, meta.Files); err != nil {
+				return nil, err
+			}
+			if _, err := meta.WriteToFile(h.logger, dir); err != nil {
+				return nil, err
+			}
+		}
+		id, err := ulid.Parse(filepath.Base(dir))
+		if err != nil {
+			return nil, err
+		}
+		blockDir := filepath.Join(filepath.Dir(h.localPath), filepath.Base(dir))
+		if err := fileutil.Rename(dir, blockDir); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, FlushedBlock{ID: id, Dir: blockDir})
+	}
+	if err := os.RemoveAll(splitPath); err != nil {
+		return nil, err
+	}
+
+	level.Info(h.logger).Log("msg", "head successfully written to multiple blocks", "blocks", len(dirs), "max_block_profiles", h.maxBlockProfiles)
+	return blocks, os.RemoveAll(h.headPath)
+}
+
+// splitBoundaries returns the time boundaries splitting the profiles with the
+// given timestamps into buckets of at most maxProfiles profiles. Profiles
+// sharing a timestamp stay in the same bucket, which can exceed the limit then.
+func splitBoundaries(times []int64, maxProfiles uint64) []time.Time {
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	var (
+		boundaries []time.Time
+		start      int
+	)
+	for uint64(len(times)-start) > maxProfiles {
+		b := times[start+int(maxProfiles)]
+		// profiles on a boundary go to the later bucket
+		next := sort.Search(len(times), func(i int) bool { return times[i] >= b })
+		if next <= start {
+			next = sort.Search(len(times), func(i int) bool { return times[i] > b })
+			if next == len(times) {
+				break
+			}
+			b = times[next]
+		}
+		boundaries = append(boundaries, time.Unix(0, b))
+		start = next
+	}
+	return boundaries
 }
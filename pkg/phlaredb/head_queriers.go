@@ -6,14 +6,17 @@ import (
 
 	"github.com/go-kit/log/level"
 	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/segmentio/parquet-go"
 
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	"github.com/grafana/phlare/pkg/iter"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
 	"github.com/grafana/phlare/pkg/phlaredb/query"
 	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
 )
@@ -21,12 +24,15 @@ import (
 type headOnDiskQuerier struct {
 	head        *Head
 	rowGroupIdx int
+	rg          *rowGroupOnDisk
+}
+
+func (q *headOnDiskQuerier) mergeCacheID() string {
+	return q.head.mergeCacheID()
 }
 
 func (q *headOnDiskQuerier) rowGroup() *rowGroupOnDisk {
-	q.head.profiles.lock.RLock()
-	defer q.head.profiles.lock.RUnlock()
-	return q.head.profiles.rowGroups[q.rowGroupIdx]
+	return q.rg
 }
 
 func (q *headOnDiskQuerier) SelectMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (iter.Iterator[Profile], error) {
@@ -95,35 +101,155 @@ func (q *headOnDiskQuerier) SelectMatchingProfiles(ctx context.Context, params *
 	return iter.NewSliceIterator(profiles), nil
 }
 
+// CountMatchingProfiles counts the profiles with the row ranges of the index,
+// if all profiles of the row group are within the time range of the request.
+func (q *headOnDiskQuerier) CountMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (map[model.Fingerprint]uint64, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "CountMatchingProfiles - HeadOnDisk")
+	defer sp.Finish()
+
+	var (
+		start = model.Time(params.Start).UnixNano()
+		end   = model.Time(params.End).UnixNano()
+	)
+	min, max, ok := timeNanosBounds(q.rowGroup())
+	if ok && (max < start || min > end) {
+		return map[model.Fingerprint]uint64{}, nil
+	}
+	if ok && start <= min && max <= end {
+		return q.head.profiles.index.countOnDisk(ctx, params, q.rowGroupIdx)
+	}
+	it, err := q.SelectMatchingProfiles(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return countProfiles(it)
+}
+
+func (q *headOnDiskQuerier) SelectByIDRange(ctx context.Context, lo, hi uuid.UUID, params *ingestv1.SelectProfilesRequest) ([]ProfileWithID, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectByIDRange - HeadOnDisk")
+	defer sp.Finish()
+
+	rowIter, labelsPerFP, err := q.head.profiles.index.selectMatchingRowRanges(ctx, params, q.rowGroupIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		start = model.Time(params.Start)
+		end   = model.Time(params.End)
+		rg    = q.rowGroup()
+	)
+	pIt := query.NewJoinIterator(
+		0,
+		[]query.Iterator{
+			rowIter,
+			rg.columnIter(ctx, "TimeNanos", query.NewIntBetweenPredicate(start.UnixNano(), end.UnixNano()), "TimeNanos"),
+			rg.columnIter(ctx, "ID", idRangePredicate(lo, hi), "ID"),
+		},
+		nil,
+	)
+	defer pIt.Close()
+
+	var (
+		result []ProfileWithID
+		buf    = make([][]parquet.Value, 2)
+	)
+	for pIt.Next() {
+		res := pIt.At()
+
+		v, ok := res.Entries[0].RowValue.(fingerprintWithRowNum)
+		if !ok {
+			panic("no fingerprint information found")
+		}
+
+		buf = res.Columns(buf, "TimeNanos", "ID")
+		p := ProfileWithID{
+			Profile: BlockProfile{
+				labels: labelsPerFP[v.fp],
+				fp:     v.fp,
+				ts:     model.TimeFromUnixNano(buf[0][0].Int64()),
+				RowNum: res.RowNumber[0],
+			},
+		}
+		copy(p.ID[:], buf[1][0].ByteArray())
+		result = append(result, p)
+	}
+	if err := pIt.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterator error")
+	}
+	return result, nil
+}
+
 func (q *headOnDiskQuerier) InRange(start, end model.Time) bool {
 	// TODO: Use per rowgroup information
 	return q.head.InRange(start, end)
 }
 
-func (q *headOnDiskQuerier) MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile]) (*ingestv1.MergeProfilesStacktracesResult, error) {
+func (q *headOnDiskQuerier) MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile], opts MergeStacktracesOptions) (*ingestv1.MergeProfilesStacktracesResult, error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeByStacktraces - HeadOnDisk")
 	defer sp.Finish()
 
+	if opts.SplitBySampleLabel != "" {
+		values := make(sampleLabelValues)
+		nameID, lookupString := q.head.stringsLookup(opts.SplitBySampleLabel)
+		err := readProfileRows(ctx, q.rowGroup(), rows, func(p Profile, row *schemav1.Profile) {
+			values.add(p, row.Samples, opts.periodFactor(row.Period), opts.SplitBySampleLabel, nameID, lookupString)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return q.head.resolveSplitStacktraces(ctx, values, opts), nil
+	}
+
 	stacktraceSamples := stacktraceSampleMap{}
 
+	if opts.NormalizePeriod {
+		if err := mergeByNormalizedStacktraces(ctx, q.rowGroup(), rows, stacktraceSamples, opts); err != nil {
+			return nil, err
+		}
+		return q.head.resolveStacktraces(ctx, stacktraceSamples, opts), nil
+	}
 	if err := mergeByStacktraces(ctx, q.rowGroup(), rows, stacktraceSamples); err != nil {
 		return nil, err
 	}
 
-	return q.head.resolveStacktraces(ctx, stacktraceSamples), nil
+	return q.head.resolveStacktraces(ctx, stacktraceSamples, opts), nil
 }
 
-func (q *headOnDiskQuerier) MergePprof(ctx context.Context, rows iter.Iterator[Profile]) (*profile.Profile, error) {
+func (q *headOnDiskQuerier) MergePprof(ctx context.Context, rows iter.Iterator[Profile], opts MergePprofOptions) (*profile.Profile, error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeByPprof - HeadOnDisk")
 	defer sp.Finish()
 
-	stacktraceSamples := profileSampleMap{}
+	var (
+		stacktraceSamples = profileSampleMap{}
+		comments          profileComments
+	)
 
-	if err := mergeByStacktraces(ctx, q.head.profiles.rowGroups[q.rowGroupIdx], rows, stacktraceSamples); err != nil {
+	if opts.SampleLabel != nil {
+		nameID, lookupString := q.head.stringsLookup(opts.SampleLabel.Name)
+		filter := newSampleLabelFilter(opts.SampleLabel, nameID, lookupString)
+		err := readProfileRows(ctx, q.rowGroup(), rows, func(_ Profile, row *schemav1.Profile) {
+			filter.add(stacktraceSamples, row.Samples)
+			comments.add(row.Comments...)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return q.head.resolvePprof(ctx, stacktraceSamples, comments), nil
+	}
+
+	multiRows, err := iter.CloneN(rows, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := mergeByStacktraces(ctx, q.rowGroup(), multiRows[0], stacktraceSamples); err != nil {
+		return nil, err
+	}
+	if err := readComments(ctx, q.rowGroup(), multiRows[1], &comments); err != nil {
 		return nil, err
 	}
 
-	return q.head.resolvePprof(ctx, stacktraceSamples), nil
+	return q.head.resolvePprof(ctx, stacktraceSamples, comments), nil
 }
 
 func (q *headOnDiskQuerier) MergeByLabels(ctx context.Context, rows iter.Iterator[Profile], by ...string) ([]*typesv1.Series, error) {
@@ -132,13 +258,32 @@ func (q *headOnDiskQuerier) MergeByLabels(ctx context.Context, rows iter.Iterato
 
 	seriesByLabels := make(seriesByLabels)
 
-	if err := mergeByLabels(ctx, q.head.profiles.rowGroups[q.rowGroupIdx], rows, seriesByLabels, by...); err != nil {
+	if err := mergeByLabels(ctx, q.rowGroup(), rows, seriesByLabels, by...); err != nil {
 		return nil, err
 	}
 
 	return seriesByLabels.normalize(), nil
 }
 
+func (q *headOnDiskQuerier) Totals(ctx context.Context, rows iter.Iterator[Profile]) ([]ProfileWithTotal, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "Totals - HeadOnDisk")
+	defer sp.Finish()
+	return profileTotals(ctx, q.rowGroup(), rows)
+}
+
+// Series returns the series of the head, as the series of the row groups share the head index.
+func (q *headOnDiskQuerier) Series(ctx context.Context, matchers []*labels.Matcher, start, end model.Time) ([]phlaremodel.Labels, error) {
+	sp, _ := opentracing.StartSpanFromContext(ctx, "Series - HeadOnDisk")
+	defer sp.Finish()
+	return q.head.profiles.index.matchingSeries(matchers, start, end)
+}
+
+func (q *headOnDiskQuerier) SeriesMaxTimes(ctx context.Context) ([]SeriesMaxTime, error) {
+	sp, _ := opentracing.StartSpanFromContext(ctx, "SeriesMaxTimes - HeadOnDisk")
+	defer sp.Finish()
+	return q.head.profiles.index.seriesMaxTimes(), nil
+}
+
 func (q *headOnDiskQuerier) Sort(in []Profile) []Profile {
 	var rowI, rowJ int64
 	sort.Slice(in, func(i, j int) bool {
@@ -155,12 +300,34 @@ func (q *headOnDiskQuerier) Sort(in []Profile) []Profile {
 
 type headInMemoryQuerier struct {
 	head *Head
+	// view is the view of the profiles the querier reads the profiles in memory of.
+	view *profilesView
+}
+
+func (q *headInMemoryQuerier) mergeCacheID() string {
+	return q.head.mergeCacheID()
 }
 
 func (q *headInMemoryQuerier) SelectMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (iter.Iterator[Profile], error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectMatchingProfiles - HeadInMemory")
 	defer sp.Finish()
 
+	series, err := q.matchingProfiles(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	iters := make([]iter.Iterator[Profile], 0, len(series))
+	for _, s := range series {
+		iters = append(iters, NewSeriesIterator(s.lbs, s.fp, iter.NewSliceIterator(s.profiles)))
+	}
+	return iter.NewSortProfileIterator(iters), nil
+}
+
+// matchingProfiles returns the profiles of the view of the querier within
+// the time range of the request, grouped by matching series and ordered by
+// timestamp.
+func (q *headInMemoryQuerier) matchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (map[model.Fingerprint]*profileSeries, error) {
 	index := q.head.profiles.index
 
 	ids, err := index.selectMatchingFPs(ctx, params)
@@ -168,35 +335,65 @@ func (q *headInMemoryQuerier) SelectMatchingProfiles(ctx context.Context, params
 		return nil, err
 	}
 
-	// get time nano information for profiles
 	var (
-		start = model.Time(params.Start)
-		end   = model.Time(params.End)
+		start    = model.Time(params.Start).UnixNano()
+		end      = model.Time(params.End).UnixNano()
+		inMemory = q.view.inMemorySeries()
+		series   = make(map[model.Fingerprint]*profileSeries, len(ids))
 	)
-
-	iters := make([]iter.Iterator[Profile], 0, len(ids))
 	index.mutex.RLock()
 	defer index.mutex.RUnlock()
-
 	for _, fp := range ids {
-		profileSeries, ok := index.profilesPerFP[fp]
-		if !ok {
+		profiles := inMemory[fp]
+		// the profiles of the series are ordered by timestamp
+		i := sort.Search(len(profiles), func(i int) bool { return profiles[i].TimeNanos >= start })
+		j := sort.Search(len(profiles), func(i int) bool { return profiles[i].TimeNanos > end })
+		if i >= j {
 			continue
 		}
+		if s, ok := index.profilesPerFP[fp]; ok {
+			series[fp] = &profileSeries{lbs: s.lbs, fp: fp, profiles: profiles[i:j:j]}
+		}
+	}
+	return series, nil
+}
 
-		var profiles = make([]*schemav1.Profile, len(profileSeries.profiles))
-		copy(profiles, profileSeries.profiles)
+func (q *headInMemoryQuerier) CountMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (map[model.Fingerprint]uint64, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "CountMatchingProfiles - HeadInMemory")
+	defer sp.Finish()
+	series, err := q.matchingProfiles(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[model.Fingerprint]uint64, len(series))
+	for fp, s := range series {
+		counts[fp] = uint64(len(s.profiles))
+	}
+	return counts, nil
+}
+
+func (q *headInMemoryQuerier) SelectByIDRange(ctx context.Context, lo, hi uuid.UUID, params *ingestv1.SelectProfilesRequest) ([]ProfileWithID, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectByIDRange - HeadInMemory")
+	defer sp.Finish()
 
-		iters = append(iters,
-			NewSeriesIterator(
-				profileSeries.lbs,
-				profileSeries.fp,
-				iter.NewTimeRangedIterator(iter.NewSliceIterator(profiles), start, end),
-			),
-		)
+	series, err := q.matchingProfiles(ctx, params)
+	if err != nil {
+		return nil, err
 	}
 
-	return iter.NewSortProfileIterator(iters), nil
+	var result []ProfileWithID
+	for _, profileSeries := range series {
+		for _, p := range profileSeries.profiles {
+			if !idInRange(p.ID, lo, hi) {
+				continue
+			}
+			result = append(result, ProfileWithID{
+				Profile: ProfileWithLabels{Profile: p, lbs: profileSeries.lbs, fp: profileSeries.fp},
+				ID:      p.ID,
+			})
+		}
+	}
+	return result, nil
 }
 
 func (q *headInMemoryQuerier) InRange(start, end model.Time) bool {
@@ -204,11 +401,30 @@ func (q *headInMemoryQuerier) InRange(start, end model.Time) bool {
 	return q.head.InRange(start, end)
 }
 
-func (q *headInMemoryQuerier) MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile]) (*ingestv1.MergeProfilesStacktracesResult, error) {
+func (q *headInMemoryQuerier) MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile], opts MergeStacktracesOptions) (*ingestv1.MergeProfilesStacktracesResult, error) {
 	sp, _ := opentracing.StartSpanFromContext(ctx, "MergeByStacktraces - HeadInMemory")
 	defer sp.Finish()
 
-	stacktraceSamples := stacktraceSampleMap{}
+	if opts.SplitBySampleLabel != "" {
+		values := make(sampleLabelValues)
+		nameID, lookupString := q.head.stringsLookup(opts.SplitBySampleLabel)
+		for rows.Next() {
+			p, ok := rows.At().(ProfileWithLabels)
+			if !ok {
+				return nil, errors.New("expected ProfileWithLabels")
+			}
+			values.add(p, p.Samples(), opts.periodFactor(p.Profile.Period), opts.SplitBySampleLabel, nameID, lookupString)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return q.head.resolveSplitStacktraces(ctx, values, opts), nil
+	}
+
+	var (
+		stacktraceSamples = stacktraceSampleMap{}
+		mem               = contextQueryMemory(ctx)
+	)
 
 	q.head.stacktraces.lock.RLock()
 	for rows.Next() {
@@ -217,6 +433,8 @@ func (q *headInMemoryQuerier) MergeByStacktraces(ctx context.Context, rows iter.
 			return nil, errors.New("expected ProfileWithLabels")
 		}
 
+		accounted := len(stacktraceSamples)
+		factor := opts.periodFactor(p.Profile.Period)
 		for _, s := range p.Samples() {
 			if s.Value == 0 {
 				continue
@@ -224,7 +442,11 @@ func (q *headInMemoryQuerier) MergeByStacktraces(ctx context.Context, rows iter.
 			if _, exists := stacktraceSamples[int64(s.StacktraceID)]; !exists {
 				stacktraceSamples[int64(s.StacktraceID)] = &ingestv1.StacktraceSample{}
 			}
-			stacktraceSamples[int64(s.StacktraceID)].Value += s.Value
+			stacktraceSamples[int64(s.StacktraceID)].Value += s.Value * factor
+		}
+		if err := mem.reserve(int64(len(stacktraceSamples)-accounted) * stacktraceSampleBytes); err != nil {
+			q.head.stacktraces.lock.RUnlock()
+			return nil, err
 		}
 	}
 	if err := rows.Err(); err != nil {
@@ -232,20 +454,41 @@ func (q *headInMemoryQuerier) MergeByStacktraces(ctx context.Context, rows iter.
 	}
 	q.head.stacktraces.lock.RUnlock()
 
-	return q.head.resolveStacktraces(ctx, stacktraceSamples), nil
+	return q.head.resolveStacktraces(ctx, stacktraceSamples, opts), nil
 }
 
-func (q *headInMemoryQuerier) MergePprof(ctx context.Context, rows iter.Iterator[Profile]) (*profile.Profile, error) {
+func (q *headInMemoryQuerier) MergePprof(ctx context.Context, rows iter.Iterator[Profile], opts MergePprofOptions) (*profile.Profile, error) {
 	sp, _ := opentracing.StartSpanFromContext(ctx, "MergePprof - HeadInMemory")
 	defer sp.Finish()
 
-	stacktraceSamples := profileSampleMap{}
+	var (
+		stacktraceSamples = profileSampleMap{}
+		comments          profileComments
+	)
+
+	if opts.SampleLabel != nil {
+		nameID, lookupString := q.head.stringsLookup(opts.SampleLabel.Name)
+		filter := newSampleLabelFilter(opts.SampleLabel, nameID, lookupString)
+		for rows.Next() {
+			p, ok := rows.At().(ProfileWithLabels)
+			if !ok {
+				return nil, errors.New("expected ProfileWithLabels")
+			}
+			filter.add(stacktraceSamples, p.Samples())
+			comments.add(p.Profile.Comments...)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return q.head.resolvePprof(ctx, stacktraceSamples, comments), nil
+	}
 
 	for rows.Next() {
 		p, ok := rows.At().(ProfileWithLabels)
 		if !ok {
 			return nil, errors.New("expected ProfileWithLabels")
 		}
+		comments.add(p.Profile.Comments...)
 
 		for _, s := range p.Samples() {
 			if s.Value == 0 {
@@ -258,7 +501,7 @@ func (q *headInMemoryQuerier) MergePprof(ctx context.Context, rows iter.Iterator
 		}
 	}
 
-	return q.head.resolvePprof(ctx, stacktraceSamples), nil
+	return q.head.resolvePprof(ctx, stacktraceSamples, comments), nil
 
 }
 
@@ -308,6 +551,33 @@ func (q *headInMemoryQuerier) MergeByLabels(ctx context.Context, rows iter.Itera
 	return seriesByLabels.normalize(), nil
 }
 
+func (q *headInMemoryQuerier) Totals(ctx context.Context, rows iter.Iterator[Profile]) ([]ProfileWithTotal, error) {
+	sp, _ := opentracing.StartSpanFromContext(ctx, "Totals - HeadInMemory")
+	defer sp.Finish()
+
+	var result []ProfileWithTotal
+	for rows.Next() {
+		p, ok := rows.At().(ProfileWithLabels)
+		if !ok {
+			return nil, errors.New("expected ProfileWithLabels")
+		}
+		result = append(result, ProfileWithTotal{Profile: p, Total: p.Total()})
+	}
+	return result, rows.Err()
+}
+
+func (q *headInMemoryQuerier) Series(ctx context.Context, matchers []*labels.Matcher, start, end model.Time) ([]phlaremodel.Labels, error) {
+	sp, _ := opentracing.StartSpanFromContext(ctx, "Series - HeadInMemory")
+	defer sp.Finish()
+	return q.head.profiles.index.matchingSeries(matchers, start, end)
+}
+
+func (q *headInMemoryQuerier) SeriesMaxTimes(ctx context.Context) ([]SeriesMaxTime, error) {
+	sp, _ := opentracing.StartSpanFromContext(ctx, "SeriesMaxTimes - HeadInMemory")
+	defer sp.Finish()
+	return q.head.profiles.index.seriesMaxTimes(), nil
+}
+
 func (q *headInMemoryQuerier) Sort(in []Profile) []Profile {
 	return in
 }
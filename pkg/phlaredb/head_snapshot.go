@@ -0,0 +1,317 @@
+package phlaredb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/segmentio/parquet-go"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+// headSnapshotMagic starts every snapshot written by Head.Snapshot, it
+// changes with the format.
+var headSnapshotMagic = []byte("PHLAREHEADSNAP1\n")
+
+// Snapshot writes the content of the head to w, so it can be restored by
+// RestoreHead after a restart.
+//
+// The snapshot holds the labels of the series, the symbol tables and the
+// profiles, including the ones already cut into row groups. Each section is
+// a length prefixed parquet file using the schema of the block files, the
+// profiles reference the series by their position in the snapshot. The state
+// of the delta computation is not part of the snapshot, so the first
+// cumulative profile of a series after the restore is stored as is.
+func (h *Head) Snapshot(w io.Writer) error {
+	// the profiles are captured before the symbols they reference, as
+	// symbols are ingested first and never removed.
+	series, profiles, err := h.profiles.snapshot()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(headSnapshotMagic); err != nil {
+		return err
+	}
+	if err := writeSnapshotSection(bw, func(w io.Writer) error {
+		return writeSnapshotSeries(w, series)
+	}); err != nil {
+		return errors.Wrap(err, "writing series")
+	}
+	if err := writeSnapshotTable[string, *schemav1.StringPersister](bw, h.strings.elements()); err != nil {
+		return errors.Wrap(err, "writing strings")
+	}
+	if err := writeSnapshotTable[*profilev1.Mapping, *schemav1.MappingPersister](bw, h.mappings.elements()); err != nil {
+		return errors.Wrap(err, "writing mappings")
+	}
+	if err := writeSnapshotTable[*profilev1.Function, *schemav1.FunctionPersister](bw, h.functions.elements()); err != nil {
+		return errors.Wrap(err, "writing functions")
+	}
+	if err := writeSnapshotTable[*profilev1.Location, *schemav1.LocationPersister](bw, h.locations.elements()); err != nil {
+		return errors.Wrap(err, "writing locations")
+	}
+	if err := writeSnapshotTable[*schemav1.Stacktrace, *schemav1.StacktracePersister](bw, h.stacktraces.elements()); err != nil {
+		return errors.Wrap(err, "writing stacktraces")
+	}
+	if err := writeSnapshotTable[*schemav1.Profile, *schemav1.ProfilePersister](bw, profiles); err != nil {
+		return errors.Wrap(err, "writing profiles")
+	}
+	return bw.Flush()
+}
+
+// RestoreHead creates a new head and ingests the content of a snapshot
+// written by Head.Snapshot. The restored head gets a new ULID and keeps all
+// profiles in memory until its next row group cut.
+func RestoreHead(phlarectx context.Context, cfg Config, limiter TenantLimiter, r io.Reader) (*Head, error) {
+	h, err := NewHead(phlarectx, cfg, limiter)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.restore(r); err != nil {
+		_ = h.Close()
+		_ = os.RemoveAll(h.headPath)
+		return nil, errors.Wrap(err, "restoring head snapshot")
+	}
+	return h, nil
+}
+
+func (h *Head) restore(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(headSnapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if !bytes.Equal(magic, headSnapshotMagic) {
+		return errors.New("not a head snapshot")
+	}
+
+	section, err := readSnapshotSection(br)
+	if err != nil {
+		return errors.Wrap(err, "reading series")
+	}
+	series, err := readSnapshotSeries(section)
+	if err != nil {
+		return errors.Wrap(err, "reading series")
+	}
+
+	strings, err := readSnapshotTable[string, *schemav1.StringPersister](br)
+	if err != nil {
+		return errors.Wrap(err, "reading strings")
+	}
+	mappings, err := readSnapshotTable[*profilev1.Mapping, *schemav1.MappingPersister](br)
+	if err != nil {
+		return errors.Wrap(err, "reading mappings")
+	}
+	functions, err := readSnapshotTable[*profilev1.Function, *schemav1.FunctionPersister](br)
+	if err != nil {
+		return errors.Wrap(err, "reading functions")
+	}
+	locations, err := readSnapshotTable[*profilev1.Location, *schemav1.LocationPersister](br)
+	if err != nil {
+		return errors.Wrap(err, "reading locations")
+	}
+	stacktraces, err := readSnapshotTable[*schemav1.Stacktrace, *schemav1.StacktracePersister](br)
+	if err != nil {
+		return errors.Wrap(err, "reading stacktraces")
+	}
+	profiles, err := readSnapshotTable[*schemav1.Profile, *schemav1.ProfilePersister](br)
+	if err != nil {
+		return errors.Wrap(err, "reading profiles")
+	}
+
+	h.strings.restore(strings)
+	h.mappings.restore(mappings)
+	h.functions.restore(functions)
+	h.locations.restore(locations)
+	h.stacktraces.restore(stacktraces)
+
+	// profiles are ordered by series and time, so they pass the out of order checks
+	for _, p := range profiles {
+		if int(p.SeriesIndex) >= len(series) {
+			return errors.Errorf("profile %s references series %d, which does not exist", p.ID, p.SeriesIndex)
+		}
+		for _, s := range p.Samples {
+			if s.StacktraceID >= uint64(len(stacktraces)) {
+				return errors.Errorf("profile %s references stacktrace %d, which does not exist", p.ID, s.StacktraceID)
+			}
+		}
+		lbs := series[p.SeriesIndex]
+		p.SeriesFingerprint = model.Fingerprint(lbs.Hash())
+		if err := h.allowProfile([]phlaremodel.Labels{lbs}, []model.Fingerprint{p.SeriesFingerprint}, p.TimeNanos); err != nil {
+			return err
+		}
+		if err := h.profiles.add([]*schemav1.Profile{p}, lbs, lbs.Get(model.MetricNameLabel)); err != nil {
+			return err
+		}
+		h.totalSamples.Add(uint64(len(p.Samples)))
+		h.updateTimeRange(p.TimeNanos, p.TimeNanos)
+	}
+
+	h.updateStatsMetrics()
+	return nil
+}
+
+// snapshot returns the labels of all series ordered by labels and copies of
+// all profiles, whose SeriesIndex is the position of their series.
+func (s *profileStore) snapshot() ([]phlaremodel.Labels, []*schemav1.Profile, error) {
+	// prevents row groups from being cut while they are read
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	s.index.mutex.RLock()
+	defer s.index.mutex.RUnlock()
+
+	pfs := make([]*profileSeries, 0, len(s.index.profilesPerFP))
+	for _, ps := range s.index.profilesPerFP {
+		pfs = append(pfs, ps)
+	}
+	sortProfileSeries(pfs)
+
+	var (
+		series   = make([]phlaremodel.Labels, len(pfs))
+		profiles []*schemav1.Profile
+	)
+	for i, ps := range pfs {
+		series[i] = ps.lbs
+		for rgIdx, rowRanges := range ps.profilesOnDisk {
+			for _, rR := range rowRanges {
+				onDisk, err := readProfileRowRange(s.rowGroups[rgIdx], rR)
+				if err != nil {
+					return nil, nil, errors.Wrap(err, "reading profiles from row group")
+				}
+				for _, p := range onDisk {
+					p.SeriesIndex = uint32(i)
+				}
+				profiles = append(profiles, onDisk...)
+			}
+		}
+		for _, p := range ps.profiles {
+			c := *p
+			c.SeriesIndex = uint32(i)
+			profiles = append(profiles, &c)
+		}
+	}
+	return series, profiles, nil
+}
+
+func readProfileRowRange(rg parquet.RowGroup, rR *rowRange) ([]*schemav1.Profile, error) {
+	var (
+		persister = &schemav1.ProfilePersister{}
+		rows      = rg.Rows()
+		buf       = make([]parquet.Row, rR.length)
+	)
+	defer rows.Close()
+	if err := rows.SeekToRow(rR.rowNum); err != nil {
+		return nil, err
+	}
+	for read := 0; read < len(buf); {
+		n, err := rows.ReadRows(buf[read:])
+		read += n
+		if err == io.EOF && read < len(buf) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	profiles := make([]*schemav1.Profile, len(buf))
+	for i, row := range buf {
+		_, p, err := persister.Reconstruct(row)
+		if err != nil {
+			return nil, err
+		}
+		profiles[i] = p
+	}
+	return profiles, nil
+}
+
+func writeSnapshotSeries(w io.Writer, series []phlaremodel.Labels) error {
+	for _, lbs := range series {
+		b, err := (&typesv1.Labels{Labels: lbs}).MarshalVT()
+		if err != nil {
+			return err
+		}
+		if err := writeUvarint(w, uint64(len(b))); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSnapshotSeries(b []byte) ([]phlaremodel.Labels, error) {
+	var series []phlaremodel.Labels
+	for len(b) > 0 {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return nil, io.ErrUnexpectedEOF
+		}
+		var lbs typesv1.Labels
+		if err := lbs.UnmarshalVT(b[n : n+int(l)]); err != nil {
+			return nil, err
+		}
+		series = append(series, lbs.Labels)
+		b = b[n+int(l):]
+	}
+	return series, nil
+}
+
+func writeSnapshotTable[T any, P schemav1.Persister[T]](w io.Writer, elements []T) error {
+	return writeSnapshotSection(w, func(w io.Writer) error {
+		var rw schemav1.ReadWriter[T, P]
+		return rw.WriteParquetFile(w, elements)
+	})
+}
+
+func readSnapshotTable[T any, P schemav1.Persister[T]](r *bufio.Reader) ([]T, error) {
+	section, err := readSnapshotSection(r)
+	if err != nil {
+		return nil, err
+	}
+	var rw schemav1.ReadWriter[T, P]
+	return rw.ReadParquetFile(bytes.NewReader(section))
+}
+
+// writeSnapshotSection writes the output of fn prefixed by its length.
+func writeSnapshotSection(w io.Writer, fn func(io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := fn(&buf); err != nil {
+		return err
+	}
+	if err := writeUvarint(w, uint64(buf.Len())); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func readSnapshotSection(r *bufio.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	section := make([]byte, l)
+	if _, err := io.ReadFull(r, section); err != nil {
+		return nil, err
+	}
+	return section, nil
+}
+
+func writeUvarint(w io.Writer, v uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.Write(buf[:binary.PutUvarint(buf[:], v)])
+	return err
+}
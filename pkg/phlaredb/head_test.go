@@ -1,8 +1,17 @@
 package phlaredb
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -10,18 +19,27 @@ import (
 
 	"github.com/bufbuild/connect-go"
 	"github.com/google/uuid"
+	"github.com/oklog/ulid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
+	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 
 	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/iter"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
 	"github.com/grafana/phlare/pkg/pprof"
+	pprofth "github.com/grafana/phlare/pkg/pprof/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 type noLimit struct{}
@@ -30,6 +48,10 @@ func (n noLimit) AllowProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNa
 	return nil
 }
 
+func (n noLimit) CheckProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNano int64) error {
+	return nil
+}
+
 func (n noLimit) Stop() {}
 
 var NoLimit = noLimit{}
@@ -48,7 +70,7 @@ type testHead struct {
 	reg *prometheus.Registry
 }
 
-func (t *testHead) Flush(ctx context.Context) error {
+func (t *testHead) Flush(ctx context.Context) ([]FlushedBlock, error) {
 	defer func() {
 		t.t.Logf("flushing head of block %v", t.Head.meta.ULID)
 	}()
@@ -214,6 +236,171 @@ phlare_head_size_bytes{type="strings"} 52
 	))
 }
 
+func TestHeadFlushMetrics(t *testing.T) {
+	ctx := context.Background()
+	head := newTestHead(t)
+	require.NoError(t, ingestStreamProfiles(ctx, head.Ingest, 0, 9, func(_ int, p *pprofth.ProfileBuilder) {
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+	}))
+	_, err := head.Flush(ctx)
+	require.NoError(t, err)
+
+	families, err := head.reg.Gather()
+	require.NoError(t, err)
+	histogram := func(name, table string) *dto.Histogram {
+		for _, f := range families {
+			if f.GetName() != name {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "name" && l.GetValue() == table {
+						return m.GetHistogram()
+					}
+				}
+			}
+		}
+		t.Fatalf("histogram %s for table %s not found", name, table)
+		return nil
+	}
+
+	require.Equal(t, uint64(1), histogram("phlare_head_flushed_table_duration_seconds", "profiles").GetSampleCount())
+	require.Equal(t, uint64(1), histogram("phlare_head_flushed_table_rows", "profiles").GetSampleCount())
+	require.Equal(t, 9.0, histogram("phlare_head_flushed_table_rows", "profiles").GetSampleSum())
+	require.Equal(t, uint64(1), histogram("phlare_head_flushed_table_row_groups", "profiles").GetSampleCount())
+	require.Equal(t, 9.0, testutil.ToFloat64(head.metrics.rowsWritten.WithLabelValues("profiles")))
+	require.Equal(t, 2.0, testutil.ToFloat64(head.metrics.rowsWritten.WithLabelValues("functions")))
+	require.Equal(t, 0, testutil.CollectAndCount(head.metrics.flushFailures))
+}
+
+func TestHeadSeriesMetrics(t *testing.T) {
+	ctx := context.Background()
+	head := newTestHead(t)
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+	}
+	require.Equal(t, 3.0, testutil.ToFloat64(head.metrics.newSeries))
+	require.Equal(t, 3.0, testutil.ToFloat64(head.metrics.activeSeries))
+
+	_, err := head.Flush(ctx)
+
+	require.NoError(t, err)
+	require.Equal(t, 3.0, testutil.ToFloat64(head.metrics.newSeries))
+	require.Equal(t, 0.0, testutil.ToFloat64(head.metrics.activeSeries))
+}
+
+func TestHeadStats(t *testing.T) {
+	head := newTestHead(t)
+	ctx := context.Background()
+
+	require.Equal(t, HeadStats{MemoryBytes: head.MemorySize()}, head.Stats())
+
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+	}
+
+	stats := head.Stats()
+	require.Equal(t, uint64(3), stats.NumSeries)
+	require.Equal(t, uint64(9), stats.NumProfiles)
+	require.Equal(t, uint64(2), stats.NumStacktraces)
+	require.Equal(t, uint64(2), stats.NumFunctions)
+	require.Equal(t, head.MemorySize(), stats.MemoryBytes)
+	require.Equal(t, int64(0), stats.MinTimeNanos)
+	require.Equal(t, 8*time.Second.Nanoseconds(), stats.MaxTimeNanos)
+
+	require.NoError(t, testutil.GatherAndCompare(head.reg,
+		strings.NewReader(`
+# HELP phlare_head_functions Number of distinct functions in the head block.
+# TYPE phlare_head_functions gauge
+phlare_head_functions 2
+# HELP phlare_head_max_time_seconds Maximum timestamp of the profiles in the head block.
+# TYPE phlare_head_max_time_seconds gauge
+phlare_head_max_time_seconds 8
+# HELP phlare_head_min_time_seconds Minimum timestamp of the profiles in the head block.
+# TYPE phlare_head_min_time_seconds gauge
+phlare_head_min_time_seconds 0
+# HELP phlare_head_profiles Total number of profiles in the head block.
+# TYPE phlare_head_profiles gauge
+phlare_head_profiles 9
+# HELP phlare_head_stacktraces Number of distinct stacktraces in the head block.
+# TYPE phlare_head_stacktraces gauge
+phlare_head_stacktraces 2
+# HELP phlare_tsdb_head_series Total number of series in the head block.
+# TYPE phlare_tsdb_head_series gauge
+phlare_tsdb_head_series 3
+`),
+		"phlare_head_functions",
+		"phlare_head_max_time_seconds",
+		"phlare_head_min_time_seconds",
+		"phlare_head_profiles",
+		"phlare_head_stacktraces",
+		"phlare_tsdb_head_series",
+	))
+}
+
+func TestHeadTruncate(t *testing.T) {
+	head := newTestHead(t)
+	ctx := context.Background()
+
+	oldProfile := func(ts time.Duration) *pprofth.ProfileBuilder {
+		p := pprofth.NewProfileBuilder(int64(ts)).CPUProfile().WithLabels("job", "foo", "stream", "stream-old")
+		p.ForStacktraceString("func3").AddSamples(5)
+		return p
+	}
+	p := oldProfile(time.Second)
+	require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+	}
+	require.Equal(t, uint64(4), head.Stats().NumSeries)
+	require.Equal(t, uint64(3), head.Stats().NumStacktraces)
+
+	dropped, err := head.Truncate(time.Unix(5, 0))
+	require.NoError(t, err)
+	require.Equal(t, 6, dropped)
+
+	stats := head.Stats()
+	require.Equal(t, uint64(3), stats.NumSeries)
+	require.Equal(t, uint64(5), stats.NumProfiles)
+	require.Equal(t, uint64(2), stats.NumStacktraces)
+	require.Equal(t, 5*time.Second.Nanoseconds(), stats.MinTimeNanos)
+	require.Equal(t, 9*time.Second.Nanoseconds(), stats.MaxTimeNanos)
+
+	res, err := head.LabelValues(ctx, connect.NewRequest(&ingestv1.LabelValuesRequest{Name: "stream"}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"stream-a", "stream-b", "stream-c"}, res.Msg.Names)
+
+	params := &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+	}
+	it, err := head.Queriers().SelectMatchingProfiles(ctx, params)
+	require.NoError(t, err)
+	profiles, err := iter.Slice(it)
+	require.NoError(t, err)
+	timestamps := make([]int64, len(profiles))
+	for i, p := range profiles {
+		timestamps[i] = p.Timestamp().Unix()
+	}
+	require.Equal(t, []int64{5, 6, 7, 8, 9}, timestamps)
+
+	// the released stacktrace gets a new ID, once it is ingested again
+	p = oldProfile(10 * time.Second)
+	require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	r, err := head.Queriers().SelectCollapsed(ctx, params)
+	require.NoError(t, err)
+	collapsed, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "func1 100\nfunc2;func1 50\nfunc3 5\n", string(collapsed))
+
+	// nothing is left to drop
+	dropped, err = head.Truncate(time.Unix(5, 0))
+	require.NoError(t, err)
+	require.Zero(t, dropped)
+}
+
 func TestHeadIngestFunctions(t *testing.T) {
 	head := newTestHead(t)
 
@@ -248,6 +435,22 @@ func TestHeadIngestStrings(t *testing.T) {
 	require.Equal(t, stringConversionTable{0, 7}, r.strings)
 }
 
+func TestHeadStringsLookup(t *testing.T) {
+	ctx := context.Background()
+	head := newTestHead(t)
+	require.NoError(t, head.strings.ingest(ctx, newProfileFoo().StringTable, &rewriter{}))
+
+	id, lookup := head.stringsLookup("func_b")
+	require.Equal(t, int64(4), id)
+	missing, _ := head.stringsLookup("func_c")
+	require.Equal(t, int64(-1), missing)
+
+	// the lookup doesn't keep strings from being ingested
+	require.NoError(t, head.strings.ingest(ctx, newProfileBaz().StringTable, &rewriter{}))
+	require.Equal(t, "func_b", lookup(id))
+	require.Equal(t, "func_c", lookup(6))
+}
+
 func TestHeadIngestStacktraces(t *testing.T) {
 	ctx := context.Background()
 	head := newTestHead(t)
@@ -301,6 +504,86 @@ func TestHeadLabelNames(t *testing.T) {
 	require.Equal(t, []string{"__period_type__", "__period_unit__", "__profile_type__", "__type__", "__unit__", "job", "namespace"}, res.Msg.Names)
 }
 
+func TestHeadForEachSeries(t *testing.T) {
+	head := newTestHead(t)
+	ctx := context.Background()
+
+	// cut row groups, so some of the profiles are on disk
+	head.profiles.cfg = &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 4}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+	}
+	require.NotEmpty(t, head.profiles.rowGroups)
+
+	var (
+		fps          []model.Fingerprint
+		countsByName = map[string]int{}
+	)
+	require.NoError(t, head.ForEachSeries(func(fp model.Fingerprint, lbls phlaremodel.Labels, profileCount int) error {
+		fps = append(fps, fp)
+		require.Equal(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds", lbls.Get(phlaremodel.LabelNameProfileType))
+		countsByName[lbls.Get("stream")] = profileCount
+		return nil
+	}))
+	require.Len(t, fps, 3)
+	require.True(t, sort.SliceIsSorted(fps, func(i, j int) bool { return fps[i] < fps[j] }))
+	require.Equal(t, map[string]int{"stream-a": 4, "stream-b": 3, "stream-c": 3}, countsByName)
+
+	// iteration stops at the first error
+	var visited int
+	err := head.ForEachSeries(func(model.Fingerprint, phlaremodel.Labels, int) error {
+		visited++
+		return errors.New("stop")
+	})
+	require.EqualError(t, err, "stop")
+	require.Equal(t, 1, visited)
+}
+
+// TestHeadFlushSharedSymbols ensures that the symbols are deduplicated for
+// the whole block, even when the profiles are split into many row groups.
+func TestHeadFlushSharedSymbols(t *testing.T) {
+	ctx := context.Background()
+	head := newTestHead(t)
+	head.profiles.cfg = &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 2}
+
+	require.NoError(t, ingestStreamProfiles(ctx, head.Ingest, 0, 20, func(_ int, p *pprofth.ProfileBuilder) {
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+		p.ForStacktraceString("func1", "func3").AddSamples(20)
+		p.ForStacktraceString("func1").AddSamples(30)
+	}))
+	_, err := head.Flush(ctx)
+	require.NoError(t, err)
+
+	type storedStacktrace struct {
+		ID          uint64
+		LocationIDs []uint64 `parquet:",list"`
+	}
+	stacktraces, _ := readFullParquetFile[storedStacktrace](t, filepath.Join(head.localPath, "stacktraces.parquet"))
+	require.Len(t, stacktraces, 3)
+	ids := make(map[uint64]struct{}, len(stacktraces))
+	locations := make(map[string]struct{}, len(stacktraces))
+	for _, s := range stacktraces {
+		ids[s.ID] = struct{}{}
+		locations[fmt.Sprint(s.LocationIDs)] = struct{}{}
+	}
+	require.Len(t, ids, 3)
+	require.Len(t, locations, 3)
+
+	profiles, numRGs := readFullParquetFile[*schemav1.Profile](t, filepath.Join(head.localPath, "profiles.parquet"))
+	require.Len(t, profiles, 20)
+	require.Equal(t, uint64(10), numRGs)
+	used := make(map[uint64]struct{}, len(ids))
+	for _, p := range profiles {
+		require.Len(t, p.Samples, 3)
+		for _, s := range p.Samples {
+			require.Contains(t, ids, s.StacktraceID)
+			used[s.StacktraceID] = struct{}{}
+		}
+	}
+	require.Equal(t, ids, used)
+}
+
 func TestHeadSeries(t *testing.T) {
 	head := newTestHead(t)
 	fooLabels := phlaremodel.NewLabelsBuilder(nil).Set("namespace", "phlare").Set("job", "foo").Labels()
@@ -322,6 +605,26 @@ func TestHeadSeries(t *testing.T) {
 	require.Equal(t, []*typesv1.Labels{{Labels: expected}}, res.Msg.LabelsSet)
 }
 
+// TestHeadSeriesFingerprintCollision ensures that the profiles of a series
+// are not merged into another series with the same fingerprint.
+func TestHeadSeriesFingerprintCollision(t *testing.T) {
+	head := newTestHead(t)
+	fooLabels := phlaremodel.NewLabelsBuilder(nil).Set("namespace", "phlare").Set("job", "foo").Labels()
+	barLabels := phlaremodel.NewLabelsBuilder(nil).Set("namespace", "phlare").Set("job", "bar").Labels()
+	require.NoError(t, head.Ingest(context.Background(), newProfileFoo(), uuid.New(), fooLabels...))
+	require.NoError(t, head.Ingest(context.Background(), newProfileBar(), uuid.New(), barLabels...))
+
+	series := head.profiles.index.snapshotSeries()
+	require.Len(t, series, 2)
+
+	// a crafted collision, as finding one of the 64-bit hash is impractical
+	require.NoError(t, head.profiles.index.allowProfile(series[0].fp, series[0].lbs, time.Now().UnixNano(), 0))
+	err := head.profiles.index.allowProfile(series[0].fp, series[1].lbs, time.Now().UnixNano(), 0)
+	require.ErrorIs(t, err, ErrInvalidProfile)
+	require.Equal(t, validation.FingerprintCollision, validation.ReasonOf(err))
+	require.Contains(t, err.Error(), "has the same fingerprint")
+}
+
 func TestHeadProfileTypes(t *testing.T) {
 	head := newTestHead(t)
 	require.NoError(t, head.Ingest(context.Background(), newProfileFoo(), uuid.New(), &typesv1.LabelPair{Name: "__name__", Value: "foo"}, &typesv1.LabelPair{Name: "job", Value: "foo"}, &typesv1.LabelPair{Name: "namespace", Value: "phlare"}))
@@ -361,7 +664,9 @@ func TestHeadIngestRealProfiles(t *testing.T) {
 		})
 	}
 
-	require.NoError(t, head.Flush(ctx))
+	_, err := head.Flush(ctx)
+
+	require.NoError(t, err)
 	t.Logf("strings=%d samples=%d", len(head.strings.slice), head.totalSamples.Load())
 }
 
@@ -392,7 +697,7 @@ func TestHead_Concurrent_Ingest_Querying(t *testing.T) {
 			defer tick.Stop()
 			for j := 0; j < profilesPerSeries; j++ {
 				<-tick.C
-				require.NoError(t, ingestThreeProfileStreams(ctx, profilesPerSeries*i+j, head.Ingest))
+				require.NoError(t, ingestThreeProfileStreams(ctx, 3*j+i, head.Ingest))
 			}
 			t.Logf("ingest stream %s done", streams[i])
 		}(i)
@@ -470,3 +775,1026 @@ func BenchmarkHeadIngestProfiles(t *testing.B) {
 		}
 	}
 }
+
+func newBatchTestProfiles(n int) []IngestInput {
+	profiles := make([]IngestInput, n)
+	for i := range profiles {
+		p := pprofth.NewProfileBuilder(int64(i)).
+			CPUProfile().
+			WithLabels("stream", streams[i%3])
+		p.ForStacktraceString("my", "other").AddSamples(int64(i + 1))
+		p.ForStacktraceString("my", "other", fmt.Sprintf("func_%d", i%100)).AddSamples(1)
+		profiles[i] = IngestInput{Profile: p.Profile, ID: p.UUID, ExternalLabels: p.Labels}
+	}
+	return profiles
+}
+
+func TestHeadIngestBatch(t *testing.T) {
+	ctx := context.Background()
+
+	// ingest profiles one by one for comparison
+	expected := newTestHead(t)
+	for _, in := range newBatchTestProfiles(6) {
+		require.NoError(t, expected.Ingest(ctx, in.Profile, in.ID, in.ExternalLabels...))
+	}
+
+	head := newTestHead(t)
+	profiles := newBatchTestProfiles(6)
+	require.NoError(t, head.IngestBatch(ctx, profiles))
+	require.Equal(t, expected.Stats(), head.Stats())
+	require.Equal(t, expected.strings.slice, head.strings.slice)
+	require.Equal(t, expected.functions.slice, head.functions.slice)
+	require.Equal(t, expected.locations.slice, head.locations.slice)
+	require.Equal(t, expected.stacktraces.slice, head.stacktraces.slice)
+}
+
+func TestHeadIngestBatchWithInvalidProfile(t *testing.T) {
+	ctx := context.Background()
+	head := newTestHead(t)
+
+	profiles := newBatchTestProfiles(4)
+	// reference a location, which doesn't exist
+	profiles[2].Profile.Sample[0].LocationId = append(profiles[2].Profile.Sample[0].LocationId, 42)
+
+	err := head.IngestBatch(ctx, profiles)
+	require.EqualError(t, err, "profile 2: sample 0 references unknown location 42")
+	require.ErrorIs(t, err, ErrInvalidProfile)
+
+	stats := head.Stats()
+	require.Equal(t, uint64(2), stats.NumSeries)
+	require.Equal(t, uint64(3), stats.NumProfiles)
+	require.Equal(t, int64(0), stats.MinTimeNanos)
+	require.Equal(t, int64(3), stats.MaxTimeNanos)
+}
+
+func TestHeadIngestInvalidProfile(t *testing.T) {
+	ctx := context.Background()
+	head := newTestHead(t)
+
+	in := newBatchTestProfiles(1)[0]
+	in.Profile.Sample[0].LocationId = append(in.Profile.Sample[0].LocationId, 42)
+
+	err := head.Ingest(ctx, in.Profile, in.ID, in.ExternalLabels...)
+	require.EqualError(t, err, "sample 0 references unknown location 42")
+	require.ErrorIs(t, err, ErrInvalidProfile)
+	require.Equal(t, uint64(0), head.Stats().NumProfiles)
+	require.Len(t, head.strings.slice, 0)
+}
+
+// BenchmarkHeadFlushRepetitiveStacks reports the size of a block, which
+// consists of many row groups of profiles sharing the same stacktraces.
+func BenchmarkHeadFlushRepetitiveStacks(b *testing.B) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		head := newTestHead(b)
+		head.profiles.cfg = &ParquetConfig{MaxRowGroupBytes: 128 * 1024 * 1024, MaxBufferRowCount: 100}
+		require.NoError(b, ingestStreamProfiles(ctx, head.Ingest, 0, 1000, func(i int, p *pprofth.ProfileBuilder) {
+			for j := 0; j < 50; j++ {
+				p.ForStacktraceString("main", fmt.Sprintf("func%d", j), "leaf").AddSamples(int64(i + j))
+			}
+		}))
+		b.StartTimer()
+
+		_, err := head.Flush(ctx)
+
+		require.NoError(b, err)
+
+		b.StopTimer()
+		var size int64
+		entries, err := os.ReadDir(head.localPath)
+		require.NoError(b, err)
+		for _, e := range entries {
+			info, err := e.Info()
+			require.NoError(b, err)
+			size += info.Size()
+		}
+		b.ReportMetric(float64(size), "block-bytes")
+		b.StartTimer()
+	}
+}
+
+func BenchmarkHeadIngest10kProfiles(b *testing.B) {
+	ctx := context.Background()
+
+	b.Run("per-profile", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			head := newTestHead(b)
+			profiles := newBatchTestProfiles(10_000)
+			b.StartTimer()
+
+			for _, in := range profiles {
+				require.NoError(b, head.Ingest(ctx, in.Profile, in.ID, in.ExternalLabels...))
+			}
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			head := newTestHead(b)
+			profiles := newBatchTestProfiles(10_000)
+			b.StartTimer()
+
+			require.NoError(b, head.IngestBatch(ctx, profiles))
+		}
+	})
+}
+
+func TestHeadGeneratedProfileIDs(t *testing.T) {
+	ctx := context.Background()
+	head := newTestHead(t)
+
+	explicit := uuid.MustParse("00000000-0000-0000-0000-000000000042")
+	before := time.Now()
+	for i := 0; i < 100; i++ {
+		p := pprofth.NewProfileBuilder(int64(i)).CPUProfile().WithLabels("stream", streams[i%3])
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+		id := uuid.Nil
+		if i == 50 {
+			id = explicit
+		}
+		require.NoError(t, head.Ingest(ctx, p.Profile, id, p.Labels...))
+	}
+	after := time.Now()
+
+	head.profiles.lock.RLock()
+	profiles := head.profiles.slice
+	head.profiles.lock.RUnlock()
+	require.Len(t, profiles, 100)
+	require.Equal(t, explicit, profiles[50].ID)
+
+	var (
+		previous ulid.ULID
+		seen     = map[uuid.UUID]struct{}{}
+	)
+	for i, p := range profiles {
+		if i == 50 {
+			continue
+		}
+		id := ulid.ULID(p.ID)
+		require.Greater(t, id.Compare(previous), 0, "profile %d", i)
+		require.GreaterOrEqual(t, id.Time(), ulid.Timestamp(before))
+		require.LessOrEqual(t, id.Time(), ulid.Timestamp(after))
+		_, exists := seen[p.ID]
+		require.False(t, exists)
+		seen[p.ID] = struct{}{}
+		previous = id
+	}
+}
+
+func TestULIDGeneratorClockGoingBackwards(t *testing.T) {
+	now := time.Unix(1000, 0)
+	g := NewULIDGenerator().(*ulidGenerator)
+	g.now = func() time.Time { return now }
+
+	first := ulid.ULID(g.NewID())
+	now = now.Add(-time.Minute)
+	second := ulid.ULID(g.NewID())
+	require.Greater(t, second.Compare(first), 0)
+	require.Equal(t, first.Time(), second.Time())
+}
+
+func TestHeadTimestampResolution(t *testing.T) {
+	ctx := testContext(t)
+	head, err := NewHead(ctx, Config{DataPath: t.TempDir(), TimestampResolution: time.Second}, NoLimit)
+	require.NoError(t, err)
+
+	for _, ts := range []time.Duration{1500 * time.Millisecond, 2700 * time.Millisecond, 3200 * time.Millisecond} {
+		p := pprofth.NewProfileBuilder(int64(ts)).CPUProfile()
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+		// the profile of the caller is left untouched
+		require.Equal(t, int64(ts), p.TimeNanos)
+	}
+
+	// neither is a rejected profile modified
+	p := pprofth.NewProfileBuilder(int64(500 * time.Millisecond)).CPUProfile()
+	p.ForStacktraceString("func1", "func2").AddSamples(10)
+	require.ErrorIs(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...), ErrOutOfOrder)
+	require.Equal(t, int64(500*time.Millisecond), p.TimeNanos)
+	require.Error(t, head.IngestBatch(ctx, []IngestInput{{Profile: p.Profile, ID: p.UUID, ExternalLabels: p.Labels}}))
+	require.Equal(t, int64(500*time.Millisecond), p.TimeNanos)
+
+	require.Equal(t, int64(time.Second), head.meta.MinTime.UnixNano())
+	require.Equal(t, int64(3*time.Second), head.meta.MaxTime.UnixNano())
+
+	selectProfiles := func(start, end model.Time) ([]model.Time, int64) {
+		it, err := head.Queriers().SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{}`,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         int64(start),
+			End:           int64(end),
+		})
+		require.NoError(t, err)
+		profiles, err := iter.Slice(it)
+		require.NoError(t, err)
+		result, err := head.Queriers()[0].MergeByStacktraces(ctx, iter.NewSliceIterator(profiles), MergeStacktracesOptions{})
+		require.NoError(t, err)
+		var total int64
+		for _, s := range result.Stacktraces {
+			total += s.Value
+		}
+		return lo.Map(profiles, func(p Profile, _ int) model.Time { return p.Timestamp() }), total
+	}
+
+	// the timestamps are floored to the second, the values are kept
+	timestamps, total := selectProfiles(0, 10000)
+	require.Equal(t, []model.Time{1000, 2000, 3000}, timestamps)
+	require.Equal(t, int64(30), total)
+
+	timestamps, total = selectProfiles(2000, 2500)
+	require.Equal(t, []model.Time{2000}, timestamps)
+	require.Equal(t, int64(10), total)
+
+	timestamps, _ = selectProfiles(2500, 2999)
+	require.Empty(t, timestamps)
+}
+
+func TestHeadSeriesReservoir(t *testing.T) {
+	ctx := testContext(t)
+	head, err := NewHead(ctx, Config{DataPath: t.TempDir(), SeriesReservoirSize: 10}, NoLimit)
+	require.NoError(t, err)
+	head.reservoirs.rand = rand.New(rand.NewSource(1))
+
+	var total int64
+	for i := 0; i < 100; i++ {
+		p := pprofth.NewProfileBuilder(int64(i) * int64(time.Second)).CPUProfile()
+		p.ForStacktraceString("func1", "func2").AddSamples(int64(i + 1))
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+		total += int64(i + 1)
+
+		// duplicates of sampled profiles are dropped
+		if i == 50 {
+			require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+		}
+	}
+	// the first 10 profiles are stored, the other 90 are sampled into 10 profiles
+	require.Equal(t, 80.0, testutil.ToFloat64(head.metrics.sampledOutProfiles))
+	require.Equal(t, 1.0, testutil.ToFloat64(head.metrics.duplicateProfiles.WithLabelValues(duplicateProfilesDropped)))
+	// the sampled profiles held back are accounted in the size of the head
+	require.NotZero(t, head.reservoirs.sizeBytes())
+	require.Equal(t, head.profiles.MemorySize()+head.reservoirs.sizeBytes(), head.MemorySize()-head.symbolsMemorySize())
+
+	selectProfiles := func() ([]Profile, int64) {
+		it, err := head.Queriers().SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{}`,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		require.NoError(t, err)
+		profiles, err := iter.Slice(it)
+		require.NoError(t, err)
+		result, err := head.Queriers()[0].MergeByStacktraces(ctx, iter.NewSliceIterator(profiles), MergeStacktracesOptions{})
+		require.NoError(t, err)
+		var total int64
+		for _, s := range result.Stacktraces {
+			total += s.Value
+		}
+		return profiles, total
+	}
+
+	// the stored profiles are queryable, the sampled profiles are held back until the flush
+	profiles, storedTotal := selectProfiles()
+	require.Len(t, profiles, 10)
+	require.Equal(t, int64(55), storedTotal)
+
+	require.NoError(t, head.storeSampledProfiles())
+	require.Zero(t, head.reservoirs.sizeBytes())
+	profiles, sampledTotal := selectProfiles()
+	require.Len(t, profiles, 20)
+	// the scaled values approximate the total of all profiles received
+	require.InEpsilon(t, total, sampledTotal, 0.25)
+
+	flushed, err := head.Flush(ctx)
+	require.NoError(t, err)
+	require.Len(t, flushed, 1)
+	meta, _, err := block.MetaFromDir(flushed[0].Dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), meta.Stats.NumProfiles)
+}
+
+func TestHeadQueryWhileCuttingRowGroups(t *testing.T) {
+	ctx := testContext(t)
+	head := newTestHead(t)
+
+	// profiles are ingested at increasing timestamps, with row groups cut in between
+	const numProfiles = 200
+	done := make(chan error)
+	go func() {
+		defer close(done)
+		for i := 0; i < numProfiles; i++ {
+			p := pprofth.NewProfileBuilder(int64(i) * int64(time.Second)).CPUProfile()
+			p.ForStacktraceString("func1", "func2").AddSamples(10)
+			if err := head.Ingest(ctx, p.Profile, p.UUID, p.Labels...); err != nil {
+				done <- err
+				return
+			}
+			if i%3 == 0 {
+				head.profiles.lock.Lock()
+				err := head.profiles.cutRowGroup()
+				head.profiles.lock.Unlock()
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+	}()
+
+	var seen int
+	for finished := false; !finished; {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			finished = true
+		default:
+		}
+
+		queriers := head.Queriers()
+		it, err := queriers.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{}`,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		require.NoError(t, err)
+		profiles, err := iter.Slice(it)
+		require.NoError(t, err)
+
+		// the profiles ingested so far are seen exactly once, no matter whether they are in memory or on disk
+		timestamps := lo.Map(profiles, func(p Profile, _ int) model.Time { return p.Timestamp() })
+		sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+		for i, ts := range timestamps {
+			require.Equal(t, model.Time(i*1000), ts, "missing or duplicated profiles: %v", timestamps)
+		}
+		require.GreaterOrEqual(t, len(timestamps), seen)
+		seen = len(timestamps)
+
+		counts, err := queriers.CountMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{}`,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(timestamps)), counts.Profiles)
+	}
+	require.Equal(t, numProfiles, seen)
+}
+
+func TestHeadInferProfileType(t *testing.T) {
+	ctx := testContext(t)
+	head := newTestHead(t)
+
+	withoutMetricName := func(lbls []*typesv1.LabelPair) []*typesv1.LabelPair {
+		return lo.Filter(lbls, func(l *typesv1.LabelPair, _ int) bool { return l.Name != model.MetricNameLabel })
+	}
+
+	p := pprofth.NewProfileBuilder(int64(time.Second)).CPUProfile().WithLabels("job", "foo")
+	p.ForStacktraceString("func1", "func2").AddSamples(10)
+	require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, withoutMetricName(p.Labels)...))
+
+	// the profile type is inferred from the sample types
+	it, err := head.Queriers().SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{job="foo"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+	})
+	require.NoError(t, err)
+	profiles, err := iter.Slice(it)
+	require.NoError(t, err)
+	require.Len(t, profiles, 1)
+	require.Equal(t, "process_cpu", profiles[0].Labels().Get(model.MetricNameLabel))
+	require.Equal(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds", profiles[0].Labels().Get(phlaremodel.LabelNameProfileType))
+
+	// the sample types of mutex and block profiles are the same
+	mutex := pprofth.NewProfileBuilder(int64(2 * time.Second)).MutexProfile()
+	mutex.ForStacktraceString("func1").AddSamples(1, 100)
+	err = head.Ingest(ctx, mutex.Profile, mutex.UUID, withoutMetricName(mutex.Labels)...)
+	require.ErrorIs(t, err, ErrInvalidProfile)
+	var inferenceErr *pprof.ProfileTypeInferenceError
+	require.ErrorAs(t, err, &inferenceErr)
+
+	results, err := head.IngestBatchResults(ctx, []IngestInput{
+		{Profile: mutex.Profile, ID: mutex.UUID, ExternalLabels: withoutMetricName(mutex.Labels)},
+		{Profile: mutex.Profile, ID: mutex.UUID, ExternalLabels: mutex.Labels},
+	})
+	require.NoError(t, err)
+	require.ErrorAs(t, results[0], &inferenceErr)
+	require.NoError(t, results[1])
+}
+
+func TestHeadValidateIngest(t *testing.T) {
+	ctx := testContext(t)
+	newProfile := func(ts int) *pprofth.ProfileBuilder {
+		p := pprofth.NewProfileBuilder(int64(time.Duration(ts)*time.Second)).CPUProfile().WithLabels("job", "foo")
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+		return p
+	}
+	// validateThenIngest returns the error of ValidateIngest, after checking
+	// Ingest returns the same.
+	validateThenIngest := func(t *testing.T, head *Head, p *profilev1.Profile, lbls ...*typesv1.LabelPair) error {
+		t.Helper()
+		validateErr := head.ValidateIngest(ctx, p, lbls...)
+		ingestErr := head.Ingest(ctx, p, uuid.New(), lbls...)
+		if ingestErr == nil {
+			require.NoError(t, validateErr)
+		} else {
+			require.EqualError(t, validateErr, ingestErr.Error())
+		}
+		return validateErr
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		head := newTestHead(t)
+		p := newProfile(10)
+		expected := proto.Clone(p.Profile)
+		require.NoError(t, head.ValidateIngest(ctx, p.Profile, p.Labels...))
+		// nothing is ingested and the profile is unchanged
+		require.Equal(t, int64(0), head.profiles.index.totalSeries.Load())
+		require.Equal(t, int64(0), head.profiles.index.totalProfiles.Load())
+		require.True(t, proto.Equal(expected, p.Profile))
+
+		require.NoError(t, validateThenIngest(t, head.Head, p.Profile, p.Labels...))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		head := newTestHead(t)
+		require.NoError(t, validateThenIngest(t, head.Head, &profilev1.Profile{}))
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		head := newTestHead(t)
+		p := newProfile(10)
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+		p = newProfile(5)
+		require.ErrorIs(t, validateThenIngest(t, head.Head, p.Profile, p.Labels...), ErrOutOfOrder)
+		// only the ingested profile is counted as out of order
+		require.Equal(t, float64(1), testutil.ToFloat64(head.metrics.profilesOutOfOrder))
+	})
+
+	t.Run("limit exceeded", func(t *testing.T) {
+		limitErr := validation.NewErrorf(validation.SeriesLimit, validation.SeriesLimitErrorMsg, 1, 1)
+		head, err := NewHead(ctx, Config{DataPath: t.TempDir()}, rejectingLimiter{err: limitErr})
+		require.NoError(t, err)
+		p := newProfile(10)
+		err = validateThenIngest(t, head, p.Profile, p.Labels...)
+		require.ErrorIs(t, err, ErrLimitExceeded)
+		require.Equal(t, validation.SeriesLimit, validation.ReasonOf(err))
+	})
+
+	t.Run("ambiguous profile type", func(t *testing.T) {
+		head := newTestHead(t)
+		p := pprofth.NewProfileBuilder(int64(time.Second)).MutexProfile()
+		p.ForStacktraceString("func1").AddSamples(1, 100)
+		lbls := lo.Filter(p.Labels, func(l *typesv1.LabelPair, _ int) bool { return l.Name != model.MetricNameLabel })
+		require.ErrorIs(t, validateThenIngest(t, head.Head, p.Profile, lbls...), ErrInvalidProfile)
+	})
+
+	t.Run("invalid reference", func(t *testing.T) {
+		head := newTestHead(t)
+		p := newProfile(10)
+		p.Sample[0].LocationId = append(p.Sample[0].LocationId, 1000)
+		require.ErrorIs(t, head.ValidateIngest(ctx, p.Profile, p.Labels...), ErrInvalidProfile)
+	})
+}
+
+func TestHeadIngestMultiplePeriodTypes(t *testing.T) {
+	ctx := testContext(t)
+	head := newTestHead(t)
+
+	// a single pprof profile of cpu time and allocated bytes, the period type
+	// of the latter is given by a comment
+	p := pprofth.NewProfileBuilder(int64(15*time.Second)).CPUProfile().
+		WithSampleType("alloc_space", "bytes").
+		WithComments(pprof.PeriodTypeCommentPrefix + " alloc_space space:bytes")
+	p.ForStacktraceString("func1", "func2").AddSamples(10, 1024)
+	p.ForStacktraceString("func1").AddSamples(20, 2048)
+	require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+	profileTypes, err := head.Queriers().ProfileTypes(ctx, 0, model.TimeFromUnixNano(int64(time.Minute)))
+	require.NoError(t, err)
+	require.Equal(t, []*typesv1.ProfileType{
+		mustParseProfileSelector(t, "process_cpu:alloc_space:bytes:space:bytes"),
+		mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+	}, profileTypes)
+
+	for _, tc := range []struct {
+		profileType string
+		periodType  string
+		periodUnit  string
+		values      map[string]int64
+	}{
+		{
+			profileType: "process_cpu:cpu:nanoseconds:cpu:nanoseconds",
+			periodType:  "cpu",
+			periodUnit:  "nanoseconds",
+			values:      map[string]int64{"func1;func2": 10, "func1": 20},
+		},
+		{
+			profileType: "process_cpu:alloc_space:bytes:space:bytes",
+			periodType:  "space",
+			periodUnit:  "bytes",
+			values:      map[string]int64{"func1;func2": 1024, "func1": 2048},
+		},
+	} {
+		t.Run(tc.profileType, func(t *testing.T) {
+			it, err := head.Queriers().SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{}`,
+				Type:          mustParseProfileSelector(t, tc.profileType),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+			})
+			require.NoError(t, err)
+			profiles, err := iter.Slice(it)
+			require.NoError(t, err)
+			require.Len(t, profiles, 1)
+			require.Equal(t, tc.periodType, profiles[0].Labels().Get(phlaremodel.LabelNamePeriodType))
+			require.Equal(t, tc.periodUnit, profiles[0].Labels().Get(phlaremodel.LabelNamePeriodUnit))
+
+			result, err := head.Queriers()[0].MergeByStacktraces(ctx, iter.NewSliceIterator(profiles), MergeStacktracesOptions{})
+			require.NoError(t, err)
+			values := make(map[string]int64, len(result.Stacktraces))
+			for _, s := range result.Stacktraces {
+				names := lo.Map(s.FunctionIds, func(id int32, _ int) string { return result.FunctionNames[id] })
+				values[strings.Join(names, ";")] += s.Value
+			}
+			require.Equal(t, tc.values, values)
+		})
+	}
+}
+
+func TestHeadMaxStackDepth(t *testing.T) {
+	ctx := testContext(t)
+	head, err := NewHead(ctx, Config{DataPath: t.TempDir(), MaxStackDepth: 100}, NoLimit)
+	require.NoError(t, err)
+
+	frames := make([]string, 5000)
+	for i := range frames {
+		frames[i] = fmt.Sprintf("frame-%d", i)
+	}
+	p := pprofth.NewProfileBuilder(int64(15 * time.Second)).CPUProfile()
+	p.ForStacktraceString(frames...).AddSamples(42)
+	p.ForStacktraceString("shallow").AddSamples(1)
+	var (
+		stringTable = p.StringTable[:len(p.StringTable):len(p.StringTable)]
+		functions   = len(p.Function)
+		locations   = len(p.Location)
+		sample      = p.Sample[0]
+	)
+	require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	require.Equal(t, 1.0, testutil.ToFloat64(head.metrics.truncatedStacktraces))
+
+	// the stacktraces of the profile of the caller are left untouched
+	require.Equal(t, stringTable, p.StringTable)
+	require.Len(t, p.Function, functions)
+	require.Len(t, p.Location, locations)
+	require.Same(t, sample, p.Sample[0])
+	require.Len(t, p.Sample[0].LocationId, 5000)
+
+	profiles, err := head.Queriers().SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+	})
+	require.NoError(t, err)
+	result, err := head.Queriers()[0].MergeByStacktraces(ctx, profiles, MergeStacktracesOptions{})
+	require.NoError(t, err)
+	require.Len(t, result.Stacktraces, 2)
+
+	for _, s := range result.Stacktraces {
+		if len(s.FunctionIds) == 1 {
+			require.Equal(t, "shallow", result.FunctionNames[s.FunctionIds[0]])
+			require.Equal(t, int64(1), s.Value)
+			continue
+		}
+		// the leaf-most frames are kept, followed by the truncated marker
+		require.Len(t, s.FunctionIds, 101)
+		for i, id := range s.FunctionIds[:100] {
+			require.Equal(t, frames[i], result.FunctionNames[id])
+		}
+		require.Equal(t, TruncatedFrameName, result.FunctionNames[s.FunctionIds[100]])
+		require.Equal(t, int64(42), s.Value)
+	}
+}
+
+func TestHeadAggregatesDuplicateSamples(t *testing.T) {
+	ctx := testContext(t)
+	head := newTestHead(t)
+
+	p := pprofth.NewProfileBuilder(int64(15 * time.Second)).CPUProfile()
+	for _, v := range []int64{1, 2, 3} {
+		p.ForStacktraceString("func1", "func2").AddSamples(v)
+	}
+	for _, v := range []int64{4, 5} {
+		p.ForStacktraceString("func1").AddSamples(v)
+	}
+	// samples with different sample labels are kept apart
+	p.ForStacktraceString("func1").WithSampleLabels("foo", "bar").AddSamples(7)
+	require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+	var stored []*schemav1.Profile
+	for _, ps := range head.profiles.index.profilesPerFP {
+		stored = append(stored, ps.profiles...)
+	}
+	require.Len(t, stored, 1)
+	values := make(map[int64]int)
+	for _, s := range stored[0].Samples {
+		values[s.Value]++
+	}
+	require.Equal(t, map[int64]int{6: 1, 9: 1, 7: 1}, values)
+
+	r, err := head.Queriers().SelectCollapsed(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+	})
+	require.NoError(t, err)
+	collapsed, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "func1 16\nfunc2;func1 6\n", string(collapsed))
+}
+
+func TestHeadDuplicateProfiles(t *testing.T) {
+	newProfile := func(id uuid.UUID, value int64) *pprofth.ProfileBuilder {
+		p := pprofth.NewProfileBuilder(int64(15 * time.Second)).CPUProfile()
+		p.UUID = id
+		p.ForStacktraceString("func1", "func2").AddSamples(value)
+		return p
+	}
+	// selectAndMerge returns the number of profiles selected and the total value merged
+	selectAndMerge := func(t *testing.T, ctx context.Context, head *Head) (profiles int, total int64) {
+		t.Helper()
+		for _, q := range head.Queriers() {
+			it, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{}`,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+			})
+			require.NoError(t, err)
+			selected, err := iter.Slice(it)
+			require.NoError(t, err)
+			profiles += len(selected)
+			result, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(selected), MergeStacktracesOptions{})
+			require.NoError(t, err)
+			for _, s := range result.Stacktraces {
+				total += s.Value
+			}
+		}
+		return profiles, total
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		ctx := testContext(t)
+		head, err := NewHead(ctx, Config{DataPath: t.TempDir()}, NoLimit)
+		require.NoError(t, err)
+
+		p := newProfile(uuid.New(), 10)
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+		require.Equal(t, int64(1), head.profiles.NumRows())
+		profiles, total := selectAndMerge(t, ctx, head)
+		require.Equal(t, 1, profiles)
+		require.Equal(t, int64(10), total)
+		require.Equal(t, 1.0, testutil.ToFloat64(head.metrics.duplicateProfiles.WithLabelValues(duplicateProfilesDropped)))
+	})
+
+	t.Run("upsert", func(t *testing.T) {
+		ctx := testContext(t)
+		head, err := NewHead(ctx, Config{DataPath: t.TempDir(), DuplicateProfiles: DuplicateProfilesUpsert}, NoLimit)
+		require.NoError(t, err)
+
+		id := uuid.New()
+		first, second := newProfile(id, 10), newProfile(id, 20)
+		require.NoError(t, head.Ingest(ctx, first.Profile, first.UUID, first.Labels...))
+		require.NoError(t, head.Ingest(ctx, second.Profile, second.UUID, second.Labels...))
+
+		require.Equal(t, int64(1), head.profiles.NumRows())
+		profiles, total := selectAndMerge(t, ctx, head)
+		require.Equal(t, 1, profiles)
+		require.Equal(t, int64(20), total)
+		require.Equal(t, 1.0, testutil.ToFloat64(head.metrics.duplicateProfiles.WithLabelValues(duplicateProfilesReplaced)))
+	})
+
+	t.Run("upsert after the row group is cut", func(t *testing.T) {
+		ctx := testContext(t)
+		head, err := NewHead(ctx, Config{DataPath: t.TempDir(), DuplicateProfiles: DuplicateProfilesUpsert}, NoLimit)
+		require.NoError(t, err)
+
+		id := uuid.New()
+		first, second := newProfile(id, 10), newProfile(id, 20)
+		require.NoError(t, head.Ingest(ctx, first.Profile, first.UUID, first.Labels...))
+		require.NoError(t, head.profiles.cutRowGroup())
+		require.NoError(t, head.Ingest(ctx, second.Profile, second.UUID, second.Labels...))
+
+		// profiles on disk can't be replaced, so the duplicate is dropped
+		require.Equal(t, int64(1), head.profiles.NumRows())
+		profiles, total := selectAndMerge(t, ctx, head)
+		require.Equal(t, 1, profiles)
+		require.Equal(t, int64(10), total)
+		require.Equal(t, 1.0, testutil.ToFloat64(head.metrics.duplicateProfiles.WithLabelValues(duplicateProfilesDropped)))
+	})
+
+	t.Run("invalid action", func(t *testing.T) {
+		_, err := NewHead(testContext(t), Config{DataPath: t.TempDir(), DuplicateProfiles: "merge"}, NoLimit)
+		require.Error(t, err)
+	})
+}
+
+func TestHeadSnapshotRestore(t *testing.T) {
+	ctx := testContext(t)
+	head := newTestHead(t)
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+		// series span row groups on disk and the profiles in memory
+		if i == 4 {
+			require.NoError(t, head.profiles.cutRowGroup())
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, head.Snapshot(&buf))
+
+	_, err := RestoreHead(ctx, Config{DataPath: t.TempDir()}, NoLimit, strings.NewReader("not a snapshot"))
+	require.Error(t, err)
+
+	restored, err := RestoreHead(ctx, Config{DataPath: t.TempDir()}, NoLimit, &buf)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, restored.Close()) })
+
+	// query returns the labels and timestamps of the profiles and the merged stacktraces
+	query := func(t *testing.T, head *Head) ([]string, map[string]int64) {
+		t.Helper()
+		var (
+			profiles []string
+			merged   = make(map[string]int64)
+		)
+		for _, q := range head.Queriers() {
+			it, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{job="foo"}`,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+			})
+			require.NoError(t, err)
+			selected, err := iter.Slice(it)
+			require.NoError(t, err)
+			for _, p := range selected {
+				profiles = append(profiles, fmt.Sprintf("%s@%d", phlaremodel.LabelPairsString(p.Labels()), p.Timestamp()))
+			}
+			result, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(selected), MergeStacktracesOptions{})
+			require.NoError(t, err)
+			for _, s := range result.Stacktraces {
+				names := make([]string, len(s.FunctionIds))
+				for i, id := range s.FunctionIds {
+					names[i] = result.FunctionNames[id]
+				}
+				merged[strings.Join(names, ";")] += s.Value
+			}
+		}
+		sort.Strings(profiles)
+		return profiles, merged
+	}
+
+	expectedProfiles, expectedMerged := query(t, head.Head)
+	require.Len(t, expectedProfiles, 9)
+	actualProfiles, actualMerged := query(t, restored)
+	require.Equal(t, expectedProfiles, actualProfiles)
+	require.Equal(t, expectedMerged, actualMerged)
+
+	expectedStats, actualStats := head.Stats(), restored.Stats()
+	expectedStats.MemoryBytes, actualStats.MemoryBytes = 0, 0
+	require.Equal(t, expectedStats, actualStats)
+
+	// the restored head keeps ingesting
+	require.NoError(t, ingestThreeProfileStreams(ctx, 9, restored.Ingest))
+	require.Equal(t, uint64(10), restored.Stats().NumProfiles)
+}
+
+func TestHeadFlushReturnsBlock(t *testing.T) {
+	ctx := testContext(t)
+	head := newTestHead(t)
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+	}
+	flushed, err := head.Flush(ctx)
+	require.NoError(t, err)
+	require.Len(t, flushed, 1)
+	require.NotEqual(t, ulid.ULID{}, flushed[0].ID)
+	require.DirExists(t, flushed[0].Dir)
+
+	meta, _, err := block.MetaFromDir(flushed[0].Dir)
+	require.NoError(t, err)
+	require.Equal(t, flushed[0].ID, meta.ULID)
+	require.Equal(t, uint64(9), meta.Stats.NumProfiles)
+
+	// an empty head writes no block
+	flushed, err = newTestHead(t).Flush(ctx)
+	require.NoError(t, err)
+	require.Empty(t, flushed)
+}
+
+func TestHeadFlushSplitsOversizedHead(t *testing.T) {
+	ctx := testContext(t)
+	dataPath := t.TempDir()
+	head, err := NewHead(ctx, Config{DataPath: dataPath, MaxBlockProfiles: 4}, NoLimit)
+	require.NoError(t, err)
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+		if i == 4 {
+			require.NoError(t, head.profiles.cutRowGroup())
+		}
+	}
+	flushed, err := head.Flush(ctx)
+	require.NoError(t, err)
+	require.Len(t, flushed, 3)
+	for _, b := range flushed {
+		require.Equal(t, filepath.Join(dataPath, pathLocal, b.ID.String()), b.Dir)
+		require.DirExists(t, b.Dir)
+	}
+
+	_, err = os.Stat(head.headPath)
+	require.True(t, os.IsNotExist(err), "head directory is removed")
+	_, err = os.Stat(head.localPath)
+	require.True(t, os.IsNotExist(err), "no block is written for the whole head")
+
+	entries, err := os.ReadDir(filepath.Join(dataPath, pathLocal))
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	// ULIDs created within the same millisecond are not ordered, so blocks are ordered by time
+	metas := make([]*block.Meta, len(entries))
+	for i, e := range entries {
+		metas[i], _, err = block.MetaFromDir(filepath.Join(dataPath, pathLocal, e.Name()))
+		require.NoError(t, err)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].MinTime < metas[j].MinTime })
+
+	var (
+		ids           = make(map[string]struct{})
+		maxTime int64 = math.MinInt64
+	)
+	for _, meta := range metas {
+		dir := filepath.Join(dataPath, pathLocal, meta.ULID.String())
+		require.LessOrEqual(t, meta.Stats.NumProfiles, uint64(4))
+		require.NoError(t, VerifyChecksums(dir))
+
+		var buf bytes.Buffer
+		require.NoError(t, ExportNDJSON(ctx, dir, &buf))
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		require.Len(t, lines, int(meta.Stats.NumProfiles))
+		for _, line := range lines {
+			var p ExportedProfile
+			require.NoError(t, json.Unmarshal([]byte(line), &p))
+			require.NotContains(t, ids, p.ID)
+			ids[p.ID] = struct{}{}
+		}
+
+		// blocks cover distinct time ranges
+		require.Greater(t, int64(meta.MinTime), maxTime)
+		maxTime = int64(meta.MaxTime)
+	}
+	require.Len(t, ids, 9)
+}
+
+func TestSplitBoundaries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		times    []int64
+		expected []int64
+	}{
+		{name: "within limit", times: []int64{2, 1}},
+		{name: "distinct timestamps", times: []int64{5, 4, 3, 2, 1}, expected: []int64{3, 5}},
+		{name: "shared timestamps stay together", times: []int64{1, 2, 2, 2, 3}, expected: []int64{2, 3}},
+		{name: "shared timestamps exceeding the limit", times: []int64{1, 1, 1, 1, 2}, expected: []int64{2}},
+		{name: "single timestamp", times: []int64{1, 1, 1, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var actual []int64
+			for _, b := range splitBoundaries(tc.times, 2) {
+				actual = append(actual, b.UnixNano())
+			}
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestHeadTempDir(t *testing.T) {
+	ctx := testContext(t)
+	tempDir := t.TempDir()
+	head, err := NewHead(ctx, Config{DataPath: t.TempDir(), TempDir: tempDir}, NoLimit)
+	require.NoError(t, err)
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+		if i%3 == 2 {
+			require.NoError(t, head.profiles.cutRowGroup())
+		}
+	}
+
+	// the row groups are written to the temporary directory only
+	segments, err := filepath.Glob(filepath.Join(tempDir, head.meta.ULID.String(), "profiles.*.parquet"))
+	require.NoError(t, err)
+	require.Len(t, segments, 3)
+	segments, err = filepath.Glob(filepath.Join(head.headPath, "profiles.*.parquet"))
+	require.NoError(t, err)
+	require.Empty(t, segments)
+
+	// a failed flush keeps the row groups
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = head.Flush(canceled)
+	require.ErrorIs(t, err, context.Canceled)
+	segments, err = filepath.Glob(filepath.Join(tempDir, head.meta.ULID.String(), "profiles.*.parquet"))
+	require.NoError(t, err)
+	require.Len(t, segments, 3)
+	require.Len(t, head.profiles.rowGroups, 3)
+
+	_, err = head.Flush(ctx)
+
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	meta, _, err := block.MetaFromDir(head.localPath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), meta.Stats.NumProfiles)
+}
+
+func TestHeadParquetConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cfg      Config
+		expected func(*ParquetConfig)
+	}{
+		{
+			name:     "defaults",
+			expected: func(*ParquetConfig) {},
+		},
+		{
+			name:     "row group target compressed size",
+			cfg:      Config{RowGroupTargetCompressedSize: 1024},
+			expected: func(c *ParquetConfig) { c.TargetRowGroupCompressedBytes = 1024 },
+		},
+		{
+			name:     "page checksums",
+			cfg:      Config{PageChecksums: true},
+			expected: func(c *ParquetConfig) { c.PageChecksums = true },
+		},
+		{
+			name: "bloom filter columns",
+			cfg:  Config{BloomFilterColumns: []string{"SeriesIndex", "Samples.list.element.StacktraceID"}},
+			expected: func(c *ParquetConfig) {
+				c.BloomFilterColumns = []string{"SeriesIndex", "Samples.list.element.StacktraceID"}
+			},
+		},
+		{
+			name:     "flush concurrency",
+			cfg:      Config{FlushConcurrency: 4},
+			expected: func(c *ParquetConfig) { c.FlushConcurrency = 4 },
+		},
+		{
+			name:     "sort order",
+			cfg:      Config{SortOrder: SortOrderTime},
+			expected: func(c *ParquetConfig) { c.SortOrder = TimeThenSeries },
+		},
+		{
+			name:     "sort order overrides test config",
+			cfg:      Config{SortOrder: SortOrderSeries, Parquet: &ParquetConfig{SortOrder: TimeThenSeries}},
+			expected: func(c *ParquetConfig) { *c = ParquetConfig{SortOrder: SeriesThenTime} },
+		},
+		{
+			name:     "test config kept by unset flags",
+			cfg:      Config{Parquet: &ParquetConfig{MaxBufferRowCount: 10, TargetRowGroupCompressedBytes: 1024}},
+			expected: func(c *ParquetConfig) { *c = ParquetConfig{MaxBufferRowCount: 10, TargetRowGroupCompressedBytes: 1024} },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.DataPath = t.TempDir()
+			tc.cfg.RowGroupTargetSize = 1024 * 1024
+			head, err := NewHead(testContext(t), tc.cfg, NoLimit)
+			require.NoError(t, err)
+
+			expected := *defaultParquetConfig
+			tc.expected(&expected)
+			expected.MaxRowGroupBytes = 1024 * 1024
+			require.Equal(t, expected, *head.parquetConfig)
+		})
+	}
+
+	_, err := NewHead(testContext(t), Config{DataPath: t.TempDir(), BloomFilterColumns: []string{"Samples"}}, NoLimit)
+	require.ErrorContains(t, err, `invalid bloom filter column "Samples"`)
+	_, err = NewHead(testContext(t), Config{DataPath: t.TempDir(), SortOrder: "random"}, NoLimit)
+	require.ErrorContains(t, err, `invalid sort order "random"`)
+}
@@ -0,0 +1,125 @@
+package phlaredb
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/iter"
+)
+
+// mergeCache caches the stacktraces merged by each querier for
+// MergeProfilesStacktraces, so repeated queries, e.g. refreshes of a
+// dashboard, don't read and merge the same profiles again.
+//
+// Results are keyed by the querier, the select request, the merge options and
+// the profiles selected by the client. The pruning, redaction and scaling of
+// the merged result are applied after the cache.
+type mergeCache struct {
+	cache    *lru.Cache
+	requests *prometheus.CounterVec
+}
+
+// mergeCacheQuerier is implemented by queriers, whose merge results can be
+// cached. The ID changes whenever merging the same profiles might give a
+// different result, an empty ID disables the cache.
+type mergeCacheQuerier interface {
+	mergeCacheID() string
+}
+
+func newMergeCache(size int, metrics *headMetrics) (*mergeCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &mergeCache{
+		cache:    cache,
+		requests: metrics.mergeCacheRequests,
+	}, nil
+}
+
+// mergeByStacktraces returns the stacktraces of the profiles merged by q from
+// the cache, or merges and caches them.
+func (c *mergeCache) mergeByStacktraces(ctx context.Context, q Querier, request *ingestv1.SelectProfilesRequest, profiles []Profile, opts MergeStacktracesOptions) (*ingestv1.MergeProfilesStacktracesResult, error) {
+	var id string
+	if cq, ok := q.(mergeCacheQuerier); ok {
+		id = cq.mergeCacheID()
+	}
+	if c == nil || id == "" {
+		return q.MergeByStacktraces(ctx, iter.NewSliceIterator(profiles), opts)
+	}
+
+	key, err := mergeCacheKey(id, request, opts, profiles)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := c.cache.Get(key); ok {
+		c.requests.WithLabelValues("hit").Inc()
+		// results are modified when merged with the ones of other queriers
+		return proto.Clone(cached.(*ingestv1.MergeProfilesStacktracesResult)).(*ingestv1.MergeProfilesStacktracesResult), nil
+	}
+	c.requests.WithLabelValues("miss").Inc()
+
+	result, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(profiles), opts)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.Add(key, proto.Clone(result))
+	return result, nil
+}
+
+// mergeCacheKey hashes the querier ID, the request, the options and the
+// series, timestamps and row numbers of the profiles.
+func mergeCacheKey(id string, request *ingestv1.SelectProfilesRequest, opts MergeStacktracesOptions, profiles []Profile) (uint64, error) {
+	requestBytes, err := request.MarshalVT()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		h   = xxhash.New()
+		buf [8]byte
+	)
+	writeUint64 := func(v uint64) {
+		binary.LittleEndian.PutUint64(buf[:], v)
+		_, _ = h.Write(buf[:])
+	}
+	writeString := func(s string) {
+		writeUint64(uint64(len(s)))
+		_, _ = h.WriteString(s)
+	}
+
+	writeString(id)
+	writeString(string(requestBytes))
+	writeUint64(uint64(opts.Granularity))
+	writeString(opts.SplitBySampleLabel)
+	if opts.NormalizePeriod {
+		writeUint64(1)
+	} else {
+		writeUint64(0)
+	}
+	writeUint64(uint64(len(profiles)))
+	for _, p := range profiles {
+		writeUint64(uint64(p.Fingerprint()))
+		writeUint64(uint64(p.Timestamp()))
+		// profiles of a series might share a timestamp
+		if r, ok := p.(interface{ RowNumber() int64 }); ok {
+			writeUint64(uint64(r.RowNumber()))
+		}
+	}
+	return h.Sum64(), nil
+}
+
+func contextWithMergeCache(ctx context.Context, c *mergeCache) context.Context {
+	return context.WithValue(ctx, mergeCacheContextKey, c)
+}
+
+func contextMergeCache(ctx context.Context) *mergeCache {
+	c, _ := ctx.Value(mergeCacheContextKey).(*mergeCache)
+	return c
+}
@@ -15,14 +15,52 @@ type contextKey uint8
 const (
 	headMetricsContextKey contextKey = iota
 	blockMetricsContextKey
+	queryMemoryLimitContextKey
+	queryMemoryContextKey
+	functionNamesFilterContextKey
+	blockEncryptionContextKey
+	mergeCacheContextKey
+)
+
+// Actions taken on duplicate profiles, used to label the duplicate profiles.
+const (
+	duplicateProfilesDropped  = "dropped"
+	duplicateProfilesReplaced = "replaced"
+)
+
+// Stages of a table flush, used to label flush failures.
+const (
+	flushStageAggregation = "aggregation"
+	flushStageIndex       = "index"
+	flushStageParquet     = "parquet"
 )
 
 type headMetrics struct {
 	series        prometheus.Gauge
 	seriesCreated *prometheus.CounterVec
+	activeSeries  prometheus.Gauge
+	newSeries     prometheus.Counter
+
+	profiles           prometheus.Gauge
+	profilesCreated    *prometheus.CounterVec
+	profilesOutOfOrder prometheus.Counter
+	duplicateProfiles  *prometheus.CounterVec
 
-	profiles        prometheus.Gauge
-	profilesCreated *prometheus.CounterVec
+	truncatedStacktraces prometheus.Counter
+	sampledOutProfiles   prometheus.Counter
+
+	selectTooManyProfiles    prometheus.Counter
+	queryMemoryLimitExceeded prometheus.Counter
+	queriesInflight          prometheus.Gauge
+	queriesTooManyConcurrent prometheus.Counter
+	mergeCacheRequests       *prometheus.CounterVec
+	diskBudgetEvictedBlocks  prometheus.Counter
+
+	stacktraces    prometheus.Gauge
+	functions      prometheus.Gauge
+	memoryBytes    prometheus.Gauge
+	minTimeSeconds prometheus.Gauge
+	maxTimeSeconds prometheus.Gauge
 
 	sizeBytes   *prometheus.GaugeVec
 	rowsWritten *prometheus.CounterVec
@@ -31,6 +69,10 @@ type headMetrics struct {
 	sampleValuesReceived *prometheus.CounterVec
 
 	flushedFileSizeBytes        *prometheus.HistogramVec
+	flushedTableDurationSeconds *prometheus.HistogramVec
+	flushedTableRows            *prometheus.HistogramVec
+	flushedTableRowGroups       *prometheus.HistogramVec
+	flushFailures               *prometheus.CounterVec
 	flushedBlockSizeBytes       prometheus.Histogram
 	flushedBlockDurationSeconds prometheus.Histogram
 	flushedBlockSeries          prometheus.Histogram
@@ -46,6 +88,14 @@ func newHeadMetrics(reg prometheus.Registerer) *headMetrics {
 			Name: "phlare_tsdb_head_series_created_total",
 			Help: "Total number of series created in the head",
 		}, []string{"profile_name"}),
+		activeSeries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "phlare_head_active_series",
+			Help: "Number of distinct series in the heads, which haven't been flushed yet.",
+		}),
+		newSeries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "phlare_head_series_created_total",
+			Help: "Total number of new series ingested into the head.",
+		}),
 		rowsWritten: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "phlare_rows_written",
@@ -56,6 +106,46 @@ func newHeadMetrics(reg prometheus.Registerer) *headMetrics {
 			Name: "phlare_head_profiles_created_total",
 			Help: "Total number of profiles created in the head",
 		}, []string{"profile_name"}),
+		profilesOutOfOrder: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "phlare_head_out_of_order_profiles_total",
+			Help: "Total number of profiles rejected by the head, because they were out of order.",
+		}),
+		duplicateProfiles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "phlare_head_duplicate_profiles_total",
+			Help: "Total number of profiles ingested with the ID of a profile already in the head, by the action taken.",
+		}, []string{"action"}),
+		truncatedStacktraces: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "phlare_head_truncated_stacktraces_total",
+			Help: "Total number of stacktraces truncated at ingestion, because they were deeper than the max stack depth.",
+		}),
+		sampledOutProfiles: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "phlare_head_sampled_out_profiles_total",
+			Help: "Total number of profiles dropped by the sampling of series exceeding the series reservoir size.",
+		}),
+		selectTooManyProfiles: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "phlare_select_too_many_profiles_total",
+			Help: "Total number of queries rejected, because they selected more profiles than allowed.",
+		}),
+		queryMemoryLimitExceeded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "phlare_query_memory_limit_exceeded_total",
+			Help: "Total number of queries rejected, because they allocated more memory than allowed.",
+		}),
+		queriesInflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "phlare_queries_inflight",
+			Help: "Number of queries running, while the concurrent queries are limited.",
+		}),
+		queriesTooManyConcurrent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "phlare_queries_too_many_concurrent_total",
+			Help: "Total number of queries rejected, because too many queries were running concurrently.",
+		}),
+		mergeCacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "phlare_merge_cache_requests_total",
+			Help: "Total number of stacktrace merges of a block or the head looked up in the merge cache, by result.",
+		}, []string{"result"}),
+		diskBudgetEvictedBlocks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "phlare_disk_budget_evicted_blocks_total",
+			Help: "Total number of local blocks deleted, because the blocks exceeded the disk budget.",
+		}),
 		sampleValuesIngested: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "phlare_head_ingested_sample_values_total",
@@ -82,12 +172,54 @@ func newHeadMetrics(reg prometheus.Registerer) *headMetrics {
 			Name: "phlare_head_profiles",
 			Help: "Total number of profiles in the head block.",
 		}),
+		stacktraces: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "phlare_head_stacktraces",
+			Help: "Number of distinct stacktraces in the head block.",
+		}),
+		functions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "phlare_head_functions",
+			Help: "Number of distinct functions in the head block.",
+		}),
+		memoryBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "phlare_head_memory_bytes",
+			Help: "Estimated size of the head block in memory.",
+		}),
+		minTimeSeconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "phlare_head_min_time_seconds",
+			Help: "Minimum timestamp of the profiles in the head block.",
+		}),
+		maxTimeSeconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "phlare_head_max_time_seconds",
+			Help: "Maximum timestamp of the profiles in the head block.",
+		}),
 		flushedFileSizeBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name: "phlare_head_flushed_table_size_bytes",
 			Help: "Size of a flushed table in bytes.",
 			//  [2MB, 4MB, 8MB, 16MB, 32MB, 64MB, 128MB, 256MB, 512MB, 1GB, 2GB]
 			Buckets: prometheus.ExponentialBuckets(2*1024*1024, 2, 11),
 		}, []string{"name"}),
+		flushedTableDurationSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "phlare_head_flushed_table_duration_seconds",
+			Help: "Time to flush a table in seconds.",
+			// [10ms, 20ms, 40ms, 80ms, 160ms, 320ms, 640ms, 1.28s, 2.56s, 5.12s, 10.24s, 20.48s]
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"name"}),
+		flushedTableRows: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "phlare_head_flushed_table_rows",
+			Help: "Number of rows in a flushed table.",
+			// [1k, 4k, 16k, 64k, 256k, 1M, 4M, 16M, 64M, 256M]
+			Buckets: prometheus.ExponentialBuckets(1000, 4, 10),
+		}, []string{"name"}),
+		flushedTableRowGroups: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "phlare_head_flushed_table_row_groups",
+			Help: "Number of row groups in a flushed table.",
+			// [1, 2, 4, 8, 16, 32, 64, 128, 256, 512]
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"name"}),
+		flushFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "phlare_head_flush_failures_total",
+			Help: "Total number of failures while flushing tables, by the stage which failed.",
+		}, []string{"stage"}),
 		flushedBlockSizeBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name: "phlare_head_flushed_block_size_bytes",
 			Help: "Size of a flushed block in bytes.",
@@ -140,13 +272,34 @@ func (m *headMetrics) register(reg prometheus.Registerer) {
 	}
 	m.series = util.RegisterOrGet(reg, m.series)
 	m.seriesCreated = util.RegisterOrGet(reg, m.seriesCreated)
+	m.activeSeries = util.RegisterOrGet(reg, m.activeSeries)
+	m.newSeries = util.RegisterOrGet(reg, m.newSeries)
 	m.profiles = util.RegisterOrGet(reg, m.profiles)
 	m.profilesCreated = util.RegisterOrGet(reg, m.profilesCreated)
+	m.profilesOutOfOrder = util.RegisterOrGet(reg, m.profilesOutOfOrder)
+	m.duplicateProfiles = util.RegisterOrGet(reg, m.duplicateProfiles)
+	m.truncatedStacktraces = util.RegisterOrGet(reg, m.truncatedStacktraces)
+	m.sampledOutProfiles = util.RegisterOrGet(reg, m.sampledOutProfiles)
+	m.selectTooManyProfiles = util.RegisterOrGet(reg, m.selectTooManyProfiles)
+	m.queryMemoryLimitExceeded = util.RegisterOrGet(reg, m.queryMemoryLimitExceeded)
+	m.queriesInflight = util.RegisterOrGet(reg, m.queriesInflight)
+	m.queriesTooManyConcurrent = util.RegisterOrGet(reg, m.queriesTooManyConcurrent)
+	m.mergeCacheRequests = util.RegisterOrGet(reg, m.mergeCacheRequests)
+	m.diskBudgetEvictedBlocks = util.RegisterOrGet(reg, m.diskBudgetEvictedBlocks)
+	m.stacktraces = util.RegisterOrGet(reg, m.stacktraces)
+	m.functions = util.RegisterOrGet(reg, m.functions)
+	m.memoryBytes = util.RegisterOrGet(reg, m.memoryBytes)
+	m.minTimeSeconds = util.RegisterOrGet(reg, m.minTimeSeconds)
+	m.maxTimeSeconds = util.RegisterOrGet(reg, m.maxTimeSeconds)
 	m.sizeBytes = util.RegisterOrGet(reg, m.sizeBytes)
 	m.rowsWritten = util.RegisterOrGet(reg, m.rowsWritten)
 	m.sampleValuesIngested = util.RegisterOrGet(reg, m.sampleValuesIngested)
 	m.sampleValuesReceived = util.RegisterOrGet(reg, m.sampleValuesReceived)
 	m.flushedFileSizeBytes = util.RegisterOrGet(reg, m.flushedFileSizeBytes)
+	m.flushedTableDurationSeconds = util.RegisterOrGet(reg, m.flushedTableDurationSeconds)
+	m.flushedTableRows = util.RegisterOrGet(reg, m.flushedTableRows)
+	m.flushedTableRowGroups = util.RegisterOrGet(reg, m.flushedTableRowGroups)
+	m.flushFailures = util.RegisterOrGet(reg, m.flushFailures)
 	m.flushedBlockSizeBytes = util.RegisterOrGet(reg, m.flushedBlockSizeBytes)
 	m.flushedBlockDurationSeconds = util.RegisterOrGet(reg, m.flushedBlockDurationSeconds)
 	m.flushedBlockSeries = util.RegisterOrGet(reg, m.flushedBlockSeries)
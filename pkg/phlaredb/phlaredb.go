@@ -15,6 +15,7 @@ import (
 	"github.com/bufbuild/connect-go"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/multierror"
 	"github.com/grafana/dskit/services"
 	"github.com/oklog/ulid"
@@ -23,6 +24,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/samber/lo"
 
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
@@ -45,22 +47,178 @@ type Config struct {
 	// Blocks are generally cut once they reach 1000M of memory size, this will setup an upper limit to the duration of data that a block has that is cut by the ingester.
 	MaxBlockDuration time.Duration `yaml:"max_block_duration,omitempty"`
 
+	// The head is flushed once its oldest profile is older than this age, regardless of its size and duration.
+	MaxProfileAge time.Duration `yaml:"max_profile_age"`
+
 	// TODO: docs
 	RowGroupTargetSize uint64 `yaml:"row_group_target_size"`
+	// Maximum memory buffered for a row group, including the symbols added while buffering it, 0 disables the limit.
+	MaxBufferBytes uint64 `yaml:"max_buffer_bytes"`
+	// Maximum functions or stacktraces added while buffering a row group, 0 disables the limit.
+	MaxDictionaryEntries int `yaml:"max_dictionary_entries"`
+	// Size of the row groups on disk targeted, 0 cuts them by their size in memory only.
+	RowGroupTargetCompressedSize uint64 `yaml:"row_group_target_compressed_size"`
+	// Validates the pages of the parquet files written by a flush against their checksums.
+	PageChecksums bool `yaml:"page_checksums"`
+	// Columns of profiles.parquet written with a bloom filter, e.g. SeriesIndex.
+	BloomFilterColumns flagext.StringSliceCSV `yaml:"bloom_filter_columns"`
+	// Temporary row groups read in parallel on flush, 0 or 1 reads them one after the other.
+	FlushConcurrency int `yaml:"flush_concurrency"`
+	// Order of the rows in profiles.parquet, either SortOrderSeries or SortOrderTime.
+	SortOrder string `yaml:"sort_order"`
+
+	// Directory of the row groups temporarily written by the head until it is flushed, defaults to the head directory.
+	TempDir string `yaml:"temp_dir"`
+
+	// Profiles of a series can be ingested out of order, as long as they are within this window of the latest profile of the series.
+	// Ordering is strict by default.
+	OutOfOrderWindow time.Duration `yaml:"out_of_order_window"`
+
+	// Stacktraces deeper than this are truncated at ingestion, keeping their leaf-most frames.
+	MaxStackDepth int `yaml:"max_stack_depth"`
+
+	// Timestamps of the profiles are truncated to this resolution at ingestion.
+	TimestampResolution time.Duration `yaml:"timestamp_resolution"`
+
+	// Action taken on profiles ingested again with the same ID, either DuplicateProfilesDrop or DuplicateProfilesUpsert.
+	DuplicateProfiles string `yaml:"duplicate_profiles"`
+
+	// Heads holding more profiles than this are flushed into multiple blocks, each covering a distinct time range.
+	MaxBlockProfiles uint64 `yaml:"max_block_profiles"`
+
+	// Series receiving more profiles than this per head have the profiles beyond sampled down to this number of profiles, 0
+	// disables the sampling.
+	SeriesReservoirSize int `yaml:"series_reservoir_size"`
+
+	// Selects matching more profiles than this limit are rejected, to avoid materializing huge results.
+	MaxProfilesPerSelect int `yaml:"max_profiles_per_select"`
+
+	// Queries allocating more memory than this limit are rejected. Requests can set a lower limit.
+	MaxQueryMemoryBytes int64 `yaml:"max_query_memory_bytes"`
+
+	// Queries beyond this number running concurrently wait for up to the queue timeout, before they are rejected.
+	MaxConcurrentQueries int           `yaml:"max_concurrent_queries"`
+	QueryQueueTimeout    time.Duration `yaml:"query_queue_timeout"`
+
+	// Maximum bytes of the local blocks, the oldest blocks are deleted once exceeded. 0 disables the budget.
+	MaxDiskBytes int64 `yaml:"max_disk_bytes"`
+
+	// Maximum number of stacktrace merges of a block or the head cached for repeated queries, 0 disables the cache.
+	MergeCacheSize int `yaml:"merge_cache_size"`
+
+	// Local blocks are compacted in the background at this interval, 0 disables the compaction.
+	CompactionInterval time.Duration `yaml:"compaction_interval"`
+	// Number of blocks of a compaction level merged into a single block of the next level.
+	CompactionBlocks int `yaml:"compaction_blocks"`
+
+	// Function names matching a deny pattern, or none of the allow patterns if set, are redacted from query results.
+	FunctionNamesAllow flagext.StringSliceCSV `yaml:"function_names_allow"`
+	FunctionNamesDeny  flagext.StringSliceCSV `yaml:"function_names_deny"`
 
 	Parquet *ParquetConfig `yaml:"-"` // Those configs should not be exposed to the user, rather they should be determined by phlare itself. Currently, they are solely used for test cases.
+	// ParquetPerProfileType overrides the row group limits of Parquet for the profiles of a profile type, e.g.
+	// "memory" or "process_cpu". Those profiles are cut into row groups of their own, while the sort order, bloom
+	// filters and block size of Parquet apply to all profiles.
+	ParquetPerProfileType map[string]*ParquetConfig `yaml:"-"`
+
+	// IDGenerator generates the IDs of profiles ingested without an ID, it defaults to time-ordered ULIDs.
+	IDGenerator IDGenerator `yaml:"-"`
+
+	// BlockEncryptionKey is an AES key of 16, 24 or 32 bytes. If set, the profiles and the index of
+	// flushed blocks are encrypted at rest with AES-GCM. Blocks are decrypted with the same key when queried.
+	BlockEncryptionKey []byte `yaml:"-"`
+
+	// BlockLabels are written to the labels of the meta.json of the flushed blocks, e.g. to tag blocks with
+	// their tenant, their source or the hash of the ingestion config. Downstream systems can route and
+	// filter the blocks by them.
+	BlockLabels map[string]string `yaml:"-"`
 }
 
 type ParquetConfig struct {
 	MaxBufferRowCount int
-	MaxRowGroupBytes  uint64 // This is the maximum row group size in bytes that the raw data uses in memory.
-	MaxBlockBytes     uint64 // This is the size of all parquet tables in memory after which a new block is cut
+	MaxRowGroupBytes  uint64    // This is the maximum row group size in bytes that the raw data uses in memory.
+	MaxBufferBytes    uint64    // This is the maximum of memory buffered for a row group, including the symbols (strings, functions, locations, stacktraces...) added while buffering it.
+	MaxBlockBytes     uint64    // This is the size of all parquet tables in memory after which a new block is cut
+	SortOrder         SortOrder // This is the order in which profiles are written to profiles.parquet.
+	// BloomFilterColumns are the columns of profiles.parquet written with a bloom filter, e.g. "SeriesIndex" or
+	// "Samples.list.element.StacktraceID". Readers skip the column chunks, whose bloom filter lacks the values looked up.
+	BloomFilterColumns []string
+	// FlushConcurrency is the number of temporary row groups read in parallel, while they are written in order to
+	// profiles.parquet on flush. Up to that many row groups are held in memory, 0 or 1 reads them one after the other.
+	FlushConcurrency int
+	// FlushReadBatchSize is the number of rows read at once from a temporary row group, while reading them in parallel
+	// on flush. The batches are pooled and reused across row groups and flushes. Defaults to 16.
+	FlushReadBatchSize int
+	// MaxDictionaryEntries is the maximum of functions or stacktraces added to the symbols of the head while buffering a
+	// row group, the row group is cut once either of them reaches it. This bounds the symbols of pathological profiles.
+	MaxDictionaryEntries int
+	// TargetRowGroupCompressedBytes is the size of the row groups on disk targeted, once set. The size the profiles
+	// are cut into a row group at is estimated by the compression ratio of the previous row groups, so the row groups
+	// are of a similar size on disk. It replaces MaxRowGroupBytes once a row group has been cut, before that the
+	// smaller of both applies.
+	TargetRowGroupCompressedBytes uint64
+	// PageChecksums validates the pages of the parquet files written by a flush against their CRC32 checksums, which
+	// are written for every page. The files are read back once written, a flush fails with a *PageChecksumError on a
+	// mismatch, so no corrupted block is written.
+	PageChecksums bool
 }
 
+// Actions taken on profiles ingested again with the same ID.
+const (
+	// DuplicateProfilesDrop keeps the profile ingested first.
+	DuplicateProfilesDrop = "drop"
+	// DuplicateProfilesUpsert replaces the profile by the one ingested last.
+	DuplicateProfilesUpsert = "upsert"
+)
+
+// SortOrder defines the order of the rows in profiles.parquet.
+type SortOrder int
+
+const (
+	// SeriesThenTime orders profiles by series first and by time within a series.
+	SeriesThenTime SortOrder = iota
+	// TimeThenSeries orders profiles by time first and by series for equal timestamps.
+	// This allows to prune row groups by time more efficiently.
+	TimeThenSeries
+)
+
+// Names of the sort orders in the config.
+const (
+	// SortOrderSeries configures SeriesThenTime.
+	SortOrderSeries = "series"
+	// SortOrderTime configures TimeThenSeries.
+	SortOrderTime = "time"
+)
+
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.StringVar(&cfg.DataPath, "phlaredb.data-path", "./data", "Directory used for local storage.")
 	f.DurationVar(&cfg.MaxBlockDuration, "phlaredb.max-block-duration", 3*time.Hour, "Upper limit to the duration of a Phlare block.")
+	f.DurationVar(&cfg.MaxProfileAge, "phlaredb.max-profile-age", 0, "Maximum age of the oldest profile in the head, based on the profile timestamp. Once exceeded the head is flushed to disk. 0 to disable.")
 	f.Uint64Var(&cfg.RowGroupTargetSize, "phlaredb.row-group-target-size", 10*128*1024*1024, "How big should a single row group be uncompressed") // This should roughly be 128MiB compressed
+	f.Uint64Var(&cfg.MaxBufferBytes, "phlaredb.max-buffer-bytes", 10*128*1024*1024, "Maximum memory in bytes buffered for a row group, including the symbols (functions, locations, stacktraces...) added by its profiles. The row group is cut to disk once exceeded, which bounds the memory of profiles with many unique stacktraces. 0 to disable.")
+	f.IntVar(&cfg.MaxDictionaryEntries, "phlaredb.max-dictionary-entries", 1_000_000, "Maximum functions or stacktraces added to the symbols of the head while buffering a row group. The row group is cut to disk once either of them reaches it, which bounds the symbols of profiles with many unique stacktraces. 0 to disable.")
+	f.Uint64Var(&cfg.RowGroupTargetCompressedSize, "phlaredb.row-group-target-compressed-size", 0, "Size in bytes of the row groups on disk targeted. The size in memory the row groups are cut at is estimated by the compression ratio of the previous row groups, so they are of a similar size on disk. 0 to cut them by their size in memory only.")
+	f.BoolVar(&cfg.PageChecksums, "phlaredb.page-checksums", false, "Validates the pages of the parquet files written by a flush against their CRC32 checksums. The files are read back once written and the flush fails on a mismatch, so no corrupted block is written.")
+	f.Var(&cfg.BloomFilterColumns, "phlaredb.bloom-filter-columns", "Comma-separated list of the columns of profiles.parquet written with a bloom filter, e.g. SeriesIndex or Samples.list.element.StacktraceID. Queries skip the column chunks, whose bloom filter lacks the values looked up. Empty to write no bloom filters.")
+	f.IntVar(&cfg.FlushConcurrency, "phlaredb.flush-concurrency", 0, "Number of the temporary row groups read in parallel, while they are written in order to profiles.parquet on flush. Up to that many row groups are held in memory. 0 or 1 to read them one after the other.")
+	f.StringVar(&cfg.SortOrder, "phlaredb.sort-order", SortOrderSeries, "Order of the rows in profiles.parquet. \""+SortOrderSeries+"\" orders the profiles by series first and by time within a series, \""+SortOrderTime+"\" orders them by time first, which allows to prune row groups by time more efficiently.")
+	f.StringVar(&cfg.TempDir, "phlaredb.temp-dir", "", "Directory used for the row groups temporarily written to disk while the head ingests profiles, e.g. on a faster scratch volume. Flushed blocks are still written to the data path. Defaults to the directory of the head in the data path.")
+	f.DurationVar(&cfg.OutOfOrderWindow, "phlaredb.out-of-order-window", 0, "Maximum age of a profile compared to the latest profile of its series. Older profiles are rejected as out of order. 0 to reject any profile older than the latest profile of its series.")
+	f.IntVar(&cfg.MaxStackDepth, "phlaredb.max-stack-depth", 0, "Maximum number of frames of a stacktrace. Deeper stacktraces are truncated at ingestion, their leaf-most frames are kept and the others are replaced by a single "+TruncatedFrameName+" frame. 0 to disable.")
+	f.DurationVar(&cfg.TimestampResolution, "phlaredb.timestamp-resolution", 0, "Resolution the timestamps of the profiles are truncated to at ingestion, e.g. 1s to store them with second granularity. The samples of the profiles are unaffected. 0 to disable.")
+	f.StringVar(&cfg.DuplicateProfiles, "phlaredb.duplicate-profiles", DuplicateProfilesDrop, "Action taken on profiles ingested again with the ID of a profile in the head, e.g. by client retries. \""+DuplicateProfilesDrop+"\" keeps the first profile, \""+DuplicateProfilesUpsert+"\" replaces it by the latest one, as long as it hasn't been cut into a row group yet.")
+	f.Uint64Var(&cfg.MaxBlockProfiles, "phlaredb.max-block-profiles", 0, "Maximum number of profiles of a block flushed from the head. Heads holding more profiles, e.g. because a flush was delayed, are split by time into multiple blocks. 0 to disable.")
+	f.IntVar(&cfg.SeriesReservoirSize, "phlaredb.series-reservoir-size", 0, "Number of profiles of a series stored per block before sampling. The profiles a series receives beyond are sampled randomly into as many profiles, whose values are scaled to approximate the totals of the series. Sampled profiles are only queryable once the head is flushed. 0 to disable.")
+	f.IntVar(&cfg.MaxProfilesPerSelect, "phlaredb.max-profiles-per-select", 0, "Maximum number of profiles a single query can select from the ingester. Queries exceeding it fail and need to select a narrower time range. 0 to disable.")
+	f.Var(&cfg.FunctionNamesAllow, "phlaredb.function-names-allow", "Comma-separated list of regular expressions matching the function names to keep in query results. Other function names are replaced by "+RedactedFunctionName+". Empty to keep all function names.")
+	f.Var(&cfg.FunctionNamesDeny, "phlaredb.function-names-deny", "Comma-separated list of regular expressions matching the function names to replace by "+RedactedFunctionName+" in query results. The values of the stacktraces are kept.")
+	f.Int64Var(&cfg.MaxQueryMemoryBytes, "phlaredb.max-query-memory-bytes", 0, "Maximum memory in bytes a single query can allocate for selecting and merging profiles. Queries exceeding it fail and need to select a narrower time range. 0 to disable.")
+	f.IntVar(&cfg.MaxConcurrentQueries, "phlaredb.max-concurrent-queries", 0, "Maximum number of queries running concurrently. Further queries wait for up to the query queue timeout for a query to finish, before they are rejected. 0 to disable.")
+	f.DurationVar(&cfg.QueryQueueTimeout, "phlaredb.query-queue-timeout", 0, "Maximum time a query waits for a concurrent query to finish, once the maximum of concurrent queries are running. 0 rejects the query right away.")
+	f.Int64Var(&cfg.MaxDiskBytes, "phlaredb.max-disk-bytes", 0, "Maximum bytes of the local blocks on disk. The oldest blocks are deleted, until the blocks are within this budget. The head is never deleted. 0 to disable.")
+	f.IntVar(&cfg.MergeCacheSize, "phlaredb.merge-cache-size", 0, "Maximum number of stacktrace merges of a block or the head cached in memory, so repeated queries, e.g. dashboard refreshes, don't merge the same profiles again. Cached merges of the head are invalidated by ingestion. 0 to disable.")
+	f.DurationVar(&cfg.CompactionInterval, "phlaredb.compaction-interval", 0, "Interval at which the local blocks are compacted in the background. Blocks of the same compaction level are merged into a single block of the next level, once enough of them are available. 0 to disable.")
+	f.IntVar(&cfg.CompactionBlocks, "phlaredb.compaction-blocks", 4, "Number of blocks of a compaction level merged into a single block of the next level.")
 }
 
 type fileSystem interface {
@@ -76,6 +234,7 @@ func (*realFileSystem) RemoveAll(path string) error                { return os.R
 
 type TenantLimiter interface {
 	AllowProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNano int64) error
+	CheckProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNano int64) error
 	Stop()
 }
 
@@ -91,12 +250,29 @@ type PhlareDB struct {
 
 	headLock sync.RWMutex
 	head     *Head
+	// flushing are the heads cut and being written to blocks, they are
+	// queried along with the head until their blocks are loaded.
+	flushing []*Head
+	// failedFlushes are the heads of flushing whose flush failed, they are
+	// flushed again by the next flush or block sync.
+	failedFlushes []*Head
+
+	// flushLock is held for reading by queries taking their snapshot of the heads and blocks and for
+	// writing by flushes, while handing a flushed head over to its block. Queries see either the head or
+	// its block, never both or none. Queries keep reading their snapshot without holding it.
+	flushLock sync.RWMutex
 
 	volumeChecker diskutil.VolumeChecker
 	fs            fileSystem
 
-	blockQuerier *BlockQuerier
-	limiter      TenantLimiter
+	blockQuerier        *BlockQuerier
+	limiter             TenantLimiter
+	functionNamesFilter *functionNamesFilter
+	mergeCache          *mergeCache
+	queryLimiter        *queryLimiter
+
+	// stopCompactor cancels the compactor running in the background, if any.
+	stopCompactor context.CancelFunc
 }
 
 func New(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*PhlareDB, error) {
@@ -104,6 +280,17 @@ func New(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*PhlareD
 	if err != nil {
 		return nil, err
 	}
+	functionNamesFilter, err := newFunctionNamesFilter(cfg.FunctionNamesAllow, cfg.FunctionNamesDeny)
+	if err != nil {
+		return nil, err
+	}
+	blockEncryption, err := newBlockEncryption(cfg.BlockEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CompactionInterval > 0 && cfg.CompactionBlocks < 2 {
+		return nil, fmt.Errorf("invalid number of compacted blocks %d, at least 2 blocks are merged", cfg.CompactionBlocks)
+	}
 
 	f := &PhlareDB{
 		cfg:    cfg,
@@ -113,8 +300,9 @@ func New(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*PhlareD
 			minFreeDisk,
 			minDiskAvailablePercentage,
 		),
-		fs:      &realFileSystem{},
-		limiter: limiter,
+		fs:                  &realFileSystem{},
+		limiter:             limiter,
+		functionNamesFilter: functionNamesFilter,
 	}
 	if err := os.MkdirAll(f.LocalDataPath(), 0o777); err != nil {
 		return nil, fmt.Errorf("mkdir %s: %w", f.LocalDataPath(), err)
@@ -122,7 +310,17 @@ func New(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*PhlareD
 	reg := phlarecontext.Registry(phlarectx)
 
 	// ensure head metrics are registered early so they are reused for the new head
-	phlarectx = contextWithHeadMetrics(phlarectx, newHeadMetrics(reg))
+	headMetrics := newHeadMetrics(reg)
+	phlarectx = contextWithHeadMetrics(phlarectx, headMetrics)
+	if cfg.MergeCacheSize > 0 {
+		if f.mergeCache, err = newMergeCache(cfg.MergeCacheSize, headMetrics); err != nil {
+			return nil, err
+		}
+	}
+	f.queryLimiter = newQueryLimiter(cfg.MaxConcurrentQueries, cfg.QueryQueueTimeout, headMetrics)
+	if blockEncryption != nil {
+		phlarectx = contextWithBlockEncryption(phlarectx, blockEncryption)
+	}
 	f.phlarectx = phlarectx
 	if _, err := f.initHead(); err != nil {
 		return nil, err
@@ -139,6 +337,9 @@ func New(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*PhlareD
 	if err := f.blockQuerier.Sync(ctx); err != nil {
 		return nil, err
 	}
+	if cfg.CompactionInterval > 0 {
+		f.startCompactor()
+	}
 	return f, nil
 }
 
@@ -246,7 +447,20 @@ func (f *PhlareDB) runBlockQuerierSync(ctx context.Context) {
 	if err := f.cleanupBlocksWhenHighDiskUtilization(ctx); err != nil {
 		level.Error(f.logger).Log("msg", "cleanup block check failed", "err", err)
 	}
+	if err := EnforceDiskBudget(f.phlarectx, f.LocalDataPath(), f.cfg.MaxDiskBytes); err != nil {
+		level.Error(f.logger).Log("msg", "enforcing the disk budget failed", "err", err)
+	}
 
+	// the block of a head whose flush failed is only loaded in place of the head
+	if err := f.retryFlushes(ctx); err != nil {
+		level.Error(f.logger).Log("msg", "flushing head block failed", "err", err)
+		return
+	}
+
+	// the compactor replaces blocks while holding the flush lock, the sync
+	// sees either the compacted blocks or the blocks replacing them
+	f.flushLock.RLock()
+	defer f.flushLock.RUnlock()
 	if err := f.blockQuerier.Sync(ctx); err != nil {
 		level.Error(f.logger).Log("msg", "sync of blocks failed", "err", err)
 	}
@@ -259,6 +473,9 @@ func (f *PhlareDB) loop() {
 		f.wg.Done()
 	}()
 
+	// flushed signals a head flushed in the background
+	flushed := make(chan struct{}, 1)
+
 	for {
 		ctx := context.Background()
 
@@ -266,10 +483,26 @@ func (f *PhlareDB) loop() {
 		case <-f.stopCh:
 			return
 		case <-f.Head().flushCh:
-			if err := f.Flush(ctx); err != nil {
-				level.Error(f.logger).Log("msg", "flushing head block failed", "err", err)
+			// ingestion continues into a new head, while the cut head is
+			// flushed in the background
+			oldHead, err := f.initHead()
+			if err != nil {
+				level.Error(f.logger).Log("msg", "cutting head block failed", "err", err)
 				continue
 			}
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				if err := f.flushHead(ctx, oldHead); err != nil {
+					level.Error(f.logger).Log("msg", "flushing head block failed", "err", err)
+					return
+				}
+				select {
+				case flushed <- struct{}{}:
+				default:
+				}
+			}()
+		case <-flushed:
 			f.runBlockQuerierSync(ctx)
 		case <-blockScanTicker.C:
 			f.runBlockQuerierSync(ctx)
@@ -283,6 +516,9 @@ func (f *PhlareDB) Close() error {
 		errs.Add(f.head.Close())
 	}
 	close(f.stopCh)
+	if f.stopCompactor != nil {
+		f.stopCompactor()
+	}
 	f.wg.Wait()
 	if err := f.blockQuerier.Close(); err != nil {
 		errs.Add(err)
@@ -298,26 +534,150 @@ func (f *PhlareDB) Head() *Head {
 }
 
 func (f *PhlareDB) Queriers() Queriers {
-	block := f.blockQuerier.Queriers()
-	head := f.Head().Queriers()
+	return f.withHeadQueriers(f.blockQuerier.Queriers(), f.heads())
+}
+
+// acquireQueriers returns the queriers like Queriers, the blocks and heads
+// are kept readable for the query until release is called. The flush lock is
+// only held while taking the snapshot, so that slow queries don't hold back
+// flushes and compactions.
+func (f *PhlareDB) acquireQueriers() (queriers Queriers, release func()) {
+	f.flushLock.RLock()
+	defer f.flushLock.RUnlock()
+
+	block, releaseBlocks := f.blockQuerier.acquireQueriers()
+	heads := f.heads()
+	done := make([]func(), len(heads))
+	for i, h := range heads {
+		done[i] = h.acquire()
+	}
+	return f.withHeadQueriers(block, heads), func() {
+		releaseBlocks()
+		for _, d := range done {
+			d()
+		}
+	}
+}
+
+// heads returns the heads being flushed and the head.
+func (f *PhlareDB) heads() []*Head {
+	f.headLock.RLock()
+	defer f.headLock.RUnlock()
+	heads := make([]*Head, 0, len(f.flushing)+1)
+	heads = append(heads, f.flushing...)
+	return append(heads, f.head)
+}
 
-	res := make(Queriers, 0, len(block)+len(head))
+func (f *PhlareDB) withHeadQueriers(block Queriers, heads []*Head) Queriers {
+	res := make(Queriers, 0, len(block)+len(heads))
 	res = append(res, block...)
-	res = append(res, head...)
+	for _, h := range heads {
+		res = append(res, h.Queriers()...)
+	}
 
+	if f.cfg.MaxProfilesPerSelect > 0 {
+		return res.withSelectLimit(f.cfg.MaxProfilesPerSelect, contextHeadMetrics(f.phlarectx).selectTooManyProfiles)
+	}
 	return res
 }
 
+// SelectMatchingProfiles returns the profiles matching the request from the blocks and the head.
+// The profiles are read before returning, so that the result is consistent with concurrent flushes.
+func (f *PhlareDB) SelectMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (iter.Iterator[Profile], error) {
+	releaseQuery, err := f.queryLimiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseQuery()
+
+	queriers, release := f.acquireQueriers()
+	defer release()
+	it, err := queriers.SelectMatchingProfiles(f.queryContext(ctx), params)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := iter.Slice(it)
+	if err != nil {
+		return nil, err
+	}
+	return iter.NewSliceIterator(profiles), nil
+}
+
+// SelectMatchingProfilesPage returns a page of the profiles matching the request from the blocks and the head,
+// ordered by series then time. See Queriers.SelectMatchingProfilesPage.
+func (f *PhlareDB) SelectMatchingProfilesPage(ctx context.Context, params *ingestv1.SelectProfilesRequest, offset, limit int) ([]Profile, error) {
+	releaseQuery, err := f.queryLimiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseQuery()
+
+	queriers, release := f.acquireQueriers()
+	defer release()
+	return queriers.SelectMatchingProfilesPage(f.queryContext(ctx), params, offset, limit)
+}
+
+// CountMatchingProfiles returns the number of profiles and series matching the request from the blocks and the head.
+func (f *PhlareDB) CountMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (ProfileCount, error) {
+	releaseQuery, err := f.queryLimiter.acquire(ctx)
+	if err != nil {
+		return ProfileCount{}, err
+	}
+	defer releaseQuery()
+
+	queriers, release := f.acquireQueriers()
+	defer release()
+	return queriers.CountMatchingProfiles(f.queryContext(ctx), params)
+}
+
 func (f *PhlareDB) MergeProfilesStacktraces(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesStacktracesRequest, ingestv1.MergeProfilesStacktracesResponse]) error {
-	return f.Queriers().MergeProfilesStacktraces(ctx, stream)
+	releaseQuery, err := f.queryLimiter.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseQuery()
+
+	queriers, release := f.acquireQueriers()
+	defer release()
+	return queriers.MergeProfilesStacktraces(f.queryContext(ctx), stream)
 }
 
 func (f *PhlareDB) MergeProfilesLabels(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesLabelsRequest, ingestv1.MergeProfilesLabelsResponse]) error {
-	return f.Queriers().MergeProfilesLabels(ctx, stream)
+	releaseQuery, err := f.queryLimiter.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseQuery()
+
+	queriers, release := f.acquireQueriers()
+	defer release()
+	return queriers.MergeProfilesLabels(f.queryContext(ctx), stream)
 }
 
 func (f *PhlareDB) MergeProfilesPprof(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesPprofRequest, ingestv1.MergeProfilesPprofResponse]) error {
-	return f.Queriers().MergeProfilesPprof(ctx, stream)
+	releaseQuery, err := f.queryLimiter.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseQuery()
+
+	queriers, release := f.acquireQueriers()
+	defer release()
+	return queriers.MergeProfilesPprof(f.queryContext(ctx), stream)
+}
+
+// queryContext adds the configured query limits and filters to ctx.
+func (f *PhlareDB) queryContext(ctx context.Context) context.Context {
+	if f.cfg.MaxQueryMemoryBytes > 0 {
+		ctx = contextWithQueryMemoryLimit(ctx, f.cfg.MaxQueryMemoryBytes, contextHeadMetrics(f.phlarectx).queryMemoryLimitExceeded)
+	}
+	if f.functionNamesFilter != nil {
+		ctx = contextWithFunctionNamesFilter(ctx, f.functionNamesFilter)
+	}
+	if f.mergeCache != nil {
+		ctx = contextWithMergeCache(ctx, f.mergeCache)
+	}
+	return ctx
 }
 
 type BidiServerMerge[Res any, Req any] interface {
@@ -330,13 +690,20 @@ type labelWithIndex struct {
 	index int
 }
 
-// filterProfiles sends profiles to the client and filters them via the bidi stream.
+// selectProfilesBatchSize is the maximum number of profiles sent to the
+// client at once. The next batch is only sent once the client acknowledged the
+// previous one with its selection, which bounds the size of each message.
+var selectProfilesBatchSize = 2048
+
+// filterProfiles sends profiles to the client in batches and filters them via the bidi stream.
+// A selection smaller than the batch is treated as if the missing profiles were not selected.
 func filterProfiles[B BidiServerMerge[Res, Req],
 	Res *ingestv1.MergeProfilesStacktracesResponse | *ingestv1.MergeProfilesLabelsResponse | *ingestv1.MergeProfilesPprofResponse,
 	Req *ingestv1.MergeProfilesStacktracesRequest | *ingestv1.MergeProfilesLabelsRequest | *ingestv1.MergeProfilesPprofRequest](
 	ctx context.Context, profiles iter.Iterator[Profile], batchProfileSize int, stream B,
 ) ([]Profile, error) {
 	selection := []Profile{}
+	mem := contextQueryMemory(ctx)
 	selectProfileResult := &ingestv1.ProfileSets{
 		Profiles:   make([]*ingestv1.SeriesProfile, 0, batchProfileSize),
 		LabelsSets: make([]*typesv1.Labels, 0, batchProfileSize),
@@ -403,17 +770,20 @@ func filterProfiles[B BidiServerMerge[Res, Req],
 		var selected []bool
 		switch s := BidiServerMerge[Res, Req](stream).(type) {
 		case BidiServerMerge[*ingestv1.MergeProfilesStacktracesResponse, *ingestv1.MergeProfilesStacktracesRequest]:
-			selectionResponse, err := s.Receive()
+			var selectionResponse *ingestv1.MergeProfilesStacktracesRequest
+			selectionResponse, err = s.Receive()
 			if err == nil {
 				selected = selectionResponse.Profiles
 			}
 		case BidiServerMerge[*ingestv1.MergeProfilesLabelsResponse, *ingestv1.MergeProfilesLabelsRequest]:
-			selectionResponse, err := s.Receive()
+			var selectionResponse *ingestv1.MergeProfilesLabelsRequest
+			selectionResponse, err = s.Receive()
 			if err == nil {
 				selected = selectionResponse.Profiles
 			}
 		case BidiServerMerge[*ingestv1.MergeProfilesPprofResponse, *ingestv1.MergeProfilesPprofRequest]:
-			selectionResponse, err := s.Receive()
+			var selectionResponse *ingestv1.MergeProfilesPprofRequest
+			selectionResponse, err = s.Receive()
 			if err == nil {
 				selected = selectionResponse.Profiles
 			}
@@ -425,18 +795,24 @@ func filterProfiles[B BidiServerMerge[Res, Req],
 			return err
 		}
 		sp.LogFields(otlog.String("msg", "selection received"))
+		if len(selected) > len(batch) {
+			return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("selection of %d profiles exceeds the batch of %d profiles", len(selected), len(batch)))
+		}
+		before := len(selection)
 		for i, k := range selected {
 			if k {
 				selection = append(selection, batch[i])
 			}
 		}
-		return nil
+		return mem.reserve(int64(len(selection)-before) * selectedProfileBytes)
 	}); err != nil {
 		return nil, err
 	}
 	return selection, nil
 }
 
+// initHead replaces the head by a new head, the previous head is returned
+// and queried until it is flushed.
 func (f *PhlareDB) initHead() (oldHead *Head, err error) {
 	f.headLock.Lock()
 	defer f.headLock.Unlock()
@@ -445,17 +821,70 @@ func (f *PhlareDB) initHead() (oldHead *Head, err error) {
 	if err != nil {
 		return oldHead, err
 	}
+	if oldHead != nil {
+		oldHead.cut(f.head)
+		f.flushing = append(f.flushing, oldHead)
+	}
 	return oldHead, nil
 }
 
+// Flush cuts the head and writes it to a block. Ingestion continues into a
+// new head and queries read the cut head while it is written, they only wait
+// for the block to be loaded in its place. The heads whose flush failed
+// before are flushed again first.
 func (f *PhlareDB) Flush(ctx context.Context) error {
+	errs := multierror.New()
+	errs.Add(f.retryFlushes(ctx))
+
 	oldHead, err := f.initHead()
 	if err != nil {
-		return err
+		errs.Add(err)
+		return errs.Err()
+	}
+
+	if oldHead != nil {
+		errs.Add(f.flushHead(ctx, oldHead))
+	}
+	return errs.Err()
+}
+
+// retryFlushes flushes the heads whose flush failed again.
+func (f *PhlareDB) retryFlushes(ctx context.Context) error {
+	f.headLock.Lock()
+	failed := f.failedFlushes
+	f.failedFlushes = nil
+	f.headLock.Unlock()
+
+	errs := multierror.New()
+	for _, h := range failed {
+		errs.Add(f.flushHead(ctx, h))
 	}
+	return errs.Err()
+}
+
+// flushHead writes a cut head to a block and replaces the head by the block
+// in the queries. A head failing to flush stays queried and is flushed again
+// by retryFlushes.
+func (f *PhlareDB) flushHead(ctx context.Context, h *Head) error {
+	_, err := h.Flush(ctx)
 
-	if oldHead == nil {
-		return nil
+	f.flushLock.Lock()
+	if err == nil {
+		err = f.blockQuerier.Sync(ctx)
 	}
-	return oldHead.Flush(ctx)
+	f.headLock.Lock()
+	if err != nil {
+		f.failedFlushes = append(f.failedFlushes, h)
+	} else {
+		f.flushing = lo.Without(f.flushing, h)
+	}
+	f.headLock.Unlock()
+	f.flushLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// queries which took their snapshot before the block replaced the head
+	// might still read it
+	return h.releaseWhenDone()
 }
@@ -3,10 +3,14 @@ package phlaredb
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -16,11 +20,14 @@ import (
 	"github.com/google/pprof/profile"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
+	"golang.org/x/sync/errgroup"
 
 	googlev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
@@ -29,7 +36,9 @@ import (
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	"github.com/grafana/phlare/pkg/iter"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
 	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	pprofth "github.com/grafana/phlare/pkg/pprof/testhelper"
 	"github.com/grafana/phlare/pkg/testhelper"
 	diskutil "github.com/grafana/phlare/pkg/util/disk"
 )
@@ -108,6 +117,10 @@ func (i *ingesterHandlerPhlareDB) Push(context.Context, *connect.Request[pushv1.
 	return nil, errors.New("not implemented")
 }
 
+func (i *ingesterHandlerPhlareDB) PushStream(context.Context, *connect.BidiStream[ingestv1.PushStreamRequest, ingestv1.PushStreamResponse]) error {
+	return errors.New("not implemented")
+}
+
 func (i *ingesterHandlerPhlareDB) LabelValues(context.Context, *connect.Request[ingestv1.LabelValuesRequest]) (*connect.Response[ingestv1.LabelValuesResponse], error) {
 	return nil, errors.New("not implemented")
 }
@@ -192,6 +205,58 @@ func TestMergeProfilesStacktraces(t *testing.T) {
 		require.Len(t, resp.Result.FunctionNames, 247)
 	})
 
+	mergeScaled := func(t *testing.T, scaling *ingestv1.ValueScaling) *ingestv1.MergeProfilesStacktracesResult {
+		bidi := client.MergeProfilesStacktraces(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{pod="my-pod"}`,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         start.UnixMilli(),
+				End:           end.UnixMilli(),
+			},
+			Scaling: scaling,
+		}))
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(_ int) bool { return true }),
+		}))
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.Nil(t, resp.Result)
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.NotNil(t, resp.Result)
+		return resp.Result
+	}
+
+	t.Run("scale values to milliseconds", func(t *testing.T) {
+		result := mergeScaled(t, &ingestv1.ValueScaling{Factor: 1e-6, Unit: "milliseconds"})
+		require.Equal(t, "milliseconds", result.Unit)
+		require.NotEmpty(t, result.Stacktraces)
+		for _, s := range result.Stacktraces {
+			require.InDelta(t, float64(s.Value)/1e6, s.ScaledValue, 1e-9)
+		}
+
+		// values are not scaled unless requested
+		result = mergeScaled(t, nil)
+		require.Empty(t, result.Unit)
+		for _, s := range result.Stacktraces {
+			require.Zero(t, s.ScaledValue)
+		}
+	})
+
+	t.Run("scale values to percent of the total", func(t *testing.T) {
+		result := mergeScaled(t, &ingestv1.ValueScaling{Percent: true})
+		require.Equal(t, "percent", result.Unit)
+		var total float64
+		for _, s := range result.Stacktraces {
+			require.Greater(t, s.ScaledValue, 0.0)
+			total += s.ScaledValue
+		}
+		require.InDelta(t, 100, total, 1e-9)
+	})
+
 	t.Run("request non existing series", func(t *testing.T) {
 		bidi := client.MergeProfilesStacktraces(ctx)
 
@@ -256,6 +321,403 @@ func TestMergeProfilesStacktraces(t *testing.T) {
 	})
 }
 
+func TestMergeProfilesStacktracesTrimRootFrames(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// stacktraces are ordered from leaf to root
+	p := pprofth.NewProfileBuilder(int64(time.Second)).CPUProfile()
+	p.ForStacktraceString("work", "main", "runtime.main", "runtime.goexit").AddSamples(100)
+	p.ForStacktraceString("gc", "runtime.gcBgMarkWorker", "runtime.goexit").AddSamples(10)
+	p.ForStacktraceString("runtime.goexit").AddSamples(5)
+	require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+	client, cleanup := db.Queriers().ingesterClient()
+	defer cleanup()
+
+	merge := func(t *testing.T, trimRootFrames ...string) (*ingestv1.MergeProfilesStacktracesResult, error) {
+		t.Helper()
+		bidi := client.MergeProfilesStacktraces(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{}`,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+			TrimRootFrames: trimRootFrames,
+		}))
+		for {
+			resp, err := bidi.Receive()
+			if err != nil {
+				return nil, err
+			}
+			if resp.Result != nil {
+				return resp.Result, nil
+			}
+			if resp.SelectedProfiles != nil {
+				require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+					Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(int) bool { return true }),
+				}))
+			}
+		}
+	}
+
+	// index the stacktraces from root to leaf
+	stacktraces := func(r *ingestv1.MergeProfilesStacktracesResult) map[string]int64 {
+		result := make(map[string]int64)
+		for _, s := range r.Stacktraces {
+			names := make([]string, len(s.FunctionIds))
+			for i, id := range s.FunctionIds {
+				names[len(names)-1-i] = r.FunctionNames[id]
+			}
+			result[strings.Join(names, ";")] += s.Value
+		}
+		return result
+	}
+
+	t.Run("exact names", func(t *testing.T) {
+		result, err := merge(t, "runtime.goexit", "runtime.main")
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{
+			"main;work":                 100,
+			"runtime.gcBgMarkWorker;gc": 10,
+			// the leaf frame is kept
+			"runtime.goexit": 5,
+		}, stacktraces(result))
+		require.NotContains(t, result.FunctionNames, "runtime.main")
+
+		// the children of the trimmed frames are the roots of the tree
+		roots := lo.Filter(result.Nodes, func(n *ingestv1.StacktraceNode, _ int) bool { return n.Parent == -1 })
+		require.Equal(t, []string{"main", "runtime.gcBgMarkWorker", "runtime.goexit"}, lo.Map(roots, func(n *ingestv1.StacktraceNode, _ int) string {
+			return result.FunctionNames[n.FunctionId]
+		}))
+		require.Equal(t, int64(115), lo.SumBy(roots, func(n *ingestv1.StacktraceNode) int64 { return n.Total }))
+	})
+
+	t.Run("pattern", func(t *testing.T) {
+		result, err := merge(t, `runtime\..*`)
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{
+			"main;work":      100,
+			"gc":             10,
+			"runtime.goexit": 5,
+		}, stacktraces(result))
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		_, err := merge(t, "runtime.(")
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	})
+}
+
+func TestMergeProfilesStacktracesNodes(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	db, err := New(context.Background(), Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ctx := context.Background()
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+	}
+	require.NoError(t, db.Flush(ctx))
+
+	client, cleanup := db.Queriers().ingesterClient()
+	defer cleanup()
+
+	bidi := client.MergeProfilesStacktraces(ctx)
+	require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+		Request: &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{job="foo"}`,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		},
+	}))
+
+	resp, err := bidi.Receive()
+	require.NoError(t, err)
+	require.Len(t, resp.SelectedProfiles.Profiles, 9)
+	require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+		Profiles: lo.Times(9, func(int) bool { return true }),
+	}))
+
+	// expect empty response
+	resp, err = bidi.Receive()
+	require.NoError(t, err)
+	require.Nil(t, resp.Result)
+
+	resp, err = bidi.Receive()
+	require.NoError(t, err)
+	require.NoError(t, bidi.CloseRequest())
+	require.NoError(t, bidi.CloseResponse())
+
+	// the nodes from root to leaf with their self and total values
+	type node struct {
+		path        string
+		self, total int64
+	}
+	var (
+		paths = make([]string, len(resp.Result.Nodes))
+		nodes = make([]node, len(resp.Result.Nodes))
+	)
+	for i, n := range resp.Result.Nodes {
+		paths[i] = resp.Result.FunctionNames[n.FunctionId]
+		if n.Parent >= 0 {
+			paths[i] = paths[n.Parent] + ";" + paths[i]
+		}
+		nodes[i] = node{path: paths[i], self: n.Self, total: n.Total}
+	}
+	// the stacktraces are "func1 180" and "func2;func1 90"
+	require.Equal(t, []node{
+		{path: "func1", self: 180, total: 180},
+		{path: "func2", self: 0, total: 90},
+		{path: "func2;func1", self: 90, total: 90},
+	}, nodes)
+}
+
+func TestMergeProfilesPprofMappings(t *testing.T) {
+	ctx := context.Background()
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// a symbolized go frame calling into an unsymbolized native library
+	p := pprofth.NewProfileBuilder(int64(time.Second)).CPUProfile()
+	p.ForStacktraceString("main").AddSamples(10)
+	p.StringTable = append(p.StringTable, "libnative.so", "3f1e8c9a2b")
+	p.Mapping = append(p.Mapping, &googlev1.Mapping{
+		Id:          2,
+		MemoryStart: 0x7f0000000000,
+		MemoryLimit: 0x7f0000100000,
+		FileOffset:  0x1000,
+		Filename:    int64(len(p.StringTable) - 2),
+		BuildId:     int64(len(p.StringTable) - 1),
+	})
+	p.Location = append(p.Location, &googlev1.Location{
+		Id:        uint64(len(p.Location) + 1),
+		MappingId: 2,
+		Address:   0x7f0000001234,
+	})
+	p.Sample = append(p.Sample, &googlev1.Sample{
+		LocationId: []uint64{uint64(len(p.Location)), p.Sample[0].LocationId[0]},
+		Value:      []int64{5},
+	})
+	require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+	mergePprof := func(t *testing.T) *profile.Profile {
+		t.Helper()
+		client, cleanup := db.Queriers().ingesterClient()
+		defer cleanup()
+
+		bidi := client.MergeProfilesPprof(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesPprofRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{}`,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+		}))
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+		require.Len(t, resp.SelectedProfiles.Profiles, 1)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesPprofRequest{
+			Profiles: []bool{true},
+		}))
+
+		// expect empty resp to signal it is finished
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.Nil(t, resp.Result)
+
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.NoError(t, bidi.CloseRequest())
+		require.NoError(t, bidi.CloseResponse())
+
+		result, err := profile.ParseUncompressed(resp.Result)
+		require.NoError(t, err)
+		return result
+	}
+
+	assertMappings := func(t *testing.T, result *profile.Profile) {
+		t.Helper()
+		require.Len(t, result.Sample, 2)
+
+		var native *profile.Location
+		for _, l := range result.Location {
+			if l.Address == 0x7f0000001234 {
+				native = l
+			}
+		}
+		require.NotNil(t, native, "unsymbolized location not found")
+		require.Empty(t, native.Line)
+		require.NotNil(t, native.Mapping)
+		require.Equal(t, "libnative.so", native.Mapping.File)
+		require.Equal(t, "3f1e8c9a2b", native.Mapping.BuildID)
+		require.Equal(t, uint64(0x7f0000000000), native.Mapping.Start)
+		require.Equal(t, uint64(0x7f0000100000), native.Mapping.Limit)
+		require.Equal(t, uint64(0x1000), native.Mapping.Offset)
+
+		// the mapping is referenced by the profile itself
+		require.Contains(t, result.Mapping, native.Mapping)
+		for _, s := range result.Sample {
+			if s.Value[0] == 5 {
+				require.Equal(t, native, s.Location[0])
+				require.Equal(t, "main", s.Location[1].Line[0].Function.Name)
+			}
+		}
+	}
+
+	t.Run("head", func(t *testing.T) {
+		assertMappings(t, mergePprof(t))
+	})
+
+	t.Run("block", func(t *testing.T) {
+		require.NoError(t, db.Flush(ctx))
+		require.NoError(t, db.blockQuerier.Sync(ctx))
+		assertMappings(t, mergePprof(t))
+	})
+}
+
+func TestMergeProfilesPprofGoRuntimeTypes(t *testing.T) {
+	ctx := context.Background()
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// goroutine profiles are a snapshot of the current goroutines
+	for i := 1; i <= 2; i++ {
+		p := pprofth.NewProfileBuilder(int64(i) * int64(time.Second)).GoroutineProfile()
+		p.ForStacktraceString("worker", "main").AddSamples(4)
+		p.ForStacktraceString("main").AddSamples(1)
+		require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+
+	// mutex profiles are cumulative, the first profile of a series is only used as baseline
+	for i, values := range [][]int64{{10, 100}, {15, 250}, {21, 400}} {
+		p := pprofth.NewProfileBuilder(int64(i+1) * int64(time.Second)).MutexProfile()
+		p.ForStacktraceString("lock", "main").AddSamples(values...)
+		require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+
+	profileTypes, err := db.Head().ProfileTypes(ctx, connect.NewRequest(&ingestv1.ProfileTypesRequest{}))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{
+		"goroutine:goroutine:count:goroutine:count",
+		"mutex:contentions:count:contentions:count",
+		"mutex:delay:nanoseconds:contentions:count",
+	}, lo.Map(profileTypes.Msg.ProfileTypes, func(t *typesv1.ProfileType, _ int) string { return t.ID }))
+
+	mergePprof := func(t *testing.T, profileType string) *profile.Profile {
+		t.Helper()
+		client, cleanup := db.Queriers().ingesterClient()
+		defer cleanup()
+
+		bidi := client.MergeProfilesPprof(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesPprofRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{}`,
+				Type:          mustParseProfileSelector(t, profileType),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+		}))
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+		require.Len(t, resp.SelectedProfiles.Profiles, 2)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesPprofRequest{
+			Profiles: []bool{true, true},
+		}))
+
+		// expect empty resp to signal it is finished
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.Nil(t, resp.Result)
+
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.NoError(t, bidi.CloseRequest())
+		require.NoError(t, bidi.CloseResponse())
+
+		result, err := profile.ParseUncompressed(resp.Result)
+		require.NoError(t, err)
+		return result
+	}
+
+	valuesByStack := func(p *profile.Profile) map[string]int64 {
+		result := make(map[string]int64)
+		for _, s := range p.Sample {
+			names := make([]string, 0, len(s.Location))
+			for _, l := range s.Location {
+				names = append(names, l.Line[0].Function.Name)
+			}
+			result[strings.Join(names, ";")] += s.Value[0]
+		}
+		return result
+	}
+
+	for _, tc := range []struct {
+		profileType string
+		sampleType  profile.ValueType
+		periodType  profile.ValueType
+		values      map[string]int64
+	}{
+		{
+			profileType: "goroutine:goroutine:count:goroutine:count",
+			sampleType:  profile.ValueType{Type: "goroutine", Unit: "count"},
+			periodType:  profile.ValueType{Type: "goroutine", Unit: "count"},
+			values:      map[string]int64{"worker;main": 8, "main": 2},
+		},
+		{
+			profileType: "mutex:contentions:count:contentions:count",
+			sampleType:  profile.ValueType{Type: "contentions", Unit: "count"},
+			periodType:  profile.ValueType{Type: "contentions", Unit: "count"},
+			values:      map[string]int64{"lock;main": 11},
+		},
+		{
+			profileType: "mutex:delay:nanoseconds:contentions:count",
+			sampleType:  profile.ValueType{Type: "delay", Unit: "nanoseconds"},
+			periodType:  profile.ValueType{Type: "contentions", Unit: "count"},
+			values:      map[string]int64{"lock;main": 300},
+		},
+	} {
+		t.Run(tc.profileType, func(t *testing.T) {
+			result := mergePprof(t, tc.profileType)
+			require.Len(t, result.SampleType, 1)
+			require.Equal(t, tc.sampleType, *result.SampleType[0])
+			require.Equal(t, tc.periodType, *result.PeriodType)
+			require.Equal(t, int64(1), result.Period)
+			require.Equal(t, tc.values, valuesByStack(result))
+		})
+	}
+}
+
 func TestMergeProfilesPprof(t *testing.T) {
 	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
 
@@ -404,6 +866,141 @@ func TestMergeProfilesPprof(t *testing.T) {
 	})
 }
 
+func TestMergeProfilesPprofPruning(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// the profiles of stream-a have the stacks func1;func2 10 and func1 20, leaf first
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+	}
+
+	client, cleanup := db.Queriers().ingesterClient()
+	defer cleanup()
+
+	mergePprof := func(t *testing.T, minPercent float64, aggregate bool) map[string]int64 {
+		bidi := client.MergeProfilesPprof(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesPprofRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{stream="stream-a"}`,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+			MinPercent:      minPercent,
+			AggregatePruned: aggregate,
+		}))
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesPprofRequest{
+			Profiles: []bool{true, true, true},
+		}))
+		// expect empty resp to signal it is finished
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.Nil(t, resp.Result)
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+
+		p, err := profile.ParseUncompressed(resp.Result)
+		require.NoError(t, err)
+		require.NoError(t, p.CheckValid())
+		stacks := map[string]int64{}
+		for _, s := range p.Sample {
+			var names []string
+			for _, loc := range s.Location {
+				for _, line := range loc.Line {
+					names = append(names, line.Function.Name)
+				}
+			}
+			stacks[strings.Join(names, ";")] += s.Value[0]
+		}
+		return stacks
+	}
+
+	require.Equal(t, map[string]int64{"func1": 60, "func1;func2": 30}, mergePprof(t, 0, false))
+	require.Equal(t, map[string]int64{"func1": 60}, mergePprof(t, 50, false))
+	require.Equal(t, map[string]int64{"func1": 60, phlaremodel.PrunedFunctionName: 30}, mergePprof(t, 50, true))
+}
+
+func TestMergeProfilesPprofComments(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// the profiles are spread across a block, a head row group on disk and the head in memory,
+	// only every third profile has comments
+	ingest := func(from, to int) {
+		require.NoError(t, ingestStreamProfiles(ctx, db.Head().Ingest, from, to, func(i int, p *pprofth.ProfileBuilder) {
+			if i%3 == 0 {
+				p.WithComments("go1.20", fmt.Sprintf("segment-%d", i/3))
+			}
+			p.ForStacktraceString("func1").AddSamples(10)
+		}))
+	}
+	ingest(0, 3)
+	require.NoError(t, db.Flush(ctx))
+	ingest(3, 6)
+	require.NoError(t, db.Head().profiles.cutRowGroup())
+	ingest(6, 9)
+	require.Len(t, db.Queriers(), 3)
+
+	client, cleanup := db.Queriers().ingesterClient()
+	defer cleanup()
+
+	mergePprof := func(t *testing.T, selector string) *profile.Profile {
+		bidi := client.MergeProfilesPprof(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesPprofRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: selector,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+		}))
+		// keep all the profiles selected by each querier, until the empty
+		// resp signals it is finished
+		for {
+			resp, err := bidi.Receive()
+			require.NoError(t, err)
+			if resp.SelectedProfiles == nil {
+				require.Nil(t, resp.Result)
+				break
+			}
+			require.NoError(t, bidi.Send(&ingestv1.MergeProfilesPprofRequest{
+				Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(int) bool { return true }),
+			}))
+		}
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+
+		p, err := profile.ParseUncompressed(resp.Result)
+		require.NoError(t, err)
+		require.NoError(t, p.CheckValid())
+		return p
+	}
+
+	p := mergePprof(t, "{}")
+	require.ElementsMatch(t, []string{"go1.20", "segment-0", "segment-1", "segment-2"}, p.Comments)
+	require.Equal(t, int64(90), p.Sample[0].Value[0])
+
+	// profiles without comments don't add any
+	require.Empty(t, mergePprof(t, `{stream="stream-b"}`).Comments)
+}
+
 func TestFilterProfiles(t *testing.T) {
 	ctx := context.Background()
 	profiles := lo.Times(11, func(i int) Profile {
@@ -466,6 +1063,1278 @@ func TestFilterProfiles(t *testing.T) {
 	}, filtered)
 }
 
+func TestFilterProfilesSelectionExceedsBatch(t *testing.T) {
+	profiles := lo.Times(3, func(i int) Profile {
+		return ProfileWithLabels{
+			Profile: &schemav1.Profile{TimeNanos: int64(i * int(time.Minute))},
+			lbs:     phlaremodel.LabelsFromStrings("foo", "bar"),
+			fp:      model.Fingerprint(phlaremodel.LabelsFromStrings("foo", "bar").Hash()),
+		}
+	})
+	bidi := &fakeBidiServerMergeProfilesStacktraces{
+		keep: [][]bool{{true, true, true, true}},
+		t:    t,
+	}
+	_, err := filterProfiles[
+		BidiServerMerge[*ingestv1.MergeProfilesStacktracesResponse, *ingestv1.MergeProfilesStacktracesRequest],
+		*ingestv1.MergeProfilesStacktracesResponse,
+		*ingestv1.MergeProfilesStacktracesRequest](context.Background(), iter.NewSliceIterator(profiles), 5, bidi)
+	require.Error(t, err)
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+// TestMergeProfilesStacktracesBatches ensures that a selection sent in
+// multiple batches results in the same merge as a single batch.
+func TestMergeProfilesStacktracesBatches(t *testing.T) {
+	ctx := testContext(t)
+	head, err := NewHead(ctx, Config{DataPath: t.TempDir()}, NoLimit)
+	require.NoError(t, err)
+
+	for i := 0; i < 30; i++ {
+		p := pprofth.NewProfileBuilder(int64(i)*int64(time.Second)).
+			CPUProfile().
+			WithLabels("stream", fmt.Sprintf("%d", i%3))
+		p.ForStacktraceString("main", fmt.Sprintf("func%d", i%5)).AddSamples(int64(i + 1))
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+
+	merge := func(t *testing.T, batchSize int) (*ingestv1.MergeProfilesStacktracesResult, int) {
+		defer func(previous int) { selectProfilesBatchSize = previous }(selectProfilesBatchSize)
+		selectProfilesBatchSize = batchSize
+
+		client, cleanup := head.Queriers().ingesterClient()
+		defer cleanup()
+
+		bidi := client.MergeProfilesStacktraces(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: "{}",
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+		}))
+
+		var batches, selected int
+		for {
+			resp, err := bidi.Receive()
+			require.NoError(t, err)
+
+			// when empty, finished reading profiles
+			if resp.SelectedProfiles == nil {
+				break
+			}
+			batches++
+			require.LessOrEqual(t, len(resp.SelectedProfiles.Profiles), batchSize)
+
+			// keep every other profile across batches
+			keep := make([]bool, len(resp.SelectedProfiles.Profiles))
+			for pos := range keep {
+				keep[pos] = selected%2 == 0
+				selected++
+			}
+			require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+				Profiles: keep,
+			}))
+		}
+		require.Equal(t, 30, selected)
+
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+		require.NoError(t, bidi.CloseRequest())
+		require.NoError(t, bidi.CloseResponse())
+		return resp.Result, batches
+	}
+
+	single, batches := merge(t, 2048)
+	require.Equal(t, 1, batches)
+
+	batched, batches := merge(t, 7)
+	require.Equal(t, 5, batches)
+
+	// function ids depend on the merge order, so compare by function names
+	stacktraces := func(r *ingestv1.MergeProfilesStacktracesResult) map[string]int64 {
+		result := make(map[string]int64, len(r.Stacktraces))
+		for _, s := range r.Stacktraces {
+			names := lo.Map(s.FunctionIds, func(id int32, _ int) string { return r.FunctionNames[id] })
+			result[strings.Join(names, ";")] += s.Value
+		}
+		return result
+	}
+	require.NotEmpty(t, single.Stacktraces)
+	require.Equal(t, stacktraces(single), stacktraces(batched))
+}
+
+func TestMaxProfilesPerSelect(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:             t.TempDir(),
+		MaxBlockDuration:     time.Duration(100000) * time.Minute, // we will manually flush
+		MaxProfilesPerSelect: 5,
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+	}
+
+	selectProfiles := func(end time.Duration) (int, error) {
+		it, err := db.Queriers().SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(end))),
+		})
+		if err != nil {
+			return 0, err
+		}
+		defer it.Close()
+		var n int
+		for it.Next() {
+			n++
+		}
+		return n, it.Err()
+	}
+
+	_, err = selectProfiles(time.Hour)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrTooManyProfiles))
+	require.Equal(t, 1.0, promtestutil.ToFloat64(contextHeadMetrics(db.phlarectx).selectTooManyProfiles))
+
+	// a narrower time range selects 5 profiles
+	n, err := selectProfiles(4 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+
+	// merges are rejected as well
+	client, cleanup := db.Queriers().ingesterClient()
+	defer cleanup()
+	bidi := client.MergeProfilesLabels(ctx)
+	require.NoError(t, bidi.Send(&ingestv1.MergeProfilesLabelsRequest{
+		Request: &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		},
+	}))
+	for {
+		resp, err := bidi.Receive()
+		if err != nil {
+			require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+			break
+		}
+		require.NotNil(t, resp.SelectedProfiles)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesLabelsRequest{
+			Profiles: make([]bool, len(resp.SelectedProfiles.Profiles)),
+		}))
+	}
+}
+
+func TestMergeProfilesAmbiguousProfileType(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// cpu and heap profiles of the same series labels
+	cpu := pprofth.NewProfileBuilder(int64(time.Second)).CPUProfile().WithLabels("service_name", "foo")
+	cpu.ForStacktraceString("work", "main").AddSamples(10)
+	require.NoError(t, db.Head().Ingest(ctx, cpu.Profile, cpu.UUID, cpu.Labels...))
+	heap := pprofth.NewProfileBuilder(int64(time.Second)).MemoryProfile().WithLabels("service_name", "foo")
+	heap.ForStacktraceString("alloc", "main").AddSamples(1, 2, 3, 4)
+	require.NoError(t, db.Head().Ingest(ctx, heap.Profile, heap.UUID, heap.Labels...))
+
+	client, cleanup := db.Queriers().ingesterClient()
+	defer cleanup()
+
+	merge := func(t *testing.T, profileType *typesv1.ProfileType) (*ingestv1.MergeProfilesStacktracesResult, error) {
+		t.Helper()
+		bidi := client.MergeProfilesStacktraces(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{service_name="foo"}`,
+				Type:          profileType,
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+		}))
+		for {
+			resp, err := bidi.Receive()
+			if err != nil {
+				return nil, err
+			}
+			if resp.Result != nil {
+				return resp.Result, nil
+			}
+			if resp.SelectedProfiles != nil {
+				profiles := make([]bool, len(resp.SelectedProfiles.Profiles))
+				for i := range profiles {
+					profiles[i] = true
+				}
+				require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{Profiles: profiles}))
+			}
+		}
+	}
+
+	t.Run("type not constrained", func(t *testing.T) {
+		_, err := merge(t, nil)
+		require.Error(t, err)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+		require.Contains(t, err.Error(), ErrAmbiguousProfileType.Error())
+	})
+
+	t.Run("type partially constrained", func(t *testing.T) {
+		_, err := merge(t, &typesv1.ProfileType{Name: "memory"})
+		require.Error(t, err)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+		result, err := merge(t, &typesv1.ProfileType{Name: "memory", SampleType: "inuse_space"})
+		require.NoError(t, err)
+		require.Len(t, result.Stacktraces, 1)
+		require.Equal(t, int64(4), result.Stacktraces[0].Value)
+	})
+
+	t.Run("type pinned", func(t *testing.T) {
+		result, err := merge(t, mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"))
+		require.NoError(t, err)
+		require.Len(t, result.Stacktraces, 1)
+		require.Equal(t, int64(10), result.Stacktraces[0].Value)
+	})
+}
+
+func TestMergeProfilesStacktracesNormalizePeriod(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// both profiles sampled 100ms of cpu time, at 100Hz and 250Hz
+	for _, p := range []struct {
+		stream   string
+		function string
+		period   int64
+		samples  int64
+	}{
+		{"100hz", "slow", 10_000_000, 10},
+		{"250hz", "fast", 4_000_000, 25},
+	} {
+		b := pprofth.NewProfileBuilder(int64(time.Second)).CPUProfile().WithLabels("stream", p.stream)
+		b.Profile.Period = p.period
+		b.ForStacktraceString(p.function, "main").AddSamples(p.samples)
+		require.NoError(t, db.Head().Ingest(ctx, b.Profile, b.UUID, b.Labels...))
+	}
+
+	merge := func(t *testing.T, normalize bool) map[string]int64 {
+		t.Helper()
+		client, cleanup := db.Queriers().ingesterClient()
+		defer cleanup()
+
+		bidi := client.MergeProfilesStacktraces(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: "{}",
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+			NormalizePeriod: normalize,
+		}))
+		for {
+			resp, err := bidi.Receive()
+			require.NoError(t, err)
+			if resp.SelectedProfiles != nil {
+				require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+					Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(_ int) bool { return true }),
+				}))
+				continue
+			}
+			if resp.Result == nil {
+				continue
+			}
+			result := make(map[string]int64)
+			for _, s := range resp.Result.Stacktraces {
+				result[resp.Result.FunctionNames[s.FunctionIds[0]]] += s.Value
+			}
+			return result
+		}
+	}
+
+	t.Run("head", func(t *testing.T) {
+		require.Equal(t, map[string]int64{"slow": 10, "fast": 25}, merge(t, false))
+		require.Equal(t, map[string]int64{"slow": 100_000_000, "fast": 100_000_000}, merge(t, true))
+	})
+
+	t.Run("block", func(t *testing.T) {
+		require.NoError(t, db.Flush(ctx))
+		require.Len(t, db.blockQuerier.Queriers(), 1)
+		require.Equal(t, map[string]int64{"slow": 10, "fast": 25}, merge(t, false))
+		require.Equal(t, map[string]int64{"slow": 100_000_000, "fast": 100_000_000}, merge(t, true))
+	})
+}
+
+func TestFlushOnMaxProfileAge(t *testing.T) {
+	ctx := testContext(t)
+	dataPath := t.TempDir()
+	db, err := New(ctx, Config{
+		DataPath:         dataPath,
+		MaxBlockDuration: time.Duration(100000) * time.Minute,
+		MaxProfileAge:    100 * time.Millisecond,
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	head := db.Head()
+	p := pprofth.NewProfileBuilder(time.Now().UnixNano()).CPUProfile()
+	p.ForStacktraceString("my", "other").AddSamples(1)
+	require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+	// the head is flushed without an explicit call
+	metaPath := filepath.Join(dataPath, pathLocal, head.meta.ULID.String(), block.MetaFilename)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(metaPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NotEqual(t, head, db.Head())
+
+	// the flushed block is queryable
+	require.Eventually(t, func() bool {
+		return len(db.blockQuerier.Queriers()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMaxProfileAgeDisabledByDefault(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute,
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	p := pprofth.NewProfileBuilder(0).CPUProfile()
+	p.ForStacktraceString("my", "other").AddSamples(1)
+	require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	_, exceeded := db.Head().profileAgeExceeded(time.Now())
+	require.False(t, exceeded)
+}
+
+func TestSelectMatchingProfilesConcurrentFlush(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, ingestStreamProfiles(ctx, db.Head().Ingest, 0, 9, func(_ int, p *pprofth.ProfileBuilder) {
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+	}))
+
+	selectProfiles := func() (int, error) {
+		it, err := db.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		if err != nil {
+			return 0, err
+		}
+		profiles, err := iter.Slice(it)
+		return len(profiles), err
+	}
+
+	var (
+		stop    = make(chan struct{})
+		done    = make(chan struct{})
+		counts  []int
+		selects int
+	)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			n, err := selectProfiles()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			selects++
+			if n != 9 {
+				counts = append(counts, n)
+			}
+		}
+	}()
+
+	// let some selects run against the head
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, db.Flush(ctx))
+	close(stop)
+	<-done
+
+	require.Greater(t, selects, 0)
+	require.Empty(t, counts, "selects returned an unexpected number of profiles")
+
+	// the profiles are now served by the block
+	require.Len(t, db.blockQuerier.Queriers(), 1)
+	n, err := selectProfiles()
+	require.NoError(t, err)
+	require.Equal(t, 9, n)
+}
+
+// TestSelectMatchingProfilesAcrossFlushedBlocksAndHead ensures that queries
+// see the profiles of a flushed head in its block exactly once, along with the
+// profiles of the head ingested since.
+func TestSelectMatchingProfilesAcrossFlushedBlocksAndHead(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ingest := func(from, to int) {
+		require.NoError(t, ingestStreamProfiles(ctx, db.Head().Ingest, from, to, func(_ int, p *pprofth.ProfileBuilder) {
+			p.ForStacktraceString("func1", "func2").AddSamples(10)
+		}))
+	}
+
+	// the first profiles end up in a block, the later ones stay in the head
+	ingest(0, 6)
+	require.NoError(t, db.Flush(ctx))
+	ingest(6, 9)
+	require.Len(t, db.blockQuerier.Queriers(), 1)
+
+	it, err := db.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: "{}",
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+	})
+	require.NoError(t, err)
+	profiles, err := iter.Slice(it)
+	require.NoError(t, err)
+
+	// every profile is returned exactly once
+	timestamps := make([]model.Time, len(profiles))
+	for i, p := range profiles {
+		timestamps[i] = p.Timestamp()
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	expected := make([]model.Time, 9)
+	for i := range expected {
+		expected[i] = model.TimeFromUnixNano(time.Second.Nanoseconds() * int64(i))
+	}
+	require.Equal(t, expected, timestamps)
+}
+
+func TestFlushWhileIngesting(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ingest := func(from, to int) error {
+		return ingestStreamProfiles(ctx, db.Head().Ingest, from, to, func(_ int, p *pprofth.ProfileBuilder) {
+			p.ForStacktraceString("func1", "func2").AddSamples(10)
+		})
+	}
+	// timestamps returns the sorted timestamps of the selected profiles
+	timestamps := func() ([]model.Time, error) {
+		it, err := db.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		if err != nil {
+			return nil, err
+		}
+		profiles, err := iter.Slice(it)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]model.Time, len(profiles))
+		for i, p := range profiles {
+			res[i] = p.Timestamp()
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+		return res, nil
+	}
+	expected := func(n int) []model.Time {
+		res := make([]model.Time, n)
+		for i := range res {
+			res[i] = model.TimeFromUnixNano(time.Second.Nanoseconds() * int64(i))
+		}
+		return res
+	}
+
+	// the cut head is queried along with the new head until its block is loaded
+	require.NoError(t, ingest(0, 6))
+	oldHead, err := db.initHead()
+	require.NoError(t, err)
+	require.NoError(t, ingest(6, 9))
+	require.NotSame(t, oldHead, db.Head())
+	ts, err := timestamps()
+	require.NoError(t, err)
+	require.Equal(t, expected(9), ts)
+
+	require.NoError(t, db.flushHead(ctx, oldHead))
+	require.Len(t, db.blockQuerier.Queriers(), 1)
+	require.Empty(t, db.flushing)
+	ts, err = timestamps()
+	require.NoError(t, err)
+	require.Equal(t, expected(9), ts)
+
+	// profiles ingested and queried during a flush are returned exactly once
+	require.NoError(t, ingest(9, 15))
+	var g errgroup.Group
+	g.Go(func() error {
+		return db.Flush(ctx)
+	})
+	g.Go(func() error {
+		return ingest(15, 30)
+	})
+	g.Go(func() error {
+		for i := 0; i < 10; i++ {
+			ts, err := timestamps()
+			if err != nil {
+				return err
+			}
+			// profiles are ingested in order, none is missing or duplicated
+			if !assert.Equal(t, expected(len(ts)), ts) {
+				return nil
+			}
+		}
+		return nil
+	})
+	require.NoError(t, g.Wait())
+
+	require.Len(t, db.blockQuerier.Queriers(), 2)
+	ts, err = timestamps()
+	require.NoError(t, err)
+	require.Equal(t, expected(30), ts)
+}
+
+// TestFlushRetry ensures that a head failing to flush is still queried and
+// written to a block by the next flush.
+func TestFlushRetry(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	count := func() uint64 {
+		count, err := db.Queriers().CountMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		require.NoError(t, err)
+		return count.Profiles
+	}
+
+	require.NoError(t, ingestStreamProfiles(ctx, db.Head().Ingest, 0, 6, func(_ int, p *pprofth.ProfileBuilder) {
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+	}))
+	require.NoError(t, db.Head().profiles.cutRowGroup())
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, db.Flush(canceled), context.Canceled)
+	require.Len(t, db.flushing, 1)
+	require.Len(t, db.failedFlushes, 1)
+	require.Empty(t, db.blockQuerier.Queriers())
+	require.Equal(t, uint64(6), count())
+
+	// the next flush writes the failed head and the new one
+	require.NoError(t, ingestStreamProfiles(ctx, db.Head().Ingest, 6, 9, func(_ int, p *pprofth.ProfileBuilder) {
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+	}))
+	require.NoError(t, db.Flush(ctx))
+	require.Empty(t, db.flushing)
+	require.Empty(t, db.failedFlushes)
+	require.Len(t, db.blockQuerier.Queriers(), 2)
+	require.Equal(t, uint64(9), count())
+
+	metas, err := db.BlockMetas(ctx)
+	require.NoError(t, err)
+	for _, meta := range metas {
+		for _, f := range meta.Files {
+			if f.Parquet != nil {
+				require.NotZero(t, f.Parquet.NumRows, f.RelPath)
+			}
+		}
+	}
+}
+
+func TestCountMatchingProfiles(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+	}
+
+	for _, tc := range []struct {
+		name       string
+		selector   string
+		start, end int64
+		expected   ProfileCount
+	}{
+		{name: "all", selector: "{}", start: 0, end: 10000, expected: ProfileCount{Profiles: 9, Series: 3}},
+		{name: "single series", selector: `{stream="stream-a"}`, start: 0, end: 10000, expected: ProfileCount{Profiles: 3, Series: 1}},
+		{name: "regex", selector: `{stream=~"stream-(a|b)"}`, start: 0, end: 10000, expected: ProfileCount{Profiles: 6, Series: 2}},
+		{name: "time range", selector: "{}", start: 2500, end: 5500, expected: ProfileCount{Profiles: 3, Series: 3}},
+		{name: "time range single series", selector: `{stream="stream-b"}`, start: 2500, end: 5500, expected: ProfileCount{Profiles: 1, Series: 1}},
+		{name: "no match", selector: `{stream="stream-d"}`, start: 0, end: 10000, expected: ProfileCount{}},
+	} {
+		params := &ingestv1.SelectProfilesRequest{
+			LabelSelector: tc.selector,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         tc.start,
+			End:           tc.end,
+		}
+		t.Run(tc.name+"/head", func(t *testing.T) {
+			count, err := db.CountMatchingProfiles(ctx, params)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, count)
+		})
+	}
+
+	// the same counts are returned from the flushed block
+	require.NoError(t, db.Flush(ctx))
+	require.Len(t, db.blockQuerier.Queriers(), 1)
+	for _, tc := range []struct {
+		selector string
+		expected ProfileCount
+	}{
+		{selector: "{}", expected: ProfileCount{Profiles: 9, Series: 3}},
+		{selector: `{stream="stream-a"}`, expected: ProfileCount{Profiles: 3, Series: 1}},
+		{selector: `{stream=~"stream-(a|b)"}`, expected: ProfileCount{Profiles: 6, Series: 2}},
+	} {
+		count, err := db.CountMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: tc.selector,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           10000,
+		})
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, count, tc.selector)
+	}
+	count, err := db.CountMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: "{}",
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         2500,
+		End:           5500,
+	})
+	require.NoError(t, err)
+	require.Equal(t, ProfileCount{Profiles: 3, Series: 3}, count)
+}
+
+func TestSelectByIDRange(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// the profiles are spread across a block, a head row group on disk and the head in memory
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+		switch i {
+		case 5:
+			require.NoError(t, db.Flush(ctx))
+		case 7:
+			require.NoError(t, db.Head().profiles.cutRowGroup())
+		}
+	}
+	require.Len(t, db.Queriers(), 3)
+
+	id := func(i int) uuid.UUID {
+		return uuid.MustParse(fmt.Sprintf("00000000-0000-0000-0000-%012d", i))
+	}
+	selectByIDRange := func(selector string, lo, hi uuid.UUID) []string {
+		profiles, err := db.Queriers().SelectByIDRange(ctx, lo, hi, &ingestv1.SelectProfilesRequest{
+			LabelSelector: selector,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		require.NoError(t, err)
+		result := make([]string, len(profiles))
+		for i, p := range profiles {
+			result[i] = fmt.Sprintf("%s %s@%d", p.ID, p.Labels().Get("stream"), p.Timestamp().Unix())
+		}
+		return result
+	}
+
+	require.Equal(t, []string{
+		"00000000-0000-0000-0000-000000000002 stream-c@2",
+		"00000000-0000-0000-0000-000000000003 stream-a@3",
+		"00000000-0000-0000-0000-000000000004 stream-b@4",
+		"00000000-0000-0000-0000-000000000005 stream-c@5",
+		"00000000-0000-0000-0000-000000000006 stream-a@6",
+		"00000000-0000-0000-0000-000000000007 stream-b@7",
+	}, selectByIDRange("{}", id(2), id(8)))
+
+	// the next page starts at the upper bound of the previous one
+	require.Equal(t, []string{
+		"00000000-0000-0000-0000-000000000008 stream-c@8",
+	}, selectByIDRange("{}", id(8), id(100)))
+
+	// the first profile has no ID and got a generated one
+	require.Equal(t, []string{
+		"00000000-0000-0000-0000-000000000003 stream-a@3",
+		"00000000-0000-0000-0000-000000000006 stream-a@6",
+	}, selectByIDRange(`{stream="stream-a"}`, id(0), id(100)))
+
+	require.Empty(t, selectByIDRange("{}", id(100), id(200)))
+
+	// a hi of uuid.Nil selects the IDs from lo across the block and the head
+	require.Equal(t, []string{
+		"00000000-0000-0000-0000-000000000005 stream-c@5",
+		"00000000-0000-0000-0000-000000000007 stream-b@7",
+		"00000000-0000-0000-0000-000000000008 stream-c@8",
+	}, selectByIDRange(`{stream!="stream-a"}`, id(5), uuid.Nil))
+}
+
+func TestSelectMatchingProfilesMatchers(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, ingestStreamProfiles(ctx, db.Head().Ingest, 0, 9, func(_ int, p *pprofth.ProfileBuilder) {
+		p.ForStacktraceString("func1").AddSamples(1)
+	}))
+	// a series without the stream label
+	p := pprofth.NewProfileBuilder(0).CPUProfile()
+	p.ForStacktraceString("func1").AddSamples(1)
+	require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+	selectStreams := func(t *testing.T, selector string) []string {
+		it, err := db.Queriers().SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: selector,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		require.NoError(t, err)
+		defer it.Close()
+		seen := map[string]struct{}{}
+		for it.Next() {
+			seen[it.At().Labels().Get("stream")] = struct{}{}
+		}
+		require.NoError(t, it.Err())
+		result := lo.Keys(seen)
+		sort.Strings(result)
+		return result
+	}
+
+	for _, tc := range []struct {
+		selector string
+		expected []string
+	}{
+		{selector: `{stream=~"stream-[ab]"}`, expected: []string{"stream-a", "stream-b"}},
+		{selector: `{job="foo", stream=~"stream-[ab]"}`, expected: []string{"stream-a", "stream-b"}},
+		{selector: `{job="bar", stream=~"stream-[ab]"}`, expected: []string{}},
+		{selector: `{stream!="stream-a"}`, expected: []string{"", "stream-b", "stream-c"}},
+		{selector: `{stream!~"stream-[ab]"}`, expected: []string{"", "stream-c"}},
+		{selector: `{job=~"f.*", stream!~"stream-[ab]", stream!=""}`, expected: []string{"stream-c"}},
+		{selector: `{stream=""}`, expected: []string{""}},
+		{selector: `{stream=~".+"}`, expected: []string{"stream-a", "stream-b", "stream-c"}},
+	} {
+		tc := tc
+		t.Run("head "+tc.selector, func(t *testing.T) {
+			require.Equal(t, tc.expected, selectStreams(t, tc.selector))
+		})
+	}
+
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+
+	for _, tc := range []struct {
+		selector string
+		expected []string
+	}{
+		{selector: `{stream=~"stream-[ab]"}`, expected: []string{"stream-a", "stream-b"}},
+		{selector: `{stream!~"stream-[ab]"}`, expected: []string{"", "stream-c"}},
+		{selector: `{job="foo", stream!="stream-a", stream=~".+"}`, expected: []string{"stream-b", "stream-c"}},
+	} {
+		tc := tc
+		t.Run("block "+tc.selector, func(t *testing.T) {
+			require.Equal(t, tc.expected, selectStreams(t, tc.selector))
+		})
+	}
+}
+
+// ingesterHandlerWithLimits serves merges through the PhlareDB handlers, which apply the configured query limits.
+type ingesterHandlerWithLimits struct {
+	*ingesterHandlerPhlareDB
+	db *PhlareDB
+}
+
+func (i *ingesterHandlerWithLimits) MergeProfilesStacktraces(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesStacktracesRequest, ingestv1.MergeProfilesStacktracesResponse]) error {
+	return i.db.MergeProfilesStacktraces(ctx, stream)
+}
+
+func (i *ingesterHandlerWithLimits) MergeProfilesPprof(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesPprofRequest, ingestv1.MergeProfilesPprofResponse]) error {
+	return i.db.MergeProfilesPprof(ctx, stream)
+}
+
+func TestQueryMemoryLimit(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:            t.TempDir(),
+		MaxBlockDuration:    time.Duration(100000) * time.Minute, // we will manually flush
+		MaxQueryMemoryBytes: 1 << 30,
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, ingestStreamProfiles(ctx, db.Head().Ingest, 0, 20, func(i int, p *pprofth.ProfileBuilder) {
+		for j := 0; j < 10; j++ {
+			p.ForStacktraceString(fmt.Sprintf("func%d", j), "main").AddSamples(int64(i + 1))
+		}
+	}))
+
+	mux := http.NewServeMux()
+	mux.Handle(ingesterv1connect.NewIngesterServiceHandler(&ingesterHandlerWithLimits{
+		ingesterHandlerPhlareDB: &ingesterHandlerPhlareDB{db.Queriers()},
+		db:                      db,
+	}))
+	serv := testhelper.NewInMemoryServer(mux)
+	defer serv.Close()
+	client := ingesterv1connect.NewIngesterServiceClient(serv.Client(), serv.URL())
+
+	mergeStacktraces := func(maxMemoryBytes int64) (*ingestv1.MergeProfilesStacktracesResult, error) {
+		bidi := client.MergeProfilesStacktraces(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: "{}",
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+			MaxMemoryBytes: maxMemoryBytes,
+		}))
+		for {
+			resp, err := bidi.Receive()
+			if err != nil {
+				return nil, err
+			}
+			if resp.Result != nil {
+				return resp.Result, nil
+			}
+			if resp.SelectedProfiles == nil {
+				continue
+			}
+			require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+				Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(int) bool { return true }),
+			}))
+		}
+	}
+
+	t.Run("generous limit", func(t *testing.T) {
+		result, err := mergeStacktraces(1 << 20)
+		require.NoError(t, err)
+		require.Len(t, result.Stacktraces, 10)
+	})
+
+	t.Run("request limit exceeded", func(t *testing.T) {
+		_, err := mergeStacktraces(128)
+		require.Error(t, err)
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+		require.Contains(t, err.Error(), ErrQueryMemoryLimitExceeded.Error())
+		require.Equal(t, 1.0, promtestutil.ToFloat64(contextHeadMetrics(db.phlarectx).queryMemoryLimitExceeded))
+	})
+
+	t.Run("configured limit exceeded", func(t *testing.T) {
+		db.cfg.MaxQueryMemoryBytes = 128
+		defer func() { db.cfg.MaxQueryMemoryBytes = 1 << 30 }()
+
+		// requests can't raise the configured limit
+		_, err := mergeStacktraces(1 << 20)
+		require.Error(t, err)
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+		require.Contains(t, err.Error(), ErrQueryMemoryLimitExceeded.Error())
+		require.Equal(t, 2.0, promtestutil.ToFloat64(contextHeadMetrics(db.phlarectx).queryMemoryLimitExceeded))
+	})
+}
+
+func TestQueryConcurrencyLimit(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:             t.TempDir(),
+		MaxBlockDuration:     time.Duration(100000) * time.Minute, // we will manually flush
+		MaxConcurrentQueries: 2,
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ingestThreeProfileStreams(ctx, 0, db.Head().Ingest)
+
+	mux := http.NewServeMux()
+	mux.Handle(ingesterv1connect.NewIngesterServiceHandler(&ingesterHandlerWithLimits{
+		ingesterHandlerPhlareDB: &ingesterHandlerPhlareDB{db.Queriers()},
+		db:                      db,
+	}))
+	serv := testhelper.NewInMemoryServer(mux)
+	defer serv.Close()
+	client := ingesterv1connect.NewIngesterServiceClient(serv.Client(), serv.URL())
+
+	// startMerge starts a merge and keeps it running, until finish selects the profiles.
+	startMerge := func() (finish func() (*ingestv1.MergeProfilesStacktracesResult, error), err error) {
+		bidi := client.MergeProfilesStacktraces(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: "{}",
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+		}))
+		resp, err := bidi.Receive()
+		if err != nil {
+			return nil, err
+		}
+		return func() (*ingestv1.MergeProfilesStacktracesResult, error) {
+			for {
+				if resp.Result != nil {
+					return resp.Result, nil
+				}
+				if resp.SelectedProfiles != nil {
+					require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+						Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(int) bool { return true }),
+					}))
+				}
+				if resp, err = bidi.Receive(); err != nil {
+					return nil, err
+				}
+			}
+		}, nil
+	}
+	metrics := contextHeadMetrics(db.phlarectx)
+
+	finish1, err := startMerge()
+	require.NoError(t, err)
+	finish2, err := startMerge()
+	require.NoError(t, err)
+	require.Equal(t, 2.0, promtestutil.ToFloat64(metrics.queriesInflight))
+
+	t.Run("rejected while the limit is reached", func(t *testing.T) {
+		_, err := startMerge()
+		require.Error(t, err)
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+		require.Contains(t, err.Error(), ErrTooManyConcurrentQueries.Error())
+
+		_, err = db.CountMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		require.ErrorIs(t, err, ErrTooManyConcurrentQueries)
+		require.ErrorIs(t, err, ErrLimitExceeded)
+		require.Equal(t, 2.0, promtestutil.ToFloat64(metrics.queriesTooManyConcurrent))
+	})
+
+	t.Run("queued until a query finished", func(t *testing.T) {
+		db.queryLimiter.queueTimeout = time.Minute
+		defer func() { db.queryLimiter.queueTimeout = 0 }()
+
+		queued := make(chan error)
+		go func() {
+			finish3, err := startMerge()
+			if err == nil {
+				_, err = finish3()
+			}
+			queued <- err
+		}()
+		select {
+		case err := <-queued:
+			t.Fatalf("query finished while the limit is reached: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		result, err := finish1()
+		require.NoError(t, err)
+		require.Len(t, result.Stacktraces, 2)
+		require.NoError(t, <-queued)
+	})
+
+	t.Run("rejected after the queue timeout", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			return promtestutil.ToFloat64(metrics.queriesInflight) == 1
+		}, time.Second, 10*time.Millisecond)
+		finish1, err := startMerge()
+		require.NoError(t, err)
+		defer func() {
+			_, err := finish1()
+			require.NoError(t, err)
+		}()
+
+		db.queryLimiter.queueTimeout = 50 * time.Millisecond
+		defer func() { db.queryLimiter.queueTimeout = 0 }()
+		_, err = startMerge()
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+		require.Equal(t, 3.0, promtestutil.ToFloat64(metrics.queriesTooManyConcurrent))
+	})
+
+	_, err = finish2()
+	require.NoError(t, err)
+	// the slot is released once the handler returned, which might be after the client received the result
+	require.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(metrics.queriesInflight) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFunctionNamesFilter(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:          t.TempDir(),
+		MaxBlockDuration:  time.Duration(100000) * time.Minute, // we will manually flush
+		FunctionNamesDeny: []string{`internal/secrets\..*`},
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	p := pprofth.NewProfileBuilder(time.Second.Nanoseconds()).CPUProfile()
+	p.ForStacktraceString("internal/secrets.Decrypt", "main").AddSamples(3)
+	p.ForStacktraceString("net/http.Serve", "main").AddSamples(5)
+	require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+	mux := http.NewServeMux()
+	mux.Handle(ingesterv1connect.NewIngesterServiceHandler(&ingesterHandlerWithLimits{
+		ingesterHandlerPhlareDB: &ingesterHandlerPhlareDB{db.Queriers()},
+		db:                      db,
+	}))
+	serv := testhelper.NewInMemoryServer(mux)
+	defer serv.Close()
+	client := ingesterv1connect.NewIngesterServiceClient(serv.Client(), serv.URL())
+
+	request := &ingestv1.SelectProfilesRequest{
+		LabelSelector: "{}",
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+	}
+
+	t.Run("stacktraces", func(t *testing.T) {
+		bidi := client.MergeProfilesStacktraces(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{Request: request}))
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+		require.Len(t, resp.SelectedProfiles.Profiles, 1)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{Profiles: []bool{true}}))
+
+		// expect empty resp to signal it is finished
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.Nil(t, resp.Result)
+
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.NoError(t, bidi.CloseRequest())
+		require.NoError(t, bidi.CloseResponse())
+
+		values := map[string]int64{}
+		for _, s := range resp.Result.Stacktraces {
+			values[resp.Result.FunctionNames[s.FunctionIds[0]]] = s.Value
+		}
+		require.Equal(t, map[string]int64{
+			RedactedFunctionName: 3,
+			"net/http.Serve":     5,
+		}, values)
+		require.NotContains(t, resp.Result.FunctionNames, "internal/secrets.Decrypt")
+	})
+
+	t.Run("pprof", func(t *testing.T) {
+		bidi := client.MergeProfilesPprof(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesPprofRequest{Request: request}))
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+		require.Len(t, resp.SelectedProfiles.Profiles, 1)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesPprofRequest{Profiles: []bool{true}}))
+
+		// expect empty resp to signal it is finished
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.Nil(t, resp.Result)
+
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.NoError(t, bidi.CloseRequest())
+		require.NoError(t, bidi.CloseResponse())
+
+		result, err := profile.ParseUncompressed(resp.Result)
+		require.NoError(t, err)
+		values := map[string]int64{}
+		for _, s := range result.Sample {
+			values[s.Location[0].Line[0].Function.Name] = s.Value[0]
+		}
+		require.Equal(t, map[string]int64{
+			RedactedFunctionName: 3,
+			"net/http.Serve":     5,
+		}, values)
+	})
+}
+
+func TestMergeCache(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+		MergeCacheSize:   16,
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ingest := func(from, to int) {
+		require.NoError(t, ingestStreamProfiles(ctx, db.Head().Ingest, from, to, func(i int, p *pprofth.ProfileBuilder) {
+			p.ForStacktraceString("func1", "main").AddSamples(int64(i + 1))
+		}))
+	}
+	// the block and the head are cached on their own
+	ingest(0, 6)
+	require.NoError(t, db.Flush(ctx))
+	ingest(6, 9)
+
+	mux := http.NewServeMux()
+	mux.Handle(ingesterv1connect.NewIngesterServiceHandler(&ingesterHandlerWithLimits{
+		ingesterHandlerPhlareDB: &ingesterHandlerPhlareDB{db.Queriers()},
+		db:                      db,
+	}))
+	serv := testhelper.NewInMemoryServer(mux)
+	defer serv.Close()
+	client := ingesterv1connect.NewIngesterServiceClient(serv.Client(), serv.URL())
+
+	mergeStacktraces := func() int64 {
+		bidi := client.MergeProfilesStacktraces(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: "{}",
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+			},
+		}))
+		for {
+			resp, err := bidi.Receive()
+			require.NoError(t, err)
+			if resp.Result != nil {
+				require.Len(t, resp.Result.Stacktraces, 1)
+				return resp.Result.Stacktraces[0].Value
+			}
+			if resp.SelectedProfiles == nil {
+				continue
+			}
+			require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+				Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(int) bool { return true }),
+			}))
+		}
+	}
+	requests := func(result string) float64 {
+		return promtestutil.ToFloat64(contextHeadMetrics(db.phlarectx).mergeCacheRequests.WithLabelValues(result))
+	}
+
+	require.Equal(t, int64(45), mergeStacktraces())
+	require.Equal(t, 0.0, requests("hit"))
+	require.Equal(t, 2.0, requests("miss"))
+
+	// the same query is served from the cache
+	require.Equal(t, int64(45), mergeStacktraces())
+	require.Equal(t, 2.0, requests("hit"))
+	require.Equal(t, 2.0, requests("miss"))
+
+	// an ingest invalidates the cached merge of the head only
+	ingest(9, 10)
+	require.Equal(t, int64(55), mergeStacktraces())
+	require.Equal(t, 3.0, requests("hit"))
+	require.Equal(t, 3.0, requests("miss"))
+}
+
+func TestNewFunctionNamesFilter(t *testing.T) {
+	f, err := newFunctionNamesFilter(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, f)
+
+	_, err = newFunctionNamesFilter([]string{"("}, nil)
+	require.Error(t, err)
+
+	f, err = newFunctionNamesFilter([]string{"main\\..*", "internal/.*"}, []string{"internal/secrets\\..*"})
+	require.NoError(t, err)
+	require.False(t, f.redacted("main.main"))
+	require.False(t, f.redacted("internal/log.Print"))
+	require.True(t, f.redacted("internal/secrets.Decrypt"))
+	require.True(t, f.redacted("net/http.Serve"))
+	// patterns match the whole function name
+	require.True(t, f.redacted("vendor/main.main"))
+}
+
 type fakeVolumeFS struct {
 	mock.Mock
 }
@@ -638,3 +2507,497 @@ func TestPhlareDB_cleanupBlocksWhenHighDiskUtilization(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectTopProfiles(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ingest := func(ts int, value int64) {
+		p := pprofth.NewProfileBuilder(int64(time.Duration(ts)*time.Second)).CPUProfile().WithLabels("job", "foo")
+		p.ForStacktraceString("func1", "func2").AddSamples(value)
+		p.ForStacktraceString("func1").AddSamples(1)
+		require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+	// the heaviest profiles are spread over a flushed block and the head
+	for ts, value := range []int64{5, 50, 20, 40, 10} {
+		ingest(ts, value)
+	}
+	require.NoError(t, db.Flush(ctx))
+	for ts, value := range []int64{30, 60, 20} {
+		ingest(ts+5, value)
+	}
+
+	selectTop := func(limit int) ([]int64, []int64) {
+		profiles, err := db.Queriers().SelectTopProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{job="foo"}`,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+		}, limit)
+		require.NoError(t, err)
+		var totals, timestamps []int64
+		for _, p := range profiles {
+			totals = append(totals, p.Total)
+			timestamps = append(timestamps, int64(p.Timestamp().Time().Second()))
+		}
+		return totals, timestamps
+	}
+
+	totals, timestamps := selectTop(3)
+	require.Equal(t, []int64{61, 51, 41}, totals)
+	require.Equal(t, []int64{6, 1, 3}, timestamps)
+
+	// ties are ordered by time
+	totals, timestamps = selectTop(0)
+	require.Equal(t, []int64{61, 51, 41, 31, 21, 21, 11, 6}, totals)
+	require.Equal(t, []int64{6, 1, 3, 5, 2, 7, 4, 0}, timestamps)
+}
+
+func TestStaleSeries(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ingest := func(ts int, stream string) {
+		p := pprofth.NewProfileBuilder(int64(time.Duration(ts)*time.Second)).CPUProfile().WithLabels("job", "foo", "stream", stream)
+		p.ForStacktraceString("func1").AddSamples(1)
+		require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+	// the latest profile of stream b is in the head, while an older one is in a flushed block
+	ingest(10, "a")
+	ingest(5, "b")
+	require.NoError(t, db.Flush(ctx))
+	ingest(30, "b")
+	ingest(20, "c")
+
+	staleStreams := func(staleness time.Duration) ([]string, []int64) {
+		series, err := db.Queriers().StaleSeries(ctx, time.Unix(40, 0), staleness)
+		require.NoError(t, err)
+		var streams []string
+		var maxTimes []int64
+		for _, s := range series {
+			require.Equal(t, model.Fingerprint(s.Labels.Hash()), s.Fingerprint)
+			streams = append(streams, s.Labels.Get("stream"))
+			maxTimes = append(maxTimes, s.MaxTimeNanos/int64(time.Second))
+		}
+		return streams, maxTimes
+	}
+
+	streams, maxTimes := staleStreams(15 * time.Second)
+	require.Equal(t, []string{"a", "c"}, streams)
+	require.Equal(t, []int64{10, 20}, maxTimes)
+
+	streams, _ = staleStreams(5 * time.Second)
+	require.Equal(t, []string{"a", "b", "c"}, streams)
+
+	streams, _ = staleStreams(35 * time.Second)
+	require.Empty(t, streams)
+}
+
+func TestSelectCollapsed(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// the stacktraces are merged across a flushed block and the head
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+		if i == 4 {
+			require.NoError(t, db.Flush(ctx))
+		}
+	}
+
+	r, err := db.Queriers().SelectCollapsed(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{job="foo"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+	})
+	require.NoError(t, err)
+	collapsed, err := io.ReadAll(r)
+	require.NoError(t, err)
+	// frames are ordered from root to leaf
+	require.Equal(t, "func1 180\nfunc2;func1 90\n", string(collapsed))
+}
+
+func TestSelectDecoded(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// the profiles are selected from a flushed block and the head
+	for i := 0; i < 6; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+		if i == 2 {
+			require.NoError(t, db.Flush(ctx))
+		}
+	}
+
+	it, err := db.Queriers().SelectDecoded(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{job="foo"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+	})
+	require.NoError(t, err)
+	profiles, err := iter.Slice(it)
+	require.NoError(t, err)
+	require.Len(t, profiles, 6)
+
+	timestamps := make([]model.Time, 0, len(profiles))
+	for _, p := range profiles {
+		timestamps = append(timestamps, p.Timestamp)
+		require.Equal(t, "foo", p.Labels.Get("job"))
+		require.Equal(t, streams[int(p.Timestamp.Unix())%3], p.Labels.Get("stream"))
+		// the samples of each profile are kept apart, stacks are ordered from leaf to root
+		require.Equal(t, []ResolvedSample{
+			{Stack: []string{"func1"}, Value: 20},
+			{Stack: []string{"func1", "func2"}, Value: 10},
+		}, p.Samples)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	require.Equal(t, []model.Time{0, 1000, 2000, 3000, 4000, 5000}, timestamps)
+}
+
+func TestSelectSpeedscope(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+		if i == 4 {
+			require.NoError(t, db.Flush(ctx))
+		}
+	}
+
+	r, err := db.Queriers().SelectSpeedscope(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{job="foo"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Minute))),
+	})
+	require.NoError(t, err)
+
+	var file struct {
+		Schema string `json:"$schema"`
+		Shared struct {
+			Frames []struct {
+				Name string `json:"name"`
+			} `json:"frames"`
+		} `json:"shared"`
+		Profiles []struct {
+			Type     string    `json:"type"`
+			Name     string    `json:"name"`
+			Unit     string    `json:"unit"`
+			EndValue int64     `json:"endValue"`
+			Samples  [][]int32 `json:"samples"`
+			Weights  []int64   `json:"weights"`
+		} `json:"profiles"`
+	}
+	require.NoError(t, json.NewDecoder(r).Decode(&file))
+	require.Equal(t, "https://www.speedscope.app/file-format-schema.json", file.Schema)
+	require.Len(t, file.Profiles, 1)
+	profile := file.Profiles[0]
+	require.Equal(t, "sampled", profile.Type)
+	require.Equal(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds", profile.Name)
+	require.Equal(t, "nanoseconds", profile.Unit)
+	require.Equal(t, int64(270), profile.EndValue)
+	require.Len(t, profile.Weights, len(profile.Samples))
+
+	// frames are ordered from root to leaf
+	weights := make(map[string]int64)
+	for i, sample := range profile.Samples {
+		names := lo.Map(sample, func(frame int32, _ int) string { return file.Shared.Frames[frame].Name })
+		weights[strings.Join(names, ";")] += profile.Weights[i]
+	}
+	require.Equal(t, map[string]int64{"func1": 180, "func2;func1": 90}, weights)
+}
+
+func TestMergeProfilesLabelsAllSampleTypes(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// alloc values are cumulative, so only their deltas are stored, inuse values are not
+	for ts := 1; ts <= 3; ts++ {
+		heap := pprofth.NewProfileBuilder(int64(time.Duration(ts)*time.Second)).MemoryProfile().WithLabels("service_name", "foo")
+		heap.ForStacktraceString("alloc", "main").AddSamples(int64(ts*ts), int64(100*ts*ts), 1, int64(10*ts))
+		require.NoError(t, db.Head().Ingest(ctx, heap.Profile, heap.UUID, heap.Labels...))
+	}
+	require.NoError(t, db.Flush(ctx))
+
+	client, cleanup := db.Queriers().ingesterClient()
+	defer cleanup()
+
+	merge := func(t *testing.T, req *ingestv1.MergeProfilesLabelsRequest) (*ingestv1.MergeProfilesLabelsResponse, error) {
+		t.Helper()
+		bidi := client.MergeProfilesLabels(ctx)
+		require.NoError(t, bidi.Send(req))
+		for {
+			resp, err := bidi.Receive()
+			if err != nil {
+				return nil, err
+			}
+			if resp.SelectedProfiles == nil {
+				return bidi.Receive()
+			}
+			require.NoError(t, bidi.Send(&ingestv1.MergeProfilesLabelsRequest{
+				Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(int) bool { return true }),
+			}))
+		}
+	}
+	selectHeap := &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{service_name="foo"}`,
+		Type:          mustParseProfileSelector(t, "memory:inuse_space:bytes:space:bytes"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+	}
+
+	result, err := merge(t, &ingestv1.MergeProfilesLabelsRequest{
+		Request:        selectHeap,
+		By:             []string{"service_name"},
+		AllSampleTypes: true,
+	})
+	require.NoError(t, err)
+	type point struct {
+		timestamp int64
+		value     float64
+	}
+	actual := make(map[string][]point)
+	for _, s := range result.Series {
+		for _, p := range s.Points {
+			lbs := phlaremodel.LabelPairsString(s.Labels)
+			actual[lbs] = append(actual[lbs], point{p.Timestamp, p.Value})
+		}
+	}
+	require.Equal(t, map[string][]point{
+		`{__type__="alloc_objects", __unit__="count", service_name="foo"}`: {{2000, 3}, {3000, 5}},
+		`{__type__="alloc_space", __unit__="bytes", service_name="foo"}`:   {{2000, 300}, {3000, 500}},
+		`{__type__="inuse_objects", __unit__="count", service_name="foo"}`: {{1000, 1}, {2000, 1}, {3000, 1}},
+		`{__type__="inuse_space", __unit__="bytes", service_name="foo"}`:   {{1000, 10}, {2000, 20}, {3000, 30}},
+	}, actual)
+
+	// a single sample type is merged without the option
+	result, err = merge(t, &ingestv1.MergeProfilesLabelsRequest{
+		Request: selectHeap,
+		By:      []string{"service_name"},
+	})
+	require.NoError(t, err)
+	require.Len(t, result.Series, 1)
+	require.Equal(t, `{service_name="foo"}`, phlaremodel.LabelPairsString(result.Series[0].Labels))
+
+	_, err = merge(t, &ingestv1.MergeProfilesLabelsRequest{
+		Request:        selectHeap,
+		AllSampleTypes: true,
+		Scaling:        &ingestv1.ValueScaling{},
+	})
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+func TestSelectMatchingProfilesPage(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// the profiles are spread across a block and the head
+	for i := 0; i < 9; i++ {
+		if i == 5 {
+			require.NoError(t, db.Flush(ctx))
+		}
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+	}
+
+	req := &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{job="foo"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+	}
+	page := func(offset, limit int) []string {
+		profiles, err := db.SelectMatchingProfilesPage(ctx, req, offset, limit)
+		require.NoError(t, err)
+		return lo.Map(profiles, func(p Profile, _ int) string {
+			return fmt.Sprintf("%s@%d", p.Labels().Get("stream"), p.Timestamp().Unix())
+		})
+	}
+
+	// the pages cover all profiles ordered by series then time
+	var all []string
+	for offset := 0; offset < 9; offset += 3 {
+		all = append(all, page(offset, 3)...)
+	}
+	require.Equal(t, []string{
+		"stream-a@0", "stream-a@3", "stream-a@6",
+		"stream-b@1", "stream-b@4", "stream-b@7",
+		"stream-c@2", "stream-c@5", "stream-c@8",
+	}, all)
+	require.Equal(t, all, page(0, 0))
+
+	// pages can span multiple series
+	require.Equal(t, []string{"stream-a@6", "stream-b@1", "stream-b@4"}, page(2, 3))
+	require.Equal(t, []string{"stream-c@8"}, page(8, 3))
+	require.Empty(t, page(9, 3))
+}
+
+func TestMergeProfilesLabelsMaxPoints(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	for i := 0; i < 30; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+	}
+
+	client, cleanup := db.Queriers().ingesterClient()
+	defer cleanup()
+
+	merge := func(t *testing.T, aggregation ingestv1.PointsAggregation) map[string][]float64 {
+		t.Helper()
+		bidi := client.MergeProfilesLabels(ctx)
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesLabelsRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{job="foo"}`,
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+				Start:         0,
+				End:           29999,
+			},
+			By:                []string{"stream"},
+			MaxPoints:         3,
+			PointsAggregation: aggregation,
+		}))
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+		for resp.SelectedProfiles != nil {
+			require.NoError(t, bidi.Send(&ingestv1.MergeProfilesLabelsRequest{
+				Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(int) bool { return true }),
+			}))
+			resp, err = bidi.Receive()
+			require.NoError(t, err)
+		}
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+
+		actual := make(map[string][]float64)
+		for _, s := range resp.Series {
+			stream := phlaremodel.Labels(s.Labels).Get("stream")
+			for i, p := range s.Points {
+				require.Equal(t, int64(i*10000), p.Timestamp)
+				actual[stream] = append(actual[stream], p.Value)
+			}
+		}
+		return actual
+	}
+
+	require.Equal(t, map[string][]float64{
+		streams[0]: {120, 90, 90},
+		streams[1]: {90, 120, 90},
+		streams[2]: {90, 90, 120},
+	}, merge(t, ingestv1.PointsAggregation_POINTS_AGGREGATION_SUM))
+	require.Equal(t, map[string][]float64{
+		streams[0]: {30, 30, 30},
+		streams[1]: {30, 30, 30},
+		streams[2]: {30, 30, 30},
+	}, merge(t, ingestv1.PointsAggregation_POINTS_AGGREGATION_MAX))
+}
+
+// TestQueryDoesNotHoldBackFlush ensures that a query holds the flush lock
+// only while taking its snapshot: a flush completes while the query still
+// reads the flushed head, whose row groups are released by the query.
+func TestQueryDoesNotHoldBackFlush(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	for i := 0; i < 9; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+	}
+
+	// a stalled query keeps its snapshot of the head
+	queriers, release := db.acquireQueriers()
+
+	flushed := make(chan error)
+	go func() {
+		flushed <- db.Flush(ctx)
+	}()
+	select {
+	case err := <-flushed:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("flush held back by a query")
+	}
+
+	req := &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{job="foo"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+	}
+	count := func(queriers Queriers) int {
+		it, err := queriers.SelectMatchingProfiles(ctx, req)
+		require.NoError(t, err)
+		profiles, err := iter.Slice(it)
+		require.NoError(t, err)
+		return len(profiles)
+	}
+
+	// the flushed head is still readable by the query, new queries read its block
+	require.Equal(t, 9, count(queriers))
+	release()
+	require.Equal(t, 9, count(db.Queriers()))
+}
@@ -0,0 +1,51 @@
+package phlaredb
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid"
+)
+
+// IDGenerator generates the IDs of the profiles ingested without an ID.
+type IDGenerator interface {
+	NewID() uuid.UUID
+}
+
+// IDGeneratorFunc is a function implementing IDGenerator.
+type IDGeneratorFunc func() uuid.UUID
+
+func (f IDGeneratorFunc) NewID() uuid.UUID { return f() }
+
+// NewULIDGenerator returns a generator of time-ordered ULIDs, so that sorting
+// profiles by ID approximates sorting them by ingestion time. The IDs
+// generated are monotonically increasing, also within the same millisecond.
+func NewULIDGenerator() IDGenerator {
+	return &ulidGenerator{
+		entropy: ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0),
+		now:     time.Now,
+	}
+}
+
+type ulidGenerator struct {
+	mtx     sync.Mutex
+	entropy io.Reader
+	now     func() time.Time
+	last    uint64
+}
+
+func (g *ulidGenerator) NewID() uuid.UUID {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	// never go back in time, to keep the IDs increasing if the clock does.
+	ms := ulid.Timestamp(g.now())
+	if ms < g.last {
+		ms = g.last
+	}
+	g.last = ms
+	return uuid.UUID(ulid.MustNew(ms, g.entropy))
+}
@@ -67,3 +67,41 @@ type labelKey struct {
 	Num     int64
 	NumUnit int64
 }
+
+// compareSampleLabels compares the label sets of two samples.
+func compareSampleLabels(a, b []*profilev1.Label) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	for i := range a {
+		if a[i] == b[i] {
+			continue
+		}
+		if d := compareInt64(a[i].Key, b[i].Key); d != 0 {
+			return d
+		}
+		if d := compareInt64(a[i].Str, b[i].Str); d != 0 {
+			return d
+		}
+		if d := compareInt64(a[i].Num, b[i].Num); d != 0 {
+			return d
+		}
+		if d := compareInt64(a[i].NumUnit, b[i].NumUnit); d != 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -8,14 +8,20 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/google/uuid"
+	"github.com/grafana/dskit/multierror"
 	"github.com/grafana/dskit/runutil"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
 	"github.com/segmentio/parquet-go"
 	"go.uber.org/atomic"
+	"golang.org/x/exp/slices"
 
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
@@ -40,13 +46,120 @@ type profileStore struct {
 
 	logger log.Logger
 	cfg    *ParquetConfig
+	// cfgPerProfileType overrides the row group limits of cfg for the profiles of a profile type. Those profiles
+	// are buffered apart and cut into row groups of their own.
+	cfgPerProfileType map[string]*ParquetConfig
+	// buffered holds the rows and size buffered per profile type with overrides, or "" for all other profile
+	// types. profileTypes maps the series of profile types with overrides to their profile type.
+	buffered     map[string]*bufferedProfiles
+	profileTypes map[model.Fingerprint]string
+
+	writer                   *parquet.GenericWriter[*schemav1.Profile]
+	writerSortOrder          SortOrder
+	writerBloomFilterColumns []string
+
+	path string
+	// tempPath is the directory of the row group segments, they are written to path if empty.
+	tempPath    string
+	rowsFlushed uint64
 
-	writer *parquet.GenericWriter[*schemav1.Profile]
+	// outOfOrderWindow is how much older than the latest profile of its series a profile can be.
+	outOfOrderWindow time.Duration
 
-	path        string
-	rowsFlushed uint64
+	// duplicateProfiles is the action taken on profiles with the ID and series of a profile ingested before.
+	duplicateProfiles string
+	// bufferedIDs maps the profiles buffered in slice to their position, cutIDs holds the profiles cut into
+	// row groups, which can't be replaced anymore.
+	bufferedIDs map[profileKey]int
+	cutIDs      map[profileKey]struct{}
+
+	rowGroups []*rowGroupOnDisk
+	// view is swapped on each change of the profiles, see profilesView.
+	view atomic.Pointer[profilesView]
+
+	// symbolsSize returns the memory held by the symbol tables of the head.
+	// It is used to account for the symbols added while buffering a row
+	// group.
+	symbolsSize func() uint64
+	// symbolsSizeAtCut is the symbols memory size at the last row group cut.
+	symbolsSizeAtCut uint64
+	// dictionaryEntries returns the number of functions and stacktraces of the head.
+	dictionaryEntries func() (functions, stacktraces int)
+	// functionsAtCut and stacktracesAtCut are the dictionary entries at the last row group cut.
+	functionsAtCut, stacktracesAtCut int
+}
 
+// profilesView is an immutable view of the profiles of the store, each
+// profile is either buffered in memory or in one of the row groups on disk.
+// Row groups are only added to a view once they have been cut completely and
+// their profiles have been taken off the buffer. The view is swapped
+// atomically, so a query reading a single view sees each profile exactly once,
+// while row groups are cut concurrently.
+type profilesView struct {
 	rowGroups []*rowGroupOnDisk
+	inMemory  []*schemav1.Profile
+
+	groupOnce sync.Once
+	// inMemoryPerFP holds the profiles in memory grouped by series and ordered by timestamp.
+	inMemoryPerFP map[model.Fingerprint][]*schemav1.Profile
+}
+
+// inMemorySeries returns the profiles in memory of the view grouped by series
+// and ordered by timestamp. They are grouped once by the first query reading
+// the view.
+func (v *profilesView) inMemorySeries() map[model.Fingerprint][]*schemav1.Profile {
+	v.groupOnce.Do(func() {
+		v.inMemoryPerFP = make(map[model.Fingerprint][]*schemav1.Profile)
+		for _, p := range v.inMemory {
+			v.inMemoryPerFP[p.SeriesFingerprint] = append(v.inMemoryPerFP[p.SeriesFingerprint], p)
+		}
+		for _, profiles := range v.inMemoryPerFP {
+			sort.SliceStable(profiles, func(i, j int) bool {
+				return profiles[i].TimeNanos < profiles[j].TimeNanos
+			})
+		}
+	})
+	return v.inMemoryPerFP
+}
+
+// publishView swaps the view for the current profiles of the store. The caller should be holding the write lock.
+// Published slices are only appended to, changes of their elements need to replace the slices.
+func (s *profileStore) publishView() {
+	s.view.Store(&profilesView{rowGroups: s.rowGroups, inMemory: s.slice})
+}
+
+// currentView returns the view of the profiles published last.
+func (s *profileStore) currentView() *profilesView {
+	if v := s.view.Load(); v != nil {
+		return v
+	}
+	return &profilesView{}
+}
+
+// bufferedProfiles accounts for the profiles buffered for a row group.
+type bufferedProfiles struct {
+	rows int
+	size uint64
+
+	// cutSize and cutCompressedSize sum up the size of the row groups cut from the buffer, in memory and on disk.
+	// Their ratio estimates the compression of the next row group.
+	cutSize, cutCompressedSize uint64
+}
+
+// maxRowGroupBytes returns the size in memory the buffered profiles are cut
+// into a row group at. With a compressed row group size targeted, it is
+// estimated by the compression ratio of the previous row groups.
+func (b *bufferedProfiles) maxRowGroupBytes(cfg *ParquetConfig) uint64 {
+	if cfg.TargetRowGroupCompressedBytes == 0 {
+		return cfg.MaxRowGroupBytes
+	}
+	if b.cutCompressedSize == 0 {
+		if cfg.MaxRowGroupBytes > 0 && cfg.MaxRowGroupBytes < cfg.TargetRowGroupCompressedBytes {
+			return cfg.MaxRowGroupBytes
+		}
+		return cfg.TargetRowGroupCompressedBytes
+	}
+	return uint64(float64(cfg.TargetRowGroupCompressedBytes) * float64(b.cutSize) / float64(b.cutCompressedSize))
 }
 
 func newProfileStore(phlarectx context.Context) *profileStore {
@@ -59,12 +172,57 @@ func newProfileStore(phlarectx context.Context) *profileStore {
 
 	// Initialize writer on /dev/null
 	// TODO: Reuse parquet.Writer beyond life time of the head.
-	s.writer = parquet.NewGenericWriter[*schemav1.Profile](io.Discard, s.persister.Schema(),
+	s.initWriter(SeriesThenTime, nil)
+
+	return s
+}
+
+// initWriter creates the parquet writer, which records the sorting columns of the given sort order in the row group metadata
+// and writes bloom filters for the given columns.
+func (s *profileStore) initWriter(order SortOrder, bloomFilterColumns []string) {
+	s.writer = newProfilesWriter(io.Discard, order, bloomFilterColumns)
+	s.writerSortOrder = order
+	s.writerBloomFilterColumns = bloomFilterColumns
+}
+
+// newProfilesWriter returns a writer of profiles to w, sorted by order and with
+// bloom filters for the dot separated column paths.
+func newProfilesWriter(w io.Writer, order SortOrder, bloomFilterColumns []string) *parquet.GenericWriter[*schemav1.Profile] {
+	options := []parquet.WriterOption{
+		(&schemav1.ProfilePersister{}).Schema(),
 		parquet.ColumnPageBuffers(parquet.NewFileBufferPool(os.TempDir(), "phlaredb-parquet-buffers*")),
 		parquet.CreatedBy("github.com/grafana/phlare/", build.Version, build.Revision),
-	)
+		parquet.SortingWriterConfig(order.sortingColumns()),
+	}
+	if len(bloomFilterColumns) > 0 {
+		options = append(options, parquet.BloomFilters(bloomFilters(bloomFilterColumns)...))
+	}
+	return parquet.NewGenericWriter[*schemav1.Profile](w, options...)
+}
 
-	return s
+// bloomFilterBitsPerValue results in a false positive rate of about 1%.
+const bloomFilterBitsPerValue = 10
+
+// bloomFilters returns split block bloom filters for the dot separated column paths.
+func bloomFilters(columns []string) []parquet.BloomFilterColumn {
+	filters := make([]parquet.BloomFilterColumn, len(columns))
+	for i, c := range columns {
+		filters[i] = parquet.SplitBlockFilter(bloomFilterBitsPerValue, strings.Split(c, ".")...)
+	}
+	return filters
+}
+
+func (o SortOrder) sortingColumns() parquet.SortingOption {
+	if o == TimeThenSeries {
+		return parquet.SortingColumns(
+			parquet.Ascending("TimeNanos"),
+			parquet.Ascending("SeriesIndex"),
+		)
+	}
+	return parquet.SortingColumns(
+		parquet.Ascending("SeriesIndex"),
+		parquet.Ascending("TimeNanos"),
+	)
 }
 
 func (s *profileStore) Name() string {
@@ -85,6 +243,9 @@ func (s *profileStore) Init(path string, cfg *ParquetConfig, metrics *headMetric
 	if err := s.Close(); err != nil {
 		return err
 	}
+	if err := s.releaseRowGroups(); err != nil {
+		return err
+	}
 
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -99,13 +260,85 @@ func (s *profileStore) Init(path string, cfg *ParquetConfig, metrics *headMetric
 	s.cfg = cfg
 	s.metrics = metrics
 
-	s.slice = s.slice[:0]
+	s.slice = nil
+	s.bufferedIDs = make(map[profileKey]int)
+	s.cutIDs = make(map[profileKey]struct{})
+	s.buffered = make(map[string]*bufferedProfiles)
+	s.profileTypes = make(map[model.Fingerprint]string)
 
 	s.rowsFlushed = 0
+	s.symbolsSizeAtCut = s.currentSymbolsSize()
+	s.functionsAtCut, s.stacktracesAtCut = s.currentDictionaryEntries()
+	s.publishView()
 
 	return nil
 }
 
+func (s *profileStore) currentSymbolsSize() uint64 {
+	if s.symbolsSize == nil {
+		return 0
+	}
+	return s.symbolsSize()
+}
+
+func (s *profileStore) currentDictionaryEntries() (functions, stacktraces int) {
+	if s.dictionaryEntries == nil {
+		return 0, 0
+	}
+	return s.dictionaryEntries()
+}
+
+// dictionaryEntriesAdded returns the most functions or stacktraces added
+// since the last row group cut.
+func (s *profileStore) dictionaryEntriesAdded() int {
+	functions, stacktraces := s.currentDictionaryEntries()
+	if added := stacktraces - s.stacktracesAtCut; added > functions-s.functionsAtCut {
+		return added
+	}
+	return functions - s.functionsAtCut
+}
+
+// bufferKey returns the key of the buffer of the profiles of the profile
+// type, which is empty unless the profile type has its own config.
+func (s *profileStore) bufferKey(profileName string) string {
+	if _, ok := s.cfgPerProfileType[profileName]; ok {
+		return profileName
+	}
+	return ""
+}
+
+// bufferConfig returns the config of the buffer with the key.
+func (s *profileStore) bufferConfig(key string) *ParquetConfig {
+	if cfg, ok := s.cfgPerProfileType[key]; ok && key != "" {
+		return cfg
+	}
+	return s.cfg
+}
+
+// bufferFull returns true, if the buffer with the key has reached the row
+// group limits of its config.
+func (s *profileStore) bufferFull(key string) bool {
+	b, ok := s.buffered[key]
+	if !ok {
+		return false
+	}
+	cfg := s.bufferConfig(key)
+	return cfg.MaxBufferRowCount > 0 && b.rows >= cfg.MaxBufferRowCount ||
+		(cfg.MaxRowGroupBytes > 0 || cfg.TargetRowGroupCompressedBytes > 0) && b.size >= b.maxRowGroupBytes(cfg) ||
+		cfg.MaxBufferBytes > 0 && s.bufferedBytes(b) >= cfg.MaxBufferBytes ||
+		cfg.MaxDictionaryEntries > 0 && s.dictionaryEntriesAdded() >= cfg.MaxDictionaryEntries
+}
+
+// bufferedBytes estimates the memory held by a row group buffer, which
+// includes the profiles and the symbols added since the last cut.
+func (s *profileStore) bufferedBytes(b *bufferedProfiles) uint64 {
+	size := b.size
+	if current := s.currentSymbolsSize(); current > s.symbolsSizeAtCut {
+		size += current - s.symbolsSizeAtCut
+	}
+	return size
+}
+
 func (s *profileStore) Close() error {
 	return nil
 }
@@ -118,11 +351,14 @@ func (s *profileStore) RowGroups() (rowGroups []parquet.RowGroup) {
 	return rowGroups
 }
 
-func (s *profileStore) profileSort(i, j int) bool {
-	// first compare the labels, if they don't match return
+func (s *profileStore) profileLess(pI, pJ *schemav1.Profile) bool {
+	// when ordering by time first, compare timenanos, if they don't match return
+	if s.cfg.SortOrder == TimeThenSeries && pI.TimeNanos != pJ.TimeNanos {
+		return pI.TimeNanos < pJ.TimeNanos
+	}
+
+	// compare the labels, if they don't match return
 	var (
-		pI   = s.slice[i]
-		pJ   = s.slice[j]
 		lbsI = s.index.profilesPerFP[pI.SeriesFingerprint].lbs
 		lbsJ = s.index.profilesPerFP[pJ.SeriesFingerprint].lbs
 	)
@@ -142,6 +378,15 @@ func (s *profileStore) profileSort(i, j int) bool {
 }
 
 func (s *profileStore) Flush(ctx context.Context) (numRows uint64, numRowGroups uint64, err error) {
+	return s.FlushWithProgress(ctx, nil)
+}
+
+// FlushWithProgress flushes the profiles like Flush, calling progress with
+// the number of rows written so far after each row group. The flush stops
+// once ctx is done, the error then wraps the error of ctx and tells how many
+// rows had been written. The files written by a failed flush are removed,
+// while the row group segments are kept, so the flush can be retried.
+func (s *profileStore) FlushWithProgress(ctx context.Context, progress func(rowsWritten uint64)) (numRows uint64, numRowGroups uint64, err error) {
 	if err := s.Close(); err != nil {
 		return 0, 0, err
 	}
@@ -149,7 +394,19 @@ func (s *profileStore) Flush(ctx context.Context) (numRows uint64, numRowGroups
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	var created []string
+	defer func() {
+		// the row group segments hold the only copy of the profiles cut to
+		// disk, they are kept for the flush to be retried
+		if err != nil {
+			for _, path := range created {
+				_ = os.Remove(path)
+			}
+		}
+	}()
+
 	if err := s.cutRowGroup(); err != nil {
+		s.metrics.flushFailures.WithLabelValues(flushStageAggregation).Inc()
 		return 0, 0, err
 	}
 
@@ -158,13 +415,22 @@ func (s *profileStore) Flush(ctx context.Context) (numRows uint64, numRowGroups
 		block.IndexFilename,
 	)
 
+	created = append(created, indexPath)
 	rowRangerPerRG, err := s.index.writeTo(ctx, indexPath)
 	if err != nil {
+		s.metrics.flushFailures.WithLabelValues(flushStageIndex).Inc()
 		return 0, 0, err
 	}
 
-	for idx, ranges := range rowRangerPerRG {
-		s.rowGroups[idx].seriesIndexes = ranges
+	// the series indexes are rewritten on copies of the row groups, the row
+	// groups themselves are still read by queries
+	rowGroups := make([]parquet.RowGroup, len(s.rowGroups))
+	for idx, rg := range s.rowGroups {
+		rewritten := *rg
+		if idx < len(rowRangerPerRG) {
+			rewritten.seriesIndexes = rowRangerPerRG[idx]
+		}
+		rowGroups[idx] = &rewritten
 	}
 
 	parquetPath := filepath.Join(
@@ -172,49 +438,114 @@ func (s *profileStore) Flush(ctx context.Context) (numRows uint64, numRowGroups
 		s.persister.Name()+block.ParquetSuffix,
 	)
 
-	numRows, numRowGroups, err = s.writeRowGroups(parquetPath, s.RowGroups())
+	created = append(created, parquetPath)
+	numRows, numRowGroups, err = s.writeRowGroups(ctx, parquetPath, rowGroups, progress)
 	if err != nil {
+		s.metrics.flushFailures.WithLabelValues(flushStageParquet).Inc()
 		return 0, 0, err
 	}
+	if s.cfg != nil && s.cfg.PageChecksums {
+		if err := VerifyPageChecksums(parquetPath); err != nil {
+			s.metrics.flushFailures.WithLabelValues(flushStageParquet).Inc()
+			return 0, 0, err
+		}
+	}
 
-	// cleanup row groups, which need cleaning
+	// the segment files are removed, their row groups stay readable for the
+	// queries of the flushed head until releaseRowGroups is called
 	for _, rg := range s.rowGroups {
-		if err := rg.Close(); err != nil {
+		if err := rg.remove(); err != nil {
 			return 0, 0, err
 		}
 	}
-	s.rowGroups = s.rowGroups[:0]
 
 	return numRows, numRowGroups, nil
 }
 
+// releaseRowGroups closes the row groups kept readable after a flush. The
+// profiles must no longer be queried.
+func (s *profileStore) releaseRowGroups() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	errs := multierror.New()
+	for _, rg := range s.rowGroups {
+		errs.Add(rg.file.Close())
+	}
+	s.rowGroups = nil
+	s.publishView()
+	return errs.Err()
+}
+
 func (s *profileStore) prepareFile(path string) (closer io.Closer, err error) {
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
 	if err != nil {
 		return nil, err
 	}
+	if s.cfg != nil && (s.cfg.SortOrder != s.writerSortOrder || !slices.Equal(s.cfg.BloomFilterColumns, s.writerBloomFilterColumns)) {
+		s.initWriter(s.cfg.SortOrder, s.cfg.BloomFilterColumns)
+	}
 	s.writer.Reset(file)
 
 	return file, err
 }
 
+// empty returns true, if no profile is buffered nor has been cut into a row group.
 func (s *profileStore) empty() bool {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	return len(s.slice) == 0
+	return len(s.slice) == 0 && len(s.rowGroups) == 0
 }
 
-// cutRowGroups gets called, when a patrticular row group has been finished and it will flush it to disk. The caller of cutRowGroups should be holding the write lock.
+// cutRowGroup cuts all buffered profiles into row groups, one per profile type with its own config and one for all
+// other profile types. The caller of cutRowGroup should be holding the write lock.
+func (s *profileStore) cutRowGroup() error {
+	keys := make([]string, 0, len(s.buffered))
+	for key, b := range s.buffered {
+		if b.rows > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := s.cutBuffer(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cutBuffer gets called, when a patrticular row group has been finished and it will flush it to disk. The caller of
+// cutBuffer should be holding the write lock.
 // TODO: write row groups asynchronously
-func (s *profileStore) cutRowGroup() (err error) {
+func (s *profileStore) cutBuffer(key string) (err error) {
+	b, ok := s.buffered[key]
 	// do nothing with empty buffer
-	bufferRowNums := len(s.slice)
-	if bufferRowNums == 0 {
+	if !ok || b.rows == 0 {
 		return nil
 	}
 
+	// the profiles of the buffer are taken off the slice once they are
+	// written, the profiles of other buffers keep their order. The published
+	// slice is left unchanged for the queries reading it.
+	var (
+		rgProfiles = make([]*schemav1.Profile, 0, b.rows)
+		kept       = make([]*schemav1.Profile, 0, len(s.slice)-b.rows)
+	)
+	for _, p := range s.slice {
+		if s.profileTypes[p.SeriesFingerprint] == key {
+			rgProfiles = append(rgProfiles, p)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+
+	dir := s.path
+	if s.tempPath != "" {
+		dir = s.tempPath
+	}
 	path := filepath.Join(
-		s.path,
+		dir,
 		fmt.Sprintf("%s.%d%s", s.persister.Name(), s.rowsFlushed, block.ParquetSuffix),
 	)
 
@@ -222,11 +553,23 @@ func (s *profileStore) cutRowGroup() (err error) {
 	if err != nil {
 		return err
 	}
+	closed := false
+	defer func() {
+		// the profiles stay buffered, when the segment couldn't be written
+		if err != nil {
+			if !closed {
+				_ = fileCloser.Close()
+			}
+			_ = os.Remove(path)
+		}
+	}()
 
 	// order profiles properly
-	sort.Slice(s.slice, s.profileSort)
+	sort.Slice(rgProfiles, func(i, j int) bool {
+		return s.profileLess(rgProfiles[i], rgProfiles[j])
+	})
 
-	n, err := s.writer.Write(s.slice)
+	n, err := s.writer.Write(rgProfiles)
 	if err != nil {
 		return errors.Wrap(err, "write row group segments to disk")
 	}
@@ -235,56 +578,83 @@ func (s *profileStore) cutRowGroup() (err error) {
 		return errors.Wrap(err, "close row group segment writer")
 	}
 
+	closed = true
 	if err := fileCloser.Close(); err != nil {
 		return errors.Wrap(err, "closing row group segment file")
 	}
 
-	s.rowsFlushed += uint64(n)
-
 	rowGroup, err := newRowGroupOnDisk(path)
 	if err != nil {
 		return err
 	}
+	s.slice = kept
+	s.rowsFlushed += uint64(n)
 	s.rowGroups = append(s.rowGroups, rowGroup)
 
 	// let index know about row group
-	if err := s.index.cutRowGroup(s.slice); err != nil {
+	if err := s.index.cutRowGroup(rgProfiles); err != nil {
 		return err
 	}
+	for _, p := range rgProfiles {
+		s.cutIDs[profileKey{id: p.ID, fp: p.SeriesFingerprint}] = struct{}{}
+	}
+	s.bufferedIDs = make(map[profileKey]int, len(s.slice))
+	for pos, p := range s.slice {
+		s.bufferedIDs[profileKey{id: p.ID, fp: p.SeriesFingerprint}] = pos
+	}
 
 	level.Debug(s.logger).Log("msg", "cut row group segment", "path", path, "numProfiles", n)
 
-	for i := range s.slice {
-		// don't retain profiles and samples in memory as re-slice.
-		s.slice[i] = nil
+	// reset buffer and metrics, the sizes of the row group are kept to estimate the compression of the next one
+	s.size.Sub(b.size)
+	*b = bufferedProfiles{
+		cutSize:           b.cutSize + b.size,
+		cutCompressedSize: b.cutCompressedSize + uint64(rowGroup.compressedSize),
 	}
-	// reset slice and metrics
-	s.slice = s.slice[:0]
-	s.size.Store(0)
-	s.metrics.sizeBytes.WithLabelValues(s.Name()).Set(0)
+	s.symbolsSizeAtCut = s.currentSymbolsSize()
+	s.functionsAtCut, s.stacktracesAtCut = s.currentDictionaryEntries()
+	s.metrics.sizeBytes.WithLabelValues(s.Name()).Set(float64(s.size.Load()))
+
+	// the row group is complete and its profiles are no longer in memory
+	s.publishView()
 	return nil
 }
 
-func (s *profileStore) writeRowGroups(path string, rowGroups []parquet.RowGroup) (n uint64, numRowGroups uint64, err error) {
+func (s *profileStore) writeRowGroups(ctx context.Context, path string, rowGroups []parquet.RowGroup, progress func(rowsWritten uint64)) (n uint64, numRowGroups uint64, err error) {
 	fileCloser, err := s.prepareFile(path)
 	if err != nil {
 		return 0, 0, err
 	}
 	defer runutil.CloseWithErrCapture(&err, fileCloser, "closing parquet file")
 
-	for rgN, rg := range rowGroups {
-		level.Debug(s.logger).Log("msg", "writing row group", "path", path, "row_group_number", rgN, "rows", rg.NumRows())
+	if progress == nil {
+		progress = func(uint64) {}
+	}
 
-		nInt64, err := s.writer.ReadRowsFrom(rg.Rows())
+	if s.cfg != nil && s.cfg.FlushConcurrency > 1 {
+		n, numRowGroups, err = s.writeRowGroupsConcurrently(ctx, path, rowGroups, s.cfg.FlushConcurrency, progress)
 		if err != nil {
 			return 0, 0, err
 		}
+	} else {
+		for rgN, rg := range rowGroups {
+			if err := flushInterrupted(ctx, n, rowGroups); err != nil {
+				return 0, 0, err
+			}
+			level.Debug(s.logger).Log("msg", "writing row group", "path", path, "row_group_number", rgN, "rows", rg.NumRows())
 
-		n += uint64(nInt64)
-		numRowGroups += 1
+			nInt64, err := s.writer.ReadRowsFrom(rg.Rows())
+			if err != nil {
+				return 0, 0, err
+			}
 
-		if err := s.writer.Flush(); err != nil {
-			return 0, 0, err
+			n += uint64(nInt64)
+			numRowGroups += 1
+
+			if err := s.writer.Flush(); err != nil {
+				return 0, 0, err
+			}
+			progress(n)
 		}
 	}
 
@@ -297,6 +667,170 @@ func (s *profileStore) writeRowGroups(path string, rowGroups []parquet.RowGroup)
 	return n, numRowGroups, nil
 }
 
+const (
+	// flushReadBatchSize is the number of rows read at once from a row group on flush.
+	flushReadBatchSize = 16
+	// flushReadAhead is the number of batches read ahead of the writer per row group.
+	flushReadAhead = 2
+)
+
+// rowsBatchPool holds the batches of rows read from the row groups on flush, they are reused across row groups and
+// flushes.
+var rowsBatchPool = &sync.Pool{New: func() any { return &rowsBatch{} }}
+
+type rowsBatch struct {
+	rows []parquet.Row
+	// buf holds the byte arrays of the rows, which need to outlive the pages of their row group.
+	buf []byte
+	n   int
+	err error
+}
+
+// getRowsBatch returns an empty batch of size rows from the pool.
+func getRowsBatch(pool *sync.Pool, size int) *rowsBatch {
+	b := pool.Get().(*rowsBatch)
+	if cap(b.rows) < size {
+		b.rows = make([]parquet.Row, size)
+	}
+	b.rows = b.rows[:size]
+	// the values of previous row groups must not be read again
+	for i := range b.rows {
+		b.rows[i] = b.rows[i][:0]
+	}
+	b.buf = b.buf[:0]
+	b.n, b.err = 0, nil
+	return b
+}
+
+// retainByteArrays copies the byte arrays of the rows read into buf, as they reference the pages of the reader, which
+// are released once read.
+func (b *rowsBatch) retainByteArrays() {
+	size := 0
+	for _, row := range b.rows[:b.n] {
+		for _, v := range row {
+			if k := v.Kind(); k == parquet.ByteArray || k == parquet.FixedLenByteArray {
+				size += len(v.ByteArray())
+			}
+		}
+	}
+	if cap(b.buf) < size {
+		b.buf = make([]byte, 0, size)
+	}
+	for _, row := range b.rows[:b.n] {
+		for i, v := range row {
+			k := v.Kind()
+			if k != parquet.ByteArray && k != parquet.FixedLenByteArray {
+				continue
+			}
+			start := len(b.buf)
+			b.buf = append(b.buf, v.ByteArray()...)
+			data := b.buf[start:len(b.buf):len(b.buf)]
+			if k == parquet.ByteArray {
+				row[i] = parquet.ByteArrayValue(data).Level(v.RepetitionLevel(), v.DefinitionLevel(), v.Column())
+			} else {
+				row[i] = parquet.FixedLenByteArrayValue(data).Level(v.RepetitionLevel(), v.DefinitionLevel(), v.Column())
+			}
+		}
+	}
+}
+
+// writeRowGroupsConcurrently reads up to concurrency row groups in parallel and writes them in order, so the
+// result is the same as when writing them one after the other.
+func (s *profileStore) writeRowGroupsConcurrently(ctx context.Context, path string, rowGroups []parquet.RowGroup, concurrency int, progress func(rowsWritten uint64)) (n uint64, numRowGroups uint64, err error) {
+	var (
+		batches   = make([]chan *rowsBatch, len(rowGroups))
+		sem       = make(chan struct{}, concurrency)
+		done      = make(chan struct{})
+		batchSize = flushReadBatchSize
+	)
+	if s.cfg.FlushReadBatchSize > 0 {
+		batchSize = s.cfg.FlushReadBatchSize
+	}
+	defer close(done)
+	for i := range batches {
+		batches[i] = make(chan *rowsBatch, flushReadAhead)
+	}
+	go func() {
+		for i, rg := range rowGroups {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go readRowGroupBatches(rg, rowsBatchPool, batchSize, batches[i], done)
+		}
+	}()
+
+	for rgN, rg := range rowGroups {
+		level.Debug(s.logger).Log("msg", "writing row group", "path", path, "row_group_number", rgN, "rows", rg.NumRows())
+
+		for b := range batches[rgN] {
+			if b.err != nil {
+				return 0, 0, b.err
+			}
+			if err := flushInterrupted(ctx, n, rowGroups); err != nil {
+				return 0, 0, err
+			}
+			written, err := s.writer.WriteRows(b.rows[:b.n])
+			rowsBatchPool.Put(b)
+			if err != nil {
+				return 0, 0, err
+			}
+			n += uint64(written)
+		}
+		<-sem
+		numRowGroups += 1
+
+		if err := s.writer.Flush(); err != nil {
+			return 0, 0, err
+		}
+		progress(n)
+	}
+	return n, numRowGroups, nil
+}
+
+// flushInterrupted returns an error wrapping the error of ctx, once it is
+// done, which tells how many of the rows of the row groups have been written.
+func flushInterrupted(ctx context.Context, rowsWritten uint64, rowGroups []parquet.RowGroup) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	var total int64
+	for _, rg := range rowGroups {
+		total += rg.NumRows()
+	}
+	return errors.Wrapf(ctx.Err(), "flush interrupted after writing %d of %d rows", rowsWritten, total)
+}
+
+// readRowGroupBatches sends the rows of the row group in batches, until all rows are read or done is closed.
+func readRowGroupBatches(rg parquet.RowGroup, pool *sync.Pool, batchSize int, batches chan<- *rowsBatch, done <-chan struct{}) {
+	defer close(batches)
+	rows := rg.Rows()
+	defer rows.Close()
+
+	for {
+		b := getRowsBatch(pool, batchSize)
+		n, err := rows.ReadRows(b.rows)
+		b.n = n
+		b.retainByteArrays()
+		if err != nil && err != io.EOF {
+			b.err = err
+		}
+		if n > 0 || b.err != nil {
+			select {
+			case batches <- b:
+			case <-done:
+				return
+			}
+		} else {
+			pool.Put(b)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 func (s *profileStore) ingest(_ context.Context, profiles []*schemav1.Profile, lbs phlaremodel.Labels, profileName string, rewriter *rewriter) error {
 	// rewrite elements
 	for pos := range profiles {
@@ -304,35 +838,198 @@ func (s *profileStore) ingest(_ context.Context, profiles []*schemav1.Profile, l
 			return err
 		}
 	}
+	return s.add(profiles, lbs, profileName)
+}
 
+// add appends profiles whose references have already been rewritten to the
+// symbols of the head.
+func (s *profileStore) add(profiles []*schemav1.Profile, lbs phlaremodel.Labels, profileName string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	defer s.publishView()
 
-	for pos, p := range profiles {
-		// check if row group is full
-		if s.cfg.MaxBufferRowCount > 0 && len(s.slice) >= s.cfg.MaxBufferRowCount ||
-			s.cfg.MaxRowGroupBytes > 0 && s.size.Load() >= s.cfg.MaxRowGroupBytes {
-			if err := s.cutRowGroup(); err != nil {
-				return err
-			}
+	for _, p := range profiles {
+		if err := s.addLocked(p, lbs, profileName); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// add profile to the index
-		s.index.Add(p, lbs, profileName)
+// seriesProfile is a profile of a single sample type with its series.
+type seriesProfile struct {
+	profile     *schemav1.Profile
+	lbs         phlaremodel.Labels
+	profileName string
+}
 
-		// increase size of stored data
-		addedBytes := s.helper.size(profiles[pos])
-		s.metrics.sizeBytes.WithLabelValues(s.Name()).Set(float64(s.size.Add(addedBytes)))
-		s.totalSize.Add(addedBytes)
+// addBatch appends the profiles of different series like add, while holding
+// the lock only once. It returns the error of each profile at its index.
+func (s *profileStore) addBatch(profiles []seriesProfile) []error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer s.publishView()
 
-		// add to slice
-		s.slice = append(s.slice, p)
+	errs := make([]error, len(profiles))
+	for i, p := range profiles {
+		errs[i] = s.addLocked(p.profile, p.lbs, p.profileName)
+	}
+	return errs
+}
 
+// addLocked appends a single profile, the store needs to be locked.
+func (s *profileStore) addLocked(p *schemav1.Profile, lbs phlaremodel.Labels, profileName string) error {
+	if s.ingestDuplicate(p) {
+		return nil
+	}
+
+	// check order again while holding the lock, as a row group might have been cut in the meantime
+	if err := s.index.allowProfile(p.SeriesFingerprint, lbs, p.TimeNanos, s.outOfOrderWindow); err != nil {
+		return err
+	}
+
+	// check if row group is full
+	key := s.bufferKey(profileName)
+	if s.bufferFull(key) {
+		if err := s.cutBuffer(key); err != nil {
+			return err
+		}
 	}
 
+	// add profile to the index
+	if s.index.Add(p, lbs, profileName) {
+		s.metrics.newSeries.Inc()
+		s.metrics.activeSeries.Inc()
+	}
+
+	// increase size of stored data
+	addedBytes := s.helper.size(p)
+	s.metrics.sizeBytes.WithLabelValues(s.Name()).Set(float64(s.size.Add(addedBytes)))
+	s.totalSize.Add(addedBytes)
+
+	b, ok := s.buffered[key]
+	if !ok {
+		b = &bufferedProfiles{}
+		s.buffered[key] = b
+	}
+	b.rows++
+	b.size += addedBytes
+	if key != "" {
+		s.profileTypes[p.SeriesFingerprint] = key
+	}
+
+	// add to slice
+	s.bufferedIDs[profileKey{id: p.ID, fp: p.SeriesFingerprint}] = len(s.slice)
+	s.slice = append(s.slice, p)
 	return nil
 }
 
+// profileKey identifies a profile of a single sample type, the profiles of the
+// different sample types of an ingested profile share the same ID.
+type profileKey struct {
+	id uuid.UUID
+	fp model.Fingerprint
+}
+
+// contains returns true, if a profile with the ID and series of p has been
+// ingested before.
+func (s *profileStore) contains(p *schemav1.Profile) bool {
+	if p.ID == uuid.Nil {
+		return false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	k := profileKey{id: p.ID, fp: p.SeriesFingerprint}
+	_, cut := s.cutIDs[k]
+	_, buffered := s.bufferedIDs[k]
+	return cut || buffered
+}
+
+// ingestDuplicate handles a profile with the ID and series of a profile
+// ingested before. It returns false, if the profile isn't a duplicate or has
+// no ID. Buffered
+// profiles are replaced in upsert mode, all other duplicates are dropped. The
+// caller must hold the write lock.
+func (s *profileStore) ingestDuplicate(p *schemav1.Profile) bool {
+	if p.ID == uuid.Nil {
+		return false
+	}
+	k := profileKey{id: p.ID, fp: p.SeriesFingerprint}
+	if _, ok := s.cutIDs[k]; ok {
+		s.metrics.duplicateProfiles.WithLabelValues(duplicateProfilesDropped).Inc()
+		return true
+	}
+	pos, ok := s.bufferedIDs[k]
+	if !ok {
+		return false
+	}
+	if s.duplicateProfiles != DuplicateProfilesUpsert {
+		s.metrics.duplicateProfiles.WithLabelValues(duplicateProfilesDropped).Inc()
+		return true
+	}
+
+	old := s.slice[pos]
+	s.index.replace(old, p)
+	// replace the slice, as it might be published
+	s.slice = append(make([]*schemav1.Profile, 0, cap(s.slice)), s.slice...)
+	s.slice[pos] = p
+	oldBytes, addedBytes := s.helper.size(old), s.helper.size(p)
+	s.size.Sub(oldBytes)
+	s.size.Add(addedBytes)
+	b := s.buffered[s.profileTypes[p.SeriesFingerprint]]
+	b.size = b.size - oldBytes + addedBytes
+	s.metrics.sizeBytes.WithLabelValues(s.Name()).Set(float64(s.size.Load()))
+	s.totalSize.Sub(oldBytes)
+	s.totalSize.Add(addedBytes)
+	s.metrics.duplicateProfiles.WithLabelValues(duplicateProfilesReplaced).Inc()
+	return true
+}
+
+// truncate drops the buffered profiles older than beforeNanos, profiles cut
+// into row groups are kept. Series without profiles left are removed from the
+// index. It returns the dropped profiles.
+func (s *profileStore) truncate(beforeNanos int64) []*schemav1.Profile {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var (
+		dropped []*schemav1.Profile
+		kept    = make([]*schemav1.Profile, 0, len(s.slice))
+	)
+	for _, p := range s.slice {
+		if p.TimeNanos >= beforeNanos {
+			kept = append(kept, p)
+			continue
+		}
+		dropped = append(dropped, p)
+
+		removedBytes := s.helper.size(p)
+		s.size.Sub(removedBytes)
+		s.totalSize.Sub(removedBytes)
+		if b, ok := s.buffered[s.profileTypes[p.SeriesFingerprint]]; ok {
+			b.rows--
+			b.size -= removedBytes
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	s.slice = kept
+	s.bufferedIDs = make(map[profileKey]int, len(s.slice))
+	for pos, p := range s.slice {
+		s.bufferedIDs[profileKey{id: p.ID, fp: p.SeriesFingerprint}] = pos
+	}
+	s.metrics.sizeBytes.WithLabelValues(s.Name()).Set(float64(s.size.Load()))
+	s.publishView()
+
+	removed := s.index.truncate(dropped)
+	for _, fp := range removed {
+		delete(s.profileTypes, fp)
+	}
+	s.metrics.activeSeries.Sub(float64(len(removed)))
+	return dropped
+}
+
 func (s *profileStore) NumRows() int64 {
 	return int64(len(s.slice)) + int64(s.rowsFlushed)
 }
@@ -341,6 +1038,8 @@ type rowGroupOnDisk struct {
 	parquet.RowGroup
 	file          *os.File
 	seriesIndexes rowRangesWithSeriesIndex
+	// compressedSize is the size of the column chunks of the row group on disk.
+	compressedSize int64
 }
 
 func newRowGroupOnDisk(path string) (*rowGroupOnDisk, error) {
@@ -371,6 +1070,9 @@ func newRowGroupOnDisk(path string) (*rowGroupOnDisk, error) {
 	}
 
 	r.RowGroup = rowGroups[0]
+	for _, c := range segmentParquet.Metadata().RowGroups[0].Columns {
+		r.compressedSize += c.MetaData.TotalCompressedSize
+	}
 
 	return r, nil
 }
@@ -396,6 +1098,12 @@ func (r *rowGroupOnDisk) Close() error {
 		return err
 	}
 
+	return r.remove()
+}
+
+// remove deletes the segment file, the row group can still be read until it
+// is closed.
+func (r *rowGroupOnDisk) remove() error {
 	if err := os.Remove(r.file.Name()); err != nil {
 		return errors.Wrap(err, "deleting row group segment file")
 	}
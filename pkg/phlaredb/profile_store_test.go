@@ -3,8 +3,13 @@ package phlaredb
 import (
 	"context"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,19 +17,23 @@ import (
 	"github.com/google/pprof/profile"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/samber/lo"
 	"github.com/segmentio/parquet-go"
+	"github.com/segmentio/parquet-go/format"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/iter"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
 	"github.com/grafana/phlare/pkg/pprof/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 func testContext(t testing.TB) context.Context {
@@ -95,8 +104,15 @@ func readFullParquetFile[M any](t *testing.T, path string) ([]M, uint64) {
 	reader := parquet.NewGenericReader[M](f)
 
 	slice := make([]M, reader.NumRows())
-	_, err = reader.Read(slice)
-	require.NoError(t, err)
+	// a single read might not return rows across multiple row groups
+	for offset := 0; offset < len(slice); {
+		n, err := reader.Read(slice[offset:])
+		if err != io.EOF {
+			require.NoError(t, err)
+		}
+		require.NotZero(t, n)
+		offset += n
+	}
 
 	return slice, numRGs
 }
@@ -171,8 +187,249 @@ func TestProfileStore_RowGroupSplitting(t *testing.T) {
 	}
 }
 
+// TestProfileStore_RowGroupSplitting_BufferBytes ensures that the symbols
+// added while buffering a row group are accounted for, when deciding to cut
+// a row group.
+func TestProfileStore_RowGroupSplitting_BufferBytes(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		maxBufferBytes uint64
+		expectCut      bool
+	}{
+		{name: "no buffer limit", maxBufferBytes: 0, expectCut: false},
+		{name: "buffer limit", maxBufferBytes: 64 * 1024, expectCut: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testContext(t)
+			// the encoded size of the profiles stays well below the row group target size
+			head, err := NewHead(ctx, Config{
+				DataPath:           t.TempDir(),
+				RowGroupTargetSize: 128 * 1024 * 1024,
+				MaxBufferBytes:     tc.maxBufferBytes,
+			}, NoLimit)
+			require.NoError(t, err)
+			require.Equal(t, tc.maxBufferBytes, head.profiles.cfg.MaxBufferBytes)
+
+			for i := 0; i < 20; i++ {
+				p := testhelper.NewProfileBuilder(time.Second.Nanoseconds() * int64(i))
+				p.CPUProfile()
+				// every profile has a lot of unique stacktraces
+				for j := 0; j < 100; j++ {
+					p.ForStacktraceString(fmt.Sprintf("func-%d-%d-a", i, j), fmt.Sprintf("func-%d-%d-b", i, j)).AddSamples(1)
+				}
+				require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+			}
+
+			assert.Less(t, head.profiles.size.Load(), head.profiles.cfg.MaxRowGroupBytes)
+			if tc.expectCut {
+				assert.Greater(t, len(head.profiles.rowGroups), 1)
+			} else {
+				assert.Equal(t, 0, len(head.profiles.rowGroups))
+			}
+			_, err = head.Flush(ctx)
+			require.NoError(t, err)
+		})
+	}
+}
+
+// TestProfileStore_RowGroupSplitting_CompressedSize ensures that row groups
+// cut by a targeted compressed size are of a similar size on disk.
+func TestProfileStore_RowGroupSplitting_CompressedSize(t *testing.T) {
+	const target = 32 * 1024
+
+	rowGroupSizes := func(t *testing.T, cfg *ParquetConfig) []int64 {
+		var (
+			ctx   = testContext(t)
+			store = newProfileStore(ctx)
+			path  = t.TempDir()
+		)
+		require.NoError(t, store.Init(path, cfg, newHeadMetrics(prometheus.NewRegistry())))
+
+		// the samples of the profiles compress well
+		samples := make([]*schemav1.Sample, 200)
+		for i := range samples {
+			samples[i] = &schemav1.Sample{StacktraceID: uint64(i), Value: 10}
+		}
+		for i := 0; i < 2000; i++ {
+			p := threeProfileStreams(i)
+			p.p.Samples = samples
+			require.NoError(t, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, emptyRewriter()))
+		}
+		_, _, err := store.Flush(context.Background())
+		require.NoError(t, err)
+
+		f, err := os.Open(filepath.Join(path, "profiles.parquet"))
+		require.NoError(t, err)
+		defer f.Close()
+		stat, err := f.Stat()
+		require.NoError(t, err)
+		pf, err := parquet.OpenFile(f, stat.Size())
+		require.NoError(t, err)
+
+		var sizes []int64
+		for _, rg := range pf.Metadata().RowGroups {
+			var size int64
+			for _, c := range rg.Columns {
+				size += c.MetaData.TotalCompressedSize
+			}
+			sizes = append(sizes, size)
+		}
+		return sizes
+	}
+
+	// the first row groups estimate the compression ratio, the last one holds the remaining profiles
+	adaptive := rowGroupSizes(t, &ParquetConfig{MaxBufferRowCount: 100000, TargetRowGroupCompressedBytes: target})
+	require.Greater(t, len(adaptive), 5)
+	for _, size := range adaptive[2 : len(adaptive)-1] {
+		assert.InDelta(t, target, size, target*0.2)
+	}
+
+	// the fixed threshold of the size in memory results in much smaller row groups on disk
+	fixed := rowGroupSizes(t, &ParquetConfig{MaxBufferRowCount: 100000, MaxRowGroupBytes: target})
+	require.Greater(t, len(fixed), len(adaptive))
+	for _, size := range fixed[:len(fixed)-1] {
+		assert.Less(t, size, int64(target/2))
+	}
+}
+
+// TestProfileStore_RowGroupSplitting_DictionaryEntries ensures that a row
+// group is cut, once the functions or stacktraces added while buffering it
+// reach the dictionary limit.
+func TestProfileStore_RowGroupSplitting_DictionaryEntries(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		maxDictionaryEntries int
+		expectedRowsPerRG    []int64
+	}{
+		{name: "no dictionary limit", maxDictionaryEntries: 0},
+		// the symbols of a profile are added before it is buffered, so the
+		// row group is cut when the third profile reaches the limit
+		{name: "dictionary limit", maxDictionaryEntries: 25, expectedRowsPerRG: []int64{2, 3, 3, 3, 3, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testContext(t)
+			// neither the row nor the byte limits are reached
+			head, err := NewHead(ctx, Config{
+				DataPath:             t.TempDir(),
+				RowGroupTargetSize:   128 * 1024 * 1024,
+				MaxDictionaryEntries: tc.maxDictionaryEntries,
+			}, NoLimit)
+			require.NoError(t, err)
+			require.Equal(t, tc.maxDictionaryEntries, head.profiles.cfg.MaxDictionaryEntries)
+
+			for i := 0; i < 20; i++ {
+				p := testhelper.NewProfileBuilder(time.Second.Nanoseconds() * int64(i))
+				p.CPUProfile()
+				// every profile adds 10 functions and stacktraces
+				for j := 0; j < 10; j++ {
+					p.ForStacktraceString(fmt.Sprintf("func-%d-%d", i, j)).AddSamples(1)
+				}
+				require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+			}
+
+			var rowsPerRG []int64
+			for _, rg := range head.profiles.rowGroups {
+				rowsPerRG = append(rowsPerRG, rg.NumRows())
+			}
+			assert.Equal(t, tc.expectedRowsPerRG, rowsPerRG)
+			_, err = head.Flush(ctx)
+			require.NoError(t, err)
+		})
+	}
+}
+
+// TestProfileStore_RowGroupSplitting_PerProfileType ensures that the
+// profiles of a profile type with its own config are cut into row groups of
+// their own, according to that config.
+func TestProfileStore_RowGroupSplitting_PerProfileType(t *testing.T) {
+	ctx := testContext(t)
+	head, err := NewHead(ctx, Config{
+		DataPath: t.TempDir(),
+		ParquetPerProfileType: map[string]*ParquetConfig{
+			"process_cpu": {MaxBufferRowCount: 2},
+			"goroutine":   {MaxBufferRowCount: 3},
+		},
+	}, NoLimit)
+	require.NoError(t, err)
+
+	// cpu profiles are within the first minute, goroutine profiles later on
+	for i := 0; i < 6; i++ {
+		p := testhelper.NewProfileBuilder(time.Second.Nanoseconds() * int64(i)).CPUProfile()
+		p.ForStacktraceString("func1", "func2").AddSamples(10)
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+		p = testhelper.NewProfileBuilder(time.Minute.Nanoseconds() + time.Second.Nanoseconds()*int64(i)).GoroutineProfile()
+		p.ForStacktraceString("func1", "func3").AddSamples(10)
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+
+	// the profiles still buffered aren't lost by cutting the ones of another profile type
+	for _, tc := range []struct {
+		profileType string
+		expected    uint64
+	}{
+		{profileType: "process_cpu:cpu:nanoseconds:cpu:nanoseconds", expected: 6},
+		{profileType: "goroutine:goroutine:count:goroutine:count", expected: 6},
+	} {
+		count, err := head.Queriers().CountMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, tc.profileType),
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(time.Hour.Nanoseconds())),
+		})
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, count.Profiles, tc.profileType)
+	}
+	_, err = head.Flush(ctx)
+	require.NoError(t, err)
+
+	f, err := os.Open(filepath.Join(head.localPath, "profiles.parquet"))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, f.Close())
+	}()
+	stat, err := f.Stat()
+	require.NoError(t, err)
+	pf, err := parquet.OpenFile(f, stat.Size())
+	require.NoError(t, err)
+
+	rowsPerType := map[string][]int64{}
+	for _, rg := range pf.RowGroups() {
+		min, max, ok := timeNanosBounds(rg)
+		require.True(t, ok)
+		switch {
+		case max < time.Minute.Nanoseconds():
+			rowsPerType["process_cpu"] = append(rowsPerType["process_cpu"], rg.NumRows())
+		case min >= time.Minute.Nanoseconds():
+			rowsPerType["goroutine"] = append(rowsPerType["goroutine"], rg.NumRows())
+		default:
+			t.Fatalf("row group mixes profile types: %d-%d", min, max)
+		}
+	}
+	require.Equal(t, map[string][]int64{
+		"process_cpu": {2, 2, 2},
+		"goroutine":   {3, 3},
+	}, rowsPerType)
+}
+
 var streams = []string{"stream-a", "stream-b", "stream-c"}
 
+// ingestStreamProfiles ingests the profiles from to to (exclusive) spread
+// over the streams. The i-th profile is a CPU profile of the stream
+// streams[i%3] taken i seconds after the epoch, samples adds its samples.
+func ingestStreamProfiles(ctx context.Context, ingest func(context.Context, *profilev1.Profile, uuid.UUID, ...*typesv1.LabelPair) error, from, to int, samples func(i int, p *testhelper.ProfileBuilder)) error {
+	for i := from; i < to; i++ {
+		p := testhelper.NewProfileBuilder(time.Second.Nanoseconds()*int64(i)).
+			CPUProfile().
+			WithLabels("stream", streams[i%3])
+		samples(i, p)
+		if err := ingest(ctx, p.Profile, p.UUID, p.Labels...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func threeProfileStreams(i int) *testProfile {
 	tp := sameProfileStream(i)
 
@@ -216,6 +473,350 @@ func TestProfileStore_Ingestion_SeriesIndexes(t *testing.T) {
 		assert.Equal(t, fmt.Sprintf("00000000-0000-0000-0000-%012d", id), rows[i].ID.String())
 		assert.Equal(t, uint32(i/3), rows[i].SeriesIndex)
 	}
+
+	// the file metadata declares the order of the rows, so readers don't need to sort them
+	f, err := os.Open(path + "/profiles.parquet")
+	require.NoError(t, err)
+	defer f.Close()
+	stat, err := f.Stat()
+	require.NoError(t, err)
+	pf, err := parquet.OpenFile(f, stat.Size())
+	require.NoError(t, err)
+	var (
+		seriesIndex, _ = pf.Schema().Lookup("SeriesIndex")
+		timeNanos, _   = pf.Schema().Lookup("TimeNanos")
+	)
+	for _, rg := range pf.Metadata().RowGroups {
+		assert.Equal(t, []format.SortingColumn{
+			{ColumnIdx: int32(seriesIndex.ColumnIndex)},
+			{ColumnIdx: int32(timeNanos.ColumnIndex)},
+		}, rg.SortingColumns)
+	}
+	assert.True(t, sort.SliceIsSorted(rows, func(i, j int) bool {
+		if rows[i].SeriesIndex != rows[j].SeriesIndex {
+			return rows[i].SeriesIndex < rows[j].SeriesIndex
+		}
+		return rows[i].TimeNanos < rows[j].TimeNanos
+	}))
+}
+
+// TestProfileStore_SortOrder ensures that profiles.parquet is ordered
+// according to the configured sort order and that the series index is
+// assigned correctly, when the rows of a series are not contiguous.
+func TestProfileStore_SortOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		order                 SortOrder
+		expectedIDs           []int
+		expectedSortingColumn []string
+	}{
+		{
+			name:  "series then time",
+			order: SeriesThenTime,
+			// row groups are cut every 4 profiles
+			expectedIDs:           []int{0, 3, 1, 2, 6, 4, 7, 5, 8},
+			expectedSortingColumn: []string{"SeriesIndex", "TimeNanos"},
+		},
+		{
+			name:                  "time then series",
+			order:                 TimeThenSeries,
+			expectedIDs:           []int{0, 1, 2, 3, 4, 5, 6, 7, 8},
+			expectedSortingColumn: []string{"TimeNanos", "SeriesIndex"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				ctx   = testContext(t)
+				store = newProfileStore(ctx)
+				path  = t.TempDir()
+			)
+			require.NoError(t, store.Init(path, &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 4, SortOrder: tc.order}, newHeadMetrics(prometheus.NewRegistry())))
+
+			for i := 0; i < 9; i++ {
+				p := threeProfileStreams(i)
+				require.NoError(t, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, emptyRewriter()))
+			}
+
+			numRows, numRGs, err := store.Flush(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, uint64(9), numRows)
+			assert.Equal(t, uint64(3), numRGs)
+
+			rows, _ := readFullParquetFile[*schemav1.Profile](t, path+"/profiles.parquet")
+			require.Equal(t, len(tc.expectedIDs), len(rows))
+			for i, id := range tc.expectedIDs {
+				assert.Equal(t, fmt.Sprintf("00000000-0000-0000-0000-%012d", id), rows[i].ID.String())
+				// series are ordered by their labels: stream-a, stream-b, stream-c
+				assert.Equal(t, uint32(id%3), rows[i].SeriesIndex)
+			}
+
+			// ensure the sort order is recorded in the row group metadata
+			f, err := os.Open(path + "/profiles.parquet")
+			require.NoError(t, err)
+			defer f.Close()
+			stat, err := f.Stat()
+			require.NoError(t, err)
+			pf, err := parquet.OpenFile(f, stat.Size())
+			require.NoError(t, err)
+			for _, rg := range pf.RowGroups() {
+				assert.Equal(t, tc.expectedSortingColumn, lo.Map(rg.SortingColumns(), func(c parquet.SortingColumn, _ int) string {
+					return strings.Join(c.Path(), ".")
+				}))
+			}
+		})
+	}
+}
+
+// TestProfileStore_FlushWithProgress ensures that the progress of a flush is
+// reported after each row group and that a flush running out of time leaves
+// no files behind, but the row group segments to retry the flush.
+func TestProfileStore_FlushWithProgress(t *testing.T) {
+	for _, concurrency := range []int{0, 2} {
+		t.Run(fmt.Sprintf("concurrency=%d", concurrency), func(t *testing.T) {
+			ingest := func(t *testing.T) (*profileStore, string) {
+				var (
+					ctx   = testContext(t)
+					store = newProfileStore(ctx)
+					path  = t.TempDir()
+				)
+				require.NoError(t, store.Init(path, &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 3, FlushConcurrency: concurrency}, newHeadMetrics(prometheus.NewRegistry())))
+				for i := 0; i < 30; i++ {
+					p := threeProfileStreams(i)
+					require.NoError(t, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, emptyRewriter()))
+				}
+				return store, path
+			}
+
+			store, _ := ingest(t)
+			var progress []uint64
+			numRows, numRGs, err := store.FlushWithProgress(context.Background(), func(rowsWritten uint64) {
+				progress = append(progress, rowsWritten)
+			})
+			require.NoError(t, err)
+			require.Equal(t, uint64(30), numRows)
+			require.Equal(t, uint64(10), numRGs)
+			require.Len(t, progress, 10)
+			for i := 1; i < len(progress); i++ {
+				require.Greater(t, progress[i], progress[i-1])
+			}
+			require.Equal(t, numRows, progress[len(progress)-1])
+
+			// the deadline passes while the first row group is written
+			store, path := ingest(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, _, err = store.FlushWithProgress(ctx, func(uint64) {
+				<-ctx.Done()
+			})
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+			require.Contains(t, err.Error(), "flush interrupted after writing 3 of 30 rows")
+
+			files, err := os.ReadDir(path)
+			require.NoError(t, err)
+			require.Len(t, files, len(store.rowGroups))
+			for _, f := range files {
+				require.NotContains(t, []string{"index.tsdb", "profiles.parquet"}, f.Name())
+			}
+
+			// the flush is retried with all the profiles
+			numRows, _, err = store.FlushWithProgress(context.Background(), nil)
+			require.NoError(t, err)
+			require.Equal(t, uint64(30), numRows)
+		})
+	}
+}
+
+// TestProfileStore_CutRowGroupFailure ensures that the profiles stay buffered,
+// when their row group segment can't be written.
+func TestProfileStore_CutRowGroupFailure(t *testing.T) {
+	var (
+		ctx   = testContext(t)
+		store = newProfileStore(ctx)
+		path  = t.TempDir()
+	)
+	require.NoError(t, store.Init(path, &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 100}, newHeadMetrics(prometheus.NewRegistry())))
+	for i := 0; i < 9; i++ {
+		p := threeProfileStreams(i)
+		require.NoError(t, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, emptyRewriter()))
+	}
+
+	// the segment file exists already
+	segment := filepath.Join(path, "profiles.0.parquet")
+	require.NoError(t, os.WriteFile(segment, nil, 0o644))
+	store.lock.Lock()
+	require.Error(t, store.cutRowGroup())
+	store.lock.Unlock()
+	require.Len(t, store.slice, 9)
+	require.Len(t, store.bufferedIDs, 9)
+	require.Empty(t, store.rowGroups)
+	require.Len(t, store.currentView().inMemory, 9)
+
+	require.NoError(t, os.Remove(segment))
+	numRows, _, err := store.Flush(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), numRows)
+}
+
+// TestProfileStore_FlushConcurrency ensures that reading the row groups in
+// parallel writes the same profiles.parquet as reading them one by one.
+func TestProfileStore_FlushConcurrency(t *testing.T) {
+	flush := func(t *testing.T, order SortOrder, concurrency int) []byte {
+		var (
+			ctx   = testContext(t)
+			store = newProfileStore(ctx)
+			path  = t.TempDir()
+		)
+		require.NoError(t, store.Init(path, &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 3, SortOrder: order, FlushConcurrency: concurrency}, newHeadMetrics(prometheus.NewRegistry())))
+
+		for i := 0; i < 30; i++ {
+			p := threeProfileStreams(i)
+			require.NoError(t, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, emptyRewriter()))
+		}
+
+		numRows, numRGs, err := store.Flush(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, uint64(30), numRows)
+		assert.Equal(t, uint64(10), numRGs)
+
+		data, err := os.ReadFile(filepath.Join(path, "profiles.parquet"))
+		require.NoError(t, err)
+		return data
+	}
+
+	for _, order := range []SortOrder{SeriesThenTime, TimeThenSeries} {
+		serial := flush(t, order, 0)
+		for _, concurrency := range []int{2, 4, 16} {
+			require.Equal(t, serial, flush(t, order, concurrency), "concurrency %d", concurrency)
+		}
+	}
+}
+
+// TestProfileStore_FlushReadBatchPool ensures that the pooled batches of rows
+// reused across flushes don't leak rows or byte arrays of previous flushes.
+func TestProfileStore_FlushReadBatchPool(t *testing.T) {
+	flush := func(t *testing.T, first, samples, concurrency, batchSize int) []byte {
+		var (
+			ctx   = testContext(t)
+			store = newProfileStore(ctx)
+			path  = t.TempDir()
+		)
+		require.NoError(t, store.Init(path, &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 3, FlushConcurrency: concurrency, FlushReadBatchSize: batchSize}, newHeadMetrics(prometheus.NewRegistry())))
+
+		for i := first; i < first+30; i++ {
+			p := threeProfileStreams(i)
+			for s := 1; s < samples; s++ {
+				p.p.Samples = append(p.p.Samples, &schemav1.Sample{StacktraceID: uint64(s + 1), Value: int64(s)})
+			}
+			require.NoError(t, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, emptyRewriter()))
+		}
+
+		numRows, _, err := store.Flush(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, uint64(30), numRows)
+
+		data, err := os.ReadFile(filepath.Join(path, "profiles.parquet"))
+		require.NoError(t, err)
+		return data
+	}
+
+	// the flushes alternate between profiles of different IDs and number of
+	// samples, so stale values of a reused batch change the output
+	for _, batchSize := range []int{1, 2, 16} {
+		for cycle := 0; cycle < 3; cycle++ {
+			for _, samples := range []int{3, 1} {
+				first := cycle*100 + samples
+				require.Equal(t, flush(t, first, samples, 0, 0), flush(t, first, samples, 4, batchSize), "batch size %d, cycle %d", batchSize, cycle)
+			}
+		}
+	}
+}
+
+// TestProfileStore_SortOrder_Querying ensures that profiles are queried
+// correctly from the head and from the block in either sort order.
+func TestProfileStore_SortOrder_Querying(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		order SortOrder
+	}{
+		{name: "series then time", order: SeriesThenTime},
+		{name: "time then series", order: TimeThenSeries},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testContext(t)
+			db, err := New(ctx, Config{
+				DataPath:         t.TempDir(),
+				MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+			}, NoLimit)
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, db.Close())
+			}()
+
+			// force different row group segments for profiles
+			db.head.profiles.cfg = &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 4, SortOrder: tc.order}
+
+			require.NoError(t, ingestStreamProfiles(ctx, db.Head().Ingest, 0, 9, func(i int, p *testhelper.ProfileBuilder) {
+				p.ForStacktraceString("func1").AddSamples(int64(i + 1))
+			}))
+
+			params := &ingestv1.SelectProfilesRequest{
+				Start:         0,
+				End:           1000000000000,
+				LabelSelector: "{}",
+				Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			}
+			expected := []string{
+				"stream-a@0", "stream-b@1", "stream-c@2",
+				"stream-a@3", "stream-b@4", "stream-c@5",
+				"stream-a@6", "stream-b@7", "stream-c@8",
+			}
+			selectProfiles := func(t *testing.T, q interface {
+				SelectMatchingProfiles(context.Context, *ingestv1.SelectProfilesRequest) (iter.Iterator[Profile], error)
+			},
+			) []string {
+				pIt, err := q.SelectMatchingProfiles(ctx, params)
+				require.NoError(t, err)
+				var result []string
+				for pIt.Next() {
+					result = append(result, fmt.Sprintf("%s@%d", pIt.At().Labels().Get("stream"), pIt.At().Timestamp().Unix()))
+				}
+				require.NoError(t, pIt.Err())
+				return result
+			}
+
+			t.Run("head", func(t *testing.T) {
+				assert.Equal(t, expected, selectProfiles(t, db.head.Queriers()))
+			})
+
+			t.Run("block", func(t *testing.T) {
+				require.NoError(t, db.Flush(ctx))
+				require.NoError(t, db.blockQuerier.Sync(ctx))
+				require.Len(t, db.blockQuerier.queriers, 1)
+				q := db.blockQuerier.queriers[0]
+
+				assert.Equal(t, expected, selectProfiles(t, q))
+
+				pIt, err := q.SelectMatchingProfiles(ctx, params)
+				require.NoError(t, err)
+				series, err := q.MergeByLabels(ctx, pIt, "stream")
+				require.NoError(t, err)
+				require.Len(t, series, 3)
+				for i, s := range series {
+					assert.Equal(t, streams[i], s.Labels[0].Value)
+					var (
+						timestamps []int64
+						values     []float64
+					)
+					for _, p := range s.Points {
+						timestamps = append(timestamps, p.Timestamp)
+						values = append(values, p.Value)
+					}
+					assert.Equal(t, []int64{int64(i) * 1000, int64(i+3) * 1000, int64(i+6) * 1000}, timestamps)
+					assert.Equal(t, []float64{float64(i + 1), float64(i + 4), float64(i + 7)}, values)
+				}
+			})
+		})
+	}
 }
 
 func BenchmarkFlush(b *testing.B) {
@@ -231,24 +832,78 @@ func BenchmarkFlush(b *testing.B) {
 			StacktraceID: uint64(i),
 		}
 	}
-	for i := 0; i < b.N; i++ {
+	for _, concurrency := range []int{0, 4} {
+		cfg := *defaultParquetConfig
+		cfg.FlushConcurrency = concurrency
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			b.StopTimer()
+			for i := 0; i < b.N; i++ {
+
+				path := b.TempDir()
+				store := newProfileStore(ctx)
+				require.NoError(b, store.Init(path, &cfg, metrics))
+				for rg := 0; rg < 10; rg++ {
+					for i := 0; i < 100; i++ {
+						// timestamps keep increasing across row groups
+						p := threeProfileStreams(rg*100 + i)
+						p.p.Samples = samples
+						require.NoError(b, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, rw))
+					}
+					require.NoError(b, store.cutRowGroup())
+				}
+				b.StartTimer()
+				_, _, err := store.Flush(context.Background())
+				require.NoError(b, err)
+				b.StopTimer()
+			}
+		})
+	}
+}
 
-		path := b.TempDir()
-		store := newProfileStore(ctx)
-		require.NoError(b, store.Init(path, defaultParquetConfig, metrics))
-		for rg := 0; rg < 10; rg++ {
-			for i := 0; i < 10^6; i++ {
-				p := threeProfileStreams(i)
-				p.p.Samples = samples
-				require.NoError(b, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, rw))
+// BenchmarkReadRowGroupBatches compares reading the row groups with the batches
+// of rows pooled across flushes to a pool per flush.
+func BenchmarkReadRowGroupBatches(b *testing.B) {
+	ctx := testContext(b)
+	store := newProfileStore(ctx)
+	require.NoError(b, store.Init(b.TempDir(), defaultParquetConfig, newHeadMetrics(prometheus.NewRegistry())))
+	for rg := 0; rg < 10; rg++ {
+		for i := 0; i < 100; i++ {
+			p := threeProfileStreams(rg*100 + i)
+			require.NoError(b, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, emptyRewriter()))
+		}
+		require.NoError(b, store.cutRowGroup())
+	}
+	defer func() {
+		for _, rg := range store.rowGroups {
+			require.NoError(b, rg.Close())
+		}
+	}()
+
+	read := func(pool *sync.Pool) {
+		done := make(chan struct{})
+		defer close(done)
+		for _, rg := range store.RowGroups() {
+			batches := make(chan *rowsBatch, flushReadAhead)
+			go readRowGroupBatches(rg, pool, flushReadBatchSize, batches, done)
+			for batch := range batches {
+				require.NoError(b, batch.err)
+				pool.Put(batch)
 			}
-			require.NoError(b, store.cutRowGroup())
 		}
-		b.StartTimer()
-		_, _, err := store.Flush(context.Background())
-		require.NoError(b, err)
-		b.StopTimer()
 	}
+
+	b.Run("pool=flush", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			read(&sync.Pool{New: func() any { return &rowsBatch{} }})
+		}
+	})
+	b.Run("pool=shared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			read(rowsBatchPool)
+		}
+	})
 }
 
 func ingestThreeProfileStreams(ctx context.Context, i int, ingest func(context.Context, *profilev1.Profile, uuid.UUID, ...*typesv1.LabelPair) error) error {
@@ -371,6 +1026,98 @@ func TestProfileStore_Querying(t *testing.T) {
 		)
 	})
 
+	t.Run("merge by labels with value filter", func(t *testing.T) {
+		client, cleanup := queriers.ingesterClient()
+		defer cleanup()
+
+		bidi := client.MergeProfilesLabels(ctx)
+
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesLabelsRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: params.LabelSelector,
+				Type:          params.Type,
+				Start:         params.Start,
+				End:           params.End,
+			},
+			By:      []string{"stream"},
+			Include: []string{"stream-a", "stream-c"},
+		}))
+
+		for {
+			resp, err := bidi.Receive()
+			require.NoError(t, err)
+
+			// when empty, finished reading profiles
+			if resp.SelectedProfiles == nil {
+				break
+			}
+
+			require.NoError(t, bidi.Send(&ingestv1.MergeProfilesLabelsRequest{
+				Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(int) bool { return true }),
+			}))
+		}
+
+		result, err := bidi.Receive()
+		require.NoError(t, err)
+
+		require.Len(t, result.Series, 2)
+		for i, expected := range []struct {
+			stream     string
+			timestamps []int64
+		}{
+			{stream: `{stream="stream-a"}`, timestamps: []int64{0, 3000, 6000}},
+			{stream: `{stream="stream-c"}`, timestamps: []int64{2000, 5000, 8000}},
+		} {
+			s := result.Series[i]
+			assert.Equal(t, expected.stream, phlaremodel.LabelPairsString(s.Labels))
+			assert.Equal(t, expected.timestamps, lo.Map(s.Points, func(p *typesv1.Point, _ int) int64 { return p.Timestamp }))
+			assert.Equal(t, []float64{30, 30, 30}, lo.Map(s.Points, func(p *typesv1.Point, _ int) float64 { return p.Value }))
+		}
+	})
+
+	t.Run("merge by derived label", func(t *testing.T) {
+		client, cleanup := queriers.ingesterClient()
+		defer cleanup()
+
+		bidi := client.MergeProfilesLabels(ctx)
+
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesLabelsRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: params.LabelSelector,
+				Type:          params.Type,
+				Start:         params.Start,
+				End:           params.End,
+			},
+			By: []string{"group"},
+			Relabel: []*ingestv1.RelabelConfig{
+				{SourceLabels: []string{"stream"}, Regex: "stream-.*", TargetLabel: "group", Replacement: "all-streams"},
+			},
+		}))
+
+		for {
+			resp, err := bidi.Receive()
+			require.NoError(t, err)
+
+			// when empty, finished reading profiles
+			if resp.SelectedProfiles == nil {
+				break
+			}
+
+			require.NoError(t, bidi.Send(&ingestv1.MergeProfilesLabelsRequest{
+				Profiles: lo.Times(len(resp.SelectedProfiles.Profiles), func(int) bool { return true }),
+			}))
+		}
+
+		result, err := bidi.Receive()
+		require.NoError(t, err)
+
+		// all streams collapse into a single series
+		require.Len(t, result.Series, 1)
+		assert.Equal(t, `{group="all-streams"}`, phlaremodel.LabelPairsString(result.Series[0].Labels))
+		assert.Len(t, result.Series[0].Points, 9)
+		assert.Equal(t, 270.0, lo.SumBy(result.Series[0].Points, func(p *typesv1.Point) float64 { return p.Value }))
+	})
+
 	t.Run("merge by stacktraces", func(t *testing.T) {
 		client, cleanup := queriers.ingesterClient()
 		defer cleanup()
@@ -501,3 +1248,70 @@ func TestProfileStore_Querying(t *testing.T) {
 		)
 	})
 }
+
+func TestProfileStore_OutOfOrder(t *testing.T) {
+	var (
+		ctx  = testContext(t)
+		base = time.Hour.Nanoseconds()
+		cfg  = Config{
+			DataPath:         t.TempDir(),
+			OutOfOrderWindow: 5 * time.Minute,
+		}
+		head, err = NewHead(ctx, cfg, NoLimit)
+	)
+	require.NoError(t, err)
+
+	// ingest profiles in shuffled order, all within the out of order window
+	order := rand.New(rand.NewSource(1)).Perm(30)
+	for _, i := range order {
+		p := testhelper.NewProfileBuilder(base+10*time.Second.Nanoseconds()*int64(i)).
+			CPUProfile().
+			WithLabels("stream", streams[i%3])
+		p.ForStacktraceString("my", "other").AddSamples(int64(i))
+		require.NoError(t, head.Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+
+	// profiles older than the window are rejected
+	p := testhelper.NewProfileBuilder(base-time.Minute.Nanoseconds()).
+		CPUProfile().
+		WithLabels("stream", streams[0])
+	p.ForStacktraceString("my", "other").AddSamples(1)
+	err = head.Ingest(ctx, p.Profile, p.UUID, p.Labels...)
+	require.Error(t, err)
+	require.Equal(t, validation.OutOfOrder, validation.ReasonOf(err))
+	require.Equal(t, float64(1), testutil.ToFloat64(head.metrics.profilesOutOfOrder))
+
+	// the in memory profiles are ordered by time
+	for _, ps := range head.profiles.index.profilesPerFP {
+		require.True(t, sort.SliceIsSorted(ps.profiles, func(i, j int) bool {
+			return ps.profiles[i].TimeNanos < ps.profiles[j].TimeNanos
+		}))
+	}
+	// and so are the ones of the view grouped by series
+	perFP := head.profiles.currentView().inMemorySeries()
+	require.Len(t, perFP, 3)
+	for fp, profiles := range perFP {
+		require.Len(t, profiles, 10)
+		for i, p := range profiles {
+			require.Equal(t, fp, p.SeriesFingerprint)
+			if i > 0 {
+				require.Less(t, profiles[i-1].TimeNanos, p.TimeNanos)
+			}
+		}
+	}
+
+	_, err = head.Flush(ctx)
+
+	require.NoError(t, err)
+
+	// the flushed profiles are ordered by series and then by time
+	profiles, _ := readFullParquetFile[*schemav1.Profile](t, filepath.Join(head.localPath, "profiles.parquet"))
+	require.Len(t, profiles, 30)
+	for i := 1; i < len(profiles); i++ {
+		prev, curr := profiles[i-1], profiles[i]
+		require.LessOrEqual(t, prev.SeriesIndex, curr.SeriesIndex)
+		if prev.SeriesIndex == curr.SeriesIndex {
+			require.Less(t, prev.TimeNanos, curr.TimeNanos)
+		}
+	}
+}
@@ -2,20 +2,19 @@ package phlaredb
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"math"
 	"sort"
 	"sync"
+	"time"
 	"unsafe"
 
-	"github.com/gogo/status"
 	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
-	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/samber/lo"
 	"go.uber.org/atomic"
-	"google.golang.org/grpc/codes"
 
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	"github.com/grafana/phlare/pkg/iter"
@@ -24,6 +23,7 @@ import (
 	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
 	"github.com/grafana/phlare/pkg/phlaredb/tsdb"
 	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 // delta encoding for ranges
@@ -37,19 +37,15 @@ type rowRangeWithSeriesIndex struct {
 	seriesIndex uint32
 }
 
-// those need to be strictly ordered
+// those need to be strictly ordered by rowNum
 type rowRangesWithSeriesIndex []rowRangeWithSeriesIndex
 
 func (s rowRangesWithSeriesIndex) getSeriesIndex(rowNum int64) uint32 {
-	// todo: binary search
-	for _, rg := range s {
-		// it is possible that the series is not existing
-		if rg.rowRange == nil {
-			continue
-		}
-		if rg.rowNum <= rowNum && rg.rowNum+int64(rg.length) > rowNum {
-			return rg.seriesIndex
-		}
+	idx := sort.Search(len(s), func(i int) bool {
+		return s[i].rowNum+int64(s[i].length) > rowNum
+	})
+	if idx < len(s) && s[idx].rowNum <= rowNum {
+		return s[idx].seriesIndex
 	}
 	panic("series index not found")
 }
@@ -127,13 +123,16 @@ type profileSeries struct {
 	fp  model.Fingerprint
 
 	minTime, maxTime int64
+	// maxTimeOnDisk is the highest timestamp of the profiles stored in row groups on disk.
+	maxTimeOnDisk int64
 
-	// profiles in memory
+	// profiles in memory, ordered by timestamp
 	profiles []*schemav1.Profile
 
-	// profiles temporary stored on disk in row group segements
+	// profiles temporary stored on disk in row group segements, depending on
+	// the sort order a series can span multiple ranges within a row group.
 	// TODO: this information is crucial to recover segements to a full block later
-	profilesOnDisk []*rowRange
+	profilesOnDisk [][]*rowRange
 }
 
 type profilesIndex struct {
@@ -163,8 +162,9 @@ func newProfileIndex(totalShards uint32, metrics *headMetrics) (*profilesIndex,
 }
 
 // Add a new set of profile to the index.
-// The seriesRef are expected to match the profile labels passed in.
-func (pi *profilesIndex) Add(ps *schemav1.Profile, lbs phlaremodel.Labels, profileName string) {
+// The seriesRef are expected to match the profile labels passed in. It returns
+// true, if the profile is the first one of its series.
+func (pi *profilesIndex) Add(ps *schemav1.Profile, lbs phlaremodel.Labels, profileName string) (newSeries bool) {
 	pi.mutex.Lock()
 	defer pi.mutex.Unlock()
 	profiles, ok := pi.profilesPerFP[ps.SeriesFingerprint]
@@ -175,33 +175,194 @@ func (pi *profilesIndex) Add(ps *schemav1.Profile, lbs phlaremodel.Labels, profi
 			fp:             ps.SeriesFingerprint,
 			minTime:        ps.TimeNanos,
 			maxTime:        ps.TimeNanos,
-			profilesOnDisk: make([]*rowRange, pi.rowGroupsOnDisk),
+			maxTimeOnDisk:  math.MinInt64,
+			profilesOnDisk: make([][]*rowRange, pi.rowGroupsOnDisk),
 		}
 		pi.profilesPerFP[ps.SeriesFingerprint] = profiles
 		pi.metrics.series.Set(float64(pi.totalSeries.Inc()))
 		pi.metrics.seriesCreated.WithLabelValues(profileName).Inc()
+		newSeries = true
 	}
 
-	profiles.profiles = append(profiles.profiles, ps)
-	if ps.TimeNanos < profiles.minTime {
-		profiles.minTime = ps.TimeNanos
-	}
-	if ps.TimeNanos > profiles.maxTime {
-		profiles.maxTime = ps.TimeNanos
-	}
+	profiles.insert(ps)
 
 	pi.metrics.profiles.Set(float64(pi.totalProfiles.Inc()))
 	pi.metrics.profilesCreated.WithLabelValues(profileName).Inc()
+	return newSeries
+}
+
+// insert adds the profile ordered by time, out of order profiles are expected to be rare and recent.
+func (s *profileSeries) insert(ps *schemav1.Profile) {
+	i := len(s.profiles)
+	for i > 0 && s.profiles[i-1].TimeNanos > ps.TimeNanos {
+		i--
+	}
+	s.profiles = append(s.profiles, nil)
+	copy(s.profiles[i+1:], s.profiles[i:])
+	s.profiles[i] = ps
+	if ps.TimeNanos < s.minTime {
+		s.minTime = ps.TimeNanos
+	}
+	if ps.TimeNanos > s.maxTime {
+		s.maxTime = ps.TimeNanos
+	}
+}
+
+// replace swaps the in-memory profile old of the index by ps of the same
+// series. Queries holding old keep reading it unchanged.
+func (pi *profilesIndex) replace(old, ps *schemav1.Profile) {
+	pi.mutex.Lock()
+	defer pi.mutex.Unlock()
+	profiles, ok := pi.profilesPerFP[old.SeriesFingerprint]
+	if !ok {
+		return
+	}
+	for i, p := range profiles.profiles {
+		if p == old {
+			profiles.profiles = append(profiles.profiles[:i], profiles.profiles[i+1:]...)
+			break
+		}
+	}
+	profiles.insert(ps)
+}
+
+// truncate removes the in-memory profiles dropped from the index. Series
+// without profiles left, neither in memory nor on disk, are removed. It
+// returns the fingerprints of the removed series.
+func (pi *profilesIndex) truncate(dropped []*schemav1.Profile) []model.Fingerprint {
+	droppedPerFP := make(map[model.Fingerprint]map[*schemav1.Profile]struct{})
+	for _, p := range dropped {
+		ps, ok := droppedPerFP[p.SeriesFingerprint]
+		if !ok {
+			ps = make(map[*schemav1.Profile]struct{})
+			droppedPerFP[p.SeriesFingerprint] = ps
+		}
+		ps[p] = struct{}{}
+	}
+
+	pi.mutex.Lock()
+	defer pi.mutex.Unlock()
+
+	var removed []model.Fingerprint
+	for fp, ps := range droppedPerFP {
+		series, ok := pi.profilesPerFP[fp]
+		if !ok {
+			continue
+		}
+		// queries copy the profiles of a series, so they are filtered into a new slice
+		profiles := make([]*schemav1.Profile, 0, len(series.profiles))
+		for _, p := range series.profiles {
+			if _, ok := ps[p]; !ok {
+				profiles = append(profiles, p)
+			}
+		}
+		pi.totalProfiles.Sub(int64(len(series.profiles) - len(profiles)))
+		series.profiles = profiles
+
+		if series.hasProfilesOnDisk() {
+			continue
+		}
+		if len(profiles) == 0 {
+			pi.ix.Delete(series.lbs, fp)
+			delete(pi.profilesPerFP, fp)
+			pi.totalSeries.Dec()
+			removed = append(removed, fp)
+			continue
+		}
+		series.minTime = profiles[0].TimeNanos
+	}
+	pi.metrics.profiles.Set(float64(pi.totalProfiles.Load()))
+	pi.metrics.series.Set(float64(pi.totalSeries.Load()))
+	return removed
+}
+
+// hasProfilesOnDisk returns true, if profiles of the series have been cut into row groups.
+func (s *profileSeries) hasProfilesOnDisk() bool {
+	for _, ranges := range s.profilesOnDisk {
+		if len(ranges) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// allowProfile returns an out of order error, if a profile of the series fp
+// with the given timestamp can't be added anymore. Profiles are accepted if
+// they are not older than the window before the latest profile of the series
+// and if they are not older than the profiles already cut into row groups.
+//
+// Profiles of a series, whose fingerprint collides with the one of another
+// series, are rejected rather than merged into the other series.
+func (pi *profilesIndex) allowProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNano int64, window time.Duration) error {
+	err := pi.checkProfile(fp, lbs, tsNano, window)
+	if errors.Is(err, ErrOutOfOrder) {
+		pi.metrics.profilesOutOfOrder.Inc()
+	}
+	return err
+}
+
+// checkProfile returns the error allowProfile would return, without counting
+// the profile as out of order.
+func (pi *profilesIndex) checkProfile(fp model.Fingerprint, lbs phlaremodel.Labels, tsNano int64, window time.Duration) error {
+	pi.mutex.RLock()
+	defer pi.mutex.RUnlock()
+
+	profiles, ok := pi.profilesPerFP[fp]
+	if !ok {
+		return nil
+	}
+	if phlaremodel.CompareLabelPairs(lbs, profiles.lbs) != 0 {
+		return withSentinel(ErrInvalidProfile, validation.NewErrorf(validation.FingerprintCollision, "series %s has the same fingerprint %016x as series %s", phlaremodel.LabelPairsString(lbs), uint64(fp), phlaremodel.LabelPairsString(profiles.lbs)))
+	}
+
+	var err error
+	if tsNano < profiles.maxTime-int64(window) {
+		err = validation.NewErrorf(validation.OutOfOrder, "profile for series %s out of order (received %s last %s, out of order window %s)", phlaremodel.LabelPairsString(lbs), time.Unix(0, tsNano), time.Unix(0, profiles.maxTime), window)
+	} else if tsNano < profiles.maxTimeOnDisk {
+		err = validation.NewErrorf(validation.OutOfOrder, "profile for series %s out of order (received %s, profiles until %s have already been cut into a row group)", phlaremodel.LabelPairsString(lbs), time.Unix(0, tsNano), time.Unix(0, profiles.maxTimeOnDisk))
+	}
+	if err != nil {
+		return withSentinel(ErrOutOfOrder, err)
+	}
+	return nil
+}
+
+// seriesInfo describes a series of the index at a point in time.
+type seriesInfo struct {
+	fp           model.Fingerprint
+	lbs          phlaremodel.Labels
+	profileCount int
+}
+
+// snapshotSeries returns all series of the index ordered by fingerprint. The
+// profile count includes the profiles already cut into row groups.
+func (pi *profilesIndex) snapshotSeries() []seriesInfo {
+	pi.mutex.RLock()
+	result := make([]seriesInfo, 0, len(pi.profilesPerFP))
+	for fp, ps := range pi.profilesPerFP {
+		count := len(ps.profiles)
+		for _, rowRanges := range ps.profilesOnDisk {
+			for _, rR := range rowRanges {
+				count += rR.length
+			}
+		}
+		result = append(result, seriesInfo{fp: fp, lbs: ps.lbs, profileCount: count})
+	}
+	pi.mutex.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].fp < result[j].fp
+	})
+	return result
 }
 
 func (pi *profilesIndex) selectMatchingFPs(ctx context.Context, params *ingestv1.SelectProfilesRequest) ([]model.Fingerprint, error) {
 	sp, _ := opentracing.StartSpanFromContext(ctx, "selectMatchingFPs - Index")
 	defer sp.Finish()
-	selectors, err := parser.ParseMetricSelector(params.LabelSelector)
+	selectors, err := selectorMatchers(params)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, "failed to parse label selectors: "+err.Error())
+		return nil, err
 	}
-	selectors = append(selectors, phlaremodel.SelectorFromProfileType(params.Type))
 
 	filters, matchers := SplitFiltersAndMatchers(selectors)
 	ids, err := pi.ix.Lookup(matchers, nil)
@@ -238,6 +399,29 @@ outer:
 	return ids[:idx], nil
 }
 
+// countOnDisk returns the number of profiles of each matching series in the
+// row group on disk, regardless of their timestamp.
+func (pi *profilesIndex) countOnDisk(ctx context.Context, params *ingestv1.SelectProfilesRequest, rowGroupIdx int) (map[model.Fingerprint]uint64, error) {
+	ids, err := pi.selectMatchingFPs(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[model.Fingerprint]uint64, len(ids))
+
+	pi.mutex.RLock()
+	defer pi.mutex.RUnlock()
+	for _, fp := range ids {
+		profileSeries, ok := pi.profilesPerFP[fp]
+		if !ok {
+			continue
+		}
+		for _, rR := range profileSeries.profilesOnDisk[rowGroupIdx] {
+			counts[fp] += uint64(rR.length)
+		}
+	}
+	return counts, nil
+}
+
 func (pi *profilesIndex) selectMatchingRowRanges(ctx context.Context, params *ingestv1.SelectProfilesRequest, rowGroupIdx int) (
 	query.Iterator,
 	map[model.Fingerprint]phlaremodel.Labels,
@@ -269,13 +453,9 @@ func (pi *profilesIndex) selectMatchingRowRanges(ctx context.Context, params *in
 
 		labelsPerFP[fp] = profileSeries.lbs
 
-		// skip if rowRange empty
-		rR := profileSeries.profilesOnDisk[rowGroupIdx]
-		if rR == nil {
-			continue
+		for _, rR := range profileSeries.profilesOnDisk[rowGroupIdx] {
+			rowRanges[*rR] = fp
 		}
-
-		rowRanges[*rR] = fp
 	}
 
 	sp.SetTag("rowGroupSegment", rowGroupIdx)
@@ -370,6 +550,57 @@ outer:
 	return nil
 }
 
+// matchingSeries returns the label sets of the series matching, whose profiles time range overlaps start and end.
+func (pi *profilesIndex) matchingSeries(matchers []*labels.Matcher, start, end model.Time) ([]phlaremodel.Labels, error) {
+	filters, matchers := SplitFiltersAndMatchers(matchers)
+	ids, err := pi.ix.Lookup(matchers, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	pi.mutex.RLock()
+	defer pi.mutex.RUnlock()
+
+	result := make([]phlaremodel.Labels, 0, len(ids))
+outer:
+	for _, fp := range ids {
+		profile, ok := pi.profilesPerFP[fp]
+		if !ok {
+			continue
+		}
+		if profile.minTime > end.UnixNano() || profile.maxTime < start.UnixNano() {
+			continue
+		}
+		for _, filter := range filters {
+			if !filter.Matches(profile.lbs.Get(filter.Name)) {
+				continue outer
+			}
+		}
+		result = append(result, profile.lbs)
+	}
+	return result, nil
+}
+
+// seriesMaxTimes returns all series of the index with the timestamp of their latest profile.
+func (pi *profilesIndex) seriesMaxTimes() []SeriesMaxTime {
+	pi.mutex.RLock()
+	defer pi.mutex.RUnlock()
+
+	result := make([]SeriesMaxTime, 0, len(pi.profilesPerFP))
+	for fp, ps := range pi.profilesPerFP {
+		result = append(result, SeriesMaxTime{Labels: ps.lbs, Fingerprint: fp, MaxTimeNanos: ps.maxTime})
+	}
+	return result
+}
+
+// sortProfileSeries orders series by labels, which is the order of the
+// series in the TSDB index.
+func sortProfileSeries(pfs []*profileSeries) {
+	sort.Slice(pfs, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(pfs[i].lbs, pfs[j].lbs) < 0
+	})
+}
+
 // WriteTo writes the profiles tsdb index to the specified filepath.
 func (pi *profilesIndex) writeTo(ctx context.Context, path string) ([][]rowRangeWithSeriesIndex, error) {
 	writer, err := index.NewWriter(ctx, path)
@@ -385,10 +616,7 @@ func (pi *profilesIndex) writeTo(ctx context.Context, path string) ([][]rowRange
 		pfs = append(pfs, p)
 	}
 
-	// sort by fp
-	sort.Slice(pfs, func(i, j int) bool {
-		return phlaremodel.CompareLabelPairs(pfs[i].lbs, pfs[j].lbs) < 0
-	})
+	sortProfileSeries(pfs)
 
 	symbolsMap := make(map[string]struct{})
 	for _, s := range pfs {
@@ -426,31 +654,39 @@ func (pi *profilesIndex) writeTo(ctx context.Context, path string) ([][]rowRange
 			return nil, err
 		}
 		// store series index
-		for idx, rg := range s.profilesOnDisk {
-			rangesPerRG[idx] = append(rangesPerRG[idx], rowRangeWithSeriesIndex{rowRange: rg, seriesIndex: uint32(i)})
+		for idx, rgs := range s.profilesOnDisk {
+			for _, rg := range rgs {
+				rangesPerRG[idx] = append(rangesPerRG[idx], rowRangeWithSeriesIndex{rowRange: rg, seriesIndex: uint32(i)})
+			}
 		}
 	}
 
+	// order ranges by row number, so the series index can be looked up
+	for _, ranges := range rangesPerRG {
+		sort.Slice(ranges, func(i, j int) bool {
+			return ranges[i].rowNum < ranges[j].rowNum
+		})
+	}
+
 	return rangesPerRG, writer.Close()
 }
 
 func (pl *profilesIndex) cutRowGroup(rgProfiles []*schemav1.Profile) error {
-	// adding rowGroup and rowNum information per fingerprint
-	rowRangePerFP := make(map[model.Fingerprint]*rowRange, len(pl.profilesPerFP))
+	// adding rowGroup and rowNum information per fingerprint, a new range is
+	// started whenever the rows of a series are not contiguous.
+	rowRangesPerFP := make(map[model.Fingerprint][]*rowRange, len(pl.profilesPerFP))
 	for rowNum, p := range rgProfiles {
-		if _, ok := rowRangePerFP[p.SeriesFingerprint]; !ok {
-			rowRangePerFP[p.SeriesFingerprint] = &rowRange{
-				rowNum: int64(rowNum),
+		ranges := rowRangesPerFP[p.SeriesFingerprint]
+		if len(ranges) > 0 {
+			if last := ranges[len(ranges)-1]; int(last.rowNum)+last.length == rowNum {
+				last.length++
+				continue
 			}
 		}
-
-		rowRange := rowRangePerFP[p.SeriesFingerprint]
-		rowRange.length++
-
-		// sanity check
-		if (int(rowRange.rowNum) + rowRange.length - 1) != rowNum {
-			return fmt.Errorf("rowRange is not matching up, ensure that the ordering of the profile row group is ordered correctly, current row_num=%d, expect range %d-%d", rowNum, rowRange.rowNum, int(rowRange.rowNum)+rowRange.length)
-		}
+		rowRangesPerFP[p.SeriesFingerprint] = append(ranges, &rowRange{
+			rowNum: int64(rowNum),
+			length: 1,
+		})
 	}
 
 	pl.mutex.Lock()
@@ -459,15 +695,17 @@ func (pl *profilesIndex) cutRowGroup(rgProfiles []*schemav1.Profile) error {
 	pl.rowGroupsOnDisk += 1
 
 	for _, ps := range pl.profilesPerFP {
-		// empty all in memory profiles
-		ps.profiles = ps.profiles[:0]
+		// empty the in memory profiles of the series cut, the profiles of
+		// other profile types might be buffered apart
+		if _, ok := rowRangesPerFP[ps.fp]; ok && len(ps.profiles) > 0 {
+			ps.maxTimeOnDisk = ps.profiles[len(ps.profiles)-1].TimeNanos
+			ps.profiles = ps.profiles[:0]
+		}
 
 		// attach rowGroup and rowNum information
-		rowRange := rowRangePerFP[ps.fp]
-
 		ps.profilesOnDisk = append(
 			ps.profilesOnDisk,
-			rowRange,
+			rowRangesPerFP[ps.fp],
 		)
 	}
 
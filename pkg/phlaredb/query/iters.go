@@ -320,6 +320,15 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 	}
 
 	for _, rg := range c.rgs {
+		// abort at row group boundaries, when the query is cancelled
+		if err := ctx.Err(); err != nil {
+			select {
+			case c.ch <- &columnIteratorBuffer{err: err}:
+			case <-c.quit:
+			}
+			return
+		}
+
 		col := rg.ColumnChunks()[c.col]
 
 		if checkSkip(rg.NumRows()) {
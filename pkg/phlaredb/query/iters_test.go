@@ -133,6 +133,44 @@ func TestColumnIterator(t *testing.T) {
 	}
 }
 
+// cancelRowGroup cancels the context once its column chunks are read.
+type cancelRowGroup struct {
+	parquet.RowGroup
+	cancel context.CancelFunc
+}
+
+func (c *cancelRowGroup) ColumnChunks() []parquet.ColumnChunk {
+	c.cancel()
+	return c.RowGroup.ColumnChunks()
+}
+
+func TestColumnIteratorContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var rowGroups []parquet.RowGroup
+	for i := 0; i < 10; i++ {
+		rowGroups = append(rowGroups, newTestBuffer([]testData{{int64(2 * i), "even"}, {int64(2*i + 1), "odd"}}))
+	}
+	// cancel while scanning the second row group
+	rowGroups[1] = &cancelRowGroup{RowGroup: rowGroups[1], cancel: cancel}
+
+	var (
+		buffer [][]parquet.Value
+		ids    []int64
+		i      = NewColumnIterator(ctx, rowGroups, 0, "id", 10, nil, "id")
+	)
+	defer i.Close()
+	for i.Next() {
+		buffer = i.At().Columns(buffer, "id")
+		ids = append(ids, buffer[0][0].Int64())
+	}
+
+	require.ErrorIs(t, i.Err(), context.Canceled)
+	// the scan stops at the next row group boundary
+	require.Equal(t, []int64{0, 1, 2, 3}, ids)
+}
+
 func TestRowNumber(t *testing.T) {
 	tr := EmptyRowNumber()
 	require.Equal(t, RowNumber{-1, -1, -1, -1, -1, -1}, tr)
@@ -40,3 +40,9 @@ func getMetricsFromContext(ctx context.Context) *Metrics {
 	}
 	return m
 }
+
+// PageRead counts a page of a column read without a column iterator in the
+// metrics of the context.
+func PageRead(ctx context.Context, table, column string) {
+	getMetricsFromContext(ctx).pageReadsTotal.WithLabelValues(table, column).Inc()
+}
@@ -52,6 +52,51 @@ func TestSubstringPredicate(t *testing.T) {
 	})
 }
 
+type UUID struct {
+	ID uuid.UUID `parquet:",uuid"`
+}
+
+func TestByteArrayRangePredicate(t *testing.T) {
+	ids := []UUID{
+		{uuid.MustParse("00000000-0000-0000-0000-000000000001")},
+		{uuid.MustParse("00000000-0000-0000-0000-000000000002")},
+		{uuid.MustParse("00000000-0000-0000-0000-000000000003")},
+	}
+	writeData := func(w *parquet.GenericWriter[UUID]) {
+		_, err := w.Write(ids)
+		require.NoError(t, err)
+	}
+
+	// the upper bound is excluded
+	lo, hi := uuid.MustParse("00000000-0000-0000-0000-000000000002"), uuid.MustParse("00000000-0000-0000-0000-000000000003")
+	testPredicate(t, predicateTestCase[UUID]{
+		predicate:  NewByteArrayRangePredicate(lo[:], hi[:]),
+		keptChunks: 1,
+		keptPages:  1,
+		keptValues: 1,
+		writeData:  writeData,
+	})
+
+	// the column index allows for skipping the chunk
+	lo, hi = uuid.MustParse("00000000-0000-0000-0000-000000000004"), uuid.MustParse("00000000-0000-0000-0000-000000000009")
+	testPredicate(t, predicateTestCase[UUID]{
+		predicate:  NewByteArrayRangePredicate(lo[:], hi[:]),
+		keptChunks: 0,
+		keptPages:  0,
+		keptValues: 0,
+		writeData:  writeData,
+	})
+
+	// a nil upper bound keeps all the values from the lower bound
+	testPredicate(t, predicateTestCase[UUID]{
+		predicate:  NewByteArrayRangePredicate(ids[1].ID[:], nil),
+		keptChunks: 1,
+		keptPages:  1,
+		keptValues: 2,
+		writeData:  writeData,
+	})
+}
+
 type predicateTestCase[P any] struct {
 	writeData  func(w *parquet.GenericWriter[P])
 	keptChunks int
@@ -177,6 +177,47 @@ func (p *IntBetweenPredicate) KeepPage(page pq.Page) bool {
 	return true
 }
 
+// ByteArrayRangePredicate checks for byte arrays between the bounds [min,max)
+// in lexicographical order, e.g. of UUIDs. A nil max leaves the range unbounded.
+type ByteArrayRangePredicate struct {
+	min, max []byte
+}
+
+var _ Predicate = (*ByteArrayRangePredicate)(nil)
+
+func NewByteArrayRangePredicate(min, max []byte) *ByteArrayRangePredicate {
+	return &ByteArrayRangePredicate{min, max}
+}
+
+func (p *ByteArrayRangePredicate) overlaps(min, max []byte) bool {
+	return bytes.Compare(max, p.min) >= 0 && (p.max == nil || bytes.Compare(min, p.max) < 0)
+}
+
+func (p *ByteArrayRangePredicate) KeepColumnChunk(c pq.ColumnChunk) bool {
+	if ci := c.ColumnIndex(); ci != nil {
+		for i := 0; i < ci.NumPages(); i++ {
+			if p.overlaps(ci.MinValue(i).ByteArray(), ci.MaxValue(i).ByteArray()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func (p *ByteArrayRangePredicate) KeepValue(v pq.Value) bool {
+	vv := v.ByteArray()
+	return bytes.Compare(p.min, vv) <= 0 && (p.max == nil || bytes.Compare(vv, p.max) < 0)
+}
+
+func (p *ByteArrayRangePredicate) KeepPage(page pq.Page) bool {
+	if min, max, ok := page.Bounds(); ok {
+		return p.overlaps(min.ByteArray(), max.ByteArray())
+	}
+	return true
+}
+
 type EqualInt64Predicate int64
 
 func NewEqualInt64Predicate(value int64) EqualInt64Predicate {
@@ -0,0 +1,72 @@
+package phlaredb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrTooManyConcurrentQueries is returned when a query is rejected, because the maximum of concurrent queries are
+// running already.
+var ErrTooManyConcurrentQueries = withSentinel(ErrLimitExceeded, errors.New("query rejected, too many concurrent queries"))
+
+// queryLimiter limits the queries running concurrently. Queries wait for up to the queue timeout for a running query
+// to finish, before they are rejected. A nil queryLimiter doesn't limit anything.
+type queryLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+
+	inflight prometheus.Gauge
+	rejected prometheus.Counter
+}
+
+// newQueryLimiter returns a limiter of max concurrent queries, or nil if max is not positive.
+func newQueryLimiter(max int, queueTimeout time.Duration, metrics *headMetrics) *queryLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &queryLimiter{
+		slots:        make(chan struct{}, max),
+		queueTimeout: queueTimeout,
+		inflight:     metrics.queriesInflight,
+		rejected:     metrics.queriesTooManyConcurrent,
+	}
+}
+
+// acquire waits for a query slot, release frees it once the query finished.
+func (l *queryLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.acquired(), nil
+	default:
+	}
+
+	if l.queueTimeout > 0 {
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			return l.acquired(), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	l.rejected.Inc()
+	return nil, connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("%w: %d queries are running already", ErrTooManyConcurrentQueries, cap(l.slots)))
+}
+
+func (l *queryLimiter) acquired() func() {
+	l.inflight.Inc()
+	return func() {
+		l.inflight.Dec()
+		<-l.slots
+	}
+}
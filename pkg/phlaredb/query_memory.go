@@ -0,0 +1,96 @@
+package phlaredb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+)
+
+// ErrQueryMemoryLimitExceeded is returned when a query allocates more memory than allowed.
+var ErrQueryMemoryLimitExceeded = withSentinel(ErrLimitExceeded, errors.New("query memory limit exceeded"))
+
+const (
+	// stacktraceSampleBytes estimates an aggregated stacktrace, including its map entry.
+	stacktraceSampleBytes = int64(unsafe.Sizeof(ingestv1.StacktraceSample{})) + 16
+	// selectedProfileBytes estimates a profile kept after the selection.
+	selectedProfileBytes = int64(unsafe.Sizeof(BlockProfile{})) + 16
+)
+
+// queryMemory accounts the memory allocated by a single query. A nil
+// queryMemory doesn't account nor limit anything.
+type queryMemory struct {
+	limit    int64
+	used     atomic.Int64
+	exceeded atomic.Bool
+	rejected prometheus.Counter
+}
+
+// newQueryMemory returns the accounting for a query, limited by the smaller
+// of the configured limit found in ctx and the limit of the request. It
+// returns nil if neither is set.
+func newQueryMemory(ctx context.Context, requestLimit int64) *queryMemory {
+	cfg, _ := ctx.Value(queryMemoryLimitContextKey).(queryMemoryLimit)
+	limit := requestLimit
+	if cfg.limit > 0 && (limit <= 0 || cfg.limit < limit) {
+		limit = cfg.limit
+	}
+	if limit <= 0 {
+		return nil
+	}
+	return &queryMemory{limit: limit, rejected: cfg.rejected}
+}
+
+// reserve accounts bytes allocated by the query, it fails once the limit is exceeded.
+func (m *queryMemory) reserve(bytes int64) error {
+	if m == nil {
+		return nil
+	}
+	if m.used.Add(bytes) <= m.limit {
+		return nil
+	}
+	if m.exceeded.CompareAndSwap(false, true) && m.rejected != nil {
+		m.rejected.Inc()
+	}
+	return connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("%w: the query allocates more than %d bytes, select a narrower time range", ErrQueryMemoryLimitExceeded, m.limit))
+}
+
+// queryMemoryLimit is the configured limit applying to all queries.
+type queryMemoryLimit struct {
+	limit    int64
+	rejected prometheus.Counter
+}
+
+func contextWithQueryMemoryLimit(ctx context.Context, limit int64, rejected prometheus.Counter) context.Context {
+	return context.WithValue(ctx, queryMemoryLimitContextKey, queryMemoryLimit{limit: limit, rejected: rejected})
+}
+
+func contextWithQueryMemory(ctx context.Context, m *queryMemory) context.Context {
+	return context.WithValue(ctx, queryMemoryContextKey, m)
+}
+
+func contextQueryMemory(ctx context.Context) *queryMemory {
+	m, _ := ctx.Value(queryMemoryContextKey).(*queryMemory)
+	return m
+}
+
+// stacktracesResultBytes estimates the memory used by a merge result.
+func stacktracesResultBytes(r *ingestv1.MergeProfilesStacktracesResult) int64 {
+	if r == nil {
+		return 0
+	}
+	size := int64(len(r.Stacktraces))*stacktraceSampleBytes + int64(len(r.Lines))*8
+	for _, s := range r.Stacktraces {
+		size += int64(len(s.FunctionIds)) * 4
+	}
+	for _, n := range r.FunctionNames {
+		size += int64(len(n)) + 16
+	}
+	return size
+}
@@ -0,0 +1,93 @@
+package phlaredb
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+// Query merges the stacktraces of the profiles selected by the request across
+// the blocks in dirs and the head, which may be nil. Blocks outside of the
+// time range of the request are skipped by their meta, without opening them.
+//
+// A profile present in more than one block, e.g. when a block has been
+// replicated, is merged only once: profiles are deduplicated by their ID and
+// series.
+func Query(ctx context.Context, dirs []string, head *Head, req *ingestv1.SelectProfilesRequest) (*ingestv1.MergeProfilesStacktracesResult, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "Query")
+	defer sp.Finish()
+
+	start, end := model.Time(req.Start), model.Time(req.End)
+
+	var queriers Queriers
+	defer func() {
+		_ = queriers.Close()
+	}()
+	for _, dir := range dirs {
+		meta, _, err := block.MetaFromDir(dir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read meta of block %s", dir)
+		}
+		if !block.InRange(meta.MinTime, meta.MaxTime, start, end) {
+			continue
+		}
+		bkt, err := filesystem.NewBucket(filepath.Dir(dir))
+		if err != nil {
+			return nil, err
+		}
+		q := newSingleBlockQuerierFromMeta(ctx, bkt, meta)
+		queriers = append(queriers, q)
+		for _, part := range q.parts {
+			queriers = append(queriers, part)
+		}
+	}
+	if head != nil {
+		queriers = append(queriers, head.Queriers()...)
+	}
+
+	var (
+		typeCheck profileTypeCheck
+		seen      = make(map[profileKey]struct{})
+		result    []*ingestv1.MergeProfilesStacktracesResult
+	)
+	for _, q := range queriers.ForTimeRange(start, end) {
+		selected, err := q.SelectByIDRange(ctx, uuid.Nil, uuid.Nil, req)
+		if err != nil {
+			return nil, err
+		}
+		profiles := make([]Profile, 0, len(selected))
+		for _, p := range selected {
+			k := profileKey{id: p.ID, fp: p.Fingerprint()}
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			profiles = append(profiles, p.Profile)
+		}
+		if len(profiles) == 0 {
+			continue
+		}
+		if err := typeCheck.check(profiles); err != nil {
+			return nil, err
+		}
+		merge, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(q.Sort(profiles)), MergeStacktracesOptions{})
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, merge)
+	}
+
+	merged := phlaremodel.MergeBatchMergeStacktraces(result...)
+	contextFunctionNamesFilter(ctx).redactStacktraces(merged)
+	return merged, nil
+}
@@ -0,0 +1,114 @@
+package phlaredb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/common/model"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	pprofth "github.com/grafana/phlare/pkg/pprof/testhelper"
+)
+
+func TestQuery(t *testing.T) {
+	ctx := testContext(t)
+
+	// flushBlock flushes the profiles [from, to) into a block
+	flushBlock := func(from, to int) string {
+		head := newTestHead(t)
+		for i := from; i < to; i++ {
+			require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+		}
+		_, err := head.Flush(ctx)
+		require.NoError(t, err)
+		return head.localPath
+	}
+	dirs := []string{
+		flushBlock(1, 4),
+		flushBlock(4, 7),
+	}
+
+	// the head holds a copy of a profile of the second block
+	head := newTestHead(t)
+	for _, i := range []int{5, 7, 8} {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, head.Ingest))
+	}
+
+	query := func(start, end time.Duration) map[string]int64 {
+		result, err := Query(ctx, dirs, head.Head, &ingestv1.SelectProfilesRequest{
+			LabelSelector: "{}",
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         int64(model.TimeFromUnixNano(int64(start))),
+			End:           int64(model.TimeFromUnixNano(int64(end))),
+		})
+		require.NoError(t, err)
+		stacktraces := make(map[string]int64, len(result.Stacktraces))
+		for _, s := range result.Stacktraces {
+			names := lo.Map(s.FunctionIds, func(id int32, _ int) string { return result.FunctionNames[id] })
+			stacktraces[strings.Join(names, ";")] += s.Value
+		}
+		return stacktraces
+	}
+
+	// the profiles 1 to 8 are merged once each
+	require.Equal(t, map[string]int64{
+		"func1;func2": 80,
+		"func1":       160,
+	}, query(0, time.Hour))
+
+	// the first block is pruned by its meta and isn't read
+	require.NoError(t, os.Remove(filepath.Join(dirs[0], "profiles.parquet")))
+	require.Equal(t, map[string]int64{
+		"func1;func2": 30,
+		"func1":       60,
+	}, query(4*time.Second, 6*time.Second))
+
+	require.Empty(t, query(time.Hour, 2*time.Hour))
+}
+
+func TestQuery_NoHead(t *testing.T) {
+	dir := newVerifyTestBlock(t)
+	result, err := Query(context.Background(), []string{dir}, nil, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{stream="stream-a"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+	})
+	require.NoError(t, err)
+	var total int64
+	for _, s := range result.Stacktraces {
+		total += s.Value
+	}
+	// 3 profiles of stream-a with 30 samples each
+	require.Equal(t, int64(90), total)
+}
+
+func TestQuery_MaxProfileID(t *testing.T) {
+	ctx := testContext(t)
+	head := newTestHead(t)
+	p := pprofth.NewProfileBuilder(time.Second.Nanoseconds()).CPUProfile().WithLabels("job", "foo")
+	p.ForStacktraceString("func1").AddSamples(10)
+	// the greatest ID is selected as well
+	id := uuid.UUID{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	}
+	require.NoError(t, head.Ingest(ctx, p.Profile, id, p.Labels...))
+
+	result, err := Query(ctx, nil, head.Head, &ingestv1.SelectProfilesRequest{
+		LabelSelector: "{}",
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         0,
+		End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+	})
+	require.NoError(t, err)
+	require.Len(t, result.Stacktraces, 1)
+	require.Equal(t, int64(10), result.Stacktraces[0].Value)
+}
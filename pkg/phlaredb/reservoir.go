@@ -0,0 +1,167 @@
+package phlaredb
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/common/model"
+	"go.uber.org/atomic"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+// seriesReservoirs samples the profiles of series exceeding size profiles per
+// head. The first size profiles of a series are stored in the head as usual,
+// the profiles received beyond are sampled into at most size profiles. The
+// sampled profiles are held back until the head is flushed, as each profile
+// received might still replace one of them.
+type seriesReservoirs struct {
+	size    int
+	upsert  bool
+	metrics *headMetrics
+	helper  profilesHelper
+
+	// memorySize is the size of the sampled profiles held back.
+	memorySize atomic.Uint64
+
+	mtx    sync.Mutex
+	rand   *rand.Rand
+	series map[model.Fingerprint]*seriesReservoir
+}
+
+type seriesReservoir struct {
+	lbs         phlaremodel.Labels
+	profileName string
+	stored      int // profiles stored in the head
+	received    int // profiles received beyond the stored profiles
+	profiles    []*schemav1.Profile
+	// ids are the positions in profiles of the received profiles by their
+	// ID, -1 for profiles sampled out.
+	ids map[uuid.UUID]int
+}
+
+// newSeriesReservoirs returns reservoirs of size profiles, or nil if size is not positive.
+func newSeriesReservoirs(size int, duplicateProfiles string, metrics *headMetrics) *seriesReservoirs {
+	if size <= 0 {
+		return nil
+	}
+	return &seriesReservoirs{
+		size:    size,
+		upsert:  duplicateProfiles == DuplicateProfilesUpsert,
+		metrics: metrics,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		series:  make(map[model.Fingerprint]*seriesReservoir),
+	}
+}
+
+// admit returns true, if the profile of the series is stored in the head as
+// usual, as the series has not exceeded the reservoir size yet. Otherwise the
+// profile needs to be added to the reservoir of the series.
+func (r *seriesReservoirs) admit(fp model.Fingerprint, lbs phlaremodel.Labels, profileName string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	res, ok := r.series[fp]
+	if !ok {
+		res = &seriesReservoir{lbs: lbs, profileName: profileName, ids: make(map[uuid.UUID]int)}
+		r.series[fp] = res
+	}
+	if res.stored < r.size {
+		res.stored++
+		return true
+	}
+	return false
+}
+
+// add offers a profile not admitted to the reservoir of its series. Once the
+// reservoir is full, the n-th profile received replaces a random sampled
+// profile with a probability of size/n, so each profile is equally likely to
+// be kept. Profiles received again with the same ID are handled like
+// duplicates of the profile store.
+func (r *seriesReservoirs) add(p *schemav1.Profile) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	res := r.series[p.SeriesFingerprint]
+	if pos, ok := res.ids[p.ID]; ok && p.ID != uuid.Nil {
+		if !r.upsert || pos < 0 {
+			r.metrics.duplicateProfiles.WithLabelValues(duplicateProfilesDropped).Inc()
+			return
+		}
+		r.replace(res, pos, p)
+		r.metrics.duplicateProfiles.WithLabelValues(duplicateProfilesReplaced).Inc()
+		return
+	}
+
+	res.received++
+	if len(res.profiles) < r.size {
+		res.profiles = append(res.profiles, nil)
+		r.replace(res, len(res.profiles)-1, p)
+		return
+	}
+	if idx := r.rand.Intn(res.received); idx < r.size {
+		r.replace(res, idx, p)
+	} else if p.ID != uuid.Nil {
+		res.ids[p.ID] = -1
+	}
+	// either the profile or the one it replaced is dropped
+	r.metrics.sampledOutProfiles.Inc()
+}
+
+// replace puts p at pos of the sampled profiles of res.
+func (r *seriesReservoirs) replace(res *seriesReservoir, pos int, p *schemav1.Profile) {
+	if old := res.profiles[pos]; old != nil {
+		r.memorySize.Sub(r.helper.size(old))
+		if old.ID != uuid.Nil {
+			res.ids[old.ID] = -1
+		}
+	}
+	res.profiles[pos] = p
+	r.memorySize.Add(r.helper.size(p))
+	if p.ID != uuid.Nil {
+		res.ids[p.ID] = pos
+	}
+}
+
+// sizeBytes returns the size of the sampled profiles held back, 0 for disabled reservoirs.
+func (r *seriesReservoirs) sizeBytes() uint64 {
+	if r == nil {
+		return 0
+	}
+	return r.memorySize.Load()
+}
+
+// drain passes the sampled profiles of each series ordered by time to fn and
+// empties the reservoirs. The sample values are scaled by the ratio of the
+// received to the sampled profiles, which approximates the total values of
+// the profiles received beyond the stored profiles.
+func (r *seriesReservoirs) drain(fn func(profiles []*schemav1.Profile, lbs phlaremodel.Labels, profileName string) error) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for fp, res := range r.series {
+		if sampled := len(res.profiles); res.received > sampled {
+			received := int64(res.received)
+			for _, p := range res.profiles {
+				for _, s := range p.Samples {
+					s.Value = (s.Value*received + int64(sampled)/2) / int64(sampled)
+				}
+			}
+		}
+		sort.Slice(res.profiles, func(i, j int) bool {
+			return res.profiles[i].TimeNanos < res.profiles[j].TimeNanos
+		})
+		if len(res.profiles) > 0 {
+			if err := fn(res.profiles, res.lbs, res.profileName); err != nil {
+				return err
+			}
+		}
+		delete(r.series, fp)
+	}
+	r.memorySize.Store(0)
+	return nil
+}
@@ -0,0 +1,157 @@
+package phlaredb
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/parquet-go"
+
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+// ErrUnsortedRows is returned by RowGroupWriter.Append for profiles not
+// following the previous profile of the row group in the sort order.
+var ErrUnsortedRows = errors.New("rows are not sorted")
+
+// RowGroupWriter writes profiles to a parquet file the way the profile store
+// flushes them, for writers interning the symbols of the profiles themselves.
+// The profiles need to be sorted by the SortOrder of the config within each row
+// group and reference their series by SeriesIndex. Row groups are cut once the
+// row or size limits of the config are reached, or explicitly by CutRowGroup.
+type RowGroupWriter struct {
+	cfg    *ParquetConfig
+	file   *os.File
+	writer *parquet.GenericWriter[*schemav1.Profile]
+	helper profilesHelper
+
+	// the last profile and the size of the current row group
+	last      *schemav1.Profile
+	rows      uint64
+	size      uint64
+	numRows   uint64
+	numGroups uint64
+}
+
+// NewRowGroupWriter creates the parquet file at path and returns a writer of
+// profiles to it. The default parquet config is used with cfg being nil.
+func NewRowGroupWriter(path string, cfg *ParquetConfig) (*RowGroupWriter, error) {
+	if cfg == nil {
+		cfg = defaultParquetConfig
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &RowGroupWriter{
+		cfg:    cfg,
+		file:   file,
+		writer: newProfilesWriter(file, cfg.SortOrder, cfg.BloomFilterColumns),
+	}, nil
+}
+
+// Append writes the profiles to the current row group, cutting it whenever it
+// reaches the limits of the config. Nothing is written, if a profile is out of
+// order.
+func (w *RowGroupWriter) Append(profiles []*schemav1.Profile) error {
+	// the profiles are validated up front, simulating the cuts of the row groups
+	last, rows, size := w.last, w.rows, w.size
+	for i, p := range profiles {
+		if last != nil && w.less(p, last) {
+			return fmt.Errorf("profile %d (series index %d, time %d) sorts before its previous profile (series index %d, time %d): %w",
+				i, p.SeriesIndex, p.TimeNanos, last.SeriesIndex, last.TimeNanos, ErrUnsortedRows)
+		}
+		last, rows, size = p, rows+1, size+w.helper.size(p)
+		if w.full(rows, size) {
+			last, rows, size = nil, 0, 0
+		}
+	}
+
+	for _, p := range profiles {
+		if _, err := w.writer.Write([]*schemav1.Profile{p}); err != nil {
+			return err
+		}
+		w.last = p
+		w.rows++
+		w.size += w.helper.size(p)
+		if w.full(w.rows, w.size) {
+			if err := w.CutRowGroup(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// full returns true, if a row group of the rows and size has reached the limits of the config.
+func (w *RowGroupWriter) full(rows, size uint64) bool {
+	return w.cfg.MaxBufferRowCount > 0 && rows >= uint64(w.cfg.MaxBufferRowCount) ||
+		w.cfg.MaxRowGroupBytes > 0 && size >= w.cfg.MaxRowGroupBytes
+}
+
+// less returns true, if pI sorts before pJ in the sort order of the config.
+func (w *RowGroupWriter) less(pI, pJ *schemav1.Profile) bool {
+	if w.cfg.SortOrder == TimeThenSeries {
+		if pI.TimeNanos != pJ.TimeNanos {
+			return pI.TimeNanos < pJ.TimeNanos
+		}
+		if pI.SeriesIndex != pJ.SeriesIndex {
+			return pI.SeriesIndex < pJ.SeriesIndex
+		}
+	} else {
+		if pI.SeriesIndex != pJ.SeriesIndex {
+			return pI.SeriesIndex < pJ.SeriesIndex
+		}
+		if pI.TimeNanos != pJ.TimeNanos {
+			return pI.TimeNanos < pJ.TimeNanos
+		}
+	}
+	for k := range pI.ID {
+		if pI.ID[k] != pJ.ID[k] {
+			return pI.ID[k] < pJ.ID[k]
+		}
+	}
+	return false
+}
+
+// CutRowGroup flushes the profiles appended since the last cut as a row
+// group. The next profile appended is not required to sort after the
+// previous ones.
+func (w *RowGroupWriter) CutRowGroup() error {
+	if w.rows == 0 {
+		return nil
+	}
+	if err := w.writer.Flush(); err != nil {
+		return errors.Wrap(err, "flushing row group")
+	}
+	w.numRows += w.rows
+	w.numGroups++
+	w.last = nil
+	w.rows = 0
+	w.size = 0
+	return nil
+}
+
+// Close cuts the last row group and completes the parquet file. It returns
+// the number of rows and row groups written.
+func (w *RowGroupWriter) Close() (numRows uint64, numRowGroups uint64, err error) {
+	if err := w.CutRowGroup(); err != nil {
+		_ = w.file.Close()
+		return 0, 0, err
+	}
+	if err := w.writer.Close(); err != nil {
+		_ = w.file.Close()
+		return 0, 0, errors.Wrap(err, "closing parquet writer")
+	}
+	if err := w.file.Close(); err != nil {
+		return 0, 0, errors.Wrap(err, "closing parquet file")
+	}
+
+	// the file is only complete once closed
+	if w.cfg.PageChecksums {
+		if err := VerifyPageChecksums(w.file.Name()); err != nil {
+			return 0, 0, err
+		}
+	}
+	return w.numRows, w.numGroups, nil
+}
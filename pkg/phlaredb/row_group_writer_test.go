@@ -0,0 +1,114 @@
+package phlaredb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samber/lo"
+	"github.com/segmentio/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+// rowGroupLayout returns the number of rows and the sorting columns of each
+// row group of the parquet file at path.
+func rowGroupLayout(t *testing.T, path string) (numRows []int64, sortingColumns [][]string) {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	stat, err := f.Stat()
+	require.NoError(t, err)
+	pf, err := parquet.OpenFile(f, stat.Size())
+	require.NoError(t, err)
+	for _, rg := range pf.RowGroups() {
+		numRows = append(numRows, rg.NumRows())
+		sortingColumns = append(sortingColumns, lo.Map(rg.SortingColumns(), func(c parquet.SortingColumn, _ int) string {
+			return strings.Join(c.Path(), ".")
+		}))
+	}
+	return numRows, sortingColumns
+}
+
+// TestRowGroupWriter ensures that appending the rows flushed by the profile
+// store produces the same parquet file as the profile store.
+func TestRowGroupWriter(t *testing.T) {
+	for _, order := range []SortOrder{SeriesThenTime, TimeThenSeries} {
+		order := order
+		t.Run(map[SortOrder]string{SeriesThenTime: "series then time", TimeThenSeries: "time then series"}[order], func(t *testing.T) {
+			var (
+				ctx   = testContext(t)
+				store = newProfileStore(ctx)
+				path  = t.TempDir()
+				cfg   = &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 3, SortOrder: order}
+			)
+			require.NoError(t, store.Init(path, cfg, newHeadMetrics(prometheus.NewRegistry())))
+			for i := 0; i < 9; i++ {
+				p := threeProfileStreams(i)
+				require.NoError(t, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, emptyRewriter()))
+			}
+			expectedNumRows, expectedNumRGs, err := store.Flush(context.Background())
+			require.NoError(t, err)
+			expected, _ := readFullParquetFile[*schemav1.Profile](t, filepath.Join(path, "profiles.parquet"))
+
+			writerPath := filepath.Join(t.TempDir(), "profiles.parquet")
+			w, err := NewRowGroupWriter(writerPath, cfg)
+			require.NoError(t, err)
+			// the rows are appended in batches not aligned with the row groups
+			require.NoError(t, w.Append(expected[:2]))
+			require.NoError(t, w.Append(expected[2:7]))
+			require.NoError(t, w.Append(expected[7:]))
+			numRows, numRGs, err := w.Close()
+			require.NoError(t, err)
+			assert.Equal(t, expectedNumRows, numRows)
+			assert.Equal(t, expectedNumRGs, numRGs)
+
+			actual, _ := readFullParquetFile[*schemav1.Profile](t, writerPath)
+			assert.Equal(t, expected, actual)
+
+			expectedRowGroupRows, expectedSortingColumns := rowGroupLayout(t, filepath.Join(path, "profiles.parquet"))
+			actualRowGroupRows, actualSortingColumns := rowGroupLayout(t, writerPath)
+			assert.Equal(t, expectedRowGroupRows, actualRowGroupRows)
+			assert.Equal(t, expectedSortingColumns, actualSortingColumns)
+		})
+	}
+}
+
+func TestRowGroupWriter_UnsortedRows(t *testing.T) {
+	profile := func(i int, seriesIndex uint32) *schemav1.Profile {
+		p := threeProfileStreams(i).p
+		p.SeriesIndex = seriesIndex
+		return &p
+	}
+
+	path := filepath.Join(t.TempDir(), "profiles.parquet")
+	w, err := NewRowGroupWriter(path, &ParquetConfig{MaxBufferRowCount: 3})
+	require.NoError(t, err)
+
+	require.NoError(t, w.Append([]*schemav1.Profile{profile(0, 1)}))
+	// the profile of series 0 sorts before the previous one of series 1
+	err = w.Append([]*schemav1.Profile{profile(1, 1), profile(2, 0)})
+	require.ErrorIs(t, err, ErrUnsortedRows)
+
+	// nothing has been written by the failing append
+	require.NoError(t, w.Append([]*schemav1.Profile{profile(1, 1), profile(2, 1)}))
+	// the row group has been cut, the next one may start with any series
+	require.NoError(t, w.Append([]*schemav1.Profile{profile(3, 0)}))
+	require.NoError(t, w.CutRowGroup())
+	require.NoError(t, w.Append([]*schemav1.Profile{profile(0, 0)}))
+
+	numRows, numRGs, err := w.Close()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), numRows)
+	assert.Equal(t, uint64(3), numRGs)
+
+	rows, _ := readFullParquetFile[*schemav1.Profile](t, path)
+	assert.Equal(t, []uint32{1, 1, 1, 0, 0}, lo.Map(rows, func(p *schemav1.Profile, _ int) uint32 {
+		return p.SeriesIndex
+	}))
+}
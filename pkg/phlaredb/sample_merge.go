@@ -2,7 +2,10 @@ package phlaredb
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"sort"
+	"strconv"
 
 	"github.com/google/pprof/profile"
 	"github.com/opentracing/opentracing-go"
@@ -17,33 +20,140 @@ import (
 	"github.com/grafana/phlare/pkg/iter"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 	"github.com/grafana/phlare/pkg/phlaredb/query"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
 )
 
-func (b *singleBlockQuerier) MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile]) (*ingestv1.MergeProfilesStacktracesResult, error) {
+func (b *singleBlockQuerier) MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile], opts MergeStacktracesOptions) (*ingestv1.MergeProfilesStacktracesResult, error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeByStacktraces - Block")
 	defer sp.Finish()
 
+	if opts.SplitBySampleLabel != "" {
+		return b.mergeBySampleLabel(ctx, rows, opts)
+	}
+
 	stacktraceAggrValues := make(stacktraceSampleMap)
+	if opts.NormalizePeriod {
+		if err := mergeByNormalizedStacktraces(ctx, b.profiles.file, rows, stacktraceAggrValues, opts); err != nil {
+			return nil, err
+		}
+		return b.resolveStacktraceSymbols(ctx, stacktraceAggrValues, opts)
+	}
 	if err := mergeByStacktraces(ctx, b.profiles.file, rows, stacktraceAggrValues); err != nil {
 		return nil, err
 	}
 
+	return b.resolveStacktraceSymbols(ctx, stacktraceAggrValues, opts)
+}
+
+func (b *singleBlockQuerier) resolveStacktraceSymbols(ctx context.Context, stacktraceAggrValues stacktraceSampleMap, opts MergeStacktracesOptions) (*ingestv1.MergeProfilesStacktracesResult, error) {
+	if opts.Granularity == ingestv1.StacktraceGranularity_STACKTRACE_GRANULARITY_LINE {
+		return b.resolveSymbolsByLine(ctx, stacktraceAggrValues)
+	}
 	return b.resolveSymbols(ctx, stacktraceAggrValues)
 }
 
-func (b *singleBlockQuerier) MergePprof(ctx context.Context, rows iter.Iterator[Profile]) (*profile.Profile, error) {
+// stringID returns the ID of the string s in the block, or -1 if the block doesn't contain it.
+func (b *singleBlockQuerier) stringID(s string) int64 {
+	for id, str := range b.strings.cache {
+		if str.String == s {
+			return int64(id)
+		}
+	}
+	return -1
+}
+
+func (b *singleBlockQuerier) lookupString(id int64) string {
+	return b.strings.cache[id].String
+}
+
+func (b *singleBlockQuerier) mergeBySampleLabel(ctx context.Context, rows iter.Iterator[Profile], opts MergeStacktracesOptions) (*ingestv1.MergeProfilesStacktracesResult, error) {
+	var (
+		nameID = b.stringID(opts.SplitBySampleLabel)
+		values = make(sampleLabelValues)
+	)
+	if err := readProfileRows(ctx, b.profiles.file, rows, func(p Profile, row *schemav1.Profile) {
+		values.add(p, row.Samples, opts.periodFactor(row.Period), opts.SplitBySampleLabel, nameID, b.lookupString)
+	}); err != nil {
+		return nil, err
+	}
+
+	stacktraceAggrValues := values.stacktraceSamples()
+	result, err := b.resolveStacktraceSymbols(ctx, stacktraceAggrValues, opts)
+	if err != nil {
+		return nil, err
+	}
+	values.split(result, stacktraceAggrValues, opts)
+	return result, nil
+}
+
+func (b *singleBlockQuerier) MergePprof(ctx context.Context, rows iter.Iterator[Profile], opts MergePprofOptions) (*profile.Profile, error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeByStacktraces - Block")
 	defer sp.Finish()
 
-	stacktraceAggrValues := make(profileSampleMap)
-	if err := mergeByStacktraces(ctx, b.profiles.file, rows, stacktraceAggrValues); err != nil {
+	var (
+		stacktraceAggrValues = make(profileSampleMap)
+		comments             profileComments
+	)
+	if opts.SampleLabel != nil {
+		filter := newSampleLabelFilter(opts.SampleLabel, b.stringID(opts.SampleLabel.Name), b.lookupString)
+		if err := readProfileRows(ctx, b.profiles.file, rows, func(_ Profile, row *schemav1.Profile) {
+			filter.add(stacktraceAggrValues, row.Samples)
+			comments.add(row.Comments...)
+		}); err != nil {
+			return nil, err
+		}
+		return b.resolvePprofSymbols(ctx, stacktraceAggrValues, comments)
+	}
+	multiRows, err := iter.CloneN(rows, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := mergeByStacktraces(ctx, b.profiles.file, multiRows[0], stacktraceAggrValues); err != nil {
+		return nil, err
+	}
+	if err := readComments(ctx, b.profiles.file, multiRows[1], &comments); err != nil {
 		return nil, err
 	}
 
-	return b.resolvePprofSymbols(ctx, stacktraceAggrValues)
+	return b.resolvePprofSymbols(ctx, stacktraceAggrValues, comments)
+}
+
+// profileComments holds the string IDs of the comments of the profiles
+// merged into a pprof profile, in the order they have been seen first.
+type profileComments struct {
+	ids  []int64
+	seen map[int64]struct{}
+}
+
+func (c *profileComments) add(ids ...int64) {
+	for _, id := range ids {
+		if _, ok := c.seen[id]; ok {
+			continue
+		}
+		if c.seen == nil {
+			c.seen = make(map[int64]struct{})
+		}
+		c.seen[id] = struct{}{}
+		c.ids = append(c.ids, id)
+	}
+}
+
+// readComments adds the comments of the profile rows to c.
+func readComments(ctx context.Context, profileSource Source, rows iter.Iterator[Profile], c *profileComments) error {
+	it := repeatedColumnIter(ctx, profileSource, "Comments.list.element", rows)
+	defer it.Close()
+	for it.Next() {
+		for _, v := range it.At().Values {
+			// profiles without comments have a single null value
+			if !v.IsNull() {
+				c.add(v.Int64())
+			}
+		}
+	}
+	return it.Err()
 }
 
-func (b *singleBlockQuerier) resolvePprofSymbols(ctx context.Context, stacktraceAggrByID map[int64]*profile.Sample) (*profile.Profile, error) {
+func (b *singleBlockQuerier) resolvePprofSymbols(ctx context.Context, stacktraceAggrByID map[int64]*profile.Sample, comments profileComments) (*profile.Profile, error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "ResolvePprofSymbols - Block")
 	defer sp.Finish()
 
@@ -161,6 +271,12 @@ func (b *singleBlockQuerier) resolvePprofSymbols(ctx context.Context, stacktrace
 		stringsIds[cur.Result.Filename] = 0
 		stringsIds[cur.Result.BuildId] = 0
 	}
+	if err := mapping.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range comments.ids {
+		stringsIds[id] = 0
+	}
 	// gather strings
 	var (
 		names   = make([]string, len(stringsIds))
@@ -209,11 +325,124 @@ func (b *singleBlockQuerier) resolvePprofSymbols(ctx context.Context, stacktrace
 		Function: lo.Values(functionModelsByIds),
 		Mapping:  mappingResult,
 	}
+	for _, id := range comments.ids {
+		result.Comments = append(result.Comments, names[stringsIds[id]])
+	}
 	normalizeProfileIds(result)
 
 	return result, nil
 }
 
+// functionLineKey identifies a stacktrace node. The line is only set when
+// merging with line granularity.
+type functionLineKey struct {
+	name int64
+	line int64
+}
+
+// resolveSymbolsByLine resolves the stacktraces into nodes keyed by function
+// name and line number.
+func (b *singleBlockQuerier) resolveSymbolsByLine(ctx context.Context, stacktraceAggrByID map[int64]*ingestv1.StacktraceSample) (*ingestv1.MergeProfilesStacktracesResult, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "ResolveSymbolsByLine - Block")
+	defer sp.Finish()
+	locationsByStacktraceID := map[int64][]uint64{}
+
+	// gather stacktraces
+	stacktraceIDs := lo.Keys(stacktraceAggrByID)
+	sort.Slice(stacktraceIDs, func(i, j int) bool {
+		return stacktraceIDs[i] < stacktraceIDs[j]
+	})
+
+	var (
+		locationIDs = newUniqueIDs[struct{}]()
+		stacktraces = repeatedColumnIter(ctx, b.stacktraces.file, "LocationIDs.list.element", iter.NewSliceIterator(stacktraceIDs))
+	)
+	for stacktraces.Next() {
+		s := stacktraces.At()
+		for _, locationID := range s.Values {
+			locID := locationID.Uint64()
+			locationIDs[int64(locID)] = struct{}{}
+			locationsByStacktraceID[s.Row] = append(locationsByStacktraceID[s.Row], locID)
+		}
+	}
+	if err := stacktraces.Err(); err != nil {
+		return nil, err
+	}
+	sp.LogFields(otlog.Int("stacktraces", len(stacktraceIDs)))
+
+	// gather locations
+	var (
+		functionIDs       = newUniqueIDs[int64]()
+		linesByLocationID = map[int64][]*googlev1.Line{}
+		locations         = b.locations.retrieveRows(ctx, locationIDs.iterator())
+	)
+	for locations.Next() {
+		s := locations.At()
+		linesByLocationID[s.RowNum] = s.Result.Line
+		for _, line := range s.Result.Line {
+			functionIDs[int64(line.FunctionId)] = 0
+		}
+	}
+	if err := locations.Err(); err != nil {
+		return nil, err
+	}
+
+	// gather functions
+	var (
+		stringIDs = newUniqueIDs[string]()
+		functions = b.functions.retrieveRows(ctx, functionIDs.iterator())
+	)
+	for functions.Next() {
+		s := functions.At()
+		functionIDs[s.RowNum] = s.Result.Name
+		stringIDs[s.Result.Name] = ""
+	}
+	if err := functions.Err(); err != nil {
+		return nil, err
+	}
+
+	// gather strings
+	strings := b.strings.retrieveRows(ctx, stringIDs.iterator())
+	for strings.Next() {
+		s := strings.At()
+		stringIDs[s.RowNum] = s.Result.String
+	}
+	if err := strings.Err(); err != nil {
+		return nil, err
+	}
+
+	// intern function name and line pairs and write them into each sample
+	var (
+		names     []string
+		lines     []int64
+		positions = map[functionLineKey]int32{}
+	)
+	for stacktraceID, sample := range stacktraceAggrByID {
+		locationIDs := locationsByStacktraceID[stacktraceID]
+		fnIDs := make([]int32, 0, len(locationIDs))
+		for _, locationID := range locationIDs {
+			for _, line := range linesByLocationID[int64(locationID)] {
+				key := functionLineKey{name: functionIDs[int64(line.FunctionId)], line: line.Line}
+				pos, ok := positions[key]
+				if !ok {
+					pos = int32(len(names))
+					positions[key] = pos
+					names = append(names, stringIDs[key.name])
+					lines = append(lines, key.line)
+				}
+				fnIDs = append(fnIDs, pos)
+			}
+		}
+		sample.FunctionIds = fnIDs
+	}
+
+	return &ingestv1.MergeProfilesStacktracesResult{
+		Stacktraces:   lo.Values(stacktraceAggrByID),
+		FunctionNames: names,
+		Lines:         lines,
+	}, nil
+}
+
 func (b *singleBlockQuerier) resolveSymbols(ctx context.Context, stacktraceAggrByID map[int64]*ingestv1.StacktraceSample) (*ingestv1.MergeProfilesStacktracesResult, error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "ResolveSymbols - Block")
 	defer sp.Finish()
@@ -354,6 +583,12 @@ func (b *singleBlockQuerier) MergeByLabels(ctx context.Context, rows iter.Iterat
 	return m.normalize(), nil
 }
 
+func (b *singleBlockQuerier) Totals(ctx context.Context, rows iter.Iterator[Profile]) ([]ProfileWithTotal, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "Totals - Block")
+	defer sp.Finish()
+	return profileTotals(ctx, b.profiles.file, rows)
+}
+
 type Source interface {
 	Schema() *parquet.Schema
 	RowGroups() []parquet.RowGroup
@@ -361,6 +596,8 @@ type Source interface {
 
 type profileSampleMap map[int64]*profile.Sample
 
+func (m profileSampleMap) len() int { return len(m) }
+
 func (m profileSampleMap) add(key, value int64) {
 	if _, ok := m[key]; ok {
 		m[key].Value[0] += value
@@ -373,6 +610,8 @@ func (m profileSampleMap) add(key, value int64) {
 
 type stacktraceSampleMap map[int64]*ingestv1.StacktraceSample
 
+func (m stacktraceSampleMap) len() int { return len(m) }
+
 func (m stacktraceSampleMap) add(key, value int64) {
 	if _, ok := m[key]; ok {
 		m[key].Value += value
@@ -383,8 +622,187 @@ func (m stacktraceSampleMap) add(key, value int64) {
 	}
 }
 
+// sampleLabelKey identifies the aggregated value of a stacktrace for a
+// particular value of the sample label to split by.
+type sampleLabelKey struct {
+	stacktraceID int64
+	value        string
+	hasValue     bool
+}
+
+type sampleLabelValues map[sampleLabelKey]int64
+
+// add aggregates the samples of a profile multiplied by factor by stacktrace
+// and the value of the sample label with the string ID nameID. The sample
+// label takes precedence, samples without it use the value of the series label
+// with the same name.
+func (m sampleLabelValues) add(p Profile, samples []*schemav1.Sample, factor int64, name string, nameID int64, lookupString func(int64) string) {
+	seriesValue := p.Labels().Get(name)
+	for _, s := range samples {
+		if s.Value == 0 {
+			continue
+		}
+		k := sampleLabelKey{
+			stacktraceID: int64(s.StacktraceID),
+			value:        seriesValue,
+			hasValue:     seriesValue != "",
+		}
+		for _, l := range s.Labels {
+			if l.Key != nameID {
+				continue
+			}
+			if l.Str != 0 {
+				k.value = lookupString(l.Str)
+			} else {
+				k.value = strconv.FormatInt(l.Num, 10)
+			}
+			k.hasValue = true
+			break
+		}
+		m[k] += s.Value * factor
+	}
+}
+
+// sampleLabelFilter keeps the samples with a given sample label.
+type sampleLabelFilter struct {
+	nameID       int64
+	value        string
+	lookupString func(int64) string
+}
+
+// newSampleLabelFilter returns a filter for the label, nameID is the string ID
+// of the label name or -1 if the string doesn't exist, so no sample matches.
+func newSampleLabelFilter(label *typesv1.LabelPair, nameID int64, lookupString func(int64) string) sampleLabelFilter {
+	return sampleLabelFilter{nameID: nameID, value: label.Value, lookupString: lookupString}
+}
+
+func (f sampleLabelFilter) keep(s *schemav1.Sample) bool {
+	if f.nameID < 0 {
+		return false
+	}
+	for _, l := range s.Labels {
+		if l.Key != f.nameID {
+			continue
+		}
+		if l.Str != 0 {
+			return f.lookupString(l.Str) == f.value
+		}
+		return strconv.FormatInt(l.Num, 10) == f.value
+	}
+	return false
+}
+
+// add adds the samples kept by the filter to m.
+func (f sampleLabelFilter) add(m mapAdder, samples []*schemav1.Sample) {
+	for _, s := range samples {
+		if s.Value != 0 && f.keep(s) {
+			m.add(int64(s.StacktraceID), s.Value)
+		}
+	}
+}
+
+// stacktraceSamples returns the distinct stacktraces, so their symbols can be
+// resolved.
+func (m sampleLabelValues) stacktraceSamples() stacktraceSampleMap {
+	samples := make(stacktraceSampleMap, len(m))
+	for k, v := range m {
+		samples.add(k.stacktraceID, v)
+	}
+	return samples
+}
+
+// split replaces the stacktraces of the result, with one stacktrace per label
+// value. Each of them gets an additional root node named "<label>=<value>".
+func (m sampleLabelValues) split(result *ingestv1.MergeProfilesStacktracesResult, resolved stacktraceSampleMap, opts MergeStacktracesOptions) {
+	var (
+		byLine = opts.Granularity == ingestv1.StacktraceGranularity_STACKTRACE_GRANULARITY_LINE
+		roots  = make(map[string]int32)
+	)
+	result.Stacktraces = make([]*ingestv1.StacktraceSample, 0, len(m))
+	for k, v := range m {
+		functionIDs := resolved[k.stacktraceID].FunctionIds
+		if k.hasValue {
+			root, ok := roots[k.value]
+			if !ok {
+				root = int32(len(result.FunctionNames))
+				roots[k.value] = root
+				result.FunctionNames = append(result.FunctionNames, opts.SplitBySampleLabel+"="+k.value)
+				if byLine {
+					result.Lines = append(result.Lines, 0)
+				}
+			}
+			functionIDs = append(functionIDs[:len(functionIDs):len(functionIDs)], root)
+		}
+		result.Stacktraces = append(result.Stacktraces, &ingestv1.StacktraceSample{
+			FunctionIds: functionIDs,
+			Value:       v,
+		})
+	}
+}
+
+// readProfileRows reads the selected profiles from the source and calls fn
+// with each of them. The profiles are expected to be sorted by row number.
+func readProfileRows(ctx context.Context, profileSource Source, rows iter.Iterator[Profile], fn func(Profile, *schemav1.Profile)) error {
+	sp, _ := opentracing.StartSpanFromContext(ctx, "readProfileRows")
+	defer sp.Finish()
+
+	var (
+		persister  = &schemav1.ProfilePersister{}
+		rowGroups  = profileSource.RowGroups()
+		rgStartRow int64
+		rgRows     parquet.Rows
+		buf        = make([]parquet.Row, 1)
+	)
+	defer func() {
+		if rgRows != nil {
+			rgRows.Close()
+		}
+	}()
+
+	for rows.Next() {
+		p := rows.At()
+		rg, ok := p.(query.RowGetter)
+		if !ok {
+			return fmt.Errorf("unexpected profile type %T", p)
+		}
+		rowNum := rg.RowNumber()
+
+		for len(rowGroups) > 0 && rowNum >= rgStartRow+rowGroups[0].NumRows() {
+			if rgRows != nil {
+				if err := rgRows.Close(); err != nil {
+					return err
+				}
+				rgRows = nil
+			}
+			rgStartRow += rowGroups[0].NumRows()
+			rowGroups = rowGroups[1:]
+		}
+		if len(rowGroups) == 0 {
+			return fmt.Errorf("row %d not found", rowNum)
+		}
+		if rgRows == nil {
+			rgRows = rowGroups[0].Rows()
+		}
+
+		if err := rgRows.SeekToRow(rowNum - rgStartRow); err != nil {
+			return err
+		}
+		buf[0] = buf[0][:0]
+		if _, err := rgRows.ReadRows(buf); err != nil && err != io.EOF {
+			return err
+		}
+		_, row, err := persister.Reconstruct(buf[0])
+		if err != nil {
+			return err
+		}
+		fn(p, row)
+	}
+	return rows.Err()
+}
+
 type mapAdder interface {
 	add(key, value int64)
+	len() int
 }
 
 func mergeByStacktraces(ctx context.Context, profileSource Source, rows iter.Iterator[Profile], m mapAdder) error {
@@ -401,15 +819,53 @@ func mergeByStacktraces(ctx context.Context, profileSource Source, rows iter.Ite
 	)
 	defer it.Close()
 
+	var (
+		mem       = contextQueryMemory(ctx)
+		accounted = m.len()
+	)
 	for it.Next() {
 		values := it.At().Values
 		for i := 0; i < len(values[0]); i++ {
 			m.add(values[0][i].Int64(), values[1][i].Int64())
 		}
+		if n := m.len(); n > accounted {
+			if err := mem.reserve(int64(n-accounted) * stacktraceSampleBytes); err != nil {
+				return err
+			}
+			accounted = n
+		}
 	}
 	return nil
 }
 
+// mergeByNormalizedStacktraces aggregates the sample values like
+// mergeByStacktraces, but multiplies them by the period factor of their
+// profile. It reads the whole profile rows to get their period.
+func mergeByNormalizedStacktraces(ctx context.Context, profileSource Source, rows iter.Iterator[Profile], m mapAdder, opts MergeStacktracesOptions) error {
+	var (
+		mem       = contextQueryMemory(ctx)
+		accounted = m.len()
+		memErr    error
+	)
+	err := readProfileRows(ctx, profileSource, rows, func(_ Profile, row *schemav1.Profile) {
+		if memErr != nil {
+			return
+		}
+		factor := opts.periodFactor(row.Period)
+		for _, s := range row.Samples {
+			m.add(int64(s.StacktraceID), s.Value*factor)
+		}
+		if n := m.len(); n > accounted {
+			memErr = mem.reserve(int64(n-accounted) * stacktraceSampleBytes)
+			accounted = n
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return memErr
+}
+
 type seriesByLabels map[string]*typesv1.Series
 
 func (m seriesByLabels) normalize() []*typesv1.Series {
@@ -426,6 +882,24 @@ func (m seriesByLabels) normalize() []*typesv1.Series {
 	return result
 }
 
+// profileTotals sums up the sample values of each profile, without reading
+// the stacktraces of the samples.
+func profileTotals(ctx context.Context, profileSource Source, rows iter.Iterator[Profile]) ([]ProfileWithTotal, error) {
+	it := repeatedColumnIter(ctx, profileSource, "Samples.list.element.Value", rows)
+	defer it.Close()
+
+	var result []ProfileWithTotal
+	for it.Next() {
+		values := it.At()
+		var total int64
+		for _, e := range values.Values {
+			total += e.Int64()
+		}
+		result = append(result, ProfileWithTotal{Profile: values.Row, Total: total})
+	}
+	return result, it.Err()
+}
+
 func mergeByLabels(ctx context.Context, profileSource Source, rows iter.Iterator[Profile], m seriesByLabels, by ...string) error {
 	it := repeatedColumnIter(ctx, profileSource, "Samples.list.element.Value", rows)
 
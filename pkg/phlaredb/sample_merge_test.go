@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -20,6 +21,7 @@ import (
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	"github.com/grafana/phlare/pkg/iter"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
 	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
 	"github.com/grafana/phlare/pkg/pprof"
 	pprofth "github.com/grafana/phlare/pkg/pprof/testhelper"
@@ -156,7 +158,7 @@ func TestMergeSampleByStacktraces(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			stacktraces, err := q.queriers[0].MergeByStacktraces(ctx, profiles)
+			stacktraces, err := q.queriers[0].MergeByStacktraces(ctx, profiles, MergeStacktracesOptions{})
 			require.NoError(t, err)
 			sort.Slice(tc.expected.Stacktraces, func(i, j int) bool {
 				return len(tc.expected.Stacktraces[i].FunctionIds) < len(tc.expected.Stacktraces[j].FunctionIds)
@@ -288,7 +290,7 @@ func TestHeadMergeSampleByStacktraces(t *testing.T) {
 				End:   int64(model.TimeFromUnixNano(int64(1 * time.Minute))),
 			})
 			require.NoError(t, err)
-			stacktraces, err := db.head.Queriers()[0].MergeByStacktraces(ctx, profiles)
+			stacktraces, err := db.head.Queriers()[0].MergeByStacktraces(ctx, profiles, MergeStacktracesOptions{})
 			require.NoError(t, err)
 
 			sort.Slice(tc.expected.Stacktraces, func(i, j int) bool {
@@ -302,6 +304,330 @@ func TestHeadMergeSampleByStacktraces(t *testing.T) {
 	}
 }
 
+// Each value of a multi-value sample is ingested as a profile of its own type, merges select the value
+// through the profile type.
+func TestMergeSampleByStacktracesMultipleValues(t *testing.T) {
+	testPath := t.TempDir()
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         testPath,
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+
+	// alloc values are cumulative, only the delta to the previous profile is kept.
+	for i := int64(1); i <= 2; i++ {
+		p := pprofth.NewProfileBuilder(i * int64(15*time.Second)).MemoryProfile()
+		p.ForStacktraceString("my", "other").AddSamples(i, i*10, 100, 1000)
+		p.ForStacktraceString("my", "other").AddSamples(i*2, i*20, 200, 2000)
+		p.ForStacktraceString("my", "other", "stack").AddSamples(i*3, i*30, 0, 0)
+		require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+
+	expected := map[string][]int64{
+		"memory:alloc_objects:count:space:bytes": {3, 3},
+		"memory:alloc_space:bytes:space:bytes":   {30, 30},
+		"memory:inuse_objects:count:space:bytes": {600},
+		"memory:inuse_space:bytes:space:bytes":   {6000},
+	}
+	merge := func(t *testing.T, queriers Queriers, profileType string) []int64 {
+		t.Helper()
+		profiles, err := queriers.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{}`,
+			Type:          mustParseProfileSelector(t, profileType),
+			Start:         int64(model.TimeFromUnixNano(0)),
+			End:           int64(model.TimeFromUnixNano(int64(1 * time.Minute))),
+		})
+		require.NoError(t, err)
+		stacktraces, err := queriers[0].MergeByStacktraces(ctx, profiles, MergeStacktracesOptions{})
+		require.NoError(t, err)
+		sort.Slice(stacktraces.Stacktraces, func(i, j int) bool {
+			return len(stacktraces.Stacktraces[i].FunctionIds) < len(stacktraces.Stacktraces[j].FunctionIds)
+		})
+		values := make([]int64, len(stacktraces.Stacktraces))
+		for i, s := range stacktraces.Stacktraces {
+			values[i] = s.Value
+		}
+		return values
+	}
+
+	for profileType, values := range expected {
+		require.Equal(t, values, merge(t, db.head.Queriers(), profileType), "head %s", profileType)
+	}
+
+	require.NoError(t, db.Flush(ctx))
+	b, err := filesystem.NewBucket(filepath.Join(testPath, pathLocal))
+	require.NoError(t, err)
+	q := NewBlockQuerier(ctx, b)
+	require.NoError(t, q.Sync(ctx))
+	for profileType, values := range expected {
+		require.Equal(t, values, merge(t, q.Queriers(), profileType), "block %s", profileType)
+	}
+}
+
+func TestMergeSampleByStacktracesGranularity(t *testing.T) {
+	// "other" is called from two different lines of "my".
+	p := pprofth.NewProfileBuilder(int64(15 * time.Second)).CPUProfile()
+	p.ForStacktraceString("other", "my").AddSamples(1)
+	p.ForStacktraceString("other", "my").AddSamples(2)
+	p.Location[1].Line[0].Line = 10
+	p.Location = append(p.Location, &googlev1.Location{
+		Id:        3,
+		MappingId: 1,
+		Line:      []*googlev1.Line{{FunctionId: p.Location[1].Line[0].FunctionId, Line: 20}},
+	})
+	p.Sample[1].LocationId = []uint64{1, 3}
+
+	testPath := t.TempDir()
+	db, err := New(context.Background(), Config{
+		DataPath:         testPath,
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+	req := &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{}`,
+		Type: &typesv1.ProfileType{
+			Name:       "process_cpu",
+			SampleType: "cpu",
+			SampleUnit: "nanoseconds",
+			PeriodType: "cpu",
+			PeriodUnit: "nanoseconds",
+		},
+		Start: int64(model.TimeFromUnixNano(0)),
+		End:   int64(model.TimeFromUnixNano(int64(1 * time.Minute))),
+	}
+
+	assertGranularity := func(t *testing.T, q Querier) {
+		t.Helper()
+		profiles, err := q.SelectMatchingProfiles(ctx, req)
+		require.NoError(t, err)
+		byFunction, err := q.MergeByStacktraces(ctx, profiles, MergeStacktracesOptions{})
+		require.NoError(t, err)
+		require.Empty(t, byFunction.Lines)
+		require.Equal(t, map[string]int64{"[other my]": 3}, flattenStacktraces(byFunction))
+
+		profiles, err = q.SelectMatchingProfiles(ctx, req)
+		require.NoError(t, err)
+		byLine, err := q.MergeByStacktraces(ctx, profiles, MergeStacktracesOptions{
+			Granularity: ingestv1.StacktraceGranularity_STACKTRACE_GRANULARITY_LINE,
+		})
+		require.NoError(t, err)
+		require.Equal(t, len(byLine.FunctionNames), len(byLine.Lines))
+		require.Equal(t, map[string]int64{
+			"[other:0 my:10]": 1,
+			"[other:0 my:20]": 2,
+		}, flattenStacktraces(byLine))
+	}
+
+	t.Run("head", func(t *testing.T) {
+		assertGranularity(t, db.head.Queriers()[0])
+	})
+
+	t.Run("block", func(t *testing.T) {
+		require.NoError(t, db.Flush(ctx))
+		b, err := filesystem.NewBucket(filepath.Join(testPath, pathLocal))
+		require.NoError(t, err)
+		q := NewBlockQuerier(ctx, b)
+		require.NoError(t, q.Sync(ctx))
+		assertGranularity(t, q.queriers[0])
+	})
+}
+
+// flattenStacktraces returns the values of the result by their frames,
+// distinct stacktraces resolving to the same frames are summed up.
+func flattenStacktraces(r *ingestv1.MergeProfilesStacktracesResult) map[string]int64 {
+	res := map[string]int64{}
+	for _, s := range r.Stacktraces {
+		frames := make([]string, 0, len(s.FunctionIds))
+		for _, id := range s.FunctionIds {
+			frame := r.FunctionNames[id]
+			if len(r.Lines) > 0 {
+				frame = fmt.Sprintf("%s:%d", frame, r.Lines[id])
+			}
+			frames = append(frames, frame)
+		}
+		res[fmt.Sprint(frames)] += s.Value
+	}
+	return res
+}
+
+func TestMergeSampleByStacktracesSplitBySampleLabel(t *testing.T) {
+	a := pprofth.NewProfileBuilder(int64(15 * time.Second)).CPUProfile()
+	a.ForStacktraceString("other", "my").WithSampleLabels("endpoint", "/foo").AddSamples(1)
+	a.ForStacktraceString("other", "my").WithSampleLabels("endpoint", "/bar", "span_id", "1").AddSamples(2)
+	a.ForStacktraceString("other", "my").AddSamples(4)
+
+	// the series label endpoint collides with the sample label
+	b := pprofth.NewProfileBuilder(int64(15*time.Second)).CPUProfile().WithLabels("endpoint", "/series")
+	b.ForStacktraceString("other", "my").WithSampleLabels("endpoint", "/foo").AddSamples(8)
+	b.ForStacktraceString("other", "my").AddSamples(16)
+
+	testPath := t.TempDir()
+	db, err := New(context.Background(), Config{
+		DataPath:         testPath,
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	ctx := context.Background()
+	// cut a row group after each profile, to query the head on disk as well
+	db.head.profiles.cfg = &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 1}
+	for _, p := range []*pprofth.ProfileBuilder{a, b} {
+		require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+
+	req := &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{}`,
+		Type: &typesv1.ProfileType{
+			Name:       "process_cpu",
+			SampleType: "cpu",
+			SampleUnit: "nanoseconds",
+			PeriodType: "cpu",
+			PeriodUnit: "nanoseconds",
+		},
+		Start: int64(model.TimeFromUnixNano(0)),
+		End:   int64(model.TimeFromUnixNano(int64(1 * time.Minute))),
+	}
+
+	assertSplit := func(t *testing.T, queriers Queriers) {
+		t.Helper()
+		merge := func(opts MergeStacktracesOptions) *ingestv1.MergeProfilesStacktracesResult {
+			var results []*ingestv1.MergeProfilesStacktracesResult
+			for _, q := range queriers {
+				profiles, err := q.SelectMatchingProfiles(ctx, req)
+				require.NoError(t, err)
+				profs, err := iter.Slice(profiles)
+				require.NoError(t, err)
+				result, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(q.Sort(profs)), opts)
+				require.NoError(t, err)
+				results = append(results, result)
+			}
+			return phlaremodel.MergeBatchMergeStacktraces(results...)
+		}
+
+		require.Equal(t, map[string]int64{"[other my]": 31}, flattenStacktraces(merge(MergeStacktracesOptions{})))
+		require.Equal(t, map[string]int64{
+			"[other my]":                  4,
+			"[other my endpoint=/foo]":    9,
+			"[other my endpoint=/bar]":    2,
+			"[other my endpoint=/series]": 16,
+		}, flattenStacktraces(merge(MergeStacktracesOptions{SplitBySampleLabel: "endpoint"})))
+		require.Equal(t, map[string]int64{
+			"[other:0 my:0]":                    4,
+			"[other:0 my:0 endpoint=/foo:0]":    9,
+			"[other:0 my:0 endpoint=/bar:0]":    2,
+			"[other:0 my:0 endpoint=/series:0]": 16,
+		}, flattenStacktraces(merge(MergeStacktracesOptions{
+			SplitBySampleLabel: "endpoint",
+			Granularity:        ingestv1.StacktraceGranularity_STACKTRACE_GRANULARITY_LINE,
+		})))
+		require.Equal(t, map[string]int64{
+			"[other my]":           29,
+			"[other my span_id=1]": 2,
+		}, flattenStacktraces(merge(MergeStacktracesOptions{SplitBySampleLabel: "span_id"})))
+		require.Equal(t, map[string]int64{"[other my]": 31}, flattenStacktraces(merge(MergeStacktracesOptions{SplitBySampleLabel: "unknown"})))
+	}
+
+	t.Run("head", func(t *testing.T) {
+		queriers := db.head.Queriers()
+		require.Len(t, queriers, 2)
+		assertSplit(t, queriers)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		require.NoError(t, db.Flush(ctx))
+		bucket, err := filesystem.NewBucket(filepath.Join(testPath, pathLocal))
+		require.NoError(t, err)
+		q := NewBlockQuerier(ctx, bucket)
+		require.NoError(t, q.Sync(ctx))
+		assertSplit(t, q.Queriers())
+	})
+}
+
+func TestMergePprofBySampleLabel(t *testing.T) {
+	a := pprofth.NewProfileBuilder(int64(15 * time.Second)).CPUProfile()
+	a.ForStacktraceString("handler", "main").WithSampleLabels("trace_id", "1234").AddSamples(1)
+	a.ForStacktraceString("db", "main").WithSampleLabels("trace_id", "5678").AddSamples(2)
+	a.ForStacktraceString("gc", "main").AddSamples(4)
+
+	// another series contributes to the same trace
+	b := pprofth.NewProfileBuilder(int64(15*time.Second)).CPUProfile().WithLabels("service", "backend")
+	b.ForStacktraceString("handler", "main").WithSampleLabels("trace_id", "1234", "span_id", "1").AddSamples(8)
+	b.ForStacktraceString("db", "main").WithSampleLabels("span_id", "2").AddSamples(16)
+
+	testPath := t.TempDir()
+	db, err := New(context.Background(), Config{
+		DataPath:         testPath,
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	ctx := context.Background()
+	// cut a row group after each profile, to query the head on disk as well
+	db.head.profiles.cfg = &ParquetConfig{MaxRowGroupBytes: 128000, MaxBufferRowCount: 1}
+	for _, p := range []*pprofth.ProfileBuilder{a, b} {
+		require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	}
+
+	req := &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{}`,
+		Type: &typesv1.ProfileType{
+			Name:       "process_cpu",
+			SampleType: "cpu",
+			SampleUnit: "nanoseconds",
+			PeriodType: "cpu",
+			PeriodUnit: "nanoseconds",
+		},
+		Start: int64(model.TimeFromUnixNano(0)),
+		End:   int64(model.TimeFromUnixNano(int64(1 * time.Minute))),
+	}
+
+	assertFiltered := func(t *testing.T, queriers Queriers) {
+		t.Helper()
+		merge := func(opts MergePprofOptions) map[string]int64 {
+			values := map[string]int64{}
+			for _, q := range queriers {
+				profiles, err := q.SelectMatchingProfiles(ctx, req)
+				require.NoError(t, err)
+				profs, err := iter.Slice(profiles)
+				require.NoError(t, err)
+				result, err := q.MergePprof(ctx, iter.NewSliceIterator(q.Sort(profs)), opts)
+				require.NoError(t, err)
+				for _, s := range result.Sample {
+					var stack []string
+					for _, loc := range s.Location {
+						stack = append(stack, loc.Line[0].Function.Name)
+					}
+					values[strings.Join(stack, " ")] += s.Value[0]
+				}
+			}
+			return values
+		}
+
+		require.Equal(t, map[string]int64{"handler main": 9, "db main": 18, "gc main": 4}, merge(MergePprofOptions{}))
+		require.Equal(t, map[string]int64{"handler main": 9}, merge(MergePprofOptions{SampleLabel: &typesv1.LabelPair{Name: "trace_id", Value: "1234"}}))
+		require.Equal(t, map[string]int64{"db main": 2}, merge(MergePprofOptions{SampleLabel: &typesv1.LabelPair{Name: "trace_id", Value: "5678"}}))
+		require.Empty(t, merge(MergePprofOptions{SampleLabel: &typesv1.LabelPair{Name: "trace_id", Value: "0000"}}))
+		require.Empty(t, merge(MergePprofOptions{SampleLabel: &typesv1.LabelPair{Name: "unknown", Value: "1234"}}))
+	}
+
+	t.Run("head", func(t *testing.T) {
+		queriers := db.head.Queriers()
+		require.Len(t, queriers, 2)
+		assertFiltered(t, queriers)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		require.NoError(t, db.Flush(ctx))
+		bucket, err := filesystem.NewBucket(filepath.Join(testPath, pathLocal))
+		require.NoError(t, err)
+		q := NewBlockQuerier(ctx, bucket)
+		require.NoError(t, q.Sync(ctx))
+		assertFiltered(t, q.Queriers())
+	})
+}
+
 func TestMergeSampleByLabels(t *testing.T) {
 	for _, tc := range []struct {
 		name     string
@@ -585,7 +911,7 @@ func TestMergePprof(t *testing.T) {
 	require.NoError(t, err)
 
 	q.queriers[0].Sort(profiles)
-	result, err := q.queriers[0].MergePprof(ctx, iter.NewSliceIterator(profiles))
+	result, err := q.queriers[0].MergePprof(ctx, iter.NewSliceIterator(profiles), MergePprofOptions{})
 	require.NoError(t, err)
 
 	data, err := proto.Marshal(generateProfile(t))
@@ -631,7 +957,7 @@ func TestHeadMergePprof(t *testing.T) {
 	require.NoError(t, err)
 
 	db.Head().Sort(profiles)
-	result, err := db.Head().Queriers()[0].MergePprof(ctx, iter.NewSliceIterator(profiles))
+	result, err := db.Head().Queriers()[0].MergePprof(ctx, iter.NewSliceIterator(profiles), MergePprofOptions{})
 	require.NoError(t, err)
 
 	data, err := proto.Marshal(generateProfile(t))
@@ -37,9 +37,12 @@ var (
 )
 
 type Sample struct {
-	StacktraceID uint64             `parquet:",delta"`
-	Value        int64              `parquet:",delta"`
-	Labels       []*profilev1.Label `parquet:",list"`
+	StacktraceID uint64 `parquet:",delta"`
+	// Value is an integer like the sample values of pprof profiles, which
+	// have no floating point values. Fractional values are stored in a
+	// smaller unit of the sample type, e.g. nanoseconds of CPU time.
+	Value  int64              `parquet:",delta"`
+	Labels []*profilev1.Label `parquet:",list"`
 }
 
 type Profile struct {
@@ -53,7 +56,9 @@ type Profile struct {
 
 	// SeriesFingerprint references the underlying series and is purely based
 	// on the label values. The value is consistent for the same label set (so
-	// also between different blocks).
+	// also between different blocks). It is not persisted: the labels of the
+	// series are only stored in the TSDB index, which can't be rebuilt from
+	// the profiles alone.
 	SeriesFingerprint model.Fingerprint `parquet:"-"`
 
 	// The set of samples recorded in this profile.
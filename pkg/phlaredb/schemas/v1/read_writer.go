@@ -53,9 +53,14 @@ func (*ReadWriter[T, P]) ReadParquetFile(file io.ReaderAt) ([]T, error) {
 	)
 	defer reader.Close()
 
+	// rows are read up to the end of a row group at a time
 	rows := make([]parquet.Row, reader.NumRows())
-	if _, err := reader.ReadRows(rows); err != nil {
-		return nil, err
+	for read := 0; read < len(rows); {
+		n, err := reader.ReadRows(rows[read:])
+		read += n
+		if err != nil && (err != io.EOF || read < len(rows)) {
+			return nil, err
+		}
 	}
 
 	var (
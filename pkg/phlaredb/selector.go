@@ -0,0 +1,69 @@
+package phlaredb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// selectorMatchers returns the matchers of the label selector of the request
+// along with the matcher of its profile type.
+//
+// The profile type is selected by the Type of the request or by the label
+// selector, either with a __profile_type__ matcher or with a __name__ matcher
+// holding a profile type ID, e.g. {__name__="process_cpu:cpu:nanoseconds:cpu:nanoseconds"}
+// or process_cpu:cpu:nanoseconds:cpu:nanoseconds{}. This shorthand is
+// resolved to a __profile_type__ matcher, while a __name__ matcher without
+// colons matches the name of the profile type. If both are given, the Type of
+// the request takes precedence and the matchers of the selector must not
+// conflict with it.
+func selectorMatchers(params *ingestv1.SelectProfilesRequest) ([]*labels.Matcher, error) {
+	matchers, err := parser.ParseMetricSelector(params.LabelSelector)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("%w: %v", ErrInvalidLabelSelector, err))
+	}
+	for i, m := range matchers {
+		if m.Name != model.MetricNameLabel || m.Type != labels.MatchEqual || !strings.Contains(m.Value, ":") {
+			continue
+		}
+		profileType, err := phlaremodel.ParseProfileTypeSelector(m.Value)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("%w: %v", ErrInvalidLabelSelector, err))
+		}
+		matchers[i] = phlaremodel.SelectorFromProfileType(profileType)
+	}
+
+	typeMatcher := phlaremodel.SelectorFromProfileType(params.Type)
+	if typeMatcher == nil {
+		return matchers, nil
+	}
+	for _, m := range matchers {
+		if conflictsWithProfileType(m, params.Type.Name, typeMatcher) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("%w: matcher %s conflicts with the profile type %s of the request", ErrInvalidLabelSelector, m, typeMatcher))
+		}
+	}
+	return append(matchers, typeMatcher), nil
+}
+
+// conflictsWithProfileType returns true if no series selected by the profile
+// type can match m. Only conflicts detectable without the index are reported,
+// e.g. regular expressions matching distinct profile types aren't compared.
+func conflictsWithProfileType(m *labels.Matcher, name string, typeMatcher *labels.Matcher) bool {
+	switch m.Name {
+	case phlaremodel.LabelNameProfileType:
+		if m.Type == labels.MatchEqual && !typeMatcher.Matches(m.Value) {
+			return true
+		}
+		return typeMatcher.Type == labels.MatchEqual && !m.Matches(typeMatcher.Value)
+	case model.MetricNameLabel:
+		return name != "" && !m.Matches(name)
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package phlaredb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+func TestSelectorMatchers_ProfileType(t *testing.T) {
+	ctx := testContext(t)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// the profiles are spread across a block and the head
+	for i := 0; i < 6; i++ {
+		require.NoError(t, ingestThreeProfileStreams(ctx, i, db.Head().Ingest))
+		if i == 2 {
+			require.NoError(t, db.Flush(ctx))
+		}
+	}
+
+	count := func(selector string, profileType *typesv1.ProfileType) (uint64, error) {
+		c, err := db.CountMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: selector,
+			Type:          profileType,
+			Start:         0,
+			End:           int64(model.TimeFromUnixNano(int64(time.Hour))),
+		})
+		return c.Profiles, err
+	}
+	cpu := mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds")
+
+	for _, tc := range []struct {
+		name        string
+		selector    string
+		profileType *typesv1.ProfileType
+		expected    uint64
+	}{
+		{name: "type only", selector: `{}`, profileType: cpu, expected: 6},
+		{name: "agreeing profile type matcher", selector: `{__profile_type__="process_cpu:cpu:nanoseconds:cpu:nanoseconds"}`, profileType: cpu, expected: 6},
+		{name: "agreeing name matcher", selector: `{__name__="process_cpu", stream="stream-a"}`, profileType: cpu, expected: 2},
+		{name: "shorthand", selector: `process_cpu:cpu:nanoseconds:cpu:nanoseconds{stream="stream-a"}`, expected: 2},
+		{name: "shorthand agreeing with the type", selector: `{__name__="process_cpu:cpu:nanoseconds:cpu:nanoseconds"}`, profileType: cpu, expected: 6},
+		{name: "shorthand of another profile type", selector: `memory:alloc_space:bytes:space:bytes{}`, expected: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := count(tc.selector, tc.profileType)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, n)
+		})
+	}
+
+	for _, selector := range []string{
+		`{__profile_type__="memory:alloc_space:bytes:space:bytes"}`,
+		`{__name__="memory"}`,
+		`memory:alloc_space:bytes:space:bytes{}`,
+	} {
+		t.Run("conflict "+selector, func(t *testing.T) {
+			_, err := count(selector, cpu)
+			require.ErrorIs(t, err, ErrInvalidLabelSelector)
+			require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+			require.ErrorContains(t, err, "conflicts with the profile type")
+		})
+	}
+
+	// the shorthand needs a valid profile type ID
+	_, err = count(`{__name__="process_cpu:cpu"}`, nil)
+	require.ErrorIs(t, err, ErrInvalidLabelSelector)
+}
@@ -56,6 +56,10 @@ const (
 
 	// store every 1024 series' fingerprints in the fingerprint offsets table
 	fingerprintInterval = 1 << 10
+
+	// defaultPostingsBatchSize is the number of postings collected in memory
+	// before they are written to the temporary postings file.
+	defaultPostingsBatchSize = 1 << 18
 )
 
 type indexWriterStage uint8
@@ -142,6 +146,10 @@ type Writer struct {
 
 	crc32 hash.Hash
 
+	// Maximum number of postings held in memory while writing them, a label
+	// name used by more series is still written in a single batch.
+	postingsBatchSize uint64
+
 	Version int
 }
 
@@ -253,6 +261,8 @@ func NewWriter(ctx context.Context, fn string) (*Writer, error) {
 		symbolCache: make(map[string]symbolCacheEntry, 1<<8),
 		labelNames:  make(map[string]uint64, 1<<8),
 		crc32:       newCRC32(),
+
+		postingsBatchSize: defaultPostingsBatchSize,
 	}
 	if err := iw.writeMeta(); err != nil {
 		return nil, err
@@ -933,15 +943,18 @@ func (w *Writer) writePostingsToTmpFiles() error {
 	if err := w.writePosting("", "", offsets); err != nil {
 		return err
 	}
-	maxPostings := uint64(len(offsets)) // No label name can have more postings than this.
 
+	var (
+		entries postingEntries
+		offs    []uint32
+	)
 	for len(names) > 0 {
 		batchNames := []string{}
 		var c uint64
 		// Try to bunch up label names into one loop, but avoid
-		// using more memory than a single label name can.
+		// holding more than a batch of postings in memory.
 		for len(names) > 0 {
-			if w.labelNames[names[0]]+c > maxPostings {
+			if len(batchNames) > 0 && w.labelNames[names[0]]+c > w.postingsBatchSize {
 				break
 			}
 			batchNames = append(batchNames, names[0])
@@ -957,8 +970,10 @@ func (w *Writer) writePostingsToTmpFiles() error {
 			}
 			nameSymbols[sid] = name
 		}
-		// Label name -> label value -> positions.
-		postings := map[uint32]map[uint32][]uint32{}
+		if uint64(cap(entries)) < c {
+			entries = make(postingEntries, 0, c)
+		}
+		entries = entries[:0]
 
 		d := encoding.DecWrap(tsdb_enc.NewDecbufRaw(RealByteSlice(f.Bytes()), int(w.toc.LabelIndices)))
 		d.Skip(int(w.toc.Series))
@@ -976,10 +991,7 @@ func (w *Writer) writePostingsToTmpFiles() error {
 				lvo := uint32(d.Uvarint())
 
 				if _, ok := nameSymbols[lno]; ok {
-					if _, ok := postings[lno]; !ok {
-						postings[lno] = map[uint32][]uint32{}
-					}
-					postings[lno][lvo] = append(postings[lno][lvo], uint32(startPos/16))
+					entries = append(entries, postingEntry{name: lno, value: lvo, ref: uint32(startPos / 16)})
 				}
 			}
 			// Skip to next series.
@@ -989,27 +1001,22 @@ func (w *Writer) writePostingsToTmpFiles() error {
 			}
 		}
 
-		for _, name := range batchNames {
-			// Write out postings for this label name.
-			sid, err := w.symbols.ReverseLookup(name)
+		// Symbol numbers are in order, so the names and values will also be in order.
+		sort.Sort(entries)
+		for i := 0; i < len(entries); {
+			offs = offs[:0]
+			j := i
+			for ; j < len(entries) && entries[j].name == entries[i].name && entries[j].value == entries[i].value; j++ {
+				offs = append(offs, entries[j].ref)
+			}
+			value, err := w.symbols.Lookup(entries[i].value)
 			if err != nil {
 				return err
 			}
-			values := make([]uint32, 0, len(postings[sid]))
-			for v := range postings[sid] {
-				values = append(values, v)
-			}
-			// Symbol numbers are in order, so the strings will also be in order.
-			sort.Sort(uint32slice(values))
-			for _, v := range values {
-				value, err := w.symbols.Lookup(v)
-				if err != nil {
-					return err
-				}
-				if err := w.writePosting(name, value, postings[sid][v]); err != nil {
-					return err
-				}
+			if err := w.writePosting(nameSymbols[entries[i].name], value, offs); err != nil {
+				return err
 			}
+			i = j
 		}
 		select {
 		case <-w.ctx.Done():
@@ -1021,6 +1028,25 @@ func (w *Writer) writePostingsToTmpFiles() error {
 	return nil
 }
 
+// postingEntry is a single series reference of the postings of a label pair.
+type postingEntry struct {
+	name, value, ref uint32
+}
+
+type postingEntries []postingEntry
+
+func (p postingEntries) Len() int      { return len(p) }
+func (p postingEntries) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p postingEntries) Less(i, j int) bool {
+	if p[i].name != p[j].name {
+		return p[i].name < p[j].name
+	}
+	if p[i].value != p[j].value {
+		return p[i].value < p[j].value
+	}
+	return p[i].ref < p[j].ref
+}
+
 func (w *Writer) writePosting(name, value string, offs []uint32) error {
 	// Align beginning to 4 bytes for more efficient postings list scans.
 	if err := w.fP.AddPadding(4); err != nil {
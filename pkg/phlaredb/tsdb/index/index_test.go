@@ -17,6 +17,7 @@ import (
 	"context"
 	"fmt"
 	"hash/crc32"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -500,6 +501,121 @@ func TestPersistence_index_e2e(t *testing.T) {
 	require.NoError(t, ir.Close())
 }
 
+func writeTestIndex(t testing.TB, dir string, series []phlaremodel.Labels, postingsBatchSize uint64) string {
+	fn := filepath.Join(dir, fmt.Sprintf("%s-%d", IndexFilename, postingsBatchSize))
+	iw, err := NewWriter(context.Background(), fn)
+	require.NoError(t, err)
+	iw.postingsBatchSize = postingsBatchSize
+
+	symbols := map[string]struct{}{}
+	for _, lset := range series {
+		for _, l := range lset {
+			symbols[l.Name] = struct{}{}
+			symbols[l.Value] = struct{}{}
+		}
+	}
+	syms := make([]string, 0, len(symbols))
+	for s := range symbols {
+		syms = append(syms, s)
+	}
+	sort.Strings(syms)
+	for _, s := range syms {
+		require.NoError(t, iw.AddSymbol(s))
+	}
+	for i, lset := range series {
+		require.NoError(t, iw.AddSeries(storage.SeriesRef(i), lset, model.Fingerprint(lset.Hash()), ChunkMeta{
+			MinTime:     int64(i),
+			MaxTime:     int64(i + 1),
+			SeriesIndex: uint32(i),
+		}))
+	}
+	require.NoError(t, iw.Close())
+	return fn
+}
+
+func TestWriterPostingsBatches(t *testing.T) {
+	dir := t.TempDir()
+
+	lbls, err := labels.ReadLabels(filepath.Join("..", "testdata", "20kseries.json"), 20000)
+	require.NoError(t, err)
+	series := make([]phlaremodel.Labels, len(lbls))
+	for i, ls := range lbls {
+		for _, l := range ls {
+			series[i] = append(series[i], &typesv1.LabelPair{Name: l.Name, Value: l.Value})
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(series[i], series[j]) < 0
+	})
+
+	// Writing all postings in a single batch is the same as holding them all in memory.
+	expected, err := os.ReadFile(writeTestIndex(t, dir, series, math.MaxUint64))
+	require.NoError(t, err)
+
+	for _, batchSize := range []uint64{1, 1000, defaultPostingsBatchSize} {
+		t.Run(fmt.Sprintf("batch size %d", batchSize), func(t *testing.T) {
+			actual, err := os.ReadFile(writeTestIndex(t, dir, series, batchSize))
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+
+	// the postings reference the series with the expected series index.
+	ir, err := NewFileReader(filepath.Join(dir, fmt.Sprintf("%s-%d", IndexFilename, 1)))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ir.Close()) }()
+	for _, name := range []string{"__name__", "instance", "job"} {
+		values, err := ir.SortedLabelValues(name)
+		require.NoError(t, err)
+		for _, value := range values {
+			p, err := ir.Postings(name, nil, value)
+			require.NoError(t, err)
+			var (
+				lset   phlaremodel.Labels
+				chunks []ChunkMeta
+			)
+			for p.Next() {
+				_, err := ir.Series(p.At(), &lset, &chunks)
+				require.NoError(t, err)
+				require.Equal(t, value, lset.Get(name))
+				require.Equal(t, series[chunks[0].SeriesIndex], lset)
+			}
+			require.NoError(t, p.Err())
+		}
+	}
+}
+
+func BenchmarkWriterManySeries(b *testing.B) {
+	series := make([]phlaremodel.Labels, 200000)
+	for i := range series {
+		series[i] = phlaremodel.LabelsFromStrings(
+			"__name__", "process_cpu",
+			"instance", fmt.Sprintf("instance-%d", i%100),
+			"job", "bench",
+			"pod", fmt.Sprintf("pod-%07d", i),
+		)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(series[i], series[j]) < 0
+	})
+
+	for _, bc := range []struct {
+		name      string
+		batchSize uint64
+	}{
+		{name: "unbounded", batchSize: math.MaxUint64},
+		{name: "default", batchSize: defaultPostingsBatchSize},
+		{name: "small", batchSize: 1 << 14},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				writeTestIndex(b, b.TempDir(), series, bc.batchSize)
+			}
+		})
+	}
+}
+
 func TestDecbufUvarintWithInvalidBuffer(t *testing.T) {
 	b := RealByteSlice([]byte{0x81, 0x81, 0x81, 0x81, 0x81, 0x81})
 
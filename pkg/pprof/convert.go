@@ -0,0 +1,269 @@
+package pprof
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+	"github.com/prometheus/common/model"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+// ConvertedProfile is the profile of a single sample type converted into
+// the phlare schema.
+type ConvertedProfile struct {
+	// Profile has no ID set, it is up to the caller to assign one.
+	Profile *schemav1.Profile
+	// Labels are the series labels of the profile, their hash is the
+	// SeriesFingerprint of the profile.
+	Labels phlaremodel.Labels
+	// Symbols holds the string table, mappings, functions and locations
+	// referenced by the profile. It is shared by all profiles converted
+	// from the same pprof profile.
+	Symbols *profilev1.Profile
+	// Stacktraces are referenced by index by the StacktraceID of the
+	// samples. They are shared by all profiles converted from the same
+	// pprof profile.
+	Stacktraces []*schemav1.Stacktrace
+}
+
+// ToPhlareProfiles converts a pprof profile into one profile per sample
+// type, labelled the same way as profiles ingested by the head. Samples
+// with a zero value are dropped and duplicate samples are aggregated.
+func ToPhlareProfiles(p *profile.Profile, extraLabels phlaremodel.Labels) ([]ConvertedProfile, error) {
+	symbols, err := FromProfile(p)
+	if err != nil {
+		return nil, err
+	}
+	labels, seriesFingerprints := LabelsForProfile(symbols, extraLabels...)
+
+	var (
+		stacktraces   []*schemav1.Stacktrace
+		stacktraceIDs = make(map[string]uint64)
+		sampleIDs     = make([]uint64, len(symbols.Sample))
+		key           []byte
+	)
+	for i, s := range symbols.Sample {
+		key = key[:0]
+		for _, loc := range s.LocationId {
+			key = binary.LittleEndian.AppendUint64(key, loc)
+		}
+		id, ok := stacktraceIDs[string(key)]
+		if !ok {
+			id = uint64(len(stacktraces))
+			stacktraceIDs[string(key)] = id
+			stacktraces = append(stacktraces, &schemav1.Stacktrace{LocationIDs: s.LocationId})
+		}
+		sampleIDs[i] = id
+	}
+
+	result := make([]ConvertedProfile, len(symbols.SampleType))
+	for idxType := range symbols.SampleType {
+		samples := make([]*schemav1.Sample, 0, len(symbols.Sample))
+		for i, s := range symbols.Sample {
+			if s.Value[idxType] == 0 {
+				continue
+			}
+			samples = append(samples, &schemav1.Sample{
+				StacktraceID: sampleIDs[i],
+				Value:        s.Value[idxType],
+				Labels:       s.Label,
+			})
+		}
+		result[idxType] = ConvertedProfile{
+			Profile: &schemav1.Profile{
+				ID:                uuid.Nil,
+				SeriesFingerprint: seriesFingerprints[idxType],
+				Samples:           aggregateSamples(samples),
+				DropFrames:        symbols.DropFrames,
+				KeepFrames:        symbols.KeepFrames,
+				TimeNanos:         symbols.TimeNanos,
+				DurationNanos:     symbols.DurationNanos,
+				Period:            symbols.Period,
+				Comments:          symbols.Comment,
+				DefaultSampleType: symbols.DefaultSampleType,
+			},
+			Labels:      labels[idxType],
+			Symbols:     symbols,
+			Stacktraces: stacktraces,
+		}
+	}
+	return result, nil
+}
+
+// aggregateSamples sorts the samples by stacktrace ID and sums up the values
+// of samples with the same stacktrace ID and labels.
+func aggregateSamples(samples []*schemav1.Sample) []*schemav1.Sample {
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].StacktraceID < samples[j].StacktraceID
+	})
+	out := samples[:0]
+	for _, s := range samples {
+		if n := len(out); n > 0 && out[n-1].StacktraceID == s.StacktraceID && equalSampleLabels(out[n-1].Labels, s.Labels) {
+			out[n-1].Value += s.Value
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func equalSampleLabels(a, b []*profilev1.Label) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].Str != b[i].Str || a[i].Num != b[i].Num || a[i].NumUnit != b[i].NumUnit {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelsForProfile returns the series labels and fingerprints of each sample
+// type of the profile.
+func LabelsForProfile(p *profilev1.Profile, externalLabels ...*typesv1.LabelPair) ([]phlaremodel.Labels, []model.Fingerprint) {
+	// build label set per sample type before references are rewritten
+	var (
+		sb                                             strings.Builder
+		lbls                                           = phlaremodel.NewLabelsBuilder(externalLabels)
+		sampleType, sampleUnit, periodType, periodUnit string
+		metricName                                     = phlaremodel.Labels(externalLabels).Get(model.MetricNameLabel)
+	)
+
+	periodTypes := samplePeriodTypes(p)
+
+	profilesLabels := make([]phlaremodel.Labels, len(p.SampleType))
+	seriesRefs := make([]model.Fingerprint, len(p.SampleType))
+	for pos := range p.SampleType {
+		sampleType = p.StringTable[p.SampleType[pos].Type]
+		lbls.Set(phlaremodel.LabelNameType, sampleType)
+		sampleUnit = p.StringTable[p.SampleType[pos].Unit]
+		lbls.Set(phlaremodel.LabelNameUnit, sampleUnit)
+		periodType, periodUnit = periodTypes(sampleType)
+		lbls.Set(phlaremodel.LabelNamePeriodType, periodType)
+		lbls.Set(phlaremodel.LabelNamePeriodUnit, periodUnit)
+
+		sb.Reset()
+		_, _ = sb.WriteString(metricName)
+		_, _ = sb.WriteRune(':')
+		_, _ = sb.WriteString(sampleType)
+		_, _ = sb.WriteRune(':')
+		_, _ = sb.WriteString(sampleUnit)
+		_, _ = sb.WriteRune(':')
+		_, _ = sb.WriteString(periodType)
+		_, _ = sb.WriteRune(':')
+		_, _ = sb.WriteString(periodUnit)
+		t := sb.String()
+		lbls.Set(phlaremodel.LabelNameProfileType, t)
+		lbs := lbls.Labels().Clone()
+		profilesLabels[pos] = lbs
+		seriesRefs[pos] = model.Fingerprint(lbs.Hash())
+
+	}
+	return profilesLabels, seriesRefs
+}
+
+// ProfileTypeInferenceError is returned by InferMetricName, when the sample
+// types of a profile don't tell its profile type.
+type ProfileTypeInferenceError struct {
+	// SampleTypes are the sample types of the profile as "type:unit".
+	SampleTypes []string
+	Reason      string
+}
+
+func (e *ProfileTypeInferenceError) Error() string {
+	return fmt.Sprintf("unable to infer the profile type of sample types [%s]: %s", strings.Join(e.SampleTypes, ", "), e.Reason)
+}
+
+// metricNamesBySampleType maps the sample types of the profiles of the Go
+// runtime to their metric name.
+var metricNamesBySampleType = map[string]string{
+	"samples":       "process_cpu",
+	"cpu":           "process_cpu",
+	"alloc_objects": "memory",
+	"alloc_space":   "memory",
+	"inuse_objects": "memory",
+	"inuse_space":   "memory",
+	"goroutine":     "goroutine",
+}
+
+// InferMetricName returns the metric name of a profile sent without one,
+// which is the first part of its profile type, e.g. "process_cpu" for the
+// profile type "process_cpu:cpu:nanoseconds:cpu:nanoseconds". It is inferred
+// from the sample types of the profiles of the Go runtime, profiles of other
+// sample types have no inferred metric name. Contention profiles are
+// ambiguous, as the mutex and block profiles share their sample types.
+func InferMetricName(p *profilev1.Profile) (string, error) {
+	sampleTypes := make([]string, 0, len(p.SampleType))
+	for _, st := range p.SampleType {
+		sampleTypes = append(sampleTypes, p.StringTable[st.Type]+":"+p.StringTable[st.Unit])
+	}
+
+	var metricName string
+	for _, st := range p.SampleType {
+		sampleType := p.StringTable[st.Type]
+		if sampleType == "contentions" || sampleType == "delay" {
+			return "", &ProfileTypeInferenceError{SampleTypes: sampleTypes, Reason: "the sample types are shared by mutex and block profiles, the metric name is required"}
+		}
+		name, ok := metricNamesBySampleType[sampleType]
+		if !ok {
+			return "", nil
+		}
+		if metricName != "" && name != metricName {
+			return "", &ProfileTypeInferenceError{SampleTypes: sampleTypes, Reason: fmt.Sprintf("the sample types belong to %s and %s profiles", metricName, name)}
+		}
+		metricName = name
+	}
+	return metricName, nil
+}
+
+// PeriodTypeCommentPrefix starts the comments of a pprof profile, which
+// override its period type for a sample type, e.g.
+// "period_type: alloc_space space:bytes". pprof profiles hold a single period
+// type, tools emitting sample types of different period types in a single
+// profile annotate the others this way.
+const PeriodTypeCommentPrefix = "period_type:"
+
+// samplePeriodTypes returns a function returning the period type and unit of a
+// sample type of the profile. Sample types without an override in the
+// comments have the period type of the profile.
+func samplePeriodTypes(p *profilev1.Profile) func(sampleType string) (periodType, periodUnit string) {
+	var defaultType, defaultUnit string
+	if p.PeriodType != nil {
+		defaultType = p.StringTable[p.PeriodType.Type]
+		defaultUnit = p.StringTable[p.PeriodType.Unit]
+	}
+	var overrides map[string][2]string
+	for _, c := range p.Comment {
+		comment := p.StringTable[c]
+		if !strings.HasPrefix(comment, PeriodTypeCommentPrefix) {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(comment, PeriodTypeCommentPrefix))
+		if len(fields) != 2 {
+			continue
+		}
+		periodType, periodUnit, ok := strings.Cut(fields[1], ":")
+		if !ok || periodType == "" || periodUnit == "" {
+			continue
+		}
+		if overrides == nil {
+			overrides = make(map[string][2]string)
+		}
+		overrides[fields[0]] = [2]string{periodType, periodUnit}
+	}
+	return func(sampleType string) (string, string) {
+		if o, ok := overrides[sampleType]; ok {
+			return o[0], o[1]
+		}
+		return defaultType, defaultUnit
+	}
+}
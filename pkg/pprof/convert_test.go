@@ -0,0 +1,134 @@
+package pprof
+
+import (
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+func TestToPhlareProfiles(t *testing.T) {
+	var (
+		fnA  = &profile.Function{ID: 1, Name: "a"}
+		fnB  = &profile.Function{ID: 2, Name: "b"}
+		locA = &profile.Location{ID: 1, Line: []profile.Line{{Function: fnA}}}
+		locB = &profile.Location{ID: 2, Line: []profile.Line{{Function: fnB}}}
+	)
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        10000000,
+		TimeNanos:     1000,
+		DurationNanos: 10,
+		Function:      []*profile.Function{fnA, fnB},
+		Location:      []*profile.Location{locA, locB},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{locB, locA}, Value: []int64{2, 20000000}},
+			{Location: []*profile.Location{locA}, Value: []int64{1, 0}},
+			{Location: []*profile.Location{locB, locA}, Value: []int64{3, 30000000}},
+		},
+	}
+
+	converted, err := ToPhlareProfiles(p, phlaremodel.LabelsFromStrings(
+		model.MetricNameLabel, "process_cpu",
+		"service_name", "foo",
+	))
+	require.NoError(t, err)
+	require.Len(t, converted, 2)
+
+	for i, expected := range []struct {
+		profileType string
+		sampleType  string
+		sampleUnit  string
+		values      []int64
+	}{
+		{"process_cpu:samples:count:cpu:nanoseconds", "samples", "count", []int64{5, 1}},
+		{"process_cpu:cpu:nanoseconds:cpu:nanoseconds", "cpu", "nanoseconds", []int64{50000000}},
+	} {
+		c := converted[i]
+		require.Equal(t, expected.profileType, c.Labels.Get(phlaremodel.LabelNameProfileType))
+		require.Equal(t, expected.sampleType, c.Labels.Get(phlaremodel.LabelNameType))
+		require.Equal(t, expected.sampleUnit, c.Labels.Get(phlaremodel.LabelNameUnit))
+		require.Equal(t, "cpu", c.Labels.Get(phlaremodel.LabelNamePeriodType))
+		require.Equal(t, "nanoseconds", c.Labels.Get(phlaremodel.LabelNamePeriodUnit))
+		require.Equal(t, "foo", c.Labels.Get("service_name"))
+		require.Equal(t, model.Fingerprint(c.Labels.Hash()), c.Profile.SeriesFingerprint)
+		require.Equal(t, int64(1000), c.Profile.TimeNanos)
+
+		values := make([]int64, len(c.Profile.Samples))
+		for j, s := range c.Profile.Samples {
+			values[j] = s.Value
+		}
+		require.Equal(t, expected.values, values)
+	}
+
+	// both profiles reference the same deduplicated stacktraces
+	require.Len(t, converted[0].Stacktraces, 2)
+	require.Equal(t, []uint64{2, 1}, converted[0].Stacktraces[converted[1].Profile.Samples[0].StacktraceID].LocationIDs)
+	require.NotEqual(t, converted[0].Labels.Hash(), converted[1].Labels.Hash())
+}
+
+func TestInferMetricName(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		sampleTypes []*profile.ValueType
+		expected    string
+		err         string
+	}{
+		{
+			name:        "cpu",
+			sampleTypes: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+			expected:    "process_cpu",
+		},
+		{
+			name:        "memory",
+			sampleTypes: []*profile.ValueType{{Type: "alloc_objects", Unit: "count"}, {Type: "inuse_space", Unit: "bytes"}},
+			expected:    "memory",
+		},
+		{
+			name:        "goroutine",
+			sampleTypes: []*profile.ValueType{{Type: "goroutine", Unit: "count"}},
+			expected:    "goroutine",
+		},
+		{
+			name:        "contentions are ambiguous",
+			sampleTypes: []*profile.ValueType{{Type: "contentions", Unit: "count"}, {Type: "delay", Unit: "nanoseconds"}},
+			err:         "unable to infer the profile type of sample types [contentions:count, delay:nanoseconds]: the sample types are shared by mutex and block profiles, the metric name is required",
+		},
+		{
+			name:        "unknown sample type",
+			sampleTypes: []*profile.ValueType{{Type: "wall", Unit: "nanoseconds"}},
+			expected:    "",
+		},
+		{
+			name:        "mixed profile types",
+			sampleTypes: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}, {Type: "alloc_space", Unit: "bytes"}},
+			err:         "unable to infer the profile type of sample types [cpu:nanoseconds, alloc_space:bytes]: the sample types belong to process_cpu and memory profiles",
+		},
+		{
+			name:     "no sample types",
+			expected: "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := FromProfile(&profile.Profile{SampleType: tc.sampleTypes})
+			require.NoError(t, err)
+
+			metricName, err := InferMetricName(p)
+			if tc.err != "" {
+				var inferenceErr *ProfileTypeInferenceError
+				require.ErrorAs(t, err, &inferenceErr)
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, metricName)
+		})
+	}
+}
@@ -86,6 +86,22 @@ func (m *ProfileBuilder) WithLabels(lv ...string) *ProfileBuilder {
 	return m
 }
 
+func (m *ProfileBuilder) WithComments(comments ...string) *ProfileBuilder {
+	for _, c := range comments {
+		m.Comment = append(m.Comment, m.addString(c))
+	}
+	return m
+}
+
+// WithSampleType adds a sample type, the samples added afterwards need a value for it.
+func (m *ProfileBuilder) WithSampleType(sampleType, unit string) *ProfileBuilder {
+	m.SampleType = append(m.SampleType, &profilev1.ValueType{
+		Type: m.addString(sampleType),
+		Unit: m.addString(unit),
+	})
+	return m
+}
+
 func (m *ProfileBuilder) Name() string {
 	for _, lbl := range m.Labels {
 		if lbl.Name == model.MetricNameLabel {
@@ -115,6 +131,64 @@ func (m *ProfileBuilder) CPUProfile() *ProfileBuilder {
 	return m
 }
 
+func (m *ProfileBuilder) GoroutineProfile() *ProfileBuilder {
+	m.Profile.SampleType = []*profilev1.ValueType{
+		{
+			Unit: m.addString("count"),
+			Type: m.addString("goroutine"),
+		},
+	}
+	m.Profile.DefaultSampleType = m.addString("goroutine")
+	m.Profile.PeriodType = &profilev1.ValueType{
+		Unit: m.addString("count"),
+		Type: m.addString("goroutine"),
+	}
+	m.Profile.Period = 1
+	m.Labels = append(m.Labels, &typesv1.LabelPair{
+		Name:  model.MetricNameLabel,
+		Value: "goroutine",
+	})
+
+	return m
+}
+
+// MutexProfile sets up a mutex profile, the values of Go's mutex profiles
+// are cumulative.
+func (m *ProfileBuilder) MutexProfile() *ProfileBuilder {
+	return m.contentionProfile("mutex")
+}
+
+// BlockProfile sets up a block profile, the values of Go's block profiles
+// are cumulative.
+func (m *ProfileBuilder) BlockProfile() *ProfileBuilder {
+	return m.contentionProfile("block")
+}
+
+func (m *ProfileBuilder) contentionProfile(name string) *ProfileBuilder {
+	m.Profile.SampleType = []*profilev1.ValueType{
+		{
+			Unit: m.addString("count"),
+			Type: m.addString("contentions"),
+		},
+		{
+			Unit: m.addString("nanoseconds"),
+			Type: m.addString("delay"),
+		},
+	}
+	m.Profile.DefaultSampleType = m.addString("delay")
+	m.Profile.PeriodType = &profilev1.ValueType{
+		Unit: m.addString("count"),
+		Type: m.addString("contentions"),
+	}
+	m.Profile.Period = 1
+	m.Labels = append(m.Labels, &typesv1.LabelPair{
+		Name:  model.MetricNameLabel,
+		Value: name,
+	})
+
+	return m
+}
+
 func (m *ProfileBuilder) ForStacktraceString(stacktraces ...string) *StacktraceBuilder {
 	namePositions := lo.Map(stacktraces, func(stacktrace string, i int) int64 {
 		return m.addString(stacktrace)
@@ -186,9 +260,21 @@ func (m *ProfileBuilder) ToModel() (*schemav1.Profile, []phlaremodel.Labels) {
 
 type StacktraceBuilder struct {
 	locationID []uint64
+	labels     []*profilev1.Label
 	*ProfileBuilder
 }
 
+// WithSampleLabels sets pprof labels on the samples added afterwards.
+func (s *StacktraceBuilder) WithSampleLabels(lv ...string) *StacktraceBuilder {
+	for i := 0; i < len(lv); i += 2 {
+		s.labels = append(s.labels, &profilev1.Label{
+			Key: s.addString(lv[i]),
+			Str: s.addString(lv[i+1]),
+		})
+	}
+	return s
+}
+
 func (s *StacktraceBuilder) AddSamples(samples ...int64) {
 	if exp, act := len(s.Profile.SampleType), len(samples); exp != act {
 		panic(fmt.Sprintf("profile expects %d sample(s), there was actually %d sample(s) given.", exp, act))
@@ -196,5 +282,6 @@ func (s *StacktraceBuilder) AddSamples(samples ...int64) {
 	s.Profile.Sample = append(s.Profile.Sample, &profilev1.Sample{
 		LocationId: s.locationID,
 		Value:      samples,
+		Label:      s.labels,
 	})
 }
@@ -260,7 +260,7 @@ func (q *Querier) SelectMergeStacktraces(ctx context.Context, req *connect.Reque
 	}
 
 	// merge all profiles
-	st, err := selectMergeStacktraces(gCtx, responses)
+	st, err := selectMergeStacktraces(gCtx, responses, req.Msg.MinValue, req.Msg.MinPercent)
 	if err != nil {
 		return nil, err
 	}
@@ -308,7 +308,8 @@ type stacktraces struct {
 }
 
 // selectMergeStacktraces selects the  profile from each ingester by deduping them and request merges of stacktraces of them.
-func selectMergeStacktraces(ctx context.Context, responses []responseFromIngesters[clientpool.BidiClientMergeProfilesStacktraces]) ([]stacktraces, error) {
+// The merged stacktraces are pruned like phlaremodel.PruneStacktraces.
+func selectMergeStacktraces(ctx context.Context, responses []responseFromIngesters[clientpool.BidiClientMergeProfilesStacktraces], minValue int64, minPercent float64) ([]stacktraces, error) {
 	mergeResults := make([]MergeResult[*ingestv1.MergeProfilesStacktracesResult], len(responses))
 	iters := make([]MergeIterator, len(responses))
 	for i, resp := range responses {
@@ -345,7 +346,7 @@ func selectMergeStacktraces(ctx context.Context, responses []responseFromIngeste
 	if err := g.Wait(); err != nil {
 		return nil, err
 	}
-	return mergeProfilesStacktracesResult(results), nil
+	return mergeProfilesStacktracesResult(results, minValue, minPercent), nil
 }
 
 // selectMergePprofProfile selects the  profile from each ingester by deduping them and request merges of stacktraces in the pprof format.
@@ -404,8 +405,10 @@ func selectMergePprofProfile(ctx context.Context, ty *typesv1.ProfileType, respo
 }
 
 // mergeProfilesStacktracesResult merges the results of multiple MergeProfilesStacktraces into a single result.
-func mergeProfilesStacktracesResult(results []*ingestv1.MergeProfilesStacktracesResult) []stacktraces {
+// The nodes are pruned once merged, as only the merged result has the total values of the nodes.
+func mergeProfilesStacktracesResult(results []*ingestv1.MergeProfilesStacktracesResult, minValue int64, minPercent float64) []stacktraces {
 	merge := phlaremodel.MergeBatchMergeStacktraces(results...)
+	phlaremodel.PruneStacktraces(merge, minValue, minPercent)
 	result := make([]stacktraces, 0, len(merge.Stacktraces))
 	for _, st := range merge.Stacktraces {
 		locs := make([]string, len(st.FunctionIds))
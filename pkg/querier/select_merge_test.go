@@ -3,6 +3,7 @@ package querier
 import (
 	"context"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -74,7 +75,7 @@ func TestSelectMergeStacktraces(t *testing.T) {
 		{
 			response: resp3,
 		},
-	})
+	}, 0, 0)
 	require.NoError(t, err)
 	require.Len(t, res, 1)
 	all := []testProfile{}
@@ -110,11 +111,42 @@ func TestSelectMergeStacktraces(t *testing.T) {
 				},
 			}),
 		},
-	})
+	}, 0, 0)
 	require.NoError(t, err)
 	require.Len(t, res, 1)
 }
 
+// TestMergeProfilesStacktracesResultPruning ensures that nodes are pruned
+// against the totals of all ingesters, not the ones of a single ingester.
+func TestMergeProfilesStacktracesResultPruning(t *testing.T) {
+	res := mergeProfilesStacktracesResult([]*ingestv1.MergeProfilesStacktracesResult{
+		{
+			FunctionNames: []string{"main", "work", "rare"},
+			// function ids are ordered from leaf to root
+			Stacktraces: []*ingestv1.StacktraceSample{
+				{FunctionIds: []int32{1, 0}, Value: 1000},
+				// below 1 percent of this ingester
+				{FunctionIds: []int32{2, 0}, Value: 5},
+			},
+		},
+		{
+			FunctionNames: []string{"rare", "main"},
+			Stacktraces: []*ingestv1.StacktraceSample{
+				{FunctionIds: []int32{0, 1}, Value: 20},
+			},
+		},
+	}, 0, 1)
+
+	values := make(map[string]int64)
+	for _, st := range res {
+		values[strings.Join(st.locations, ";")] += st.value
+	}
+	require.Equal(t, map[string]int64{
+		"work;main": 1000,
+		"rare;main": 25,
+	}, values)
+}
+
 func TestSelectMergeByLabels(t *testing.T) {
 	resp1 := newFakeBidiClientSeries([]*ingestv1.ProfileSets{
 		{
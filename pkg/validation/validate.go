@@ -39,6 +39,9 @@ const (
 	// SeriesLimit is a reason for discarding lines when we can't create a new stream
 	// because the limit of active streams has been reached.
 	SeriesLimit Reason = "series_limit"
+	// FingerprintCollision is a reason for discarding profiles of a series whose
+	// fingerprint collides with the one of another series.
+	FingerprintCollision Reason = "fingerprint_collision"
 
 	SeriesLimitErrorMsg            = "Maximum active series limit exceeded (%d/%d), reduce the number of active streams (reduce labels or reduce label values), or contact your administrator to see if the limit can be increased"
 	MissingLabelsErrorMsg          = "error at least one label pair is required per profile"